@@ -11,6 +11,7 @@ package api
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/url"
 
 	"maunium.net/go/mautrix/id"
@@ -54,6 +55,24 @@ type ConfigureServiceRequest struct {
 	Config json.RawMessage
 }
 
+// CloneServiceRequest is a request to /admin/cloneService
+type CloneServiceRequest struct {
+	// The ID of the service to copy.
+	ID string
+	// The ID of the new service. This must not already exist.
+	NewID string
+	// Optional. The user ID of the configured client the new service will use. Defaults to the
+	// copied service's user ID.
+	UserID id.UserID
+	// Room IDs in the copied service's config to replace, and what to replace them with. Room IDs
+	// are replaced wherever they appear as a whole value or map key, so this can also replace
+	// aliases and labels such as "label:backend-teams".
+	Rooms map[id.RoomID]id.RoomID
+	// Optional. Top-level config keys which replace those in the copied service's config, after
+	// room IDs have been replaced, e.g. to give the new service its own secret token.
+	Config json.RawMessage
+}
+
 // A ClientConfig contains the configuration information for a matrix client so that
 // Go-NEB can drive it. It forms the HTTP body to /configureClient requests.
 type ClientConfig struct {
@@ -61,7 +80,8 @@ type ClientConfig struct {
 	UserID id.UserID
 	// A URL with the host and port of the matrix server. E.g. https://matrix.org:8448
 	HomeserverURL string
-	// The matrix access token to authenticate the requests with.
+	// The matrix access token to authenticate the requests with. This may instead be a reference to
+	// a secret store, e.g. "vault:secret/data/go-neb#bot_access_token".
 	AccessToken string
 	// The device ID for this access token.
 	DeviceID id.DeviceID
@@ -78,10 +98,175 @@ type ClientConfig struct {
 	// The desired display name for this client.
 	// This does not automatically set the display name for this client. See /configureClient.
 	DisplayName string
+	// The desired avatar for this client: an mxc:// URI, or an http(s):// URL or local file path
+	// whose image is uploaded to the homeserver's media repository. It is set when the client is
+	// configured and when it starts, if it differs. Images are only uploaded again if they change.
+	AvatarURL string
 	// A list of regexes that control which users are allowed to start a SAS verification with this client.
 	// When a user starts a new SAS verification with us, their user ID has to match one of these regexes
 	// for the verification process to start.
 	AcceptVerificationFromUsers []string
+	// True to stop this client from sending into Matrix, e.g. during homeserver maintenance. It
+	// keeps syncing and its services keep receiving webhooks, but the messages they send are
+	// queued until it stops being read-only, and commands are ignored. See /admin/readOnly.
+	ReadOnly bool
+	// Which devices this client shares the keys for its encrypted messages with. By default, keys
+	// are shared with every device of every member of the room.
+	EncryptionPolicy EncryptionPolicy
+	// Limits on how often commands can be run, so that one user can't use up the quotas of the
+	// APIs which services call. By default there are no limits.
+	RateLimit RateLimit
+	// The fewest minutes between the "@room" mentions this client sends into each room, for
+	// services which ask to mention everyone, e.g. about critical alerts. Defaults to
+	// DefaultRoomMentionCooldown. A negative number stops the client mentioning rooms.
+	RoomMentionCooldown int
+	// How many minutes after sending a command users can edit it, e.g. to fix a typo, to have
+	// the corrected command run. The client's responses to the original command are edited to
+	// show the new ones. Only commands which failed or weren't recognised are run again, so that
+	// edits don't repeat what a command did. By default edits are ignored.
+	CommandEditWindow int
+	// How many of the most recent events in each room services process when the client's device
+	// first syncs, e.g. to answer commands sent while Go-NEB was being set up. By default none
+	// are: the first sync only fetches the state of each room and skips its history. At most
+	// MaxInitialSyncBackfill.
+	InitialSyncBackfill int
+	// What to do about commands which were sent while the client wasn't syncing, e.g. because
+	// Go-NEB was down, and which the homeserver left out of the client's next sync because too
+	// much had happened in the room. They are fetched from the room's history, up to
+	// MaxCatchUpEvents. CatchUpNotify tells the room which commands weren't run, so they can be
+	// sent again. CatchUpRun runs the commands which are safe to run late (see
+	// types.Command.Idempotent), and tells the room about the rest. By default they are ignored.
+	// Commands which were in the sync are run either way.
+	CatchUp string
+	// Optional. The rooms to catch up in. Defaults to every room.
+	CatchUpRooms []id.RoomID
+	// How many seconds after a service sends a notification into a room that notifications about
+	// the same thing, e.g. the same commit, are combined with it rather than sent separately. Only
+	// notifications which services give a correlation ID are combined, see
+	// matrix.CorrelatedMessage. By default notifications aren't combined.
+	NotificationDedupeWindow int
+	// How this client connects to its homeserver, e.g. through a proxy or trusting a private CA.
+	// Clients with these settings get their own HTTP client, so clients on different homeservers
+	// can connect differently. By default clients share Go-NEB's HTTP client.
+	HTTP HTTPConfig
+}
+
+// An HTTPConfig controls how a client connects to its homeserver.
+//
+// Example:
+//   {
+//       "Proxy": "http://proxy.internal:3128",
+//       "CAFile": "/etc/go-neb/lab-ca.pem"
+//   }
+type HTTPConfig struct {
+	// The URL of the HTTP, HTTPS or SOCKS5 proxy to connect through. By default the proxy is taken
+	// from the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.
+	Proxy string
+	// The path of a PEM file of CA certificates to trust as well as the system's, e.g. for a
+	// homeserver whose certificate is signed by a private CA.
+	CAFile string
+	// True to accept any certificate from the homeserver. This is only for test labs, as it lets
+	// anyone intercept the client's connections.
+	InsecureSkipVerify bool
+}
+
+// IsZero returns true if the client connects with Go-NEB's HTTP client.
+func (c *HTTPConfig) IsZero() bool {
+	return c.Proxy == "" && c.CAFile == "" && !c.InsecureSkipVerify
+}
+
+// DefaultRoomMentionCooldown is the default RoomMentionCooldown in minutes.
+const DefaultRoomMentionCooldown = 60
+
+// MaxInitialSyncBackfill is the most events per room a client can process on its first sync.
+const MaxInitialSyncBackfill = 100
+
+// The ways in which a client can catch up on the commands it missed, see ClientConfig.CatchUp.
+const (
+	// CatchUpNotify tells the room which commands were missed.
+	CatchUpNotify = "notify"
+	// CatchUpRun runs the missed commands which are safe to run late, and tells the room about
+	// the rest.
+	CatchUpRun = "run"
+)
+
+// MaxCatchUpEvents is the most events per room a client fetches when catching up.
+const MaxCatchUpEvents = 500
+
+// A RateLimit limits how many commands are run per minute. Short bursts of up to the limit are
+// allowed, after which commands are refused until enough time has passed. Messages which start
+// with "!" count as commands. Zero means no limit.
+//
+// Example:
+//   {
+//       "PerUser": 10,
+//       "PerRoom": 30
+//   }
+type RateLimit struct {
+	// How many commands each user can run per minute, across every room.
+	PerUser int
+	// How many commands can be run per minute in each room.
+	PerRoom int
+}
+
+// An EncryptionPolicy controls which devices a client shares room keys with, and so which devices
+// can read the messages it sends into encrypted rooms. Devices which aren't allowed to read a
+// message are sent an m.room_key.withheld event instead.
+//
+// Example:
+//   {
+//       "VerifiedOnly": false,
+//       "VerifiedOnlyRooms": ["!ops:localhost"],
+//       "BlacklistedDevices": {
+//           "@alice:localhost": ["LOSTPHONE"],
+//           "@mallory:localhost": []
+//       }
+//   }
+type EncryptionPolicy struct {
+	// True to only share keys with devices which have been verified, e.g. with /verifySAS, or
+	// which are cross-signed by a verified user.
+	VerifiedOnly bool
+	// Rooms in which keys are only shared with verified devices, as if VerifiedOnly was true.
+	VerifiedOnlyRooms []id.RoomID
+	// A map of user ID to devices which are never sent keys, e.g. because they have been lost or
+	// compromised. An empty list blacklists every device of that user. Removing a device from this
+	// list makes it unverified again, even if it was verified before.
+	BlacklistedDevices map[id.UserID][]id.DeviceID
+}
+
+// IsZero returns true if the policy is the default of sharing keys with every device.
+func (p *EncryptionPolicy) IsZero() bool {
+	return !p.VerifiedOnly && len(p.VerifiedOnlyRooms) == 0 && len(p.BlacklistedDevices) == 0
+}
+
+// VerifiedOnlyIn returns true if keys for the room must only be shared with verified devices.
+func (p *EncryptionPolicy) VerifiedOnlyIn(roomID id.RoomID) bool {
+	if p.VerifiedOnly {
+		return true
+	}
+	for _, r := range p.VerifiedOnlyRooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBlacklisted returns true if the device must never be sent keys.
+func (p *EncryptionPolicy) IsBlacklisted(userID id.UserID, deviceID id.DeviceID) bool {
+	deviceIDs, ok := p.BlacklistedDevices[userID]
+	if !ok {
+		return false
+	}
+	if len(deviceIDs) == 0 {
+		return true
+	}
+	for _, d := range deviceIDs {
+		if d == deviceID {
+			return true
+		}
+	}
+	return false
 }
 
 // A IncomingDecimalSAS contains the decimal SAS as displayed on another device. The SAS consists of three numbers.
@@ -113,6 +298,19 @@ type ConfigFile struct {
 	Sessions []Session
 }
 
+// ConfigChanges describes what reloading the config file changed. Realms and sessions are stored
+// again on every reload, so aren't listed.
+type ConfigChanges struct {
+	AddedClients    []id.UserID
+	ChangedClients  []id.UserID
+	RemovedClients  []id.UserID
+	AddedServices   []string
+	ChangedServices []string
+	RemovedServices []string
+	// Why clients or services couldn't be changed. Empty if every change was applied.
+	Errors []string `json:",omitempty"`
+}
+
 // Check validates the /configureService request
 func (c *ConfigureServiceRequest) Check() error {
 	if c.ID == "" || c.Type == "" || c.UserID == "" || c.Config == nil {
@@ -121,6 +319,17 @@ func (c *ConfigureServiceRequest) Check() error {
 	return nil
 }
 
+// Check validates the /admin/cloneService request
+func (c *CloneServiceRequest) Check() error {
+	if c.ID == "" || c.NewID == "" || len(c.Rooms) == 0 {
+		return errors.New(`Must supply an "ID", a "NewID" and "Rooms"`)
+	}
+	if c.ID == c.NewID {
+		return errors.New(`"NewID" must be different to "ID"`)
+	}
+	return nil
+}
+
 // Check validates the /configureAuthRealm request
 func (c *ConfigureAuthRealmRequest) Check() error {
 	if c.ID == "" || c.Type == "" || c.Config == nil {
@@ -145,6 +354,21 @@ func (c *ClientConfig) Check() error {
 	if _, err := url.Parse(c.HomeserverURL); err != nil {
 		return err
 	}
+	if c.RateLimit.PerUser < 0 || c.RateLimit.PerRoom < 0 {
+		return errors.New(`"RateLimit" limits must not be negative`)
+	}
+	if c.CommandEditWindow < 0 {
+		return errors.New(`"CommandEditWindow" must not be negative`)
+	}
+	if c.InitialSyncBackfill < 0 || c.InitialSyncBackfill > MaxInitialSyncBackfill {
+		return fmt.Errorf(`"InitialSyncBackfill" must be between 0 and %d`, MaxInitialSyncBackfill)
+	}
+	if c.NotificationDedupeWindow < 0 {
+		return errors.New(`"NotificationDedupeWindow" must not be negative`)
+	}
+	if c.CatchUp != "" && c.CatchUp != CatchUpNotify && c.CatchUp != CatchUpRun {
+		return fmt.Errorf(`"CatchUp" must be %q or %q`, CatchUpNotify, CatchUpRun)
+	}
 	return nil
 }
 
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestEncryptionPolicy(t *testing.T) {
+	var p EncryptionPolicy
+	if !p.IsZero() || p.VerifiedOnlyIn("!room:localhost") || p.IsBlacklisted("@alice:localhost", "PHONE") {
+		t.Fatal("Zero EncryptionPolicy restricts sharing, want keys shared with every device")
+	}
+
+	p = EncryptionPolicy{
+		VerifiedOnlyRooms: []id.RoomID{"!ops:localhost"},
+		BlacklistedDevices: map[id.UserID][]id.DeviceID{
+			"@alice:localhost":   {"LOSTPHONE"},
+			"@mallory:localhost": {},
+		},
+	}
+	if p.IsZero() {
+		t.Error("IsZero => true, want false")
+	}
+	if !p.VerifiedOnlyIn("!ops:localhost") || p.VerifiedOnlyIn("!chat:localhost") {
+		t.Error("VerifiedOnlyIn doesn't match VerifiedOnlyRooms")
+	}
+	for _, tc := range []struct {
+		userID   id.UserID
+		deviceID id.DeviceID
+		want     bool
+	}{
+		{"@alice:localhost", "LOSTPHONE", true},
+		{"@alice:localhost", "LAPTOP", false},
+		{"@mallory:localhost", "ANYTHING", true},
+		{"@bob:localhost", "LOSTPHONE", false},
+	} {
+		if got := p.IsBlacklisted(tc.userID, tc.deviceID); got != tc.want {
+			t.Errorf("IsBlacklisted(%s, %s) => %v, want %v", tc.userID, tc.deviceID, got, tc.want)
+		}
+	}
+
+	p.VerifiedOnly = true
+	if !p.VerifiedOnlyIn("!chat:localhost") {
+		t.Error("VerifiedOnlyIn => false with VerifiedOnly set, want true")
+	}
+}
+
+func TestClientConfigCheck(t *testing.T) {
+	for _, tc := range []struct {
+		config ClientConfig
+		ok     bool
+	}{
+		{ClientConfig{UserID: "@neb:localhost", HomeserverURL: "http://localhost", AccessToken: "token"}, true},
+		{ClientConfig{UserID: "@neb:localhost", HomeserverURL: "http://localhost"}, false},
+		{ClientConfig{UserID: "@neb:localhost", HomeserverURL: "http://localhost", AccessToken: "token", InitialSyncBackfill: 20}, true},
+		{ClientConfig{UserID: "@neb:localhost", HomeserverURL: "http://localhost", AccessToken: "token", InitialSyncBackfill: 1000}, false},
+		{ClientConfig{UserID: "@neb:localhost", HomeserverURL: "http://localhost", AccessToken: "token", RateLimit: RateLimit{PerUser: -1}}, false},
+		{ClientConfig{UserID: "@neb:localhost", HomeserverURL: "http://localhost", AccessToken: "token", CatchUp: CatchUpRun}, true},
+		{ClientConfig{UserID: "@neb:localhost", HomeserverURL: "http://localhost", AccessToken: "token", CatchUp: "everything"}, false},
+	} {
+		if err := tc.config.Check(); (err == nil) != tc.ok {
+			t.Errorf("Check(%+v) => %v, want ok=%v", tc.config, err, tc.ok)
+		}
+	}
+}
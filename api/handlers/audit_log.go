@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/util"
+	"maunium.net/go/mautrix/id"
+)
+
+// defaultAuditLimit is how many audit log entries are returned if no limit is given.
+const defaultAuditLimit = 100
+
+// AuditLog represents an HTTP handler which can process /admin/auditLog requests.
+type AuditLog struct {
+	DB *database.ServiceDB
+}
+
+// OnIncomingRequest handles GET requests to /admin/auditLog.
+//
+// Returns the commands users ran and the notifications services sent in response to webhooks,
+// newest first. Entries can be filtered by "user_id", "room_id" and "service_id", and by time
+// with "since" and "until", which are RFC 3339 timestamps. "limit" defaults to 100, and 0
+// returns every matching entry. Entries are kept for clients.AuditRetention, see the
+// AUDIT_RETENTION environment variable.
+//
+// Request:
+//  GET /admin/auditLog?room_id=!qmElAGdFYCHoCJuaNt:localhost&since=2021-06-01T00:00:00Z&limit=2
+// Response:
+//  HTTP/1.1 200 OK
+//  [
+//      {
+//          "Kind": "command",
+//          "UserID": "@alice:localhost",
+//          "RoomID": "!qmElAGdFYCHoCJuaNt:localhost",
+//          "ServiceID": "githubcommands",
+//          "ServiceType": "github",
+//          "Command": "github create",
+//          "Outcome": "success",
+//          "Detail": "",
+//          "Timestamp": "2021-06-02T09:30:12.345Z"
+//      },
+//      {
+//          "Kind": "webhook_send",
+//          "UserID": "@my_bot:localhost",
+//          "RoomID": "!qmElAGdFYCHoCJuaNt:localhost",
+//          "ServiceID": "githubwebhooks",
+//          "ServiceType": "github-webhook",
+//          "Command": "",
+//          "Outcome": "failure",
+//          "Detail": "M_FORBIDDEN: You are not in this room",
+//          "Timestamp": "2021-06-02T09:12:01.002Z"
+//      }
+//  ]
+func (h *AuditLog) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "GET" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	params := req.URL.Query()
+	q := database.AuditQuery{
+		UserID:    id.UserID(params.Get("user_id")),
+		RoomID:    id.RoomID(params.Get("room_id")),
+		ServiceID: params.Get("service_id"),
+		Limit:     defaultAuditLimit,
+	}
+	var err error
+	if since := params.Get("since"); since != "" {
+		if q.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return util.MessageResponse(400, `"since" must be an RFC 3339 timestamp`)
+		}
+	}
+	if until := params.Get("until"); until != "" {
+		if q.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return util.MessageResponse(400, `"until" must be an RFC 3339 timestamp`)
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 0 {
+			return util.MessageResponse(400, `"limit" must be a number`)
+		}
+	}
+
+	entries, err := h.DB.LoadAuditEntries(q)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadAuditEntries")
+		return util.MessageResponse(500, "Failed to load the audit log")
+	}
+	if entries == nil {
+		entries = []database.AuditEntry{}
+	}
+	return util.JSONResponse{Code: 200, JSON: entries}
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/util"
+)
+
+// Cleanup represents an HTTP handler which can process /admin/cleanup requests.
+type Cleanup struct {
+	Clients *clients.Clients
+}
+
+// OnIncomingRequest handles POST requests to /admin/cleanup.
+//
+// Makes clients leave and forget the rooms they are in which no service sends into, e.g. old
+// alert rooms, so that they stop adding to every sync. Rooms with bot options and direct chats are
+// kept. Clients running services which answer commands in any room are skipped. If "DryRun" is
+// true, the rooms which would be left are returned but not left. This also happens periodically
+// if the CLEANUP_INTERVAL environment variable is set.
+//
+// Request:
+//  POST /admin/cleanup
+//  {
+//      "DryRun": true
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "LeftRooms": [
+//          {
+//              "UserID": "@my_bot:localhost",
+//              "RoomID": "!qmElAGdFYCHoCJuaNt:localhost"
+//          }
+//      ],
+//      "SkippedClients": ["@my_command_bot:localhost"]
+//  }
+func (h *Cleanup) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		DryRun bool
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	report, err := h.Clients.LeaveUnusedRooms(body.DryRun)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to leave unused rooms")
+		return util.MessageResponse(500, "Failed to leave unused rooms")
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: report,
+	}
+}
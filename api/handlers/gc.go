@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/util"
+)
+
+// GarbageCollect represents an HTTP handler which can process /admin/gc requests.
+type GarbageCollect struct {
+	Clients *clients.Clients
+}
+
+// OnIncomingRequest handles POST requests to /admin/gc.
+//
+// Removes auth sessions for realms which no longer exist, logged notifications older than
+// clients.NotificationRetention, audit log entries older than clients.AuditRetention, and bot
+// options for rooms which the bot has left or whose client no longer exists. This also happens periodically, see the GC_INTERVAL
+// environment variable. Returns what was removed.
+//
+// Request:
+//  POST /admin/gc
+//  {}
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "AuthSessions": 2,
+//      "SentNotifications": 130,
+//      "AuditEntries": 52,
+//      "BotOptions": [
+//          {
+//              "UserID": "@my_bot:localhost",
+//              "RoomID": "!qmElAGdFYCHoCJuaNt:localhost"
+//          }
+//      ]
+//  }
+func (h *GarbageCollect) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	report, err := h.Clients.CollectGarbage()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to collect garbage")
+		return util.MessageResponse(500, "Failed to collect garbage")
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: report,
+	}
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/util"
+)
+
+// PollingStatus represents an HTTP handler which can process /admin/polling requests.
+type PollingStatus struct{}
+
+// OnIncomingRequest handles GET requests to /admin/polling.
+//
+// Returns the poll health of every polled service, ordered by service ID. Times are
+// RFC 3339 timestamps; a zero time ("0001-01-01T00:00:00Z") means "never" for LastPollTime
+// and "not scheduled" for NextPollTime. BackingOff is true if the next poll has been delayed
+// because the service's polls keep failing.
+//
+// Request:
+//  GET /admin/polling
+//
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Services": [
+//          {
+//              "ServiceID": "my_rss_service",
+//              "ServiceType": "rssbot",
+//              "LastPollTime": "2016-11-29T12:00:00Z",
+//              "NextPollTime": "2016-11-29T12:05:00Z",
+//              "LastError": "http://example.com/feed: 503 Service Unavailable",
+//              "ConsecutiveFailures": 3,
+//              "BackingOff": true
+//          }
+//      ]
+//  }
+func (*PollingStatus) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "GET" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Services []polling.ServiceStatus
+		}{polling.Status()},
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/util"
+	"maunium.net/go/mautrix/id"
+)
+
+// ReadOnly represents an HTTP handler which can process /admin/readOnly requests.
+type ReadOnly struct {
+	Clients *clients.Clients
+}
+
+// OnIncomingRequest handles GET and POST requests to /admin/readOnly.
+//
+// Read-only clients keep syncing and their services keep receiving webhooks and polling, but
+// messages they send are queued until they stop being read-only, and commands are ignored. This
+// is useful during homeserver maintenance or migrations.
+//
+// GET returns whether every client is read-only, and which clients are read-only individually.
+//
+// Request:
+//  GET /admin/readOnly
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ReadOnly": false,
+//      "Clients": ["@my_bot:localhost"]
+//  }
+//
+// POST makes a client read-only or not. If "UserID" is omitted, this applies to every client, but
+// doesn't change the setting of clients which are read-only individually. A client's setting is
+// stored in its config, so it persists across restarts; the setting for every client does not,
+// but can be given on start-up with the READ_ONLY environment variable.
+//
+// Request:
+//  POST /admin/readOnly
+//  {
+//      "UserID": "@my_bot:localhost",
+//      "ReadOnly": true
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {}
+func (h *ReadOnly) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	switch req.Method {
+	case "GET":
+		global, userIDs := h.Clients.ReadOnly()
+		return util.JSONResponse{
+			Code: 200,
+			JSON: struct {
+				ReadOnly bool
+				Clients  []id.UserID
+			}{global, userIDs},
+		}
+	case "POST":
+		var body struct {
+			UserID   id.UserID
+			ReadOnly *bool
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return util.MessageResponse(400, "Error parsing request JSON")
+		}
+		if body.ReadOnly == nil {
+			return util.MessageResponse(400, `Must supply "ReadOnly"`)
+		}
+		if err := h.Clients.SetReadOnly(body.UserID, *body.ReadOnly); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to set read-only mode")
+			return util.MessageResponse(500, "Failed to set read-only mode: "+err.Error())
+		}
+		return util.JSONResponse{Code: 200, JSON: struct{}{}}
+	}
+	return util.MessageResponse(405, "Unsupported Method")
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/util"
+)
+
+// ReloadConfig represents an HTTP handler which can process /admin/reload requests.
+type ReloadConfig struct {
+	Reload func() (*api.ConfigChanges, error)
+}
+
+// OnIncomingRequest handles POST requests to /admin/reload. It is only available when Go-NEB is
+// run with a config file.
+//
+// Re-reads the config file and applies the clients and services which were added, changed or
+// removed since it was last read, without restarting. Sending Go-NEB SIGHUP does the same. Clients
+// which haven't changed keep syncing, and services which haven't changed aren't registered again.
+// If the config file can't be read or is invalid, nothing is changed and the response is a 400.
+// If some changes couldn't be applied, the rest are, and the response is a 500 listing why.
+//
+// Request:
+//  POST /admin/reload
+//  {}
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "AddedClients": null,
+//      "ChangedClients": ["@my_bot:localhost"],
+//      "RemovedClients": null,
+//      "AddedServices": ["team_b_alerts"],
+//      "ChangedServices": null,
+//      "RemovedServices": ["old_rss"]
+//  }
+func (h *ReloadConfig) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	changes, err := h.Reload()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to reload config file")
+		return util.MessageResponse(400, "Failed to reload config file: "+err.Error())
+	}
+	code := 200
+	if len(changes.Errors) > 0 {
+		code = 500
+	}
+	return util.JSONResponse{
+		Code: code,
+		JSON: changes,
+	}
+}
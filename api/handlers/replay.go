@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplayFixture represents an HTTP handler which can process /admin/replayFixture requests.
+type ReplayFixture struct {
+	DB      *database.ServiceDB
+	Clients *clients.Clients
+}
+
+// OnIncomingRequest handles POST requests to /admin/replayFixture/{serviceID}.
+//
+// The request describes a recorded webhook request, which is passed to the service as if it had
+// just been received. This is useful for checking changes to a service's templates or rooms
+// against real payloads. "Method" defaults to "POST". "Body" is sent as is, unless it is a JSON
+// string, in which case the string is sent, e.g. for form encoded payloads. Headers such as
+// signatures must be included if the service checks them.
+//
+// If "DryRun" is true, nothing is sent into Matrix. Instead, the response lists what would have
+// been sent. Services still update their own state as they normally would, e.g. which alerts are
+// firing, and disabled services can be replayed.
+//
+// Request:
+//  POST /admin/replayFixture/my_alertmanager_service
+//  {
+//      "Method": "POST",
+//      "Query": "secret=abc",
+//      "Headers": {"Content-Type": ["application/json"]},
+//      "Body": {"status": "firing", "alerts": []},
+//      "DryRun": true
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Code": 200,
+//      "Response": "",
+//      "Actions": [
+//          {
+//              "Action": "send",
+//              "RoomID": "!qmElAGdFYCHoCJuaNt:localhost",
+//              "Type": "m.room.message",
+//              "Content": {"msgtype": "m.text", "body": "..."}
+//          }
+//      ]
+//  }
+//
+// "Code" and "Response" are the status code and body the service responded with.
+func (h *ReplayFixture) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	srvID := strings.TrimPrefix(req.URL.Path, "/admin/replayFixture/")
+	if srvID == "" || srvID == req.URL.Path {
+		return util.MessageResponse(400, "Missing service ID")
+	}
+	var body struct {
+		Method  string
+		Query   string
+		Headers http.Header
+		Body    json.RawMessage
+		DryRun  bool
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if body.Method == "" {
+		body.Method = "POST"
+	}
+	payload := []byte(body.Body)
+	var s string
+	if err := json.Unmarshal(body.Body, &s); err == nil {
+		payload = []byte(s)
+	}
+
+	service, err := h.DB.LoadService(srvID)
+	if err != nil {
+		return util.MessageResponse(404, "Unknown service: "+srvID)
+	}
+	botClient, err := h.Clients.Client(service.ServiceUserID())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("user_id", service.ServiceUserID()).Error(
+			"Failed to retrieve matrix client instance")
+		return util.MessageResponse(500, "Failed to retrieve matrix client instance")
+	}
+	var cli types.MatrixClient = botClient
+	var dryRun *clients.DryRunClient
+	if body.DryRun {
+		dryRun = clients.NewDryRunClient(botClient)
+		cli = dryRun
+	}
+
+	hookURL := "/services/hooks/replay"
+	if body.Query != "" {
+		hookURL += "?" + body.Query
+	}
+	hookReq, err := http.NewRequest(body.Method, hookURL, bytes.NewReader(payload))
+	if err != nil {
+		return util.MessageResponse(400, "Bad request: "+err.Error())
+	}
+	for k, v := range body.Headers {
+		hookReq.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	hookReq = hookReq.WithContext(req.Context())
+
+	log.WithFields(log.Fields{
+		"service_id":   service.ServiceID(),
+		"service_type": service.ServiceType(),
+		"dry_run":      body.DryRun,
+	}).Print("Replaying webhook for service")
+	w := httptest.NewRecorder()
+	service.OnReceiveWebhook(w, hookReq, cli)
+
+	res := struct {
+		Code     int
+		Response string
+		Actions  []clients.DryRunAction `json:",omitempty"`
+	}{Code: w.Code, Response: w.Body.String()}
+	if dryRun != nil {
+		res.Actions = dryRun.Actions()
+	}
+	return util.JSONResponse{Code: 200, JSON: res}
+}
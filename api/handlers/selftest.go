@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/selftest"
+	"github.com/matrix-org/util"
+)
+
+// SelfTest represents an HTTP handler which can process /admin/selftest requests.
+type SelfTest struct {
+	DB      *database.ServiceDB
+	Clients *clients.Clients
+	// The public-facing base URL of Go-NEB, which the webhook probe is sent to.
+	BaseURL string
+}
+
+// OnIncomingRequest handles GET requests to /admin/selftest.
+//
+// Checks that the database can be reached and its schema is up to date, that each client's
+// homeserver can be reached and accepts its access token, that each client's crypto store can be
+// loaded, and that each realm can reach the APIs it uses. With "?webhooks=true", also checks that
+// a webhook request sent to BASE_URL reaches Go-NEB, which catches misconfigured proxies.
+//
+// Responds with 200 if every check passed and 503 otherwise, so deploy pipelines can use the
+// status code alone. The "go-neb selftest" command runs the same checks without a running Go-NEB.
+//
+// Request:
+//  GET /admin/selftest?webhooks=true
+// Response:
+//  HTTP/1.1 503 Service Unavailable
+//  {
+//      "OK": false,
+//      "DurationMs": 412,
+//      "Checks": [
+//          { "Name": "database", "OK": true },
+//          { "Name": "homeserver", "Target": "@my_bot:localhost", "OK": true },
+//          { "Name": "crypto_store", "Target": "@my_bot:localhost", "OK": true },
+//          { "Name": "realm", "Target": "github_realm", "OK": true },
+//          {
+//              "Name": "webhooks",
+//              "OK": false,
+//              "Error": "Post \"https://neb.example.com/services/hooks/-\": dial tcp: connection refused"
+//          }
+//      ]
+//  }
+func (h *SelfTest) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "GET" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	opts := selftest.Options{
+		DB:      h.DB,
+		Clients: h.Clients,
+	}
+	if req.URL.Query().Get("webhooks") == "true" {
+		if h.BaseURL == "" {
+			return util.MessageResponse(400, "BASE_URL isn't set, so webhooks can't be checked")
+		}
+		opts.WebhookBaseURL = h.BaseURL
+	}
+	report := selftest.Run(opts)
+	code := 200
+	if !report.OK {
+		code = 503
+	}
+	return util.JSONResponse{
+		Code: code,
+		JSON: report,
+	}
+}
@@ -3,51 +3,18 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
 	"net/http"
-	"sync"
 
 	"github.com/matrix-org/go-neb/api"
-	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
-	"github.com/matrix-org/go-neb/matrix"
-	"github.com/matrix-org/go-neb/metrics"
-	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/provision"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 )
 
 // ConfigureService represents an HTTP handler which can process /admin/configureService requests.
-type ConfigureService struct {
-	db               *database.ServiceDB
-	clients          *clients.Clients
-	mapMutex         sync.Mutex
-	mutexByServiceID map[string]*sync.Mutex
-}
-
-// NewConfigureService creates a new ConfigureService handler
-func NewConfigureService(db *database.ServiceDB, clients *clients.Clients) *ConfigureService {
-	return &ConfigureService{
-		db:               db,
-		clients:          clients,
-		mutexByServiceID: make(map[string]*sync.Mutex),
-	}
-}
-
-func (s *ConfigureService) getMutexForServiceID(serviceID string) *sync.Mutex {
-	s.mapMutex.Lock()
-	defer s.mapMutex.Unlock()
-	m := s.mutexByServiceID[serviceID]
-	if m == nil {
-		// XXX TODO: There's a memory leak here. The amount of mutexes created is unbounded, as there will be 1 per service which are never deleted.
-		// A better solution would be to have a striped hash map with a bounded pool of mutexes. We can't live with a single global mutex because the Register()
-		// function this is protecting does many many HTTP requests which can take a long time on bad networks and will head of line block other services.
-		m = &sync.Mutex{}
-		s.mutexByServiceID[serviceID] = m
-	}
-	return m
-}
+type ConfigureService struct{}
 
 // OnIncomingRequest handles POST requests to /admin/configureService.
 //
@@ -91,50 +58,14 @@ func (s *ConfigureService) OnIncomingRequest(req *http.Request) util.JSONRespons
 		"service_user_id": service.ServiceUserID(),
 	}).Print("Incoming configure service request")
 
-	// Have mutexes around each service to queue up multiple requests for the same service ID
-	mut := s.getMutexForServiceID(service.ServiceID())
-	mut.Lock()
-	defer mut.Unlock()
-
-	old, err := s.db.LoadService(service.ServiceID())
-	if err != nil && err != sql.ErrNoRows {
-		logger.WithError(err).Error("Failed to LoadService")
-		return util.MessageResponse(500, "Error loading old service")
-	}
-
-	client, err := s.clients.Client(service.ServiceUserID())
+	oldService, err := provision.Configure(service)
 	if err != nil {
-		return util.MessageResponse(400, "Unknown matrix client")
-	}
-
-	if err := checkClientForService(service, client); err != nil {
-		return util.MessageResponse(400, err.Error())
-	}
-
-	if err = service.Register(old, client); err != nil {
-		return util.MessageResponse(500, "Failed to register service: "+err.Error())
-	}
-
-	oldService, err := s.db.StoreService(service)
-	if err != nil {
-		logger.WithError(err).Error("Failed to StoreService")
-		return util.MessageResponse(500, "Error storing service")
-	}
-
-	// Start any polling NOW because they may decide to stop it in PostRegister, and we want to make
-	// sure we'll actually stop.
-	if _, ok := service.(types.Poller); ok {
-		if err := polling.StartPolling(service); err != nil {
-			logger.WithFields(log.Fields{
-				"service_id": service.ServiceID(),
-				log.ErrorKey: err,
-			}).Error("Failed to start poll loop.")
+		if provErr, ok := err.(*provision.Error); ok {
+			return util.MessageResponse(provErr.Code, provErr.Message)
 		}
+		return util.MessageResponse(500, err.Error())
 	}
 
-	service.PostRegister(old)
-	metrics.IncrementConfigureService(service.ServiceType())
-
 	return util.JSONResponse{
 		Code: 200,
 		JSON: struct {
@@ -166,6 +97,95 @@ func (s *ConfigureService) createService(req *http.Request) (types.Service, *uti
 	return service, nil
 }
 
+// CloneService represents an HTTP handler which can process /admin/cloneService requests.
+type CloneService struct {
+	DB *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/cloneService.
+//
+// The request body MUST be of type "api.CloneServiceRequest". The service with the given ID is
+// copied to a new service with NewID, replacing room IDs in its config as given in Rooms, so that
+// the same setup can be rolled out to several rooms. The new service is configured in the same way
+// as with /admin/configureService.
+//
+// Request:
+//  POST /admin/cloneService
+//  {
+//      "ID": "team_a_alerts",
+//      "NewID": "team_b_alerts",
+//      "Rooms": {
+//          "!teamA:localhost": "!teamB:localhost"
+//      },
+//      "Config": {
+//          // optional top-level config keys to replace
+//      }
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ID": "team_b_alerts",
+//      "Type": "alertmanager",
+//      "Config": {
+//          // new service-specific config information
+//      }
+//  }
+func (h *CloneService) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body api.CloneServiceRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if err := body.Check(); err != nil {
+		return util.MessageResponse(400, err.Error())
+	}
+
+	source, err := h.DB.LoadService(body.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return util.MessageResponse(404, `Service not found`)
+		}
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadService")
+		return util.MessageResponse(500, `Failed to load service`)
+	}
+	// Cloning mustn't replace an existing service, which /admin/configureService would do
+	if _, err = h.DB.LoadService(body.NewID); err != sql.ErrNoRows {
+		if err == nil {
+			return util.MessageResponse(409, `A service with "NewID" already exists`)
+		}
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadService")
+		return util.MessageResponse(500, `Failed to load service`)
+	}
+
+	service, err := provision.Clone(source, body.NewID, body.UserID, body.Rooms, body.Config)
+	if err == nil {
+		util.GetLogger(req.Context()).WithFields(log.Fields{
+			"service_id":        service.ServiceID(),
+			"service_type":      service.ServiceType(),
+			"service_user_id":   service.ServiceUserID(),
+			"cloned_service_id": body.ID,
+		}).Print("Incoming clone service request")
+		_, err = provision.Configure(service)
+	}
+	if err != nil {
+		if provErr, ok := err.(*provision.Error); ok {
+			return util.MessageResponse(provErr.Code, provErr.Message)
+		}
+		return util.MessageResponse(500, err.Error())
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			ID     string
+			Type   string
+			Config types.Service
+		}{service.ServiceID(), service.ServiceType(), service},
+	}
+}
+
 // GetService represents an HTTP handler which can process /admin/getService requests.
 type GetService struct {
 	DB *database.ServiceDB
@@ -223,19 +243,3 @@ func (h *GetService) OnIncomingRequest(req *http.Request) util.JSONResponse {
 		}{srv.ServiceID(), srv.ServiceType(), srv},
 	}
 }
-
-func checkClientForService(service types.Service, client *clients.BotClient) error {
-	// If there are any commands or expansions for this Service then the service user ID
-	// MUST be a syncing client or else the Service will never get the incoming command/expansion!
-	cmds := service.Commands(client)
-	expans := service.Expansions(client)
-	if len(cmds) > 0 || len(expans) > 0 {
-		nebStore := client.Store.(*matrix.NEBStore)
-		if !nebStore.ClientConfig.Sync {
-			return fmt.Errorf(
-				"Service type '%s' requires a syncing client", service.ServiceType(),
-			)
-		}
-	}
-	return nil
-}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/util"
+)
+
+// ServiceHealth represents an HTTP handler which can process /admin/serviceHealth requests.
+type ServiceHealth struct{}
+
+// OnIncomingRequest handles GET requests to /admin/serviceHealth.
+//
+// Returns the rooms which webhook and polling services are failing to send notifications into,
+// e.g. because the bot was kicked and isn't allowed to join again, ordered by service ID. A room
+// is no longer listed once a notification is sent into it. Notifications for these rooms are sent
+// into the service's fallback room, if it has one.
+//
+// Request:
+//  GET /admin/serviceHealth
+//
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Services": [
+//          {
+//              "ServiceID": "my_github_webhook",
+//              "ServiceType": "github-webhook",
+//              "Rooms": [
+//                  {
+//                      "RoomID": "!qmElAGdFYCHoCJuaNt:localhost",
+//                      "ConsecutiveFailures": 2,
+//                      "LastError": "failed to join room !qmElAGdFYCHoCJuaNt:localhost: M_FORBIDDEN",
+//                      "LastFailureTime": "2016-11-29T12:00:00Z"
+//                  }
+//              ]
+//          }
+//      ]
+//  }
+func (*ServiceHealth) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "GET" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Services []clients.ServiceDelivery
+		}{clients.DeliveryFailures()},
+	}
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/provision"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/util"
+	"maunium.net/go/mautrix/id"
+)
+
+// Services represents an HTTP handler which can process /admin/services requests, for
+// dashboards which manage many services at once.
+type Services struct {
+	DB *database.ServiceDB
+}
+
+// ServiceSummary describes a service in the response to GET /admin/services.
+type ServiceSummary struct {
+	ID      string
+	Type    string
+	UserID  id.UserID
+	Rooms   []id.RoomID
+	Enabled bool
+}
+
+// OnIncomingRequest handles GET, DELETE and PATCH requests to /admin/services.
+//
+// GET lists every service, ordered by ID. Rooms are the rooms a service sends notifications
+// into, which is empty for services which only respond to commands.
+//
+// Request:
+//  GET /admin/services
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Services": [
+//          {
+//              "ID": "my_rss_service",
+//              "Type": "rssbot",
+//              "UserID": "@my_bot:localhost",
+//              "Rooms": ["!qmElAGdFYCHoCJuaNt:localhost"],
+//              "Enabled": true
+//          }
+//      ]
+//  }
+//
+// DELETE removes the services with the given IDs.
+//
+// Request:
+//  DELETE /admin/services
+//  {
+//      "IDs": ["my_rss_service", "my_other_service"]
+//  }
+//
+// PATCH enables or disables the services with the given IDs without changing their config.
+// Disabled services don't respond to commands, ignore webhooks and aren't polled.
+//
+// Request:
+//  PATCH /admin/services
+//  {
+//      "IDs": ["my_rss_service"],
+//      "Enabled": false
+//  }
+//
+// DELETE and PATCH respond with the IDs of the services which were changed. Services are changed
+// one at a time, so if an error is returned the services before the failed one have changed:
+//  HTTP/1.1 200 OK
+//  {
+//      "IDs": ["my_rss_service"]
+//  }
+func (h *Services) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	switch req.Method {
+	case "GET":
+		return h.list(req)
+	case "DELETE", "PATCH":
+		return h.update(req)
+	}
+	return util.MessageResponse(405, "Unsupported Method")
+}
+
+func (h *Services) list(req *http.Request) util.JSONResponse {
+	services, disabled, err := h.DB.LoadServices()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadServices")
+		return util.MessageResponse(500, "Failed to load services")
+	}
+	summaries := make([]ServiceSummary, 0, len(services))
+	for _, srv := range services {
+		summary := ServiceSummary{
+			ID:      srv.ServiceID(),
+			Type:    srv.ServiceType(),
+			UserID:  srv.ServiceUserID(),
+			Rooms:   []id.RoomID{},
+			Enabled: !disabled[srv.ServiceID()],
+		}
+		if targeter, ok := srv.(types.RoomTargeter); ok {
+			summary.Rooms = append(summary.Rooms, targeter.TargetRooms()...)
+		}
+		summaries = append(summaries, summary)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Services []ServiceSummary
+		}{summaries},
+	}
+}
+
+// update deletes (DELETE) or enables/disables (PATCH) each service in the request body.
+func (h *Services) update(req *http.Request) util.JSONResponse {
+	var body struct {
+		IDs     []string
+		Enabled *bool
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if len(body.IDs) == 0 {
+		return util.MessageResponse(400, `Must supply "IDs"`)
+	}
+	if req.Method == "PATCH" && body.Enabled == nil {
+		return util.MessageResponse(400, `Must supply "Enabled"`)
+	}
+	changed := []string{}
+	for _, serviceID := range body.IDs {
+		var err error
+		if req.Method == "DELETE" {
+			err = provision.Delete(serviceID)
+		} else {
+			err = provision.SetEnabled(serviceID, *body.Enabled)
+		}
+		if err != nil {
+			if provErr, ok := err.(*provision.Error); ok {
+				return util.MessageResponse(provErr.Code, provErr.Message)
+			}
+			return util.MessageResponse(500, err.Error())
+		}
+		changed = append(changed, serviceID)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			IDs []string
+		}{changed},
+	}
+}
+
+// ServiceRooms represents an HTTP handler which can process /admin/serviceRooms requests, which add
+// a room to or remove a room from many services at once, e.g. when onboarding a new team room.
+type ServiceRooms struct{}
+
+// OnIncomingRequest handles PUT and DELETE requests to /admin/serviceRooms.
+//
+// PUT makes each service send into the room in the same way as into the rooms it already sends
+// into: the room is added to every list of rooms in the service's config, and every map keyed by
+// room ID gets a copy of the entry for one of its rooms. DELETE removes the room from every list
+// and map in each service's config. See provision.AddRoom for the details.
+//
+// Every service is registered with its new config, which checks it in the same way as
+// /admin/configureService, before any of them are stored, so if any service fails none change.
+//
+// Request:
+//  PUT /admin/serviceRooms
+//  {
+//      "RoomID": "!newteam:localhost",
+//      "IDs": ["team_alerts", "team_github"]
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "IDs": ["team_alerts", "team_github"]
+//  }
+func (h *ServiceRooms) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "PUT" && req.Method != "DELETE" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		RoomID id.RoomID
+		IDs    []string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if body.RoomID == "" || len(body.IDs) == 0 {
+		return util.MessageResponse(400, `Must supply a "RoomID" and "IDs"`)
+	}
+	var services []types.Service
+	var err error
+	if req.Method == "PUT" {
+		services, err = provision.AddRoom(body.IDs, body.RoomID)
+	} else {
+		services, err = provision.RemoveRoom(body.IDs, body.RoomID)
+	}
+	if err != nil {
+		if provErr, ok := err.(*provision.Error); ok {
+			return util.MessageResponse(provErr.Code, provErr.Message)
+		}
+		return util.MessageResponse(500, err.Error())
+	}
+	changed := []string{}
+	for _, srv := range services {
+		changed = append(changed, srv.ServiceID())
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			IDs []string
+		}{changed},
+	}
+}
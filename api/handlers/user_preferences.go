@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// UserPreferences represents an HTTP handler which can process /admin/userPreferences requests.
+type UserPreferences struct {
+	DB *database.ServiceDB
+}
+
+// OnIncomingRequest handles GET and POST requests to /admin/userPreferences.
+//
+// Preferences are set by users for themselves, and apply to their commands in every room, e.g. the
+// "github" preference holds the repository used by !github commands which don't name one.
+//
+// GET returns every preference the user has set.
+//
+// Request:
+//  GET /admin/userPreferences?user_id=@alice:localhost
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "github": {
+//          "default_repo": "matrix-org/go-neb"
+//      }
+//  }
+//
+// POST sets one of the user's preferences. A "Value" of null removes it.
+//
+// Request:
+//  POST /admin/userPreferences
+//  {
+//      "UserID": "@alice:localhost",
+//      "Key": "github",
+//      "Value": {
+//          "default_repo": "matrix-org/go-neb"
+//      }
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {}
+func (h *UserPreferences) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	logger := util.GetLogger(req.Context())
+	switch req.Method {
+	case "GET":
+		userID := id.UserID(req.URL.Query().Get("user_id"))
+		if userID == "" {
+			return util.MessageResponse(400, `Must supply a "user_id"`)
+		}
+		prefs, err := h.DB.LoadUserPreferences(userID)
+		if err != nil {
+			logger.WithError(err).Error("Failed to LoadUserPreferences")
+			return util.MessageResponse(500, "Failed to load user preferences")
+		}
+		return util.JSONResponse{Code: 200, JSON: prefs}
+	case "POST":
+		var body struct {
+			UserID id.UserID
+			Key    string
+			Value  json.RawMessage
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return util.MessageResponse(400, "Error parsing request JSON")
+		}
+		if body.UserID == "" || body.Key == "" {
+			return util.MessageResponse(400, `Must supply a "UserID" and a "Key"`)
+		}
+		logger.WithFields(log.Fields{
+			"user_id": body.UserID,
+			"key":     body.Key,
+		}).Print("Incoming user preference request")
+
+		var err error
+		if len(body.Value) == 0 || string(body.Value) == "null" {
+			err = h.DB.RemoveUserPreference(body.UserID, body.Key)
+		} else {
+			err = h.DB.StoreUserPreference(body.UserID, body.Key, body.Value)
+		}
+		if err != nil {
+			logger.WithError(err).Error("Failed to store user preference")
+			return util.MessageResponse(500, "Failed to store user preference")
+		}
+		return util.JSONResponse{Code: 200, JSON: struct{}{}}
+	}
+	return util.MessageResponse(405, "Unsupported Method")
+}
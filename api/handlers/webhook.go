@@ -4,9 +4,11 @@ import (
 	"encoding/base64"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
 	"github.com/matrix-org/go-neb/metrics"
 	log "github.com/sirupsen/logrus"
 )
@@ -26,10 +28,21 @@ func NewWebhook(db *database.ServiceDB, cli *clients.Clients) *Webhook {
 //
 // The webhook MUST have a known base64 encoded service ID as the last path segment
 // in order for this request to be passed to the correct service, or else this will return
-// HTTP 400. If the base64 encoded service ID is unknown, this will return HTTP 404.
+// HTTP 400. If the base64 encoded service ID is unknown or the service is disabled, this will
+// return HTTP 404.
 // Beyond this, the exact response is determined by the specific Service implementation.
+//
+// The request is given a correlation ID, which is logged with everything about it and returned
+// in the X-Request-ID header. Services can log with it using logging.FromContext(req.Context()).
 func (wh *Webhook) Handle(w http.ResponseWriter, req *http.Request) {
-	log.WithField("path", req.URL.Path).Print("Incoming webhook request")
+	// Every response has the correlation ID, even if the request is rejected, so that the self-test
+	// can tell that its requests reach Go-NEB.
+	correlationID := logging.RequestCorrelationID(req)
+	w.Header().Set(logging.RequestIDHeader, correlationID)
+	log.WithFields(log.Fields{
+		"path":                   req.URL.Path,
+		logging.CorrelationIDKey: correlationID,
+	}).Print("Incoming webhook request")
 	segments := strings.Split(req.URL.Path, "/")
 	// last path segment is the service ID which we will pass the incoming request to,
 	// but we've base64d it.
@@ -50,17 +63,53 @@ func (wh *Webhook) Handle(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(404)
 		return
 	}
-	cli, err := wh.clients.Client(service.ServiceUserID())
+	if disabled, err := wh.db.IsServiceDisabled(srvID); err != nil || disabled {
+		log.WithError(err).WithField("service_id", srvID).Print("Ignoring webhook for disabled service")
+		w.WriteHeader(404)
+		return
+	}
+	cli, err := wh.clients.Client(clients.NotificationSender(service))
 	if err != nil {
-		log.WithError(err).WithField("user_id", service.ServiceUserID()).Print(
+		log.WithError(err).WithField("user_id", clients.NotificationSender(service)).Print(
 			"Failed to retrieve matrix client instance")
 		w.WriteHeader(500)
 		return
 	}
-	log.WithFields(log.Fields{
-		"service_id":   service.ServiceID(),
-		"service_type": service.ServiceType(),
-	}).Print("Incoming webhook for service")
+	logger := log.WithFields(log.Fields{
+		"service_id":             service.ServiceID(),
+		"service_type":           service.ServiceType(),
+		logging.CorrelationIDKey: correlationID,
+	})
+	logger.Print("Incoming webhook for service")
 	metrics.IncrementWebhook(service.ServiceType())
-	service.OnReceiveWebhook(w, req, cli)
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w, code: 200}
+	req = req.WithContext(logging.WithLogger(req.Context(), logger))
+	service.OnReceiveWebhook(sw, req, clients.NewDeliveryClient(cli, service).WithLogger(logger).Audited())
+	logger.WithFields(log.Fields{
+		"status":      sw.code,
+		"duration_ms": time.Since(start).Milliseconds(),
+	}).Debug("Handled webhook")
+	metrics.ObserveWebhook(service.ServiceType(), metrics.WebhookOutcomeForStatus(sw.code), time.Since(start))
+}
+
+// statusWriter remembers the status code of the response, which is 200 unless the service sets
+// another.
+type statusWriter struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.code = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
 }
@@ -0,0 +1,56 @@
+package clients
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// roomACL returns the ACL in the room's bot options, or nil if there isn't one.
+func (c *Clients) roomACL(botUserID id.UserID, roomID id.RoomID) *types.ACL {
+	opts, err := c.db.LoadBotOptions(botUserID, roomID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithError(err).WithFields(log.Fields{
+				"room_id":     roomID,
+				"bot_user_id": botUserID,
+			}).Error("Failed to load bot options")
+		}
+		return nil
+	}
+	if opts.Options == nil {
+		return nil
+	}
+	return opts.Options.ACL
+}
+
+// authoriseCommand returns an error if the command is privileged and the user isn't allowed to
+// run it in the room. The service's ACL is used if it has one, otherwise the room's.
+func (c *Clients) authoriseCommand(botClient *BotClient, service types.Service, cmd *types.Command,
+	roomID id.RoomID, userID id.UserID) error {
+
+	if !cmd.Privileged {
+		return nil
+	}
+	var acl *types.ACL
+	if s, ok := service.(types.CommandACLer); ok {
+		acl = s.CommandACL()
+	}
+	if acl.IsZero() {
+		acl = c.roomACL(botClient.UserID, roomID)
+	}
+	if acl.AllowsInRoom(botClient, roomID, userID) {
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"room_id":    roomID,
+		"user_id":    userID,
+		"service_id": service.ServiceID(),
+		"command":    cmd.Path,
+	}).Info("Refusing to run privileged command")
+	return fmt.Errorf("You don't have permission to use !%s in this room", strings.Join(cmd.Path, " "))
+}
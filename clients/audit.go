@@ -0,0 +1,78 @@
+package clients
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+// DefaultAuditRetention is how long the audit log of commands and webhook sends is kept by
+// default.
+const DefaultAuditRetention = 365 * 24 * time.Hour
+
+var (
+	auditMutex     sync.Mutex
+	auditRetention = DefaultAuditRetention
+)
+
+// SetAuditRetention sets how long CollectGarbage keeps audit log entries for. 0 keeps them
+// forever.
+func SetAuditRetention(d time.Duration) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	auditRetention = d
+}
+
+// AuditRetention returns how long audit log entries are kept for, or 0 if they are kept forever.
+func AuditRetention() time.Duration {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	return auditRetention
+}
+
+// audit records the entry in the audit log. Failing to do so is logged rather than stopping the
+// command or send, which has already happened.
+func audit(db database.Storer, e database.AuditEntry) {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+	if err := db.InsertAuditEntry(e); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"kind":       e.Kind,
+			"user_id":    e.UserID,
+			"room_id":    e.RoomID,
+			"service_id": e.ServiceID,
+		}).Error("Failed to record audit log entry")
+	}
+}
+
+// auditCommand records a command which was run by the sender of the event, or which they weren't
+// allowed to run. The response is the notice sent if the command failed.
+func auditCommand(db database.Storer, service types.Service, event *mevt.Event, cmd *types.Command,
+	response interface{}, failed, denied bool) {
+
+	e := database.AuditEntry{
+		Kind:        database.AuditCommand,
+		UserID:      event.Sender,
+		RoomID:      event.RoomID,
+		ServiceID:   service.ServiceID(),
+		ServiceType: service.ServiceType(),
+		Command:     strings.Join(cmd.Path, " "),
+		Outcome:     database.AuditSuccess,
+	}
+	if failed {
+		e.Outcome = database.AuditFailure
+		if denied {
+			e.Outcome = database.AuditDenied
+		}
+		if notice, ok := response.(mevt.MessageEventContent); ok {
+			e.Detail = notice.Body
+		}
+	}
+	audit(db, e)
+}
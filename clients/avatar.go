@@ -0,0 +1,122 @@
+package clients
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// avatarAccountDataType is the account data which records the avatar image Go-NEB last uploaded
+// for a client, so that the same image isn't uploaded each time the client starts.
+const avatarAccountDataType = "org.goneb.avatar"
+
+// maxAvatarSize is the largest avatar image which is uploaded.
+const maxAvatarSize = 10 * 1024 * 1024
+
+type uploadedAvatar struct {
+	// The hex encoded SHA-256 of the image.
+	SHA256 string              `json:"sha256"`
+	URI    id.ContentURIString `json:"uri"`
+}
+
+// applyAvatar sets the client's avatar to the one in its config. Failing to is logged, but doesn't
+// stop the client from being used.
+func applyAvatar(botClient *BotClient) {
+	if err := setAvatar(botClient.Client, botClient.config.AvatarURL); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"avatar_url": botClient.config.AvatarURL,
+			"user_id":    botClient.config.UserID,
+		}).Error("Failed to set avatar")
+	}
+}
+
+// setAvatar sets the client's avatar to the image at the source, if it isn't already. The source
+// is an mxc:// URI, an http(s):// URL or a path to a local file. Images which aren't in the media
+// repository yet are uploaded to it.
+func setAvatar(cli *mautrix.Client, source string) error {
+	uri, err := avatarURI(cli, source)
+	if err != nil {
+		return err
+	}
+	current, err := cli.GetOwnAvatarURL()
+	if err == nil && current == uri {
+		return nil
+	}
+	return cli.SetAvatarURL(uri)
+}
+
+// avatarURI returns the mxc:// URI of the avatar image, uploading it if need be.
+func avatarURI(cli *mautrix.Client, source string) (id.ContentURI, error) {
+	if strings.HasPrefix(source, "mxc://") {
+		return id.ParseContentURI(source)
+	}
+	data, fileName, err := readAvatar(cli.Client, source)
+	if err != nil {
+		return id.ContentURI{}, err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	var uploaded uploadedAvatar
+	if cli.GetAccountData(avatarAccountDataType, &uploaded) == nil && uploaded.SHA256 == hash {
+		if uri, err := id.ParseContentURI(string(uploaded.URI)); err == nil {
+			return uri, nil
+		}
+	}
+	res, err := cli.UploadBytesWithName(data, http.DetectContentType(data), fileName)
+	if err != nil {
+		return id.ContentURI{}, fmt.Errorf("failed to upload avatar: %s", err)
+	}
+	uploaded = uploadedAvatar{SHA256: hash, URI: res.ContentURI.CUString()}
+	// If this fails the avatar is just uploaded again next time.
+	_ = cli.SetAccountData(avatarAccountDataType, &uploaded)
+	return res.ContentURI, nil
+}
+
+// readAvatar reads the avatar image from an http(s):// URL or a local file, returning it and its
+// file name.
+func readAvatar(httpClient *http.Client, source string) ([]byte, string, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		res, err := httpClient.Get(source)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to download avatar: %s", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			return nil, "", fmt.Errorf("failed to download avatar: HTTP %d", res.StatusCode)
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxAvatarSize+1))
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to download avatar: %s", err)
+		}
+		if len(data) > maxAvatarSize {
+			return nil, "", fmt.Errorf("avatar is larger than %d bytes", maxAvatarSize)
+		}
+		return data, path.Base(res.Request.URL.Path), nil
+	}
+	filePath := strings.TrimPrefix(source, "file://")
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read avatar: %s", err)
+	}
+	if info.Size() > maxAvatarSize {
+		return nil, "", fmt.Errorf("avatar is larger than %d bytes", maxAvatarSize)
+	}
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read avatar: %s", err)
+	}
+	return data, filepath.Base(filePath), nil
+}
@@ -2,6 +2,7 @@ package clients
 
 import (
 	"errors"
+	"fmt"
 	"regexp"
 	"sync"
 	"sync/atomic"
@@ -32,6 +33,22 @@ type BotClient struct {
 	stateStore               *NebStateStore
 	verificationSAS          *sync.Map
 	ongoingVerificationCount int32
+
+	// shareMutex serialises sharing megolm sessions, as the OlmMachine's AllowUnverifiedDevices
+	// depends on the room being shared into.
+	shareMutex *sync.Mutex
+	// policyApplied is the set of rooms whose megolm session was shared under the current
+	// EncryptionPolicy. Guarded by shareMutex.
+	policyApplied map[id.RoomID]bool
+	readOnly      *readOnlyState
+	rateLimiter   *rateLimiter
+	roomMentions  *roomMentions
+	commandEdits  *commandEdits
+	// answersReadOnly is true for the copy of a read-only client which answers a command, whose
+	// messages are sent rather than queued.
+	answersReadOnly bool
+	// notificationDedupe combines notifications about the same thing, see sendCorrelated.
+	notificationDedupe *notificationDedupe
 }
 
 // InitOlmMachine initializes a BotClient's internal OlmMachine given a client object and a Neb store,
@@ -41,7 +58,8 @@ func (botClient *BotClient) InitOlmMachine(client *mautrix.Client, nebStore *mat
 	var cryptoStore crypto.Store
 	cryptoLogger := CryptoMachineLogger{}
 	if sdb, ok := database.GetServiceDB().(*database.ServiceDB); ok {
-		// Create an SQL crypto store based on the ServiceDB used
+		// Create an SQL crypto store based on the ServiceDB used. The dialect is already
+		// normalised to "sqlite3" or "postgres", which are the names the crypto store expects.
 		db, dialect := sdb.GetSQLDb()
 		accountID := botClient.config.UserID.String() + "-" + client.DeviceID.String()
 		sqlCryptoStore := crypto.NewSQLCryptoStore(db, dialect, accountID, client.DeviceID, []byte(client.DeviceID.String()+"pickle"), cryptoLogger)
@@ -64,7 +82,7 @@ func (botClient *BotClient) InitOlmMachine(client *mautrix.Client, nebStore *mat
 		cryptoLogger.Debug("Using gob storage as the crypto store")
 	}
 
-	botClient.stateStore = &NebStateStore{&nebStore.InMemoryStore}
+	botClient.stateStore = &NebStateStore{Storer: &nebStore.InMemoryStore}
 	olmMachine := crypto.NewOlmMachine(client, cryptoLogger, cryptoStore, botClient.stateStore)
 
 	regexes := make([]*regexp.Regexp, 0, len(botClient.config.AcceptVerificationFromUsers))
@@ -126,45 +144,173 @@ func (botClient *BotClient) DecryptMegolmEvent(evt *mevt.Event) (*mevt.Event, er
 
 // SendMessageEvent sends the given content to the given room ID using this BotClient as a message event.
 // If the target room has enabled encryption, a megolm session is created if one doesn't already exist
-// and the message is sent after being encrypted.
+// and the message is sent after being encrypted. This is the case for messages sent by commands,
+// webhooks and pollers alike, as services are all given a BotClient.
+//
+// If /sync hasn't told us about the room, e.g. because this client doesn't sync or has only just
+// joined the room, its state is fetched first so that we know whether to encrypt.
+//
+// Sessions are only shared with the devices allowed by the client's EncryptionPolicy.
+//
+// If the client is read-only, the message is queued and sent when it stops being read-only,
+// unless it answers a command.
+//
+// A matrix.MentionRoomMessage mentions the room if the client is allowed to, subject to its
+// RoomMentionCooldown. A matrix.CorrelatedMessage is combined with recent notifications about the
+// same thing, subject to its NotificationDedupeWindow.
 func (botClient *BotClient) SendMessageEvent(roomID id.RoomID, evtType mevt.Type, content interface{},
 	extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error) {
 
+	pending.add()
+	defer pending.done()
+	if botClient.IsReadOnly() && !botClient.answersReadOnly {
+		return botClient.queueMessage(roomID, evtType, content, extra)
+	}
+	var reply *matrix.ReplyMessage
+	switch msg := content.(type) {
+	case matrix.ReplyMessage:
+		reply = botClient.prepareReply(roomID, msg)
+		content = *reply
+	case *matrix.ReplyMessage:
+		reply = botClient.prepareReply(roomID, *msg)
+		content = *reply
+	case matrix.MentionRoomMessage:
+		content = botClient.mentionRoom(roomID, msg)
+	case *matrix.MentionRoomMessage:
+		content = botClient.mentionRoom(roomID, *msg)
+	case matrix.CorrelatedMessage:
+		return botClient.sendCorrelated(roomID, evtType, msg, extra)
+	case *matrix.CorrelatedMessage:
+		return botClient.sendCorrelated(roomID, evtType, *msg, extra)
+	}
+	if botClient.stateStore.NeedsRoomState(roomID) {
+		if err := botClient.stateStore.FetchRoomState(botClient.Client, roomID); err != nil {
+			// Don't risk sending plaintext into an encrypted room
+			return nil, fmt.Errorf("failed to fetch state of room %s: %s", roomID, err)
+		}
+	}
 	olmMachine := botClient.olmMachine
 	if olmMachine.StateStore.IsEncrypted(roomID) {
-		// Check if there is already a megolm session
-		if sess, err := olmMachine.CryptoStore.GetOutboundGroupSession(roomID); err != nil {
+		if err := botClient.ensureGroupSession(roomID); err != nil {
 			return nil, err
-		} else if sess == nil || sess.Expired() || !sess.Shared {
-			// No error but valid, shared session does not exist
-			memberIDs, err := botClient.stateStore.GetJoinedMembers(roomID)
-			if err != nil {
-				return nil, err
-			}
-			// Share group session with room members
-			if err = olmMachine.ShareGroupSession(roomID, memberIDs); err != nil {
-				return nil, err
-			}
 		}
-		enc, err := olmMachine.EncryptMegolmEvent(roomID, mevt.EventMessage, content)
+		enc, err := olmMachine.EncryptMegolmEvent(roomID, evtType, content)
 		if err != nil {
 			return nil, err
 		}
 		content = enc
 		evtType = mevt.EventEncrypted
+		if reply != nil {
+			// Relations must be in the clear for clients to show the reply or thread.
+			content = matrix.ReplyMessage{Content: enc, InReplyTo: reply.InReplyTo, ThreadRoot: reply.ThreadRoot}
+		}
 	}
 	return botClient.Client.SendMessageEvent(roomID, evtType, content, extra...)
 }
 
+// ensureGroupSession makes sure that there is a megolm session for the room which has been shared
+// with the devices that the client's EncryptionPolicy allows.
+func (botClient *BotClient) ensureGroupSession(roomID id.RoomID) error {
+	olmMachine := botClient.olmMachine
+	policy := &botClient.config.EncryptionPolicy
+	botClient.shareMutex.Lock()
+	defer botClient.shareMutex.Unlock()
+
+	// Check if there is already a megolm session
+	sess, err := olmMachine.CryptoStore.GetOutboundGroupSession(roomID)
+	if err != nil {
+		return err
+	}
+	if sess != nil && !sess.Expired() && sess.Shared {
+		if policy.IsZero() || botClient.policyApplied[roomID] {
+			return nil
+		}
+		// The session may have been shared under a different policy before we started, so
+		// start a new one rather than risk sending to devices the policy now excludes.
+		if err = olmMachine.CryptoStore.RemoveOutboundGroupSession(roomID); err != nil {
+			return err
+		}
+	}
+
+	// No valid, shared session exists so share a new one with room members
+	memberIDs, err := botClient.stateStore.GetJoinedMembers(roomID)
+	if err != nil {
+		return err
+	}
+	for _, userID := range memberIDs {
+		botClient.applyBlacklist(userID)
+	}
+	olmMachine.AllowUnverifiedDevices = !policy.VerifiedOnlyIn(roomID)
+	if err = olmMachine.ShareGroupSession(roomID, memberIDs); err != nil {
+		return err
+	}
+	botClient.policyApplied[roomID] = true
+	return nil
+}
+
+// applyBlacklist marks the user's devices as blacklisted or not according to the client's
+// EncryptionPolicy, which the OlmMachine then takes into account when sharing sessions.
+func (botClient *BotClient) applyBlacklist(userID id.UserID) {
+	policy := &botClient.config.EncryptionPolicy
+	cryptoStore := botClient.olmMachine.CryptoStore
+	devices, err := cryptoStore.GetDevices(userID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", userID).Error("Failed to get devices")
+		return
+	}
+	if devices == nil {
+		if _, ok := policy.BlacklistedDevices[userID]; !ok {
+			return // ShareGroupSession will fetch them, and none of them are blacklisted
+		}
+		devices = botClient.olmMachine.LoadDevices(userID)
+	}
+	for _, device := range devices {
+		blacklisted := policy.IsBlacklisted(userID, device.DeviceID)
+		if blacklisted == (device.Trust == crypto.TrustStateBlacklisted) {
+			continue
+		}
+		if blacklisted {
+			device.Trust = crypto.TrustStateBlacklisted
+		} else {
+			device.Trust = crypto.TrustStateUnset
+		}
+		if err := cryptoStore.PutDevice(userID, device); err != nil {
+			log.WithError(err).WithField("device_id", device.DeviceID).Error("Failed to update device trust")
+		}
+	}
+}
+
 // Sync loops to keep syncing the client with the homeserver by calling the /sync endpoint.
 func (botClient *BotClient) Sync() {
+	// If the device hasn't synced before then this is its initial sync, which is where it starts
+	// syncing from. Services only see the events in it which are being backfilled.
+	firstSync := botClient.Store.LoadNextBatch(botClient.UserID) == ""
+	backfill := 0
+	if firstSync {
+		backfill = botClient.config.InitialSyncBackfill
+	}
+
 	// Get the state store up to date
-	resp, err := botClient.SyncRequest(30000, "", "", true, mevt.PresenceOnline, context.TODO())
+	resp, err := botClient.SyncRequest(30000, "", initialSyncFilter(backfill), true, mevt.PresenceOnline, context.TODO())
 	if err != nil {
 		log.WithError(err).Error("Error performing initial sync")
 		return
 	}
-	botClient.stateStore.UpdateStateStore(resp)
+	if !firstSync {
+		botClient.stateStore.UpdateStateStore(resp)
+	} else if backfill > 0 {
+		log.WithFields(log.Fields{
+			"user_id":  botClient.config.UserID,
+			"backfill": backfill,
+		}).Info("Processing recent events from the initial sync")
+		if err = botClient.Syncer.ProcessResponse(resp, backfillSince); err != nil {
+			log.WithError(err).Error("Error processing initial sync")
+		}
+		botClient.Store.SaveNextBatch(botClient.UserID, resp.NextBatch)
+	} else {
+		botClient.syncCallback(resp, "")
+		botClient.Store.SaveNextBatch(botClient.UserID, resp.NextBatch)
+	}
 
 	for {
 		if e := botClient.Client.Sync(); e != nil {
@@ -180,6 +326,19 @@ func (botClient *BotClient) Sync() {
 	}
 }
 
+// backfillSince is passed to sync listeners as the since token of an initial sync whose events
+// are being backfilled, as an empty one tells mautrix.OldEventIgnorer to ignore every event.
+const backfillSince = "initial-sync"
+
+// initialSyncFilter returns the filter for a sync which fetches the state of every room along with
+// the given number of recent events in each, or as few as possible if it is 0.
+func initialSyncFilter(backfill int) string {
+	if backfill < 1 {
+		backfill = 1 // a limit of 0 means the server's default
+	}
+	return fmt.Sprintf(`{"room":{"timeline":{"limit":%d}}}`, backfill)
+}
+
 // VerifySASMatch returns whether the received SAS matches the SAS that the bot generated.
 // It retrieves the SAS of the other device from the bot client's SAS sync map, where it was stored by the `SubmitDecimalSAS` function.
 func (botClient *BotClient) VerifySASMatch(otherDevice *crypto.DeviceIdentity, sas crypto.SASData) bool {
@@ -0,0 +1,174 @@
+package clients
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// CapabilitiesEventType is the state event in which a client lists the services available in a
+// room, so that other bots and integrations can discover them. Its state key is the client's
+// user ID.
+var CapabilitiesEventType = mevt.Type{Type: "org.goneb.services", Class: mevt.StateEventType}
+
+// CapabilitiesContent is the content of a CapabilitiesEventType event.
+//
+// Example:
+//   {
+//       "services": [
+//           {
+//               "id": "my_github_service",
+//               "type": "github",
+//               "commands": [
+//                   {"command": "!github create"},
+//                   {"command": "!github close", "privileged": true}
+//               ],
+//               "expansions": ["(?:^|\\s)([A-z0-9-_.]+)/([A-z0-9-_.]+)#(\\d+)\\b"]
+//           },
+//           {
+//               "id": "my_alertmanager_service",
+//               "type": "alertmanager",
+//               "notifications": true
+//           }
+//       ]
+//   }
+type CapabilitiesContent struct {
+	Services []ServiceCapabilities `json:"services"`
+}
+
+// ServiceCapabilities describes what a service does in a room.
+type ServiceCapabilities struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// The commands the service responds to.
+	Commands []CommandCapability `json:"commands,omitempty"`
+	// Regular expressions matching the text the service expands, e.g. issue references.
+	Expansions []string `json:"expansions,omitempty"`
+	// True if the service sends notifications into the room, e.g. from webhooks or feeds.
+	Notifications bool `json:"notifications,omitempty"`
+}
+
+// CommandCapability describes a command, e.g. "!github close".
+type CommandCapability struct {
+	Command string `json:"command"`
+	// True if only users allowed by the room's ACL can run the command.
+	Privileged bool `json:"privileged,omitempty"`
+}
+
+// PublishCapabilities updates the CapabilitiesEventType event in every room the client is in.
+// Rooms whose event wouldn't change are left alone. Errors are logged.
+func (c *Clients) PublishCapabilities(userID id.UserID) {
+	logger := log.WithField("service_user_id", userID)
+	botClient, err := c.Client(userID)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to load client to publish capabilities")
+		return
+	}
+	if botClient.IsReadOnly() {
+		logger.Info("Not publishing capabilities as the client is read-only")
+		return
+	}
+	services, err := c.db.LoadServicesForUser(userID)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to load services to publish capabilities")
+		return
+	}
+	joined, err := botClient.JoinedRooms()
+	if err != nil {
+		logger.WithError(err).Warn("Failed to list joined rooms to publish capabilities")
+		return
+	}
+
+	// Publishing is serialised so that an older list can't overwrite a newer one.
+	c.capabilitiesMutex.Lock()
+	defer c.capabilitiesMutex.Unlock()
+	if c.capabilities == nil {
+		c.capabilities = make(map[id.UserID]map[id.RoomID]string)
+	}
+	published := c.capabilities[userID]
+	if published == nil {
+		published = make(map[id.RoomID]string)
+		c.capabilities[userID] = published
+	}
+
+	for roomID, content := range roomCapabilities(botClient, services, joined.JoinedRooms) {
+		j, _ := json.Marshal(content)
+		if _, ok := published[roomID]; !ok {
+			// Don't send the same event again after a restart.
+			var current CapabilitiesContent
+			if err := botClient.StateEvent(roomID, CapabilitiesEventType, userID.String(), &current); err == nil {
+				currentJSON, _ := json.Marshal(current)
+				published[roomID] = string(currentJSON)
+			}
+		}
+		if published[roomID] == string(j) {
+			continue
+		}
+		if _, err := botClient.SendStateEvent(roomID, CapabilitiesEventType, userID.String(), content); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Info("Failed to publish capabilities")
+			continue
+		}
+		published[roomID] = string(j)
+	}
+}
+
+// PublishAllCapabilities publishes the capabilities of every client. Errors are logged.
+func (c *Clients) PublishAllCapabilities() {
+	configs, err := c.db.LoadMatrixClientConfigs()
+	if err != nil {
+		log.WithError(err).Warn("Failed to load clients to publish capabilities")
+		return
+	}
+	for _, cfg := range configs {
+		c.PublishCapabilities(cfg.UserID)
+	}
+}
+
+// roomCapabilities returns the content of the CapabilitiesEventType event for each of the rooms.
+// Services with commands or expansions are listed in every room, and services which send
+// notifications are listed in the rooms they send them into.
+func roomCapabilities(cli types.MatrixClient, services []types.Service, roomIDs []id.RoomID) map[id.RoomID]CapabilitiesContent {
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].ServiceID() < services[j].ServiceID()
+	})
+	rooms := make(map[id.RoomID]CapabilitiesContent, len(roomIDs))
+	for _, roomID := range roomIDs {
+		rooms[roomID] = CapabilitiesContent{Services: []ServiceCapabilities{}}
+	}
+	for _, service := range services {
+		caps := ServiceCapabilities{ID: service.ServiceID(), Type: service.ServiceType()}
+		for _, cmd := range service.Commands(cli) {
+			caps.Commands = append(caps.Commands, CommandCapability{
+				Command:    "!" + strings.Join(cmd.Path, " "),
+				Privileged: cmd.Privileged,
+			})
+		}
+		for _, exp := range service.Expansions(cli) {
+			caps.Expansions = append(caps.Expansions, exp.Regexp.String())
+		}
+		notified := make(map[id.RoomID]bool)
+		if targeter, ok := service.(types.RoomTargeter); ok {
+			for _, target := range targeter.TargetRooms() {
+				for _, roomID := range utils.ResolveRooms(cli, service.ServiceUserID(), target) {
+					notified[roomID] = true
+				}
+			}
+		}
+		for roomID, content := range rooms {
+			roomCaps := caps
+			roomCaps.Notifications = notified[roomID]
+			if len(roomCaps.Commands) == 0 && len(roomCaps.Expansions) == 0 && !roomCaps.Notifications {
+				continue
+			}
+			content.Services = append(content.Services, roomCaps)
+			rooms[roomID] = content
+		}
+	}
+	return rooms
+}
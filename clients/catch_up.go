@@ -0,0 +1,171 @@
+package clients
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/types"
+	shellwords "github.com/mattn/go-shellwords"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// catchUpPageSize is how many events are fetched from a room's history at a time when catching up.
+const catchUpPageSize = 100
+
+// catchUpListener returns a sync listener which catches up on the commands in each room which the
+// sync response left out, because its timeline is limited. The missed events are fetched with
+// /messages, back to the token the client synced from, and handled before the events in the
+// response, as config.CatchUp says.
+func (c *Clients) catchUpListener(botClient *BotClient) func(resp *mautrix.RespSync, since string) bool {
+	return func(resp *mautrix.RespSync, since string) bool {
+		// The first sync of a device has nothing to catch up on, see InitialSyncBackfill.
+		if since == "" || since == backfillSince || botClient.IsReadOnly() {
+			return true
+		}
+		for roomID, room := range resp.Rooms.Join {
+			if !room.Timeline.Limited || room.Timeline.PrevBatch == "" || !botClient.catchesUpIn(roomID) {
+				continue
+			}
+			logger := log.WithFields(log.Fields{
+				"user_id": botClient.UserID,
+				"room_id": roomID,
+			})
+			events, err := missedEvents(botClient.Client, roomID, room.Timeline.PrevBatch, since)
+			if err != nil {
+				logger.WithError(err).Warn("Failed to fetch missed events")
+				continue
+			}
+			logger.WithField("events", len(events)).Info("Catching up on missed events")
+			c.onMissedEvents(botClient, roomID, events)
+		}
+		return true
+	}
+}
+
+// catchesUpIn returns true if the client catches up on missed commands in the room.
+func (botClient *BotClient) catchesUpIn(roomID id.RoomID) bool {
+	if len(botClient.config.CatchUpRooms) == 0 {
+		return true
+	}
+	for _, r := range botClient.config.CatchUpRooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// missedEvents returns the room's events between the from and to tokens, oldest first. At most
+// api.MaxCatchUpEvents are returned, the most recent ones if there are more.
+func missedEvents(cli *mautrix.Client, roomID id.RoomID, from, to string) ([]*mevt.Event, error) {
+	var events []*mevt.Event
+	for len(events) < api.MaxCatchUpEvents {
+		resp, err := cli.Messages(roomID, from, to, 'b', catchUpPageSize)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, resp.Chunk...)
+		if len(resp.Chunk) == 0 || resp.End == "" || resp.End == from {
+			break
+		}
+		from = resp.End
+	}
+	if len(events) > api.MaxCatchUpEvents {
+		events = events[:api.MaxCatchUpEvents]
+	}
+	// /messages returns the newest first when paginating backwards.
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, nil
+}
+
+// onMissedEvents handles the commands in events which the client missed. Commands are run if the
+// client runs missed commands and every service command they match is idempotent. The room is
+// told about the other commands, so they can be sent again.
+func (c *Clients) onMissedEvents(botClient *BotClient, roomID id.RoomID, events []*mevt.Event) {
+	services, err := c.db.LoadServicesForUser(botClient.UserID)
+	if err != nil {
+		log.WithError(err).WithField("service_user_id", botClient.UserID).Warn("Error loading services")
+		return
+	}
+	var missed []string
+	for _, evt := range events {
+		evt.RoomID = roomID
+		if evt.Sender == botClient.UserID || evt.StateKey != nil || c.seenEvents.has(botClient.UserID, evt.ID) {
+			continue
+		}
+		evt.Type.Class = mevt.MessageEventType
+		if err := evt.Content.ParseRaw(evt.Type); err != nil {
+			continue
+		}
+		if evt.Type == mevt.EventEncrypted {
+			decrypted, err := botClient.DecryptMegolmEvent(evt)
+			if err != nil {
+				log.WithError(err).WithField("event_id", evt.ID).Warn("Failed to decrypt missed event")
+				continue
+			}
+			evt = decrypted
+		}
+		if evt.Type != mevt.EventMessage {
+			continue
+		}
+		message := evt.Content.AsMessage()
+		if message.MsgType == mevt.MsgNotice || !strings.HasPrefix(message.Body, "!") {
+			continue
+		}
+		if message.RelatesTo != nil && message.RelatesTo.Type == mevt.RelReplace {
+			continue // edits of missed commands aren't run either
+		}
+		matched, idempotent := c.matchCommand(botClient, services, roomID, message.Body)
+		if !matched {
+			continue
+		}
+		if idempotent && botClient.config.CatchUp == api.CatchUpRun {
+			c.onMessageEvent(botClient, evt)
+			continue
+		}
+		c.seenEvents.first(botClient.UserID, evt.ID)
+		missed = append(missed, fmt.Sprintf("%s from %s", message.Body, evt.Sender))
+	}
+	if len(missed) == 0 {
+		return
+	}
+	body := fmt.Sprintf(
+		"These commands were sent while I was offline and weren't run. Please send them again if they are still needed:\n%s",
+		strings.Join(missed, "\n"),
+	)
+	if _, err := botClient.SendMessageEvent(roomID, mevt.EventMessage, mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}); err != nil {
+		log.WithError(err).WithField("room_id", roomID).Warn("Failed to tell the room about missed commands")
+	}
+}
+
+// matchCommand returns whether the body is a command of one of the services, and if so whether
+// every command it matches is idempotent.
+func (c *Clients) matchCommand(botClient *BotClient, services []types.Service, roomID id.RoomID, body string) (matched, idempotent bool) {
+	args, err := shellwords.Parse(body[1:])
+	if err != nil {
+		args = strings.Split(body[1:], " ")
+	}
+	idempotent = true
+	for _, service := range services {
+		cmds := service.Commands(botClient)
+		if dcs, ok := service.(types.DirectChatService); ok {
+			if userID := c.directChats.user(botClient.Client, roomID); userID != "" {
+				cmds = dcs.DirectChatCommands(botClient, userID)
+			}
+		}
+		if cmd := bestCommand(cmds, args); cmd != nil {
+			matched = true
+			idempotent = idempotent && cmd.Idempotent
+		}
+	}
+	return matched, matched && idempotent
+}
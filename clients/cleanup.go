@@ -0,0 +1,182 @@
+package clients
+
+import (
+	"sort"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// A CleanupReport describes what LeaveUnusedRooms did.
+type CleanupReport struct {
+	// The rooms which were left and forgotten, or would have been in a dry run.
+	LeftRooms []LeftRoom
+	// The clients whose rooms were all kept, because they run services which answer commands in
+	// any room, so no room can be known to be unused, or because they run no services.
+	SkippedClients []id.UserID
+}
+
+// LeftRoom identifies a room left by LeaveUnusedRooms.
+type LeftRoom struct {
+	UserID id.UserID
+	RoomID id.RoomID
+}
+
+// LeaveUnusedRooms makes clients leave and forget the rooms they are in which no service sends
+// into, such as old alert rooms, so that they stop adding to every sync. A room is in use by a
+// client if one of its services, or a service which sends notifications with it, targets the room
+// or uses it as a fallback room, if it has bot options in the room, or if the room is a direct
+// chat. Clients running a service which isn't a types.RoomTargeter or which has commands or
+// expansions are skipped, as such services are used from any room. Clients running no services
+// are skipped too, as they may be used for something else. If dryRun is true the rooms are
+// reported but not left.
+func (c *Clients) LeaveUnusedRooms(dryRun bool) (report CleanupReport, err error) {
+	report.LeftRooms = []LeftRoom{}
+	report.SkippedClients = []id.UserID{}
+	configs, err := c.db.LoadMatrixClientConfigs()
+	if err != nil {
+		return
+	}
+	used, skipped, err := c.usedRooms(configs)
+	if err != nil {
+		return
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].UserID < configs[j].UserID })
+	for _, config := range configs {
+		userID := config.UserID
+		if skipped[userID] {
+			report.SkippedClients = append(report.SkippedClients, userID)
+			continue
+		}
+		logger := log.WithField("user_id", userID)
+		botClient, err := c.Client(userID)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to load client, keeping its rooms")
+			continue
+		}
+		if !dryRun && botClient.IsReadOnly() {
+			logger.Info("Client is read-only, keeping its rooms")
+			continue
+		}
+		res, err := botClient.JoinedRooms()
+		if err != nil {
+			logger.WithError(err).Warn("Failed to list joined rooms, keeping them")
+			continue
+		}
+		for _, roomID := range res.JoinedRooms {
+			if used[userID][roomID] || c.directChats.user(botClient.Client, roomID) != "" {
+				continue
+			}
+			if !dryRun {
+				if _, err := botClient.LeaveRoom(roomID); err != nil {
+					logger.WithError(err).WithField("room_id", roomID).Warn("Failed to leave unused room")
+					continue
+				}
+				if _, err := botClient.ForgetRoom(roomID); err != nil {
+					logger.WithError(err).WithField("room_id", roomID).Warn("Failed to forget unused room")
+				}
+				logger.WithField("room_id", roomID).Info("Left unused room")
+			}
+			report.LeftRooms = append(report.LeftRooms, LeftRoom{userID, roomID})
+		}
+	}
+	return
+}
+
+// usedRooms returns the rooms in use by each of the clients, and the clients whose rooms are all
+// in use.
+func (c *Clients) usedRooms(configs []api.ClientConfig) (used map[id.UserID]map[id.RoomID]bool, skipped map[id.UserID]bool, err error) {
+	used = make(map[id.UserID]map[id.RoomID]bool)
+	skipped = make(map[id.UserID]bool)
+	hasServices := make(map[id.UserID]bool)
+	use := func(userID id.UserID, roomID id.RoomID) {
+		if used[userID] == nil {
+			used[userID] = make(map[id.RoomID]bool)
+		}
+		used[userID][roomID] = true
+	}
+
+	services, _, err := c.db.LoadServices()
+	if err != nil {
+		return
+	}
+	for _, service := range services {
+		hasServices[service.ServiceUserID()] = true
+		targeter, ok := service.(types.RoomTargeter)
+		if !ok {
+			skipped[service.ServiceUserID()] = true
+			continue
+		}
+		userIDs := []id.UserID{service.ServiceUserID()}
+		if sender := NotificationSender(service); sender != service.ServiceUserID() {
+			userIDs = append(userIDs, sender)
+			hasServices[sender] = true
+		}
+		botClient, err := c.Client(service.ServiceUserID())
+		if err != nil {
+			// Without the client, labels and spaces can't be resolved.
+			log.WithError(err).WithField("service_id", service.ServiceID()).Warn("Failed to load client, keeping rooms")
+			for _, userID := range userIDs {
+				skipped[userID] = true
+			}
+			continue
+		}
+		if len(service.Commands(botClient)) > 0 || len(service.Expansions(botClient)) > 0 {
+			// Commands are answered in any room the client is in. A separate sender only uses the
+			// targets.
+			skipped[service.ServiceUserID()] = true
+		}
+		var roomIDs []id.RoomID
+		for _, target := range targeter.TargetRooms() {
+			if !utils.IsLabel(target) {
+				roomIDs = append(roomIDs, target) // Spaces are kept as well as the rooms in them
+			}
+			roomIDs = append(roomIDs, utils.ResolveRooms(botClient, service.ServiceUserID(), target)...)
+		}
+		if fallback, ok := service.(types.FallbackService); ok && fallback.FallbackRoom() != "" {
+			roomIDs = append(roomIDs, fallback.FallbackRoom())
+		}
+		for _, userID := range userIDs {
+			for _, roomID := range roomIDs {
+				use(userID, roomID)
+			}
+		}
+	}
+
+	for _, config := range configs {
+		if !hasServices[config.UserID] {
+			skipped[config.UserID] = true
+		}
+	}
+
+	rooms, err := c.db.LoadBotOptionsRooms()
+	if err != nil {
+		return
+	}
+	for userID, roomIDs := range rooms {
+		for _, roomID := range roomIDs {
+			use(userID, roomID)
+		}
+	}
+	return
+}
+
+// LeaveUnusedRoomsPeriodically calls LeaveUnusedRooms every interval, forever. The results are
+// logged.
+func (c *Clients) LeaveUnusedRoomsPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		report, err := c.LeaveUnusedRooms(false)
+		if err != nil {
+			log.WithError(err).Error("Failed to leave unused rooms")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"left_rooms":      len(report.LeftRooms),
+			"skipped_clients": len(report.SkippedClients),
+		}).Info("Left unused rooms")
+	}
+}
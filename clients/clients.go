@@ -2,16 +2,20 @@ package clients
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
 	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/secrets"
 	"github.com/matrix-org/go-neb/types"
 	shellwords "github.com/mattn/go-shellwords"
 	log "github.com/sirupsen/logrus"
@@ -27,14 +31,25 @@ type Clients struct {
 	dbMutex    sync.Mutex
 	mapMutex   sync.Mutex
 	clients    map[id.UserID]BotClient
+
+	capabilitiesMutex sync.Mutex
+	// The JSON of the CapabilitiesEventType event last published by each client in each room.
+	capabilities map[id.UserID]map[id.RoomID]string
+
+	// The message events which clients have handled, so that they are only handled once.
+	seenEvents *seenEvents
+	// The rooms which are direct chats with the clients.
+	directChats *directChats
 }
 
 // New makes a new collection of matrix clients
 func New(db database.Storer, cli *http.Client) *Clients {
 	clients := &Clients{
-		db:         db,
-		httpClient: cli,
-		clients:    make(map[id.UserID]BotClient), // user_id => BotClient
+		db:          db,
+		httpClient:  cli,
+		clients:     make(map[id.UserID]BotClient), // user_id => BotClient
+		seenEvents:  newSeenEvents(),
+		directChats: newDirectChats(),
 	}
 	return clients
 }
@@ -55,6 +70,25 @@ func (c *Clients) Update(config api.ClientConfig) (api.ClientConfig, error) {
 	return old.config, err
 }
 
+// Remove stops the client for the userID syncing, forgets it and deletes its config. Services
+// which use it should be deleted first.
+func (c *Clients) Remove(userID id.UserID) error {
+	c.dbMutex.Lock()
+	defer c.dbMutex.Unlock()
+
+	if err := c.db.DeleteMatrixClientConfig(userID); err != nil {
+		return err
+	}
+	c.mapMutex.Lock()
+	old := c.clients[userID]
+	delete(c.clients, userID)
+	c.mapMutex.Unlock()
+	if old.Client != nil {
+		old.StopSync()
+	}
+	return nil
+}
+
 // Start listening on client /sync streams
 func (c *Clients) Start() error {
 	configs, err := c.db.LoadMatrixClientConfigs()
@@ -102,6 +136,9 @@ func (c *Clients) loadClientFromDB(userID id.UserID) (entry BotClient, err error
 	if err = c.initClient(&entry); err != nil {
 		return
 	}
+	if entry.config.AvatarURL != "" {
+		applyAvatar(&entry)
+	}
 
 	c.setClient(entry)
 	return
@@ -136,17 +173,20 @@ func (c *Clients) updateClientInDB(newConfig api.ClientConfig) (new, old BotClie
 		}
 	}
 
+	if new.config.AvatarURL != "" && (old.Client == nil || old.config.AvatarURL != new.config.AvatarURL) {
+		applyAvatar(&new)
+	}
+
 	if old.config, err = c.db.StoreMatrixClientConfig(new.config); err != nil {
 		new.StopSync()
 		return
 	}
 
+	// Replace the old client, so that everything which sends with it uses the new config.
+	c.setClient(new)
 	if old.Client != nil {
 		old.Client.StopSync()
-		return
 	}
-
-	c.setClient(new)
 	return
 }
 
@@ -167,18 +207,116 @@ func (c *Clients) onMessageEvent(botClient *BotClient, event *mevt.Event) {
 		return
 	}
 
-	// filter m.notice to prevent loops
-	if message.MsgType == mevt.MsgNotice {
+	if !c.seenEvents.first(botClient.UserID, event.ID) {
+		// e.g. a sync which was retried after a reconnect, which would run commands again.
+		log.WithFields(log.Fields{
+			"event_id":        event.ID,
+			"room_id":         event.RoomID,
+			"service_user_id": botClient.UserID,
+		}).Debug("Ignoring message which was already handled")
 		return
 	}
 
+	// A read-only client still runs commands which only look things up, and answers commands
+	// straight away rather than queueing the answers. Everything else may change things.
+	readOnly := botClient.IsReadOnly()
+	if readOnly {
+		if body[0] != '!' {
+			log.WithFields(log.Fields{
+				"room_id":         event.RoomID,
+				"service_user_id": botClient.UserID,
+			}).Debug("Ignoring message as the client is read-only")
+			return
+		}
+		answering := *botClient
+		answering.answersReadOnly = true
+		botClient = &answering
+	}
+
+	// Commands are identified in the logs by the event which invoked them, up to the responses.
+	logger := log.WithFields(log.Fields{
+		logging.CorrelationIDKey: string(event.ID),
+		"room_id":                event.RoomID,
+		"user_id":                event.Sender,
+	})
+
+	if event.Sender != botClient.UserID && !readOnly {
+		for _, service := range services {
+			if listener, ok := service.(types.MessageListener); ok {
+				listener.OnMessage(botClient, event)
+			}
+		}
+	}
+
+	// filter m.notice, and the locations and custom msgtypes services send, to prevent loops
+	if message.MsgType == mevt.MsgNotice || (event.Sender == botClient.UserID && message.MsgType != mevt.MsgText) {
+		return
+	}
+
+	// An edit of a failed command runs the corrected command, if edits are enabled.
+	var edited *failedCommand
+	commandEventID := event.ID
+	if rel := message.RelatesTo; rel != nil && rel.Type == mevt.RelReplace && botClient.commandEdits.enabled() {
+		if message.NewContent == nil || !strings.HasPrefix(message.NewContent.Body, "!") {
+			return
+		}
+		if edited = botClient.commandEdits.take(rel.EventID, event.Sender, time.Now()); edited == nil {
+			return
+		}
+		commandEventID = rel.EventID
+		body = message.NewContent.Body
+	}
+	// Responses which are replies refer to the command, rather than to its edit.
+	replyTo := event
+	if edited != nil && edited.event != nil {
+		replyTo = edited.event
+	}
+
 	// replace all smart quotes with their normal counterparts so shellwords can parse it
 	body = strings.Replace(body, `‘`, `'`, -1)
 	body = strings.Replace(body, `’`, `'`, -1)
 	body = strings.Replace(body, `“`, `"`, -1)
 	body = strings.Replace(body, `”`, `"`, -1)
 
+	// The message answers a question a service asked this user, unless it is a command in
+	// which case the question is abandoned.
+	if answerer := types.TakeQuestion(botClient.UserID, event.RoomID, event.Sender); answerer != nil && body[0] != '!' {
+		sendResponses(botClient, logger, event, []interface{}{answerQuestion(answerer, logger, body)})
+		return
+	}
+
+	if body[0] == '!' {
+		if ok, reason := botClient.rateLimiter.allow(event.Sender, event.RoomID, time.Now()); !ok {
+			logger.Info("Ignoring command as the rate limit was reached")
+			if reason != "" {
+				sendResponses(botClient, logger, event, []interface{}{mevt.MessageEventContent{
+					MsgType: mevt.MsgNotice,
+					Body:    reason,
+				}})
+			}
+			return
+		}
+	}
+
 	var responses []interface{}
+	succeeded := false
+
+	// The user the room is a direct chat with, only looked up if a service supports direct chats.
+	var directUser *id.UserID
+	commandsFor := func(service types.Service) []types.Command {
+		dcs, ok := service.(types.DirectChatService)
+		if !ok {
+			return service.Commands(botClient)
+		}
+		if directUser == nil {
+			u := c.directChats.user(botClient.Client, event.RoomID)
+			directUser = &u
+		}
+		if *directUser == "" {
+			return service.Commands(botClient)
+		}
+		return dcs.DirectChatCommands(botClient, *directUser)
+	}
 
 	for _, service := range services {
 		if body[0] == '!' { // message is a command
@@ -187,60 +325,122 @@ func (c *Clients) onMessageEvent(botClient *BotClient, event *mevt.Event) {
 				args = strings.Split(body[1:], " ")
 			}
 
-			if response := runCommandForService(service.Commands(botClient), event, args); response != nil {
-				responses = append(responses, response)
+			denied := false
+			authorise := func(cmd *types.Command) error {
+				if readOnly && (cmd.Privileged || !cmd.Idempotent) {
+					denied = true
+					return fmt.Errorf("!%s can't be used while the bot is in read-only mode", strings.Join(cmd.Path, " "))
+				}
+				err := c.authoriseCommand(botClient, service, cmd, event.RoomID, event.Sender)
+				denied = err != nil
+				return err
+			}
+			serviceLogger := logger.WithFields(log.Fields{
+				"service_id":   service.ServiceID(),
+				"service_type": service.ServiceType(),
+			})
+			response, cmd, failed := runCommandForService(commandsFor(service), serviceLogger, event, args, authorise)
+			if cmd != nil {
+				auditCommand(c.db, service, event, cmd, response, failed, denied)
+			}
+			if response != nil {
+				responses = append(responses, asReply(response, replyTo, replyStyle(service, cmd)))
 			}
+			succeeded = succeeded || (response != nil && !failed)
 		} else { // message isn't a command, it might need expanding
-			expansions := runExpansionsForService(service.Expansions(botClient), event, body)
-			responses = append(responses, expansions...)
+			style := replyStyle(service, nil)
+			for _, expansion := range runExpansionsForService(service.Expansions(botClient), event, body) {
+				responses = append(responses, asReply(expansion, replyTo, style))
+			}
 		}
 	}
 
+	// The built-in !help lists every service's commands, unless a service answered it.
+	if body[0] == '!' && len(responses) == 0 {
+		if args := strings.Fields(body[1:]); len(args) > 0 && strings.EqualFold(args[0], helpCommand) {
+			responses = append(responses, helpMessage(botClient, services, args[1:]))
+			succeeded = true
+		}
+	}
+
+	var responseIDs []id.EventID
+	if edited != nil {
+		responseIDs = replaceResponses(botClient, logger, event, edited.responses, responses)
+	} else {
+		responseIDs = sendResponses(botClient, logger, event, responses)
+	}
+	if body[0] == '!' && !succeeded {
+		sent := time.Now()
+		if edited != nil {
+			sent = edited.sent
+		}
+		botClient.commandEdits.record(commandEventID, &failedCommand{
+			sender:    event.Sender,
+			sent:      sent,
+			event:     replyTo,
+			responses: responseIDs,
+		}, time.Now())
+	}
+}
+
+// sendResponses sends the responses into the event's room, returning the event IDs of those which
+// were sent.
+func sendResponses(botClient *BotClient, logger *log.Entry, event *mevt.Event, responses []interface{}) []id.EventID {
+	var eventIDs []id.EventID
 	for _, content := range responses {
-		if _, err := botClient.SendMessageEvent(event.RoomID, mevt.EventMessage, content); err != nil {
-			log.WithFields(log.Fields{
-				"room_id": event.RoomID,
-				"content": content,
-				"sender":  event.Sender,
-			}).WithError(err).Error("Failed to send command response")
+		resp, err := botClient.SendMessageEvent(event.RoomID, mevt.EventMessage, content)
+		if err != nil {
+			logger.WithField("content", content).WithError(err).Error("Failed to send command response")
+			continue
 		}
+		logger.WithField("event_id", resp.EventID).Debug("Sent command response")
+		eventIDs = append(eventIDs, resp.EventID)
 	}
+	return eventIDs
 }
 
-// runCommandForService runs a single command read from a matrix event. Runs
-// the matching command with the longest path. Returns the JSON encodable
-// content of a single matrix message event to use as a response or nil if no
-// response is appropriate.
-func runCommandForService(cmds []types.Command, event *mevt.Event, arguments []string) interface{} {
-	var bestMatch *types.Command
-	for i, command := range cmds {
-		matches := command.Matches(arguments)
-		betterMatch := bestMatch == nil || len(bestMatch.Path) < len(command.Path)
-		if matches && betterMatch {
-			bestMatch = &cmds[i]
+// answerQuestion passes the body of a message to the service which asked the sender a question.
+// Returns the JSON encodable content of the reply, which is an error notice if answering failed.
+func answerQuestion(answerer types.Answerer, logger *log.Entry, body string) interface{} {
+	logger.Info("Answering question")
+	content, err := answerer(body)
+	if err != nil {
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    err.Error(),
 		}
 	}
+	return content
+}
+
+// runCommandForService runs a single command read from a matrix event. Runs
+// the matching command with the longest path, if authorise allows it. Returns the
+// JSON encodable content of a single matrix message event to use as a response or
+// nil if no response is appropriate, the command which matched, and whether it failed.
+func runCommandForService(cmds []types.Command, logger *log.Entry, event *mevt.Event, arguments []string,
+	authorise func(cmd *types.Command) error) (content interface{}, cmd *types.Command, failed bool) {
 
+	bestMatch := bestCommand(cmds, arguments)
 	if bestMatch == nil {
-		return nil
+		return nil, nil, false
+	}
+
+	if err := authorise(bestMatch); err != nil {
+		metrics.IncrementCommand(bestMatch.Path[0], metrics.StatusFailure)
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    err.Error(),
+		}, bestMatch, true
 	}
 
 	cmdArgs := arguments[len(bestMatch.Path):]
-	log.WithFields(log.Fields{
-		"room_id": event.RoomID,
-		"user_id": event.Sender,
-		"command": bestMatch.Path,
-	}).Info("Executing command")
+	logger = logger.WithField("command", bestMatch.Path)
+	logger.Info("Executing command")
 	content, err := bestMatch.Command(event.RoomID, event.Sender, cmdArgs)
+	failed = err != nil
 	if err != nil {
 		if content != nil {
-			log.WithFields(log.Fields{
-				log.ErrorKey: err,
-				"room_id":    event.RoomID,
-				"user_id":    event.Sender,
-				"command":    bestMatch.Path,
-				"args":       cmdArgs,
-			}).Warn("Command returned both error and content.")
+			logger.WithError(err).WithField("args", cmdArgs).Warn("Command returned both error and content.")
 		}
 		metrics.IncrementCommand(bestMatch.Path[0], metrics.StatusFailure)
 		content = mevt.MessageEventContent{
@@ -251,7 +451,21 @@ func runCommandForService(cmds []types.Command, event *mevt.Event, arguments []s
 		metrics.IncrementCommand(bestMatch.Path[0], metrics.StatusSuccess)
 	}
 
-	return content
+	return content, bestMatch, failed
+}
+
+// bestCommand returns the command which matches the arguments with the longest path, or nil if
+// none match.
+func bestCommand(cmds []types.Command, arguments []string) *types.Command {
+	var bestMatch *types.Command
+	for i, command := range cmds {
+		matches := command.Matches(arguments)
+		betterMatch := bestMatch == nil || len(bestMatch.Path) < len(command.Path)
+		if matches && betterMatch {
+			bestMatch = &cmds[i]
+		}
+	}
+	return bestMatch
 }
 
 // run the expansions for a matrix event.
@@ -276,7 +490,8 @@ func runExpansionsForService(expans []types.Expansion, event *mevt.Event, body s
 	return responses
 }
 
-func (c *Clients) onBotOptionsEvent(client *mautrix.Client, event *mevt.Event) {
+func (c *Clients) onBotOptionsEvent(botClient *BotClient, event *mevt.Event) {
+	client := botClient.Client
 	// see if these options are for us. The state key is the user ID with a leading _
 	// to get around restrictions in the HS about having user IDs as state keys.
 	if event.StateKey == nil {
@@ -286,6 +501,15 @@ func (c *Clients) onBotOptionsEvent(client *mautrix.Client, event *mevt.Event) {
 	if targetUserID != client.UserID {
 		return
 	}
+	// Only users allowed by the room's current ACL can change the options, including the ACL.
+	if !c.roomACL(client.UserID, event.RoomID).AllowsInRoom(botClient, event.RoomID, event.Sender) {
+		log.WithFields(log.Fields{
+			"room_id":        event.RoomID,
+			"bot_user_id":    client.UserID,
+			"set_by_user_id": event.Sender,
+		}).Warn("Ignoring bot options from a user who isn't allowed to set them")
+		return
+	}
 	// these options fully clobber what was there previously.
 
 	opts := types.BotOptions{
@@ -325,6 +549,12 @@ func (c *Clients) onRoomMemberEvent(client *mautrix.Client, event *mevt.Event) {
 			logger.WithError(err).Print("Failed to join room")
 		} else {
 			logger.Print("Joined room")
+			if event.Content.AsMember().IsDirect {
+				if err := c.directChats.add(client, event.RoomID, event.Sender); err != nil {
+					logger.WithError(err).Warn("Failed to record direct chat")
+				}
+			}
+			go c.PublishCapabilities(client.UserID)
 		}
 	}
 }
@@ -333,29 +563,52 @@ var StateBotOptionsEvent = mevt.Type{Type: "m.room.bot.options", Class: mevt.Sta
 
 func (c *Clients) initClient(botClient *BotClient) error {
 	config := botClient.config
-	client, err := mautrix.NewClient(config.HomeserverURL, config.UserID, config.AccessToken)
+	accessToken, err := secrets.Resolve(config.AccessToken)
+	if err != nil {
+		return err
+	}
+	client, err := mautrix.NewClient(config.HomeserverURL, config.UserID, accessToken)
 	if err != nil {
 		return err
 	}
 
-	client.Client = c.httpClient
+	if client.Client, err = httpClientFor(c.httpClient, config.HTTP); err != nil {
+		return err
+	}
+	if config.HTTP.InsecureSkipVerify {
+		log.WithField("user_id", config.UserID).Warn("Not verifying the homeserver's TLS certificate")
+	}
 	client.DeviceID = config.DeviceID
 	if client.DeviceID == "" {
 		log.Warn("Device ID is not set which will result in E2E encryption/decryption not working")
 	}
 	botClient.Client = client
 	botClient.verificationSAS = &sync.Map{}
+	botClient.shareMutex = &sync.Mutex{}
+	botClient.policyApplied = make(map[id.RoomID]bool)
+	botClient.readOnly = &readOnlyState{enabled: config.ReadOnly}
+	botClient.rateLimiter = newRateLimiter(config.RateLimit)
+	botClient.roomMentions = newRoomMentions(config.RoomMentionCooldown)
+	botClient.commandEdits = newCommandEdits(config.CommandEditWindow)
+	botClient.notificationDedupe = newNotificationDedupe(config.NotificationDedupeWindow)
 
 	syncer := client.Syncer.(*mautrix.DefaultSyncer)
 	syncer.ParseEventContent = true
+	// Shutdown waits for the sync responses being processed.
+	client.Syncer = trackingSyncer{syncer}
 
 	// Add m.room.bot.options to mautrix's TypeMap so that it parses it as a valid event
 	mevt.TypeMap[StateBotOptionsEvent] = reflect.TypeOf(types.BotOptionsContent{})
 
+	filterJSON, err := json.Marshal(syncer.GetFilterJSON(config.UserID))
+	if err != nil {
+		return err
+	}
 	nebStore := &matrix.NEBStore{
 		InMemoryStore: *mautrix.NewInMemoryStore(),
 		Database:      c.db,
 		ClientConfig:  config,
+		FilterJSON:    string(filterJSON),
 	}
 	client.Store = nebStore
 
@@ -374,7 +627,7 @@ func (c *Clients) initClient(botClient *BotClient) error {
 	})
 
 	syncer.OnEventType(StateBotOptionsEvent, func(_ mautrix.EventSource, event *mevt.Event) {
-		c.onBotOptionsEvent(botClient.Client, event)
+		c.onBotOptionsEvent(botClient, event)
 	})
 
 	if config.AutoJoinRooms {
@@ -411,6 +664,10 @@ func (c *Clients) initClient(botClient *BotClient) error {
 	// Ignore events before neb's join event.
 	eventIgnorer := mautrix.OldEventIgnorer{UserID: config.UserID}
 	eventIgnorer.Register(syncer)
+	// Catch up on commands which were missed, after rooms the client just joined are dropped.
+	if config.CatchUp != "" {
+		syncer.OnSync(c.catchUpListener(botClient))
+	}
 
 	log.WithFields(log.Fields{
 		"user_id":         config.UserID,
@@ -1,15 +1,24 @@
 package clients
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/types"
+	_ "github.com/mattn/go-sqlite3"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto"
 	mevt "maunium.net/go/mautrix/event"
@@ -107,6 +116,113 @@ func TestCommandParsing(t *testing.T) {
 
 }
 
+type MockListener struct {
+	MockService
+	heard []string
+}
+
+func (s *MockListener) OnMessage(cli types.MatrixClient, ev *mevt.Event) {
+	s.heard = append(s.heard, ev.Content.AsMessage().Body)
+}
+
+func TestMessageListener(t *testing.T) {
+	s := MockListener{}
+	store := MockStore{service: &s}
+	database.SetServiceDB(&store)
+	clients := New(&store, &http.Client{})
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	botClient := BotClient{Client: mxCli}
+
+	for _, msg := range []struct {
+		sender  id.UserID
+		msgType mevt.MessageType
+		body    string
+	}{
+		{"@someone:somewhere", mevt.MsgText, "!test command"},
+		{"@someone:somewhere", mevt.MsgNotice, "a notice"},
+		{"@service:user", mevt.MsgText, "the bot's own message"},
+	} {
+		event := mevt.Event{
+			Type:    mevt.EventMessage,
+			Sender:  msg.sender,
+			RoomID:  "!foo:bar",
+			Content: mevt.Content{Parsed: &mevt.MessageEventContent{MsgType: msg.msgType, Body: msg.body}},
+		}
+		clients.onMessageEvent(&botClient, &event)
+	}
+	if want := []string{"!test command", "a notice"}; !reflect.DeepEqual(s.heard, want) {
+		t.Errorf("TestMessageListener want %v, got %v", want, s.heard)
+	}
+}
+
+type MockDirectChatService struct {
+	MockService
+	directCommands []types.Command
+}
+
+func (s *MockDirectChatService) DirectChatCommands(cli types.MatrixClient, userID id.UserID) []types.Command {
+	return s.directCommands
+}
+
+func TestDirectChats(t *testing.T) {
+	var ran []string
+	command := func(name string) []types.Command {
+		return []types.Command{{
+			Path: []string{"test"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				ran = append(ran, name)
+				return nil, nil
+			},
+		}}
+	}
+	s := MockDirectChatService{MockService: MockService{commands: command("group")}, directCommands: command("direct")}
+	store := MockStore{service: &s}
+	database.SetServiceDB(&store)
+	clients := New(&store, &http.Client{})
+
+	direct := `{"@someone:somewhere":["!dm:bar"]}`
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		if !strings.HasSuffix(req.URL.Path, "/account_data/m.direct") {
+			return nil, fmt.Errorf("unhandled test path %s", req.URL.Path)
+		}
+		if req.Method == "PUT" {
+			body, _ := ioutil.ReadAll(req.Body)
+			direct = string(body)
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(direct))}, nil
+	}}}
+	botClient := BotClient{Client: mxCli}
+	send := func(eventID id.EventID, roomID id.RoomID) {
+		clients.onMessageEvent(&botClient, &mevt.Event{
+			ID:      eventID,
+			Type:    mevt.EventMessage,
+			Sender:  "@someone:somewhere",
+			RoomID:  roomID,
+			Content: mevt.Content{Parsed: &mevt.MessageEventContent{MsgType: mevt.MsgText, Body: "!test"}},
+		})
+	}
+
+	send("$1", "!dm:bar")
+	send("$2", "!foo:bar")
+	if want := []string{"direct", "group"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("TestDirectChats want %v, got %v", want, ran)
+	}
+
+	// Accepting an invite to a direct chat records it in m.direct.
+	if err := clients.directChats.add(mxCli, "!dm2:bar", "@other:somewhere"); err != nil {
+		t.Fatalf("Failed to add direct chat: %s", err)
+	}
+	if want := `{"@other:somewhere":["!dm2:bar"],"@someone:somewhere":["!dm:bar"]}`; direct != want {
+		t.Errorf("TestDirectChats want m.direct %s, got %s", want, direct)
+	}
+	ran = nil
+	send("$3", "!dm2:bar")
+	if want := []string{"direct"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("TestDirectChats want %v after the invite, got %v", want, ran)
+	}
+}
+
 func TestSASVerificationHandling(t *testing.T) {
 	botClient := BotClient{verificationSAS: &sync.Map{}}
 	botClient.olmMachine = &crypto.OlmMachine{
@@ -151,3 +267,1399 @@ func TestSASVerificationHandling(t *testing.T) {
 		t.Error("Verification did not finish after receiving the SAS from the correct user")
 	}
 }
+
+func TestFetchRoomState(t *testing.T) {
+	trans := struct{ MockTransport }{}
+	trans.roundTrip = func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/rooms/!encrypted:bar/state" {
+			return nil, fmt.Errorf("unhandled test path %s", req.URL.Path)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(`[
+				{"type":"m.room.encryption","state_key":"","content":{"algorithm":"m.megolm.v1.aes-sha2"}},
+				{"type":"m.room.member","state_key":"@service:user","content":{"membership":"join"}},
+				{"type":"m.room.member","state_key":"@someone:somewhere","content":{"membership":"leave"}}
+			]`)),
+		}, nil
+	}
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = &http.Client{Transport: trans}
+	ss := &NebStateStore{Storer: mautrix.NewInMemoryStore()}
+
+	if !ss.NeedsRoomState("!encrypted:bar") {
+		t.Fatal("Expected an unknown room to need its state fetching")
+	}
+	if err := ss.FetchRoomState(mxCli, "!encrypted:bar"); err != nil {
+		t.Fatal("Failed to fetch room state: ", err)
+	}
+	if ss.NeedsRoomState("!encrypted:bar") || !ss.IsEncrypted("!encrypted:bar") {
+		t.Error("Expected the fetched room to be known to be encrypted")
+	}
+	if members, err := ss.GetJoinedMembers("!encrypted:bar"); err != nil || !reflect.DeepEqual(members, []id.UserID{"@service:user"}) {
+		t.Errorf("Expected only @service:user to be joined, got %v (%v)", members, err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	var executed []string
+	command := func(name string) func(id.RoomID, id.UserID, []string) (interface{}, error) {
+		return func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			executed = append(executed, name)
+			return mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "Ran " + name}, nil
+		}
+	}
+	s := MockService{commands: []types.Command{
+		{Path: []string{"test"}, Command: command("test")},
+		{Path: []string{"look"}, Idempotent: true, Command: command("look")},
+		{Path: []string{"admin"}, Idempotent: true, Privileged: true, Command: command("admin")},
+	}}
+	store := MockStore{service: &s}
+	database.SetServiceDB(&store)
+	clients := New(&store, &http.Client{})
+	var sent []string
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/state") {
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`[]`))}, nil
+		}
+		if req.Method != "PUT" || !strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			t.Errorf("Read-only client made a request to %s", req.URL.Path)
+			return nil, fmt.Errorf("unhandled test path %s", req.URL.Path)
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, err
+		}
+		sent = append(sent, msg.Body)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$response"}`))}, nil
+	}}}
+	ss := &NebStateStore{Storer: mautrix.NewInMemoryStore()}
+	botClient := BotClient{
+		Client:     mxCli,
+		stateStore: ss,
+		olmMachine: &crypto.OlmMachine{StateStore: ss},
+		readOnly:   &readOnlyState{enabled: true},
+	}
+
+	for _, body := range []string{"!test", "!look", "!admin", "hello"} {
+		clients.onMessageEvent(&botClient, &mevt.Event{
+			ID: id.EventID("$" + body), Type: mevt.EventMessage, Sender: "@someone:somewhere", RoomID: "!foo:bar",
+			Content: mevt.Content{Parsed: &mevt.MessageEventContent{MsgType: mevt.MsgText, Body: body}},
+		})
+	}
+	if want := []string{"look"}; !reflect.DeepEqual(executed, want) {
+		t.Errorf("Read-only client executed %v, want %v", executed, want)
+	}
+	want := []string{
+		"!test can't be used while the bot is in read-only mode",
+		"Ran look",
+		"!admin can't be used while the bot is in read-only mode",
+	}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("Read-only client answered %v, want %v", sent, want)
+	}
+	if len(botClient.readOnly.queue) != 0 {
+		t.Errorf("Read-only client queued %d answers, want none", len(botClient.readOnly.queue))
+	}
+
+	if _, err := botClient.RedactEvent("!foo:bar", "$event"); err != ErrReadOnly {
+		t.Errorf("RedactEvent => %v, want ErrReadOnly", err)
+	}
+	for i := 0; i < maxQueuedMessages; i++ {
+		if _, err := botClient.SendMessageEvent("!foo:bar", mevt.EventMessage, mevt.MessageEventContent{Body: "hi"}); err != nil {
+			t.Fatalf("SendMessageEvent %d failed: %s", i, err)
+		}
+	}
+	if len(botClient.readOnly.queue) != maxQueuedMessages {
+		t.Errorf("Queued %d messages, want %d", len(botClient.readOnly.queue), maxQueuedMessages)
+	}
+	if _, err := botClient.SendMessageEvent("!foo:bar", mevt.EventMessage, mevt.MessageEventContent{Body: "hi"}); err != ErrReadOnly {
+		t.Errorf("SendMessageEvent with a full queue => %v, want ErrReadOnly", err)
+	}
+
+	botClient.readOnly.enabled = false
+	if err := clients.SetReadOnly("", true); err != nil || !botClient.IsReadOnly() {
+		t.Errorf("SetReadOnly for every client => %v, IsReadOnly %v, want true", err, botClient.IsReadOnly())
+	}
+	if err := clients.SetReadOnly("", false); err != nil || botClient.IsReadOnly() {
+		t.Errorf("SetReadOnly(false) for every client => %v, IsReadOnly %v, want false", err, botClient.IsReadOnly())
+	}
+}
+
+type MockACLStore struct {
+	MockStore
+	roomACL *types.ACL
+	stored  []types.BotOptions
+}
+
+func (d *MockACLStore) LoadBotOptions(userID id.UserID, roomID id.RoomID) (types.BotOptions, error) {
+	return types.BotOptions{Options: &types.BotOptionsContent{ACL: d.roomACL}}, nil
+}
+
+func (d *MockACLStore) StoreBotOptions(opts types.BotOptions) (types.BotOptions, error) {
+	d.stored = append(d.stored, opts)
+	return opts, nil
+}
+
+func TestPrivilegedCommands(t *testing.T) {
+	store := MockACLStore{}
+	database.SetServiceDB(&store)
+	clients := New(&store, &http.Client{})
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/rooms/!foo:bar/state/m.room.power_levels/" {
+			return nil, fmt.Errorf("unhandled test path %s", req.URL.Path)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"users":{"@mod:somewhere":50,"@admin:somewhere":100}}`)),
+		}, nil
+	}}}
+	botClient := BotClient{Client: mxCli}
+
+	cmd := &types.Command{Path: []string{"github", "close"}, Privileged: true}
+	s := &MockService{}
+	ten := 10
+	for _, tc := range []struct {
+		serviceACL *types.ACL
+		roomACL    *types.ACL
+		userID     id.UserID
+		want       bool
+	}{
+		{nil, nil, "@someone:somewhere", false},
+		{nil, nil, "@mod:somewhere", true},
+		{nil, &types.ACL{Users: []string{"@*:somewhere"}}, "@someone:somewhere", true},
+		{nil, &types.ACL{Users: []string{"@someone:somewhere"}}, "@admin:somewhere", false},
+		{nil, &types.ACL{PowerLevel: &ten}, "@mod:somewhere", true},
+		{&types.ACL{Users: []string{"@someone:somewhere"}}, &types.ACL{PowerLevel: &ten}, "@mod:somewhere", false},
+		{&types.ACL{}, &types.ACL{Users: []string{"@someone:somewhere"}}, "@someone:somewhere", true},
+	} {
+		s.ACL = tc.serviceACL
+		store.roomACL = tc.roomACL
+		err := clients.authoriseCommand(&botClient, s, cmd, "!foo:bar", tc.userID)
+		if got := err == nil; got != tc.want {
+			t.Errorf("authoriseCommand(service ACL %+v, room ACL %+v, %s) => %v, want allowed %v",
+				tc.serviceACL, tc.roomACL, tc.userID, err, tc.want)
+		}
+	}
+	if err := clients.authoriseCommand(&botClient, s, &types.Command{Path: []string{"github", "search"}}, "!foo:bar", "@nobody:somewhere"); err != nil {
+		t.Errorf("authoriseCommand for an unprivileged command => %v, want nil", err)
+	}
+
+	// Bot options can only be changed by users allowed by the room's ACL.
+	store.roomACL = nil
+	stateKey := "_@service:user"
+	for _, sender := range []id.UserID{"@someone:somewhere", "@mod:somewhere"} {
+		clients.onBotOptionsEvent(&botClient, &mevt.Event{
+			Type:     StateBotOptionsEvent,
+			Sender:   sender,
+			RoomID:   "!foo:bar",
+			StateKey: &stateKey,
+			Content:  mevt.Content{Parsed: &types.BotOptionsContent{Timezone: "Europe/London"}},
+		})
+	}
+	if len(store.stored) != 1 || store.stored[0].SetByUserID != "@mod:somewhere" {
+		t.Errorf("Expected only the moderator's bot options to be stored, got %+v", store.stored)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(api.RateLimit{PerUser: 2, PerRoom: 3})
+	now := time.Now()
+	allow := func(userID id.UserID, roomID id.RoomID) (bool, string) {
+		return rl.allow(userID, roomID, now)
+	}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := allow("@alice:hs", "!room:hs"); !ok {
+			t.Fatalf("command %d was refused", i+1)
+		}
+	}
+	if ok, reason := allow("@alice:hs", "!room:hs"); ok || reason == "" {
+		t.Errorf("third command: got %v %q, want a refusal with a reason", ok, reason)
+	}
+	if ok, reason := allow("@alice:hs", "!room:hs"); ok || reason != "" {
+		t.Errorf("fourth command: got %v %q, want a silent refusal", ok, reason)
+	}
+
+	// Bob has their own allowance, but the room only has one command left.
+	if ok, _ := allow("@bob:hs", "!room:hs"); !ok {
+		t.Error("bob's first command was refused")
+	}
+	if ok, reason := allow("@bob:hs", "!room:hs"); ok || reason == "" {
+		t.Errorf("room limit: got %v %q, want a refusal with a reason", ok, reason)
+	}
+	if ok, _ := allow("@bob:hs", "!other:hs"); !ok {
+		t.Error("bob's command in another room was refused")
+	}
+
+	// Half a minute refills one of Alice's commands.
+	now = now.Add(30 * time.Second)
+	if ok, _ := allow("@alice:hs", "!other:hs"); !ok {
+		t.Error("alice's command after waiting was refused")
+	}
+
+	var unlimited *rateLimiter
+	if ok, _ := unlimited.allow("@alice:hs", "!room:hs", now); !ok {
+		t.Error("a client without a rate limiter refused a command")
+	}
+}
+
+func TestInitialSyncFilter(t *testing.T) {
+	for backfill, want := range map[int]string{
+		0:  `{"room":{"timeline":{"limit":1}}}`,
+		20: `{"room":{"timeline":{"limit":20}}}`,
+	} {
+		if got := initialSyncFilter(backfill); got != want {
+			t.Errorf("initialSyncFilter(%d) => %s, want %s", backfill, got, want)
+		}
+	}
+}
+
+func TestDryRunClient(t *testing.T) {
+	var requests []string
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"joined_rooms": ["!foo:bar"]}`))}, nil
+	}}}
+	cli := NewDryRunClient(&BotClient{Client: mxCli})
+
+	if _, err := cli.JoinedRooms(); err != nil {
+		t.Errorf("JoinedRooms failed: %s", err)
+	}
+	content := mevt.MessageEventContent{MsgType: mevt.MsgText, Body: "hi"}
+	res, err := cli.SendMessageEvent("!foo:bar", mevt.EventMessage, content)
+	if err != nil || res.EventID != "$dry-run-1" {
+		t.Errorf("SendMessageEvent => %v, %v, want $dry-run-1", res, err)
+	}
+	if _, err := cli.RedactEvent("!foo:bar", "$event"); err != nil {
+		t.Errorf("RedactEvent failed: %s", err)
+	}
+	if _, err := cli.MakeRequest("PUT", cli.BuildBaseURL("_matrix", "client", "r0", "profile"), nil, nil); err != nil {
+		t.Errorf("MakeRequest failed: %s", err)
+	}
+
+	if want := []string{"GET /_matrix/client/r0/joined_rooms"}; !reflect.DeepEqual(requests, want) {
+		t.Errorf("Dry run client made requests %v, want %v", requests, want)
+	}
+	want := []DryRunAction{
+		{Action: "send", RoomID: "!foo:bar", Type: "m.room.message", Content: content},
+		{Action: "redact", RoomID: "!foo:bar", Target: "$event"},
+		{Action: "PUT", Target: "https://someplace.somewhere/_matrix/client/r0/profile"},
+	}
+	if got := cli.Actions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Actions() = %+v, want %+v", got, want)
+	}
+}
+
+type MockTargeterService struct {
+	MockService
+	rooms []id.RoomID
+}
+
+func (s *MockTargeterService) TargetRooms() []id.RoomID {
+	return s.rooms
+}
+
+func TestPublishCapabilities(t *testing.T) {
+	s := MockTargeterService{
+		MockService: MockService{
+			DefaultService: types.NewDefaultService("feeds", "@service:user", "rssbot"),
+			commands:       []types.Command{{Path: []string{"feeds", "add"}, Privileged: true}},
+		},
+		rooms: []id.RoomID{"!b:hs"},
+	}
+	store := MockStore{service: &s}
+	database.SetServiceDB(&store)
+	clients := New(&store, &http.Client{})
+
+	roomA := `{"services":[{"id":"feeds","type":"rssbot","commands":[{"command":"!feeds add","privileged":true}]}]}`
+	var requests []string
+	sent := make(map[string]string)
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		body := `{}`
+		code := 200
+		switch {
+		case req.URL.Path == "/_matrix/client/r0/joined_rooms":
+			body = `{"joined_rooms": ["!a:hs", "!b:hs"]}`
+		case req.Method == "GET" && strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!a:hs/state/org.goneb.services/"):
+			body = roomA
+		case req.Method == "PUT":
+			b, _ := ioutil.ReadAll(req.Body)
+			sent[req.URL.Path] = string(b)
+			body = `{"event_id": "$event"}`
+		default:
+			code = 404
+		}
+		return &http.Response{StatusCode: code, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	}}}
+	clients.setClient(BotClient{Client: mxCli, config: api.ClientConfig{UserID: "@service:user"}})
+
+	clients.PublishCapabilities("@service:user")
+	want := map[string]string{
+		"/_matrix/client/r0/rooms/!b:hs/state/org.goneb.services/@service:user": `{"services":[{"id":"feeds","type":"rssbot","commands":[{"command":"!feeds add","privileged":true}],"notifications":true}]}`,
+	}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("Published %v, want %v", sent, want)
+	}
+
+	requests = nil
+	clients.PublishCapabilities("@service:user")
+	if want := []string{"GET /_matrix/client/r0/joined_rooms"}; !reflect.DeepEqual(requests, want) {
+		t.Errorf("Publishing unchanged capabilities made requests %v, want %v", requests, want)
+	}
+}
+
+func TestMentionRoom(t *testing.T) {
+	powerLevels := map[id.RoomID]string{
+		"!ops:hs":   `{"users": {"@service:user": 50}}`,
+		"!quiet:hs": `{"users": {"@service:user": 50}, "notifications": {"room": 100}}`,
+	}
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		for roomID, pl := range powerLevels {
+			if strings.Contains(req.URL.Path, "/rooms/"+roomID.String()+"/state/m.room.power_levels") {
+				return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(pl))}, nil
+			}
+		}
+		return nil, fmt.Errorf("unhandled test path %s", req.URL.Path)
+	}}}
+	botClient := BotClient{Client: mxCli, roomMentions: newRoomMentions(0)}
+
+	msg := matrix.MentionRoomMessage{
+		MessageEventContent: mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "Disk full"},
+		MentionRoom:         true,
+	}
+	if got := botClient.mentionRoom("!ops:hs", msg).Body; got != "@room: Disk full" {
+		t.Errorf("first mention => %q, want the room mentioned", got)
+	}
+	if got := botClient.mentionRoom("!ops:hs", msg).Body; got != "Disk full" {
+		t.Errorf("second mention => %q, want it throttled", got)
+	}
+	if got := botClient.mentionRoom("!quiet:hs", msg).Body; got != "Disk full" {
+		t.Errorf("mention without the power level => %q, want no mention", got)
+	}
+
+	msg.MentionRoom = false
+	if got := botClient.mentionRoom("!other:hs", msg).Body; got != "Disk full" {
+		t.Errorf("message without mention_room => %q, want no mention", got)
+	}
+	// The cooldown is per room.
+	now := time.Now()
+	if !botClient.roomMentions.allow("!other:hs", now) {
+		t.Error("a room which hasn't been mentioned was throttled")
+	}
+	if !botClient.roomMentions.allow("!ops:hs", now.Add(api.DefaultRoomMentionCooldown*time.Minute)) {
+		t.Error("a room was still throttled after the cooldown")
+	}
+}
+
+func TestCommandEdits(t *testing.T) {
+	s := MockService{commands: []types.Command{{
+		Path: []string{"test"},
+		Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			if len(args) != 1 || args[0] != "right" {
+				return nil, fmt.Errorf("Unknown argument")
+			}
+			return mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "Done"}, nil
+		},
+	}}}
+	store := MockStore{service: &s}
+	database.SetServiceDB(&store)
+	clients := New(&store, &http.Client{})
+
+	var sent []mevt.MessageEventContent
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/state") {
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`[]`))}, nil
+		}
+		if req.Method != "PUT" || !strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			return nil, fmt.Errorf("unhandled test path %s", req.URL.Path)
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, err
+		}
+		sent = append(sent, msg)
+		body := fmt.Sprintf(`{"event_id":"$response%d"}`, len(sent))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	}}}
+	ss := &NebStateStore{Storer: mautrix.NewInMemoryStore()}
+	botClient := BotClient{
+		Client:       mxCli,
+		stateStore:   ss,
+		olmMachine:   &crypto.OlmMachine{StateStore: ss},
+		commandEdits: newCommandEdits(5),
+	}
+	send := func(eventID id.EventID, content *mevt.MessageEventContent) {
+		clients.onMessageEvent(&botClient, &mevt.Event{
+			ID:      eventID,
+			Type:    mevt.EventMessage,
+			Sender:  "@someone:somewhere",
+			RoomID:  "!foo:bar",
+			Content: mevt.Content{Parsed: content},
+		})
+	}
+	edit := func(eventID id.EventID, body string) {
+		send(eventID, &mevt.MessageEventContent{
+			MsgType:    mevt.MsgText,
+			Body:       "* " + body,
+			NewContent: &mevt.MessageEventContent{MsgType: mevt.MsgText, Body: body},
+			RelatesTo:  &mevt.RelatesTo{Type: mevt.RelReplace, EventID: "$command"},
+		})
+	}
+
+	send("$command", &mevt.MessageEventContent{MsgType: mevt.MsgText, Body: "!test wrnog"})
+	if len(sent) != 1 || sent[0].Body != "Unknown argument" {
+		t.Fatalf("Expected an error response to the command, got %+v", sent)
+	}
+
+	edit("$edit1", "!test right")
+	if len(sent) != 2 {
+		t.Fatalf("Expected the edited command to be run, got %+v", sent)
+	}
+	if rel := sent[1].RelatesTo; rel == nil || rel.Type != mevt.RelReplace || rel.EventID != "$response1" {
+		t.Errorf("Expected the error response to be edited, got %+v", rel)
+	}
+	if sent[1].NewContent == nil || sent[1].NewContent.Body != "Done" {
+		t.Errorf("Expected the edit to contain the new response, got %+v", sent[1].NewContent)
+	}
+
+	// The command succeeded, so editing it again doesn't run it again.
+	edit("$edit2", "!test right")
+	if len(sent) != 2 {
+		t.Errorf("Expected a successful command not to be run again, got %+v", sent[2:])
+	}
+}
+
+func TestReplies(t *testing.T) {
+	respond := func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+		return mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "Done"}, nil
+	}
+	s := MockService{commands: []types.Command{
+		{Path: []string{"thread"}, Command: respond},
+		{Path: []string{"reply"}, Command: respond, Replies: types.RepliesReply},
+		{Path: []string{"plain"}, Command: respond, Replies: types.RepliesPlain},
+	}}
+	s.Replies = types.RepliesThread
+	store := MockStore{service: &s}
+	database.SetServiceDB(&store)
+	clients := New(&store, &http.Client{})
+
+	var sent []map[string]interface{}
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/state") {
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`[]`))}, nil
+		}
+		if req.Method != "PUT" || !strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			return nil, fmt.Errorf("unhandled test path %s", req.URL.Path)
+		}
+		var msg struct {
+			RelatesTo map[string]interface{} `json:"m.relates_to"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, err
+		}
+		sent = append(sent, msg.RelatesTo)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$response"}`))}, nil
+	}}}
+	ss := &NebStateStore{Storer: mautrix.NewInMemoryStore()}
+	botClient := BotClient{
+		Client:       mxCli,
+		stateStore:   ss,
+		olmMachine:   &crypto.OlmMachine{StateStore: ss},
+		commandEdits: newCommandEdits(5),
+	}
+	send := func(eventID id.EventID, content *mevt.MessageEventContent) {
+		clients.onMessageEvent(&botClient, &mevt.Event{
+			ID:      eventID,
+			Type:    mevt.EventMessage,
+			Sender:  "@someone:somewhere",
+			RoomID:  "!foo:bar",
+			Content: mevt.Content{Parsed: content},
+		})
+	}
+
+	for _, tc := range []struct {
+		eventID   id.EventID
+		body      string
+		relatesTo map[string]interface{}
+	}{
+		{"$thread", "!thread", map[string]interface{}{
+			"rel_type":        "m.thread",
+			"event_id":        "$thread",
+			"is_falling_back": true,
+			"m.in_reply_to":   map[string]interface{}{"event_id": "$thread"},
+		}},
+		{"$reply", "!reply", map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$reply"}}},
+		{"$plain", "!plain", nil},
+	} {
+		sent = nil
+		send(tc.eventID, &mevt.MessageEventContent{MsgType: mevt.MsgText, Body: tc.body})
+		if len(sent) != 1 || !reflect.DeepEqual(sent[0], tc.relatesTo) {
+			t.Errorf("TestReplies %s: want a response related by %+v, got %+v", tc.body, tc.relatesTo, sent)
+		}
+	}
+
+	// The response to a corrected command in a thread is sent in the thread, even though the
+	// edit isn't in it.
+	sent = nil
+	send("$command", &mevt.MessageEventContent{
+		MsgType:   mevt.MsgText,
+		Body:      "!thraed",
+		RelatesTo: &mevt.RelatesTo{Type: "m.thread", EventID: "$root"},
+	})
+	send("$edit", &mevt.MessageEventContent{
+		MsgType:    mevt.MsgText,
+		Body:       "* !thread",
+		NewContent: &mevt.MessageEventContent{MsgType: mevt.MsgText, Body: "!thread"},
+		RelatesTo:  &mevt.RelatesTo{Type: mevt.RelReplace, EventID: "$command"},
+	})
+	want := map[string]interface{}{
+		"rel_type":        "m.thread",
+		"event_id":        "$root",
+		"is_falling_back": true,
+		"m.in_reply_to":   map[string]interface{}{"event_id": "$command"},
+	}
+	if len(sent) != 1 || !reflect.DeepEqual(sent[0], want) {
+		t.Errorf("TestReplies: want the corrected command's response related by %+v, got %+v", want, sent)
+	}
+}
+
+func TestNotificationDedupe(t *testing.T) {
+	var sent []mevt.MessageEventContent
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/state") {
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`[]`))}, nil
+		}
+		if req.Method != "PUT" || !strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			return nil, fmt.Errorf("unhandled test path %s", req.URL.Path)
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, err
+		}
+		sent = append(sent, msg)
+		body := fmt.Sprintf(`{"event_id":"$notification%d"}`, len(sent))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	}}}
+	ss := &NebStateStore{Storer: mautrix.NewInMemoryStore()}
+	botClient := BotClient{
+		Client:             mxCli,
+		stateStore:         ss,
+		olmMachine:         &crypto.OlmMachine{StateStore: ss},
+		notificationDedupe: newNotificationDedupe(60),
+	}
+	notify := func(roomID id.RoomID, correlationID, body string) id.EventID {
+		res, err := botClient.SendMessageEvent(roomID, mevt.EventMessage, matrix.CorrelatedMessage{
+			MessageEventContent: mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: body},
+			CorrelationID:       correlationID,
+		})
+		if err != nil {
+			t.Fatalf("Failed to send %q: %s", body, err)
+		}
+		return res.EventID
+	}
+
+	notify("!foo:bar", "matrix-org/go-neb@abc", "alice pushed to main")
+	notify("!foo:bar", "matrix-org/go-neb@abc", "Build #1 passed")
+	if len(sent) != 2 {
+		t.Fatalf("Expected a message and an edit, got %+v", sent)
+	}
+	if rel := sent[1].RelatesTo; rel == nil || rel.Type != mevt.RelReplace || rel.EventID != "$notification1" {
+		t.Errorf("Expected the first notification to be edited, got %+v", rel)
+	}
+	if sent[1].NewContent == nil || sent[1].NewContent.Body != "alice pushed to main\nBuild #1 passed" {
+		t.Errorf("Expected the edit to combine the notifications, got %+v", sent[1].NewContent)
+	}
+
+	// Repeats are dropped
+	if eventID := notify("!foo:bar", "matrix-org/go-neb@abc", "Build #1 passed"); eventID != "$notification1" || len(sent) != 2 {
+		t.Errorf("Expected a repeated notification to be dropped, got %s and %+v", eventID, sent[2:])
+	}
+	// Other rooms and correlation IDs get their own messages
+	notify("!other:bar", "matrix-org/go-neb@abc", "alice pushed to main")
+	notify("!foo:bar", "matrix-org/go-neb@def", "bob pushed to main")
+	if len(sent) != 4 || sent[2].RelatesTo != nil || sent[3].RelatesTo != nil {
+		t.Errorf("Expected new messages for another room and commit, got %+v", sent[2:])
+	}
+
+	// Notifications after the window get their own messages
+	botClient.notificationDedupe.sent[dedupeKey{"!foo:bar", "matrix-org/go-neb@abc"}].sent = time.Now().Add(-time.Minute)
+	notify("!foo:bar", "matrix-org/go-neb@abc", "Build #2 passed")
+	if len(sent) != 5 || sent[4].RelatesTo != nil {
+		t.Errorf("Expected a new message after the window, got %+v", sent[4:])
+	}
+}
+
+func TestDeliveryClient(t *testing.T) {
+	s := MockTargeterService{
+		MockService: MockService{DefaultService: types.NewDefaultService("hooks", "@service:user", "github-webhook")},
+		rooms:       []id.RoomID{"!kicked:hs", "!banned:hs"},
+	}
+	s.Owner = "@owner:hs"
+	var requests []string
+	direct := ""
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		body := `{"event_id": "$event"}`
+		code := 200
+		switch {
+		case req.URL.Path == "/_matrix/client/r0/user/@service:user/account_data/m.direct":
+			if req.Method == "PUT" {
+				data, _ := ioutil.ReadAll(req.Body)
+				direct, body = string(data), `{}`
+			} else if direct == "" {
+				code, body = 404, `{"errcode": "M_NOT_FOUND", "error": "Account data not found"}`
+			} else {
+				body = direct
+			}
+		case req.URL.Path == "/_matrix/client/r0/joined_rooms":
+			body = `{"joined_rooms": ["!joined:hs"]}`
+		case req.URL.Path == "/_matrix/client/r0/join/!banned:hs":
+			code, body = 403, `{"errcode": "M_FORBIDDEN", "error": "You are banned"}`
+		case req.URL.Path == "/_matrix/client/r0/join/!kicked:hs":
+			body = `{"room_id": "!kicked:hs"}`
+		case req.URL.Path == "/_matrix/client/r0/createRoom":
+			body = `{"room_id": "!dm:hs"}`
+		}
+		return &http.Response{StatusCode: code, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	}}}
+	cli := NewDeliveryClient(mxCli, &s)
+	send := func(roomID id.RoomID) error {
+		_, err := cli.SendMessageEvent(roomID, mevt.EventMessage, mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "hi"})
+		return err
+	}
+
+	if err := send("!joined:hs"); err != nil {
+		t.Errorf("Failed to send into a joined room: %s", err)
+	}
+	if err := send("!kicked:hs"); err != nil {
+		t.Errorf("Failed to rejoin a room the service sends into: %s", err)
+	}
+	if err := send("!typo:hs"); err == nil {
+		t.Error("Expected sending into a room the service doesn't send into to fail")
+	}
+	if err := send("!banned:hs"); err == nil {
+		t.Error("Expected sending into a room which can't be joined to fail")
+	}
+	if err := send("!typo:hs"); err == nil {
+		t.Error("Expected sending into a room the service doesn't send into to fail")
+	}
+	want := []string{
+		"GET /_matrix/client/r0/joined_rooms",
+		"PUT /_matrix/client/r0/rooms/!joined:hs/send/m.room.message/",
+		"POST /_matrix/client/r0/join/!kicked:hs",
+		"PUT /_matrix/client/r0/rooms/!kicked:hs/send/m.room.message/",
+		"GET /_matrix/client/r0/user/@service:user/account_data/m.direct",
+		"POST /_matrix/client/r0/createRoom",
+		"PUT /_matrix/client/r0/user/@service:user/account_data/m.direct",
+		"PUT /_matrix/client/r0/rooms/!dm:hs/send/m.room.message/",
+		"POST /_matrix/client/r0/join/!banned:hs",
+		"GET /_matrix/client/r0/user/@service:user/account_data/m.direct",
+		"PUT /_matrix/client/r0/rooms/!dm:hs/send/m.room.message/",
+	}
+	for i := range requests {
+		// Strip transaction IDs
+		if strings.Contains(requests[i], "/send/") {
+			requests[i] = requests[i][:strings.LastIndex(requests[i], "/")+1]
+		}
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("Delivery client made requests %v, want %v", requests, want)
+	}
+
+	failures := DeliveryFailures()
+	if len(failures) != 1 || failures[0].ServiceID != "hooks" || len(failures[0].Rooms) != 2 {
+		t.Fatalf("DeliveryFailures() = %+v, want the banned and mistyped rooms", failures)
+	}
+	if typo := failures[0].Rooms[1]; typo.RoomID != "!typo:hs" || typo.ConsecutiveFailures != 2 {
+		t.Errorf("Expected 2 failures to send into the mistyped room, got %+v", typo)
+	}
+	if direct != `{"@owner:hs":["!dm:hs"]}` {
+		t.Errorf("Expected the direct chat with the owner to be stored in m.direct, got %s", direct)
+	}
+}
+
+func TestDeliveryRetryBudget(t *testing.T) {
+	deliveryRetryDelay, deliveryRetryBudget = time.Millisecond, 3*time.Millisecond
+	defer func() { deliveryRetryDelay, deliveryRetryBudget = 2*time.Second, 10*time.Second }()
+	s := MockTargeterService{
+		MockService: MockService{DefaultService: types.NewDefaultService("alerts", "@service:user", "alertmanager")},
+		rooms:       []id.RoomID{"!flaky:hs"},
+	}
+	attempts := 0
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		code, body := 200, `{"joined_rooms": ["!flaky:hs"]}`
+		if strings.Contains(req.URL.Path, "/send/") {
+			attempts++
+			code, body = 502, `{}`
+		}
+		return &http.Response{StatusCode: code, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	}}}
+	cli := NewDeliveryClient(mxCli, &s)
+
+	content := mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "Disk full"}
+	for i := 0; i < 2; i++ {
+		if _, err := cli.SendMessageEvent("!flaky:hs", mevt.EventMessage, content); err == nil {
+			t.Error("Expected sending into a failing room to fail")
+		}
+	}
+	// The first send waits 1ms then 2ms between its 3 attempts, which uses up the budget.
+	if attempts != deliveryAttempts+1 {
+		t.Errorf("Made %d attempts, want %d", attempts, deliveryAttempts+1)
+	}
+}
+
+func TestDeliveryFallback(t *testing.T) {
+	deliveryRetryDelay = 0
+	defer func() { deliveryRetryDelay = 2 * time.Second }()
+	s := MockTargeterService{
+		MockService: MockService{DefaultService: types.NewDefaultService("alerts", "@service:user", "alertmanager")},
+		rooms:       []id.RoomID{"!gone:hs", "!flaky:hs"},
+	}
+	s.FallbackRoomID = "!fallback:hs"
+	flakyAttempts := 0
+	sent := make(map[id.RoomID][]string)
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		body := `{"event_id": "$event"}`
+		code := 200
+		switch {
+		case req.URL.Path == "/_matrix/client/r0/joined_rooms":
+			body = `{"joined_rooms": ["!gone:hs", "!flaky:hs", "!fallback:hs"]}`
+		case strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!gone:hs/send/"):
+			code, body = 403, `{"errcode": "M_FORBIDDEN", "error": "Not in room"}`
+		case strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!flaky:hs/send/"):
+			if flakyAttempts++; flakyAttempts < deliveryAttempts {
+				code, body = 502, `{}`
+			}
+		}
+		if code == 200 && strings.Contains(req.URL.Path, "/send/") {
+			var content mevt.MessageEventContent
+			if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+				t.Fatal("Failed to decode message: ", err)
+			}
+			roomID := id.RoomID(strings.Split(req.URL.Path, "/")[5])
+			sent[roomID] = append(sent[roomID], content.Body)
+		}
+		return &http.Response{StatusCode: code, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	}}}
+	cli := NewDeliveryClient(mxCli, &s)
+
+	content := mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "Disk full"}
+	if _, err := cli.SendMessageEvent("!flaky:hs", mevt.EventMessage, content); err != nil {
+		t.Errorf("Expected sending to be retried, got %s", err)
+	}
+	if _, err := cli.SendMessageEvent("!gone:hs", mevt.EventMessage, content); err != nil {
+		t.Errorf("Expected the notification to be sent into the fallback room, got %s", err)
+	}
+	want := map[id.RoomID][]string{
+		"!flaky:hs":    {"Disk full"},
+		"!fallback:hs": {"Couldn't send this notification into !gone:hs: M_FORBIDDEN: Not in room\nDisk full"},
+	}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("Sent %q, want %q", sent, want)
+	}
+}
+
+func TestDeliveryRoomProfiles(t *testing.T) {
+	newService := func(serviceID, name string) *MockTargeterService {
+		s := &MockTargeterService{
+			MockService: MockService{DefaultService: types.NewDefaultService(serviceID, "@service:user", "alertmanager")},
+			rooms:       []id.RoomID{"!shared:hs"},
+		}
+		s.SenderUserID = "@notifier:hs"
+		s.RoomProfiles = map[id.RoomID]types.RoomProfile{"!shared:hs": {DisplayName: name}}
+		return s
+	}
+	ci, alerts := newService("ci", "CI"), newService("alerts", "Alerts")
+	if sender := NotificationSender(ci); sender != "@notifier:hs" {
+		t.Errorf("NotificationSender => %s, want @notifier:hs", sender)
+	}
+
+	var requests []string
+	member := `{"membership": "join", "displayname": "notifier"}`
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@notifier:hs", "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		body := `{"event_id": "$event"}`
+		switch {
+		case req.URL.Path == "/_matrix/client/r0/joined_rooms":
+			body = `{"joined_rooms": ["!shared:hs"]}`
+		case strings.HasSuffix(req.URL.Path, "/state/m.room.member/@notifier:hs"):
+			if req.Method == "GET" {
+				body = member
+			} else {
+				data, _ := ioutil.ReadAll(req.Body)
+				member = string(data)
+			}
+		}
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	}}}
+	send := func(service types.Service) {
+		content := mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "hi"}
+		if _, err := NewDeliveryClient(mxCli, service).SendMessageEvent("!shared:hs", mevt.EventMessage, content); err != nil {
+			t.Fatalf("Failed to send: %s", err)
+		}
+	}
+
+	send(ci)
+	send(ci)
+	send(alerts)
+	want := []string{
+		"GET /_matrix/client/r0/joined_rooms",
+		"GET /_matrix/client/r0/rooms/!shared:hs/state/m.room.member/@notifier:hs",
+		"PUT /_matrix/client/r0/rooms/!shared:hs/state/m.room.member/@notifier:hs",
+		"PUT /_matrix/client/r0/rooms/!shared:hs/send/m.room.message/",
+		// The profile is already set
+		"GET /_matrix/client/r0/joined_rooms",
+		"PUT /_matrix/client/r0/rooms/!shared:hs/send/m.room.message/",
+		// Another service switches to its profile
+		"GET /_matrix/client/r0/joined_rooms",
+		"GET /_matrix/client/r0/rooms/!shared:hs/state/m.room.member/@notifier:hs",
+		"PUT /_matrix/client/r0/rooms/!shared:hs/state/m.room.member/@notifier:hs",
+		"PUT /_matrix/client/r0/rooms/!shared:hs/send/m.room.message/",
+	}
+	for i := range requests {
+		// Strip transaction IDs
+		if strings.Contains(requests[i], "/send/") {
+			requests[i] = requests[i][:strings.LastIndex(requests[i], "/")+1]
+		}
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("Delivery client made requests %v, want %v", requests, want)
+	}
+	if member != `{"membership":"join","displayname":"Alerts"}` {
+		t.Errorf("Member event is %s, want the alerts profile", member)
+	}
+}
+
+func TestSetAvatar(t *testing.T) {
+	avatarPath := filepath.Join(t.TempDir(), "bot.png")
+	if err := ioutil.WriteFile(avatarPath, []byte("\x89PNG\r\n\x1a\nnot really"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var requests []string
+	accountData := `{"errcode": "M_NOT_FOUND"}`
+	avatarURL := ""
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@bot:hs", "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		code, body := 200, `{}`
+		var data []byte
+		if req.Body != nil {
+			data, _ = ioutil.ReadAll(req.Body)
+		}
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/account_data/"+avatarAccountDataType) && req.Method == "GET":
+			if strings.Contains(accountData, "M_NOT_FOUND") {
+				code = 404
+			}
+			body = accountData
+		case strings.HasSuffix(req.URL.Path, "/account_data/"+avatarAccountDataType):
+			accountData = string(data)
+		case strings.HasSuffix(req.URL.Path, "/upload"):
+			if req.Header.Get("Content-Type") != "image/png" || req.URL.Query().Get("filename") != "bot.png" {
+				t.Errorf("Bad upload: %s %s", req.Header.Get("Content-Type"), req.URL)
+			}
+			body = `{"content_uri": "mxc://hs/avatar"}`
+		case strings.HasSuffix(req.URL.Path, "/avatar_url") && req.Method == "GET":
+			body = fmt.Sprintf(`{"avatar_url": %q}`, avatarURL)
+		case strings.HasSuffix(req.URL.Path, "/avatar_url"):
+			var content struct {
+				AvatarURL string `json:"avatar_url"`
+			}
+			json.Unmarshal(data, &content)
+			avatarURL = content.AvatarURL
+		}
+		return &http.Response{StatusCode: code, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	}}}
+
+	// The image is uploaded the first time, then the upload is reused.
+	for i := 0; i < 2; i++ {
+		if err := setAvatar(mxCli, avatarPath); err != nil {
+			t.Fatalf("setAvatar: %s", err)
+		}
+	}
+	want := []string{
+		"GET /_matrix/client/r0/user/@bot:hs/account_data/" + avatarAccountDataType,
+		"POST /_matrix/media/r0/upload",
+		"PUT /_matrix/client/r0/user/@bot:hs/account_data/" + avatarAccountDataType,
+		"GET /_matrix/client/r0/profile/@bot:hs/avatar_url",
+		"PUT /_matrix/client/r0/profile/@bot:hs/avatar_url",
+		"GET /_matrix/client/r0/user/@bot:hs/account_data/" + avatarAccountDataType,
+		"GET /_matrix/client/r0/profile/@bot:hs/avatar_url",
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("setAvatar made requests %v, want %v", requests, want)
+	}
+	if avatarURL != "mxc://hs/avatar" {
+		t.Errorf("Avatar is %q, want mxc://hs/avatar", avatarURL)
+	}
+
+	// mxc:// URIs are used as they are.
+	requests = nil
+	if err := setAvatar(mxCli, "mxc://hs/other"); err != nil {
+		t.Fatalf("setAvatar: %s", err)
+	}
+	if avatarURL != "mxc://hs/other" || len(requests) != 2 {
+		t.Errorf("Avatar is %q after requests %v, want mxc://hs/other without uploading", avatarURL, requests)
+	}
+	if err := setAvatar(mxCli, filepath.Join(t.TempDir(), "missing.png")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+type cleanupStore struct {
+	database.NopStorage
+	services   []types.Service
+	botOptions map[id.UserID][]id.RoomID
+	configs    []api.ClientConfig
+}
+
+func (s *cleanupStore) LoadServices() ([]types.Service, map[string]bool, error) {
+	return s.services, nil, nil
+}
+
+func (s *cleanupStore) LoadBotOptionsRooms() (map[id.UserID][]id.RoomID, error) {
+	return s.botOptions, nil
+}
+
+func (s *cleanupStore) LoadMatrixClientConfigs() ([]api.ClientConfig, error) {
+	return s.configs, nil
+}
+
+func TestLeaveUnusedRooms(t *testing.T) {
+	alerts := MockTargeterService{
+		MockService: MockService{DefaultService: types.NewDefaultService("alerts", "@service:user", "alertmanager")},
+		rooms:       []id.RoomID{"!alerts:hs"},
+	}
+	alerts.SenderUserID = "@sender:user"
+	alerts.FallbackRoomID = "!fallback:hs"
+	giphy := MockService{DefaultService: types.NewDefaultService("giphy", "@commands:user", "giphy")}
+	deploys := MockTargeterService{
+		MockService: MockService{
+			DefaultService: types.NewDefaultService("deploys", "@deploys:user", "deploy"),
+			commands:       []types.Command{{Path: []string{"deploy"}}},
+		},
+		rooms: []id.RoomID{"!deploys:hs"},
+	}
+	store := cleanupStore{
+		services:   []types.Service{&alerts, &giphy, &deploys},
+		botOptions: map[id.UserID][]id.RoomID{"@service:user": {"!options:hs"}},
+		configs: []api.ClientConfig{
+			{UserID: "@service:user"}, {UserID: "@sender:user"}, {UserID: "@commands:user"},
+			{UserID: "@deploys:user"}, {UserID: "@idle:user"},
+		},
+	}
+	database.SetServiceDB(&store)
+	clients := New(&store, &http.Client{})
+
+	var left []string
+	for userID, joined := range map[id.UserID]string{
+		"@service:user":  `["!alerts:hs", "!fallback:hs", "!options:hs", "!dm:hs", "!old:hs"]`,
+		"@sender:user":   `["!alerts:hs", "!stale:hs"]`,
+		"@commands:user": `["!anywhere:hs"]`,
+		"@deploys:user":  `["!deploys:hs", "!chat:hs"]`,
+		"@idle:user":     `["!idle:hs"]`,
+	} {
+		userID, joined := userID, joined
+		mxCli, _ := mautrix.NewClient("https://someplace.somewhere", userID, "token")
+		mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+			code, body := 200, `{}`
+			switch {
+			case req.URL.Path == "/_matrix/client/r0/joined_rooms":
+				body = `{"joined_rooms": ` + joined + `}`
+			case strings.HasSuffix(req.URL.Path, "/account_data/m.direct") && userID == "@service:user":
+				body = `{"@someone:hs": ["!dm:hs"]}`
+			case strings.HasSuffix(req.URL.Path, "/leave") || strings.HasSuffix(req.URL.Path, "/forget"):
+				left = append(left, string(userID)+" "+req.URL.Path)
+			default:
+				code, body = 404, `{"errcode": "M_NOT_FOUND"}`
+			}
+			return &http.Response{StatusCode: code, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+		}}}
+		clients.setClient(BotClient{Client: mxCli, config: api.ClientConfig{UserID: userID}})
+	}
+
+	want := CleanupReport{
+		LeftRooms: []LeftRoom{
+			{"@sender:user", "!stale:hs"},
+			{"@service:user", "!old:hs"},
+		},
+		SkippedClients: []id.UserID{"@commands:user", "@deploys:user", "@idle:user"},
+	}
+	report, err := clients.LeaveUnusedRooms(true)
+	if err != nil {
+		t.Fatalf("LeaveUnusedRooms: %s", err)
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("Dry run reported %+v, want %+v", report, want)
+	}
+	if len(left) != 0 {
+		t.Errorf("Dry run left rooms: %v", left)
+	}
+
+	if report, err = clients.LeaveUnusedRooms(false); err != nil {
+		t.Fatalf("LeaveUnusedRooms: %s", err)
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("Reported %+v, want %+v", report, want)
+	}
+	wantLeft := []string{
+		"@sender:user /_matrix/client/r0/rooms/!stale:hs/leave",
+		"@sender:user /_matrix/client/r0/rooms/!stale:hs/forget",
+		"@service:user /_matrix/client/r0/rooms/!old:hs/leave",
+		"@service:user /_matrix/client/r0/rooms/!old:hs/forget",
+	}
+	if !reflect.DeepEqual(left, wantLeft) {
+		t.Errorf("Left rooms with requests %v, want %v", left, wantLeft)
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	var ran []string
+	command := func(name string) func(id.RoomID, id.UserID, []string) (interface{}, error) {
+		return func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+			ran = append(ran, name)
+			return mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "Ran " + name}, nil
+		}
+	}
+	s := MockService{commands: []types.Command{
+		{Path: []string{"look"}, Idempotent: true, Command: command("look")},
+		{Path: []string{"deploy"}, Command: command("deploy")},
+	}}
+	store := MockStore{service: &s}
+	database.SetServiceDB(&store)
+	clients := New(&store, &http.Client{})
+
+	var sent []string
+	var messagesQueries []string
+	mxCli, _ := mautrix.NewClient("https://someplace.somewhere", "@service:user", "token")
+	mxCli.Client = &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		body := `{}`
+		switch {
+		case req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/state"):
+			body = `[]`
+		case req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/rooms/!room:hs/messages":
+			q := req.URL.Query()
+			messagesQueries = append(messagesQueries, q.Get("from")+" "+q.Get("to")+" "+q.Get("dir"))
+			// Newest first
+			body = `{"chunk": [
+				{"event_id": "$4", "type": "m.room.message", "sender": "@service:user", "content": {"msgtype": "m.text", "body": "!deploy mine"}},
+				{"event_id": "$3", "type": "m.room.message", "sender": "@alice:hs", "content": {"msgtype": "m.text", "body": "!deploy prod"}},
+				{"event_id": "$2", "type": "m.room.member", "state_key": "@alice:hs", "sender": "@alice:hs", "content": {"membership": "join"}},
+				{"event_id": "$1", "type": "m.room.message", "sender": "@alice:hs", "content": {"msgtype": "m.text", "body": "!look up"}},
+				{"event_id": "$0", "type": "m.room.message", "sender": "@alice:hs", "content": {"msgtype": "m.text", "body": "!unknown"}}
+			], "start": "p1", "end": ""}`
+		case req.Method == "PUT" && strings.Contains(req.URL.Path, "/send/m.room.message/"):
+			var msg mevt.MessageEventContent
+			if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+				return nil, err
+			}
+			sent = append(sent, msg.Body)
+			body = `{"event_id": "$response"}`
+		default:
+			return nil, fmt.Errorf("unhandled test path %s %s", req.Method, req.URL.Path)
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	}}}
+	ss := &NebStateStore{Storer: mautrix.NewInMemoryStore()}
+	botClient := BotClient{
+		Client:       mxCli,
+		config:       api.ClientConfig{UserID: "@service:user", CatchUp: api.CatchUpRun},
+		stateStore:   ss,
+		olmMachine:   &crypto.OlmMachine{StateStore: ss},
+		commandEdits: newCommandEdits(0),
+	}
+	var resp mautrix.RespSync
+	if err := json.Unmarshal([]byte(`{"rooms": {"join": {"!room:hs": {"timeline": {"limited": true, "prev_batch": "p1", "events": []}}}}}`), &resp); err != nil {
+		t.Fatal(err)
+	}
+	listener := clients.catchUpListener(&botClient)
+
+	// The first sync of a device has nothing to catch up on.
+	listener(&resp, "")
+	if len(messagesQueries) != 0 {
+		t.Errorf("Expected no catching up on the first sync, got %v", messagesQueries)
+	}
+
+	listener(&resp, "s1")
+	if want := []string{"p1 s1 b"}; !reflect.DeepEqual(messagesQueries, want) {
+		t.Errorf("Fetched missed events with %v, want %v", messagesQueries, want)
+	}
+	if want := []string{"look"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("Ran missed commands %v, want only the idempotent %v", ran, want)
+	}
+	want := []string{
+		"Ran look",
+		"These commands were sent while I was offline and weren't run. Please send them again if they are still needed:\n!deploy prod from @alice:hs",
+	}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("Sent %q, want %q", sent, want)
+	}
+
+	// Events are only caught up on once.
+	sent = nil
+	listener(&resp, "s1")
+	if len(ran) != 1 || len(sent) != 0 {
+		t.Errorf("Expected missed events to be handled once, ran %v and sent %q", ran, sent)
+	}
+
+	// Rooms which aren't caught up in aren't fetched.
+	botClient.config.CatchUpRooms = []id.RoomID{"!other:hs"}
+	messagesQueries = nil
+	listener(&resp, "s1")
+	if len(messagesQueries) != 0 {
+		t.Errorf("Expected no catching up in other rooms, got %v", messagesQueries)
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	var f inFlight
+	if n := f.wait(context.Background()); n != 0 {
+		t.Fatalf("TestInFlight: want nothing under way, got %d", n)
+	}
+
+	f.add()
+	f.add()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if n := f.wait(ctx); n != 2 {
+		t.Errorf("TestInFlight: want 2 under way when giving up, got %d", n)
+	}
+
+	go func() {
+		f.done()
+		f.done()
+	}()
+	if n := f.wait(context.Background()); n != 0 {
+		t.Errorf("TestInFlight: want nothing under way once done, got %d", n)
+	}
+}
+
+func TestUpdateClient(t *testing.T) {
+	db, err := database.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestUpdateClient: %s", err)
+	}
+	database.SetServiceDB(db)
+
+	var mu sync.Mutex
+	syncs := make(map[string]int) // homeserver => number of /sync requests
+	syncsTo := func(homeserver string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return syncs[homeserver]
+	}
+	cli := &http.Client{Transport: MockTransport{func(req *http.Request) (*http.Response, error) {
+		body := `{}`
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/sync"):
+			mu.Lock()
+			syncs[req.URL.Host]++
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			body = `{"next_batch":"s1"}`
+		case strings.HasSuffix(req.URL.Path, "/filter"):
+			body = `{"filter_id":"1"}`
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	}}}
+	waitForSyncs := func(homeserver string) {
+		for i := 0; i < 100 && syncsTo(homeserver) < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if syncsTo(homeserver) < 2 {
+			t.Fatalf("TestUpdateClient: the client never synced with %s", homeserver)
+		}
+	}
+	stoppedSyncing := func(homeserver string) bool {
+		time.Sleep(50 * time.Millisecond) // for the sync under way to finish
+		n := syncsTo(homeserver)
+		time.Sleep(50 * time.Millisecond)
+		return syncsTo(homeserver) == n
+	}
+
+	c := New(db, cli)
+	config := api.ClientConfig{
+		UserID:        "@neb:hyrule",
+		HomeserverURL: "https://old.hyrule",
+		AccessToken:   "old_token",
+		DeviceID:      "NEB",
+		Sync:          true,
+	}
+	if _, err := c.Update(config); err != nil {
+		t.Fatalf("TestUpdateClient: Update: %s", err)
+	}
+	waitForSyncs("old.hyrule")
+
+	config.HomeserverURL = "https://new.hyrule"
+	config.AccessToken = "new_token"
+	if _, err := c.Update(config); err != nil {
+		t.Fatalf("TestUpdateClient: Update: %s", err)
+	}
+	botClient, err := c.Client("@neb:hyrule")
+	if err != nil {
+		t.Fatalf("TestUpdateClient: Client: %s", err)
+	}
+	if botClient.config.AccessToken != "new_token" || botClient.AccessToken != "new_token" || botClient.HomeserverURL.Host != "new.hyrule" {
+		t.Errorf("TestUpdateClient: want the client with the new config, got %+v using %s", botClient.config, botClient.HomeserverURL)
+	}
+	waitForSyncs("new.hyrule")
+	if !stoppedSyncing("old.hyrule") {
+		t.Error("TestUpdateClient: the old client is still syncing")
+	}
+
+	if err := c.Remove("@neb:hyrule"); err != nil {
+		t.Fatalf("TestUpdateClient: Remove: %s", err)
+	}
+	if !stoppedSyncing("new.hyrule") {
+		t.Error("TestUpdateClient: the removed client is still syncing")
+	}
+}
+
+func TestUpdateClientHTTP(t *testing.T) {
+	db, err := database.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestUpdateClientHTTP: %s", err)
+	}
+	database.SetServiceDB(db)
+	shared := &http.Client{}
+	c := New(db, shared)
+	config := api.ClientConfig{UserID: "@neb:hyrule", HomeserverURL: "https://hyrule", DeviceID: "NEB"}
+	if _, err := c.Update(config); err != nil {
+		t.Fatalf("TestUpdateClientHTTP: Update: %s", err)
+	}
+
+	config.HTTP = api.HTTPConfig{Proxy: "http://proxy.internal:3128"}
+	if _, err := c.Update(config); err != nil {
+		t.Fatalf("TestUpdateClientHTTP: Update: %s", err)
+	}
+	botClient, err := c.Client("@neb:hyrule")
+	if err != nil {
+		t.Fatalf("TestUpdateClientHTTP: Client: %s", err)
+	}
+	transport, ok := botClient.Client.Client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("TestUpdateClientHTTP: want the client to use its own transport, got %+v", botClient.Client.Client)
+	}
+	req, _ := http.NewRequest("GET", "https://hyrule/_matrix/client/r0/sync", nil)
+	if proxyURL, err := transport.Proxy(req); err != nil || proxyURL.String() != "http://proxy.internal:3128" {
+		t.Errorf("TestUpdateClientHTTP: want proxy http://proxy.internal:3128, got %v (err: %v)", proxyURL, err)
+	}
+
+	config.HTTP = api.HTTPConfig{}
+	if _, err := c.Update(config); err != nil {
+		t.Fatalf("TestUpdateClientHTTP: Update: %s", err)
+	}
+	if botClient, err = c.Client("@neb:hyrule"); err != nil || botClient.Client.Client != shared {
+		t.Errorf("TestUpdateClientHTTP: want the shared HTTP client without settings, got %+v (err: %v)", botClient.Client.Client, err)
+	}
+}
+
+func TestHTTPClientFor(t *testing.T) {
+	shared := &http.Client{Timeout: time.Minute}
+	if cli, err := httpClientFor(shared, api.HTTPConfig{}); err != nil || cli != shared {
+		t.Errorf("TestHTTPClientFor: want the shared client without settings, got %v (err: %v)", cli, err)
+	}
+
+	cli, err := httpClientFor(shared, api.HTTPConfig{Proxy: "http://proxy.internal:3128", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TestHTTPClientFor: %s", err)
+	}
+	transport := cli.Transport.(*http.Transport)
+	req, _ := http.NewRequest("GET", "https://hyrule/_matrix/client/r0/sync", nil)
+	if proxyURL, err := transport.Proxy(req); err != nil || proxyURL.String() != "http://proxy.internal:3128" {
+		t.Errorf("TestHTTPClientFor: want proxy http://proxy.internal:3128, got %v (err: %v)", proxyURL, err)
+	}
+	if !transport.TLSClientConfig.InsecureSkipVerify || cli.Timeout != time.Minute {
+		t.Errorf("TestHTTPClientFor: want InsecureSkipVerify and the shared client's timeout, got %+v", cli)
+	}
+	if shared.Transport != nil {
+		t.Error("TestHTTPClientFor: the shared client was changed")
+	}
+
+	for _, config := range []api.HTTPConfig{
+		{Proxy: "ftp://proxy.internal"},
+		{CAFile: "/does/not/exist.pem"},
+	} {
+		if _, err := httpClientFor(shared, config); err == nil {
+			t.Errorf("TestHTTPClientFor: expected an error for %+v", config)
+		}
+	}
+	if _, err := httpClientFor(&http.Client{Transport: MockTransport{}}, api.HTTPConfig{Proxy: "http://proxy.internal"}); err == nil {
+		t.Error("TestHTTPClientFor: expected an error for a custom transport")
+	}
+}
+
+func TestSeenEvents(t *testing.T) {
+	se := newSeenEvents()
+	if !se.first("@alice:hyrule", "$event") {
+		t.Errorf("TestSeenEvents: want a new event to be first")
+	}
+	if se.first("@alice:hyrule", "$event") {
+		t.Errorf("TestSeenEvents: want a replayed event not to be first")
+	}
+	if !se.first("@bob:hyrule", "$event") {
+		t.Errorf("TestSeenEvents: want another client's first sight of an event to be first")
+	}
+	for i := 0; i < maxSeenEvents; i++ {
+		se.first("@alice:hyrule", id.EventID(fmt.Sprintf("$filler%d", i)))
+	}
+	if len(se.seen) != maxSeenEvents {
+		t.Errorf("TestSeenEvents: want %d events remembered, got %d", maxSeenEvents, len(se.seen))
+	}
+	if !se.first("@alice:hyrule", "$event") {
+		t.Errorf("TestSeenEvents: want a forgotten event to be first again")
+	}
+}
+
+type MockDocumentedService struct {
+	MockService
+}
+
+func (s *MockDocumentedService) CommandUsage() map[string]string {
+	return map[string]string{"deploy": "!deploy app [environment]"}
+}
+
+func TestHelpMessage(t *testing.T) {
+	noop := func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) { return nil, nil }
+	github := &MockService{commands: []types.Command{
+		{Path: []string{"github", "create"}, Command: noop, Help: "Create an issue"},
+		{Path: []string{"github", "close"}, Command: noop, Privileged: true},
+	}}
+	github.DefaultService = types.NewDefaultService("github_service", "@bot:hyrule", "github")
+	deploy := &MockDocumentedService{MockService{commands: []types.Command{{Path: []string{"deploy"}, Command: noop}}}}
+	deploy.DefaultService = types.NewDefaultService("deploy_service", "@bot:hyrule", "deploy")
+	services := []types.Service{deploy, github}
+
+	msg := helpMessage(nil, services, nil)
+	want := "<p><b>deploy</b> (deploy_service)</p><ul><li><code>!deploy app [environment]</code></li></ul>" +
+		"<p><b>github</b> (github_service)</p><ul><li><code>!github create</code> - Create an issue</li>" +
+		"<li><code>!github close</code> <i>(privileged)</i></li></ul>"
+	if msg.FormattedBody != want {
+		t.Errorf("TestHelpMessage: want %s, got %s", want, msg.FormattedBody)
+	}
+
+	msg = helpMessage(nil, services, []string{"GitHub", "close"})
+	want = "<p><b>github</b> (github_service)</p><ul><li><code>!github close</code> <i>(privileged)</i></li></ul>"
+	if msg.FormattedBody != want {
+		t.Errorf("TestHelpMessage: want %s for !help github close, got %s", want, msg.FormattedBody)
+	}
+
+	msg = helpMessage(nil, services, []string{"jira"})
+	if msg.FormattedBody != "" || msg.Body != "No commands start with !jira" {
+		t.Errorf("TestHelpMessage: want a notice that no commands match, got %+v", msg)
+	}
+}
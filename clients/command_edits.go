@@ -0,0 +1,135 @@
+package clients
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/matrix"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// failedCommand is a command which failed or wasn't recognised, which is run again if its sender
+// edits it within the client's CommandEditWindow.
+type failedCommand struct {
+	sender id.UserID
+	sent   time.Time
+	// The event which sent the command. Edits only relate to it by m.replace, so responses to
+	// the corrected command reply to this event, and are sent in its thread.
+	event *mevt.Event
+	// The client's responses, in the order they were sent.
+	responses []id.EventID
+}
+
+// commandEdits tracks the failed commands which can be edited. It is shared by all copies of a
+// BotClient.
+type commandEdits struct {
+	mu sync.Mutex
+	// The window in minutes, see api.ClientConfig.CommandEditWindow.
+	window   int
+	commands map[id.EventID]*failedCommand
+}
+
+func newCommandEdits(window int) *commandEdits {
+	return &commandEdits{window: window, commands: make(map[id.EventID]*failedCommand)}
+}
+
+// enabled returns true if commands can be edited.
+func (ce *commandEdits) enabled() bool {
+	if ce == nil {
+		return false
+	}
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	return ce.window > 0
+}
+
+// record remembers that the command with the given event ID failed.
+func (ce *commandEdits) record(eventID id.EventID, cmd *failedCommand, now time.Time) {
+	if ce == nil {
+		return
+	}
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	if ce.window <= 0 {
+		return
+	}
+	// Forget the commands which can no longer be edited, so the map doesn't grow forever.
+	for evID, c := range ce.commands {
+		if now.Sub(c.sent) >= time.Duration(ce.window)*time.Minute {
+			delete(ce.commands, evID)
+		}
+	}
+	ce.commands[eventID] = cmd
+}
+
+// take returns the failed command with the given event ID if the sender can still edit it, and
+// forgets it. Returns nil if there isn't one.
+func (ce *commandEdits) take(eventID id.EventID, sender id.UserID, now time.Time) *failedCommand {
+	if ce == nil {
+		return nil
+	}
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	cmd, ok := ce.commands[eventID]
+	if !ok || cmd.sender != sender {
+		return nil
+	}
+	delete(ce.commands, eventID)
+	if now.Sub(cmd.sent) >= time.Duration(ce.window)*time.Minute {
+		return nil
+	}
+	return cmd
+}
+
+// replaceResponses replaces the client's responses to a command with the responses to the edited
+// command. Messages are edited in place, and other responses are redacted and sent again. Returns
+// the event IDs of the new responses.
+func replaceResponses(botClient *BotClient, logger *log.Entry, event *mevt.Event, old []id.EventID, responses []interface{}) []id.EventID {
+	var eventIDs []id.EventID
+	for i, content := range responses {
+		if i >= len(old) {
+			eventIDs = append(eventIDs, sendResponses(botClient, logger, event, []interface{}{content})...)
+			continue
+		}
+		// Responses are edited in place, so they keep the relation they were sent with.
+		inner := content
+		if reply, ok := content.(matrix.ReplyMessage); ok {
+			inner = reply.Content
+		}
+		var msg *mevt.MessageEventContent
+		switch c := inner.(type) {
+		case mevt.MessageEventContent:
+			msg = &c
+		case *mevt.MessageEventContent:
+			msg = c
+		}
+		if msg == nil {
+			redactResponse(botClient, logger, event.RoomID, old[i])
+			eventIDs = append(eventIDs, sendResponses(botClient, logger, event, []interface{}{content})...)
+			continue
+		}
+		edit := mevt.MessageEventContent{
+			MsgType:    msg.MsgType,
+			Body:       "* " + msg.Body,
+			NewContent: msg,
+			RelatesTo:  &mevt.RelatesTo{Type: mevt.RelReplace, EventID: old[i]},
+		}
+		if _, err := botClient.SendMessageEvent(event.RoomID, mevt.EventMessage, edit); err != nil {
+			logger.WithError(err).Error("Failed to edit command response")
+		}
+		// Edits of the response edit the original event.
+		eventIDs = append(eventIDs, old[i])
+	}
+	for i := len(responses); i < len(old); i++ {
+		redactResponse(botClient, logger, event.RoomID, old[i])
+	}
+	return eventIDs
+}
+
+func redactResponse(botClient *BotClient, logger *log.Entry, roomID id.RoomID, eventID id.EventID) {
+	if _, err := botClient.RedactEvent(roomID, eventID); err != nil {
+		logger.WithError(err).WithField("event_id", eventID).Error("Failed to redact command response")
+	}
+}
@@ -0,0 +1,131 @@
+package clients
+
+import (
+	"html"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/matrix"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// dedupeKey identifies the notifications which are combined.
+type dedupeKey struct {
+	roomID        id.RoomID
+	correlationID string
+}
+
+// combinedNotification is a message which later notifications with the same correlation ID are
+// combined with.
+type combinedNotification struct {
+	eventID id.EventID
+	sent    time.Time
+	// The message as it is now, including every notification combined with it.
+	content mevt.MessageEventContent
+	// The bodies of the notifications combined into the message, so repeats can be dropped.
+	bodies map[string]bool
+}
+
+// notificationDedupe tracks the recent notifications which later ones can be combined with. It is
+// shared by all copies of a BotClient.
+type notificationDedupe struct {
+	// Held while sending correlated notifications, so that two services notifying about the same
+	// thing at once can't both send a new message.
+	mu sync.Mutex
+	// The window in seconds, see api.ClientConfig.NotificationDedupeWindow.
+	window int
+	sent   map[dedupeKey]*combinedNotification
+}
+
+func newNotificationDedupe(window int) *notificationDedupe {
+	return &notificationDedupe{window: window, sent: make(map[dedupeKey]*combinedNotification)}
+}
+
+// sendCorrelated sends the notification, or combines it with a notification with the same
+// correlation ID which was sent into the room within the client's NotificationDedupeWindow by
+// editing that message. Notifications with the same body as one already combined are dropped.
+func (botClient *BotClient) sendCorrelated(roomID id.RoomID, evtType mevt.Type, msg matrix.CorrelatedMessage,
+	extra []mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error) {
+
+	nd := botClient.notificationDedupe
+	if nd == nil || msg.CorrelationID == "" {
+		return botClient.SendMessageEvent(roomID, evtType, msg.MessageEventContent, extra...)
+	}
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	if nd.window <= 0 {
+		return botClient.SendMessageEvent(roomID, evtType, msg.MessageEventContent, extra...)
+	}
+	now := time.Now()
+	window := time.Duration(nd.window) * time.Second
+	// Forget the notifications which can no longer be combined with, so the map doesn't grow forever.
+	for key, n := range nd.sent {
+		if now.Sub(n.sent) >= window {
+			delete(nd.sent, key)
+		}
+	}
+
+	key := dedupeKey{roomID, msg.CorrelationID}
+	n := nd.sent[key]
+	if n == nil {
+		resp, err := botClient.SendMessageEvent(roomID, evtType, msg.MessageEventContent, extra...)
+		if err == nil {
+			nd.sent[key] = &combinedNotification{
+				eventID: resp.EventID,
+				sent:    now,
+				content: msg.MessageEventContent,
+				bodies:  map[string]bool{msg.Body: true},
+			}
+		}
+		return resp, err
+	}
+	logger := log.WithFields(log.Fields{
+		"user_id":        botClient.UserID,
+		"room_id":        roomID,
+		"correlation_id": msg.CorrelationID,
+	})
+	if n.bodies[msg.Body] {
+		logger.Info("Dropping repeated notification")
+		return &mautrix.RespSendEvent{EventID: n.eventID}, nil
+	}
+
+	combined := combine(n.content, msg.MessageEventContent)
+	edit := mevt.MessageEventContent{
+		MsgType:    combined.MsgType,
+		Body:       "* " + combined.Body,
+		NewContent: &combined,
+		RelatesTo:  &mevt.RelatesTo{Type: mevt.RelReplace, EventID: n.eventID},
+	}
+	resp, err := botClient.SendMessageEvent(roomID, mevt.EventMessage, edit)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Combined notification with an earlier one")
+	n.content = combined
+	n.bodies[msg.Body] = true
+	return resp, nil
+}
+
+// combine returns a message with the second message's content after the first's. The result is
+// HTML if either message is.
+func combine(first, second mevt.MessageEventContent) mevt.MessageEventContent {
+	combined := first
+	combined.Body = first.Body + "\n" + second.Body
+	if first.Format == mevt.FormatHTML || second.Format == mevt.FormatHTML {
+		combined.Format = mevt.FormatHTML
+		combined.FormattedBody = htmlBody(first) + "<br>" + htmlBody(second)
+	}
+	return combined
+}
+
+// htmlBody returns the message's HTML, or its body as HTML if it is plain text.
+func htmlBody(msg mevt.MessageEventContent) string {
+	if msg.Format == mevt.FormatHTML {
+		return msg.FormattedBody
+	}
+	return strings.ReplaceAll(html.EscapeString(msg.Body), "\n", "<br>")
+}
@@ -0,0 +1,507 @@
+package clients
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RoomDelivery describes a room which a service can't send its notifications into.
+type RoomDelivery struct {
+	RoomID id.RoomID
+	// The number of notifications in a row which couldn't be sent.
+	ConsecutiveFailures int
+	LastError           string
+	LastFailureTime     time.Time
+}
+
+// ServiceDelivery describes the rooms which a service can't send its notifications into.
+type ServiceDelivery struct {
+	ServiceID   string
+	ServiceType string
+	Rooms       []RoomDelivery
+}
+
+type serviceDelivery struct {
+	serviceType string
+	rooms       map[id.RoomID]*RoomDelivery
+}
+
+var (
+	deliveryMutex sync.Mutex
+	// service ID => failing rooms. Rooms are removed once a notification gets through.
+	deliveries = make(map[string]*serviceDelivery)
+	// The profiles which senders were last given in each room, so they aren't fetched every time.
+	roomProfiles = make(map[profileKey]types.RoomProfile)
+)
+
+type profileKey struct {
+	userID id.UserID
+	roomID id.RoomID
+}
+
+// DeliveryFailures returns the rooms which services are failing to send notifications into,
+// ordered by service ID and room ID.
+func DeliveryFailures() []ServiceDelivery {
+	deliveryMutex.Lock()
+	defer deliveryMutex.Unlock()
+	failures := []ServiceDelivery{}
+	for serviceID, sd := range deliveries {
+		if len(sd.rooms) == 0 {
+			continue
+		}
+		d := ServiceDelivery{ServiceID: serviceID, ServiceType: sd.serviceType}
+		for _, rd := range sd.rooms {
+			d.Rooms = append(d.Rooms, *rd)
+		}
+		sort.Slice(d.Rooms, func(i, j int) bool { return d.Rooms[i].RoomID < d.Rooms[j].RoomID })
+		failures = append(failures, d)
+	}
+	sort.Slice(failures, func(i, j int) bool { return failures[i].ServiceID < failures[j].ServiceID })
+	return failures
+}
+
+// deliveryAttempts is the number of times a notification is sent before giving up on the room.
+const deliveryAttempts = 3
+
+// deliveryRetryDelay is how long to wait before sending a notification again. It doubles after
+// each attempt.
+var deliveryRetryDelay = 2 * time.Second
+
+// deliveryRetryBudget is the longest a DeliveryClient waits between attempts in total. Sends
+// aren't retried once it has been used up, so that e.g. a webhook request isn't held up for long
+// by a struggling homeserver.
+var deliveryRetryBudget = 10 * time.Second
+
+// A DeliveryClient sends a service's notifications with its underlying client. Before sending
+// into a room the client isn't in, e.g. after a config typo or being kicked, it joins the room if
+// the service is configured to send into it. Sending is retried if it fails temporarily, within
+// the deliveryRetryBudget. If a
+// notification still can't be sent, the room is reported by DeliveryFailures, the service's
+// owner is sent a message the first time, and the notification is sent into the service's
+// fallback room instead, if it has one.
+type DeliveryClient struct {
+	types.MatrixClient
+	service types.Service
+	logger  *log.Entry
+	// Whether sends are recorded in the audit log.
+	audited bool
+	mu      sync.Mutex
+	// The rooms the client is in, or nil if they haven't been fetched.
+	joined map[id.RoomID]bool
+	// How long the client has waited between attempts, see deliveryRetryBudget.
+	waited time.Duration
+}
+
+// NotificationSender returns the user whose client sends the service's notifications. This is
+// the service's user unless the service has another sender.
+func NotificationSender(service types.Service) id.UserID {
+	if s, ok := service.(types.SenderService); ok && s.NotificationSender() != "" {
+		return s.NotificationSender()
+	}
+	return service.ServiceUserID()
+}
+
+// NewDeliveryClient returns a DeliveryClient which sends the service's notifications with the
+// given client, which should be the client of the service's NotificationSender.
+func NewDeliveryClient(cli types.MatrixClient, service types.Service) *DeliveryClient {
+	return &DeliveryClient{
+		MatrixClient: cli,
+		service:      service,
+		logger: log.WithFields(log.Fields{
+			"service_id":   service.ServiceID(),
+			"service_type": service.ServiceType(),
+		}),
+	}
+}
+
+// WithLogger makes the client log with the given logger, e.g. one with the correlation ID of the
+// webhook request it is sending notifications for. Returns the client.
+func (c *DeliveryClient) WithLogger(logger *log.Entry) *DeliveryClient {
+	c.logger = logger
+	return c
+}
+
+// Audited makes the client record every notification it sends, or fails to send, in the audit
+// log, e.g. those sent in response to a webhook. Returns the client.
+func (c *DeliveryClient) Audited() *DeliveryClient {
+	c.audited = true
+	return c
+}
+
+// SendMessageEvent sends the event if the client is, or can join, the room, and records whether
+// it was sent. If it can't be sent, it is sent into the fallback room if the service has one.
+func (c *DeliveryClient) SendMessageEvent(roomID id.RoomID, eventType mevt.Type, contentJSON interface{},
+	extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error) {
+
+	resp, err := c.send(roomID, eventType, contentJSON, extra)
+	if err == nil {
+		c.delivered(roomID)
+		return resp, nil
+	}
+	c.failed(roomID, err)
+
+	fallback := c.fallbackRoom()
+	if fallback == "" || fallback == roomID {
+		return nil, err
+	}
+	header := fmt.Sprintf("Couldn't send this notification into %s: %s", roomID, describeError(err))
+	if content, ok := withHeader(contentJSON, header); ok {
+		resp, ferr := c.send(fallback, eventType, content, extra)
+		if ferr != nil {
+			c.logger.WithError(ferr).WithField("room_id", fallback).Error("Failed to send notification into fallback room")
+			return nil, err
+		}
+		return resp, nil
+	}
+	// The header can't be added to other content, so it goes first.
+	if _, ferr := c.send(fallback, mevt.EventMessage, mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: header}, nil); ferr != nil {
+		c.logger.WithError(ferr).WithField("room_id", fallback).Error("Failed to send notification into fallback room")
+		return nil, err
+	}
+	if resp, ferr := c.send(fallback, eventType, contentJSON, extra); ferr == nil {
+		return resp, nil
+	}
+	return nil, err
+}
+
+// send sends the event into the room, joining it if need be and setting the sender's profile in
+// it, and tries again if sending fails temporarily. Messages which are sent are recorded, so that they can be exported later.
+func (c *DeliveryClient) send(roomID id.RoomID, eventType mevt.Type, contentJSON interface{},
+	extra []mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error) {
+
+	if err := c.ensureJoined(roomID); err != nil {
+		return nil, err
+	}
+	c.ensureProfile(roomID)
+	delay := deliveryRetryDelay
+	for attempt := 1; ; attempt++ {
+		resp, err := c.MatrixClient.SendMessageEvent(roomID, eventType, contentJSON, extra...)
+		if err == nil {
+			c.logger.WithFields(log.Fields{
+				"room_id":  roomID,
+				"event_id": resp.EventID,
+			}).Debug("Sent notification")
+			if eventType == mevt.EventMessage {
+				c.record(roomID, contentJSON, resp.EventID)
+			}
+		}
+		if err == nil || attempt == deliveryAttempts || !retryable(err) || !c.mayWait(delay) {
+			if c.audited {
+				c.audit(roomID, err)
+			}
+			return resp, err
+		}
+		c.logger.WithError(err).WithFields(log.Fields{
+			"room_id": roomID,
+			"attempt": attempt,
+		}).Warn("Failed to send notification, retrying")
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// mayWait returns true if the client can wait for delay before trying again, within the
+// deliveryRetryBudget, and counts it as waited.
+func (c *DeliveryClient) mayWait(delay time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.waited+delay > deliveryRetryBudget {
+		return false
+	}
+	c.waited += delay
+	return true
+}
+
+// record stores the body of a message which was sent into the room.
+func (c *DeliveryClient) record(roomID id.RoomID, contentJSON interface{}, eventID id.EventID) {
+	var content struct {
+		Body string `json:"body"`
+	}
+	data, err := json.Marshal(contentJSON)
+	if err != nil || json.Unmarshal(data, &content) != nil || content.Body == "" {
+		return
+	}
+	err = database.GetServiceDB().InsertSentNotification(database.SentNotification{
+		UserID:    NotificationSender(c.service),
+		RoomID:    roomID,
+		EventID:   eventID,
+		ServiceID: c.service.ServiceID(),
+		Timestamp: time.Now(),
+		Body:      content.Body,
+	})
+	if err != nil {
+		c.logger.WithError(err).WithField("room_id", roomID).Warn("Failed to record sent notification")
+	}
+}
+
+// audit records the outcome of sending a notification into the room in the audit log.
+func (c *DeliveryClient) audit(roomID id.RoomID, err error) {
+	e := database.AuditEntry{
+		Kind:        database.AuditWebhookSend,
+		UserID:      NotificationSender(c.service),
+		RoomID:      roomID,
+		ServiceID:   c.service.ServiceID(),
+		ServiceType: c.service.ServiceType(),
+		Outcome:     database.AuditSuccess,
+	}
+	if err != nil {
+		e.Outcome = database.AuditFailure
+		e.Detail = describeError(err)
+	}
+	audit(database.GetServiceDB(), e)
+}
+
+// retryable returns true if sending might succeed if it is tried again. Errors such as not being
+// allowed to send into the room won't go away by themselves.
+func retryable(err error) bool {
+	var herr mautrix.HTTPError
+	if errors.As(err, &herr) && herr.Response != nil {
+		code := herr.Response.StatusCode
+		return code == http.StatusTooManyRequests || code >= 500
+	}
+	return true
+}
+
+// describeError returns the homeserver's explanation of the error if it has one, which is more
+// useful to room members than the failed request.
+func describeError(err error) string {
+	var herr mautrix.HTTPError
+	if errors.As(err, &herr) && herr.RespError != nil {
+		return herr.RespError.Error()
+	}
+	return err.Error()
+}
+
+// withHeader returns a copy of the message content with the header before it, or false if the
+// content isn't a message.
+func withHeader(contentJSON interface{}, header string) (interface{}, bool) {
+	var content mevt.MessageEventContent
+	switch c := contentJSON.(type) {
+	case mevt.MessageEventContent:
+		content = c
+	case *mevt.MessageEventContent:
+		content = *c
+	case matrix.MentionRoomMessage:
+		content = c.MessageEventContent
+	case *matrix.MentionRoomMessage:
+		content = c.MessageEventContent
+	case matrix.CorrelatedMessage:
+		content = c.MessageEventContent
+	case *matrix.CorrelatedMessage:
+		content = c.MessageEventContent
+	default:
+		return nil, false
+	}
+	if content.Format == mevt.FormatHTML {
+		content.FormattedBody = "<b>" + html.EscapeString(header) + "</b><br>" + content.FormattedBody
+	}
+	content.Body = header + "\n" + content.Body
+	return content, true
+}
+
+// fallbackRoom returns the service's fallback room, or "" if it doesn't have one.
+func (c *DeliveryClient) fallbackRoom() id.RoomID {
+	if s, ok := c.service.(types.FallbackService); ok {
+		return s.FallbackRoom()
+	}
+	return ""
+}
+
+// ensureJoined joins the room if the client isn't in it and the service sends into it.
+func (c *DeliveryClient) ensureJoined(roomID id.RoomID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.joined == nil {
+		res, err := c.MatrixClient.JoinedRooms()
+		if err != nil {
+			// Don't stop the notification being sent just because we can't tell.
+			c.logger.WithError(err).Warn("Failed to list joined rooms")
+			return nil
+		}
+		c.joined = make(map[id.RoomID]bool)
+		for _, r := range res.JoinedRooms {
+			c.joined[r] = true
+		}
+	}
+	if c.joined[roomID] {
+		return nil
+	}
+	if !c.mayJoin(roomID) {
+		return fmt.Errorf("not in room %s", roomID)
+	}
+	if _, err := c.MatrixClient.JoinRoom(roomID.String(), "", nil); err != nil {
+		return fmt.Errorf("failed to join room %s: %s", roomID, err)
+	}
+	c.logger.WithField("room_id", roomID).Info("Joined room to send notification")
+	c.joined[roomID] = true
+	return nil
+}
+
+// ensureProfile sets the sender's display name and avatar in the room to the service's profile
+// for the room, if it has one. Senders shared by several services switch profiles as each sends,
+// and clients show each notification with the profile it was sent with. Notifications are sent
+// even if the profile can't be set.
+func (c *DeliveryClient) ensureProfile(roomID id.RoomID) {
+	s, ok := c.service.(types.SenderService)
+	if !ok {
+		return
+	}
+	profile := s.RoomProfile(roomID)
+	if profile == nil {
+		return
+	}
+	key := profileKey{NotificationSender(c.service), roomID}
+	deliveryMutex.Lock()
+	current, known := roomProfiles[key]
+	deliveryMutex.Unlock()
+	if known && (profile.DisplayName == "" || profile.DisplayName == current.DisplayName) &&
+		(profile.AvatarURL == "" || profile.AvatarURL == current.AvatarURL) {
+		return
+	}
+
+	logger := c.logger.WithField("room_id", roomID)
+	var member mevt.MemberEventContent
+	if err := c.MatrixClient.StateEvent(roomID, mevt.StateMember, key.userID.String(), &member); err != nil {
+		logger.WithError(err).Warn("Failed to fetch member event to set profile")
+		return
+	}
+	if (profile.DisplayName != "" && profile.DisplayName != member.Displayname) ||
+		(profile.AvatarURL != "" && profile.AvatarURL != member.AvatarURL) {
+		if profile.DisplayName != "" {
+			member.Displayname = profile.DisplayName
+		}
+		if profile.AvatarURL != "" {
+			member.AvatarURL = profile.AvatarURL
+		}
+		u := c.MatrixClient.BuildBaseURL("_matrix", "client", "r0", "rooms", roomID, "state", mevt.StateMember.Type, key.userID)
+		if _, err := c.MatrixClient.MakeRequest("PUT", u, &member, nil); err != nil {
+			logger.WithError(err).Warn("Failed to set profile")
+			return
+		}
+		logger.WithField("displayname", member.Displayname).Info("Set profile")
+	}
+	deliveryMutex.Lock()
+	roomProfiles[key] = types.RoomProfile{DisplayName: member.Displayname, AvatarURL: member.AvatarURL}
+	deliveryMutex.Unlock()
+}
+
+// mayJoin returns true if the service is configured to send into the room, or it is the service's
+// fallback room.
+func (c *DeliveryClient) mayJoin(roomID id.RoomID) bool {
+	if roomID == c.fallbackRoom() {
+		return true
+	}
+	targeter, ok := c.service.(types.RoomTargeter)
+	if !ok {
+		return false
+	}
+	for _, r := range targeter.TargetRooms() {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *DeliveryClient) delivered(roomID id.RoomID) {
+	deliveryMutex.Lock()
+	defer deliveryMutex.Unlock()
+	if sd := deliveries[c.service.ServiceID()]; sd != nil {
+		delete(sd.rooms, roomID)
+	}
+}
+
+func (c *DeliveryClient) failed(roomID id.RoomID, err error) {
+	deliveryMutex.Lock()
+	sd := deliveries[c.service.ServiceID()]
+	if sd == nil {
+		sd = &serviceDelivery{serviceType: c.service.ServiceType(), rooms: make(map[id.RoomID]*RoomDelivery)}
+		deliveries[c.service.ServiceID()] = sd
+	}
+	rd := sd.rooms[roomID]
+	if rd == nil {
+		rd = &RoomDelivery{RoomID: roomID}
+		sd.rooms[roomID] = rd
+	}
+	rd.ConsecutiveFailures++
+	rd.LastError = err.Error()
+	rd.LastFailureTime = time.Now()
+	first := rd.ConsecutiveFailures == 1
+	deliveryMutex.Unlock()
+	metrics.IncrementSendFailure(c.service.ServiceType())
+
+	c.logger.WithError(err).WithField("room_id", roomID).Warn("Failed to deliver notification")
+	if first {
+		c.tellOwner(roomID, err)
+	}
+}
+
+// tellOwner sends the service's owner, if it has one, a direct message about the failure.
+func (c *DeliveryClient) tellOwner(roomID id.RoomID, err error) {
+	owned, ok := c.service.(types.OwnedService)
+	if !ok || owned.ServiceOwner() == "" {
+		return
+	}
+	owner := owned.ServiceOwner()
+	logger := c.logger.WithField("owner", owner)
+
+	dmRoomID, ferr := c.directChat(owner)
+	if ferr != nil {
+		logger.WithError(ferr).Error("Failed to find a room to message service owner")
+		return
+	}
+
+	msg := fmt.Sprintf("Service %s (%s) couldn't send a notification into %s: %s. "+
+		"You won't be told again until a notification gets through.",
+		c.service.ServiceID(), c.service.ServiceType(), roomID, err)
+	if _, err := c.MatrixClient.SendMessageEvent(dmRoomID, mevt.EventMessage, mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    msg,
+	}); err != nil {
+		logger.WithError(err).Error("Failed to message service owner")
+	}
+}
+
+// directChat returns a direct chat with the user from the sender's m.direct account data, or else
+// creates one and adds it there, so that the same room is used after a restart.
+func (c *DeliveryClient) directChat(userID id.UserID) (id.RoomID, error) {
+	direct := make(mevt.DirectChatsEventContent)
+	directURL := c.MatrixClient.BuildBaseURL("_matrix", "client", "r0", "user", NotificationSender(c.service),
+		"account_data", mevt.AccountDataDirectChats.Type)
+	if _, err := c.MatrixClient.MakeRequest("GET", directURL, nil, &direct); err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return "", fmt.Errorf("failed to load direct chats: %s", err)
+	}
+	if rooms := direct[userID]; len(rooms) > 0 {
+		return rooms[0], nil
+	}
+
+	var res mautrix.RespCreateRoom
+	_, err := c.MatrixClient.MakeRequest("POST", c.MatrixClient.BuildBaseURL("_matrix", "client", "r0", "createRoom"), &mautrix.ReqCreateRoom{
+		Preset:   "trusted_private_chat",
+		IsDirect: true,
+		Invite:   []id.UserID{userID},
+	}, &res)
+	if err != nil {
+		return "", fmt.Errorf("failed to create room: %s", err)
+	}
+	direct[userID] = append(direct[userID], res.RoomID)
+	if _, err := c.MatrixClient.MakeRequest("PUT", directURL, direct, nil); err != nil {
+		c.logger.WithError(err).WithField("room_id", res.RoomID).Warn("Failed to record direct chat")
+	}
+	return res.RoomID, nil
+}
@@ -0,0 +1,162 @@
+package clients
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// directChats remembers which rooms are direct chats for each client, from the clients' m.direct
+// account data. Rooms are added when a client accepts an invite to a direct chat.
+type directChats struct {
+	mu sync.Mutex
+	// The user each direct chat is with, for each client whose m.direct has been loaded.
+	rooms map[id.UserID]map[id.RoomID]id.UserID
+}
+
+func newDirectChats() *directChats {
+	return &directChats{rooms: make(map[id.UserID]map[id.RoomID]id.UserID)}
+}
+
+// user returns the user the room is a direct chat with, or "" if it is a group room. The client's
+// m.direct is loaded the first time.
+func (dc *directChats) user(cli *mautrix.Client, roomID id.RoomID) id.UserID {
+	rooms := dc.load(cli)
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return rooms[roomID]
+}
+
+// room returns a direct chat with the user, or "" if the client doesn't have one.
+func (dc *directChats) room(cli *mautrix.Client, userID id.UserID) id.RoomID {
+	rooms := dc.load(cli)
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	// Pick the same room each time if there is more than one.
+	var room id.RoomID
+	for roomID, u := range rooms {
+		if u == userID && (room == "" || roomID < room) {
+			room = roomID
+		}
+	}
+	return room
+}
+
+// load returns the client's direct chats, loading its m.direct the first time. No rooms are
+// returned if it can't be loaded, and loading is tried again next time.
+func (dc *directChats) load(cli *mautrix.Client) map[id.RoomID]id.UserID {
+	dc.mu.Lock()
+	rooms, ok := dc.rooms[cli.UserID]
+	dc.mu.Unlock()
+	if ok {
+		return rooms
+	}
+	direct, err := loadDirectChats(cli)
+	if err != nil {
+		log.WithError(err).WithField("user_id", cli.UserID).Warn("Failed to load direct chats")
+		return nil
+	}
+	rooms = make(map[id.RoomID]id.UserID)
+	for userID, roomIDs := range direct {
+		for _, r := range roomIDs {
+			rooms[r] = userID
+		}
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if loaded, ok := dc.rooms[cli.UserID]; ok {
+		// Another message loaded them first, and invites may have been added since.
+		return loaded
+	}
+	dc.rooms[cli.UserID] = rooms
+	return rooms
+}
+
+// add records that the room is a direct chat with the user, in the client's m.direct.
+func (dc *directChats) add(cli *mautrix.Client, roomID id.RoomID, userID id.UserID) error {
+	direct, err := loadDirectChats(cli)
+	if err != nil {
+		return err
+	}
+	for _, r := range direct[userID] {
+		if r == roomID {
+			return nil
+		}
+	}
+	direct[userID] = append(direct[userID], roomID)
+	if err := cli.SetAccountData(mevt.AccountDataDirectChats.Type, direct); err != nil {
+		return err
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if rooms, ok := dc.rooms[cli.UserID]; ok {
+		rooms[roomID] = userID
+	}
+	return nil
+}
+
+// loadDirectChats returns the client's m.direct, which is empty if it has never been set.
+func loadDirectChats(cli *mautrix.Client) (mevt.DirectChatsEventContent, error) {
+	direct := make(mevt.DirectChatsEventContent)
+	err := cli.GetAccountData(mevt.AccountDataDirectChats.Type, &direct)
+	if httpErr, ok := err.(mautrix.HTTPError); ok && httpErr.IsStatus(http.StatusNotFound) {
+		return make(mevt.DirectChatsEventContent), nil
+	}
+	return direct, err
+}
+
+// SendDirectMessage sends a message to the user in a direct chat. It is sent by a client which
+// already has a direct chat with them, or else by the first client, ordered by user ID, which
+// invites them to a new direct chat.
+func (c *Clients) SendDirectMessage(userID id.UserID, content interface{}) error {
+	configs, err := c.db.LoadMatrixClientConfigs()
+	if err != nil {
+		return err
+	}
+	if len(configs) == 0 {
+		return fmt.Errorf("there are no clients to send from")
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].UserID < configs[j].UserID })
+
+	var botClient *BotClient
+	var roomID id.RoomID
+	for _, config := range configs {
+		cli, err := c.Client(config.UserID)
+		if err != nil {
+			log.WithError(err).WithField("user_id", config.UserID).Warn("Failed to load client")
+			continue
+		}
+		if botClient == nil {
+			botClient = cli
+		}
+		if roomID = c.directChats.room(cli.Client, userID); roomID != "" {
+			botClient = cli
+			break
+		}
+	}
+	if botClient == nil {
+		return fmt.Errorf("failed to load any client to send from")
+	}
+	if roomID == "" {
+		res, err := botClient.CreateRoom(&mautrix.ReqCreateRoom{
+			Preset:   "trusted_private_chat",
+			Invite:   []id.UserID{userID},
+			IsDirect: true,
+		})
+		if err != nil {
+			return err
+		}
+		roomID = res.RoomID
+		if err := c.directChats.add(botClient.Client, roomID, userID); err != nil {
+			log.WithError(err).WithField("room_id", roomID).Warn("Failed to record direct chat")
+		}
+	}
+	_, err = botClient.SendMessageEvent(roomID, mevt.EventMessage, content)
+	return err
+}
@@ -0,0 +1,93 @@
+package clients
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// A DryRunAction is something a DryRunClient was asked to do in Matrix, but didn't.
+type DryRunAction struct {
+	// "send", "redact", "join", "upload" or, for other requests, their HTTP method.
+	Action  string
+	RoomID  id.RoomID   `json:",omitempty"`
+	Type    string      `json:",omitempty"`
+	Content interface{} `json:",omitempty"`
+	// The redacted event, the joined room ID or alias, the uploaded link or the request URL.
+	Target string `json:",omitempty"`
+}
+
+// A DryRunClient reads from Matrix as its underlying client does, but records everything which
+// would change something in Matrix instead of doing it. It returns made up event IDs and content
+// URIs, so that services carry on as if they had been sent.
+type DryRunClient struct {
+	types.MatrixClient
+	mu      sync.Mutex
+	actions []DryRunAction
+}
+
+// NewDryRunClient returns a DryRunClient which reads with the given client.
+func NewDryRunClient(cli types.MatrixClient) *DryRunClient {
+	return &DryRunClient{MatrixClient: cli}
+}
+
+// Actions returns what the client was asked to do, in order.
+func (c *DryRunClient) Actions() []DryRunAction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]DryRunAction{}, c.actions...)
+}
+
+// record adds the action, returning a count of the actions so far for use in made up IDs.
+func (c *DryRunClient) record(a DryRunAction) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.actions = append(c.actions, a)
+	return len(c.actions)
+}
+
+// JoinRoom records the join. The room ID or alias is returned as the joined room's ID.
+func (c *DryRunClient) JoinRoom(roomIDorAlias, serverName string, content interface{}) (*mautrix.RespJoinRoom, error) {
+	c.record(DryRunAction{Action: "join", Target: roomIDorAlias})
+	return &mautrix.RespJoinRoom{RoomID: id.RoomID(roomIDorAlias)}, nil
+}
+
+// SendMessageEvent records the event.
+func (c *DryRunClient) SendMessageEvent(roomID id.RoomID, eventType mevt.Type, contentJSON interface{},
+	extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error) {
+
+	n := c.record(DryRunAction{Action: "send", RoomID: roomID, Type: eventType.Type, Content: contentJSON})
+	return &mautrix.RespSendEvent{EventID: id.EventID(fmt.Sprintf("$dry-run-%d", n))}, nil
+}
+
+// RedactEvent records the redaction.
+func (c *DryRunClient) RedactEvent(roomID id.RoomID, eventID id.EventID, extra ...mautrix.ReqRedact) (*mautrix.RespSendEvent, error) {
+	n := c.record(DryRunAction{Action: "redact", RoomID: roomID, Target: eventID.String()})
+	return &mautrix.RespSendEvent{EventID: id.EventID(fmt.Sprintf("$dry-run-%d", n))}, nil
+}
+
+// UploadLink records the upload.
+func (c *DryRunClient) UploadLink(link string) (*mautrix.RespMediaUpload, error) {
+	n := c.record(DryRunAction{Action: "upload", Target: link})
+	return &mautrix.RespMediaUpload{ContentURI: id.ContentURI{Homeserver: "dry-run", FileID: fmt.Sprint(n)}}, nil
+}
+
+// UploadBytesWithName records the upload.
+func (c *DryRunClient) UploadBytesWithName(data []byte, contentType, fileName string) (*mautrix.RespMediaUpload, error) {
+	n := c.record(DryRunAction{Action: "upload", Type: contentType, Target: fileName})
+	return &mautrix.RespMediaUpload{ContentURI: id.ContentURI{Homeserver: "dry-run", FileID: fmt.Sprint(n)}}, nil
+}
+
+// MakeRequest makes GET requests, and records any other request.
+func (c *DryRunClient) MakeRequest(method string, httpURL string, reqBody interface{}, resBody interface{}) ([]byte, error) {
+	if method == http.MethodGet {
+		return c.MatrixClient.MakeRequest(method, httpURL, reqBody, resBody)
+	}
+	c.record(DryRunAction{Action: method, Content: reqBody, Target: httpURL})
+	return []byte("{}"), nil
+}
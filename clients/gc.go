@@ -0,0 +1,117 @@
+package clients
+
+import (
+	"database/sql"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultGCInterval is how often CollectGarbagePeriodically removes orphaned data by default.
+const DefaultGCInterval = 24 * time.Hour
+
+// NotificationRetention is how long the log of the notifications services send is kept, and so
+// how far back rooms can export their notifications.
+const NotificationRetention = 90 * 24 * time.Hour
+
+// A GCReport describes what a garbage collection removed.
+type GCReport struct {
+	// The number of auth sessions removed because their realm no longer exists.
+	AuthSessions int64
+	// The number of logged notifications removed because they are older than NotificationRetention.
+	SentNotifications int64
+	// The number of audit log entries removed because they are older than AuditRetention.
+	AuditEntries int64
+	// The bot options removed because the bot is no longer in the room, or the bot's client no
+	// longer exists.
+	BotOptions []RemovedBotOptions
+}
+
+// RemovedBotOptions identifies bot options removed by a garbage collection.
+type RemovedBotOptions struct {
+	UserID id.UserID
+	RoomID id.RoomID
+}
+
+// CollectGarbage removes data which can no longer be used: auth sessions for realms which no
+// longer exist, logged notifications older than NotificationRetention, audit log entries older
+// than AuditRetention, and bot options for rooms which the bot has left. Bot options are kept if
+// the client's rooms can't be listed, e.g. because the homeserver is down, so that they aren't
+// removed by mistake.
+func (c *Clients) CollectGarbage() (report GCReport, err error) {
+	report.BotOptions = []RemovedBotOptions{}
+	if report.AuthSessions, err = c.db.RemoveOrphanedAuthSessions(); err != nil {
+		return
+	}
+	if report.SentNotifications, err = c.db.RemoveSentNotificationsBefore(time.Now().Add(-NotificationRetention)); err != nil {
+		return
+	}
+	if retention := AuditRetention(); retention > 0 {
+		if report.AuditEntries, err = c.db.RemoveAuditEntriesBefore(time.Now().Add(-retention)); err != nil {
+			return
+		}
+	}
+
+	rooms, err := c.db.LoadBotOptionsRooms()
+	if err != nil {
+		return
+	}
+	for userID, roomIDs := range rooms {
+		logger := log.WithField("user_id", userID)
+		joined, err := c.joinedRooms(userID)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to list joined rooms, keeping bot options")
+			continue
+		}
+		for _, roomID := range roomIDs {
+			if joined[roomID] {
+				continue
+			}
+			if err := c.db.RemoveBotOptions(userID, roomID); err != nil {
+				return report, err
+			}
+			report.BotOptions = append(report.BotOptions, RemovedBotOptions{userID, roomID})
+		}
+	}
+	return
+}
+
+// joinedRooms returns the rooms the client is in, or no rooms if the client doesn't exist.
+func (c *Clients) joinedRooms(userID id.UserID) (map[id.RoomID]bool, error) {
+	joined := make(map[id.RoomID]bool)
+	if _, err := c.db.LoadMatrixClientConfig(userID); err == sql.ErrNoRows {
+		return joined, nil
+	} else if err != nil {
+		return nil, err
+	}
+	botClient, err := c.Client(userID)
+	if err != nil {
+		return nil, err
+	}
+	res, err := botClient.JoinedRooms()
+	if err != nil {
+		return nil, err
+	}
+	for _, roomID := range res.JoinedRooms {
+		joined[roomID] = true
+	}
+	return joined, nil
+}
+
+// CollectGarbagePeriodically calls CollectGarbage every interval, forever. The results are logged.
+func (c *Clients) CollectGarbagePeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		report, err := c.CollectGarbage()
+		if err != nil {
+			log.WithError(err).Error("Failed to collect garbage")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"auth_sessions":      report.AuthSessions,
+			"sent_notifications": report.SentNotifications,
+			"audit_entries":      report.AuditEntries,
+			"bot_options":        len(report.BotOptions),
+		}).Info("Collected garbage")
+	}
+}
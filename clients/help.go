@@ -0,0 +1,80 @@
+package clients
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+// helpCommand is the built-in command which lists the commands of every service for the client,
+// e.g. "!help", or "!help github" for just the commands starting with "!github". Services which
+// have their own "!help" command answer it instead.
+const helpCommand = "help"
+
+// helpMessage returns the response to the built-in "!help" command with the given arguments. It
+// lists each service's commands, with their usage and help if the service provides them.
+func helpMessage(cli types.MatrixClient, services []types.Service, filter []string) mevt.MessageEventContent {
+	var sb strings.Builder
+	for _, service := range services {
+		var usage map[string]string
+		if documented, ok := service.(types.DocumentedService); ok {
+			usage = documented.CommandUsage()
+		}
+		var items []string
+		for _, cmd := range service.Commands(cli) {
+			if !hasPrefix(cmd.Path, filter) {
+				continue
+			}
+			path := strings.Join(cmd.Path, " ")
+			item := "<li><code>" + html.EscapeString(commandUsage(path, usage)) + "</code>"
+			if cmd.Help != "" {
+				item += " - " + html.EscapeString(cmd.Help)
+			}
+			if cmd.Privileged {
+				item += " <i>(privileged)</i>"
+			}
+			items = append(items, item+"</li>")
+		}
+		if len(items) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "<p><b>%s</b> (%s)</p><ul>%s</ul>",
+			html.EscapeString(service.ServiceType()), html.EscapeString(service.ServiceID()), strings.Join(items, ""))
+	}
+	if sb.Len() == 0 {
+		if len(filter) > 0 {
+			return mevt.MessageEventContent{
+				MsgType: mevt.MsgNotice,
+				Body:    "No commands start with !" + strings.Join(filter, " "),
+			}
+		}
+		return mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "No commands are available"}
+	}
+	return utils.StrippedHTMLMessage(mevt.MsgNotice, sb.String())
+}
+
+// commandUsage returns the usage of the command with the path, joined with spaces, from the
+// service's usage, or just the command if the service doesn't describe it.
+func commandUsage(path string, usage map[string]string) string {
+	if u := usage[path]; u != "" {
+		return u
+	}
+	return "!" + path
+}
+
+// hasPrefix returns true if the command's path starts with the prefix, ignoring case.
+func hasPrefix(path, prefix []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i, segment := range prefix {
+		if !strings.EqualFold(segment, path[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package clients
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/go-neb/api"
+)
+
+// httpClientFor returns the HTTP client for a client with the given settings: shared if it has
+// none, otherwise a copy of shared with its own transport.
+func httpClientFor(shared *http.Client, config api.HTTPConfig) (*http.Client, error) {
+	if config.IsZero() {
+		return shared, nil
+	}
+
+	var transport *http.Transport
+	switch t := shared.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return nil, errors.New("HTTP settings can't be applied to Go-NEB's HTTP client")
+	}
+
+	if config.Proxy != "" {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("bad proxy URL: %s", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("bad proxy URL: scheme must be http, https or socks5")
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if config.CAFile != "" || config.InsecureSkipVerify {
+		tlsConfig := &tls.Config{}
+		if transport.TLSClientConfig != nil {
+			tlsConfig = transport.TLSClientConfig.Clone()
+		}
+		if config.CAFile != "" {
+			pem, err := ioutil.ReadFile(config.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA file: %s", err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA file %s", config.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		tlsConfig.InsecureSkipVerify = config.InsecureSkipVerify
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	cli := *shared
+	cli.Transport = transport
+	return &cli, nil
+}
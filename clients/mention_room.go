@@ -0,0 +1,106 @@
+package clients
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/matrix"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The power level needed to mention the room if the room's power levels don't say.
+const defaultRoomNotificationLevel = 50
+
+// roomMentions tracks when each room was last mentioned with "@room". It is shared by all copies
+// of a BotClient.
+type roomMentions struct {
+	mu sync.Mutex
+	// The cooldown in minutes, see api.ClientConfig.RoomMentionCooldown.
+	cooldown int
+	last     map[id.RoomID]time.Time
+}
+
+func newRoomMentions(cooldown int) *roomMentions {
+	return &roomMentions{cooldown: cooldown, last: make(map[id.RoomID]time.Time)}
+}
+
+// allow returns true if the room can be mentioned now, recording that it was.
+func (rm *roomMentions) allow(roomID id.RoomID, now time.Time) bool {
+	if rm == nil {
+		return false
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	cooldown := rm.cooldown
+	if cooldown == 0 {
+		cooldown = api.DefaultRoomMentionCooldown
+	}
+	if cooldown < 0 {
+		return false
+	}
+	if last, ok := rm.last[roomID]; ok && now.Sub(last) < time.Duration(cooldown)*time.Minute {
+		return false
+	}
+	// Forget the rooms which can be mentioned again, so the map doesn't grow forever.
+	for r, last := range rm.last {
+		if now.Sub(last) >= time.Duration(cooldown)*time.Minute {
+			delete(rm.last, r)
+		}
+	}
+	rm.last[roomID] = now
+	return true
+}
+
+// notificationPowerLevels are the parts of m.room.power_levels which say who can mention the
+// room. mevt.PowerLevelsEventContent doesn't have the notifications levels.
+type notificationPowerLevels struct {
+	Users         map[id.UserID]int `json:"users"`
+	UsersDefault  int               `json:"users_default"`
+	Notifications struct {
+		Room *int `json:"room"`
+	} `json:"notifications"`
+}
+
+// mentionRoom returns the message to send for a MentionRoomMessage, starting with "@room" if the
+// client has the power level to notify the room and hasn't mentioned it within the cooldown.
+func (botClient *BotClient) mentionRoom(roomID id.RoomID, msg matrix.MentionRoomMessage) mevt.MessageEventContent {
+	content := msg.MessageEventContent
+	if !msg.MentionRoom {
+		return content
+	}
+	logger := log.WithFields(log.Fields{
+		"user_id": botClient.UserID,
+		"room_id": roomID,
+	})
+
+	var pl notificationPowerLevels
+	if err := botClient.StateEvent(roomID, mevt.StatePowerLevels, "", &pl); err != nil {
+		logger.WithError(err).Warn("Failed to load power levels, not mentioning the room")
+		return content
+	}
+	level, ok := pl.Users[botClient.UserID]
+	if !ok {
+		level = pl.UsersDefault
+	}
+	required := defaultRoomNotificationLevel
+	if pl.Notifications.Room != nil {
+		required = *pl.Notifications.Room
+	}
+	if level < required {
+		logger.WithField("power_level", level).Info("Not mentioning the room as the power level is too low")
+		return content
+	}
+	if !botClient.roomMentions.allow(roomID, time.Now()) {
+		logger.Info("Not mentioning the room as it was mentioned recently")
+		return content
+	}
+
+	content.Body = "@room: " + content.Body
+	if content.Format == mevt.FormatHTML {
+		content.FormattedBody = "@room: " + content.FormattedBody
+	}
+	return content
+}
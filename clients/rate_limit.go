@@ -0,0 +1,117 @@
+package clients
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"maunium.net/go/mautrix/id"
+)
+
+// maxBuckets is the number of users and rooms the rate limiter tracks before it forgets those
+// which haven't run a command for long enough that they have their full allowance again.
+const maxBuckets = 1000
+
+// tokenBucket holds a user's or room's allowance of commands. It refills continuously, up to a
+// minute's worth of commands.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// True once the user or room has been told that they are being rate limited, so that they
+	// aren't told again until a command is allowed.
+	warned bool
+}
+
+func (b *tokenBucket) refill(limit int, now time.Time) {
+	b.tokens += now.Sub(b.last).Minutes() * float64(limit)
+	if b.tokens > float64(limit) {
+		b.tokens = float64(limit)
+	}
+	b.last = now
+}
+
+// rateLimiter is shared by all copies of a BotClient.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limits api.RateLimit
+	// The buckets of users and rooms, keyed by user or room ID, which can't clash as they
+	// start with "@" and "!" respectively.
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(limits api.RateLimit) *rateLimiter {
+	return &rateLimiter{limits: limits, buckets: make(map[string]*tokenBucket)}
+}
+
+// limitFor returns the limit for the bucket with the given key.
+func (rl *rateLimiter) limitFor(key string) int {
+	if strings.HasPrefix(key, "@") {
+		return rl.limits.PerUser
+	}
+	return rl.limits.PerRoom
+}
+
+// bucket returns the refilled bucket for the key, or nil if it isn't limited.
+func (rl *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	limit := rl.limitFor(key)
+	if limit <= 0 {
+		return nil
+	}
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit), last: now}
+		rl.buckets[key] = b
+	}
+	b.refill(limit, now)
+	return b
+}
+
+// prune forgets the buckets which are full, as they are the same as new buckets.
+func (rl *rateLimiter) prune(now time.Time) {
+	for key, b := range rl.buckets {
+		limit := rl.limitFor(key)
+		b.refill(limit, now)
+		if b.tokens >= float64(limit) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// allow returns true if the user can run a command in the room now, using up some of their
+// allowance. If they can't, a polite notice is returned the first time, and "" after that until
+// the user can run commands again.
+func (rl *rateLimiter) allow(userID id.UserID, roomID id.RoomID, now time.Time) (bool, string) {
+	if rl == nil {
+		return true, ""
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if len(rl.buckets) > maxBuckets {
+		rl.prune(now)
+	}
+
+	user := rl.bucket(userID.String(), now)
+	room := rl.bucket(roomID.String(), now)
+	if user != nil && user.tokens < 1 {
+		if user.warned {
+			return false, ""
+		}
+		user.warned = true
+		return false, "You're sending commands too quickly. Please wait a minute and try again."
+	}
+	if room != nil && room.tokens < 1 {
+		if room.warned {
+			return false, ""
+		}
+		room.warned = true
+		return false, "Too many commands have been sent in this room. Please wait a minute and try again."
+	}
+	for _, b := range []*tokenBucket{user, room} {
+		if b != nil {
+			b.tokens--
+			b.warned = false
+		}
+	}
+	return true, ""
+}
@@ -0,0 +1,205 @@
+package clients
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// maxQueuedMessages is the number of messages a read-only client holds on to. Messages sent after
+// that are dropped.
+const maxQueuedMessages = 1000
+
+// ErrReadOnly is returned when a read-only client is asked to do something which it can't queue
+// for later, such as redacting an event or sending a message when its queue is full.
+var ErrReadOnly = errors.New("client is in read-only mode")
+
+// globalReadOnly is 1 if every client is read-only.
+var globalReadOnly int32
+
+type queuedMessage struct {
+	roomID  id.RoomID
+	evtType mevt.Type
+	content interface{}
+	extra   []mautrix.ReqSendEvent
+}
+
+// readOnlyState is shared by all copies of a BotClient.
+type readOnlyState struct {
+	mu       sync.Mutex
+	enabled  bool
+	flushing bool
+	queue    []queuedMessage
+}
+
+// IsReadOnly returns true if the client must not send anything into Matrix, either because it was
+// made read-only or because every client is.
+func (botClient *BotClient) IsReadOnly() bool {
+	if atomic.LoadInt32(&globalReadOnly) == 1 {
+		return true
+	}
+	if botClient.readOnly == nil {
+		return false
+	}
+	botClient.readOnly.mu.Lock()
+	defer botClient.readOnly.mu.Unlock()
+	return botClient.readOnly.enabled
+}
+
+// RedactEvent redacts the event, unless the client is read-only.
+func (botClient *BotClient) RedactEvent(roomID id.RoomID, eventID id.EventID, extra ...mautrix.ReqRedact) (*mautrix.RespSendEvent, error) {
+	if botClient.IsReadOnly() {
+		return nil, ErrReadOnly
+	}
+	return botClient.Client.RedactEvent(roomID, eventID, extra...)
+}
+
+// queueMessage holds on to a message which a read-only client was asked to send, so that it can be
+// sent when the client stops being read-only.
+func (botClient *BotClient) queueMessage(roomID id.RoomID, evtType mevt.Type, content interface{},
+	extra []mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error) {
+
+	logger := log.WithFields(log.Fields{"user_id": botClient.config.UserID, "room_id": roomID})
+	if botClient.readOnly == nil {
+		return nil, ErrReadOnly
+	}
+	botClient.readOnly.mu.Lock()
+	defer botClient.readOnly.mu.Unlock()
+	if len(botClient.readOnly.queue) >= maxQueuedMessages {
+		logger.Warn("Dropping message as the client is read-only and its queue is full")
+		return nil, ErrReadOnly
+	}
+	botClient.readOnly.queue = append(botClient.readOnly.queue, queuedMessage{roomID, evtType, content, extra})
+	logger.Info("Queued message as the client is read-only")
+	return &mautrix.RespSendEvent{}, nil
+}
+
+// flushQueue sends the messages which were queued while the client was read-only, in order.
+func (botClient *BotClient) flushQueue() {
+	botClient.readOnly.mu.Lock()
+	if botClient.readOnly.flushing {
+		botClient.readOnly.mu.Unlock()
+		return
+	}
+	botClient.readOnly.flushing = true
+	botClient.readOnly.mu.Unlock()
+	defer func() {
+		botClient.readOnly.mu.Lock()
+		botClient.readOnly.flushing = false
+		botClient.readOnly.mu.Unlock()
+	}()
+
+	for !botClient.IsReadOnly() {
+		botClient.readOnly.mu.Lock()
+		if len(botClient.readOnly.queue) == 0 {
+			botClient.readOnly.mu.Unlock()
+			return
+		}
+		msg := botClient.readOnly.queue[0]
+		botClient.readOnly.queue = botClient.readOnly.queue[1:]
+		botClient.readOnly.mu.Unlock()
+
+		if _, err := botClient.SendMessageEvent(msg.roomID, msg.evtType, msg.content, msg.extra...); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"user_id": botClient.config.UserID,
+				"room_id": msg.roomID,
+			}).Error("Failed to send queued message")
+		}
+	}
+}
+
+// setReadOnly makes the client read-only or not, sending its queued messages if it no longer is.
+func (botClient *BotClient) setReadOnly(readOnly bool) {
+	botClient.readOnly.mu.Lock()
+	botClient.readOnly.enabled = readOnly
+	botClient.readOnly.mu.Unlock()
+	if !readOnly {
+		go botClient.flushQueue()
+	}
+}
+
+// SetReadOnly makes a client read-only, or every client if userID is empty. Read-only clients keep
+// syncing, and services keep receiving webhooks and polling, but messages they send are queued
+// until the client stops being read-only. Only idempotent commands which aren't privileged are run,
+// and users are told that other commands can't be. A client's read-only setting
+// is stored in its config so that it persists across restarts. The global setting does not.
+func (c *Clients) SetReadOnly(userID id.UserID, readOnly bool) error {
+	if userID == "" {
+		var v int32
+		if readOnly {
+			v = 1
+		}
+		atomic.StoreInt32(&globalReadOnly, v)
+		log.WithField("read_only", readOnly).Info("Set read-only mode for all clients")
+		if !readOnly {
+			c.mapMutex.Lock()
+			defer c.mapMutex.Unlock()
+			for _, botClient := range c.clients {
+				if botClient.readOnly != nil {
+					bc := botClient
+					go bc.flushQueue()
+				}
+			}
+		}
+	} else {
+		botClient, err := c.Client(userID)
+		if err != nil {
+			return err
+		}
+		if err = c.storeReadOnly(botClient, readOnly); err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{"user_id": userID, "read_only": readOnly}).Info("Set read-only mode")
+	}
+	return nil
+}
+
+func (c *Clients) storeReadOnly(botClient *BotClient, readOnly bool) error {
+	c.dbMutex.Lock()
+	defer c.dbMutex.Unlock()
+	config, err := c.db.LoadMatrixClientConfig(botClient.config.UserID)
+	if err != nil {
+		return err
+	}
+	config.ReadOnly = readOnly
+	if _, err = c.db.StoreMatrixClientConfig(config); err != nil {
+		return err
+	}
+	botClient.setReadOnly(readOnly)
+
+	// Keep the cached config in step with the database so that reconfiguring the client with the
+	// same config isn't mistaken for a change.
+	c.mapMutex.Lock()
+	defer c.mapMutex.Unlock()
+	if entry, ok := c.clients[botClient.config.UserID]; ok {
+		entry.config.ReadOnly = readOnly
+		c.clients[botClient.config.UserID] = entry
+	}
+	return nil
+}
+
+// ReadOnly returns whether every client is read-only, and the clients which have been made
+// read-only individually.
+func (c *Clients) ReadOnly() (global bool, userIDs []id.UserID) {
+	c.mapMutex.Lock()
+	defer c.mapMutex.Unlock()
+	userIDs = []id.UserID{}
+	for userID, botClient := range c.clients {
+		if botClient.readOnly == nil {
+			continue
+		}
+		botClient.readOnly.mu.Lock()
+		if botClient.readOnly.enabled {
+			userIDs = append(userIDs, userID)
+		}
+		botClient.readOnly.mu.Unlock()
+	}
+	sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+	return atomic.LoadInt32(&globalReadOnly) == 1, userIDs
+}
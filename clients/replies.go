@@ -0,0 +1,48 @@
+package clients
+
+import (
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// replyStyle returns how to send the service's response to the command, or to one of its
+// expansions if cmd is nil. The command's style takes precedence over the service's.
+func replyStyle(service types.Service, cmd *types.Command) string {
+	if cmd != nil && cmd.Replies != "" {
+		return cmd.Replies
+	}
+	if replier, ok := service.(types.ReplyingService); ok && replier.ReplyStyle() != "" {
+		return replier.ReplyStyle()
+	}
+	return types.RepliesPlain
+}
+
+// asReply returns the content to send in response to the event in the given reply style.
+func asReply(content interface{}, to *mevt.Event, style string) interface{} {
+	switch style {
+	case types.RepliesReply:
+		return matrix.NewReply(content, to, false)
+	case types.RepliesThread:
+		return matrix.NewReply(content, to, true)
+	}
+	return content
+}
+
+// prepareReply resolves the message types which SendMessageEvent would otherwise handle in the
+// content of a reply.
+func (botClient *BotClient) prepareReply(roomID id.RoomID, reply matrix.ReplyMessage) *matrix.ReplyMessage {
+	switch msg := reply.Content.(type) {
+	case matrix.MentionRoomMessage:
+		reply.Content = botClient.mentionRoom(roomID, msg)
+	case *matrix.MentionRoomMessage:
+		reply.Content = botClient.mentionRoom(roomID, *msg)
+	case matrix.CorrelatedMessage:
+		// Replies are never combined with other notifications.
+		reply.Content = msg.MessageEventContent
+	case *matrix.CorrelatedMessage:
+		reply.Content = msg.MessageEventContent
+	}
+	return &reply
+}
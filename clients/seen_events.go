@@ -0,0 +1,67 @@
+package clients
+
+import (
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// maxSeenEvents is how many of the most recent message events seenEvents remembers, across all
+// clients. Replayed events are only ever a sync or two old, so this is plenty.
+const maxSeenEvents = 10000
+
+// seenEvent is a message event received by a client. Each client handles events in rooms it
+// shares with others, so the same event ID is seen once by each of them.
+type seenEvent struct {
+	userID  id.UserID
+	eventID id.EventID
+}
+
+// seenEvents remembers the message events which clients have handled, so that an event which is
+// delivered again, e.g. when a sync is retried after a reconnect, doesn't run its commands twice.
+// It belongs to Clients rather than BotClient so that it outlives a client being reconfigured.
+type seenEvents struct {
+	mu   sync.Mutex
+	seen map[seenEvent]bool
+	// The remembered events in the order they were seen, used as a ring buffer.
+	order []seenEvent
+	next  int
+}
+
+func newSeenEvents() *seenEvents {
+	return &seenEvents{seen: make(map[seenEvent]bool), order: make([]seenEvent, 0, maxSeenEvents)}
+}
+
+// has returns true if the client has seen the event, without recording that it has.
+func (se *seenEvents) has(userID id.UserID, eventID id.EventID) bool {
+	if se == nil || eventID == "" {
+		return false
+	}
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	return se.seen[seenEvent{userID, eventID}]
+}
+
+// first returns true if the client hasn't seen the event before, recording that it has. Events
+// without an ID are always new.
+func (se *seenEvents) first(userID id.UserID, eventID id.EventID) bool {
+	if se == nil || eventID == "" {
+		return true
+	}
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	key := seenEvent{userID, eventID}
+	if se.seen[key] {
+		return false
+	}
+	if len(se.order) < maxSeenEvents {
+		se.order = append(se.order, key)
+	} else {
+		// Forget the oldest event, so the map doesn't grow forever.
+		delete(se.seen, se.order[se.next])
+		se.order[se.next] = key
+		se.next = (se.next + 1) % maxSeenEvents
+	}
+	se.seen[key] = true
+	return true
+}
@@ -0,0 +1,42 @@
+package clients
+
+import (
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// SelfTest checks that a client's homeserver can be reached and accepts its access token for its
+// user ID, and that its end-to-end encryption account can be loaded from its crypto store. A client
+// which isn't running is set up without syncing for the check, then dropped. If the client can't
+// be set up, both errors are the reason why.
+func (c *Clients) SelfTest(userID id.UserID) (homeserver, cryptoStore error) {
+	botClient := c.getClient(userID)
+	if botClient.Client == nil {
+		config, err := c.db.LoadMatrixClientConfig(userID)
+		if err != nil {
+			return err, err
+		}
+		config.Sync = false
+		botClient = BotClient{config: config}
+		if err = c.initClient(&botClient); err != nil {
+			return err, err
+		}
+	}
+
+	resp, err := botClient.Whoami()
+	if err != nil {
+		homeserver = err
+	} else if resp.UserID != userID {
+		homeserver = fmt.Errorf("the access token is for %s", resp.UserID)
+	}
+
+	account, err := botClient.olmMachine.CryptoStore.GetAccount()
+	if err != nil {
+		cryptoStore = err
+	} else if account == nil {
+		cryptoStore = errors.New("the crypto store has no account")
+	}
+	return
+}
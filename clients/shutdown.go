@@ -0,0 +1,117 @@
+package clients
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+)
+
+// inFlight counts work which is under way, so that shutting down can wait for it to finish.
+// Unlike a sync.WaitGroup, work can start while something is waiting.
+type inFlight struct {
+	mu sync.Mutex
+	n  int
+	// Closed when n drops to 0.
+	idle chan struct{}
+}
+
+func (f *inFlight) add() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.n == 0 {
+		f.idle = make(chan struct{})
+	}
+	f.n++
+}
+
+func (f *inFlight) done() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n--
+	if f.n == 0 {
+		close(f.idle)
+	}
+}
+
+// wait waits until there is no work under way, or the context is done. Returns the number of
+// pieces of work still under way.
+func (f *inFlight) wait(ctx context.Context) int {
+	for {
+		f.mu.Lock()
+		n, idle := f.n, f.idle
+		f.mu.Unlock()
+		if n == 0 {
+			return 0
+		}
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			return n
+		}
+	}
+}
+
+// pending is the sync responses being processed, which includes running commands, and the
+// messages being sent, by every client.
+var pending inFlight
+
+// trackingSyncer counts the sync responses it is processing in pending.
+type trackingSyncer struct {
+	*mautrix.DefaultSyncer
+}
+
+func (s trackingSyncer) ProcessResponse(resp *mautrix.RespSync, since string) error {
+	pending.add()
+	defer pending.done()
+	return s.DefaultSyncer.ProcessResponse(resp, since)
+}
+
+// Shutdown stops every client syncing, then waits until the sync responses being processed,
+// including the commands they invoke, and the messages being sent have finished, or the context
+// is done. Then it flushes each client's crypto store. The next_batch token of each sync response
+// is stored before the response is processed, and a response which arrives after a client stops
+// syncing is thrown away, so the next sync starts where this one left off.
+//
+// Services' webhooks and polling should be stopped first, so that nothing new is sent. Messages
+// queued by read-only clients are lost.
+func (c *Clients) Shutdown(ctx context.Context) error {
+	c.mapMutex.Lock()
+	botClients := make([]BotClient, 0, len(c.clients))
+	for _, botClient := range c.clients {
+		botClients = append(botClients, botClient)
+	}
+	c.mapMutex.Unlock()
+
+	for _, botClient := range botClients {
+		botClient.StopSync()
+	}
+	unfinished := pending.wait(ctx)
+	if unfinished > 0 {
+		log.WithField("unfinished", unfinished).Warn("Gave up waiting for sync responses and sends to finish")
+	}
+
+	var err error
+	for _, botClient := range botClients {
+		logger := log.WithField("user_id", botClient.config.UserID)
+		if botClient.readOnly != nil {
+			botClient.readOnly.mu.Lock()
+			if queued := len(botClient.readOnly.queue); queued > 0 {
+				logger.WithField("queued", queued).Warn("Dropping messages queued while the client is read-only")
+			}
+			botClient.readOnly.mu.Unlock()
+		}
+		if botClient.olmMachine == nil {
+			continue
+		}
+		if e := botClient.olmMachine.CryptoStore.Flush(); e != nil {
+			logger.WithError(e).Error("Failed to flush crypto store")
+			err = e
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
@@ -2,17 +2,62 @@ package clients
 
 import (
 	"errors"
+	"sync"
+	"time"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
+// stateRefreshInterval is how long the fetched state of an unencrypted room is trusted for, as
+// clients which don't sync won't otherwise find out when encryption is enabled.
+const stateRefreshInterval = 10 * time.Minute
+
 // NebStateStore implements the StateStore interface for OlmMachine.
 // It is used to determine which rooms are encrypted and which rooms are shared with a user.
-// The state is updated by /sync responses.
+// The state is updated by /sync responses, or fetched for rooms which /sync hasn't told us about.
 type NebStateStore struct {
 	Storer *mautrix.InMemoryStore
+
+	fetchedMutex sync.Mutex
+	fetched      map[id.RoomID]time.Time
+}
+
+// NeedsRoomState returns true if the state of the room should be fetched before sending into it,
+// because /sync hasn't told us about the room, e.g. because the client doesn't sync or has just
+// joined it.
+func (ss *NebStateStore) NeedsRoomState(roomID id.RoomID) bool {
+	if ss.Storer.LoadRoom(roomID) == nil {
+		return true
+	}
+	ss.fetchedMutex.Lock()
+	fetchedAt, ok := ss.fetched[roomID]
+	ss.fetchedMutex.Unlock()
+	return ok && !ss.IsEncrypted(roomID) && time.Since(fetchedAt) > stateRefreshInterval
+}
+
+// FetchRoomState replaces the stored state of a room with its current state on the homeserver.
+func (ss *NebStateStore) FetchRoomState(cli *mautrix.Client, roomID id.RoomID) error {
+	var evts []*event.Event
+	if _, err := cli.MakeRequest("GET", cli.BuildURL("rooms", roomID, "state"), nil, &evts); err != nil {
+		return err
+	}
+	room := mautrix.NewRoom(roomID)
+	for _, evt := range evts {
+		evt.Type.Class = event.StateEventType
+		_ = evt.Content.ParseRaw(evt.Type) // unknown state event types can't be parsed, which is fine
+		room.UpdateState(evt)
+	}
+	ss.Storer.SaveRoom(room)
+
+	ss.fetchedMutex.Lock()
+	defer ss.fetchedMutex.Unlock()
+	if ss.fetched == nil {
+		ss.fetched = make(map[id.RoomID]time.Time)
+	}
+	ss.fetched[roomID] = time.Now()
+	return nil
 }
 
 // GetEncryptionEvent returns the encryption event for a room.
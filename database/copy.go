@@ -0,0 +1,271 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/crypto/sql_store_upgrade"
+)
+
+// copiedTables are the tables which Copy copies, in order. Go-NEB's own tables come first,
+// followed by the end-to-end encryption store. schema_version and crypto_version aren't copied
+// as both databases are already upgraded to the latest versions.
+var copiedTables = []string{
+	"services",
+	"matrix_clients",
+	"client_sync_state",
+	"auth_realms",
+	"auth_sessions",
+	"bot_options",
+	"sent_notifications",
+	"user_preferences",
+	"audit_log",
+	"crypto_account",
+	"crypto_message_index",
+	"crypto_tracked_user",
+	"crypto_device",
+	"crypto_olm_session",
+	"crypto_megolm_inbound_session",
+	"crypto_megolm_outbound_session",
+	"crypto_cross_signing_keys",
+	"crypto_cross_signing_signatures",
+}
+
+// CopyReport is the number of rows copied into each table.
+type CopyReport map[string]int
+
+// Copy copies every service, client, realm, session, bot option, sent notification, user
+// preference, audit log entry and the end-to-end encryption store from one database to another,
+// e.g. to move from SQLite to PostgreSQL. The destination must not have any of this data already.
+// The source is read in a single transaction, so Go-NEB can keep running against it, but anything
+// it changes after the copy starts won't be copied.
+//
+// Once copied, the contents of each table in the destination are compared with what was read
+// from the source, and an error is returned if they differ.
+func Copy(from, to *ServiceDB) (report CopyReport, err error) {
+	// The destination needs the crypto tables even if the source has never used encryption.
+	if err = sql_store_upgrade.Upgrade(to.db, to.dialect); err != nil {
+		return
+	}
+	for _, table := range copiedTables {
+		var count int
+		if err = to.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			return
+		}
+		if count > 0 {
+			return nil, fmt.Errorf("the destination already has data in %s", table)
+		}
+	}
+
+	report = make(CopyReport)
+	copied := make(map[string]rowFingerprints)
+	err = runTransaction(from.db, func(fromTxn *sql.Tx) error {
+		return runTransaction(to.db, func(toTxn *sql.Tx) error {
+			for _, table := range copiedTables {
+				rows, err := copyTableTxn(fromTxn, toTxn, from.dialect, table)
+				if err != nil {
+					return fmt.Errorf("failed to copy %s: %s", table, err)
+				}
+				report[table] = rows.count()
+				copied[table] = rows
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, table := range copiedTables {
+		var rows rowFingerprints
+		err = runTransaction(to.db, func(txn *sql.Tx) error {
+			rows, err = tableFingerprintsTxn(txn, table)
+			return err
+		})
+		if err != nil {
+			return report, err
+		}
+		if err = copied[table].compare(rows); err != nil {
+			return report, fmt.Errorf("verification of %s failed: %s", table, err)
+		}
+	}
+	return report, nil
+}
+
+// rowFingerprints is the number of times each distinct row appears in a table, keyed by a hash
+// of the row.
+type rowFingerprints map[[sha256.Size]byte]int
+
+// add adds a row. The columns may be in a different order in each database, e.g. after ALTER
+// TABLE, so they are sorted by name. Values are formatted the same way whichever database they
+// came from.
+func (f rowFingerprints) add(columns []string, values []interface{}) {
+	fields := make(map[string]string, len(columns))
+	sorted := make([]string, len(columns))
+	for i, v := range values {
+		fields[columns[i]] = normaliseValue(v)
+		sorted[i] = columns[i]
+	}
+	sort.Strings(sorted)
+	var row strings.Builder
+	for _, column := range sorted {
+		fmt.Fprintf(&row, "%s=%q;", column, fields[column])
+	}
+	f[sha256.Sum256([]byte(row.String()))]++
+}
+
+func (f rowFingerprints) count() (n int) {
+	for _, c := range f {
+		n += c
+	}
+	return
+}
+
+// compare returns an error if the other table doesn't have the same rows.
+func (f rowFingerprints) compare(other rowFingerprints) error {
+	if f.count() != other.count() {
+		return fmt.Errorf("%d rows were copied but the destination has %d", f.count(), other.count())
+	}
+	for fingerprint, n := range f {
+		if other[fingerprint] != n {
+			return fmt.Errorf("a copied row differs in the destination")
+		}
+	}
+	return nil
+}
+
+// copyTableTxn copies every row of the table, returning the rows copied. Tables which don't
+// exist in the source, e.g. the crypto tables if encryption has never been used, are treated
+// as empty.
+func copyTableTxn(fromTxn, toTxn *sql.Tx, fromDialect, table string) (rowFingerprints, error) {
+	copied := make(rowFingerprints)
+	if exists, err := tableExistsTxn(fromTxn, fromDialect, table); err != nil || !exists {
+		return copied, err
+	}
+	rows, err := fromTxn.Query("SELECT * FROM " + table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	binary, err := binaryColumnsTxn(toTxn, table)
+	if err != nil {
+		return nil, err
+	}
+	// Columns are quoted as some are keywords, e.g. "index".
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = `"` + column + `"`
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	stmt, err := toTxn.Prepare(fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(quoted, ", "), strings.Join(placeholders, ", "),
+	))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		copied.add(columns, values)
+		for i, v := range values {
+			// SQLite may return text as bytes, which PostgreSQL would store as an escaped
+			// bytea literal in a TEXT column.
+			if b, ok := v.([]byte); ok && !binary[columns[i]] {
+				values[i] = string(b)
+			}
+		}
+		if _, err := stmt.Exec(values...); err != nil {
+			return nil, err
+		}
+	}
+	return copied, rows.Err()
+}
+
+// tableExistsTxn returns true if the table exists. Querying a missing table would abort a
+// PostgreSQL transaction, so the catalogue is checked instead.
+func tableExistsTxn(txn *sql.Tx, dialect, table string) (exists bool, err error) {
+	if dialect == TypePostgres {
+		err = txn.QueryRow("SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists)
+	} else {
+		err = txn.QueryRow("SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = $1", table).Scan(&exists)
+	}
+	return
+}
+
+// binaryColumnsTxn returns the columns of the table which hold bytes rather than text.
+func binaryColumnsTxn(txn *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := txn.Query("SELECT * FROM " + table + " WHERE 1 = 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	binary := make(map[string]bool)
+	for _, t := range columnTypes {
+		switch strings.ToUpper(t.DatabaseTypeName()) {
+		case "BYTEA", "BLOB":
+			binary[t.Name()] = true
+		}
+	}
+	return binary, nil
+}
+
+// tableFingerprintsTxn returns the rows of the table.
+func tableFingerprintsTxn(txn *sql.Tx, table string) (rowFingerprints, error) {
+	fingerprints := make(rowFingerprints)
+	rows, err := txn.Query("SELECT * FROM " + table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		fingerprints.add(columns, values)
+	}
+	return fingerprints, rows.Err()
+}
+
+// normaliseValue formats a value the same way whichever database it came from.
+func normaliseValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return string(v)
+	case time.Time:
+		// PostgreSQL stores timestamps to the microsecond.
+		return v.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
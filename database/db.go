@@ -30,22 +30,26 @@ func GetServiceDB() Storer {
 	return globalServiceDB
 }
 
-// Open a SQL database to use as a ServiceDB. This will automatically create
-// the necessary database tables if they aren't already present.
+// Open a SQL database to use as a ServiceDB. The database type may be "sqlite3" or
+// "postgres". This will automatically create or upgrade the necessary database tables.
 func Open(databaseType, databaseURL string) (serviceDB *ServiceDB, err error) {
-	db, err := sql.Open(databaseType, databaseURL)
+	dialect, err := normaliseDatabaseType(databaseType)
 	if err != nil {
 		return
 	}
-	if _, err = db.Exec(schemaSQL); err != nil {
+	db, err := sql.Open(dialect, databaseURL)
+	if err != nil {
 		return
 	}
-	if databaseType == "sqlite3" {
+	if dialect == TypeSQLite3 {
 		// Fix for "database is locked" errors
 		// https://github.com/mattn/go-sqlite3/issues/274
 		db.SetMaxOpenConns(1)
 	}
-	serviceDB = &ServiceDB{db: db, dialect: databaseType}
+	if err = runMigrations(db, dialect); err != nil {
+		return
+	}
+	serviceDB = &ServiceDB{db: db, dialect: dialect}
 	return
 }
 
@@ -86,18 +90,47 @@ func (d *ServiceDB) LoadMatrixClientConfig(userID id.UserID) (config api.ClientC
 	return
 }
 
-// UpdateNextBatch updates the next_batch token for the given user.
-func (d *ServiceDB) UpdateNextBatch(userID id.UserID, nextBatch string) (err error) {
+// DeleteMatrixClientConfig deletes the Matrix client config for the given user from the database,
+// along with the sync tokens and filter IDs of its devices.
+func (d *ServiceDB) DeleteMatrixClientConfig(userID id.UserID) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteMatrixClientConfigTxn(txn, userID)
+	})
+	return
+}
+
+// UpdateNextBatch updates the next_batch token for the given user's device.
+func (d *ServiceDB) UpdateNextBatch(userID id.UserID, deviceID id.DeviceID, nextBatch string) (err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		return updateNextBatchTxn(txn, userID, nextBatch)
+		return updateNextBatchTxn(txn, time.Now(), userID, deviceID, nextBatch)
 	})
 	return
 }
 
-// LoadNextBatch loads the next_batch token for the given user.
-func (d *ServiceDB) LoadNextBatch(userID id.UserID) (nextBatch string, err error) {
+// LoadNextBatch loads the next_batch token for the given user's device. Returns "" if the device
+// hasn't synced before.
+func (d *ServiceDB) LoadNextBatch(userID id.UserID, deviceID id.DeviceID) (nextBatch string, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		nextBatch, err = selectNextBatchTxn(txn, userID)
+		nextBatch, err = selectNextBatchTxn(txn, userID, deviceID)
+		return err
+	})
+	return
+}
+
+// UpdateFilterID stores the ID of the sync filter created for the given user's device, along with
+// the filter's JSON so that a new filter can be created if it changes.
+func (d *ServiceDB) UpdateFilterID(userID id.UserID, deviceID id.DeviceID, filterID, filterJSON string) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		return updateFilterTxn(txn, time.Now(), userID, deviceID, filterID, filterJSON)
+	})
+	return
+}
+
+// LoadFilterID loads the ID and JSON of the sync filter for the given user's device. Returns ""
+// for both if no filter has been stored.
+func (d *ServiceDB) LoadFilterID(userID id.UserID, deviceID id.DeviceID) (filterID, filterJSON string, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		filterID, filterJSON, err = selectFilterTxn(txn, userID, deviceID)
 		return err
 	})
 	return
@@ -121,7 +154,7 @@ func (d *ServiceDB) DeleteService(serviceID string) (err error) {
 	return
 }
 
-// LoadServicesForUser loads all the bot services configured for a given user.
+// LoadServicesForUser loads all the enabled bot services configured for a given user.
 // Returns an empty list if there aren't any services configured.
 func (d *ServiceDB) LoadServicesForUser(serviceUserID id.UserID) (services []types.Service, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
@@ -134,7 +167,7 @@ func (d *ServiceDB) LoadServicesForUser(serviceUserID id.UserID) (services []typ
 	return
 }
 
-// LoadServicesByType loads all the bot services configured for a given type.
+// LoadServicesByType loads all the enabled bot services configured for a given type.
 // Returns an empty list if there aren't any services configured.
 func (d *ServiceDB) LoadServicesByType(serviceType string) (services []types.Service, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
@@ -147,6 +180,36 @@ func (d *ServiceDB) LoadServicesByType(serviceType string) (services []types.Ser
 	return
 }
 
+// LoadServices loads every service, including disabled ones, along with the set of service IDs
+// which are disabled.
+func (d *ServiceDB) LoadServices() (services []types.Service, disabled map[string]bool, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		services, disabled, err = selectServicesTxn(txn)
+		return err
+	})
+	return
+}
+
+// IsServiceDisabled returns true if the service has been disabled.
+// Returns sql.ErrNoRows if the service isn't in the database.
+func (d *ServiceDB) IsServiceDisabled(serviceID string) (disabled bool, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		disabled, err = selectServiceDisabledTxn(txn, serviceID)
+		return err
+	})
+	return
+}
+
+// SetServiceDisabled disables or re-enables a service. Disabled services keep their config but
+// are not returned by LoadServicesForUser or LoadServicesByType, so they don't respond to
+// commands or get polled. Returns sql.ErrNoRows if the service isn't in the database.
+func (d *ServiceDB) SetServiceDisabled(serviceID string, disabled bool) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		return updateServiceDisabledTxn(txn, time.Now(), serviceID, disabled)
+	})
+	return
+}
+
 // StoreService stores a service into the database either by inserting a new
 // service or updating an existing service. Returns the old service if there
 // was one.
@@ -227,6 +290,16 @@ func (d *ServiceDB) RemoveAuthSession(realmID string, userID id.UserID) error {
 	})
 }
 
+// RemoveOrphanedAuthSessions removes auth sessions whose realm no longer exists, returning
+// how many were removed.
+func (d *ServiceDB) RemoveOrphanedAuthSessions() (removed int64, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		removed, err = deleteOrphanedAuthSessionsTxn(txn)
+		return err
+	})
+	return
+}
+
 // LoadAuthSessionByUser loads an AuthSession from the database based on the given
 // realm and user ID.
 // Returns sql.ErrNoRows if the session isn't in the database.
@@ -249,6 +322,15 @@ func (d *ServiceDB) LoadAuthSessionByID(realmID, sessionID string) (session type
 	return
 }
 
+// LoadAuthSessionsByRealm loads every AuthSession for the given realm, ordered by user ID.
+func (d *ServiceDB) LoadAuthSessionsByRealm(realmID string) (sessions []types.AuthSession, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		sessions, err = selectAuthSessionsByRealmTxn(txn, realmID)
+		return err
+	})
+	return
+}
+
 // LoadBotOptions loads bot options from the database.
 // Returns sql.ErrNoRows if the bot options isn't in the database.
 func (d *ServiceDB) LoadBotOptions(userID id.UserID, roomID id.RoomID) (opts types.BotOptions, err error) {
@@ -276,6 +358,117 @@ func (d *ServiceDB) StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOpt
 	return
 }
 
+// LoadBotOptionsRooms returns the rooms which each bot user has bot options stored for.
+func (d *ServiceDB) LoadBotOptionsRooms() (rooms map[id.UserID][]id.RoomID, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		rooms, err = selectBotOptionsRoomsTxn(txn)
+		return err
+	})
+	return
+}
+
+// RemoveBotOptions removes the bot options for the given bot user in the given room.
+// No error is returned if there were no bot options in the first place.
+func (d *ServiceDB) RemoveBotOptions(userID id.UserID, roomID id.RoomID) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteBotOptionsTxn(txn, userID, roomID)
+	})
+}
+
+// InsertSentNotification records a notification which a service sent into a room.
+func (d *ServiceDB) InsertSentNotification(n SentNotification) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertSentNotificationTxn(txn, n)
+	})
+}
+
+// LoadSentNotifications returns the notifications sent as the given user into the given room
+// since the given time, oldest first.
+func (d *ServiceDB) LoadSentNotifications(userID id.UserID, roomID id.RoomID, since time.Time) (notifications []SentNotification, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		notifications, err = selectSentNotificationsTxn(txn, userID, roomID, since)
+		return err
+	})
+	return
+}
+
+// RemoveSentNotificationsBefore removes the notifications sent before the given time, returning
+// how many were removed.
+func (d *ServiceDB) RemoveSentNotificationsBefore(before time.Time) (removed int64, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		removed, err = deleteSentNotificationsBeforeTxn(txn, before)
+		return err
+	})
+	return
+}
+
+// LoadUserPreference loads the user's preference with the given key.
+// Returns sql.ErrNoRows if the user hasn't set it.
+func (d *ServiceDB) LoadUserPreference(userID id.UserID, key string) (pref json.RawMessage, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		pref, err = selectUserPreferenceTxn(txn, userID, key)
+		return err
+	})
+	return
+}
+
+// LoadUserPreferences loads every preference the user has set, keyed by preference key.
+func (d *ServiceDB) LoadUserPreferences(userID id.UserID) (prefs map[string]json.RawMessage, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		prefs, err = selectUserPreferencesTxn(txn, userID)
+		return err
+	})
+	return
+}
+
+// StoreUserPreference stores the user's preference with the given key, replacing any existing
+// value.
+func (d *ServiceDB) StoreUserPreference(userID id.UserID, key string, pref json.RawMessage) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		_, err := selectUserPreferenceTxn(txn, userID, key)
+		if err == sql.ErrNoRows {
+			return insertUserPreferenceTxn(txn, time.Now(), userID, key, pref)
+		} else if err != nil {
+			return err
+		}
+		return updateUserPreferenceTxn(txn, time.Now(), userID, key, pref)
+	})
+}
+
+// RemoveUserPreference removes the user's preference with the given key.
+// No error is returned if the user hadn't set it in the first place.
+func (d *ServiceDB) RemoveUserPreference(userID id.UserID, key string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteUserPreferenceTxn(txn, userID, key)
+	})
+}
+
+// InsertAuditEntry records a command or webhook send in the audit log.
+func (d *ServiceDB) InsertAuditEntry(e AuditEntry) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertAuditEntryTxn(txn, e)
+	})
+}
+
+// LoadAuditEntries returns the entries in the audit log which match the query, newest first.
+func (d *ServiceDB) LoadAuditEntries(q AuditQuery) (entries []AuditEntry, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		entries, err = selectAuditEntriesTxn(txn, q)
+		return err
+	})
+	return
+}
+
+// RemoveAuditEntriesBefore removes the audit log entries from before the given time, returning
+// how many were removed.
+func (d *ServiceDB) RemoveAuditEntriesBefore(before time.Time) (removed int64, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		removed, err = deleteAuditEntriesBeforeTxn(txn, before)
+		return err
+	})
+	return
+}
+
 // InsertFromConfig inserts entries from the config file into the database. This only really
 // makes sense for in-memory databases.
 func (d *ServiceDB) InsertFromConfig(cfg *api.ConfigFile) error {
@@ -0,0 +1,444 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/crypto/sql_store_upgrade"
+	"maunium.net/go/mautrix/id"
+)
+
+type testService struct {
+	types.DefaultService
+}
+
+type testRealm struct {
+	id string
+}
+
+func (r *testRealm) ID() string                                                 { return r.id }
+func (r *testRealm) Type() string                                               { return "database-test" }
+func (r *testRealm) Init() error                                                { return nil }
+func (r *testRealm) Register() error                                            { return nil }
+func (r *testRealm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request) {}
+func (r *testRealm) RequestAuthSession(userID id.UserID, config json.RawMessage) interface{} {
+	return nil
+}
+func (r *testRealm) AuthSession(sessionID string, userID id.UserID, realmID string) types.AuthSession {
+	return &testSession{id: sessionID, userID: userID, realmID: realmID}
+}
+
+type testSession struct {
+	id      string
+	userID  id.UserID
+	realmID string
+	Token   string
+}
+
+func (s *testSession) ID() string          { return s.id }
+func (s *testSession) UserID() id.UserID   { return s.userID }
+func (s *testSession) RealmID() string     { return s.realmID }
+func (s *testSession) Authenticated() bool { return s.Token != "" }
+func (s *testSession) Info() interface{}   { return nil }
+
+func init() {
+	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
+		return &testRealm{id: realmID}
+	})
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &testService{types.NewDefaultService(serviceID, serviceUserID, "database-test")}
+	})
+}
+
+func TestDisabledServices(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	sqlDB, _ := db.GetSQLDb()
+	sqlDB.SetMaxOpenConns(1) // each connection to :memory: is a different database
+
+	userID := id.UserID("@neb:localhost")
+	for _, serviceID := range []string{"a", "b"} {
+		srv, _ := types.CreateService(serviceID, "database-test", userID, []byte("{}"))
+		if _, err = db.StoreService(srv); err != nil {
+			t.Fatalf("StoreService: %s", err)
+		}
+	}
+	if err = db.SetServiceDisabled("b", true); err != nil {
+		t.Fatalf("SetServiceDisabled: %s", err)
+	}
+	if err = db.SetServiceDisabled("missing", true); err != sql.ErrNoRows {
+		t.Errorf("SetServiceDisabled of a missing service => %v, want sql.ErrNoRows", err)
+	}
+
+	forUser, err := db.LoadServicesForUser(userID)
+	if err != nil || len(forUser) != 1 || forUser[0].ServiceID() != "a" {
+		t.Errorf("LoadServicesForUser => %v, %v, want only service a", forUser, err)
+	}
+	byType, err := db.LoadServicesByType("database-test")
+	if err != nil || len(byType) != 1 || byType[0].ServiceID() != "a" {
+		t.Errorf("LoadServicesByType => %v, %v, want only service a", byType, err)
+	}
+	all, disabled, err := db.LoadServices()
+	if err != nil || len(all) != 2 || disabled["a"] || !disabled["b"] {
+		t.Errorf("LoadServices => %d services, disabled %v, %v, want 2 services with b disabled", len(all), disabled, err)
+	}
+	if isDisabled, err := db.IsServiceDisabled("b"); err != nil || !isDisabled {
+		t.Errorf("IsServiceDisabled(b) => %v, %v, want true", isDisabled, err)
+	}
+
+	// storing a new config keeps the service disabled
+	srv, _ := types.CreateService("b", "database-test", userID, []byte("{}"))
+	if _, err = db.StoreService(srv); err != nil {
+		t.Fatalf("StoreService: %s", err)
+	}
+	if isDisabled, _ := db.IsServiceDisabled("b"); !isDisabled {
+		t.Error("StoreService re-enabled a disabled service")
+	}
+	if err = db.SetServiceDisabled("b", false); err != nil {
+		t.Fatalf("SetServiceDisabled: %s", err)
+	}
+	if isDisabled, _ := db.IsServiceDisabled("b"); isDisabled {
+		t.Error("SetServiceDisabled(false) didn't re-enable the service")
+	}
+}
+
+func TestSyncStatePerDevice(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	userID := id.UserID("@neb:localhost")
+
+	if err = db.UpdateNextBatch(userID, "A", "s1"); err != nil {
+		t.Fatalf("UpdateNextBatch: %s", err)
+	}
+	if err = db.UpdateFilterID(userID, "A", "f1", `{"room":{}}`); err != nil {
+		t.Fatalf("UpdateFilterID: %s", err)
+	}
+	if err = db.UpdateNextBatch(userID, "B", "s2"); err != nil {
+		t.Fatalf("UpdateNextBatch: %s", err)
+	}
+	if err = db.UpdateNextBatch(userID, "A", "s3"); err != nil {
+		t.Fatalf("UpdateNextBatch: %s", err)
+	}
+
+	for device, want := range map[id.DeviceID]string{"A": "s3", "B": "s2", "C": ""} {
+		if got, err := db.LoadNextBatch(userID, device); err != nil || got != want {
+			t.Errorf("LoadNextBatch(%s) => %q, %v, want %q", device, got, err, want)
+		}
+	}
+	if filterID, filterJSON, err := db.LoadFilterID(userID, "A"); err != nil || filterID != "f1" || filterJSON != `{"room":{}}` {
+		t.Errorf("LoadFilterID(A) => %q, %q, %v, want f1", filterID, filterJSON, err)
+	}
+	if filterID, _, err := db.LoadFilterID(userID, "B"); err != nil || filterID != "" {
+		t.Errorf("LoadFilterID(B) => %q, %v, want nothing", filterID, err)
+	}
+
+	// Removing the client forgets where each of its devices had synced to.
+	if err = db.DeleteMatrixClientConfig(userID); err != nil {
+		t.Fatalf("DeleteMatrixClientConfig: %s", err)
+	}
+	if got, err := db.LoadNextBatch(userID, "A"); err != nil || got != "" {
+		t.Errorf("LoadNextBatch(A) after deleting the client => %q, %v, want nothing", got, err)
+	}
+	if filterID, _, err := db.LoadFilterID(userID, "A"); err != nil || filterID != "" {
+		t.Errorf("LoadFilterID(A) after deleting the client => %q, %v, want nothing", filterID, err)
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	sqlDB, _ := db.GetSQLDb()
+	sqlDB.SetMaxOpenConns(1) // each connection to :memory: is a different database
+
+	// Sessions for a realm which was never stored, as if it had been deleted.
+	for _, userID := range []string{"@alice:localhost", "@bob:localhost"} {
+		if _, err = sqlDB.Exec(insertAuthSessionSQL, "sid"+userID, "gone", userID, "{}", 0, 0); err != nil {
+			t.Fatalf("Failed to insert session: %s", err)
+		}
+	}
+	if removed, err := db.RemoveOrphanedAuthSessions(); err != nil || removed != 2 {
+		t.Errorf("RemoveOrphanedAuthSessions => %d, %v, want 2", removed, err)
+	}
+	if removed, err := db.RemoveOrphanedAuthSessions(); err != nil || removed != 0 {
+		t.Errorf("RemoveOrphanedAuthSessions again => %d, %v, want 0", removed, err)
+	}
+
+	userID := id.UserID("@neb:localhost")
+	for _, roomID := range []id.RoomID{"!a:localhost", "!b:localhost"} {
+		if _, err = db.StoreBotOptions(types.BotOptions{UserID: userID, RoomID: roomID}); err != nil {
+			t.Fatalf("StoreBotOptions: %s", err)
+		}
+	}
+	if err = db.RemoveBotOptions(userID, "!a:localhost"); err != nil {
+		t.Fatalf("RemoveBotOptions: %s", err)
+	}
+	rooms, err := db.LoadBotOptionsRooms()
+	if err != nil {
+		t.Fatalf("LoadBotOptionsRooms: %s", err)
+	}
+	if len(rooms) != 1 || len(rooms[userID]) != 1 || rooms[userID][0] != "!b:localhost" {
+		t.Errorf("LoadBotOptionsRooms => %v, want only !b:localhost", rooms)
+	}
+}
+
+func TestSentNotifications(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	sqlDB, _ := db.GetSQLDb()
+	sqlDB.SetMaxOpenConns(1) // each connection to :memory: is a different database
+
+	userID := id.UserID("@neb:localhost")
+	start := time.Date(2016, 1, 5, 12, 0, 0, 0, time.UTC)
+	for i, roomID := range []id.RoomID{"!a:localhost", "!b:localhost", "!a:localhost", "!a:localhost"} {
+		err = db.InsertSentNotification(SentNotification{
+			UserID:    userID,
+			RoomID:    roomID,
+			EventID:   id.EventID(fmt.Sprintf("$%d", i)),
+			ServiceID: "alerts",
+			Timestamp: start.Add(time.Duration(i) * time.Hour),
+			Body:      "Disk full",
+		})
+		if err != nil {
+			t.Fatalf("InsertSentNotification: %s", err)
+		}
+	}
+	sent, err := db.LoadSentNotifications(userID, "!a:localhost", start.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("LoadSentNotifications: %s", err)
+	}
+	if len(sent) != 2 || sent[0].EventID != "$2" || sent[1].EventID != "$3" || !sent[0].Timestamp.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("LoadSentNotifications => %+v, want $2 and $3", sent)
+	}
+	if removed, err := db.RemoveSentNotificationsBefore(start.Add(2 * time.Hour)); err != nil || removed != 2 {
+		t.Errorf("RemoveSentNotificationsBefore => %d, %v, want 2", removed, err)
+	}
+	if sent, err = db.LoadSentNotifications(userID, "!a:localhost", start); err != nil || len(sent) != 2 {
+		t.Errorf("LoadSentNotifications after removal => %d notifications, %v, want 2", len(sent), err)
+	}
+}
+
+func TestUserPreferences(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	sqlDB, _ := db.GetSQLDb()
+	sqlDB.SetMaxOpenConns(1) // each connection to :memory: is a different database
+
+	userID := id.UserID("@alice:localhost")
+	if _, err = db.LoadUserPreference(userID, "github"); err != sql.ErrNoRows {
+		t.Errorf("LoadUserPreference before storing => %v, want sql.ErrNoRows", err)
+	}
+	for _, pref := range []string{`{"default_repo":"a/b"}`, `{"default_repo":"c/d"}`} {
+		if err = db.StoreUserPreference(userID, "github", json.RawMessage(pref)); err != nil {
+			t.Fatalf("StoreUserPreference: %s", err)
+		}
+	}
+	if err = db.StoreUserPreference("@bob:localhost", "github", json.RawMessage(`{}`)); err != nil {
+		t.Fatalf("StoreUserPreference: %s", err)
+	}
+	if pref, err := db.LoadUserPreference(userID, "github"); err != nil || string(pref) != `{"default_repo":"c/d"}` {
+		t.Errorf("LoadUserPreference => %s, %v, want the updated preference", pref, err)
+	}
+	prefs, err := db.LoadUserPreferences(userID)
+	if err != nil || len(prefs) != 1 || string(prefs["github"]) != `{"default_repo":"c/d"}` {
+		t.Errorf("LoadUserPreferences => %v, %v, want only github", prefs, err)
+	}
+	if err = db.RemoveUserPreference(userID, "github"); err != nil {
+		t.Fatalf("RemoveUserPreference: %s", err)
+	}
+	if _, err = db.LoadUserPreference(userID, "github"); err != sql.ErrNoRows {
+		t.Errorf("LoadUserPreference after removal => %v, want sql.ErrNoRows", err)
+	}
+	if _, err = db.LoadUserPreference("@bob:localhost", "github"); err != nil {
+		t.Errorf("LoadUserPreference for another user after removal => %v, want it kept", err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	sqlDB, _ := db.GetSQLDb()
+	sqlDB.SetMaxOpenConns(1) // each connection to :memory: is a different database
+
+	start := time.Date(2016, 1, 5, 12, 0, 0, 0, time.UTC)
+	for i, roomID := range []id.RoomID{"!a:localhost", "!b:localhost", "!a:localhost", "!a:localhost"} {
+		err = db.InsertAuditEntry(AuditEntry{
+			Kind:        AuditCommand,
+			UserID:      "@alice:localhost",
+			RoomID:      roomID,
+			ServiceID:   "github",
+			ServiceType: "github",
+			Command:     fmt.Sprintf("github %d", i),
+			Outcome:     AuditSuccess,
+			Timestamp:   start.Add(time.Duration(i) * time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("InsertAuditEntry: %s", err)
+		}
+	}
+	entries, err := db.LoadAuditEntries(AuditQuery{RoomID: "!a:localhost", Since: start.Add(time.Hour), Limit: 1})
+	if err != nil {
+		t.Fatalf("LoadAuditEntries: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Command != "github 3" || !entries[0].Timestamp.Equal(start.Add(3*time.Hour)) {
+		t.Errorf("LoadAuditEntries => %+v, want the newest entry in !a:localhost", entries)
+	}
+	entries, err = db.LoadAuditEntries(AuditQuery{UserID: "@alice:localhost", Until: start.Add(2 * time.Hour)})
+	if err != nil || len(entries) != 2 || entries[0].Command != "github 1" || entries[1].Command != "github 0" {
+		t.Errorf("LoadAuditEntries until => %+v, %v, want github 1 and github 0", entries, err)
+	}
+	if removed, err := db.RemoveAuditEntriesBefore(start.Add(2 * time.Hour)); err != nil || removed != 2 {
+		t.Errorf("RemoveAuditEntriesBefore => %d, %v, want 2", removed, err)
+	}
+	if entries, err = db.LoadAuditEntries(AuditQuery{}); err != nil || len(entries) != 2 {
+		t.Errorf("LoadAuditEntries after removal => %d entries, %v, want 2", len(entries), err)
+	}
+}
+
+func TestEncryptedSecrets(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	sqlDB, _ := db.GetSQLDb()
+	sqlDB.SetMaxOpenConns(1) // each connection to :memory: is a different database
+	defer SetEncryptionKey(nil)
+
+	// Secrets stored before a key is set are in plaintext.
+	if _, err = db.StoreAuthRealm(&testRealm{id: "realm"}); err != nil {
+		t.Fatalf("StoreAuthRealm: %s", err)
+	}
+	if _, err = db.StoreAuthSession(&testSession{id: "sid1", userID: "@alice:localhost", realmID: "realm", Token: "alice_secret"}); err != nil {
+		t.Fatalf("StoreAuthSession: %s", err)
+	}
+	if _, err = db.StoreMatrixClientConfig(api.ClientConfig{UserID: "@neb:localhost", AccessToken: "neb_secret"}); err != nil {
+		t.Fatalf("StoreMatrixClientConfig: %s", err)
+	}
+
+	key := make([]byte, 32)
+	if err = SetEncryptionKey(key[:16]); err == nil {
+		t.Error("SetEncryptionKey accepted a 16 byte key")
+	}
+	if err = SetEncryptionKey(key); err != nil {
+		t.Fatalf("SetEncryptionKey: %s", err)
+	}
+	if _, err = db.StoreAuthSession(&testSession{id: "sid2", userID: "@bob:localhost", realmID: "realm", Token: "bob_secret"}); err != nil {
+		t.Fatalf("StoreAuthSession: %s", err)
+	}
+	if encrypted, err := db.EncryptSecrets(); err != nil || encrypted != 2 {
+		t.Errorf("EncryptSecrets => %d, %v, want 2", encrypted, err)
+	}
+	if encrypted, err := db.EncryptSecrets(); err != nil || encrypted != 0 {
+		t.Errorf("EncryptSecrets again => %d, %v, want 0", encrypted, err)
+	}
+
+	// Nothing secret is left in plaintext, but everything loads as before.
+	for _, query := range []string{"SELECT session_json FROM auth_sessions", "SELECT client_json FROM matrix_clients"} {
+		rows, err := sqlDB.Query(query)
+		if err != nil {
+			t.Fatalf("Query: %s", err)
+		}
+		for rows.Next() {
+			var stored string
+			rows.Scan(&stored)
+			if strings.Contains(stored, "secret") {
+				t.Errorf("Secret stored in plaintext: %s", stored)
+			}
+		}
+		rows.Close()
+	}
+	for _, userID := range []id.UserID{"@alice:localhost", "@bob:localhost"} {
+		session, err := db.LoadAuthSessionByUser("realm", userID)
+		if err != nil || !session.Authenticated() {
+			t.Errorf("LoadAuthSessionByUser(%s) => %+v, %v, want the decrypted session", userID, session, err)
+		}
+	}
+	config, err := db.LoadMatrixClientConfig("@neb:localhost")
+	if err != nil || config.AccessToken != "neb_secret" {
+		t.Errorf("LoadMatrixClientConfig => %+v, %v, want the decrypted access token", config, err)
+	}
+
+	SetEncryptionKey(nil)
+	if _, err = db.LoadAuthSessionByUser("realm", "@alice:localhost"); err != ErrNoEncryptionKey {
+		t.Errorf("LoadAuthSessionByUser without a key => %v, want ErrNoEncryptionKey", err)
+	}
+	key[0] = 1
+	SetEncryptionKey(key)
+	if _, err = db.LoadMatrixClientConfigs(); err == nil {
+		t.Error("LoadMatrixClientConfigs with the wrong key succeeded")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	dir := t.TempDir()
+	from, err := Open("sqlite3", filepath.Join(dir, "from.db"))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	userID := id.UserID("@neb:localhost")
+	srv, _ := types.CreateService("a", "database-test", userID, []byte("{}"))
+	if _, err = from.StoreService(srv); err != nil {
+		t.Fatalf("StoreService: %s", err)
+	}
+	if err = from.SetServiceDisabled("a", true); err != nil {
+		t.Fatalf("SetServiceDisabled: %s", err)
+	}
+	if err = from.UpdateNextBatch(userID, "DEVICE", "s1"); err != nil {
+		t.Fatalf("UpdateNextBatch: %s", err)
+	}
+	opts := types.BotOptions{UserID: userID, RoomID: "!a:localhost", Options: &types.BotOptionsContent{}}
+	if _, err = from.StoreBotOptions(opts); err != nil {
+		t.Fatalf("StoreBotOptions: %s", err)
+	}
+	if err = sql_store_upgrade.Upgrade(from.db, from.dialect); err != nil {
+		t.Fatalf("Failed to create crypto store: %s", err)
+	}
+	_, err = from.db.Exec(
+		"INSERT INTO crypto_olm_session (account_id, session_id, sender_key, session, created_at, last_used) VALUES ($1, $2, $3, $4, $5, $6)",
+		"@neb:localhost-DEVICE", "sid", "key", []byte{0, 1, 2}, time.Now(), time.Now(),
+	)
+	if err != nil {
+		t.Fatalf("Failed to insert olm session: %s", err)
+	}
+
+	to, err := Open("sqlite3", filepath.Join(dir, "to.db"))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	report, err := Copy(from, to)
+	if err != nil {
+		t.Fatalf("Copy: %s", err)
+	}
+	if report["services"] != 1 || report["client_sync_state"] != 1 || report["bot_options"] != 1 || report["crypto_olm_session"] != 1 {
+		t.Errorf("Copy reported %v, want 1 service, sync state, bot options and olm session", report)
+	}
+	if disabled, err := to.IsServiceDisabled("a"); err != nil || !disabled {
+		t.Errorf("IsServiceDisabled(a) after copy => %v, %v, want true", disabled, err)
+	}
+	if nextBatch, err := to.LoadNextBatch(userID, "DEVICE"); err != nil || nextBatch != "s1" {
+		t.Errorf("LoadNextBatch after copy => %q, %v, want s1", nextBatch, err)
+	}
+
+	if _, err = Copy(from, to); err == nil {
+		t.Error("Copy into a database with data succeeded, want an error")
+	}
+}
@@ -0,0 +1,235 @@
+package database
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"maunium.net/go/mautrix/id"
+)
+
+// encryptedPrefix marks a value encrypted with the encryption key. It is followed by the base64
+// encoded nonce and ciphertext.
+const encryptedPrefix = "enc:v1:"
+
+// ErrNoEncryptionKey is returned when an encrypted secret is loaded but no encryption key is set.
+var ErrNoEncryptionKey = errors.New("the database contains encrypted secrets but no encryption key is set")
+
+var (
+	encryptionMu  sync.RWMutex
+	encryptionKey cipher.AEAD
+)
+
+// SetEncryptionKey sets the key used to encrypt auth sessions and Matrix client access tokens
+// before they are stored in the database. The key must be 32 bytes long, for AES-256-GCM. Secrets
+// are stored in plaintext if no key is set, and secrets stored in plaintext before the key was
+// set are still loaded, see EncryptSecrets. A nil key stops encrypting newly stored secrets, but
+// ones which are already encrypted can then no longer be loaded.
+func SetEncryptionKey(key []byte) error {
+	var aead cipher.AEAD
+	if key != nil {
+		if len(key) != 32 {
+			return fmt.Errorf("the encryption key must be 32 bytes long, not %d", len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		if aead, err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+	}
+	encryptionMu.Lock()
+	defer encryptionMu.Unlock()
+	encryptionKey = aead
+	return nil
+}
+
+// ParseEncryptionKey decodes a base64 encoded encryption key, e.g. from `openssl rand -base64 32`.
+func ParseEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("the encryption key must be base64 encoded: %s", err)
+	}
+	return key, nil
+}
+
+// sealSecret encrypts the secret with the encryption key, or returns it unchanged if there isn't
+// one.
+func sealSecret(secret []byte) ([]byte, error) {
+	encryptionMu.RLock()
+	aead := encryptionKey
+	encryptionMu.RUnlock()
+	if aead == nil {
+		return secret, nil
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, secret, nil)
+	return []byte(encryptedPrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// openSecret decrypts a secret returned by sealSecret. Secrets which aren't encrypted are returned
+// unchanged.
+func openSecret(stored []byte) ([]byte, error) {
+	if !isSealed(stored) {
+		return stored, nil
+	}
+	encryptionMu.RLock()
+	aead := encryptionKey
+	encryptionMu.RUnlock()
+	if aead == nil {
+		return nil, ErrNoEncryptionKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(stored[len(encryptedPrefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted secret: %s", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed encrypted secret: too short")
+	}
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret, is the encryption key correct? %s", err)
+	}
+	return secret, nil
+}
+
+func isSealed(stored []byte) bool {
+	return bytes.HasPrefix(stored, []byte(encryptedPrefix))
+}
+
+// sealClientConfig returns the config with its access token encrypted. The rest of the config is
+// left readable.
+func sealClientConfig(config api.ClientConfig) (api.ClientConfig, error) {
+	if config.AccessToken == "" {
+		return config, nil
+	}
+	token, err := sealSecret([]byte(config.AccessToken))
+	if err != nil {
+		return config, err
+	}
+	config.AccessToken = string(token)
+	return config, nil
+}
+
+// openClientConfig decrypts the access token of a config returned by sealClientConfig.
+func openClientConfig(config api.ClientConfig) (api.ClientConfig, error) {
+	token, err := openSecret([]byte(config.AccessToken))
+	if err != nil {
+		return config, fmt.Errorf("client %s: %s", config.UserID, err)
+	}
+	config.AccessToken = string(token)
+	return config, nil
+}
+
+// EncryptSecrets encrypts the auth sessions and Matrix client access tokens which were stored in
+// plaintext, e.g. before an encryption key was set, returning how many rows were encrypted. It
+// does nothing if no encryption key is set.
+func (d *ServiceDB) EncryptSecrets() (encrypted int64, err error) {
+	encryptionMu.RLock()
+	hasKey := encryptionKey != nil
+	encryptionMu.RUnlock()
+	if !hasKey {
+		return 0, nil
+	}
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		encrypted = 0
+		n, err := encryptAuthSessionsTxn(txn, time.Now())
+		if err != nil {
+			return err
+		}
+		encrypted += n
+		n, err = encryptMatrixClientConfigsTxn(txn, time.Now())
+		encrypted += n
+		return err
+	})
+	return
+}
+
+func encryptAuthSessionsTxn(txn *sql.Tx, now time.Time) (int64, error) {
+	type plainSession struct {
+		realmID     string
+		userID      id.UserID
+		sessionJSON []byte
+	}
+	rows, err := txn.Query("SELECT realm_id, user_id, session_json FROM auth_sessions")
+	if err != nil {
+		return 0, err
+	}
+	var plain []plainSession
+	for rows.Next() {
+		var s plainSession
+		if err := rows.Scan(&s.realmID, &s.userID, &s.sessionJSON); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !isSealed(s.sessionJSON) {
+			plain = append(plain, s)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	t := now.UnixNano() / 1000000
+	for _, s := range plain {
+		sealed, err := sealSecret(s.sessionJSON)
+		if err != nil {
+			return 0, err
+		}
+		_, err = txn.Exec(
+			"UPDATE auth_sessions SET session_json=$1, time_updated_ms=$2 WHERE realm_id=$3 AND user_id=$4",
+			sealed, t, s.realmID, s.userID,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(plain)), nil
+}
+
+func encryptMatrixClientConfigsTxn(txn *sql.Tx, now time.Time) (int64, error) {
+	rows, err := txn.Query(selectMatrixClientConfigsSQL)
+	if err != nil {
+		return 0, err
+	}
+	var plain []api.ClientConfig
+	for rows.Next() {
+		var config api.ClientConfig
+		var configJSON []byte
+		if err := rows.Scan(&configJSON); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if err := json.Unmarshal(configJSON, &config); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if config.AccessToken != "" && !isSealed([]byte(config.AccessToken)) {
+			plain = append(plain, config)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, config := range plain {
+		if err := updateMatrixClientConfigTxn(txn, now, config); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(plain)), nil
+}
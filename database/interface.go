@@ -1,6 +1,10 @@
 package database
 
 import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/types"
 	"maunium.net/go/mautrix/id"
@@ -11,15 +15,21 @@ type Storer interface {
 	StoreMatrixClientConfig(config api.ClientConfig) (oldConfig api.ClientConfig, err error)
 	LoadMatrixClientConfigs() (configs []api.ClientConfig, err error)
 	LoadMatrixClientConfig(userID id.UserID) (config api.ClientConfig, err error)
+	DeleteMatrixClientConfig(userID id.UserID) (err error)
 
-	UpdateNextBatch(userID id.UserID, nextBatch string) (err error)
-	LoadNextBatch(userID id.UserID) (nextBatch string, err error)
+	UpdateNextBatch(userID id.UserID, deviceID id.DeviceID, nextBatch string) (err error)
+	LoadNextBatch(userID id.UserID, deviceID id.DeviceID) (nextBatch string, err error)
+	UpdateFilterID(userID id.UserID, deviceID id.DeviceID, filterID, filterJSON string) (err error)
+	LoadFilterID(userID id.UserID, deviceID id.DeviceID) (filterID, filterJSON string, err error)
 
 	LoadService(serviceID string) (service types.Service, err error)
 	DeleteService(serviceID string) (err error)
 	LoadServicesForUser(serviceUserID id.UserID) (services []types.Service, err error)
 	LoadServicesByType(serviceType string) (services []types.Service, err error)
 	StoreService(service types.Service) (oldService types.Service, err error)
+	LoadServices() (services []types.Service, disabled map[string]bool, err error)
+	IsServiceDisabled(serviceID string) (disabled bool, err error)
+	SetServiceDisabled(serviceID string, disabled bool) (err error)
 
 	LoadAuthRealm(realmID string) (realm types.AuthRealm, err error)
 	LoadAuthRealmsByType(realmType string) (realms []types.AuthRealm, err error)
@@ -28,14 +38,92 @@ type Storer interface {
 	StoreAuthSession(session types.AuthSession) (old types.AuthSession, err error)
 	LoadAuthSessionByUser(realmID string, userID id.UserID) (session types.AuthSession, err error)
 	LoadAuthSessionByID(realmID, sessionID string) (session types.AuthSession, err error)
+	LoadAuthSessionsByRealm(realmID string) (sessions []types.AuthSession, err error)
 	RemoveAuthSession(realmID string, userID id.UserID) error
+	RemoveOrphanedAuthSessions() (removed int64, err error)
 
 	LoadBotOptions(userID id.UserID, roomID id.RoomID) (opts types.BotOptions, err error)
 	StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOptions, err error)
+	LoadBotOptionsRooms() (rooms map[id.UserID][]id.RoomID, err error)
+	RemoveBotOptions(userID id.UserID, roomID id.RoomID) error
+
+	InsertSentNotification(n SentNotification) error
+	LoadSentNotifications(userID id.UserID, roomID id.RoomID, since time.Time) (notifications []SentNotification, err error)
+	RemoveSentNotificationsBefore(before time.Time) (removed int64, err error)
+
+	LoadUserPreference(userID id.UserID, key string) (pref json.RawMessage, err error)
+	LoadUserPreferences(userID id.UserID) (prefs map[string]json.RawMessage, err error)
+	StoreUserPreference(userID id.UserID, key string, pref json.RawMessage) error
+	RemoveUserPreference(userID id.UserID, key string) error
+
+	InsertAuditEntry(e AuditEntry) error
+	LoadAuditEntries(q AuditQuery) (entries []AuditEntry, err error)
+	RemoveAuditEntriesBefore(before time.Time) (removed int64, err error)
 
 	InsertFromConfig(cfg *api.ConfigFile) error
 }
 
+// A SentNotification is a notification which a service sent into a room. They are kept so that
+// rooms can export the notifications they were sent, e.g. for incident reviews.
+type SentNotification struct {
+	// The user the notification was sent as.
+	UserID  id.UserID
+	RoomID  id.RoomID
+	EventID id.EventID
+	// The service which sent the notification.
+	ServiceID string
+	Timestamp time.Time
+	// The plain text of the notification.
+	Body string
+}
+
+// Kinds of AuditEntry.
+const (
+	// A command which a user ran.
+	AuditCommand = "command"
+	// A notification which a service sent in response to a webhook.
+	AuditWebhookSend = "webhook_send"
+)
+
+// Outcomes of an AuditEntry.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	// The user wasn't allowed to run the command.
+	AuditDenied = "denied"
+)
+
+// An AuditEntry records a command which a user ran, or a notification which a service sent in
+// response to a webhook. They are kept for compliance, e.g. to show who changed what and when.
+type AuditEntry struct {
+	// AuditCommand or AuditWebhookSend.
+	Kind string
+	// The user who ran the command, or the user the notification was sent as.
+	UserID      id.UserID
+	RoomID      id.RoomID
+	ServiceID   string
+	ServiceType string
+	// The path of the command which was run, e.g. "github create". Empty for webhook sends.
+	Command string
+	// AuditSuccess, AuditFailure or AuditDenied.
+	Outcome string
+	// Why the command or send failed, if it did.
+	Detail    string
+	Timestamp time.Time
+}
+
+// An AuditQuery selects entries from the audit log. Fields which aren't set match every entry.
+type AuditQuery struct {
+	UserID    id.UserID
+	RoomID    id.RoomID
+	ServiceID string
+	// Only entries at or after Since, and before Until, are returned.
+	Since time.Time
+	Until time.Time
+	// The most entries to return. 0 returns every entry.
+	Limit int
+}
+
 // NopStorage nops every store API call. This is intended to be embedded into derived structs
 // in tests
 type NopStorage struct{}
@@ -55,13 +143,28 @@ func (s *NopStorage) LoadMatrixClientConfig(userID id.UserID) (config api.Client
 	return
 }
 
+// DeleteMatrixClientConfig NOP
+func (s *NopStorage) DeleteMatrixClientConfig(userID id.UserID) (err error) {
+	return
+}
+
 // UpdateNextBatch NOP
-func (s *NopStorage) UpdateNextBatch(userID id.UserID, nextBatch string) (err error) {
+func (s *NopStorage) UpdateNextBatch(userID id.UserID, deviceID id.DeviceID, nextBatch string) (err error) {
 	return
 }
 
 // LoadNextBatch NOP
-func (s *NopStorage) LoadNextBatch(userID id.UserID) (nextBatch string, err error) {
+func (s *NopStorage) LoadNextBatch(userID id.UserID, deviceID id.DeviceID) (nextBatch string, err error) {
+	return
+}
+
+// UpdateFilterID NOP
+func (s *NopStorage) UpdateFilterID(userID id.UserID, deviceID id.DeviceID, filterID, filterJSON string) (err error) {
+	return
+}
+
+// LoadFilterID NOP
+func (s *NopStorage) LoadFilterID(userID id.UserID, deviceID id.DeviceID) (filterID, filterJSON string, err error) {
 	return
 }
 
@@ -90,6 +193,21 @@ func (s *NopStorage) StoreService(service types.Service) (oldService types.Servi
 	return
 }
 
+// LoadServices NOP
+func (s *NopStorage) LoadServices() (services []types.Service, disabled map[string]bool, err error) {
+	return
+}
+
+// IsServiceDisabled NOP
+func (s *NopStorage) IsServiceDisabled(serviceID string) (disabled bool, err error) {
+	return
+}
+
+// SetServiceDisabled NOP
+func (s *NopStorage) SetServiceDisabled(serviceID string, disabled bool) (err error) {
+	return
+}
+
 // LoadAuthRealm NOP
 func (s *NopStorage) LoadAuthRealm(realmID string) (realm types.AuthRealm, err error) {
 	return
@@ -120,11 +238,21 @@ func (s *NopStorage) LoadAuthSessionByID(realmID, sessionID string) (session typ
 	return
 }
 
+// LoadAuthSessionsByRealm NOP
+func (s *NopStorage) LoadAuthSessionsByRealm(realmID string) (sessions []types.AuthSession, err error) {
+	return
+}
+
 // RemoveAuthSession NOP
 func (s *NopStorage) RemoveAuthSession(realmID string, userID id.UserID) error {
 	return nil
 }
 
+// RemoveOrphanedAuthSessions NOP
+func (s *NopStorage) RemoveOrphanedAuthSessions() (removed int64, err error) {
+	return
+}
+
 // LoadBotOptions NOP
 func (s *NopStorage) LoadBotOptions(userID id.UserID, roomID id.RoomID) (opts types.BotOptions, err error) {
 	return
@@ -135,6 +263,66 @@ func (s *NopStorage) StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOp
 	return
 }
 
+// LoadBotOptionsRooms NOP
+func (s *NopStorage) LoadBotOptionsRooms() (rooms map[id.UserID][]id.RoomID, err error) {
+	return
+}
+
+// RemoveBotOptions NOP
+func (s *NopStorage) RemoveBotOptions(userID id.UserID, roomID id.RoomID) error {
+	return nil
+}
+
+// InsertSentNotification NOP
+func (s *NopStorage) InsertSentNotification(n SentNotification) error {
+	return nil
+}
+
+// LoadSentNotifications NOP
+func (s *NopStorage) LoadSentNotifications(userID id.UserID, roomID id.RoomID, since time.Time) (notifications []SentNotification, err error) {
+	return
+}
+
+// RemoveSentNotificationsBefore NOP
+func (s *NopStorage) RemoveSentNotificationsBefore(before time.Time) (removed int64, err error) {
+	return
+}
+
+// InsertAuditEntry NOP
+func (s *NopStorage) InsertAuditEntry(e AuditEntry) error {
+	return nil
+}
+
+// LoadAuditEntries NOP
+func (s *NopStorage) LoadAuditEntries(q AuditQuery) (entries []AuditEntry, err error) {
+	return
+}
+
+// RemoveAuditEntriesBefore NOP
+func (s *NopStorage) RemoveAuditEntriesBefore(before time.Time) (removed int64, err error) {
+	return
+}
+
+// LoadUserPreference NOP
+func (s *NopStorage) LoadUserPreference(userID id.UserID, key string) (pref json.RawMessage, err error) {
+	return nil, sql.ErrNoRows
+}
+
+// LoadUserPreferences NOP
+func (s *NopStorage) LoadUserPreferences(userID id.UserID) (prefs map[string]json.RawMessage, err error) {
+	return
+}
+
+// StoreUserPreference NOP
+func (s *NopStorage) StoreUserPreference(userID id.UserID, key string, pref json.RawMessage) error {
+	return nil
+}
+
+// RemoveUserPreference NOP
+func (s *NopStorage) RemoveUserPreference(userID id.UserID, key string) error {
+	return nil
+}
+
 // InsertFromConfig NOP
 func (s *NopStorage) InsertFromConfig(cfg *api.ConfigFile) error {
 	return nil
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Supported values for the database type.
+const (
+	TypeSQLite3  = "sqlite3"
+	TypePostgres = "postgres"
+)
+
+// normaliseDatabaseType maps the user supplied database type onto the name of the SQL driver
+// (and crypto store dialect) to use for it.
+func normaliseDatabaseType(databaseType string) (string, error) {
+	switch databaseType {
+	case "sqlite3", "sqlite":
+		return TypeSQLite3, nil
+	case "postgres", "postgresql":
+		return TypePostgres, nil
+	}
+	return "", fmt.Errorf("unsupported database type '%s': must be '%s' or '%s'", databaseType, TypeSQLite3, TypePostgres)
+}
+
+// A migration upgrades the schema by a single version. The dialect is one of TypeSQLite3 or
+// TypePostgres and can be used for statements which are not portable between the two.
+type migration func(txn *sql.Tx, dialect string) error
+
+// migrations is the ordered list of schema upgrades. The schema version stored in the database
+// is the number of migrations which have been applied. New migrations MUST be appended; existing
+// ones MUST NOT be modified once released.
+var migrations = []migration{
+	// 1: the original schema. This uses IF NOT EXISTS so that databases created before
+	// schema versioning was introduced are picked up without changes.
+	func(txn *sql.Tx, dialect string) error {
+		_, err := txn.Exec(schemaSQL)
+		return err
+	},
+	// 2: services can be disabled without deleting their config.
+	func(txn *sql.Tx, dialect string) error {
+		_, err := txn.Exec("ALTER TABLE services ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE")
+		return err
+	},
+	// 3: sync tokens and filter IDs are stored per device, so that the same user can sync with
+	// more than one device. They get a table of their own, as matrix_clients has one row per
+	// user, holding the config. matrix_clients.next_batch is no longer used.
+	func(txn *sql.Tx, dialect string) error {
+		if _, err := txn.Exec(createClientSyncStateSQL); err != nil {
+			return err
+		}
+		return copyNextBatchesTxn(txn)
+	},
+	// 4: notifications sent by services are logged, so that rooms can export them.
+	func(txn *sql.Tx, dialect string) error {
+		_, err := txn.Exec(createSentNotificationsSQL)
+		return err
+	},
+	// 5: users can store preferences which apply in every room, e.g. their default GitHub repo.
+	func(txn *sql.Tx, dialect string) error {
+		_, err := txn.Exec(createUserPreferencesSQL)
+		return err
+	},
+	// 6: commands and webhook sends are logged for auditing.
+	func(txn *sql.Tx, dialect string) error {
+		_, err := txn.Exec(createAuditLogSQL)
+		return err
+	},
+}
+
+const createClientSyncStateSQL = `
+CREATE TABLE client_sync_state (
+	user_id TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	next_batch TEXT NOT NULL,
+	filter_id TEXT NOT NULL,
+	filter_json TEXT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(user_id, device_id)
+)
+`
+
+const createSentNotificationsSQL = `
+CREATE TABLE sent_notifications (
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	service_id TEXT NOT NULL,
+	body TEXT NOT NULL,
+	time_sent_ms BIGINT NOT NULL
+);
+CREATE INDEX sent_notifications_room_idx ON sent_notifications(user_id, room_id, time_sent_ms);
+`
+
+const createSchemaVersionSQL = `
+CREATE TABLE IF NOT EXISTS schema_version (
+	version INTEGER NOT NULL
+)
+`
+
+const createUserPreferencesSQL = `
+CREATE TABLE user_preferences (
+	user_id TEXT NOT NULL,
+	pref_key TEXT NOT NULL,
+	pref_json TEXT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(user_id, pref_key)
+)
+`
+
+const createAuditLogSQL = `
+CREATE TABLE audit_log (
+	kind TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	service_id TEXT NOT NULL,
+	service_type TEXT NOT NULL,
+	command TEXT NOT NULL,
+	outcome TEXT NOT NULL,
+	detail TEXT NOT NULL,
+	time_ms BIGINT NOT NULL
+);
+CREATE INDEX audit_log_time_idx ON audit_log(time_ms);
+CREATE INDEX audit_log_room_idx ON audit_log(room_id, time_ms);
+`
+
+// runMigrations brings the schema up to date, applying each outstanding migration in its own
+// transaction.
+func runMigrations(db *sql.DB, dialect string) error {
+	if _, err := db.Exec(createSchemaVersionSQL); err != nil {
+		return err
+	}
+	var version int
+	err := db.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		if _, err = db.Exec("INSERT INTO schema_version(version) VALUES (0)"); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		err = runTransaction(db, func(txn *sql.Tx) error {
+			if err := migrations[version](txn, dialect); err != nil {
+				return fmt.Errorf("migration to schema version %d failed: %s", version+1, err)
+			}
+			_, err := txn.Exec("UPDATE schema_version SET version = $1", version+1)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SchemaVersion returns the schema version of the database, and the latest version which databases
+// are upgraded to when they are opened. This queries the database, so also checks that it can be
+// reached.
+func (d *ServiceDB) SchemaVersion() (version, latest int, err error) {
+	err = d.db.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	return version, len(migrations), err
+}
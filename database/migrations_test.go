@@ -0,0 +1,70 @@
+package database
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestOpenMigratesSchema(t *testing.T) {
+	db, err := Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	sqlDB, dialect := db.GetSQLDb()
+	if dialect != TypeSQLite3 {
+		t.Errorf("Open: want dialect %s, got %s", TypeSQLite3, dialect)
+	}
+	var version int
+	if err = sqlDB.QueryRow("SELECT version FROM schema_version").Scan(&version); err != nil {
+		t.Fatalf("Failed to select schema version: %s", err)
+	}
+	if version != len(migrations) {
+		t.Errorf("want schema version %d, got %d", len(migrations), version)
+	}
+	if version, latest, err := db.SchemaVersion(); err != nil || version != latest || latest != len(migrations) {
+		t.Errorf("SchemaVersion: want %d, %d, got %d, %d, %v", len(migrations), len(migrations), version, latest, err)
+	}
+	// running the migrations again must be a no-op
+	if err = runMigrations(sqlDB, dialect); err != nil {
+		t.Errorf("Failed to re-run migrations: %s", err)
+	}
+
+	if _, err = Open("mysql", ""); err == nil {
+		t.Error("Open: expected an error for an unsupported database type")
+	}
+}
+
+func TestMigrateNextBatches(t *testing.T) {
+	sqlDB, err := sql.Open(TypeSQLite3, ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %s", err)
+	}
+	sqlDB.SetMaxOpenConns(1) // each connection to :memory: is a different database
+
+	// Create a database from before sync state was stored per device.
+	all := migrations
+	migrations = all[:2]
+	err = runMigrations(sqlDB, TypeSQLite3)
+	migrations = all
+	if err != nil {
+		t.Fatalf("runMigrations: %s", err)
+	}
+	_, err = sqlDB.Exec(`INSERT INTO matrix_clients(user_id, client_json, next_batch, time_added_ms, time_updated_ms)
+		VALUES ('@neb:localhost', '{"UserID":"@neb:localhost","DeviceID":"NEB"}', 's123', 0, 0)`)
+	if err != nil {
+		t.Fatalf("Failed to insert client: %s", err)
+	}
+
+	if err = runMigrations(sqlDB, TypeSQLite3); err != nil {
+		t.Fatalf("runMigrations: %s", err)
+	}
+	db := &ServiceDB{db: sqlDB, dialect: TypeSQLite3}
+	if nextBatch, err := db.LoadNextBatch("@neb:localhost", "NEB"); err != nil || nextBatch != "s123" {
+		t.Errorf("LoadNextBatch => %q, %v, want s123", nextBatch, err)
+	}
+	if nextBatch, err := db.LoadNextBatch("@neb:localhost", "OTHER"); err != nil || nextBatch != "" {
+		t.Errorf("LoadNextBatch for another device => %q, %v, want nothing", nextBatch, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/matrix-org/go-neb/api"
@@ -11,6 +12,9 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
+// Statements in this file MUST work on both SQLite and PostgreSQL. Both accept "$1"-style
+// placeholders, so use those rather than "?". Schema changes belong in migrations.go.
+
 const schemaSQL = `
 CREATE TABLE IF NOT EXISTS services (
 	service_id TEXT NOT NULL,
@@ -73,8 +77,10 @@ func selectMatrixClientConfigTxn(txn *sql.Tx, userID id.UserID) (config api.Clie
 	if err != nil {
 		return
 	}
-	err = json.Unmarshal(configJSON, &config)
-	return
+	if err = json.Unmarshal(configJSON, &config); err != nil {
+		return
+	}
+	return openClientConfig(config)
 }
 
 const selectMatrixClientConfigsSQL = `
@@ -96,6 +102,9 @@ func selectMatrixClientConfigsTxn(txn *sql.Tx) (configs []api.ClientConfig, err
 		if err = json.Unmarshal(configJSON, &config); err != nil {
 			return
 		}
+		if config, err = openClientConfig(config); err != nil {
+			return
+		}
 		configs = append(configs, config)
 	}
 	return
@@ -109,6 +118,10 @@ INSERT INTO matrix_clients(
 
 func insertMatrixClientConfigTxn(txn *sql.Tx, now time.Time, config api.ClientConfig) error {
 	t := now.UnixNano() / 1000000
+	config, err := sealClientConfig(config)
+	if err != nil {
+		return err
+	}
 	configJSON, err := json.Marshal(&config)
 	if err != nil {
 		return err
@@ -117,6 +130,23 @@ func insertMatrixClientConfigTxn(txn *sql.Tx, now time.Time, config api.ClientCo
 	return err
 }
 
+const deleteMatrixClientConfigSQL = `
+DELETE FROM matrix_clients WHERE user_id = $1
+`
+
+const deleteClientSyncStateSQL = `
+DELETE FROM client_sync_state WHERE user_id = $1
+`
+
+func deleteMatrixClientConfigTxn(txn *sql.Tx, userID id.UserID) error {
+	if _, err := txn.Exec(deleteMatrixClientConfigSQL, userID); err != nil {
+		return err
+	}
+	// A client configured again for the user must not resume syncing from where this one was.
+	_, err := txn.Exec(deleteClientSyncStateSQL, userID)
+	return err
+}
+
 const updateMatrixClientConfigSQL = `
 UPDATE matrix_clients SET client_json = $1, time_updated_ms = $2
 	WHERE user_id = $3
@@ -124,6 +154,10 @@ UPDATE matrix_clients SET client_json = $1, time_updated_ms = $2
 
 func updateMatrixClientConfigTxn(txn *sql.Tx, now time.Time, config api.ClientConfig) error {
 	t := now.UnixNano() / 1000000
+	config, err := sealClientConfig(config)
+	if err != nil {
+		return err
+	}
 	configJSON, err := json.Marshal(&config)
 	if err != nil {
 		return err
@@ -132,28 +166,110 @@ func updateMatrixClientConfigTxn(txn *sql.Tx, now time.Time, config api.ClientCo
 	return err
 }
 
-const updateNextBatchSQL = `
-UPDATE matrix_clients SET next_batch = $1 WHERE user_id = $2
+// copyNextBatchesTxn copies the sync tokens in matrix_clients into client_sync_state, for the
+// device in each client's config.
+func copyNextBatchesTxn(txn *sql.Tx) error {
+	rows, err := txn.Query("SELECT client_json, next_batch FROM matrix_clients WHERE next_batch != ''")
+	if err != nil {
+		return err
+	}
+	var configs []api.ClientConfig
+	var nextBatches []string
+	for rows.Next() {
+		var configJSON []byte
+		var nextBatch string
+		var config api.ClientConfig
+		if err = rows.Scan(&configJSON, &nextBatch); err != nil {
+			rows.Close()
+			return err
+		}
+		if err = json.Unmarshal(configJSON, &config); err != nil {
+			rows.Close()
+			return err
+		}
+		configs = append(configs, config)
+		nextBatches = append(nextBatches, nextBatch)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	now := time.Now()
+	for i, config := range configs {
+		if err = updateNextBatchTxn(txn, now, config.UserID, config.DeviceID, nextBatches[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const insertClientSyncStateSQL = `
+INSERT INTO client_sync_state(
+	user_id, device_id, next_batch, filter_id, filter_json, time_updated_ms
+) VALUES ($1, $2, '', '', '', $3)
 `
 
-func updateNextBatchTxn(txn *sql.Tx, userID id.UserID, nextBatch string) error {
-	_, err := txn.Exec(updateNextBatchSQL, nextBatch, userID)
+// execSyncStateTxn runs an UPDATE of the device's row in client_sync_state, creating the row
+// first if there isn't one. The user and device IDs are the last two arguments of the statement.
+func execSyncStateTxn(txn *sql.Tx, now time.Time, userID id.UserID, deviceID id.DeviceID, updateSQL string, args ...interface{}) error {
+	args = append(args, userID, deviceID)
+	res, err := txn.Exec(updateSQL, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	if _, err = txn.Exec(insertClientSyncStateSQL, userID, deviceID, now.UnixNano()/1000000); err != nil {
+		return err
+	}
+	_, err = txn.Exec(updateSQL, args...)
 	return err
 }
 
+const updateNextBatchSQL = `
+UPDATE client_sync_state SET next_batch = $1, time_updated_ms = $2
+	WHERE user_id = $3 AND device_id = $4
+`
+
+func updateNextBatchTxn(txn *sql.Tx, now time.Time, userID id.UserID, deviceID id.DeviceID, nextBatch string) error {
+	return execSyncStateTxn(txn, now, userID, deviceID, updateNextBatchSQL, nextBatch, now.UnixNano()/1000000)
+}
+
 const selectNextBatchSQL = `
-SELECT next_batch FROM matrix_clients WHERE user_id = $1
+SELECT next_batch FROM client_sync_state WHERE user_id = $1 AND device_id = $2
 `
 
-func selectNextBatchTxn(txn *sql.Tx, userID id.UserID) (string, error) {
+func selectNextBatchTxn(txn *sql.Tx, userID id.UserID, deviceID id.DeviceID) (string, error) {
 	var nextBatch string
-	row := txn.QueryRow(selectNextBatchSQL, userID)
-	if err := row.Scan(&nextBatch); err != nil {
+	row := txn.QueryRow(selectNextBatchSQL, userID, deviceID)
+	if err := row.Scan(&nextBatch); err != nil && err != sql.ErrNoRows {
 		return "", err
 	}
 	return nextBatch, nil
 }
 
+const updateFilterSQL = `
+UPDATE client_sync_state SET filter_id = $1, filter_json = $2, time_updated_ms = $3
+	WHERE user_id = $4 AND device_id = $5
+`
+
+func updateFilterTxn(txn *sql.Tx, now time.Time, userID id.UserID, deviceID id.DeviceID, filterID, filterJSON string) error {
+	return execSyncStateTxn(txn, now, userID, deviceID, updateFilterSQL, filterID, filterJSON, now.UnixNano()/1000000)
+}
+
+const selectFilterSQL = `
+SELECT filter_id, filter_json FROM client_sync_state WHERE user_id = $1 AND device_id = $2
+`
+
+func selectFilterTxn(txn *sql.Tx, userID id.UserID, deviceID id.DeviceID) (filterID, filterJSON string, err error) {
+	row := txn.QueryRow(selectFilterSQL, userID, deviceID)
+	if err = row.Scan(&filterID, &filterJSON); err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
 const selectServiceSQL = `
 SELECT service_type, service_user_id, service_json FROM services
 	WHERE service_id = $1
@@ -208,7 +324,8 @@ func insertServiceTxn(txn *sql.Tx, now time.Time, service types.Service) error {
 }
 
 const selectServicesForUserSQL = `
-SELECT service_id, service_type, service_json FROM services WHERE service_user_id=$1 ORDER BY service_id
+SELECT service_id, service_type, service_json FROM services
+	WHERE service_user_id=$1 AND NOT disabled ORDER BY service_id
 `
 
 func selectServicesForUserTxn(txn *sql.Tx, userID id.UserID) (srvs []types.Service, err error) {
@@ -235,7 +352,8 @@ func selectServicesForUserTxn(txn *sql.Tx, userID id.UserID) (srvs []types.Servi
 }
 
 const selectServicesByTypeSQL = `
-SELECT service_id, service_user_id, service_json FROM services WHERE service_type=$1 ORDER BY service_id
+SELECT service_id, service_user_id, service_json FROM services
+	WHERE service_type=$1 AND NOT disabled ORDER BY service_id
 `
 
 func selectServicesByTypeTxn(txn *sql.Tx, serviceType string) (srvs []types.Service, err error) {
@@ -261,6 +379,62 @@ func selectServicesByTypeTxn(txn *sql.Tx, serviceType string) (srvs []types.Serv
 	return
 }
 
+const selectServicesSQL = `
+SELECT service_id, service_type, service_user_id, service_json, disabled FROM services ORDER BY service_id
+`
+
+func selectServicesTxn(txn *sql.Tx) (srvs []types.Service, disabled map[string]bool, err error) {
+	rows, err := txn.Query(selectServicesSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	disabled = make(map[string]bool)
+	for rows.Next() {
+		var s types.Service
+		var serviceID, serviceType string
+		var serviceUserID id.UserID
+		var serviceJSON []byte
+		var isDisabled bool
+		if err = rows.Scan(&serviceID, &serviceType, &serviceUserID, &serviceJSON, &isDisabled); err != nil {
+			return
+		}
+		s, err = types.CreateService(serviceID, serviceType, serviceUserID, serviceJSON)
+		if err != nil {
+			return
+		}
+		srvs = append(srvs, s)
+		if isDisabled {
+			disabled[serviceID] = true
+		}
+	}
+	return
+}
+
+const selectServiceDisabledSQL = `
+SELECT disabled FROM services WHERE service_id = $1
+`
+
+func selectServiceDisabledTxn(txn *sql.Tx, serviceID string) (disabled bool, err error) {
+	err = txn.QueryRow(selectServiceDisabledSQL, serviceID).Scan(&disabled)
+	return
+}
+
+const updateServiceDisabledSQL = `
+UPDATE services SET disabled=$1, time_updated_ms=$2 WHERE service_id=$3
+`
+
+func updateServiceDisabledTxn(txn *sql.Tx, now time.Time, serviceID string, disabled bool) error {
+	res, err := txn.Exec(updateServiceDisabledSQL, disabled, now.UnixNano()/1000000, serviceID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 const deleteServiceSQL = `
 DELETE FROM services WHERE service_id = $1
 `
@@ -358,6 +532,9 @@ func insertAuthSessionTxn(txn *sql.Tx, now time.Time, session types.AuthSession)
 	if err != nil {
 		return err
 	}
+	if sessionJSON, err = sealSecret(sessionJSON); err != nil {
+		return err
+	}
 	t := now.UnixNano() / 1000000
 	_, err = txn.Exec(
 		insertAuthSessionSQL,
@@ -375,6 +552,18 @@ func deleteAuthSessionTxn(txn *sql.Tx, realmID string, userID id.UserID) error {
 	return err
 }
 
+const deleteOrphanedAuthSessionsSQL = `
+DELETE FROM auth_sessions WHERE realm_id NOT IN (SELECT realm_id FROM auth_realms)
+`
+
+func deleteOrphanedAuthSessionsTxn(txn *sql.Tx) (int64, error) {
+	res, err := txn.Exec(deleteOrphanedAuthSessionsSQL)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 const selectAuthSessionByUserSQL = `
 SELECT session_id, realm_type, realm_json, session_json FROM auth_sessions
 	JOIN auth_realms ON auth_sessions.realm_id = auth_realms.realm_id
@@ -398,6 +587,10 @@ func selectAuthSessionByUserTxn(txn *sql.Tx, realmID string, userID id.UserID) (
 	if session == nil {
 		return nil, fmt.Errorf("Cannot create session for given realm")
 	}
+	sessionJSON, err = openSecret(sessionJSON)
+	if err != nil {
+		return nil, err
+	}
 	if err := json.Unmarshal(sessionJSON, session); err != nil {
 		return nil, err
 	}
@@ -427,12 +620,57 @@ func selectAuthSessionByIDTxn(txn *sql.Tx, realmID, sid string) (types.AuthSessi
 	if session == nil {
 		return nil, fmt.Errorf("Cannot create session for given realm")
 	}
+	sessionJSON, err = openSecret(sessionJSON)
+	if err != nil {
+		return nil, err
+	}
 	if err := json.Unmarshal(sessionJSON, session); err != nil {
 		return nil, err
 	}
 	return session, nil
 }
 
+const selectAuthSessionsByRealmSQL = `
+SELECT session_id, user_id, realm_type, realm_json, session_json FROM auth_sessions
+	JOIN auth_realms ON auth_sessions.realm_id = auth_realms.realm_id
+	WHERE auth_sessions.realm_id = $1 ORDER BY user_id
+`
+
+func selectAuthSessionsByRealmTxn(txn *sql.Tx, realmID string) ([]types.AuthSession, error) {
+	rows, err := txn.Query(selectAuthSessionsByRealmSQL, realmID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []types.AuthSession
+	var realm types.AuthRealm
+	for rows.Next() {
+		var sid, realmType string
+		var userID id.UserID
+		var realmJSON, sessionJSON []byte
+		if err := rows.Scan(&sid, &userID, &realmType, &realmJSON, &sessionJSON); err != nil {
+			return nil, err
+		}
+		if realm == nil {
+			if realm, err = types.CreateAuthRealm(realmID, realmType, realmJSON); err != nil {
+				return nil, err
+			}
+		}
+		session := realm.AuthSession(sid, userID, realmID)
+		if session == nil {
+			return nil, fmt.Errorf("Cannot create session for given realm")
+		}
+		if sessionJSON, err = openSecret(sessionJSON); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(sessionJSON, session); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
 const updateAuthSessionSQL = `
 UPDATE auth_sessions SET session_id=$1, session_json=$2, time_updated_ms=$3
 	WHERE realm_id=$4 AND user_id=$5
@@ -443,6 +681,9 @@ func updateAuthSessionTxn(txn *sql.Tx, now time.Time, session types.AuthSession)
 	if err != nil {
 		return err
 	}
+	if sessionJSON, err = sealSecret(sessionJSON); err != nil {
+		return err
+	}
 	t := now.UnixNano() / 1000000
 	_, err = txn.Exec(
 		updateAuthSessionSQL, session.ID(), sessionJSON, t,
@@ -495,3 +736,222 @@ func updateBotOptionsTxn(txn *sql.Tx, now time.Time, opts types.BotOptions) erro
 	_, err = txn.Exec(updateBotOptionsSQL, optsJSON, opts.SetByUserID, t, opts.UserID, opts.RoomID)
 	return err
 }
+
+const selectBotOptionsRoomsSQL = `
+SELECT user_id, room_id FROM bot_options
+`
+
+func selectBotOptionsRoomsTxn(txn *sql.Tx) (map[id.UserID][]id.RoomID, error) {
+	rows, err := txn.Query(selectBotOptionsRoomsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rooms := make(map[id.UserID][]id.RoomID)
+	for rows.Next() {
+		var userID id.UserID
+		var roomID id.RoomID
+		if err := rows.Scan(&userID, &roomID); err != nil {
+			return nil, err
+		}
+		rooms[userID] = append(rooms[userID], roomID)
+	}
+	return rooms, rows.Err()
+}
+
+const deleteBotOptionsSQL = `
+DELETE FROM bot_options WHERE user_id = $1 AND room_id = $2
+`
+
+func deleteBotOptionsTxn(txn *sql.Tx, userID id.UserID, roomID id.RoomID) error {
+	_, err := txn.Exec(deleteBotOptionsSQL, userID, roomID)
+	return err
+}
+
+const insertSentNotificationSQL = `
+INSERT INTO sent_notifications(
+	user_id, room_id, event_id, service_id, body, time_sent_ms
+) VALUES ($1, $2, $3, $4, $5, $6)
+`
+
+func insertSentNotificationTxn(txn *sql.Tx, n SentNotification) error {
+	_, err := txn.Exec(insertSentNotificationSQL, n.UserID, n.RoomID, n.EventID, n.ServiceID, n.Body,
+		n.Timestamp.UnixNano()/1000000)
+	return err
+}
+
+const selectSentNotificationsSQL = `
+SELECT event_id, service_id, body, time_sent_ms FROM sent_notifications
+	WHERE user_id = $1 AND room_id = $2 AND time_sent_ms >= $3 ORDER BY time_sent_ms
+`
+
+func selectSentNotificationsTxn(txn *sql.Tx, userID id.UserID, roomID id.RoomID, since time.Time) ([]SentNotification, error) {
+	rows, err := txn.Query(selectSentNotificationsSQL, userID, roomID, since.UnixNano()/1000000)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var notifications []SentNotification
+	for rows.Next() {
+		n := SentNotification{UserID: userID, RoomID: roomID}
+		var sentMs int64
+		if err := rows.Scan(&n.EventID, &n.ServiceID, &n.Body, &sentMs); err != nil {
+			return nil, err
+		}
+		n.Timestamp = time.Unix(0, sentMs*1000000)
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+const deleteSentNotificationsBeforeSQL = `
+DELETE FROM sent_notifications WHERE time_sent_ms < $1
+`
+
+func deleteSentNotificationsBeforeTxn(txn *sql.Tx, before time.Time) (int64, error) {
+	res, err := txn.Exec(deleteSentNotificationsBeforeSQL, before.UnixNano()/1000000)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+const selectUserPreferenceSQL = `
+SELECT pref_json FROM user_preferences WHERE user_id = $1 AND pref_key = $2
+`
+
+func selectUserPreferenceTxn(txn *sql.Tx, userID id.UserID, key string) (json.RawMessage, error) {
+	var pref []byte
+	if err := txn.QueryRow(selectUserPreferenceSQL, userID, key).Scan(&pref); err != nil {
+		return nil, err
+	}
+	return json.RawMessage(pref), nil
+}
+
+const selectUserPreferencesSQL = `
+SELECT pref_key, pref_json FROM user_preferences WHERE user_id = $1
+`
+
+func selectUserPreferencesTxn(txn *sql.Tx, userID id.UserID) (map[string]json.RawMessage, error) {
+	rows, err := txn.Query(selectUserPreferencesSQL, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	prefs := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var key string
+		var pref []byte
+		if err := rows.Scan(&key, &pref); err != nil {
+			return nil, err
+		}
+		prefs[key] = json.RawMessage(pref)
+	}
+	return prefs, rows.Err()
+}
+
+const insertUserPreferenceSQL = `
+INSERT INTO user_preferences(user_id, pref_key, pref_json, time_updated_ms) VALUES ($1, $2, $3, $4)
+`
+
+func insertUserPreferenceTxn(txn *sql.Tx, now time.Time, userID id.UserID, key string, pref json.RawMessage) error {
+	_, err := txn.Exec(insertUserPreferenceSQL, userID, key, string(pref), now.UnixNano()/1000000)
+	return err
+}
+
+const updateUserPreferenceSQL = `
+UPDATE user_preferences SET pref_json = $1, time_updated_ms = $2 WHERE user_id = $3 AND pref_key = $4
+`
+
+func updateUserPreferenceTxn(txn *sql.Tx, now time.Time, userID id.UserID, key string, pref json.RawMessage) error {
+	_, err := txn.Exec(updateUserPreferenceSQL, string(pref), now.UnixNano()/1000000, userID, key)
+	return err
+}
+
+const deleteUserPreferenceSQL = `
+DELETE FROM user_preferences WHERE user_id = $1 AND pref_key = $2
+`
+
+func deleteUserPreferenceTxn(txn *sql.Tx, userID id.UserID, key string) error {
+	_, err := txn.Exec(deleteUserPreferenceSQL, userID, key)
+	return err
+}
+
+const insertAuditEntrySQL = `
+INSERT INTO audit_log(
+	kind, user_id, room_id, service_id, service_type, command, outcome, detail, time_ms
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+`
+
+func insertAuditEntryTxn(txn *sql.Tx, e AuditEntry) error {
+	_, err := txn.Exec(insertAuditEntrySQL, e.Kind, e.UserID, e.RoomID, e.ServiceID, e.ServiceType,
+		e.Command, e.Outcome, e.Detail, e.Timestamp.UnixNano()/1000000)
+	return err
+}
+
+const selectAuditEntriesSQL = `
+SELECT kind, user_id, room_id, service_id, service_type, command, outcome, detail, time_ms FROM audit_log
+`
+
+func selectAuditEntriesTxn(txn *sql.Tx, q AuditQuery) ([]AuditEntry, error) {
+	var where []string
+	var args []interface{}
+	filter := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+	if q.UserID != "" {
+		filter("user_id = $%d", q.UserID)
+	}
+	if q.RoomID != "" {
+		filter("room_id = $%d", q.RoomID)
+	}
+	if q.ServiceID != "" {
+		filter("service_id = $%d", q.ServiceID)
+	}
+	if !q.Since.IsZero() {
+		filter("time_ms >= $%d", q.Since.UnixNano()/1000000)
+	}
+	if !q.Until.IsZero() {
+		filter("time_ms < $%d", q.Until.UnixNano()/1000000)
+	}
+	query := selectAuditEntriesSQL
+	if len(where) > 0 {
+		query += "WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY time_ms DESC"
+	if q.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+
+	rows, err := txn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var timeMs int64
+		err := rows.Scan(&e.Kind, &e.UserID, &e.RoomID, &e.ServiceID, &e.ServiceType, &e.Command,
+			&e.Outcome, &e.Detail, &timeMs)
+		if err != nil {
+			return nil, err
+		}
+		e.Timestamp = time.Unix(0, timeMs*1000000)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+const deleteAuditEntriesBeforeSQL = `
+DELETE FROM audit_log WHERE time_ms < $1
+`
+
+func deleteAuditEntriesBeforeTxn(txn *sql.Tx, before time.Time) (int64, error) {
+	res, err := txn.Exec(deleteAuditEntriesBeforeSQL, before.UnixNano()/1000000)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -4,12 +4,16 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/matrix-org/dugong"
@@ -17,25 +21,54 @@ import (
 	"github.com/matrix-org/go-neb/api/handlers"
 	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
 	_ "github.com/matrix-org/go-neb/metrics"
 	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/provision"
+	_ "github.com/matrix-org/go-neb/realms/discourse"
+	_ "github.com/matrix-org/go-neb/realms/email"
 	_ "github.com/matrix-org/go-neb/realms/github"
 	_ "github.com/matrix-org/go-neb/realms/jira"
+	"github.com/matrix-org/go-neb/secrets"
 
 	_ "github.com/matrix-org/go-neb/services/alertmanager"
+	_ "github.com/matrix-org/go-neb/services/analytics"
+	_ "github.com/matrix-org/go-neb/services/backups"
+	_ "github.com/matrix-org/go-neb/services/birthdays"
+	_ "github.com/matrix-org/go-neb/services/calendar"
 	_ "github.com/matrix-org/go-neb/services/cryptotest"
+	_ "github.com/matrix-org/go-neb/services/deploy"
+	_ "github.com/matrix-org/go-neb/services/discord"
+	_ "github.com/matrix-org/go-neb/services/discourse"
 	_ "github.com/matrix-org/go-neb/services/echo"
+	_ "github.com/matrix-org/go-neb/services/fediverse"
+	_ "github.com/matrix-org/go-neb/services/genericwebhook"
 	_ "github.com/matrix-org/go-neb/services/giphy"
 	_ "github.com/matrix-org/go-neb/services/github"
+	_ "github.com/matrix-org/go-neb/services/gitlab"
 
 	_ "github.com/matrix-org/go-neb/services/google"
+	_ "github.com/matrix-org/go-neb/services/grafana"
 	_ "github.com/matrix-org/go-neb/services/guggy"
 	_ "github.com/matrix-org/go-neb/services/imgur"
 
+	_ "github.com/matrix-org/go-neb/services/janitor"
 	_ "github.com/matrix-org/go-neb/services/jira"
+	_ "github.com/matrix-org/go-neb/services/linkguard"
+	_ "github.com/matrix-org/go-neb/services/minutes"
+	_ "github.com/matrix-org/go-neb/services/outboundwebhook"
+	_ "github.com/matrix-org/go-neb/services/remindme"
+	_ "github.com/matrix-org/go-neb/services/router"
 	_ "github.com/matrix-org/go-neb/services/rssbot"
+	_ "github.com/matrix-org/go-neb/services/scheduler"
+	_ "github.com/matrix-org/go-neb/services/sentry"
+	_ "github.com/matrix-org/go-neb/services/setup"
 	_ "github.com/matrix-org/go-neb/services/slackapi"
+	_ "github.com/matrix-org/go-neb/services/summarize"
+	_ "github.com/matrix-org/go-neb/services/timer"
+	_ "github.com/matrix-org/go-neb/services/translate"
 	_ "github.com/matrix-org/go-neb/services/travisci"
+	_ "github.com/matrix-org/go-neb/services/weather"
 	_ "github.com/matrix-org/go-neb/services/wikipedia"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/util"
@@ -74,6 +107,11 @@ func loadFromConfig(db *database.ServiceDB, configFilePath string) (*api.ConfigF
 	// Convert to map[string]interface
 	dict := convertKeysToStrings(cfg)
 
+	// Replace ${ENV_VAR} and file:// references with the secrets they refer to
+	if dict, err = expandSecrets(dict); err != nil {
+		return nil, err
+	}
+
 	// Convert to JSON bytes
 	b, err := json.Marshal(dict)
 	if err != nil {
@@ -114,6 +152,32 @@ func convertKeysToStrings(iface interface{}) interface{} {
 	return iface // base type like string or number
 }
 
+// expandSecrets replaces references to secrets in string values with the secrets, see
+// secrets.Expand. Map keys are left alone.
+func expandSecrets(iface interface{}) (interface{}, error) {
+	switch v := iface.(type) {
+	case string:
+		return secrets.Expand(v)
+	case map[string]interface{}:
+		for k := range v {
+			expanded, err := expandSecrets(v[k])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", k, err)
+			}
+			v[k] = expanded
+		}
+	case []interface{}:
+		for i := range v {
+			expanded, err := expandSecrets(v[i])
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %s", i, err)
+			}
+			v[i] = expanded
+		}
+	}
+	return iface, nil
+}
+
 func insertServicesFromConfig(clis *clients.Clients, serviceReqs []api.ConfigureServiceRequest) error {
 	for i, s := range serviceReqs {
 		if err := s.Check(); err != nil {
@@ -141,6 +205,20 @@ func insertServicesFromConfig(clis *clients.Clients, serviceReqs []api.Configure
 	return nil
 }
 
+// setEncryptionKey sets the key secrets are encrypted with in the database. The key may be a
+// reference to a secret, e.g. one kept in Vault.
+func setEncryptionKey(value string) error {
+	encoded, err := secrets.Resolve(value)
+	if err != nil {
+		return err
+	}
+	key, err := database.ParseEncryptionKey(encoded)
+	if err != nil {
+		return err
+	}
+	return database.SetEncryptionKey(key)
+}
+
 func loadDatabase(databaseType, databaseURL, configYAML string) (*database.ServiceDB, error) {
 	if databaseType == "" && databaseURL == "" {
 		databaseType = "sqlite3"
@@ -154,16 +232,40 @@ func loadDatabase(databaseType, databaseURL, configYAML string) (*database.Servi
 	return db, err
 }
 
-func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
+// setup starts Go-NEB's clients and polling and adds its HTTP handlers to the mux. The config
+// reloader is nil unless a config file is used.
+func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) (*clients.Clients, *configReloader) {
 	err := types.BaseURL(e.BaseURL)
 	if err != nil {
 		log.WithError(err).Panic("Failed to get base url")
 	}
 
+	// Secrets may be kept in Vault rather than the database or config file, see the secrets package.
+	if os.Getenv("VAULT_ADDR") != "" {
+		vault, err := secrets.NewVaultFromEnv()
+		if err != nil {
+			log.WithError(err).Panic("Failed to configure Vault")
+		}
+		secrets.Register("vault", vault)
+		vault.StartRenewing()
+	}
+
+	// Auth sessions and client access tokens are encrypted in the database if a key is given.
+	if e.DatabaseEncryptionKey != "" {
+		if err := setEncryptionKey(e.DatabaseEncryptionKey); err != nil {
+			log.WithError(err).Panic("Bad DATABASE_ENCRYPTION_KEY")
+		}
+	}
+
 	db, err := loadDatabase(e.DatabaseType, e.DatabaseURL, e.ConfigFile)
 	if err != nil {
 		log.WithError(err).Panic("Failed to open database")
 	}
+	if encrypted, err := db.EncryptSecrets(); err != nil {
+		log.WithError(err).Panic("Failed to encrypt secrets stored in plaintext")
+	} else if encrypted > 0 {
+		log.WithField("rows", encrypted).Info("Encrypted secrets stored in plaintext")
+	}
 
 	// Populate the database from the config file if one was supplied.
 	var cfg *api.ConfigFile
@@ -180,6 +282,9 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 	}
 
 	matrixClients := clients.New(db, matrixClient)
+	if e.ReadOnly {
+		_ = matrixClients.SetReadOnly("", true) // can't fail when setting every client
+	}
 	if err := matrixClients.Start(); err != nil {
 		log.WithError(err).Panic("Failed to start up clients")
 	}
@@ -193,64 +298,196 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 	mux.HandleFunc("/realms/redirects/", prometheus.InstrumentHandlerFunc("realmRedirectHandler", util.Protect(rh.Handle)))
 
 	mux.Handle("/verifySAS", prometheus.InstrumentHandler("verifySAS", util.MakeJSONAPI(&handlers.VerifySAS{matrixClients})))
+	// These don't change the configuration of clients, services or realms, so they are available
+	// in config file mode too.
+	mux.Handle("/admin/polling", prometheus.InstrumentHandler("pollingStatus", util.MakeJSONAPI(&handlers.PollingStatus{})))
+	mux.Handle("/admin/serviceHealth", prometheus.InstrumentHandler("serviceHealth", util.MakeJSONAPI(&handlers.ServiceHealth{})))
+	mux.Handle("/admin/gc", prometheus.InstrumentHandler("gc", util.MakeJSONAPI(&handlers.GarbageCollect{matrixClients})))
+	mux.Handle("/admin/cleanup", prometheus.InstrumentHandler("cleanup", util.MakeJSONAPI(&handlers.Cleanup{matrixClients})))
+	mux.Handle("/admin/selftest", prometheus.InstrumentHandler("selftest", util.MakeJSONAPI(&handlers.SelfTest{db, matrixClients, e.BaseURL})))
+	mux.Handle("/admin/userPreferences", prometheus.InstrumentHandler("userPreferences", util.MakeJSONAPI(&handlers.UserPreferences{db})))
+	mux.Handle("/admin/auditLog", prometheus.InstrumentHandler("auditLog", util.MakeJSONAPI(&handlers.AuditLog{db})))
 
 	// Read exclusively from the config file if one was supplied.
 	// Otherwise, add HTTP listeners for new Services/Sessions/Clients/etc.
+	var reloader *configReloader
 	if e.ConfigFile != "" {
 		if err := insertServicesFromConfig(matrixClients, cfg.Services); err != nil {
 			log.WithError(err).Panic("Failed to insert services")
 		}
 
 		log.Info("Inserted ", len(cfg.Services), " services")
+		reloader = &configReloader{path: e.ConfigFile, db: db, clients: matrixClients, current: cfg}
+		mux.Handle("/admin/reload", prometheus.InstrumentHandler("reload", util.MakeJSONAPI(&handlers.ReloadConfig{reloader.Reload})))
 	} else {
 		mux.Handle("/admin/getService", prometheus.InstrumentHandler("getService", util.MakeJSONAPI(&handlers.GetService{db})))
 		mux.Handle("/admin/getSession", prometheus.InstrumentHandler("getSession", util.MakeJSONAPI(&handlers.GetSession{db})))
 		mux.Handle("/admin/configureClient", prometheus.InstrumentHandler("configureClient", util.MakeJSONAPI(&handlers.ConfigureClient{matrixClients})))
-		mux.Handle("/admin/configureService", prometheus.InstrumentHandler("configureService", util.MakeJSONAPI(handlers.NewConfigureService(db, matrixClients))))
+		mux.Handle("/admin/configureService", prometheus.InstrumentHandler("configureService", util.MakeJSONAPI(&handlers.ConfigureService{})))
+		mux.Handle("/admin/cloneService", prometheus.InstrumentHandler("cloneService", util.MakeJSONAPI(&handlers.CloneService{db})))
 		mux.Handle("/admin/configureAuthRealm", prometheus.InstrumentHandler("configureAuthRealm", util.MakeJSONAPI(&handlers.ConfigureAuthRealm{db})))
 		mux.Handle("/admin/requestAuthSession", prometheus.InstrumentHandler("requestAuthSession", util.MakeJSONAPI(&handlers.RequestAuthSession{db})))
+		mux.Handle("/admin/services", prometheus.InstrumentHandler("services", util.MakeJSONAPI(&handlers.Services{db})))
+		mux.Handle("/admin/serviceRooms", prometheus.InstrumentHandler("serviceRooms", util.MakeJSONAPI(&handlers.ServiceRooms{})))
 		mux.Handle("/admin/removeAuthSession", prometheus.InstrumentHandler("removeAuthSession", util.MakeJSONAPI(&handlers.RemoveAuthSession{db})))
+		mux.Handle("/admin/readOnly", prometheus.InstrumentHandler("readOnly", util.MakeJSONAPI(&handlers.ReadOnly{matrixClients})))
+		mux.Handle("/admin/replayFixture/", prometheus.InstrumentHandler("replayFixture", util.MakeJSONAPI(&handlers.ReplayFixture{db, matrixClients})))
 	}
 	polling.SetClients(matrixClients)
+	provision.SetClients(matrixClients)
+	if e.PollMaxBackoff != "" {
+		maxBackoff, err := time.ParseDuration(e.PollMaxBackoff)
+		if err != nil || maxBackoff <= 0 {
+			log.WithField("poll_max_backoff", e.PollMaxBackoff).Panic("Bad POLL_MAX_BACKOFF")
+		}
+		polling.SetMaxBackoff(maxBackoff)
+	}
+	if e.AuditRetention != "" {
+		retention, err := time.ParseDuration(e.AuditRetention)
+		if err != nil || retention < 0 {
+			log.WithField("audit_retention", e.AuditRetention).Panic("Bad AUDIT_RETENTION")
+		}
+		clients.SetAuditRetention(retention)
+	}
 	if err := polling.Start(); err != nil {
 		log.WithError(err).Panic("Failed to start polling")
 	}
+	go matrixClients.PublishAllCapabilities()
+
+	gcInterval := clients.DefaultGCInterval
+	if e.GCInterval != "" {
+		if gcInterval, err = time.ParseDuration(e.GCInterval); err != nil {
+			log.WithError(err).Panic("Bad GC_INTERVAL")
+		}
+	}
+	if gcInterval > 0 {
+		go matrixClients.CollectGarbagePeriodically(gcInterval)
+	}
+	if e.CleanupInterval != "" {
+		cleanupInterval, err := time.ParseDuration(e.CleanupInterval)
+		if err != nil || cleanupInterval < 0 {
+			log.WithField("cleanup_interval", e.CleanupInterval).Panic("Bad CLEANUP_INTERVAL")
+		}
+		if cleanupInterval > 0 {
+			go matrixClients.LeaveUnusedRoomsPeriodically(cleanupInterval)
+		}
+	}
+	return matrixClients, reloader
 }
 
 type envVars struct {
-	BindAddress  string
-	DatabaseType string
-	DatabaseURL  string
-	BaseURL      string
-	LogDir       string
-	ConfigFile   string
+	BindAddress      string
+	DatabaseType     string
+	DatabaseURL      string
+	BaseURL          string
+	LogDir           string
+	ConfigFile       string
+	ReadOnly         bool
+	GCInterval       string
+	CleanupInterval  string
+	PollMaxBackoff   string
+	LogLevel         string
+	ServiceLogLevels string
+	ShutdownTimeout  string
+	AuditRetention   string
+	// Not logged, see String.
+	DatabaseEncryptionKey string
+}
+
+// String formats the variables for logging, without the database encryption key.
+func (e envVars) String() string {
+	if e.DatabaseEncryptionKey != "" {
+		e.DatabaseEncryptionKey = "<redacted>"
+	}
+	type vars envVars // without the String method
+	return fmt.Sprintf("%+v", vars(e))
 }
 
 func main() {
-	e := envVars{
-		BindAddress:  os.Getenv("BIND_ADDRESS"),
-		DatabaseType: os.Getenv("DATABASE_TYPE"),
-		DatabaseURL:  os.Getenv("DATABASE_URL"),
-		BaseURL:      os.Getenv("BASE_URL"),
-		LogDir:       os.Getenv("LOG_DIR"),
-		ConfigFile:   os.Getenv("CONFIG_FILE"),
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		os.Exit(runSelfTest(os.Args[2:]))
 	}
 
+	// Every option can be set by environment variable or overridden on the command line.
+	var e envVars
+	flag.StringVar(&e.BindAddress, "bind-address", os.Getenv("BIND_ADDRESS"), "The address to listen on, e.g. ':4050'")
+	flag.StringVar(&e.DatabaseType, "database-type", os.Getenv("DATABASE_TYPE"), "The database type: 'sqlite3' or 'postgres'")
+	flag.StringVar(&e.DatabaseURL, "database-url", os.Getenv("DATABASE_URL"), "The database URL or connection string")
+	flag.StringVar(&e.BaseURL, "base-url", os.Getenv("BASE_URL"), "The public-facing base URL of Go-NEB")
+	flag.StringVar(&e.LogDir, "log-dir", os.Getenv("LOG_DIR"), "The directory to write rotated log files to")
+	flag.StringVar(&e.ConfigFile, "config-file", os.Getenv("CONFIG_FILE"), "The path to a YAML configuration file")
+	flag.BoolVar(&e.ReadOnly, "read-only", os.Getenv("READ_ONLY") == "true", "Start with every client in read-only mode")
+	flag.StringVar(&e.GCInterval, "gc-interval", os.Getenv("GC_INTERVAL"), "How often to remove orphaned auth sessions and bot options, e.g. '24h'. '0' disables this")
+	flag.StringVar(&e.CleanupInterval, "cleanup-interval", os.Getenv("CLEANUP_INTERVAL"), "How often clients leave rooms which no service sends into, e.g. '24h'. Disabled by default")
+	flag.StringVar(&e.PollMaxBackoff, "poll-max-backoff", os.Getenv("POLL_MAX_BACKOFF"), "The longest a failing polled service is left between polls, e.g. '30m'")
+	flag.StringVar(&e.LogLevel, "log-level", os.Getenv("LOG_LEVEL"), "The level to log at: 'debug', 'info', 'warn' or 'error'. Defaults to 'info'")
+	flag.StringVar(&e.ServiceLogLevels, "service-log-levels", os.Getenv("SERVICE_LOG_LEVELS"), "Log levels for services, by service ID or type, e.g. 'my_github=debug,rssbot=warn'")
+	flag.StringVar(&e.ShutdownTimeout, "shutdown-timeout", os.Getenv("SHUTDOWN_TIMEOUT"), "How long to wait for work under way to finish on SIGTERM, e.g. '1m'. Defaults to '30s'")
+	flag.StringVar(&e.AuditRetention, "audit-retention", os.Getenv("AUDIT_RETENTION"), "How long to keep the audit log of commands and webhook sends, e.g. '2160h'. '0' keeps it forever. Defaults to a year")
+	flag.StringVar(&e.DatabaseEncryptionKey, "database-encryption-key", os.Getenv("DATABASE_ENCRYPTION_KEY"), "A base64 encoded 32 byte key to encrypt auth sessions and client access tokens in the database with, or a reference to one, e.g. 'vault:secret/data/go-neb#db_key'")
+	flag.Parse()
+
+	shutdownTimeout := defaultShutdownTimeout
+	if e.ShutdownTimeout != "" {
+		var err error
+		if shutdownTimeout, err = time.ParseDuration(e.ShutdownTimeout); err != nil || shutdownTimeout <= 0 {
+			log.WithField("shutdown_timeout", e.ShutdownTimeout).Fatal("Bad SHUTDOWN_TIMEOUT")
+		}
+	}
+
+	level := log.InfoLevel
+	if e.LogLevel != "" {
+		var err error
+		if level, err = log.ParseLevel(e.LogLevel); err != nil {
+			log.WithError(err).Fatal("Bad LOG_LEVEL")
+		}
+	}
+	serviceLevels, err := logging.ParseLevels(e.ServiceLogLevels)
+	if err != nil {
+		log.WithError(err).Fatal("Bad SERVICE_LOG_LEVELS")
+	}
+	logging.SetLevels(level, serviceLevels)
+	log.SetFormatter(logging.Filter(&log.TextFormatter{}))
+
 	if e.LogDir != "" {
 		log.AddHook(dugong.NewFSHook(
 			filepath.Join(e.LogDir, "go-neb.log"),
-			&log.TextFormatter{
+			logging.Filter(&log.TextFormatter{
 				TimestampFormat:  "2006-01-02 15:04:05.000000",
 				DisableColors:    true,
 				DisableTimestamp: false,
 				DisableSorting:   false,
-			}, &dugong.DailyRotationSchedule{GZip: false},
+			}), &dugong.DailyRotationSchedule{GZip: false},
 		))
 		log.SetOutput(ioutil.Discard)
 	}
 
-	log.Infof("Go-NEB (%+v)", e)
+	log.Infof("Go-NEB (%s)", e)
 
-	setup(e, http.DefaultServeMux, http.DefaultClient)
-	log.Fatal(http.ListenAndServe(e.BindAddress, nil))
+	matrixClients, reloader := setup(e, http.DefaultServeMux, http.DefaultClient)
+	srv := &http.Server{Addr: e.BindAddress}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+	sig := <-signals
+	for ; sig == syscall.SIGHUP; sig = <-signals {
+		if reloader == nil {
+			log.Warn("Ignoring SIGHUP as there is no config file to reload")
+		} else if _, err := reloader.Reload(); err != nil {
+			log.WithError(err).Error("Failed to reload config file")
+		}
+	}
+	log.WithField("signal", sig).Info("Shutting down")
+	if !shutdown(srv, matrixClients, shutdownTimeout) {
+		os.Exit(1)
+	}
+	log.Info("Shut down cleanly")
 }
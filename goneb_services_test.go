@@ -32,6 +32,10 @@ func setupMockServer() (*http.ServeMux, *matrixTripper, *httptest.ResponseRecord
 	mockWriter := httptest.NewRecorder()
 	reqChan := make(chan string)
 	mxTripper.HandlePOSTFilter("@link:hyrule")
+	// Capabilities are published after services are configured and rooms are joined.
+	mxTripper.Handle("GET", "/_matrix/client/r0/joined_rooms", func(req *http.Request) (*http.Response, error) {
+		return newResponse(200, `{"joined_rooms": []}`), nil
+	})
 	mxTripper.Handle("GET", "/_matrix/client/r0/sync",
 		func(req *http.Request) (*http.Response, error) {
 			if _, ok := req.URL.Query()["since"]; !ok {
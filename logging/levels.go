@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	levelsMutex sync.RWMutex
+	level       = log.InfoLevel
+	// service ID or type => level
+	serviceLevels map[string]log.Level
+)
+
+// ParseLevels parses per-service log levels such as "my_github=debug,rssbot=warn", where each
+// service is given by its ID or type.
+func ParseLevels(s string) (map[string]log.Level, error) {
+	levels := make(map[string]log.Level)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q isn't of the form service=level", pair)
+		}
+		lvl, err := log.ParseLevel(pair[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		levels[strings.TrimSpace(pair[:i])] = lvl
+	}
+	return levels, nil
+}
+
+// SetLevels sets the level entries are logged at, and the levels of services which log at their
+// own levels, keyed by service ID or type. Entries are about a service if they have a service_id
+// or service_type field, and a service's ID takes precedence over its type.
+//
+// The standard logger is set to the most verbose of the levels, so formatters must be wrapped by
+// Filter to drop the entries which are too verbose for the service they are about.
+func SetLevels(lvl log.Level, services map[string]log.Level) {
+	levelsMutex.Lock()
+	defer levelsMutex.Unlock()
+	level = lvl
+	serviceLevels = services
+	for _, l := range services {
+		if l > lvl {
+			lvl = l
+		}
+	}
+	log.SetLevel(lvl)
+}
+
+// Enabled returns true if the entry is at or above the level of the service it is about, or of
+// everything else if it isn't about a service.
+func Enabled(entry *log.Entry) bool {
+	levelsMutex.RLock()
+	defer levelsMutex.RUnlock()
+	for _, key := range []string{"service_id", "service_type"} {
+		if s, ok := entry.Data[key].(string); ok {
+			if l, ok := serviceLevels[s]; ok {
+				return entry.Level <= l
+			}
+		}
+	}
+	return entry.Level <= level
+}
+
+// Filter returns a formatter which formats the entries which are Enabled with the given formatter,
+// and drops the rest.
+func Filter(formatter log.Formatter) log.Formatter {
+	return filter{formatter}
+}
+
+type filter struct {
+	log.Formatter
+}
+
+func (f filter) Format(entry *log.Entry) ([]byte, error) {
+	if !Enabled(entry) {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
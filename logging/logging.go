@@ -0,0 +1,62 @@
+// Package logging ties log entries to the webhook request or command they are about, and lets
+// services log at their own levels.
+//
+// Webhook requests and commands are given a correlation ID when they are received, which is
+// logged with every entry about them, up to and including the messages sent because of them.
+// A webhook's correlation ID is also returned in its response's X-Request-ID header.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CorrelationIDKey is the field of log entries which holds the correlation ID.
+const CorrelationIDKey = "correlation_id"
+
+// RequestIDHeader is the HTTP header which a webhook request's correlation ID is read from, if a
+// proxy has set it, and returned in.
+const RequestIDHeader = "X-Request-ID"
+
+// Correlation IDs from request headers are only used if they can't mess up log lines.
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// NewCorrelationID returns a new random correlation ID.
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.WithError(err).Error("Failed to generate a correlation ID")
+	}
+	return hex.EncodeToString(b)
+}
+
+// RequestCorrelationID returns the correlation ID in the request's X-Request-ID header, or a new
+// one if it doesn't have a usable one.
+func RequestCorrelationID(req *http.Request) string {
+	if id := req.Header.Get(RequestIDHeader); requestIDRegex.MatchString(id) {
+		return id
+	}
+	return NewCorrelationID()
+}
+
+type contextKey struct{}
+
+// WithLogger returns a copy of the context which carries the logger, e.g. to give services a
+// logger for a webhook request with its service and correlation ID fields.
+func WithLogger(ctx context.Context, logger *log.Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by the context, or the standard logger if there isn't
+// one.
+func FromContext(ctx context.Context) *log.Entry {
+	if logger, ok := ctx.Value(contextKey{}).(*log.Entry); ok {
+		return logger
+	}
+	return log.NewEntry(log.StandardLogger())
+}
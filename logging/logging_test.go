@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestParseLevels(t *testing.T) {
+	levels, err := ParseLevels(" my_github=debug, rssbot=WARN ,")
+	if err != nil {
+		t.Fatal("Failed to parse levels: ", err)
+	}
+	if len(levels) != 2 || levels["my_github"] != log.DebugLevel || levels["rssbot"] != log.WarnLevel {
+		t.Errorf("Bad levels: %v", levels)
+	}
+	for _, bad := range []string{"rssbot", "=debug", "rssbot=loud"} {
+		if _, err := ParseLevels(bad); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.Out = &buf
+	logger.Formatter = Filter(&log.TextFormatter{DisableTimestamp: true})
+	defer SetLevels(log.InfoLevel, nil)
+	SetLevels(log.InfoLevel, map[string]log.Level{"noisy": log.DebugLevel, "rssbot": log.ErrorLevel})
+	// SetLevels sets the standard logger's level
+	logger.Level = log.GetLevel()
+	if logger.Level != log.DebugLevel {
+		t.Errorf("Expected the standard logger to log at the most verbose level, got %s", logger.Level)
+	}
+
+	logger.Debug("global debug")
+	logger.Info("global info")
+	logger.WithField("service_id", "noisy").Debug("noisy debug")
+	logger.WithField("service_id", "quiet").Debug("quiet debug")
+	logger.WithFields(log.Fields{"service_id": "feeds", "service_type": "rssbot"}).Warn("rssbot warn")
+	logger.WithFields(log.Fields{"service_id": "feeds", "service_type": "rssbot"}).Error("rssbot error")
+	logger.WithFields(log.Fields{"service_id": "noisy", "service_type": "rssbot"}).Debug("noisy rssbot debug")
+
+	got := buf.String()
+	for _, want := range []string{"global info", "noisy debug", "rssbot error", "noisy rssbot debug"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %q to be logged, got:\n%s", want, got)
+		}
+	}
+	for _, dropped := range []string{"global debug", "quiet debug", "rssbot warn"} {
+		if strings.Contains(got, dropped) {
+			t.Errorf("Expected %q to be dropped, got:\n%s", dropped, got)
+		}
+	}
+}
+
+func TestRequestCorrelationID(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://neb/services/hooks/abc", nil)
+	generated := RequestCorrelationID(req)
+	if len(generated) != 16 || generated == RequestCorrelationID(req) {
+		t.Errorf("Expected new random correlation IDs, got %q", generated)
+	}
+	req.Header.Set(RequestIDHeader, "proxy-1234")
+	if got := RequestCorrelationID(req); got != "proxy-1234" {
+		t.Errorf("Expected the X-Request-ID header to be used, got %q", got)
+	}
+	req.Header.Set(RequestIDHeader, "bad\nid")
+	if got := RequestCorrelationID(req); got == "bad\nid" {
+		t.Error("Expected a bad X-Request-ID header to be ignored")
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if logger := FromContext(context.Background()); logger == nil || len(logger.Data) != 0 {
+		t.Errorf("Expected the standard logger without fields, got %v", logger)
+	}
+	ctx := WithLogger(context.Background(), log.WithField(CorrelationIDKey, "abc"))
+	if got := FromContext(ctx).Data[CorrelationIDKey]; got != "abc" {
+		t.Errorf("Expected the context's logger, got correlation ID %v", got)
+	}
+}
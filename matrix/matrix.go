@@ -2,29 +2,36 @@ package matrix
 
 import (
 	"encoding/json"
+	"strconv"
 
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/database"
 	log "github.com/sirupsen/logrus"
 	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
 // NEBStore implements the mautrix.Storer interface.
 //
-// It persists the next batch token in the database, and includes a ClientConfig for the client.
+// It persists the next batch token and filter ID of the client's device in the database, and
+// includes a ClientConfig for the client.
 type NEBStore struct {
 	mautrix.InMemoryStore
 	Database     database.Storer
 	ClientConfig api.ClientConfig
+	// The JSON of the filter the client syncs with. A stored filter ID is only used if it was
+	// created for the same JSON.
+	FilterJSON string
 }
 
 // SaveNextBatch saves to the database.
 func (s *NEBStore) SaveNextBatch(userID id.UserID, nextBatch string) {
-	if err := s.Database.UpdateNextBatch(userID, nextBatch); err != nil {
+	if err := s.Database.UpdateNextBatch(userID, s.ClientConfig.DeviceID, nextBatch); err != nil {
 		log.WithFields(log.Fields{
 			log.ErrorKey: err,
 			"user_id":    userID,
+			"device_id":  s.ClientConfig.DeviceID,
 			"next_batch": nextBatch,
 		}).Error("Failed to persist next_batch token")
 	}
@@ -32,17 +39,48 @@ func (s *NEBStore) SaveNextBatch(userID id.UserID, nextBatch string) {
 
 // LoadNextBatch loads from the database.
 func (s *NEBStore) LoadNextBatch(userID id.UserID) string {
-	token, err := s.Database.LoadNextBatch(userID)
+	token, err := s.Database.LoadNextBatch(userID, s.ClientConfig.DeviceID)
 	if err != nil {
 		log.WithFields(log.Fields{
 			log.ErrorKey: err,
 			"user_id":    userID,
+			"device_id":  s.ClientConfig.DeviceID,
 		}).Error("Failed to load next_batch token")
 		return ""
 	}
 	return token
 }
 
+// SaveFilterID saves to the database.
+func (s *NEBStore) SaveFilterID(userID id.UserID, filterID string) {
+	if err := s.Database.UpdateFilterID(userID, s.ClientConfig.DeviceID, filterID, s.FilterJSON); err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"user_id":    userID,
+			"device_id":  s.ClientConfig.DeviceID,
+			"filter_id":  filterID,
+		}).Error("Failed to persist filter ID")
+	}
+}
+
+// LoadFilterID loads from the database. Returns "" if the stored filter was created for
+// different JSON, so that a new one is created.
+func (s *NEBStore) LoadFilterID(userID id.UserID) string {
+	filterID, filterJSON, err := s.Database.LoadFilterID(userID, s.ClientConfig.DeviceID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"user_id":    userID,
+			"device_id":  s.ClientConfig.DeviceID,
+		}).Error("Failed to load filter ID")
+		return ""
+	}
+	if filterJSON != s.FilterJSON {
+		return ""
+	}
+	return filterID
+}
+
 // StarterLinkMessage represents a message with a starter_link custom data.
 type StarterLinkMessage struct {
 	Body string
@@ -68,3 +106,136 @@ func (m StarterLinkMessage) MarshalJSON() ([]byte, error) {
 	}
 	return json.Marshal(msg)
 }
+
+// MentionRoomMessage represents a message which asks to notify everyone in the room by starting
+// with "@room", e.g. for a critical alert. Clients only add the mention if they are allowed to
+// notify the room and haven't mentioned it recently, otherwise the message is sent without it.
+type MentionRoomMessage struct {
+	mevt.MessageEventContent
+	// True to mention the room.
+	MentionRoom bool `json:"mention_room"`
+}
+
+// MarshalJSON converts this message into actual event content JSON, without a mention.
+func (m MentionRoomMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.MessageEventContent)
+}
+
+// CorrelatedMessage represents a notification about something which other services may also
+// notify about, e.g. a commit which both the Github webhook and a CI service report. Clients with
+// a NotificationDedupeWindow combine messages with the same CorrelationID which are sent into the
+// same room within the window into one message, by editing the first, rather than sending each.
+type CorrelatedMessage struct {
+	mevt.MessageEventContent
+	// Identifies what the notification is about, e.g. "matrix-org/go-neb@4a1c0e2". Services which
+	// notify about the same things must use the same IDs for them.
+	CorrelationID string `json:"correlation_id"`
+}
+
+// MarshalJSON converts this message into actual event content JSON, without the correlation ID.
+func (m CorrelatedMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.MessageEventContent)
+}
+
+// relThread is the rel_type of a message in a thread.
+const relThread = mevt.RelationType("m.thread")
+
+// ReplyMessage represents a message sent in reply to another event, e.g. a command's response, as
+// a rich reply or in a thread, so that it stays attached to the event in busy rooms.
+type ReplyMessage struct {
+	// The JSON encodable content of the message.
+	Content interface{}
+	// The event being replied to.
+	InReplyTo id.EventID
+	// The root event of the thread to send the message in, or "" to send it as a rich reply.
+	ThreadRoot id.EventID
+}
+
+// NewReply returns a reply to the event with the content. If thread is true, the reply is sent in
+// the event's thread, or starts a thread from the event if it isn't in one.
+func NewReply(content interface{}, to *mevt.Event, thread bool) ReplyMessage {
+	reply := ReplyMessage{Content: content, InReplyTo: to.ID}
+	if thread {
+		reply.ThreadRoot = to.ID
+		if rel := to.Content.AsMessage().RelatesTo; rel != nil && rel.Type == relThread {
+			reply.ThreadRoot = rel.EventID
+		}
+	}
+	return reply
+}
+
+// MarshalJSON converts this message into actual event content JSON, which is the content with an
+// "m.relates_to" field.
+func (m ReplyMessage) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(m.Content)
+	if err != nil {
+		return nil, err
+	}
+	var content map[string]interface{}
+	if err = json.Unmarshal(b, &content); err != nil {
+		return nil, err
+	}
+	relatesTo := map[string]interface{}{
+		"m.in_reply_to": map[string]id.EventID{"event_id": m.InReplyTo},
+	}
+	if m.ThreadRoot != "" {
+		relatesTo["rel_type"] = relThread
+		relatesTo["event_id"] = m.ThreadRoot
+		// Clients which don't show threads show the message as a reply instead.
+		relatesTo["is_falling_back"] = true
+	}
+	content["m.relates_to"] = relatesTo
+	return json.Marshal(content)
+}
+
+// LocationMessage represents an m.location message, which clients show as a pin on a map.
+type LocationMessage struct {
+	// A description of the location, shown by clients which can't show maps.
+	Body string
+	// The location as a geo URI, e.g. "geo:51.5008,0.1247". See GeoURI.
+	GeoURI string
+	// Optional. Extra fields to add to the content.
+	Extra map[string]interface{}
+}
+
+// GeoURI formats a latitude and longitude as a geo URI for a LocationMessage.
+func GeoURI(latitude, longitude float64) string {
+	return "geo:" + strconv.FormatFloat(latitude, 'f', -1, 64) + "," + strconv.FormatFloat(longitude, 'f', -1, 64)
+}
+
+// MarshalJSON converts this message into actual event content JSON.
+func (m LocationMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(withFields(m.Extra, map[string]interface{}{
+		"msgtype": "m.location",
+		"body":    m.Body,
+		"geo_uri": m.GeoURI,
+	}))
+}
+
+// CustomMessage represents a message with any msgtype and extra content fields, e.g.
+// machine-readable data for other bots. Clients which don't understand the msgtype show the body.
+type CustomMessage struct {
+	MsgType string
+	Body    string
+	// Optional. Fields to add to the content alongside "msgtype" and "body", which they can't
+	// replace.
+	Fields map[string]interface{}
+}
+
+// MarshalJSON converts this message into actual event content JSON.
+func (m CustomMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(withFields(m.Fields, map[string]interface{}{
+		"msgtype": m.MsgType,
+		"body":    m.Body,
+	}))
+}
+
+// withFields returns the content with the extra fields added, without replacing any of its own.
+func withFields(extra, content map[string]interface{}) map[string]interface{} {
+	for k, v := range extra {
+		if _, ok := content[k]; !ok {
+			content[k] = v
+		}
+	}
+	return content
+}
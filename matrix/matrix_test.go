@@ -0,0 +1,137 @@
+package matrix
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestMessageJSON(t *testing.T) {
+	for _, tc := range []struct {
+		msg  interface{}
+		want string
+	}{
+		{
+			StarterLinkMessage{Body: "Log in first", Link: "https://example.org/login"},
+			`{"msgtype":"m.notice","body":"Log in first","data":{"org.matrix.neb.starter_link":"https://example.org/login"}}`,
+		},
+		{
+			LocationMessage{Body: "London", GeoURI: GeoURI(51.5008, -0.1247)},
+			`{"body":"London","geo_uri":"geo:51.5008,-0.1247","msgtype":"m.location"}`,
+		},
+		{
+			CustomMessage{
+				MsgType: "org.example.uptime",
+				Body:    "example.org is down",
+				Fields:  map[string]interface{}{"org.example.status": "down", "body": "ignored"},
+			},
+			`{"body":"example.org is down","msgtype":"org.example.uptime","org.example.status":"down"}`,
+		},
+		{
+			ReplyMessage{Content: mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "Done"}, InReplyTo: "$cmd"},
+			`{"body":"Done","m.relates_to":{"m.in_reply_to":{"event_id":"$cmd"}},"msgtype":"m.notice"}`,
+		},
+		{
+			ReplyMessage{Content: mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "Done"}, InReplyTo: "$cmd", ThreadRoot: "$root"},
+			`{"body":"Done","m.relates_to":{"event_id":"$root","is_falling_back":true,"m.in_reply_to":{"event_id":"$cmd"},"rel_type":"m.thread"},"msgtype":"m.notice"}`,
+		},
+	} {
+		got, err := json.Marshal(tc.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("got %s, want %s", got, tc.want)
+		}
+	}
+}
+
+func TestNewReply(t *testing.T) {
+	command := &mevt.Event{ID: "$cmd", Content: mevt.Content{Parsed: &mevt.MessageEventContent{Body: "!echo hi"}}}
+	inThread := &mevt.Event{ID: "$cmd2", Content: mevt.Content{Parsed: &mevt.MessageEventContent{
+		Body:      "!echo hi",
+		RelatesTo: &mevt.RelatesTo{Type: relThread, EventID: "$root"},
+	}}}
+
+	for _, tc := range []struct {
+		to         *mevt.Event
+		thread     bool
+		threadRoot id.EventID
+	}{
+		{command, false, ""},
+		{command, true, "$cmd"},
+		{inThread, true, "$root"},
+	} {
+		reply := NewReply("content", tc.to, tc.thread)
+		if reply.InReplyTo != tc.to.ID || reply.ThreadRoot != tc.threadRoot {
+			t.Errorf("NewReply(%s, %v): want reply to %s in thread %q, got %+v", tc.to.ID, tc.thread, tc.to.ID, tc.threadRoot, reply)
+		}
+	}
+}
+
+type syncStateStore struct {
+	database.NopStorage
+	nextBatches map[id.DeviceID]string
+	filters     map[id.DeviceID][2]string
+}
+
+func (s *syncStateStore) UpdateNextBatch(userID id.UserID, deviceID id.DeviceID, nextBatch string) error {
+	s.nextBatches[deviceID] = nextBatch
+	return nil
+}
+
+func (s *syncStateStore) LoadNextBatch(userID id.UserID, deviceID id.DeviceID) (string, error) {
+	return s.nextBatches[deviceID], nil
+}
+
+func (s *syncStateStore) UpdateFilterID(userID id.UserID, deviceID id.DeviceID, filterID, filterJSON string) error {
+	s.filters[deviceID] = [2]string{filterID, filterJSON}
+	return nil
+}
+
+func (s *syncStateStore) LoadFilterID(userID id.UserID, deviceID id.DeviceID) (string, string, error) {
+	f := s.filters[deviceID]
+	return f[0], f[1], nil
+}
+
+func TestNEBStore(t *testing.T) {
+	db := &syncStateStore{nextBatches: make(map[id.DeviceID]string), filters: make(map[id.DeviceID][2]string)}
+	newStore := func(deviceID id.DeviceID, filterJSON string) *NEBStore {
+		return &NEBStore{
+			InMemoryStore: *mautrix.NewInMemoryStore(),
+			Database:      db,
+			ClientConfig:  api.ClientConfig{UserID: "@neb:hs", DeviceID: deviceID},
+			FilterJSON:    filterJSON,
+		}
+	}
+
+	store := newStore("A", `{"room":{}}`)
+	store.SaveNextBatch("@neb:hs", "s1")
+	store.SaveFilterID("@neb:hs", "f1")
+
+	// A restarted client resumes from its device's token and reuses its filter.
+	restarted := newStore("A", `{"room":{}}`)
+	if got := restarted.LoadNextBatch("@neb:hs"); got != "s1" {
+		t.Errorf("LoadNextBatch => %q, want s1", got)
+	}
+	if got := restarted.LoadFilterID("@neb:hs"); got != "f1" {
+		t.Errorf("LoadFilterID => %q, want f1", got)
+	}
+	// A filter created for different JSON isn't reused, so the new filter is created.
+	if got := newStore("A", `{"room":{"timeline":{"limit":50}}}`).LoadFilterID("@neb:hs"); got != "" {
+		t.Errorf("LoadFilterID with changed filter JSON => %q, want nothing", got)
+	}
+	// Another device of the same user starts afresh.
+	other := newStore("B", `{"room":{}}`)
+	if got := other.LoadNextBatch("@neb:hs"); got != "" {
+		t.Errorf("LoadNextBatch for another device => %q, want nothing", got)
+	}
+	if got := other.LoadFilterID("@neb:hs"); got != "" {
+		t.Errorf("LoadFilterID for another device => %q, want nothing", got)
+	}
+}
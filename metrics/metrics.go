@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -13,6 +15,36 @@ const (
 	StatusFailure = "failure"
 )
 
+// WebhookOutcome is what happened to an incoming webhook request, going by the HTTP status the
+// service responded with.
+type WebhookOutcome string
+
+// Webhook outcomes
+const (
+	// The service handled the request (2xx or 3xx).
+	WebhookProcessed = "processed"
+	// The request's signature or token was wrong (401 or 403).
+	WebhookRejectedSignature = "rejected_signature"
+	// The request was malformed or not for this service (other 4xx).
+	WebhookRejected = "rejected"
+	// The service failed to handle the request (5xx).
+	WebhookFailed = "failed"
+)
+
+// WebhookOutcomeForStatus returns the outcome of a webhook request which was responded to with
+// the given HTTP status code.
+func WebhookOutcomeForStatus(code int) WebhookOutcome {
+	switch {
+	case code == 401 || code == 403:
+		return WebhookRejectedSignature
+	case code >= 500:
+		return WebhookFailed
+	case code >= 400:
+		return WebhookRejected
+	}
+	return WebhookProcessed
+}
+
 var (
 	cmdCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "goneb_pling_cmd_total",
@@ -30,6 +62,19 @@ var (
 		Name: "goneb_auth_session_total",
 		Help: "The total number of successful /requestAuthSession requests",
 	}, []string{"realm_type"})
+	webhookOutcomeCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goneb_webhook_outcomes_total",
+		Help: "The total number of handled webhook requests, by what happened to them",
+	}, []string{"service_type", "outcome"})
+	webhookDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "goneb_webhook_duration_seconds",
+		Help:    "How long services took to handle webhook requests",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"service_type"})
+	sendFailureCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goneb_notification_send_failures_total",
+		Help: "The total number of notifications which services couldn't send into Matrix rooms",
+	}, []string{"service_type"})
 )
 
 // IncrementCommand increments the pling command counter
@@ -47,6 +92,18 @@ func IncrementWebhook(serviceType string) {
 	webhookCounter.With(prometheus.Labels{"service_type": serviceType}).Inc()
 }
 
+// ObserveWebhook records the outcome of a webhook request and how long the service took to
+// handle it.
+func ObserveWebhook(serviceType string, outcome WebhookOutcome, duration time.Duration) {
+	webhookOutcomeCounter.With(prometheus.Labels{"service_type": serviceType, "outcome": string(outcome)}).Inc()
+	webhookDuration.With(prometheus.Labels{"service_type": serviceType}).Observe(duration.Seconds())
+}
+
+// IncrementSendFailure increments the counter of notifications which couldn't be sent
+func IncrementSendFailure(serviceType string) {
+	sendFailureCounter.With(prometheus.Labels{"service_type": serviceType}).Inc()
+}
+
 // IncrementAuthSession increments the /requestAuthSession request counter
 func IncrementAuthSession(realmType string) {
 	authSessionCounter.With(prometheus.Labels{"realm_type": realmType}).Inc()
@@ -57,4 +114,7 @@ func init() {
 	prometheus.MustRegister(configureServicesCounter)
 	prometheus.MustRegister(webhookCounter)
 	prometheus.MustRegister(authSessionCounter)
+	prometheus.MustRegister(webhookOutcomeCounter)
+	prometheus.MustRegister(webhookDuration)
+	prometheus.MustRegister(sendFailureCounter)
 }
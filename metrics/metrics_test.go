@@ -0,0 +1,21 @@
+package metrics
+
+import "testing"
+
+func TestWebhookOutcomeForStatus(t *testing.T) {
+	for code, want := range map[int]WebhookOutcome{
+		200: WebhookProcessed,
+		204: WebhookProcessed,
+		302: WebhookProcessed,
+		400: WebhookRejected,
+		401: WebhookRejectedSignature,
+		403: WebhookRejectedSignature,
+		404: WebhookRejected,
+		500: WebhookFailed,
+		503: WebhookFailed,
+	} {
+		if got := WebhookOutcomeForStatus(code); got != want {
+			t.Errorf("WebhookOutcomeForStatus(%d) => %s, want %s", code, got, want)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package polling
 
 import (
+	"context"
+	"fmt"
 	"runtime/debug"
 	"sync"
 	"time"
@@ -17,6 +19,12 @@ import (
 var (
 	pollMutex     sync.Mutex
 	startPollTime = make(map[string]int64) // ServiceID => unix timestamp
+	// Once stopped, no more polls are started. Guarded by pollMutex.
+	stopped bool
+	// Closed by Stop to wake up poll loops which are waiting for their next poll.
+	stopping = make(chan struct{})
+	// The running poll loops, which Stop waits for.
+	running sync.WaitGroup
 )
 var clientPool *clients.Clients
 
@@ -25,8 +33,15 @@ func SetClients(clis *clients.Clients) {
 	clientPool = clis
 }
 
-// Start polling already existing services
+// Start polling already existing services, and refreshing auth sessions before they expire
 func Start() error {
+	pollMutex.Lock()
+	if !stopped {
+		running.Add(1)
+		go refreshLoop()
+	}
+	pollMutex.Unlock()
+
 	// Work out which service types require polling
 	for _, serviceType := range types.PollingServiceTypes() {
 		// Query for all services with said service type
@@ -51,11 +66,40 @@ func StartPolling(service types.Service) error {
 	// Set the poll time BEFORE spinning off the goroutine in case the caller immediately stops us. If we don't do this here,
 	// we risk them setting the ts to 0 BEFORE we've set the start time, resulting in a poll when one was not intended.
 	ts := time.Now().UnixNano()
-	setPollStartTime(service, ts)
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+	if stopped {
+		return nil
+	}
+	startPollTime[service.ServiceID()] = ts
+	running.Add(1)
 	go pollLoop(service, ts)
 	return nil
 }
 
+// Stop stops every polling loop and waits until the polls which are running have finished, or
+// the context is done. No more polls are started afterwards.
+func Stop(ctx context.Context) error {
+	pollMutex.Lock()
+	if !stopped {
+		stopped = true
+		close(stopping)
+	}
+	pollMutex.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // StopPolling stops all pollers for this service.
 func StopPolling(service types.Service) {
 	log.WithFields(log.Fields{
@@ -63,11 +107,15 @@ func StopPolling(service types.Service) {
 		"service_type": service.ServiceType(),
 	}).Info("StopPolling")
 	setPollStartTime(service, 0)
+	pollMutex.Lock()
+	removeStatus(service.ServiceID())
+	pollMutex.Unlock()
 }
 
-// pollLoop begins the polling loop for this service. Does not return, so call this
-// as a goroutine!
+// pollLoop begins the polling loop for this service. Does not return until the poll is stopped,
+// so call this as a goroutine!
 func pollLoop(service types.Service, ts int64) {
+	defer running.Done()
 	logger := log.WithFields(log.Fields{
 		"timestamp":    ts,
 		"service_id":   service.ServiceID(),
@@ -81,6 +129,9 @@ func pollLoop(service types.Service, ts int64) {
 			logger.WithField("panic", r).Errorf(
 				"pollLoop panicked!\n%s", debug.Stack(),
 			)
+			if !pollTimeChanged(service, ts) {
+				recordPoll(service, time.Now(), time.Time{}, fmt.Errorf("poll loop panicked: %v", r))
+			}
 		}
 	}()
 
@@ -90,25 +141,33 @@ func pollLoop(service types.Service, ts int64) {
 		return
 	}
 	logger.Info("Starting polling loop")
-	cli, err := clientPool.Client(service.ServiceUserID())
+	cli, err := clientPool.Client(clients.NotificationSender(service))
 	if err != nil {
-		logger.WithError(err).WithField("user_id", service.ServiceUserID()).Error("Poll setup failed: failed to load client")
+		logger.WithError(err).WithField("user_id", clients.NotificationSender(service)).Error("Poll setup failed: failed to load client")
+		recordPoll(service, time.Now(), time.Time{}, fmt.Errorf("failed to load client: %s", err))
 		return
 	}
 	for {
 		logger.Info("OnPoll")
-		nextTime := poller.OnPoll(cli)
+		nextTime := poller.OnPoll(clients.NewDeliveryClient(cli, service))
 		if pollTimeChanged(service, ts) {
 			logger.Info("Terminating poll.")
 			break
 		}
 		// work out how long to sleep
 		if nextTime.Unix() == 0 {
+			recordPoll(service, time.Now(), time.Time{}, nil)
 			logger.Info("Terminating poll - OnPoll returned 0")
 			break
 		}
-		now := time.Now()
-		time.Sleep(nextTime.Sub(now))
+		// Failing services are polled less often, see recordPoll
+		nextTime = recordPoll(service, time.Now(), nextTime, nil)
+		select {
+		case <-time.After(time.Until(nextTime)):
+		case <-stopping:
+			logger.Info("Terminating poll - stopped")
+			return
+		}
 
 		if pollTimeChanged(service, ts) {
 			logger.Info("Terminating poll.")
@@ -0,0 +1,87 @@
+package polling
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+)
+
+type mockService struct {
+	types.DefaultService
+}
+
+func TestPollStatus(t *testing.T) {
+	srv := &mockService{types.NewDefaultService("poll_status_service", "@neb:hyrule", "mock")}
+	defer StopPolling(srv)
+	noJitter(t)
+
+	now := time.Now()
+	next := now.Add(time.Minute)
+
+	ReportError(srv, errors.New("first"))
+	ReportError(srv, errors.New("second"))
+	recordPoll(srv, now, next, nil)
+	ReportError(srv, errors.New("third"))
+	recordPoll(srv, now, next, nil)
+
+	st := Status()
+	if len(st) != 1 {
+		t.Fatalf("TestPollStatus: want 1 status, got %d", len(st))
+	}
+	if st[0].ConsecutiveFailures != 2 || st[0].LastError != "third" {
+		t.Errorf("TestPollStatus: want 2 failures with last error 'third', got %d with '%s'",
+			st[0].ConsecutiveFailures, st[0].LastError)
+	}
+	// the second failure in a row doubles the time until the next poll
+	if want := now.Add(2 * time.Minute); !st[0].NextPollTime.Equal(want) || !st[0].BackingOff {
+		t.Errorf("TestPollStatus: want to back off until %s, got %s (backing off: %v)", want, st[0].NextPollTime, st[0].BackingOff)
+	}
+
+	// a clean poll resets the failure count
+	recordPoll(srv, now, next, nil)
+	st = Status()
+	if st[0].ConsecutiveFailures != 0 || st[0].LastError != "" || st[0].BackingOff || !st[0].NextPollTime.Equal(next) {
+		t.Errorf("TestPollStatus: want no failures after clean poll, got %+v", st[0])
+	}
+
+	StopPolling(srv)
+	if len(Status()) != 0 {
+		t.Errorf("TestPollStatus: want status removed after StopPolling, got %+v", Status())
+	}
+}
+
+// noJitter makes backoff delays their maximum for the rest of the test.
+func noJitter(t *testing.T) {
+	randInt63n = func(n int64) int64 { return n - 1 }
+	t.Cleanup(func() { randInt63n = rand.Int63n })
+}
+
+func TestBackoff(t *testing.T) {
+	noJitter(t)
+	SetMaxBackoff(time.Hour)
+	defer SetMaxBackoff(DefaultMaxBackoff)
+	for _, test := range []struct {
+		interval time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{5 * time.Minute, 1, 5 * time.Minute},
+		{5 * time.Minute, 3, 20 * time.Minute},
+		{5 * time.Minute, 10, time.Hour},
+		{0, 1, minBackoff},
+		{0, 2, 2 * minBackoff},
+	} {
+		if got := backoff(test.interval, test.failures); got != test.want {
+			t.Errorf("backoff(%s, %d): want %s, got %s", test.interval, test.failures, test.want, got)
+		}
+	}
+
+	// Jitter keeps delays between half and all of the backoff
+	randInt63n = func(n int64) int64 { return 0 }
+	if got := backoff(5*time.Minute, 3); got != 10*time.Minute {
+		t.Errorf("backoff with jitter: want 10m, got %s", got)
+	}
+}
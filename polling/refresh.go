@@ -0,0 +1,120 @@
+package polling
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RefreshAhead is how long before their credentials expire auth sessions are refreshed.
+const RefreshAhead = 10 * time.Minute
+
+// refreshInterval is how often auth sessions are checked for expiry.
+var refreshInterval = time.Minute
+
+// sendDirectMessage sends a message to a user. It is a variable so tests can replace it.
+var sendDirectMessage = func(userID id.UserID, content interface{}) error {
+	return clientPool.SendDirectMessage(userID, content)
+}
+
+// A RefreshReport describes what RefreshSessions did.
+type RefreshReport struct {
+	// The number of sessions refreshed.
+	Refreshed int
+	// The number of sessions which failed to refresh, and will be retried.
+	Failed int
+	// The number of sessions which can't be refreshed, whose users were asked to authenticate
+	// again.
+	Expired int
+}
+
+// RefreshSessions refreshes the auth sessions of realms which are types.SessionRefresher, if
+// their credentials expire within RefreshAhead. Users whose sessions can't be refreshed are sent
+// a direct message asking them to authenticate again.
+func RefreshSessions() (report RefreshReport, err error) {
+	now := time.Now()
+	for _, realmType := range types.AuthRealmTypes() {
+		realms, err := database.GetServiceDB().LoadAuthRealmsByType(realmType)
+		if err != nil {
+			return report, err
+		}
+		for _, realm := range realms {
+			refresher, ok := realm.(types.SessionRefresher)
+			if !ok {
+				continue
+			}
+			sessions, err := database.GetServiceDB().LoadAuthSessionsByRealm(realm.ID())
+			if err != nil {
+				return report, err
+			}
+			for _, session := range sessions {
+				expiry := refresher.SessionExpiry(session)
+				if !session.Authenticated() || expiry.IsZero() || expiry.After(now.Add(RefreshAhead)) {
+					continue
+				}
+				refreshSession(realm, refresher, session, &report)
+			}
+		}
+	}
+	return report, nil
+}
+
+func refreshSession(realm types.AuthRealm, refresher types.SessionRefresher, session types.AuthSession, report *RefreshReport) {
+	logger := log.WithFields(log.Fields{
+		"realm_id": realm.ID(),
+		"user_id":  session.UserID(),
+	})
+	err := refresher.RefreshSession(session)
+	if err == nil {
+		logger.Info("Refreshed auth session")
+		report.Refreshed++
+		return
+	}
+	if !errors.Is(err, types.ErrReauthRequired) {
+		logger.WithError(err).Warn("Failed to refresh auth session, will retry")
+		report.Failed++
+		return
+	}
+	logger.WithError(err).Info("Auth session can't be refreshed, asking the user to authenticate again")
+	report.Expired++
+	err = sendDirectMessage(session.UserID(), mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body: fmt.Sprintf(
+			"Your %s login (realm %s) has expired and couldn't be renewed. Please log in again.",
+			realm.Type(), realm.ID(),
+		),
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to tell the user their auth session has expired")
+	}
+}
+
+// refreshLoop calls RefreshSessions every refreshInterval until polling is stopped.
+func refreshLoop() {
+	defer running.Done()
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		report, err := RefreshSessions()
+		if err != nil {
+			log.WithError(err).Error("Failed to refresh auth sessions")
+		} else if report != (RefreshReport{}) {
+			log.WithFields(log.Fields{
+				"refreshed": report.Refreshed,
+				"failed":    report.Failed,
+				"expired":   report.Expired,
+			}).Info("Refreshed auth sessions")
+		}
+		select {
+		case <-stopping:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package polling
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultMaxBackoff is the longest a failing service is left between polls, unless changed with
+// SetMaxBackoff.
+const DefaultMaxBackoff = time.Hour
+
+// minBackoff is the shortest delay after a failed poll, for services which ask to be polled again
+// straight away.
+const minBackoff = 30 * time.Second
+
+var (
+	maxBackoff = DefaultMaxBackoff
+	// randInt63n is a variable so tests can remove the jitter.
+	randInt63n   = rand.Int63n
+	backoffGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goneb_polling_backoff_services",
+		Help: "The number of services whose polls are being delayed because they are failing",
+	}, []string{"service_type"})
+)
+
+// SetMaxBackoff sets the longest a failing service is left between polls.
+func SetMaxBackoff(d time.Duration) {
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+	maxBackoff = d
+}
+
+// ServiceStatus is a snapshot of the poll health of a single service.
+type ServiceStatus struct {
+	ServiceID   string
+	ServiceType string
+	// The time the last OnPoll call returned. Zero if the service has not been polled yet.
+	LastPollTime time.Time
+	// The time OnPoll will next be called. Zero if the service will not be polled again.
+	NextPollTime time.Time
+	// The last error reported by the service or the poll loop. Empty if the last poll succeeded.
+	LastError string
+	// The number of polls in a row which have reported at least one error.
+	ConsecutiveFailures int
+	// True if the next poll has been delayed beyond the time the service asked for, because its
+	// polls are failing.
+	BackingOff bool
+}
+
+// pollStatus is the internal bookkeeping for a single service. Guarded by pollMutex.
+type pollStatus struct {
+	ServiceStatus
+	// errors reported during the poll which is currently in progress
+	pendingErrs []error
+}
+
+var statuses = make(map[string]*pollStatus) // ServiceID => status
+
+// ReportError records that something went wrong whilst polling this service. Services should
+// call this from within OnPoll for failures which would otherwise only be logged (e.g. a feed
+// which could not be fetched). Any reported error marks the current poll as failed.
+func ReportError(service types.Service, err error) {
+	if err == nil {
+		return
+	}
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+	st := statusFor(service)
+	st.pendingErrs = append(st.pendingErrs, err)
+}
+
+// Status returns the poll health of every service which is being polled, ordered by service ID.
+func Status() []ServiceStatus {
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+	result := make([]ServiceStatus, 0, len(statuses))
+	for _, st := range statuses {
+		result = append(result, st.ServiceStatus)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ServiceID < result[j].ServiceID
+	})
+	return result
+}
+
+// statusFor returns the status entry for this service, creating it if needed. The caller MUST
+// hold pollMutex.
+func statusFor(service types.Service) *pollStatus {
+	st := statuses[service.ServiceID()]
+	if st == nil {
+		st = &pollStatus{
+			ServiceStatus: ServiceStatus{
+				ServiceID:   service.ServiceID(),
+				ServiceType: service.ServiceType(),
+			},
+		}
+		statuses[service.ServiceID()] = st
+	}
+	return st
+}
+
+// recordPoll completes the bookkeeping for a single OnPoll call. The poll is considered failed
+// if pollErr is non-nil or if the service reported any errors via ReportError. Returns when to
+// poll next, which is nextTime unless the service is failing, in which case the time since the
+// last poll doubles with each failure, with jitter, up to the max backoff.
+func recordPoll(service types.Service, pollTime, nextTime time.Time, pollErr error) time.Time {
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+	st := statusFor(service)
+	if pollErr != nil {
+		st.pendingErrs = append(st.pendingErrs, pollErr)
+	}
+	st.LastPollTime = pollTime
+	if len(st.pendingErrs) > 0 {
+		st.LastError = st.pendingErrs[len(st.pendingErrs)-1].Error()
+		st.ConsecutiveFailures++
+	} else {
+		st.LastError = ""
+		st.ConsecutiveFailures = 0
+	}
+	st.pendingErrs = nil
+
+	backingOff := false
+	if st.ConsecutiveFailures > 0 && !nextTime.IsZero() {
+		if delay := backoff(nextTime.Sub(pollTime), st.ConsecutiveFailures); pollTime.Add(delay).After(nextTime) {
+			nextTime = pollTime.Add(delay)
+			backingOff = true
+		}
+	}
+	setBackingOff(st, backingOff)
+	st.NextPollTime = nextTime
+	return nextTime
+}
+
+// backoff returns how long to wait before polling a service which asked to be polled again after
+// interval, but
+// whose last polls failed the given number of times in a row. The caller MUST hold pollMutex.
+func backoff(interval time.Duration, failures int) time.Duration {
+	if interval < minBackoff {
+		interval = minBackoff
+	}
+	delay := interval
+	for i := 1; i < failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	// Jitter, so that services which failed together, e.g. when the network went down, don't all
+	// poll again at once.
+	half := int64(delay / 2)
+	return time.Duration(half + randInt63n(half+1))
+}
+
+// setBackingOff updates whether the service is backing off, and the gauge of services which are.
+// The caller MUST hold pollMutex.
+func setBackingOff(st *pollStatus, backingOff bool) {
+	if st.BackingOff == backingOff {
+		return
+	}
+	st.BackingOff = backingOff
+	if backingOff {
+		backoffGauge.WithLabelValues(st.ServiceType).Inc()
+	} else {
+		backoffGauge.WithLabelValues(st.ServiceType).Dec()
+	}
+}
+
+// removeStatus forgets about this service. The caller MUST hold pollMutex.
+func removeStatus(serviceID string) {
+	if st := statuses[serviceID]; st != nil {
+		setBackingOff(st, false)
+	}
+	delete(statuses, serviceID)
+}
+
+func init() {
+	prometheus.MustRegister(backoffGauge)
+}
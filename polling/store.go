@@ -0,0 +1,68 @@
+package polling
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Services which keep state in their config, e.g. reminders, change it both from commands and from
+// the poll loop, often in different instances of the service. storeLocks serialises loading,
+// modifying and storing each service's state, so that no changes are lost.
+var (
+	storeLocksMutex sync.Mutex
+	storeLocks      = make(map[string]*sync.Mutex) // ServiceID => lock
+)
+
+// Lock locks the stored state of the service against other changes, and returns the function
+// which unlocks it. Hold it whilst loading the Latest copy of the service, changing it and storing
+// it.
+func Lock(service types.Service) (unlock func()) {
+	storeLocksMutex.Lock()
+	l, ok := storeLocks[service.ServiceID()]
+	if !ok {
+		l = &sync.Mutex{}
+		storeLocks[service.ServiceID()] = l
+	}
+	storeLocksMutex.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// Latest returns the stored copy of the service, as another instance may have changed its state
+// since this one was loaded. Returns service itself if there is no stored copy.
+func Latest(service types.Service) types.Service {
+	srv, err := database.GetServiceDB().LoadService(service.ServiceID())
+	if err != nil {
+		log.WithError(err).WithField("service_id", service.ServiceID()).Warn("Failed to load latest copy of service")
+	}
+	if srv == nil || srv.ServiceType() != service.ServiceType() {
+		return service
+	}
+	return srv
+}
+
+// Update applies fn to the Latest copy of the service, under its Lock, then stores the copy. If
+// restart is true polling is restarted with the copy, so that the poll loop picks up the changes,
+// e.g. to when it next needs to poll. Nothing is stored if fn fails. Returns what fn returns.
+func Update(service types.Service, restart bool, fn func(latest types.Service) (interface{}, error)) (interface{}, error) {
+	defer Lock(service)()
+	latest := Latest(service)
+	content, err := fn(latest)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := database.GetServiceDB().StoreService(latest); err != nil {
+		log.WithError(err).WithField("service_id", service.ServiceID()).Error("Failed to store service")
+		return nil, errors.New("Failed to save the changes")
+	}
+	if restart {
+		if err := StartPolling(latest); err != nil {
+			log.WithError(err).WithField("service_id", service.ServiceID()).Error("Failed to start poll loop")
+		}
+	}
+	return content, nil
+}
@@ -0,0 +1,93 @@
+package provision
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/id"
+)
+
+// Clone returns a new, unconfigured service with the same type and config as source, but with the
+// given ID and user ID and with room IDs replaced as given in rooms. Room IDs are replaced wherever
+// they are a whole string value or map key in the config. Top-level keys in overrides, which may be
+// nil, then replace those in the config. Pass the result to Configure to register and store it.
+// Errors are of type *Error.
+func Clone(source types.Service, newID string, userID id.UserID, rooms map[id.RoomID]id.RoomID, overrides json.RawMessage) (types.Service, error) {
+	configJSON, err := json.Marshal(source)
+	if err != nil {
+		return nil, &Error{500, "Failed to encode service config"}
+	}
+	var config interface{}
+	if err = json.Unmarshal(configJSON, &config); err != nil {
+		return nil, &Error{500, "Failed to decode service config"}
+	}
+	replacements := make(map[string]string, len(rooms))
+	for from, to := range rooms {
+		replacements[string(from)] = string(to)
+	}
+	config, replaced := replaceRooms(config, replacements)
+	if replaced == 0 {
+		return nil, &Error{400, "None of the rooms to replace are in the service's config"}
+	}
+
+	if len(overrides) > 0 {
+		var fields map[string]json.RawMessage
+		if err = json.Unmarshal(overrides, &fields); err != nil {
+			return nil, &Error{400, "Config must be a JSON object"}
+		}
+		configMap, ok := config.(map[string]interface{})
+		if !ok {
+			return nil, &Error{500, "Service config isn't a JSON object"}
+		}
+		for k, v := range fields {
+			configMap[k] = v
+		}
+	}
+
+	if configJSON, err = json.Marshal(config); err != nil {
+		return nil, &Error{500, "Failed to encode service config"}
+	}
+	if userID == "" {
+		userID = source.ServiceUserID()
+	}
+	service, err := types.CreateService(newID, source.ServiceType(), userID, configJSON)
+	if err != nil {
+		return nil, &Error{400, fmt.Sprintf("Failed to create service: %s", err)}
+	}
+	return service, nil
+}
+
+// replaceRooms returns v, which is decoded JSON, with strings and map keys which are in
+// replacements replaced, and the number of replacements made.
+func replaceRooms(v interface{}, replacements map[string]string) (interface{}, int) {
+	switch val := v.(type) {
+	case string:
+		if to, ok := replacements[val]; ok {
+			return to, 1
+		}
+		return val, 0
+	case []interface{}:
+		total := 0
+		for i := range val {
+			var n int
+			val[i], n = replaceRooms(val[i], replacements)
+			total += n
+		}
+		return val, total
+	case map[string]interface{}:
+		total := 0
+		replaced := make(map[string]interface{}, len(val))
+		for k, elem := range val {
+			if to, ok := replacements[k]; ok {
+				k = to
+				total++
+			}
+			var n int
+			replaced[k], n = replaceRooms(elem, replacements)
+			total += n
+		}
+		return replaced, total
+	}
+	return v, 0
+}
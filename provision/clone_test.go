@@ -0,0 +1,65 @@
+package provision
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/id"
+)
+
+type cloneService struct {
+	types.DefaultService
+	Rooms  []id.RoomID                  `json:"rooms"`
+	Repos  map[id.RoomID][]string       `json:"repos"`
+	Token  string                       `json:"token"`
+	Nested map[string]map[string]string `json:"nested"`
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &cloneService{DefaultService: types.NewDefaultService(serviceID, serviceUserID, "provision-clone-test")}
+	})
+}
+
+func TestClone(t *testing.T) {
+	srv, err := types.CreateService("team_a", "provision-clone-test", "@neb:hyrule", []byte(`{
+		"rooms": ["!a:hyrule", "!other:hyrule"],
+		"repos": {"!a:hyrule": ["matrix-org/go-neb"]},
+		"token": "a_secret",
+		"nested": {"fallback": {"room": "!a:hyrule", "note": "!a:hyrule is team A"}}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+
+	clone, err := Clone(srv, "team_b", "", map[id.RoomID]id.RoomID{"!a:hyrule": "!b:hyrule"}, json.RawMessage(`{"token": "b_secret"}`))
+	if err != nil {
+		t.Fatal("Clone failed: ", err)
+	}
+	if clone.ServiceID() != "team_b" || clone.ServiceUserID() != "@neb:hyrule" || clone.ServiceType() != "provision-clone-test" {
+		t.Errorf("Clone => %s %s %s, want team_b @neb:hyrule provision-clone-test", clone.ServiceID(), clone.ServiceUserID(), clone.ServiceType())
+	}
+	got := clone.(*cloneService)
+	want := &cloneService{
+		DefaultService: got.DefaultService,
+		Rooms:          []id.RoomID{"!b:hyrule", "!other:hyrule"},
+		Repos:          map[id.RoomID][]string{"!b:hyrule": {"matrix-org/go-neb"}},
+		Token:          "b_secret",
+		// Only whole values are replaced
+		Nested: map[string]map[string]string{"fallback": {"room": "!b:hyrule", "note": "!a:hyrule is team A"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Clone => %+v, want %+v", got, want)
+	}
+	// The source is unchanged
+	if src := srv.(*cloneService); src.Rooms[0] != "!a:hyrule" || src.Token != "a_secret" {
+		t.Errorf("Clone modified the source service: %+v", src)
+	}
+
+	_, err = Clone(srv, "team_c", "", map[id.RoomID]id.RoomID{"!c:hyrule": "!d:hyrule"}, nil)
+	if perr, ok := err.(*Error); !ok || perr.Code != 400 {
+		t.Errorf("Clone with no matching rooms => %v, want a 400 error", err)
+	}
+}
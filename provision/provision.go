@@ -0,0 +1,211 @@
+// Package provision configures services: it registers them with their Matrix client, persists
+// them and starts polling them. It is shared by the /admin/configureService API and the
+// in-room setup wizard, so that services configured either way go through exactly the same steps.
+package provision
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// An Error is a failure to configure a service. Code is the HTTP status code which best
+// describes the failure.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+var (
+	clientPool       *clients.Clients
+	mapMutex         sync.Mutex
+	mutexByServiceID = make(map[string]*sync.Mutex)
+)
+
+// SetClients sets the pool of clients which services are registered with.
+func SetClients(clis *clients.Clients) {
+	clientPool = clis
+}
+
+func getMutexForServiceID(serviceID string) *sync.Mutex {
+	mapMutex.Lock()
+	defer mapMutex.Unlock()
+	m := mutexByServiceID[serviceID]
+	if m == nil {
+		// XXX TODO: There's a memory leak here. The amount of mutexes created is unbounded, as there will be 1 per service which are never deleted.
+		// A better solution would be to have a striped hash map with a bounded pool of mutexes. We can't live with a single global mutex because the Register()
+		// function this is protecting does many many HTTP requests which can take a long time on bad networks and will head of line block other services.
+		m = &sync.Mutex{}
+		mutexByServiceID[serviceID] = m
+	}
+	return m
+}
+
+// Configure registers and stores the service, replacing any existing service with the same ID,
+// then starts polling it if it is a types.Poller. Returns the old service, or nil if there wasn't
+// one. Errors are of type *Error.
+func Configure(service types.Service) (types.Service, error) {
+	// Have mutexes around each service to queue up multiple requests for the same service ID
+	mut := getMutexForServiceID(service.ServiceID())
+	mut.Lock()
+	defer mut.Unlock()
+
+	old, err := register(service)
+	if err != nil {
+		return nil, err
+	}
+	return commit(service, old)
+}
+
+// register registers the service with its client, returning the stored service it replaces, or nil
+// if there isn't one. The caller must hold the service's mutex.
+func register(service types.Service) (types.Service, error) {
+	db := database.GetServiceDB()
+	old, err := db.LoadService(service.ServiceID())
+	if err != nil && err != sql.ErrNoRows {
+		log.WithError(err).WithField("service_id", service.ServiceID()).Error("Failed to LoadService")
+		return nil, &Error{500, "Error loading old service"}
+	}
+
+	client, err := clientPool.Client(service.ServiceUserID())
+	if err != nil {
+		return nil, &Error{400, "Unknown matrix client"}
+	}
+
+	if err := checkClientForService(service, client); err != nil {
+		return nil, &Error{400, err.Error()}
+	}
+
+	if replier, ok := service.(types.ReplyingService); ok && !types.IsReplyStyle(replier.ReplyStyle()) {
+		return nil, &Error{400, fmt.Sprintf("Unknown reply style %q", replier.ReplyStyle())}
+	}
+
+	if err = service.Register(old, client); err != nil {
+		return nil, &Error{500, "Failed to register service: " + err.Error()}
+	}
+	return old, nil
+}
+
+// commit stores a registered service and starts polling it. The caller must hold the service's mutex.
+func commit(service, old types.Service) (types.Service, error) {
+	logger := log.WithFields(log.Fields{
+		"service_id":      service.ServiceID(),
+		"service_type":    service.ServiceType(),
+		"service_user_id": service.ServiceUserID(),
+	})
+	db := database.GetServiceDB()
+	oldService, err := db.StoreService(service)
+	if err != nil {
+		logger.WithError(err).Error("Failed to StoreService")
+		return nil, &Error{500, "Error storing service"}
+	}
+
+	// Start any polling NOW because they may decide to stop it in PostRegister, and we want to make
+	// sure we'll actually stop. Disabled services stay disabled when their config is changed.
+	disabled, err := db.IsServiceDisabled(service.ServiceID())
+	if err != nil {
+		logger.WithError(err).Error("Failed to check whether service is disabled")
+	}
+	if _, ok := service.(types.Poller); ok && !disabled {
+		if err := polling.StartPolling(service); err != nil {
+			logger.WithError(err).Error("Failed to start poll loop.")
+		}
+	}
+
+	service.PostRegister(old)
+	metrics.IncrementConfigureService(service.ServiceType())
+
+	go clientPool.PublishCapabilities(service.ServiceUserID())
+	if old != nil && old.ServiceUserID() != service.ServiceUserID() {
+		go clientPool.PublishCapabilities(old.ServiceUserID())
+	}
+
+	return oldService, nil
+}
+
+// Delete removes the service and stops polling it. Errors are of type *Error.
+func Delete(serviceID string) error {
+	mut := getMutexForServiceID(serviceID)
+	mut.Lock()
+	defer mut.Unlock()
+
+	db := database.GetServiceDB()
+	service, err := db.LoadService(serviceID)
+	if err != nil {
+		return loadError(serviceID, err)
+	}
+	if err = db.DeleteService(serviceID); err != nil {
+		log.WithError(err).WithField("service_id", serviceID).Error("Failed to DeleteService")
+		return &Error{500, "Error deleting service"}
+	}
+	if _, ok := service.(types.Poller); ok {
+		polling.StopPolling(service)
+	}
+	go clientPool.PublishCapabilities(service.ServiceUserID())
+	return nil
+}
+
+// SetEnabled enables or disables the service without changing its config. Disabled services
+// don't respond to commands or receive webhooks, and aren't polled. Errors are of type *Error.
+func SetEnabled(serviceID string, enabled bool) error {
+	mut := getMutexForServiceID(serviceID)
+	mut.Lock()
+	defer mut.Unlock()
+
+	db := database.GetServiceDB()
+	service, err := db.LoadService(serviceID)
+	if err != nil {
+		return loadError(serviceID, err)
+	}
+	if err = db.SetServiceDisabled(serviceID, !enabled); err != nil {
+		log.WithError(err).WithField("service_id", serviceID).Error("Failed to SetServiceDisabled")
+		return &Error{500, "Error updating service"}
+	}
+	if _, ok := service.(types.Poller); ok {
+		if enabled {
+			if err := polling.StartPolling(service); err != nil {
+				log.WithError(err).WithField("service_id", serviceID).Error("Failed to start poll loop.")
+			}
+		} else {
+			polling.StopPolling(service)
+		}
+	}
+	go clientPool.PublishCapabilities(service.ServiceUserID())
+	return nil
+}
+
+func loadError(serviceID string, err error) error {
+	if err == sql.ErrNoRows {
+		return &Error{404, "Service not found: " + serviceID}
+	}
+	log.WithError(err).WithField("service_id", serviceID).Error("Failed to LoadService")
+	return &Error{500, "Error loading service"}
+}
+
+func checkClientForService(service types.Service, client *clients.BotClient) error {
+	// If there are any commands or expansions for this Service then the service user ID
+	// MUST be a syncing client or else the Service will never get the incoming command/expansion!
+	cmds := service.Commands(client)
+	expans := service.Expansions(client)
+	if len(cmds) > 0 || len(expans) > 0 {
+		nebStore := client.Store.(*matrix.NEBStore)
+		if !nebStore.ClientConfig.Sync {
+			return fmt.Errorf(
+				"Service type '%s' requires a syncing client", service.ServiceType(),
+			)
+		}
+	}
+	return nil
+}
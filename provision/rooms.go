@@ -0,0 +1,210 @@
+package provision
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/id"
+)
+
+// AddRoom makes each of the services send notifications into the room, in the same way as into the
+// rooms they already send into.
+//
+// Every service is changed, or none are: the services' configs are edited and every service is
+// registered with its new config before any of them are stored. Services must be
+// types.RoomTargeters. Returns the services with their new configs. Errors are of type *Error.
+func AddRoom(serviceIDs []string, roomID id.RoomID) ([]types.Service, error) {
+	return editRooms(serviceIDs, roomID, withRoom)
+}
+
+// RemoveRoom stops each of the services sending notifications into the room. As with AddRoom,
+// every service is changed or none are.
+func RemoveRoom(serviceIDs []string, roomID id.RoomID) ([]types.Service, error) {
+	return editRooms(serviceIDs, roomID, withoutRoom)
+}
+
+func editRooms(serviceIDs []string, roomID id.RoomID, edit func(types.Service, id.RoomID) (types.Service, error)) ([]types.Service, error) {
+	if len(serviceIDs) == 0 {
+		return nil, &Error{400, "No services given"}
+	}
+	// Lock the services in order, so that concurrent edits of overlapping services can't deadlock
+	ids := append([]string(nil), serviceIDs...)
+	sort.Strings(ids)
+	var unique []string
+	for i, serviceID := range ids {
+		if i > 0 && serviceID == ids[i-1] {
+			continue
+		}
+		unique = append(unique, serviceID)
+		mut := getMutexForServiceID(serviceID)
+		mut.Lock()
+		defer mut.Unlock()
+	}
+
+	db := database.GetServiceDB()
+	services := make([]types.Service, len(unique))
+	olds := make([]types.Service, len(unique))
+	for i, serviceID := range unique {
+		current, err := db.LoadService(serviceID)
+		if err != nil {
+			return nil, loadError(serviceID, err)
+		}
+		if services[i], err = edit(current, roomID); err != nil {
+			return nil, err
+		}
+		if olds[i], err = register(services[i]); err != nil {
+			perr := err.(*Error)
+			return nil, &Error{perr.Code, serviceID + ": " + perr.Message}
+		}
+	}
+	for i, service := range services {
+		if _, err := commit(service, olds[i]); err != nil {
+			return services[:i], err
+		}
+	}
+	return services, nil
+}
+
+// withRoom returns a copy of the service with the room added to its config. The room is appended
+// to every list which contains one of the rooms the service sends into, and every map keyed by
+// those rooms gets an entry for the room which is a copy of the entry for the first of them.
+func withRoom(service types.Service, roomID id.RoomID) (types.Service, error) {
+	targeter, ok := service.(types.RoomTargeter)
+	if !ok {
+		return nil, &Error{400, service.ServiceID() + " doesn't send notifications into rooms"}
+	}
+	targets := make(map[string]bool)
+	for _, r := range targeter.TargetRooms() {
+		targets[string(r)] = true
+	}
+	if targets[string(roomID)] {
+		return nil, &Error{400, fmt.Sprintf("%s already sends into %s", service.ServiceID(), roomID)}
+	}
+	if len(targets) == 0 {
+		return nil, &Error{400, service.ServiceID() + " has no rooms to add the room alongside"}
+	}
+	edited, err := editConfig(service, func(config interface{}) (interface{}, int) {
+		return addRoom(config, string(roomID), targets)
+	})
+	if err == nil && edited == nil {
+		return nil, &Error{400, service.ServiceID() + "'s rooms aren't in lists or maps in its config"}
+	}
+	return edited, err
+}
+
+// withoutRoom returns a copy of the service with the room removed from every list and map in its config.
+func withoutRoom(service types.Service, roomID id.RoomID) (types.Service, error) {
+	if _, ok := service.(types.RoomTargeter); !ok {
+		return nil, &Error{400, service.ServiceID() + " doesn't send notifications into rooms"}
+	}
+	edited, err := editConfig(service, func(config interface{}) (interface{}, int) {
+		return removeRoom(config, string(roomID))
+	})
+	if err == nil && edited == nil {
+		return nil, &Error{400, fmt.Sprintf("%s doesn't send into %s", service.ServiceID(), roomID)}
+	}
+	return edited, err
+}
+
+// editConfig returns a copy of the service with its config, as decoded JSON, changed by fn, which
+// returns the new config and the number of changes it made. Returns nil if nothing was changed.
+func editConfig(service types.Service, fn func(config interface{}) (interface{}, int)) (types.Service, error) {
+	configJSON, err := json.Marshal(service)
+	if err != nil {
+		return nil, &Error{500, "Failed to encode service config"}
+	}
+	var config interface{}
+	if err = json.Unmarshal(configJSON, &config); err != nil {
+		return nil, &Error{500, "Failed to decode service config"}
+	}
+	config, changed := fn(config)
+	if changed == 0 {
+		return nil, nil
+	}
+	if configJSON, err = json.Marshal(config); err != nil {
+		return nil, &Error{500, "Failed to encode service config"}
+	}
+	edited, err := types.CreateService(service.ServiceID(), service.ServiceType(), service.ServiceUserID(), configJSON)
+	if err != nil {
+		return nil, &Error{500, fmt.Sprintf("Failed to create service: %s", err)}
+	}
+	return edited, nil
+}
+
+func addRoom(v interface{}, roomID string, targets map[string]bool) (interface{}, int) {
+	switch val := v.(type) {
+	case []interface{}:
+		total := 0
+		hasTarget := false
+		for i := range val {
+			if s, ok := val[i].(string); ok && targets[s] {
+				hasTarget = true
+			}
+			var n int
+			val[i], n = addRoom(val[i], roomID, targets)
+			total += n
+		}
+		if hasTarget {
+			val = append(val, roomID)
+			total++
+		}
+		return val, total
+	case map[string]interface{}:
+		total := 0
+		var keys []string
+		for k, elem := range val {
+			if targets[k] {
+				keys = append(keys, k)
+			}
+			var n int
+			val[k], n = addRoom(elem, roomID, targets)
+			total += n
+		}
+		if len(keys) > 0 {
+			sort.Strings(keys)
+			// Copy the entry, so that the rooms' entries don't share lists or maps
+			entry, _ := json.Marshal(val[keys[0]])
+			var copied interface{}
+			json.Unmarshal(entry, &copied)
+			val[roomID] = copied
+			total++
+		}
+		return val, total
+	}
+	return v, 0
+}
+
+func removeRoom(v interface{}, roomID string) (interface{}, int) {
+	switch val := v.(type) {
+	case []interface{}:
+		total := 0
+		kept := val[:0]
+		for _, elem := range val {
+			if s, ok := elem.(string); ok && s == roomID {
+				total++
+				continue
+			}
+			var n int
+			elem, n = removeRoom(elem, roomID)
+			total += n
+			kept = append(kept, elem)
+		}
+		return kept, total
+	case map[string]interface{}:
+		total := 0
+		if _, ok := val[roomID]; ok {
+			delete(val, roomID)
+			total++
+		}
+		for k, elem := range val {
+			var n int
+			val[k], n = removeRoom(elem, roomID)
+			total += n
+		}
+		return val, total
+	}
+	return v, 0
+}
@@ -0,0 +1,71 @@
+package provision
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/id"
+)
+
+type roomsService struct {
+	types.DefaultService
+	Rooms []id.RoomID `json:"rooms"`
+	Repos map[id.RoomID]struct {
+		Repos []string `json:"repos"`
+	} `json:"repos"`
+}
+
+func (s *roomsService) TargetRooms() []id.RoomID {
+	return s.Rooms
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &roomsService{DefaultService: types.NewDefaultService(serviceID, serviceUserID, "provision-rooms-test")}
+	})
+}
+
+func TestWithRoom(t *testing.T) {
+	srv, err := types.CreateService("team_a", "provision-rooms-test", "@neb:hyrule", []byte(`{
+		"rooms": ["!b:hyrule", "!a:hyrule"],
+		"repos": {"!a:hyrule": {"repos": ["matrix-org/go-neb"]}, "!b:hyrule": {"repos": ["matrix-org/dendrite"]}}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+
+	added, err := withRoom(srv, "!c:hyrule")
+	if err != nil {
+		t.Fatal("withRoom failed: ", err)
+	}
+	got := added.(*roomsService)
+	if want := []id.RoomID{"!b:hyrule", "!a:hyrule", "!c:hyrule"}; !reflect.DeepEqual(got.Rooms, want) {
+		t.Errorf("withRoom rooms => %v, want %v", got.Rooms, want)
+	}
+	// The new room gets a copy of the first room's entry
+	if repos := got.Repos["!c:hyrule"].Repos; !reflect.DeepEqual(repos, []string{"matrix-org/go-neb"}) {
+		t.Errorf("withRoom repos => %v, want [matrix-org/go-neb]", repos)
+	}
+	if len(srv.(*roomsService).Rooms) != 2 {
+		t.Errorf("withRoom modified the service: %+v", srv)
+	}
+	if _, err = withRoom(added, "!c:hyrule"); err == nil {
+		t.Error("Expected an error adding a room the service already sends into")
+	}
+
+	removed, err := withoutRoom(added, "!a:hyrule")
+	if err != nil {
+		t.Fatal("withoutRoom failed: ", err)
+	}
+	got = removed.(*roomsService)
+	if want := []id.RoomID{"!b:hyrule", "!c:hyrule"}; !reflect.DeepEqual(got.Rooms, want) {
+		t.Errorf("withoutRoom rooms => %v, want %v", got.Rooms, want)
+	}
+	if _, ok := got.Repos["!a:hyrule"]; ok || len(got.Repos) != 2 {
+		t.Errorf("withoutRoom repos => %v, want !b:hyrule and !c:hyrule", got.Repos)
+	}
+	if _, err = withoutRoom(removed, "!a:hyrule"); err == nil {
+		t.Error("Expected an error removing a room the service doesn't send into")
+	}
+}
@@ -0,0 +1,277 @@
+// Package discourse implements API key authentication for Discourse forums.
+package discourse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// RealmType of the Discourse realm
+const RealmType = "discourse"
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// ErrNoSession is returned by API when the user hasn't added a Discourse API key.
+var ErrNoSession = errors.New("no Discourse session for this user")
+
+// Realm is an AuthRealm for a Discourse forum. Discourse has no OAuth, so users authenticate by
+// giving Go-NEB a user API key, or an admin gives Go-NEB an admin API key along with the
+// user's Discourse username. Sessions are created with /admin/requestAuthSession, which checks
+// the key works before storing it.
+//
+// Example request:
+//   {
+//       "ServerURL": "https://forum.example.org",
+//       "StarterLink": "https://example.org/how-to-link-your-forum-account"
+//   }
+type Realm struct {
+	id          string
+	redirectURL string
+
+	// The URL of the Discourse forum.
+	ServerURL string
+	// Optional. If supplied, !discourse commands will return this link whenever someone is
+	// prompted to add their API key.
+	StarterLink string
+}
+
+// Session is a Discourse API key and the username it acts as, for a Matrix user.
+type Session struct {
+	id      string
+	userID  id.UserID
+	realmID string
+
+	// The Discourse username which the API key acts as.
+	Username string
+	// The API key. This may instead be a reference to a secret store, see the secrets package.
+	APIKey string
+}
+
+// AuthRequest is a request for authenticating with Discourse.
+type AuthRequest struct {
+	// The Discourse username to act as.
+	Username string
+	// A user API key for the username, or an admin API key. This may instead be a reference
+	// to a secret store.
+	APIKey string
+}
+
+// AuthResponse is a response to an AuthRequest.
+type AuthResponse struct {
+	// The Discourse username which posts will be made as.
+	Username string
+}
+
+// Authenticated returns true if the user has an API key.
+func (s *Session) Authenticated() bool {
+	return s.APIKey != "" && s.Username != ""
+}
+
+// Info returns the Discourse username.
+func (s *Session) Info() interface{} {
+	return struct {
+		Username string
+	}{s.Username}
+}
+
+// UserID returns the Matrix user ID who added the API key.
+func (s *Session) UserID() id.UserID {
+	return s.userID
+}
+
+// RealmID returns the ID of the realm the session is for.
+func (s *Session) RealmID() string {
+	return s.realmID
+}
+
+// ID returns the session ID
+func (s *Session) ID() string {
+	return s.id
+}
+
+// ID returns the realm ID
+func (r *Realm) ID() string {
+	return r.id
+}
+
+// Type is discourse
+func (r *Realm) Type() string {
+	return RealmType
+}
+
+// Init makes sure the ServerURL is valid.
+func (r *Realm) Init() error {
+	u, err := url.Parse(r.ServerURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("ServerURL must be an http or https URL")
+	}
+	r.ServerURL = strings.TrimSuffix(r.ServerURL, "/")
+	return nil
+}
+
+// Register does nothing.
+func (r *Realm) Register() error {
+	return nil
+}
+
+// SelfTest checks that the forum's public site info can be fetched.
+func (r *Realm) SelfTest() error {
+	res, err := httpClient.Get(r.ServerURL + "/site/basic-info.json")
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 500 {
+		return fmt.Errorf("Discourse returned HTTP %d", res.StatusCode)
+	}
+	return nil
+}
+
+// RequestAuthSession checks the API key by asking Discourse who it acts as, then stores it for
+// the user. The request body is of type "discourse.AuthRequest". The response is of type
+// "discourse.AuthResponse".
+//
+// Request example:
+//   {
+//       "Username": "alice",
+//       "APIKey": "0b0d8f3a..."
+//   }
+//
+// Response example:
+//   {
+//       "Username": "alice"
+//   }
+func (r *Realm) RequestAuthSession(userID id.UserID, req json.RawMessage) interface{} {
+	logger := log.WithFields(log.Fields{"user_id": userID, "realm_id": r.id})
+	var body AuthRequest
+	if err := json.Unmarshal(req, &body); err != nil || body.Username == "" || body.APIKey == "" {
+		logger.WithError(err).Print("Username and APIKey are required")
+		return nil
+	}
+	session := &Session{userID: userID, realmID: r.id, Username: body.Username, APIKey: body.APIKey}
+
+	var current struct {
+		CurrentUser struct {
+			Username string `json:"username"`
+		} `json:"current_user"`
+	}
+	if err := r.do(session, "GET", "/session/current.json", nil, &current); err != nil {
+		logger.WithError(err).Print("Failed to check Discourse API key")
+		return nil
+	}
+	if !strings.EqualFold(current.CurrentUser.Username, body.Username) {
+		logger.WithField("username", current.CurrentUser.Username).Print("Discourse API key is for another user")
+		return nil
+	}
+
+	var err error
+	if session.id, err = randomString(10); err != nil {
+		logger.WithError(err).Print("Failed to generate session ID")
+		return nil
+	}
+	if _, err = database.GetServiceDB().StoreAuthSession(session); err != nil {
+		logger.WithError(err).Print("Failed to store new auth session")
+		return nil
+	}
+	return &AuthResponse{current.CurrentUser.Username}
+}
+
+// OnReceiveRedirect is not used as Discourse sessions don't involve redirects.
+func (r *Realm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(404)
+}
+
+// AuthSession returns a Discourse Session for this user
+func (r *Realm) AuthSession(id string, userID id.UserID, realmID string) types.AuthSession {
+	return &Session{
+		id:      id,
+		userID:  userID,
+		realmID: realmID,
+	}
+}
+
+// API makes a request to the Discourse API as the given user, encoding body as JSON if it isn't
+// nil and decoding the response into out. Returns ErrNoSession if the user has no API key.
+func (r *Realm) API(userID id.UserID, method, path string, body, out interface{}) error {
+	session, err := database.GetServiceDB().LoadAuthSessionByUser(r.id, userID)
+	if err == sql.ErrNoRows {
+		return ErrNoSession
+	} else if err != nil {
+		return err
+	}
+	dSession, ok := session.(*Session)
+	if !ok || !dSession.Authenticated() {
+		return ErrNoSession
+	}
+	return r.do(dSession, method, path, body, out)
+}
+
+func (r *Realm) do(session *Session, method, path string, body, out interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, r.ServerURL+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	apiKey, err := secrets.Resolve(session.APIKey)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Api-Key", apiKey)
+	req.Header.Set("Api-Username", session.Username)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		var discourseErr struct {
+			Errors []string `json:"errors"`
+		}
+		if json.NewDecoder(res.Body).Decode(&discourseErr) == nil && len(discourseErr.Errors) > 0 {
+			return fmt.Errorf("Discourse returned an error: %s", strings.Join(discourseErr.Errors, ", "))
+		}
+		return fmt.Errorf("Discourse returned HTTP %d", res.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// Generate a cryptographically secure pseudorandom string with the given number of bytes (length).
+// Returns a hex string of the bytes.
+func randomString(length int) (string, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func init() {
+	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
+		return &Realm{id: realmID, redirectURL: redirectURL}
+	})
+}
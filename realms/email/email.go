@@ -0,0 +1,492 @@
+// Package email implements a realm which links verified email addresses to Matrix users.
+package email
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// RealmType of the email realm
+const RealmType = "email"
+
+const (
+	defaultCodeExpiryMins = 15
+	defaultSMTPPort       = 587
+	defaultMailgunURL     = "https://api.mailgun.net/v3"
+	// maxAttempts is how many wrong codes can be given before a new code must be requested.
+	maxAttempts = 5
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// sendSMTP sends an email over SMTP. It is a variable so tests can avoid needing a mail server.
+var sendSMTP = smtp.SendMail
+
+// Realm is an AuthRealm which links email addresses to Matrix users, so that services can tell
+// which Matrix user an email address belongs to, e.g. to mention the authors of commits, without
+// asking an identity server. A user links an address by asking for a verification code to be
+// sent to it, then giving the code back with /admin/requestAuthSession. Codes are sent over SMTP
+// or with Mailgun.
+//
+// Example request:
+//   {
+//       "From": "Go-NEB <neb@example.org>",
+//       "SMTP": {
+//           "Host": "smtp.example.org",
+//           "Username": "neb",
+//           "Password": "vault:secret/neb#smtp_password"
+//       }
+//   }
+type Realm struct {
+	id          string
+	redirectURL string
+
+	// The address verification codes are sent from.
+	From string
+	// The SMTP server to send codes with. Either SMTP or Mailgun must be given.
+	SMTP *SMTPConfig `json:",omitempty"`
+	// The Mailgun domain to send codes with.
+	Mailgun *MailgunConfig `json:",omitempty"`
+	// Optional. How long codes can be used for. Defaults to 15 minutes.
+	CodeExpiryMins int `json:",omitempty"`
+}
+
+// SMTPConfig is an SMTP server which verification codes are sent through. STARTTLS is used if
+// the server supports it.
+type SMTPConfig struct {
+	Host string
+	// Optional. Defaults to 587.
+	Port int `json:",omitempty"`
+	// Optional. If given, Go-NEB logs in with PLAIN authentication.
+	Username string `json:",omitempty"`
+	// This may instead be a reference to a secret store, see the secrets package.
+	Password string `json:",omitempty"`
+}
+
+// MailgunConfig is a Mailgun domain which verification codes are sent through.
+type MailgunConfig struct {
+	// The sending domain, e.g. "mg.example.org".
+	Domain string
+	// This may instead be a reference to a secret store, see the secrets package.
+	APIKey string
+	// Optional. The Mailgun API to use, e.g. "https://api.eu.mailgun.net/v3" for the EU region.
+	// Defaults to "https://api.mailgun.net/v3".
+	BaseURL string `json:",omitempty"`
+}
+
+// Session is the email address linked to a Matrix user, and the address they are verifying.
+type Session struct {
+	id      string
+	userID  id.UserID
+	realmID string
+
+	// The verified address, or "" if the user hasn't verified one.
+	Email string
+	// When Email was verified.
+	VerifiedTimestampSecs int64
+	// The address a code has been sent to, which replaces Email once it is verified.
+	PendingEmail string
+	// The SHA-256 hash of the code sent to PendingEmail, in hex.
+	CodeHash string
+	// When the code stops working.
+	CodeExpiresTimestampSecs int64
+	// The number of wrong codes given.
+	Attempts int
+}
+
+// AuthRequest is a request for linking an email address. Send the address alone to be sent a
+// code, then send it again with the code to verify it.
+type AuthRequest struct {
+	Email string
+	Code  string
+}
+
+// AuthResponse is a response to an AuthRequest.
+type AuthResponse struct {
+	Email string
+	// True if the address is now linked, false if a code has been sent to it.
+	Verified bool
+}
+
+// Authenticated returns true if the user has verified an email address.
+func (s *Session) Authenticated() bool {
+	return s.Email != ""
+}
+
+// Info returns the verified email address and the address being verified, if any.
+func (s *Session) Info() interface{} {
+	return struct {
+		Email        string
+		PendingEmail string
+	}{s.Email, s.PendingEmail}
+}
+
+// UserID returns the Matrix user ID the address is linked to.
+func (s *Session) UserID() id.UserID {
+	return s.userID
+}
+
+// RealmID returns the ID of the realm the session is for.
+func (s *Session) RealmID() string {
+	return s.realmID
+}
+
+// ID returns the session ID
+func (s *Session) ID() string {
+	return s.id
+}
+
+// ID returns the realm ID
+func (r *Realm) ID() string {
+	return r.id
+}
+
+// Type is email
+func (r *Realm) Type() string {
+	return RealmType
+}
+
+// Init makes sure exactly one way of sending codes is configured.
+func (r *Realm) Init() error {
+	if _, err := mail.ParseAddress(r.From); err != nil {
+		return errors.New("From must be an email address")
+	}
+	if (r.SMTP == nil) == (r.Mailgun == nil) {
+		return errors.New("One of SMTP or Mailgun must be given")
+	}
+	if r.SMTP != nil && r.SMTP.Host == "" {
+		return errors.New("SMTP.Host must be given")
+	}
+	if r.Mailgun != nil && (r.Mailgun.Domain == "" || r.Mailgun.APIKey == "") {
+		return errors.New("Mailgun.Domain and Mailgun.APIKey must be given")
+	}
+	if r.CodeExpiryMins < 0 {
+		return errors.New("CodeExpiryMins must not be negative")
+	}
+	return nil
+}
+
+// Register does nothing.
+func (r *Realm) Register() error {
+	return nil
+}
+
+// SelfTest checks that the SMTP server accepts connections, or that Mailgun accepts the API key
+// for the domain. No email is sent.
+func (r *Realm) SelfTest() error {
+	if r.Mailgun == nil {
+		conn, err := net.DialTimeout("tcp", r.smtpAddr(), 30*time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	apiKey, err := secrets.Resolve(r.Mailgun.APIKey)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", r.mailgunURL()+"/domains/"+url.PathEscape(r.Mailgun.Domain), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("api", apiKey)
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Mailgun returned HTTP %d", res.StatusCode)
+	}
+	return nil
+}
+
+// RequestAuthSession sends a verification code to an email address, or verifies the code which
+// was sent. The request body is of type "email.AuthRequest". The response is of type
+// "email.AuthResponse". Until the new address is verified, the user's previous address stays
+// linked.
+//
+// Request example, to send a code:
+//   {
+//       "Email": "alice@example.org"
+//   }
+//
+// Request example, to verify the code:
+//   {
+//       "Email": "alice@example.org",
+//       "Code": "493027"
+//   }
+//
+// Response example:
+//   {
+//       "Email": "alice@example.org",
+//       "Verified": true
+//   }
+func (r *Realm) RequestAuthSession(userID id.UserID, req json.RawMessage) interface{} {
+	logger := log.WithFields(log.Fields{"user_id": userID, "realm_id": r.id})
+	var body AuthRequest
+	if err := json.Unmarshal(req, &body); err != nil {
+		logger.WithError(err).Print("Failed to decode request body")
+		return nil
+	}
+	address, err := normalise(body.Email)
+	if err != nil {
+		logger.WithError(err).Print("Email must be an email address")
+		return nil
+	}
+	session, err := r.session(userID)
+	if err != nil {
+		logger.WithError(err).Print("Failed to load auth session")
+		return nil
+	}
+
+	now := time.Now()
+	if body.Code == "" {
+		code, err := randomCode()
+		if err != nil {
+			logger.WithError(err).Print("Failed to generate code")
+			return nil
+		}
+		session.PendingEmail = address
+		session.CodeHash = hashCode(code)
+		session.CodeExpiresTimestampSecs = now.Add(r.codeExpiry()).Unix()
+		session.Attempts = 0
+		if _, err = database.GetServiceDB().StoreAuthSession(session); err != nil {
+			logger.WithError(err).Print("Failed to store auth session")
+			return nil
+		}
+		if err = r.send(address, "Your verification code", verificationText(userID, code, r.codeExpiry())); err != nil {
+			logger.WithError(err).Print("Failed to send verification code")
+			return nil
+		}
+		return &AuthResponse{Email: address}
+	}
+
+	if session.PendingEmail != address || session.CodeHash == "" {
+		logger.Print("No code has been sent to this address")
+		return nil
+	}
+	if now.Unix() > session.CodeExpiresTimestampSecs || session.Attempts >= maxAttempts {
+		logger.Print("Verification code has expired")
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashCode(strings.TrimSpace(body.Code))), []byte(session.CodeHash)) != 1 {
+		session.Attempts++
+		if _, err = database.GetServiceDB().StoreAuthSession(session); err != nil {
+			logger.WithError(err).Print("Failed to store auth session")
+		}
+		logger.Print("Wrong verification code")
+		return nil
+	}
+	session.Email = address
+	session.VerifiedTimestampSecs = now.Unix()
+	session.PendingEmail = ""
+	session.CodeHash = ""
+	session.CodeExpiresTimestampSecs = 0
+	session.Attempts = 0
+	if _, err = database.GetServiceDB().StoreAuthSession(session); err != nil {
+		logger.WithError(err).Print("Failed to store auth session")
+		return nil
+	}
+	logger.WithField("email", address).Info("Verified email address")
+	return &AuthResponse{Email: address, Verified: true}
+}
+
+// OnReceiveRedirect is not used as email sessions don't involve redirects.
+func (r *Realm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(404)
+}
+
+// AuthSession returns an email Session for this user
+func (r *Realm) AuthSession(id string, userID id.UserID, realmID string) types.AuthSession {
+	return &Session{
+		id:      id,
+		userID:  userID,
+		realmID: realmID,
+	}
+}
+
+// UserForEmail returns the Matrix user who has verified the email address, or "" if nobody has.
+// If several users have verified it, the one who verified it most recently is returned, as they
+// are the one who can read its mail now.
+func (r *Realm) UserForEmail(address string) (id.UserID, error) {
+	address, err := normalise(address)
+	if err != nil {
+		return "", nil
+	}
+	sessions, err := database.GetServiceDB().LoadAuthSessionsByRealm(r.id)
+	if err != nil {
+		return "", err
+	}
+	var userID id.UserID
+	var verified int64
+	for _, s := range sessions {
+		if es, ok := s.(*Session); ok && es.Email == address && es.VerifiedTimestampSecs >= verified {
+			userID, verified = es.userID, es.VerifiedTimestampSecs
+		}
+	}
+	return userID, nil
+}
+
+// session returns the user's session, or a new one if they don't have one.
+func (r *Realm) session(userID id.UserID) (*Session, error) {
+	s, err := database.GetServiceDB().LoadAuthSessionByUser(r.id, userID)
+	if err == sql.ErrNoRows {
+		sid, err := randomHex(10)
+		if err != nil {
+			return nil, err
+		}
+		return &Session{id: sid, userID: userID, realmID: r.id}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	session, ok := s.(*Session)
+	if !ok {
+		return nil, fmt.Errorf("session for realm %s isn't an email session", r.id)
+	}
+	return session, nil
+}
+
+func (r *Realm) codeExpiry() time.Duration {
+	if r.CodeExpiryMins == 0 {
+		return defaultCodeExpiryMins * time.Minute
+	}
+	return time.Duration(r.CodeExpiryMins) * time.Minute
+}
+
+// send sends a plain text email with the configured sender.
+func (r *Realm) send(to, subject, text string) error {
+	if r.Mailgun != nil {
+		return r.sendMailgun(to, subject, text)
+	}
+	var auth smtp.Auth
+	if r.SMTP.Username != "" {
+		password, err := secrets.Resolve(r.SMTP.Password)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", r.SMTP.Username, password, r.SMTP.Host)
+	}
+	from, _ := mail.ParseAddress(r.From) // validated by Init
+	msg := "From: " + r.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.Replace(text, "\n", "\r\n", -1)
+	return sendSMTP(r.smtpAddr(), auth, from.Address, []string{to}, []byte(msg))
+}
+
+// smtpAddr returns the host:port of the SMTP server.
+func (r *Realm) smtpAddr() string {
+	port := r.SMTP.Port
+	if port == 0 {
+		port = defaultSMTPPort
+	}
+	return net.JoinHostPort(r.SMTP.Host, strconv.Itoa(port))
+}
+
+// mailgunURL returns the Mailgun API to use, without a trailing slash.
+func (r *Realm) mailgunURL() string {
+	if r.Mailgun.BaseURL == "" {
+		return defaultMailgunURL
+	}
+	return strings.TrimSuffix(r.Mailgun.BaseURL, "/")
+}
+
+func (r *Realm) sendMailgun(to, subject, text string) error {
+	apiKey, err := secrets.Resolve(r.Mailgun.APIKey)
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"from":    {r.From},
+		"to":      {to},
+		"subject": {subject},
+		"text":    {text},
+	}
+	req, err := http.NewRequest("POST", r.mailgunURL()+"/"+url.PathEscape(r.Mailgun.Domain)+"/messages",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("api", apiKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Mailgun returned HTTP %d", res.StatusCode)
+	}
+	return nil
+}
+
+func verificationText(userID id.UserID, code string, expiry time.Duration) string {
+	return fmt.Sprintf("Your code to link this email address to the Matrix user %s is:\n\n"+
+		"    %s\n\n"+
+		"It can be used for %d minutes. If you didn't ask for this code, you can ignore this email.\n",
+		userID, code, int(expiry/time.Minute))
+}
+
+// normalise returns the bare, lower case email address, e.g. "alice@example.org" for
+// "Alice <Alice@Example.org>".
+func normalise(address string) (string, error) {
+	a, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(a.Address), nil
+}
+
+// randomCode returns a random 6-digit code.
+func randomCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// Generate a cryptographically secure pseudorandom string with the given number of bytes (length).
+// Returns a hex string of the bytes.
+func randomHex(length int) (string, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func init() {
+	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
+		return &Realm{id: realmID, redirectURL: redirectURL}
+	})
+}
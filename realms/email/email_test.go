@@ -0,0 +1,168 @@
+package email
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/smtp"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/id"
+)
+
+type sessionStore struct {
+	database.NopStorage
+	sessions map[id.UserID]*Session
+}
+
+func (s *sessionStore) StoreAuthSession(session types.AuthSession) (types.AuthSession, error) {
+	s.sessions[session.UserID()] = session.(*Session)
+	return nil, nil
+}
+
+func (s *sessionStore) LoadAuthSessionByUser(realmID string, userID id.UserID) (types.AuthSession, error) {
+	if session, ok := s.sessions[userID]; ok {
+		return session, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *sessionStore) LoadAuthSessionsByRealm(realmID string) ([]types.AuthSession, error) {
+	var sessions []types.AuthSession
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+var codeRegex = regexp.MustCompile(`\d{6}`)
+
+func TestVerification(t *testing.T) {
+	database.SetServiceDB(&sessionStore{sessions: make(map[id.UserID]*Session)})
+	var sent []string
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "https://api.eu.mailgun.net/v3/mg.hyrule/messages" {
+			t.Fatalf("Unexpected request: %s", req.URL)
+		}
+		if _, key, _ := req.BasicAuth(); key != "its_a_secret" {
+			t.Errorf("Bad Mailgun API key: %s", key)
+		}
+		req.ParseForm()
+		if req.PostForm.Get("to") != "link@hyrule.example" {
+			t.Errorf("Code sent to %s, want link@hyrule.example", req.PostForm.Get("to"))
+		}
+		sent = append(sent, req.PostForm.Get("text"))
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	})}
+	realm, err := types.CreateAuthRealm("email", RealmType, []byte(`{
+		"From": "Go-NEB <neb@hyrule.example>",
+		"Mailgun": {"Domain": "mg.hyrule", "APIKey": "its_a_secret", "BaseURL": "https://api.eu.mailgun.net/v3/"}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create realm: ", err)
+	}
+	r := realm.(*Realm)
+	request := func(userID id.UserID, address, code string) *AuthResponse {
+		body, _ := json.Marshal(AuthRequest{Email: address, Code: code})
+		res, _ := r.RequestAuthSession(userID, body).(*AuthResponse)
+		return res
+	}
+
+	res := request("@link:hyrule", "Link <Link@Hyrule.example>", "")
+	if res == nil || res.Email != "link@hyrule.example" || res.Verified || len(sent) != 1 {
+		t.Fatalf("Expected a code to be sent, got %+v and %d emails", res, len(sent))
+	}
+	code := codeRegex.FindString(sent[0])
+	if !strings.Contains(sent[0], "@link:hyrule") || code == "" {
+		t.Fatalf("Bad verification email: %q", sent[0])
+	}
+	if userID, _ := r.UserForEmail("link@hyrule.example"); userID != "" {
+		t.Errorf("Expected an unverified address not to resolve, got %s", userID)
+	}
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	if res = request("@link:hyrule", "link@hyrule.example", wrong); res != nil {
+		t.Errorf("Expected a wrong code to fail, got %+v", res)
+	}
+	if res = request("@zelda:hyrule", "link@hyrule.example", code); res != nil {
+		t.Errorf("Expected another user's code to fail, got %+v", res)
+	}
+	if res = request("@link:hyrule", "link@hyrule.example", code); res == nil || !res.Verified {
+		t.Fatalf("Expected the code to verify the address, got %+v", res)
+	}
+	if res = request("@link:hyrule", "link@hyrule.example", code); res != nil {
+		t.Errorf("Expected a used code to fail, got %+v", res)
+	}
+	if userID, err := r.UserForEmail("LINK@hyrule.example"); err != nil || userID != "@link:hyrule" {
+		t.Errorf("UserForEmail => %s, %v, want @link:hyrule", userID, err)
+	}
+
+	// Too many wrong codes use up the code
+	request("@link:hyrule", "link@hyrule.example", "")
+	code = codeRegex.FindString(sent[len(sent)-1])
+	for i := 0; i < maxAttempts; i++ {
+		request("@link:hyrule", "link@hyrule.example", "not a code")
+	}
+	if res = request("@link:hyrule", "link@hyrule.example", code); res != nil {
+		t.Errorf("Expected the code to stop working after %d wrong attempts, got %+v", maxAttempts, res)
+	}
+}
+
+func TestUserForEmail(t *testing.T) {
+	now := time.Now().Unix()
+	database.SetServiceDB(&sessionStore{sessions: map[id.UserID]*Session{
+		"@old:hyrule":     {userID: "@old:hyrule", Email: "shared@hyrule.example", VerifiedTimestampSecs: now - 60},
+		"@new:hyrule":     {userID: "@new:hyrule", Email: "shared@hyrule.example", VerifiedTimestampSecs: now},
+		"@pending:hyrule": {userID: "@pending:hyrule", PendingEmail: "pending@hyrule.example"},
+	}})
+	r := &Realm{id: "email"}
+	for address, want := range map[string]id.UserID{
+		"shared@hyrule.example":  "@new:hyrule",
+		"pending@hyrule.example": "",
+		"not an address":         "",
+	} {
+		if got, err := r.UserForEmail(address); err != nil || got != want {
+			t.Errorf("UserForEmail(%q) => %s, %v, want %s", address, got, err, want)
+		}
+	}
+}
+
+func TestSMTP(t *testing.T) {
+	database.SetServiceDB(&sessionStore{sessions: make(map[id.UserID]*Session)})
+	var gotAddr, gotFrom string
+	var gotMsg []byte
+	sendSMTP = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		gotAddr, gotFrom, gotMsg = addr, from, msg
+		return nil
+	}
+	defer func() { sendSMTP = smtp.SendMail }()
+	realm, err := types.CreateAuthRealm("email", RealmType, []byte(`{
+		"From": "Go-NEB <neb@hyrule.example>",
+		"SMTP": {"Host": "smtp.hyrule.example", "Username": "neb", "Password": "its_a_secret"}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create realm: ", err)
+	}
+	if res := realm.RequestAuthSession("@link:hyrule", []byte(`{"Email":"link@hyrule.example"}`)); res == nil {
+		t.Fatal("Expected a code to be sent")
+	}
+	if gotAddr != "smtp.hyrule.example:587" || gotFrom != "neb@hyrule.example" {
+		t.Errorf("Sent to %s from %s, want smtp.hyrule.example:587 from neb@hyrule.example", gotAddr, gotFrom)
+	}
+	if !strings.Contains(string(gotMsg), "To: link@hyrule.example\r\n") || !codeRegex.Match(gotMsg) {
+		t.Errorf("Bad message:\n%s", gotMsg)
+	}
+
+	if _, err := types.CreateAuthRealm("email", RealmType, []byte(`{"From": "neb@hyrule.example"}`)); err == nil {
+		t.Error("Expected an error for a realm without SMTP or Mailgun")
+	}
+}
@@ -0,0 +1,174 @@
+package github
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	deviceCodeURL  = "https://github.com/login/device/code"
+	accessTokenURL = "https://github.com/login/oauth/access_token"
+	// The grant type for exchanging a device code for an access token.
+	deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// DeviceAuthResponse is the code which a user enters at a URL to log in with the device flow.
+type DeviceAuthResponse struct {
+	// The URL to visit to enter the code, usually https://github.com/login/device
+	URL string
+	// The code to enter, e.g. "WDJB-MJHT"
+	UserCode string
+	// How many seconds the code can be entered for.
+	ExpiresInSecs int
+}
+
+// deviceCode is GitHub's response when a device flow is started.
+type deviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+	Error           string `json:"error"`
+}
+
+// deviceToken is GitHub's response when polling for the device flow's access token.
+type deviceToken struct {
+	AccessToken string `json:"access_token"`
+	Scope       string `json:"scope"`
+	Error       string `json:"error"`
+	// The new polling interval in seconds, if Error is "slow_down".
+	Interval int `json:"interval"`
+}
+
+// StartDeviceFlow starts logging the user in with GitHub's OAuth device flow, for users who can't
+// be redirected back to Go-NEB after authorising it. The user must visit the returned URL and
+// enter the code. The realm polls GitHub until they do, or the code expires, then stores the
+// access token in the user's session. If onDone isn't nil, it is called with the result.
+func (r *Realm) StartDeviceFlow(userID id.UserID, onDone func(err error)) (*DeviceAuthResponse, error) {
+	if !r.DeviceFlow {
+		return nil, fmt.Errorf("the device flow is not enabled for realm %s", r.id)
+	}
+	var code deviceCode
+	err := postForm(deviceCodeURL, url.Values{
+		"client_id": {r.ClientID},
+		"scope":     {"admin:repo_hook,admin:org_hook,repo"},
+	}, &code)
+	if err != nil {
+		return nil, err
+	}
+	if code.Error != "" {
+		return nil, fmt.Errorf("GitHub refused to start the device flow: %s", code.Error)
+	}
+	logger := log.WithFields(log.Fields{
+		"user_id":  userID,
+		"realm_id": r.id,
+	})
+	logger.Print("Started device flow")
+	expires := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	go func() {
+		err := r.pollDeviceFlow(userID, code.DeviceCode, time.Duration(code.Interval)*time.Second, expires)
+		if err != nil {
+			logger.WithError(err).Print("Device flow failed")
+		} else {
+			logger.Print("Device flow completed")
+		}
+		if onDone != nil {
+			onDone(err)
+		}
+	}()
+	return &DeviceAuthResponse{
+		URL:           code.VerificationURI,
+		UserCode:      code.UserCode,
+		ExpiresInSecs: code.ExpiresIn,
+	}, nil
+}
+
+// pollDeviceFlow waits for the user to enter the code, then stores the access token in their
+// session.
+func (r *Realm) pollDeviceFlow(userID id.UserID, deviceCode string, interval time.Duration, expires time.Time) error {
+	for {
+		time.Sleep(interval)
+		if time.Now().After(expires) {
+			return fmt.Errorf("the code expired before it was entered")
+		}
+		var token deviceToken
+		err := postForm(accessTokenURL, url.Values{
+			"client_id":   {r.ClientID},
+			"device_code": {deviceCode},
+			"grant_type":  {deviceGrantType},
+		}, &token)
+		if err != nil {
+			// Keep trying until the code expires, as GitHub may just be unavailable briefly.
+			log.WithError(err).WithField("user_id", userID).Print("Failed to poll for device flow token")
+			continue
+		}
+		switch token.Error {
+		case "":
+			return r.storeToken(userID, token.AccessToken, token.Scope)
+		case "authorization_pending":
+		case "slow_down":
+			if token.Interval > 0 {
+				interval = time.Duration(token.Interval) * time.Second
+			} else {
+				interval += 5 * time.Second
+			}
+		default:
+			// e.g. "expired_token" or "access_denied"
+			return fmt.Errorf("GitHub refused the device flow: %s", token.Error)
+		}
+	}
+}
+
+// storeToken stores the access token in the user's session, creating it if they don't have one.
+func (r *Realm) storeToken(userID id.UserID, accessToken, scopes string) error {
+	var ghSession *Session
+	session, err := database.GetServiceDB().LoadAuthSessionByUser(r.id, userID)
+	if err == sql.ErrNoRows {
+		sessionID, err := randomString(10)
+		if err != nil {
+			return err
+		}
+		ghSession = r.AuthSession(sessionID, userID, r.id).(*Session)
+	} else if err != nil {
+		return err
+	} else {
+		var ok bool
+		if ghSession, ok = session.(*Session); !ok {
+			return fmt.Errorf("unexpected session found")
+		}
+	}
+	ghSession.AccessToken = accessToken
+	ghSession.Scopes = scopes
+	_, err = database.GetServiceDB().StoreAuthSession(ghSession)
+	return err
+}
+
+// postForm POSTs the form to GitHub, decoding the JSON response into result. GitHub responds
+// with HTTP 200 for errors such as "authorization_pending", with the error in the body.
+func postForm(u string, form url.Values, result interface{}) error {
+	req, err := http.NewRequest("POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("GitHub returned HTTP %d", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
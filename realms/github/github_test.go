@@ -0,0 +1,131 @@
+package github
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/id"
+)
+
+type sessionStore struct {
+	database.NopStorage
+	sessions map[id.UserID]*Session
+}
+
+func (s *sessionStore) StoreAuthSession(session types.AuthSession) (types.AuthSession, error) {
+	s.sessions[session.UserID()] = session.(*Session)
+	return nil, nil
+}
+
+func (s *sessionStore) LoadAuthSessionByUser(realmID string, userID id.UserID) (types.AuthSession, error) {
+	if session, ok := s.sessions[userID]; ok {
+		return session, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func TestDeviceFlow(t *testing.T) {
+	store := &sessionStore{sessions: make(map[id.UserID]*Session)}
+	database.SetServiceDB(store)
+	polls := 0
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		req.ParseForm()
+		if req.PostForm.Get("client_id") != "client" {
+			t.Errorf("Bad client_id: %s", req.PostForm.Get("client_id"))
+		}
+		var body string
+		switch req.URL.String() {
+		case deviceCodeURL:
+			body = `{"device_code":"dev","user_code":"WDJB-MJHT","verification_uri":"https://github.com/login/device","expires_in":900,"interval":0}`
+		case accessTokenURL:
+			if req.PostForm.Get("device_code") != "dev" || req.PostForm.Get("grant_type") != deviceGrantType {
+				t.Errorf("Bad token request: %v", req.PostForm)
+			}
+			polls++
+			if polls == 1 {
+				body = `{"error":"authorization_pending"}`
+			} else {
+				body = `{"access_token":"its_a_secret","scope":"repo"}`
+			}
+		default:
+			t.Errorf("Unexpected request: %s", req.URL)
+			return nil, fmt.Errorf("unexpected request")
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})}
+	defer func() { httpClient = &http.Client{Timeout: 30 * time.Second} }()
+
+	r := &Realm{id: "ghrealm", ClientID: "client"}
+	if _, err := r.StartDeviceFlow("@alice:hyrule", nil); err == nil {
+		t.Error("Expected an error when the device flow isn't enabled")
+	}
+
+	r.DeviceFlow = true
+	done := make(chan error)
+	res, err := r.StartDeviceFlow("@alice:hyrule", func(err error) { done <- err })
+	if err != nil {
+		t.Fatalf("StartDeviceFlow returned an error: %s", err)
+	}
+	if res.UserCode != "WDJB-MJHT" || res.URL != "https://github.com/login/device" || res.ExpiresInSecs != 900 {
+		t.Errorf("Unexpected device flow response: %+v", res)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("Device flow failed: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Device flow didn't complete")
+	}
+	session := store.sessions["@alice:hyrule"]
+	if session == nil || !session.Authenticated() || session.AccessToken != "its_a_secret" || session.Scopes != "repo" {
+		t.Errorf("Expected the access token to be stored in the session, got %+v", session)
+	}
+	if polls != 2 {
+		t.Errorf("Expected to poll until the code was entered, polled %d times", polls)
+	}
+}
+
+func TestPersonalAccessToken(t *testing.T) {
+	store := &sessionStore{sessions: make(map[id.UserID]*Session)}
+	database.SetServiceDB(store)
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != apiURL+"user" {
+			t.Errorf("Unexpected request: %s", req.URL)
+			return nil, fmt.Errorf("unexpected request")
+		}
+		if req.Header.Get("Authorization") != "token good_token" {
+			return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"X-Oauth-Scopes": []string{"repo, read:org"}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"login":"octocat"}`)),
+		}, nil
+	})}
+	defer func() { httpClient = &http.Client{Timeout: 30 * time.Second} }()
+
+	r := &Realm{id: "ghrealm"}
+	if res := r.RequestAuthSession("@alice:hyrule", []byte(`{"PersonalAccessToken":"bad_token"}`)); res != nil {
+		t.Errorf("Expected a rejected token to fail, got %+v", res)
+	}
+	if len(store.sessions) != 0 {
+		t.Errorf("Expected no session to be stored for a rejected token, got %+v", store.sessions)
+	}
+	res, ok := r.RequestAuthSession("@alice:hyrule", []byte(`{"PersonalAccessToken":"good_token"}`)).(*TokenAuthResponse)
+	if !ok || res.Login != "octocat" {
+		t.Fatalf("Expected the token's login, got %+v", res)
+	}
+	session := store.sessions["@alice:hyrule"]
+	if session == nil || session.AccessToken != "good_token" || session.Scopes != "repo, read:org" {
+		t.Errorf("Expected the token to be stored in the session, got %+v", session)
+	}
+}
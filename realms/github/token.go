@@ -0,0 +1,43 @@
+package github
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// StorePersonalAccessToken stores a personal access token in the user's session, for when OAuth
+// apps can't be created. The token is checked by fetching the GitHub user it belongs to, whose
+// login is returned.
+func (r *Realm) StorePersonalAccessToken(userID id.UserID, token string) (string, error) {
+	req, err := http.NewRequest("GET", apiURL+"user", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "token "+token)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized {
+		return "", errors.New("GitHub rejected the token")
+	} else if res.StatusCode != 200 {
+		return "", fmt.Errorf("GitHub returned HTTP %d", res.StatusCode)
+	}
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&user); err != nil {
+		return "", err
+	}
+	// Fine-grained tokens don't have scopes, so this may be empty.
+	if err = r.storeToken(userID, token, res.Header.Get("X-OAuth-Scopes")); err != nil {
+		return "", err
+	}
+	return user.Login, nil
+}
@@ -0,0 +1,318 @@
+package jira
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/realms/jira/urls"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"maunium.net/go/mautrix/id"
+)
+
+// The Atlassian endpoints used to authenticate with JIRA Cloud. Variables so tests can replace them.
+var (
+	atlassianAuthURL  = "https://auth.atlassian.com/authorize"
+	atlassianTokenURL = "https://auth.atlassian.com/oauth/token"
+	atlassianAPIURL   = "https://api.atlassian.com/"
+)
+
+// The scopes requested from JIRA Cloud users. offline_access gets a refresh token.
+var cloudScopes = []string{"read:jira-work", "write:jira-work", "read:jira-user", "offline_access"}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Atlassian rotates refresh tokens, so refreshes of the same session are serialised to stop
+// them racing to use the old refresh token.
+var refreshMutex sync.Mutex
+
+// IsCloud returns true if the realm is for a JIRA Cloud site, either because Cloud is set or because
+// JIRAEndpoint is an *.atlassian.net site.
+func (r *Realm) IsCloud() bool {
+	if r.Cloud {
+		return true
+	}
+	u, err := url.Parse(r.JIRAEndpoint)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(strings.ToLower(u.Hostname()), ".atlassian.net")
+}
+
+func (r *Realm) oauth2Config() (*oauth2.Config, error) {
+	clientSecret, err := secrets.Resolve(r.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Config{
+		ClientID:     r.ClientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  r.redirectURL,
+		Scopes:       cloudScopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   atlassianAuthURL,
+			TokenURL:  atlassianTokenURL,
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+	}, nil
+}
+
+// requestCloudAuthSession starts an OAuth 2.0 (3LO) session with Atlassian, keyed off the state param.
+func (r *Realm) requestCloudAuthSession(userID id.UserID, reqBody AuthRequest) interface{} {
+	logger := log.WithField("jira_url", r.JIRAEndpoint)
+	cfg, err := r.oauth2Config()
+	if err != nil {
+		logger.WithError(err).Print("Failed to load client secret")
+		return nil
+	}
+	state, err := randomString(10)
+	if err != nil {
+		logger.WithError(err).Print("Failed to generate state param")
+		return nil
+	}
+	authURL := cfg.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("audience", "api.atlassian.com"),
+		oauth2.SetAuthURLParam("prompt", "consent"),
+	)
+	_, err = database.GetServiceDB().StoreAuthSession(&Session{
+		id:                 state,
+		userID:             userID,
+		realmID:            r.id,
+		ClientsRedirectURL: reqBody.RedirectURL,
+	})
+	if err != nil {
+		logger.WithError(err).Print("Failed to store new auth session")
+		return nil
+	}
+	return &AuthResponse{authURL}
+}
+
+// onReceiveCloudRedirect exchanges the code from Atlassian for tokens, and finds the cloud ID of
+// the realm's site.
+func (r *Realm) onReceiveCloudRedirect(w http.ResponseWriter, req *http.Request) {
+	code := req.URL.Query().Get("code")
+	state := req.URL.Query().Get("state")
+	logger := log.WithFields(log.Fields{
+		"jira_url": r.JIRAEndpoint,
+		"state":    state,
+	})
+	if code == "" || state == "" {
+		failWith(logger, w, 400, "code and state are required", nil)
+		return
+	}
+	session, err := database.GetServiceDB().LoadAuthSessionByID(r.id, state)
+	if err != nil {
+		failWith(logger, w, 400, "Provided ?state= param is not recognised.", err)
+		return
+	}
+	jiraSession, ok := session.(*Session)
+	if !ok {
+		failWith(logger, w, 500, "Unexpected session type found.", nil)
+		return
+	}
+	logger = logger.WithField("user_id", jiraSession.UserID())
+	logger.Print("Retrieved auth session for user")
+
+	cfg, err := r.oauth2Config()
+	if err != nil {
+		failWith(logger, w, 500, "Failed to load client secret", err)
+		return
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+	token, err := cfg.Exchange(ctx, code)
+	if err != nil {
+		failWith(logger, w, 502, "Failed exchange for access token.", err)
+		return
+	}
+	cloudID, err := r.cloudID(token.AccessToken)
+	if err != nil {
+		failWith(logger, w, 502, "Failed to find the JIRA site.", err)
+		return
+	}
+	logger.WithField("cloud_id", cloudID).Print("Exchanged for access token")
+
+	jiraSession.AccessToken = token.AccessToken
+	jiraSession.RefreshToken = token.RefreshToken
+	jiraSession.Expiry = token.Expiry
+	jiraSession.CloudID = cloudID
+	if _, err = database.GetServiceDB().StoreAuthSession(jiraSession); err != nil {
+		failWith(logger, w, 500, "Failed to persist JIRA session", err)
+		return
+	}
+	r.redirectOr(w, jiraSession)
+}
+
+// accessibleResource is a site which an Atlassian token can access.
+type accessibleResource struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// cloudID returns the ID which Atlassian's API uses for the realm's site, from the sites the
+// access token can access.
+func (r *Realm) cloudID(accessToken string) (string, error) {
+	req, err := http.NewRequest("GET", atlassianAPIURL+"oauth/token/accessible-resources", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("accessible-resources returned code %d", res.StatusCode)
+	}
+	var resources []accessibleResource
+	if err := json.NewDecoder(res.Body).Decode(&resources); err != nil {
+		return "", err
+	}
+	for _, resource := range resources {
+		if urls.SameJIRAURL(resource.URL, r.JIRAEndpoint) {
+			return resource.ID, nil
+		}
+	}
+	return "", fmt.Errorf("the token can't access %s", r.JIRAEndpoint)
+}
+
+// cloudClient returns a client for Atlassian's API for the session's site. Access tokens are
+// refreshed when they expire, and the new tokens stored in the session.
+func (r *Realm) cloudClient(jsession *Session) (*jira.Client, error) {
+	if jsession.CloudID == "" || jsession.RefreshToken == "" {
+		return nil, errors.New("No authenticated session found for " + jsession.UserID().String())
+	}
+	cfg, err := r.oauth2Config()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+	token := &oauth2.Token{
+		AccessToken:  jsession.AccessToken,
+		RefreshToken: jsession.RefreshToken,
+		Expiry:       jsession.Expiry,
+		TokenType:    "Bearer",
+	}
+	ts := &sessionTokenSource{
+		base:    cfg.TokenSource(ctx, token),
+		session: jsession,
+	}
+	return jira.NewClient(oauth2.NewClient(ctx, ts), atlassianAPIURL+"ex/jira/"+jsession.CloudID+"/")
+}
+
+// sessionTokenSource stores tokens in the session when they are refreshed.
+type sessionTokenSource struct {
+	base    oauth2.TokenSource
+	session *Session
+}
+
+func (ts *sessionTokenSource) Token() (*oauth2.Token, error) {
+	refreshMutex.Lock()
+	defer refreshMutex.Unlock()
+	token, err := ts.base.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token.AccessToken == ts.session.AccessToken {
+		return token, nil
+	}
+	ts.session.AccessToken = token.AccessToken
+	ts.session.Expiry = token.Expiry
+	if token.RefreshToken != "" {
+		ts.session.RefreshToken = token.RefreshToken
+	}
+	if _, err := database.GetServiceDB().StoreAuthSession(ts.session); err != nil {
+		log.WithError(err).WithField("user_id", ts.session.UserID()).Error("Failed to store refreshed JIRA token")
+	}
+	return token, nil
+}
+
+// SessionExpiry returns when a JIRA Cloud session's access token expires. Sessions which use
+// OAuth 1.0a or a personal access token don't expire.
+func (r *Realm) SessionExpiry(session types.AuthSession) time.Time {
+	jsession, ok := session.(*Session)
+	if !ok || !r.IsCloud() || jsession.PersonalAccessToken != "" || jsession.RefreshToken == "" {
+		return time.Time{}
+	}
+	return jsession.Expiry
+}
+
+// RefreshSession gets a new access token for a JIRA Cloud session with its refresh token. If
+// Atlassian refuses the refresh token, e.g. because the user revoked access or hasn't used it for
+// 90 days, the session's tokens are removed.
+func (r *Realm) RefreshSession(session types.AuthSession) error {
+	jsession, ok := session.(*Session)
+	if !ok {
+		return errors.New("Failed to cast user session to a Session")
+	}
+	cfg, err := r.oauth2Config()
+	if err != nil {
+		return err
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+
+	refreshMutex.Lock()
+	defer refreshMutex.Unlock()
+	// Without an access token, the token source always refreshes.
+	token, err := cfg.TokenSource(ctx, &oauth2.Token{RefreshToken: jsession.RefreshToken}).Token()
+	if err != nil {
+		if rErr, ok := err.(*oauth2.RetrieveError); ok && rErr.Response.StatusCode >= 400 && rErr.Response.StatusCode < 500 {
+			jsession.AccessToken = ""
+			jsession.RefreshToken = ""
+			jsession.Expiry = time.Time{}
+			if _, err := database.GetServiceDB().StoreAuthSession(jsession); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: Atlassian refused the refresh token: %s", types.ErrReauthRequired, err)
+		}
+		return err
+	}
+	jsession.AccessToken = token.AccessToken
+	jsession.Expiry = token.Expiry
+	if token.RefreshToken != "" {
+		jsession.RefreshToken = token.RefreshToken
+	}
+	_, err = database.GetServiceDB().StoreAuthSession(jsession)
+	return err
+}
+
+func (r *Realm) redirectOr(w http.ResponseWriter, jiraSession *Session) {
+	if jiraSession.ClientsRedirectURL != "" {
+		w.Header().Set("Location", jiraSession.ClientsRedirectURL)
+		w.WriteHeader(302)
+		// technically don't need a body but *shrug*
+		w.Write([]byte(jiraSession.ClientsRedirectURL))
+		return
+	}
+	w.WriteHeader(200)
+	w.Write([]byte(
+		fmt.Sprintf("You have successfully linked your JIRA account on %s to %s",
+			r.JIRAEndpoint, jiraSession.UserID(),
+		),
+	))
+}
+
+// Generate a cryptographically secure pseudorandom string with the given number of bytes (length).
+// Returns a hex string of the bytes.
+func randomString(length int) (string, error) {
+	b := make([]byte, length)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,228 @@
+package jira
+
+import (
+	"database/sql"
+	"errors"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/id"
+)
+
+type sessionStore struct {
+	database.NopStorage
+	session *Session
+}
+
+func (s *sessionStore) StoreAuthSession(session types.AuthSession) (types.AuthSession, error) {
+	s.session = session.(*Session)
+	return nil, nil
+}
+
+func (s *sessionStore) LoadAuthSessionByID(realmID, sessionID string) (types.AuthSession, error) {
+	return s.session, nil
+}
+
+func (s *sessionStore) LoadAuthSessionByUser(realmID string, userID id.UserID) (types.AuthSession, error) {
+	if s.session == nil {
+		return nil, sql.ErrNoRows
+	}
+	return s.session, nil
+}
+
+func TestIsCloud(t *testing.T) {
+	for endpoint, want := range map[string]bool{
+		"https://example.atlassian.net/": true,
+		"https://jira.example.org/":      false,
+		"https://atlassian.net.evil/":    false,
+	} {
+		r := Realm{JIRAEndpoint: endpoint}
+		if got := r.IsCloud(); got != want {
+			t.Errorf("IsCloud(%s) => %v, want %v", endpoint, got, want)
+		}
+	}
+	r := Realm{JIRAEndpoint: "https://jira.example.org/", Cloud: true}
+	if !r.IsCloud() {
+		t.Error("IsCloud() => false for a realm with Cloud set")
+	}
+}
+
+func TestCloudAuth(t *testing.T) {
+	atlassian := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/oauth/token":
+			req.ParseForm()
+			if req.PostForm.Get("code") != "the_code" || req.PostForm.Get("client_secret") != "secret" {
+				t.Errorf("Bad token request: %v", req.PostForm)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token": "access", "refresh_token": "refresh", "expires_in": 3600, "token_type": "Bearer"}`))
+		case "/oauth/token/accessible-resources":
+			if req.Header.Get("Authorization") != "Bearer access" {
+				t.Errorf("Bad accessible-resources auth: %s", req.Header.Get("Authorization"))
+			}
+			w.Write([]byte(`[
+				{"id": "other-id", "url": "https://other.atlassian.net"},
+				{"id": "cloud-id", "url": "https://example.atlassian.net"}
+			]`))
+		default:
+			t.Errorf("Unexpected request to %s", req.URL.Path)
+			w.WriteHeader(404)
+		}
+	}))
+	defer atlassian.Close()
+	atlassianTokenURL = atlassian.URL + "/oauth/token"
+	atlassianAPIURL = atlassian.URL + "/"
+
+	store := &sessionStore{}
+	database.SetServiceDB(store)
+	r := Realm{
+		id:           "jirarealm",
+		redirectURL:  "https://neb/realms/redirects/jirarealm",
+		JIRAEndpoint: "https://example.atlassian.net",
+		ClientID:     "client",
+		ClientSecret: "secret",
+	}
+	if err := r.Init(); err != nil {
+		t.Fatal("Failed to init realm: ", err)
+	}
+
+	res := r.RequestAuthSession(id.UserID("@alice:hs"), []byte(`{}`))
+	authRes, ok := res.(*AuthResponse)
+	if !ok || !strings.Contains(authRes.URL, "audience=api.atlassian.com") || store.session == nil {
+		t.Fatalf("RequestAuthSession => %+v, want an Atlassian URL", res)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/?code=the_code&state="+store.session.ID(), nil)
+	r.OnReceiveRedirect(w, req)
+	if w.Code != 200 {
+		t.Fatalf("OnReceiveRedirect => %d %s", w.Code, w.Body.String())
+	}
+	if store.session.CloudID != "cloud-id" || store.session.RefreshToken != "refresh" || !store.session.Authenticated() {
+		t.Errorf("Stored session %+v, want an authenticated session for cloud-id", store.session)
+	}
+}
+
+func TestRefreshSession(t *testing.T) {
+	refreshed := false
+	atlassian := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.PostForm.Get("grant_type") != "refresh_token" {
+			t.Errorf("Bad refresh request: %v", req.PostForm)
+		}
+		if req.PostForm.Get("refresh_token") != "refresh" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(403)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		refreshed = true
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "new_access", "refresh_token": "new_refresh", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	defer atlassian.Close()
+	atlassianTokenURL = atlassian.URL + "/oauth/token"
+	httpClient = atlassian.Client()
+
+	store := &sessionStore{}
+	database.SetServiceDB(store)
+	r := Realm{id: "jirarealm", JIRAEndpoint: "https://example.atlassian.net/", ClientID: "client", ClientSecret: "secret"}
+	expiry := time.Now().Add(time.Minute)
+	session := &Session{userID: "@alice:hs", realmID: "jirarealm", AccessToken: "access", RefreshToken: "refresh", CloudID: "cloud-id", Expiry: expiry}
+	if got := r.SessionExpiry(session); !got.Equal(expiry) {
+		t.Errorf("SessionExpiry => %s, want %s", got, expiry)
+	}
+	if got := r.SessionExpiry(&Session{PersonalAccessToken: "token"}); !got.IsZero() {
+		t.Errorf("SessionExpiry for a personal access token => %s, want zero", got)
+	}
+
+	if err := r.RefreshSession(session); err != nil {
+		t.Fatalf("RefreshSession => %s", err)
+	}
+	if !refreshed || store.session != session || session.AccessToken != "new_access" || session.RefreshToken != "new_refresh" || !session.Expiry.After(expiry) {
+		t.Errorf("Stored session %+v, want the new tokens", store.session)
+	}
+
+	// The old refresh token is refused, so the user has to authenticate again
+	session.RefreshToken = "refresh_old"
+	if err := r.RefreshSession(session); !errors.Is(err, types.ErrReauthRequired) {
+		t.Errorf("RefreshSession with a refused token => %v, want ErrReauthRequired", err)
+	}
+	if store.session.Authenticated() {
+		t.Errorf("Stored session %+v, want it to no longer be authenticated", store.session)
+	}
+}
+
+func TestPersonalAccessToken(t *testing.T) {
+	var auth string
+	jiraServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/rest/api/2/myself" {
+			t.Errorf("Unexpected request to %s", req.URL.Path)
+			w.WriteHeader(404)
+			return
+		}
+		auth = req.Header.Get("Authorization")
+		if auth != "Bearer good_token" && auth != "Basic "+base64.StdEncoding.EncodeToString([]byte("alice@example.org:api_token")) {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte(`{"name": "alice", "displayName": "Alice"}`))
+	}))
+	defer jiraServer.Close()
+	httpClient = jiraServer.Client()
+
+	store := &sessionStore{session: &Session{id: "old", userID: "@alice:hs", realmID: "jirarealm", AccessToken: "oauth", AccessSecret: "secret"}}
+	database.SetServiceDB(store)
+	r := Realm{id: "jirarealm", JIRAEndpoint: jiraServer.URL + "/"}
+	if _, err := r.StorePersonalAccessToken("@alice:hs", "bad_token"); err == nil {
+		t.Error("Expected a rejected token to fail")
+	}
+	res, ok := r.RequestAuthSession("@alice:hs", []byte(`{"PersonalAccessToken": "good_token"}`)).(*TokenAuthResponse)
+	if !ok || res.DisplayName != "Alice" {
+		t.Fatalf("RequestAuthSession => %+v, want Alice", res)
+	}
+	if s := store.session; s.ID() != "old" || s.PersonalAccessToken != "good_token" || s.AccessToken != "" || !s.Authenticated() {
+		t.Errorf("Stored session %+v, want the token to replace the OAuth tokens", s)
+	}
+	if _, err := r.JIRAClient("@alice:hs", false); err != nil {
+		t.Errorf("JIRAClient with a token => %s", err)
+	}
+
+	// JIRA Cloud uses API tokens with the account's email address
+	r.Cloud = true
+	if _, err := r.StorePersonalAccessToken("@alice:hs", "api_token"); err == nil {
+		t.Error("Expected an API token without an email address to fail for JIRA Cloud")
+	}
+	if name, err := r.StorePersonalAccessToken("@alice:hs", "alice@example.org:api_token"); err != nil || name != "Alice" {
+		t.Errorf("StorePersonalAccessToken for JIRA Cloud => %q, %v, want Alice", name, err)
+	}
+	if !strings.HasPrefix(auth, "Basic ") {
+		t.Errorf("Expected basic auth for JIRA Cloud, got %q", auth)
+	}
+}
+
+func TestRegisterRecorded(t *testing.T) {
+	database.SetServiceDB(&sessionStore{})
+	cassette := testutils.NewCassette(t, "testdata/server_info.json")
+	httpClient = cassette.Client()
+
+	r := Realm{
+		JIRAEndpoint: "https://hyrule.atlassian.net/",
+		ClientID:     "client_id",
+		ClientSecret: "client_secret",
+	}
+	if err := r.Register(); err != nil {
+		t.Fatal("Failed to register realm: ", err)
+	}
+	if r.Server != "Hyrule JIRA" || r.Version != "1001.0.0-SNAPSHOT" {
+		t.Errorf("Register found server %q version %q, want Hyrule JIRA 1001.0.0-SNAPSHOT", r.Server, r.Version)
+	}
+}
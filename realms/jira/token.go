@@ -0,0 +1,99 @@
+package jira
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	jira "github.com/andygrunwald/go-jira"
+	"github.com/matrix-org/go-neb/database"
+	"maunium.net/go/mautrix/id"
+)
+
+// StorePersonalAccessToken stores a personal access token in the user's session, for JIRA
+// installations where OAuth can't be set up. The token is checked by fetching the JIRA user it
+// belongs to, whose display name is returned. Any OAuth tokens in the session are replaced.
+//
+// Self-hosted JIRA installations (8.14 and later) take the token as a bearer token. JIRA Cloud
+// doesn't have personal access tokens, so an API token is used with the account's email address,
+// given as "email:api_token".
+func (r *Realm) StorePersonalAccessToken(userID id.UserID, token string) (string, error) {
+	cli, err := r.tokenClient(token)
+	if err != nil {
+		return "", err
+	}
+	user, res, err := cli.User.GetSelf()
+	if err != nil {
+		if res != nil && res.StatusCode == http.StatusUnauthorized {
+			return "", errors.New("JIRA rejected the token")
+		}
+		return "", err
+	}
+
+	var jsession *Session
+	session, err := database.GetServiceDB().LoadAuthSessionByUser(r.id, userID)
+	if err == sql.ErrNoRows {
+		sessionID, err := randomString(10)
+		if err != nil {
+			return "", err
+		}
+		jsession = r.AuthSession(sessionID, userID, r.id).(*Session)
+	} else if err != nil {
+		return "", err
+	} else {
+		var ok bool
+		if jsession, ok = session.(*Session); !ok {
+			return "", errors.New("Failed to cast user session to a Session")
+		}
+	}
+	// Drop the OAuth tokens, so that it is clear which credentials the session uses.
+	*jsession = Session{
+		id:                  jsession.id,
+		userID:              userID,
+		realmID:             r.id,
+		PersonalAccessToken: token,
+		ClientsRedirectURL:  jsession.ClientsRedirectURL,
+	}
+	if _, err = database.GetServiceDB().StoreAuthSession(jsession); err != nil {
+		return "", err
+	}
+	return user.DisplayName, nil
+}
+
+// tokenClient returns a client which authenticates with the personal access token.
+func (r *Realm) tokenClient(token string) (*jira.Client, error) {
+	var transport http.RoundTripper
+	if r.IsCloud() {
+		i := strings.LastIndex(token, ":")
+		if i <= 0 || i == len(token)-1 {
+			return nil, errors.New(`JIRA Cloud API tokens must be given as "email:api_token"`)
+		}
+		transport = &jira.BasicAuthTransport{
+			Username:  token[:i],
+			Password:  token[i+1:],
+			Transport: httpClient.Transport,
+		}
+	} else {
+		transport = &bearerTransport{token: token, transport: httpClient.Transport}
+	}
+	return jira.NewClient(&http.Client{Transport: transport, Timeout: httpClient.Timeout}, r.JIRAEndpoint)
+}
+
+// bearerTransport authenticates requests with a bearer token.
+type bearerTransport struct {
+	token string
+	// The underlying transport, or http.DefaultTransport if nil.
+	transport http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request
+	req2 := req.Clone(req.Context())
+	req2.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.token))
+	if t.transport == nil {
+		return http.DefaultTransport.RoundTrip(req2)
+	}
+	return t.transport.RoundTrip(req2)
+}
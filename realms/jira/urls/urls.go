@@ -46,6 +46,8 @@ func ParseJIRAURL(u string) (j JIRAURL, err error) {
 	// Attempt to parse out REST API paths. This is a horrible heuristic which mostly works.
 	if strings.Contains(u, "/rest/api/") {
 		j.Base = makeBaseURL(strings.Split(u, "/rest/api/")[0])
+	} else if strings.Contains(u, "/rest/agile/") {
+		j.Base = makeBaseURL(strings.Split(u, "/rest/agile/")[0])
 	} else {
 		// Assume it already is a base URL
 		j.Base = makeBaseURL(u)
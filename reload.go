@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/provision"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// A configReloader re-reads the config file on SIGHUP or /admin/reload, and applies what changed
+// since it was last applied, so that clients keep syncing and services keep their state.
+type configReloader struct {
+	path    string
+	db      *database.ServiceDB
+	clients *clients.Clients
+
+	mu sync.Mutex
+	// The config which was last applied in full.
+	current *api.ConfigFile
+}
+
+// Reload re-reads the config file and applies the changes. Clients are added or changed as with
+// /admin/configureClient, and services as with /admin/configureService, so they go through
+// Register and PostRegister. Removed services are deleted, then removed clients. Realms and sessions
+// are stored again. If the config file can't be read nothing is changed and an error is returned.
+// Otherwise, changes which can't be applied are listed in the Errors of the response, and are
+// tried again on the next reload.
+func (r *configReloader) Reload() (*api.ConfigChanges, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := loadFromConfig(r.db, r.path)
+	if err != nil {
+		return nil, err
+	}
+	// Check every service before changing anything, so that a typo doesn't half-apply the file.
+	services := make(map[string]types.Service)
+	for i, s := range cfg.Services {
+		if err = s.Check(); err != nil {
+			return nil, fmt.Errorf("config: Service[%d] : %s", i, err)
+		}
+		service, err := types.CreateService(s.ID, s.Type, s.UserID, s.Config)
+		if err != nil {
+			return nil, fmt.Errorf("config: Service[%d] : %s", i, err)
+		}
+		services[s.ID] = service
+	}
+	clientConfigs := make(map[id.UserID]api.ClientConfig)
+	for _, c := range cfg.Clients {
+		clientConfigs[c.UserID] = c
+	}
+
+	changes := diffConfig(r.current, cfg)
+	fail := func(err error, field, value string) {
+		log.WithError(err).WithField(field, value).Error("Failed to apply config file change")
+		changes.Errors = append(changes.Errors, fmt.Sprintf("%s: %s", value, err))
+	}
+
+	for _, userIDs := range [][]id.UserID{changes.AddedClients, changes.ChangedClients} {
+		for _, userID := range userIDs {
+			if _, err := r.clients.Update(clientConfigs[userID]); err != nil {
+				fail(err, "user_id", userID.String())
+			}
+		}
+	}
+	if err := r.db.InsertFromConfig(&api.ConfigFile{Realms: cfg.Realms, Sessions: cfg.Sessions}); err != nil {
+		fail(err, "path", r.path)
+	}
+	for _, serviceID := range changes.RemovedServices {
+		if err := provision.Delete(serviceID); err != nil {
+			fail(err, "service_id", serviceID)
+		}
+	}
+	for _, serviceIDs := range [][]string{changes.AddedServices, changes.ChangedServices} {
+		for _, serviceID := range serviceIDs {
+			if _, err := provision.Configure(services[serviceID]); err != nil {
+				fail(err, "service_id", serviceID)
+			}
+		}
+	}
+	for _, userID := range changes.RemovedClients {
+		if err := r.clients.Remove(userID); err != nil {
+			fail(err, "user_id", userID.String())
+		}
+	}
+
+	if len(changes.Errors) == 0 {
+		r.current = cfg
+	}
+	log.WithFields(log.Fields{
+		"added_clients":    changes.AddedClients,
+		"changed_clients":  changes.ChangedClients,
+		"removed_clients":  changes.RemovedClients,
+		"added_services":   changes.AddedServices,
+		"changed_services": changes.ChangedServices,
+		"removed_services": changes.RemovedServices,
+		"errors":           len(changes.Errors),
+	}).Info("Reloaded config file")
+	return &changes, nil
+}
+
+// diffConfig returns the clients and services which were added, changed or removed between the
+// old and new config files. Lists are sorted.
+func diffConfig(old, new *api.ConfigFile) (changes api.ConfigChanges) {
+	oldClients := make(map[id.UserID]api.ClientConfig)
+	for _, c := range old.Clients {
+		oldClients[c.UserID] = c
+	}
+	for _, c := range new.Clients {
+		if o, ok := oldClients[c.UserID]; !ok {
+			changes.AddedClients = append(changes.AddedClients, c.UserID)
+		} else if !reflect.DeepEqual(o, c) {
+			changes.ChangedClients = append(changes.ChangedClients, c.UserID)
+		}
+		delete(oldClients, c.UserID)
+	}
+	for userID := range oldClients {
+		changes.RemovedClients = append(changes.RemovedClients, userID)
+	}
+
+	oldServices := make(map[string]api.ConfigureServiceRequest)
+	for _, s := range old.Services {
+		oldServices[s.ID] = s
+	}
+	for _, s := range new.Services {
+		if o, ok := oldServices[s.ID]; !ok {
+			changes.AddedServices = append(changes.AddedServices, s.ID)
+		} else if o.Type != s.Type || o.UserID != s.UserID || !bytes.Equal(o.Config, s.Config) {
+			changes.ChangedServices = append(changes.ChangedServices, s.ID)
+		}
+		delete(oldServices, s.ID)
+	}
+	for serviceID := range oldServices {
+		changes.RemovedServices = append(changes.RemovedServices, serviceID)
+	}
+
+	for _, userIDs := range [][]id.UserID{changes.AddedClients, changes.ChangedClients, changes.RemovedClients} {
+		sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+	}
+	for _, serviceIDs := range [][]string{changes.AddedServices, changes.ChangedServices, changes.RemovedServices} {
+		sort.Strings(serviceIDs)
+	}
+	return
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestDiffConfig(t *testing.T) {
+	old := &api.ConfigFile{
+		Clients: []api.ClientConfig{
+			{UserID: "@same:hyrule", HomeserverURL: "https://hyrule"},
+			{UserID: "@changed:hyrule", HomeserverURL: "https://hyrule"},
+			{UserID: "@removed:hyrule", HomeserverURL: "https://hyrule"},
+		},
+		Services: []api.ConfigureServiceRequest{
+			{ID: "same", Type: "echo", UserID: "@same:hyrule", Config: json.RawMessage(`{}`)},
+			{ID: "changed_config", Type: "rssbot", UserID: "@same:hyrule", Config: json.RawMessage(`{"feeds":{}}`)},
+			{ID: "changed_user", Type: "echo", UserID: "@same:hyrule", Config: json.RawMessage(`{}`)},
+			{ID: "removed", Type: "echo", UserID: "@removed:hyrule", Config: json.RawMessage(`{}`)},
+		},
+	}
+	new := &api.ConfigFile{
+		Clients: []api.ClientConfig{
+			{UserID: "@added:hyrule", HomeserverURL: "https://hyrule"},
+			{UserID: "@changed:hyrule", HomeserverURL: "https://hyrule", Sync: true},
+			{UserID: "@same:hyrule", HomeserverURL: "https://hyrule"},
+		},
+		Services: []api.ConfigureServiceRequest{
+			{ID: "added", Type: "echo", UserID: "@added:hyrule", Config: json.RawMessage(`{}`)},
+			{ID: "changed_user", Type: "echo", UserID: "@changed:hyrule", Config: json.RawMessage(`{}`)},
+			{ID: "changed_config", Type: "rssbot", UserID: "@same:hyrule", Config: json.RawMessage(`{"feeds":{"x":{}}}`)},
+			{ID: "same", Type: "echo", UserID: "@same:hyrule", Config: json.RawMessage(`{}`)},
+		},
+	}
+
+	want := api.ConfigChanges{
+		AddedClients:    []id.UserID{"@added:hyrule"},
+		ChangedClients:  []id.UserID{"@changed:hyrule"},
+		RemovedClients:  []id.UserID{"@removed:hyrule"},
+		AddedServices:   []string{"added"},
+		ChangedServices: []string{"changed_config", "changed_user"},
+		RemovedServices: []string{"removed"},
+	}
+	if got := diffConfig(old, new); !reflect.DeepEqual(got, want) {
+		t.Errorf("TestDiffConfig: want %+v, got %+v", want, got)
+	}
+	if got := diffConfig(new, new); !reflect.DeepEqual(got, api.ConfigChanges{}) {
+		t.Errorf("TestDiffConfig: want no changes for the same config, got %+v", got)
+	}
+}
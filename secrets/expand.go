@@ -0,0 +1,43 @@
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// fileScheme prefixes values which are the path of a file holding the secret, e.g. a Docker or
+// Kubernetes secret mounted at "file:///run/secrets/github_token".
+const fileScheme = "file://"
+
+var envVarRegex = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// Expand resolves the references in a value from the config file when it is loaded. A value of
+// the form "file:///path" is replaced by the contents of the file, without a trailing newline.
+// A value which is just "${NAME}" is replaced by the environment variable NAME. Other values are
+// left alone, even if they contain "${", so that e.g. message templates and passwords which happen
+// to contain it needn't be escaped. Unlike references resolved by Resolve, these are only read
+// when the config file is loaded. Returns an error if a file can't be read or an environment
+// variable isn't set, so that a missing secret is noticed straight away.
+func Expand(value string) (string, error) {
+	if strings.HasPrefix(value, fileScheme) {
+		path := strings.TrimPrefix(value, fileScheme)
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %s", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+
+	m := envVarRegex.FindStringSubmatch(value)
+	if m == nil {
+		return value, nil
+	}
+	v, ok := os.LookupEnv(m[1])
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", m[1])
+	}
+	return v, nil
+}
@@ -0,0 +1,114 @@
+// Package secrets resolves references to secrets which are kept outside of Go-NEB's database and
+// config file, such as "vault:secret/data/go-neb#giphy_api_key".
+//
+// Values which don't start with the scheme of a registered Provider are returned unchanged, so
+// existing configurations which contain secrets inline keep working.
+package secrets
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultCacheDuration is how long a resolved secret is cached for if its Provider doesn't say.
+const DefaultCacheDuration = 5 * time.Minute
+
+// Provider fetches secrets from a secret store.
+type Provider interface {
+	// Fetch returns the secret for the reference, which is everything after "scheme:", along with
+	// how long it may be cached for. A zero duration means DefaultCacheDuration.
+	Fetch(ref string) (secret string, ttl time.Duration, err error)
+}
+
+type cached struct {
+	secret  string
+	expires time.Time
+}
+
+var (
+	mu        sync.Mutex
+	providers = make(map[string]Provider)
+	cache     = make(map[string]cached)
+)
+
+// Register a Provider for references of the form "scheme:ref". Registering a scheme again replaces
+// the Provider and forgets anything it has resolved.
+func Register(scheme string, p Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	providers[scheme] = p
+	forget(scheme)
+}
+
+// Unregister the Provider for a scheme, so values with that scheme are no longer resolved.
+func Unregister(scheme string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(providers, scheme)
+	forget(scheme)
+}
+
+// forget the cached secrets for a scheme. The caller must hold mu.
+func forget(scheme string) {
+	for value := range cache {
+		if strings.HasPrefix(value, scheme+":") {
+			delete(cache, value)
+		}
+	}
+}
+
+// IsReference returns true if the value refers to a secret held by a registered Provider.
+func IsReference(value string) bool {
+	_, _, p := lookup(value)
+	return p != nil
+}
+
+// Resolve returns the secret referred to by the value, or the value itself if it isn't a reference.
+//
+// Secrets are cached for as long as their Provider allows. If a Provider fails to fetch a secret
+// which has been resolved before, the expired secret is returned rather than an error so that a
+// secret store outage doesn't take down every service at once.
+func Resolve(value string) (string, error) {
+	scheme, ref, p := lookup(value)
+	if p == nil {
+		return value, nil
+	}
+
+	mu.Lock()
+	c, ok := cache[value]
+	mu.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.secret, nil
+	}
+
+	secret, ttl, err := p.Fetch(ref)
+	if err != nil {
+		if ok {
+			log.WithError(err).WithField("scheme", scheme).Warn("Failed to refresh secret, using cached value")
+			return c.secret, nil
+		}
+		return "", fmt.Errorf("failed to fetch %s secret: %s", scheme, err)
+	}
+	if ttl <= 0 || ttl > DefaultCacheDuration {
+		ttl = DefaultCacheDuration
+	}
+	mu.Lock()
+	cache[value] = cached{secret, time.Now().Add(ttl)}
+	mu.Unlock()
+	return secret, nil
+}
+
+func lookup(value string) (scheme, ref string, p Provider) {
+	i := strings.Index(value, ":")
+	if i <= 0 {
+		return "", "", nil
+	}
+	scheme, ref = value[:i], value[i+1:]
+	mu.Lock()
+	defer mu.Unlock()
+	return scheme, ref, providers[scheme]
+}
@@ -0,0 +1,164 @@
+package secrets
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeProvider struct {
+	secrets map[string]string
+	ttl     time.Duration
+	err     error
+	fetches int
+}
+
+func (p *fakeProvider) Fetch(ref string) (string, time.Duration, error) {
+	p.fetches++
+	if p.err != nil {
+		return "", 0, p.err
+	}
+	s, ok := p.secrets[ref]
+	if !ok {
+		return "", 0, errors.New("not found")
+	}
+	return s, p.ttl, nil
+}
+
+func TestResolve(t *testing.T) {
+	p := &fakeProvider{secrets: map[string]string{"api_key": "s3cret"}}
+	Register("fake", p)
+	defer Unregister("fake")
+
+	for value, want := range map[string]string{
+		"plain-api-key":           "plain-api-key",
+		"https://example.com/key": "https://example.com/key",
+		"fake:api_key":            "s3cret",
+	} {
+		got, err := Resolve(value)
+		if err != nil {
+			t.Fatalf("Resolve(%q) failed: %s", value, err)
+		}
+		if got != want {
+			t.Errorf("Resolve(%q) => %q, want %q", value, got, want)
+		}
+	}
+	if _, err := Resolve("fake:missing"); err == nil {
+		t.Error("Resolve of a missing secret succeeded, want error")
+	}
+
+	// cached, so the provider shouldn't be asked again
+	p.fetches = 0
+	if _, err := Resolve("fake:api_key"); err != nil || p.fetches != 0 {
+		t.Errorf("Resolve of a cached secret made %d fetches (err=%v), want 0", p.fetches, err)
+	}
+}
+
+func TestResolveUsesExpiredSecretOnError(t *testing.T) {
+	p := &fakeProvider{secrets: map[string]string{"api_key": "s3cret"}, ttl: time.Nanosecond}
+	Register("fake", p)
+	defer Unregister("fake")
+
+	if _, err := Resolve("fake:api_key"); err != nil {
+		t.Fatalf("Resolve failed: %s", err)
+	}
+	time.Sleep(time.Millisecond)
+	p.err = errors.New("vault is down")
+	got, err := Resolve("fake:api_key")
+	if err != nil || got != "s3cret" {
+		t.Errorf("Resolve during an outage => %q, %v, want the expired secret", got, err)
+	}
+	if p.fetches != 2 {
+		t.Errorf("Provider fetched %d times, want 2", p.fetches)
+	}
+}
+
+func TestVault(t *testing.T) {
+	var renewed bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(403)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		switch req.Method + " " + req.URL.Path {
+		case "GET /v1/secret/data/go-neb":
+			w.Write([]byte(`{"data":{"data":{"giphy":"kv2-key","google":"other"},"metadata":{"version":3}}}`))
+		case "GET /v1/kv/go-neb":
+			w.Write([]byte(`{"lease_duration":60,"data":{"token":"kv1-token"}}`))
+		case "GET /v1/auth/token/lookup-self":
+			w.Write([]byte(`{"data":{"ttl":3600,"renewable":true}}`))
+		case "POST /v1/auth/token/renew-self":
+			renewed = true
+			w.Write([]byte(`{"auth":{"lease_duration":7200,"renewable":true}}`))
+		default:
+			w.WriteHeader(404)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	defer srv.Close()
+	v := &Vault{Address: srv.URL, Token: "root"}
+
+	secret, _, err := v.Fetch("secret/data/go-neb#giphy")
+	if err != nil || secret != "kv2-key" {
+		t.Errorf("Fetch of a KV v2 secret => %q, %v, want kv2-key", secret, err)
+	}
+	secret, ttl, err := v.Fetch("kv/go-neb")
+	if err != nil || secret != "kv1-token" || ttl != time.Minute {
+		t.Errorf("Fetch of a KV v1 secret => %q, %s, %v, want kv1-token, 1m0s", secret, ttl, err)
+	}
+	if _, _, err = v.Fetch("secret/data/go-neb"); err == nil {
+		t.Error("Fetch of a secret with several keys and no #key succeeded, want error")
+	}
+	if _, _, err = v.Fetch("secret/data/missing#key"); err == nil {
+		t.Error("Fetch of a missing secret succeeded, want error")
+	}
+
+	ttl, err = v.RenewToken()
+	if err != nil || !renewed || ttl != 2*time.Hour {
+		t.Errorf("RenewToken => %s, %v (renewed=%v), want 2h0m0s", ttl, err, renewed)
+	}
+
+	v.Token = "wrong"
+	if _, _, err = v.Fetch("kv/go-neb"); err == nil {
+		t.Error("Fetch with a bad token succeeded, want error")
+	}
+}
+
+func TestExpand(t *testing.T) {
+	os.Setenv("GO_NEB_TEST_TOKEN", "s3cret")
+	defer os.Unsetenv("GO_NEB_TEST_TOKEN")
+	path := filepath.Join(t.TempDir(), "github_token")
+	if err := ioutil.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for value, want := range map[string]string{
+		"plain-api-key":                    "plain-api-key",
+		"https://example.com/key":          "https://example.com/key",
+		"pa$$word":                         "pa$$word",
+		"${GO_NEB_TEST_TOKEN}":             "s3cret",
+		"Bearer ${GO_NEB_TEST_TOKEN}":      "Bearer ${GO_NEB_TEST_TOKEN}",
+		"Hello ${user}, welcome":           "Hello ${user}, welcome",
+		"pa${ss":                           "pa${ss",
+		"${GO_NEB_TEST_UNSET} and more":    "${GO_NEB_TEST_UNSET} and more",
+		"file://" + path:                   "from-file",
+		"vault:secret/go-neb#github_token": "vault:secret/go-neb#github_token",
+	} {
+		got, err := Expand(value)
+		if err != nil || got != want {
+			t.Errorf("Expand(%q): want %q, got %q (err: %v)", value, want, got, err)
+		}
+	}
+
+	for _, value := range []string{"${GO_NEB_TEST_UNSET}", "file://" + path + ".missing"} {
+		if _, err := Expand(value); err == nil {
+			t.Errorf("Expand(%q): expected an error", value)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Vault is a Provider which reads secrets from a HashiCorp Vault KV secrets engine. Both version 1
+// and version 2 of the engine are supported. References are of the form "path#key", where path is
+// the full API path of the secret, e.g. "secret/data/go-neb#giphy_api_key" for a KV v2 engine
+// mounted at "secret/". If "#key" is omitted, the secret must have exactly one key.
+type Vault struct {
+	// The address of the Vault server, e.g. "https://vault.example.com:8200"
+	Address string
+	// The Vault token to authenticate with. Ignored if TokenFile is set.
+	Token string
+	// A file to read the Vault token from, e.g. one kept up to date by Vault Agent. It is read
+	// again on every request so that the token can be rotated without restarting Go-NEB.
+	TokenFile string
+	// The Vault Enterprise namespace to use, if any.
+	Namespace string
+	// The HTTP client to make requests with. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// NewVaultFromEnv returns a Vault configured from the standard VAULT_ADDR, VAULT_TOKEN and
+// VAULT_NAMESPACE environment variables, or VAULT_TOKEN_FILE in place of VAULT_TOKEN.
+func NewVaultFromEnv() (*Vault, error) {
+	v := &Vault{
+		Address:   strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/"),
+		Token:     os.Getenv("VAULT_TOKEN"),
+		TokenFile: os.Getenv("VAULT_TOKEN_FILE"),
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+	}
+	if v.Address == "" {
+		return nil, errors.New("VAULT_ADDR must be set")
+	}
+	if v.Token == "" && v.TokenFile == "" {
+		return nil, errors.New("VAULT_TOKEN or VAULT_TOKEN_FILE must be set")
+	}
+	return v, nil
+}
+
+type vaultSecret struct {
+	LeaseDuration int                    `json:"lease_duration"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		LeaseDuration int  `json:"lease_duration"`
+		Renewable     bool `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// Fetch a secret from Vault.
+func (v *Vault) Fetch(ref string) (string, time.Duration, error) {
+	path, key := ref, ""
+	if i := strings.LastIndex(ref, "#"); i != -1 {
+		path, key = ref[:i], ref[i+1:]
+	}
+	var res vaultSecret
+	if err := v.do("GET", path, &res); err != nil {
+		return "", 0, err
+	}
+	data := res.Data
+	// KV v2 wraps the secret's keys in data.data, alongside data.metadata.
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	if key == "" {
+		if len(data) != 1 {
+			return "", 0, fmt.Errorf("%s has %d keys, so the reference must end with #key", path, len(data))
+		}
+		for k := range data {
+			key = k
+		}
+	}
+	secret, ok := data[key].(string)
+	if !ok {
+		return "", 0, fmt.Errorf("%s has no string key %q", path, key)
+	}
+	return secret, time.Duration(res.LeaseDuration) * time.Second, nil
+}
+
+// RenewToken renews the Vault token, returning its new TTL. A TTL of zero means that the token
+// never expires, and so doesn't need renewing.
+func (v *Vault) RenewToken() (time.Duration, error) {
+	var lookup vaultSecret
+	if err := v.do("GET", "auth/token/lookup-self", &lookup); err != nil {
+		return 0, err
+	}
+	ttl, _ := lookup.Data["ttl"].(float64)
+	renewable, _ := lookup.Data["renewable"].(bool)
+	if ttl == 0 || !renewable {
+		return time.Duration(ttl) * time.Second, nil
+	}
+	var renew vaultSecret
+	if err := v.do("POST", "auth/token/renew-self", &renew); err != nil {
+		return 0, err
+	}
+	if renew.Auth == nil {
+		return 0, errors.New("renew-self response has no auth")
+	}
+	return time.Duration(renew.Auth.LeaseDuration) * time.Second, nil
+}
+
+// StartRenewing renews the Vault token in the background when half of its TTL has passed. Tokens
+// which are read from a TokenFile are not renewed, as whatever writes the file is responsible for
+// that.
+func (v *Vault) StartRenewing() {
+	if v.TokenFile != "" {
+		return
+	}
+	go func() {
+		for {
+			ttl, err := v.RenewToken()
+			if err != nil {
+				log.WithError(err).Error("Failed to renew Vault token")
+				time.Sleep(time.Minute)
+				continue
+			}
+			if ttl == 0 {
+				log.Info("Vault token does not expire or is not renewable, so it will not be renewed")
+				return
+			}
+			log.WithField("ttl", ttl).Info("Renewed Vault token")
+			time.Sleep(ttl / 2)
+		}
+	}()
+}
+
+func (v *Vault) token() (string, error) {
+	if v.TokenFile == "" {
+		return v.Token, nil
+	}
+	b, err := ioutil.ReadFile(v.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (v *Vault) do(method, path string, out *vaultSecret) error {
+	token, err := v.token()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, v.Address+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	cli := v.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	res, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil && res.StatusCode == 200 {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("vault returned HTTP %d for %s: %s", res.StatusCode, path, strings.Join(out.Errors, ", "))
+	}
+	return nil
+}
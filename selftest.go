@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/selftest"
+)
+
+const selfTestUsage = `Usage: go-neb selftest [--webhooks]
+
+Checks that the database can be reached and its schema is up to date, that each client's
+homeserver can be reached and accepts its access token, that each client's crypto store can be
+loaded, and that each realm can reach the APIs it uses. With --webhooks, also checks that a
+webhook request sent to BASE_URL reaches a running Go-NEB. The database and config file are
+given as for running Go-NEB. Prints the report as JSON, and exits with 1 if any check failed.
+`
+
+// runSelfTest runs the "selftest" subcommand with the given arguments, returning the exit code.
+func runSelfTest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), selfTestUsage)
+		fs.PrintDefaults()
+	}
+	databaseType := fs.String("database-type", os.Getenv("DATABASE_TYPE"), "The database type: 'sqlite3' or 'postgres'")
+	databaseURL := fs.String("database-url", os.Getenv("DATABASE_URL"), "The database URL or connection string")
+	configFile := fs.String("config-file", os.Getenv("CONFIG_FILE"), "The path to a YAML configuration file")
+	baseURL := fs.String("base-url", os.Getenv("BASE_URL"), "The public-facing base URL of Go-NEB")
+	webhooks := fs.Bool("webhooks", false, "Check that webhook requests sent to the base URL reach Go-NEB")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 || (*webhooks && *baseURL == "") {
+		fs.Usage()
+		return 2
+	}
+
+	if os.Getenv("VAULT_ADDR") != "" {
+		vault, err := secrets.NewVaultFromEnv()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to configure Vault: %s\n", err)
+			return 1
+		}
+		secrets.Register("vault", vault)
+	}
+
+	db, err := loadDatabase(*databaseType, *databaseURL, *configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open the database: %s\n", err)
+		return 1
+	}
+	if *configFile != "" {
+		cfg, err := loadFromConfig(db, *configFile)
+		if err == nil {
+			err = db.InsertFromConfig(cfg)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load the config file: %s\n", err)
+			return 1
+		}
+	}
+
+	opts := selftest.Options{
+		DB:      db,
+		Clients: clients.New(db, http.DefaultClient),
+	}
+	if *webhooks {
+		opts.WebhookBaseURL = *baseURL
+	}
+	report := selftest.Run(opts)
+	out, _ := json.MarshalIndent(report, "", "  ") // can't fail
+	fmt.Println(string(out))
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
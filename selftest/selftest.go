@@ -0,0 +1,151 @@
+// Package selftest checks that everything Go-NEB depends on is working, so that deploy pipelines
+// can tell whether a new instance is fit to use. The self-test is run by /admin/selftest and by the
+// "go-neb selftest" command.
+//
+// It checks that the database can be reached and its schema is up to date, that each client's
+// homeserver can be reached and accepts its access token, that each client's crypto store can be
+// loaded, and that each realm can reach the APIs it uses. Optionally, it checks that webhook
+// requests sent to the base URL reach Go-NEB.
+package selftest
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// The names of the checks.
+const (
+	CheckDatabase    = "database"
+	CheckClients     = "clients"
+	CheckHomeserver  = "homeserver"
+	CheckCryptoStore = "crypto_store"
+	CheckRealm       = "realm"
+	CheckWebhooks    = "webhooks"
+)
+
+// webhookProbePath is where the webhook probe is sent. "-" isn't a base64 service ID, so the
+// request is rejected before it could reach a service.
+const webhookProbePath = "services/hooks/-"
+
+// A Check is the outcome of checking one thing.
+type Check struct {
+	// What was checked, e.g. "homeserver".
+	Name string
+	// Which one was checked, e.g. the client's user ID or the realm's ID. Empty for checks of
+	// which there is only one.
+	Target string `json:",omitempty"`
+	OK     bool
+	// Why the check failed. Empty if it passed.
+	Error string `json:",omitempty"`
+}
+
+// A Report is the outcome of a self-test. It is OK if every check passed.
+type Report struct {
+	OK         bool
+	DurationMs int64
+	Checks     []Check
+}
+
+// Options are what the self-test checks.
+type Options struct {
+	DB      *database.ServiceDB
+	Clients *clients.Clients
+	// Optional. The base URL to send a webhook request to. If empty, webhooks aren't checked.
+	WebhookBaseURL string
+	// Optional. The client to send the webhook request with. Defaults to one with a 30s timeout.
+	HTTPClient *http.Client
+}
+
+// Run runs the self-test. Failed checks are logged as well as reported.
+func Run(opts Options) Report {
+	start := time.Now()
+	r := Report{OK: true}
+
+	version, latest, err := opts.DB.SchemaVersion()
+	if err == nil && version != latest {
+		err = fmt.Errorf("schema version is %d, expected %d", version, latest)
+	}
+	r.add(CheckDatabase, "", err)
+	if err != nil {
+		// Everything else is loaded from the database.
+		r.DurationMs = time.Since(start).Milliseconds()
+		return r
+	}
+
+	configs, err := opts.DB.LoadMatrixClientConfigs()
+	if err != nil {
+		r.add(CheckClients, "", err)
+	}
+	for _, config := range configs {
+		homeserver, cryptoStore := opts.Clients.SelfTest(config.UserID)
+		r.add(CheckHomeserver, config.UserID.String(), homeserver)
+		r.add(CheckCryptoStore, config.UserID.String(), cryptoStore)
+	}
+
+	for _, realmType := range types.AuthRealmTypes() {
+		realms, err := opts.DB.LoadAuthRealmsByType(realmType)
+		if err != nil {
+			r.add(CheckRealm, realmType, err)
+			continue
+		}
+		for _, realm := range realms {
+			if tester, ok := realm.(types.SelfTester); ok {
+				r.add(CheckRealm, realm.ID(), tester.SelfTest())
+			}
+		}
+	}
+
+	if opts.WebhookBaseURL != "" {
+		cli := opts.HTTPClient
+		if cli == nil {
+			cli = &http.Client{Timeout: 30 * time.Second}
+		}
+		r.add(CheckWebhooks, "", probeWebhooks(cli, opts.WebhookBaseURL))
+	}
+
+	r.DurationMs = time.Since(start).Milliseconds()
+	return r
+}
+
+func (r *Report) add(name, target string, err error) {
+	c := Check{Name: name, Target: target, OK: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+		r.OK = false
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"check":      name,
+			"target":     target,
+		}).Warn("Self-test check failed")
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// probeWebhooks sends a webhook request to the base URL, and checks that Go-NEB answered it by
+// looking for the request's correlation ID in the response.
+func probeWebhooks(cli *http.Client, baseURL string) error {
+	u := strings.TrimSuffix(baseURL, "/") + "/" + webhookProbePath
+	req, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		return err
+	}
+	correlationID := logging.NewCorrelationID()
+	req.Header.Set(logging.RequestIDHeader, correlationID)
+	res, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.Header.Get(logging.RequestIDHeader) != correlationID {
+		return fmt.Errorf("%s returned HTTP %d without the request's correlation ID, so it isn't Go-NEB", u, res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package selftest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestRun(t *testing.T) {
+	db, err := database.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	report := Run(Options{DB: db, Clients: clients.New(db, http.DefaultClient)})
+	if !report.OK || len(report.Checks) != 1 || report.Checks[0].Name != CheckDatabase || !report.Checks[0].OK {
+		t.Errorf("Run with an empty database: want only a passing database check, got %+v", report)
+	}
+}
+
+func TestProbeWebhooks(t *testing.T) {
+	goneb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/services/hooks/-" {
+			t.Errorf("probe sent to %s", req.URL.Path)
+		}
+		w.Header().Set(logging.RequestIDHeader, logging.RequestCorrelationID(req))
+		w.WriteHeader(400)
+	}))
+	defer goneb.Close()
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+
+	if err := probeWebhooks(goneb.Client(), goneb.URL+"/"); err != nil {
+		t.Errorf("probeWebhooks(Go-NEB): %s", err)
+	}
+	if err := probeWebhooks(other.Client(), other.URL); err == nil {
+		t.Error("probeWebhooks(not Go-NEB): expected an error")
+	}
+}
@@ -7,10 +7,13 @@ import (
 	"fmt"
 	html "html/template"
 	"net/http"
+	"sort"
 	"strings"
 	text "text/template"
 
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/go-neb/services/utils"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
@@ -32,13 +35,31 @@ const ServiceType = "alertmanager"
 //
 // You can set msg_type to either m.text or m.notice
 //
+// The templates are optional. Rooms without a text_template are sent a summary of the alerts,
+// formatted according to the room's "format" bot option, and msg_type defaults to m.notice.
+//
+// In rooms with edit_resolved set, a message about firing alerts is edited to strike it through
+// once all of its alerts have resolved, and resolutions of those alerts aren't sent as messages
+// of their own. This keeps rooms readable during alert storms. Alerts are tracked by their
+// fingerprint, which Alertmanager sends from version 0.19.
+//
+// To stop an alert storm burying a room, or hitting the homeserver's rate limits, notifications
+// received within group_window_secs of the first are combined into a single message. Rooms with
+// max_messages_per_minute set are sent at most that many messages a minute; the alerts which
+// would have been sent beyond that are summarised once the minute is up, e.g. "...and 27 more
+// alerts".
+//
 // Example JSON request:
 //    {
 //        rooms: {
 //            "!ewfug483gsfe:localhost": {
 //                "text_template": "your plain text template goes here",
 //                "html_template": "your html template goes here",
-//                "msg_type": "m.text"
+//                "msg_type": "m.text",
+//                "mention_room": true,
+//                "edit_resolved": true,
+//                "group_window_secs": 30,
+//                "max_messages_per_minute": 5
 //            },
 //        }
 //    }
@@ -47,12 +68,34 @@ type Service struct {
 	webhookEndpointURL string
 	// The URL which should be added to alertmanagers config - Populated by Go-NEB after Service registration.
 	WebhookURL string `json:"webhook_url"`
-	// A map of matrix rooms to templates
-	Rooms map[id.RoomID]struct {
-		TextTemplate string           `json:"text_template"`
-		HTMLTemplate string           `json:"html_template"`
-		MsgType      mevt.MessageType `json:"msg_type"`
-	} `json:"rooms"`
+	// A map of matrix rooms to templates. A room may be a Space or a
+	// label such as "label:backend-teams", see utils.ResolveRooms. The
+	// templates may be left empty to use the default formatting.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+	// Optional. Create a room to send alerts into if no rooms are configured.
+	utils.RoomCreation
+
+	// Internal: the messages about alerts which are still firing, in rooms with edit_resolved
+	// set. This is populated by Go-NEB.
+	FiringMessages []FiringMessage `json:"firing_messages,omitempty"`
+}
+
+// RoomConfig is how alerts are sent into a room.
+type RoomConfig struct {
+	TextTemplate string           `json:"text_template"`
+	HTMLTemplate string           `json:"html_template"`
+	MsgType      mevt.MessageType `json:"msg_type"`
+	// True to mention everyone in the room with "@room" when alerts with a "critical"
+	// severity label fire. Mentions are limited by the client's RoomMentionCooldown.
+	MentionRoom bool `json:"mention_room"`
+	// True to edit messages about firing alerts once they have resolved, rather than
+	// sending the resolution as a new message.
+	EditResolved bool `json:"edit_resolved"`
+	// Optional. How many seconds to wait after a notification for others to combine it with,
+	// at most maxGroupWindowSecs. By default notifications are sent straight away.
+	GroupWindowSecs int `json:"group_window_secs"`
+	// Optional. The most messages to send into the room a minute. By default there is no limit.
+	MaxMessagesPerMinute int `json:"max_messages_per_minute"`
 }
 
 // WebhookNotification is the payload from Alertmanager
@@ -72,16 +115,18 @@ type WebhookNotification struct {
 		StartsAt     string            `json:"startsAt"`
 		EndsAt       string            `json:"endsAt"`
 		GeneratorURL string            `json:"generatorURL"`
+		Fingerprint  string            `json:"fingerprint"`
 		SilenceURL   string
 	} `json:"alerts"`
 }
 
 // OnReceiveWebhook receives requests from Alertmanager and sends requests to Matrix as a result.
 func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	logger := logging.FromContext(req.Context())
 	decoder := json.NewDecoder(req.Body)
 	var notif WebhookNotification
 	if err := decoder.Decode(&notif); err != nil {
-		log.WithError(err).Error("Alertmanager webhook received an invalid JSON payload")
+		logger.WithError(err).Error("Alertmanager webhook received an invalid JSON payload")
 		w.WriteHeader(400)
 		return
 	}
@@ -98,13 +143,27 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 		alert.SilenceURL = fmt.Sprintf("%s#silences/new?filter={%s}", notif.ExternalURL, strings.Join(filters, ","))
 	}
 
+	critical := isCritical(notif)
+	tracker := s.trackAlerts(notif)
+	defer tracker.store()
 	for roomID, templates := range s.Rooms {
-		var msg interface{}
+		mentionRoom := templates.MentionRoom && critical
+		if templates.TextTemplate == "" {
+			n := notification(notif)
+			n.MsgType = templates.MsgType
+			for _, toRoomID := range utils.ResolveRooms(cli, s.ServiceUserID(), roomID) {
+				msg := n.Render(utils.RoomFormat(s.ServiceUserID(), toRoomID))
+				s.deliver(cli, tracker, toRoomID, templates, msg, mentionRoom, len(notif.Alerts))
+			}
+			continue
+		}
+
+		var msg mevt.MessageEventContent
 		// we don't check whether the templates parse because we already did when storing them in the db
 		textTemplate, _ := text.New("textTemplate").Parse(templates.TextTemplate)
 		var bodyBuffer bytes.Buffer
 		if err := textTemplate.Execute(&bodyBuffer, notif); err != nil {
-			log.WithError(err).Error("Alertmanager webhook failed to execute text template")
+			logger.WithError(err).Error("Alertmanager webhook failed to execute text template")
 			w.WriteHeader(500)
 			return
 		}
@@ -113,7 +172,7 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 			htmlTemplate, _ := html.New("htmlTemplate").Parse(templates.HTMLTemplate)
 			var formattedBodyBuffer bytes.Buffer
 			if err := htmlTemplate.Execute(&formattedBodyBuffer, notif); err != nil {
-				log.WithError(err).Error("Alertmanager webhook failed to execute HTML template")
+				logger.WithError(err).Error("Alertmanager webhook failed to execute HTML template")
 				w.WriteHeader(500)
 				return
 			}
@@ -130,25 +189,123 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 			}
 		}
 
-		log.WithFields(log.Fields{
-			"message": msg,
-			"room_id": roomID,
-		}).Print("Sending Alertmanager notification to room")
-		if _, e := cli.SendMessageEvent(roomID, mevt.EventMessage, msg); e != nil {
-			log.WithError(e).WithField("room_id", roomID).Print(
-				"Failed to send Alertmanager notification to room.")
+		for _, toRoomID := range utils.ResolveRooms(cli, s.ServiceUserID(), roomID) {
+			s.deliver(cli, tracker, toRoomID, templates, msg, mentionRoom, len(notif.Alerts))
 		}
 	}
 	w.WriteHeader(200)
 }
 
+// notifyRoom sends the message into the room, returning its event ID or "" if it wasn't sent.
+func (s *Service) notifyRoom(cli types.MatrixClient, roomID id.RoomID, msg interface{}) id.EventID {
+	log.WithFields(log.Fields{
+		"message": msg,
+		"room_id": roomID,
+	}).Print("Sending Alertmanager notification to room")
+	resp, e := cli.SendMessageEvent(roomID, mevt.EventMessage, msg)
+	if e != nil {
+		log.WithError(e).WithField("room_id", roomID).Print(
+			"Failed to send Alertmanager notification to room.")
+		return ""
+	}
+	return resp.EventID
+}
+
+// isCritical returns true if any of the firing alerts have a "critical" severity.
+func isCritical(notif WebhookNotification) bool {
+	for _, alert := range notif.Alerts {
+		if alert.Status != "resolved" && alert.Labels["severity"] == "critical" {
+			return true
+		}
+	}
+	return false
+}
+
+// notification summarises the alerts for rooms without templates, e.g.
+//   [receiver] FIRING:2: Disk is nearly full - http://alertmanager
+//   FIRING: DiskFull (instance=db1:9100) - Disk is nearly full
+//   FIRING: DiskFull (instance=db2:9100) - Disk is nearly full
+func notification(notif WebhookNotification) *utils.Notification {
+	var firing int
+	var lines []string
+	for _, alert := range notif.Alerts {
+		if alert.Status != "resolved" {
+			firing++
+		}
+		line := strings.ToUpper(alert.Status) + ": " + alert.Labels["alertname"]
+		if instance := alert.Labels["instance"]; instance != "" {
+			line += " (instance=" + instance + ")"
+		}
+		if summary := alertSummary(alert.Annotations); summary != "" {
+			line += " - " + summary
+		}
+		lines = append(lines, strings.TrimPrefix(line, ": "))
+	}
+
+	status := utils.Span{Text: "RESOLVED", Bold: true, Color: "green"}
+	if notif.Status != "resolved" {
+		status = utils.Span{Text: fmt.Sprintf("FIRING:%d", firing), Bold: true, Color: "red"}
+	}
+	n := &utils.Notification{
+		Source:      notif.Receiver,
+		Summary:     []utils.Span{status},
+		Title:       alertSummary(notif.CommonAnnotations),
+		URL:         notif.ExternalURL,
+		Lines:       lines,
+		Description: notif.CommonAnnotations["description"],
+	}
+	if n.Source == "" {
+		n.Source = "alertmanager"
+	}
+	if n.Title == "" {
+		n.Title = notif.CommonLabels["alertname"]
+	}
+	if n.Title == n.Description {
+		n.Description = ""
+	}
+	if len(notif.CommonLabels) > 0 {
+		var labels []string
+		for name, val := range notif.CommonLabels {
+			labels = append(labels, name+"="+val)
+		}
+		sort.Strings(labels)
+		n.Fields = []utils.Field{{Name: "Labels", Value: strings.Join(labels, ", ")}}
+	}
+	return n
+}
+
+// alertSummary returns the "summary" annotation, falling back to the "description".
+func alertSummary(annotations map[string]string) string {
+	if summary := annotations["summary"]; summary != "" {
+		return summary
+	}
+	return annotations["description"]
+}
+
 // Register makes sure the Config information supplied is valid.
 func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
 	s.WebhookURL = s.webhookEndpointURL
-	for _, templates := range s.Rooms {
-		// validate that we have at least a plain text template
+	var oldRooms *utils.RoomCreation
+	if old, ok := oldService.(*Service); ok {
+		oldRooms = &old.RoomCreation
+	}
+	roomID, err := s.CreateMissingRoom(client, s.ServiceUserID(), s.Owner, len(s.Rooms) > 0, oldRooms)
+	if err != nil {
+		return fmt.Errorf("failed to create room: %s", err)
+	}
+	if roomID != "" {
+		s.Rooms = map[id.RoomID]RoomConfig{roomID: {}}
+	}
+	for roomID, templates := range s.Rooms {
 		if templates.TextTemplate == "" {
-			return fmt.Errorf("plain text template missing")
+			// the default formatting is used, which can't have an html template
+			if templates.HTMLTemplate != "" {
+				return fmt.Errorf("plain text template missing")
+			}
+			if templates.MsgType == "" {
+				templates.MsgType = mevt.MsgNotice
+				s.Rooms[roomID] = templates
+			}
 		}
 
 		// validate the plain text template is valid
@@ -168,6 +325,16 @@ func (s *Service) Register(oldService types.Service, client types.MatrixClient)
 		if templates.MsgType != "m.notice" && templates.MsgType != "m.text" {
 			return fmt.Errorf("msg_type is neither 'm.notice' nor 'm.text'")
 		}
+		if templates.GroupWindowSecs < 0 || templates.GroupWindowSecs > maxGroupWindowSecs {
+			return fmt.Errorf("group_window_secs must be between 0 and %d", maxGroupWindowSecs)
+		}
+		if templates.MaxMessagesPerMinute < 0 {
+			return fmt.Errorf("max_messages_per_minute must not be negative")
+		}
+	}
+	// Keep tracking firing alerts, so that reconfiguring doesn't stop their messages being edited.
+	if old, ok := oldService.(*Service); ok {
+		s.FiringMessages = old.FiringMessages
 	}
 	s.joinRooms(client)
 	return nil
@@ -190,8 +357,20 @@ func (s *Service) PostRegister(oldService types.Service) {
 	}
 }
 
+// TargetRooms returns the rooms alerts are sent into.
+func (s *Service) TargetRooms() []id.RoomID {
+	roomIDs := make([]id.RoomID, 0, len(s.Rooms))
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
 func (s *Service) joinRooms(client types.MatrixClient) {
 	for roomID := range s.Rooms {
+		if utils.IsLabel(roomID) {
+			continue // labelled rooms are joined by the service which labels them
+		}
 		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
 			log.WithFields(log.Fields{
 				log.ErrorKey: err,
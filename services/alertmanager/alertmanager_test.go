@@ -11,6 +11,7 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/testutils"
@@ -183,3 +184,197 @@ func checkSilenceLine(t *testing.T, line string, expectedKeys map[string]string)
 		t.Errorf("number of filter fields got %d, want %d", matched, len(expectedKeys))
 	}
 }
+
+func TestNotifyDefaultFormat(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	msgs := []mevt.MessageEventContent{}
+	matrixCli := buildTestClient(&msgs)
+
+	srv, err := types.CreateService("id", "alertmanager", "@neb:hs", []byte(`{
+		"rooms":{ "!testroom:id" : {} }
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Register defaults the msgtype
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(
+		"POST", "", bytes.NewBufferString(`
+			{
+				"receiver": "ops",
+				"status": "firing",
+				"externalURL": "http://alertmanager",
+				"commonLabels": {"alertname": "DiskFull"},
+				"commonAnnotations": {"summary": "Disk is nearly full"},
+				"alerts": [
+					{"status": "firing", "labels": {"alertname": "DiskFull", "instance": "db1"}},
+					{"status": "resolved", "labels": {"alertname": "DiskFull", "instance": "db2"}}
+				]
+			}
+		`),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create webhook request: %s", err)
+	}
+	mockWriter := httptest.NewRecorder()
+	srv.OnReceiveWebhook(mockWriter, req, matrixCli)
+
+	if mockWriter.Code != 200 {
+		t.Fatalf("Expected response 200 OK, got %d", mockWriter.Code)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("Expected sent 1 msgs, sent %d", len(msgs))
+	}
+	want := "[ops] FIRING:1: Disk is nearly full - http://alertmanager\n" +
+		"FIRING: DiskFull (instance=db1)\n" +
+		"RESOLVED: DiskFull (instance=db2)"
+	if msgs[0].Body != want {
+		t.Errorf("Wrong body: got\n%s\nwant\n%s", msgs[0].Body, want)
+	}
+	if msgs[0].MsgType != mevt.MsgNotice {
+		t.Errorf("Wrong msgtype: got %s want m.notice", msgs[0].MsgType)
+	}
+	if !strings.Contains(msgs[0].FormattedBody, `<b><font color="red">FIRING:1</font></b>`) {
+		t.Errorf("Expected the status in red, got %s", msgs[0].FormattedBody)
+	}
+}
+
+func TestEditResolved(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	msgs := []mevt.MessageEventContent{}
+	matrixCli := buildTestClient(&msgs)
+
+	srv, err := types.CreateService("id", "alertmanager", "@neb:hs", []byte(`{
+		"rooms":{ "!testroom:id" : {"edit_resolved": true} }
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal(err)
+	}
+	notify := func(status string, alerts ...string) {
+		req, err := http.NewRequest("POST", "", bytes.NewBufferString(fmt.Sprintf(`{
+			"status": %q,
+			"commonLabels": {"alertname": "DiskFull"},
+			"alerts": [%s]
+		}`, status, strings.Join(alerts, ","))))
+		if err != nil {
+			t.Fatalf("Failed to create webhook request: %s", err)
+		}
+		mockWriter := httptest.NewRecorder()
+		srv.OnReceiveWebhook(mockWriter, req, matrixCli)
+		if mockWriter.Code != 200 {
+			t.Fatalf("Expected response 200 OK, got %d", mockWriter.Code)
+		}
+	}
+	alert := func(status, fingerprint string) string {
+		return fmt.Sprintf(`{"status": %q, "fingerprint": %q, "labels": {"alertname": "DiskFull"}}`, status, fingerprint)
+	}
+
+	notify("firing", alert("firing", "db1"), alert("firing", "db2"))
+	if len(msgs) != 1 {
+		t.Fatalf("Expected the firing alerts to be sent, sent %d msgs", len(msgs))
+	}
+
+	// The message is only edited once both of its alerts have resolved.
+	notify("resolved", alert("resolved", "db1"))
+	if len(msgs) != 1 {
+		t.Fatalf("Expected no message while an alert is still firing, got %+v", msgs[1:])
+	}
+	notify("resolved", alert("resolved", "db2"))
+	if len(msgs) != 2 {
+		t.Fatalf("Expected the firing message to be edited, sent %d msgs", len(msgs))
+	}
+	edit := msgs[1]
+	if edit.RelatesTo == nil || edit.RelatesTo.Type != mevt.RelReplace || edit.RelatesTo.EventID != "$yup:event" {
+		t.Errorf("Expected an edit of the firing message, got %+v", edit.RelatesTo)
+	}
+	if edit.NewContent == nil || !strings.Contains(edit.NewContent.Body, "\nRESOLVED at ") ||
+		!strings.HasPrefix(edit.NewContent.FormattedBody, "<del>") {
+		t.Errorf("Expected the edit to strike through the message, got %+v", edit.NewContent)
+	}
+	if n := len(srv.(*Service).FiringMessages); n != 0 {
+		t.Errorf("Expected the resolved message to no longer be tracked, have %d", n)
+	}
+
+	// Resolutions of alerts which weren't tracked are sent as usual.
+	notify("resolved", alert("resolved", "db3"))
+	if len(msgs) != 3 || msgs[2].RelatesTo != nil {
+		t.Errorf("Expected the untracked resolution to be sent, got %+v", msgs[2:])
+	}
+}
+
+func TestFloodControl(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	now := time.Now()
+	var scheduled []func()
+	floods = newFloodControl()
+	floods.now = func() time.Time { return now }
+	floods.after = func(d time.Duration, f func()) { scheduled = append(scheduled, f) }
+	defer func() { floods = newFloodControl() }()
+	runScheduled := func() {
+		fns := scheduled
+		scheduled = nil
+		for _, f := range fns {
+			f()
+		}
+	}
+
+	msgs := []mevt.MessageEventContent{}
+	matrixCli := buildTestClient(&msgs)
+	srv, err := types.CreateService("id", "alertmanager", "@neb:hs", []byte(`{
+		"rooms":{
+			"!grouped:id" : {"group_window_secs": 30},
+			"!limited:id" : {"max_messages_per_minute": 2}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal(err)
+	}
+	notify := func(alertname string) {
+		req, err := http.NewRequest("POST", "", bytes.NewBufferString(fmt.Sprintf(`{
+			"status": "firing",
+			"commonLabels": {"alertname": %q},
+			"alerts": [{"status": "firing"}, {"status": "firing"}]
+		}`, alertname)))
+		if err != nil {
+			t.Fatalf("Failed to create webhook request: %s", err)
+		}
+		srv.OnReceiveWebhook(httptest.NewRecorder(), req, matrixCli)
+	}
+
+	for _, alertname := range []string{"DiskFull", "HighLoad", "NodeDown", "OutOfMemory"} {
+		notify(alertname)
+	}
+	// The limited room is sent the first 2 notifications straight away.
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 msgs within the limit, sent %d", len(msgs))
+	}
+
+	now = now.Add(time.Minute)
+	runScheduled()
+	if len(msgs) != 4 {
+		t.Fatalf("Expected the grouped notifications and the summary to be sent, sent %d msgs", len(msgs))
+	}
+	var grouped, summary bool
+	for _, msg := range msgs[2:] {
+		switch {
+		case msg.Body == "...and 4 more alerts":
+			summary = true
+		case strings.Count(msg.Body, "FIRING:2") == 4:
+			grouped = true
+		}
+	}
+	if !grouped || !summary {
+		t.Errorf("Expected a message with all 4 notifications and a summary of 4 alerts, got %+v", msgs[2:])
+	}
+}
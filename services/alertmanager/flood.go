@@ -0,0 +1,204 @@
+package alertmanager
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The longest a room's group_window_secs can be, so that alerts aren't held back for too long.
+const maxGroupWindowSecs = 600
+
+// floods limits the messages sent into each room by each service.
+var floods = newFloodControl()
+
+// pendingMessage is a notification's message which hasn't been sent yet.
+type pendingMessage struct {
+	content mevt.MessageEventContent
+	mention bool
+	// The fingerprints of the firing alerts to track, if the room has edit_resolved set.
+	fingerprints []string
+	// How many alerts the notification was about.
+	alerts int
+}
+
+type floodKey struct {
+	serviceID string
+	roomID    id.RoomID
+}
+
+// roomFlood is the state of a room's group window and message limit.
+type roomFlood struct {
+	// The messages waiting for the group window to end.
+	pending []pendingMessage
+	// When messages were sent in the last minute.
+	sent []time.Time
+	// How many alerts weren't sent because the limit was reached, and whether the summary of
+	// them is scheduled.
+	dropped        int
+	summaryPending bool
+}
+
+// floodControl groups the notifications for each room and limits how many messages are sent.
+// Its state is in memory, as it only covers the next few minutes.
+type floodControl struct {
+	mu    sync.Mutex
+	rooms map[floodKey]*roomFlood
+	now   func() time.Time
+	// after calls the function after the duration, in another goroutine.
+	after func(time.Duration, func())
+}
+
+func newFloodControl() *floodControl {
+	return &floodControl{
+		rooms: make(map[floodKey]*roomFlood),
+		now:   time.Now,
+		after: func(d time.Duration, f func()) { time.AfterFunc(d, f) },
+	}
+}
+
+// deliver sends a notification's message into the room, according to the room's config: it may
+// be dropped if it is about alerts which have resolved, or be delayed, combined with others or
+// summarised to stop the room being flooded.
+func (s *Service) deliver(cli types.MatrixClient, tracker *alertTracker, roomID id.RoomID, room RoomConfig,
+	content mevt.MessageEventContent, mention bool, alerts int) {
+
+	var fingerprints []string
+	if room.EditResolved {
+		if tracker.resolve(cli, roomID) {
+			return
+		}
+		fingerprints = tracker.firing
+	}
+	p := pendingMessage{content: content, mention: mention, fingerprints: fingerprints, alerts: alerts}
+	if room.GroupWindowSecs <= 0 && room.MaxMessagesPerMinute <= 0 {
+		tracker.track(roomID, s.notifyRoom(cli, roomID, p.message()), content, fingerprints)
+		return
+	}
+	if floods.add(s, cli, roomID, room, p) {
+		tracker.track(roomID, s.notifyRoom(cli, roomID, p.message()), content, fingerprints)
+	}
+}
+
+// add groups or limits the message. Returns true if it should be sent now.
+func (fc *floodControl) add(s *Service, cli types.MatrixClient, roomID id.RoomID, room RoomConfig, p pendingMessage) bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	key := floodKey{s.ServiceID(), roomID}
+	rf := fc.rooms[key]
+	if rf == nil {
+		rf = &roomFlood{}
+		fc.rooms[key] = rf
+	}
+	if room.GroupWindowSecs > 0 {
+		rf.pending = append(rf.pending, p)
+		if len(rf.pending) == 1 {
+			fc.after(time.Duration(room.GroupWindowSecs)*time.Second, func() {
+				fc.flush(s, cli, roomID, room)
+			})
+		}
+		return false
+	}
+	return fc.allow(s, cli, key, rf, room, p.alerts)
+}
+
+// flush sends the messages which were waiting for the room's group window to end as one message.
+func (fc *floodControl) flush(s *Service, cli types.MatrixClient, roomID id.RoomID, room RoomConfig) {
+	fc.mu.Lock()
+	key := floodKey{s.ServiceID(), roomID}
+	rf := fc.rooms[key]
+	if rf == nil || len(rf.pending) == 0 {
+		fc.mu.Unlock()
+		return
+	}
+	p := combine(rf.pending)
+	rf.pending = nil
+	allowed := fc.allow(s, cli, key, rf, room, p.alerts)
+	fc.mu.Unlock()
+
+	if allowed {
+		s.trackSent(roomID, s.notifyRoom(cli, roomID, p.message()), p.content, p.fingerprints)
+	}
+}
+
+// allow returns true if a message can be sent into the room, recording that it was. Otherwise the
+// message's alerts are counted for the summary, which is sent once the room's limit allows.
+// The caller must hold fc.mu.
+func (fc *floodControl) allow(s *Service, cli types.MatrixClient, key floodKey, rf *roomFlood, room RoomConfig, alerts int) bool {
+	now := fc.now()
+	// Forget the messages which no longer count towards the limit.
+	recent := rf.sent[:0]
+	for _, t := range rf.sent {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	rf.sent = recent
+	if room.MaxMessagesPerMinute <= 0 || len(rf.sent) < room.MaxMessagesPerMinute {
+		rf.sent = append(rf.sent, now)
+		return true
+	}
+	rf.dropped += alerts
+	if !rf.summaryPending {
+		rf.summaryPending = true
+		fc.after(rf.sent[0].Add(time.Minute).Sub(now), func() {
+			fc.summarise(s, cli, key, room)
+		})
+	}
+	return false
+}
+
+// summarise sends the summary of the alerts which weren't sent because the room's limit was
+// reached.
+func (fc *floodControl) summarise(s *Service, cli types.MatrixClient, key floodKey, room RoomConfig) {
+	fc.mu.Lock()
+	rf := fc.rooms[key]
+	if rf == nil {
+		fc.mu.Unlock()
+		return
+	}
+	dropped := rf.dropped
+	rf.dropped = 0
+	rf.summaryPending = false
+	rf.sent = append(rf.sent, fc.now())
+	fc.mu.Unlock()
+
+	if dropped == 0 {
+		return
+	}
+	noun := "alerts"
+	if dropped == 1 {
+		noun = "alert"
+	}
+	s.notifyRoom(cli, key.roomID, mevt.MessageEventContent{
+		MsgType: room.MsgType,
+		Body:    fmt.Sprintf("...and %d more %s", dropped, noun),
+	})
+}
+
+// message returns the JSON encodable content to send.
+func (p pendingMessage) message() interface{} {
+	return matrix.MentionRoomMessage{MessageEventContent: p.content, MentionRoom: p.mention}
+}
+
+// combine returns the messages as one message, which mentions the room if any of them do. The
+// result is HTML if any of the messages are.
+func combine(msgs []pendingMessage) pendingMessage {
+	combined := msgs[0]
+	for _, p := range msgs[1:] {
+		if combined.content.Format == mevt.FormatHTML || p.content.Format == mevt.FormatHTML {
+			combined.content.FormattedBody = htmlBody(combined.content) + "<br>" + htmlBody(p.content)
+			combined.content.Format = mevt.FormatHTML
+		}
+		combined.content.Body += "\n" + p.content.Body
+		combined.mention = combined.mention || p.mention
+		combined.fingerprints = append(append([]string{}, combined.fingerprints...), p.fingerprints...)
+		combined.alerts += p.alerts
+	}
+	return combined
+}
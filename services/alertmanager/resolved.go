@@ -0,0 +1,200 @@
+package alertmanager
+
+import (
+	"html"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// How long a message about firing alerts is tracked for. Alerts which haven't resolved by then,
+// e.g. because their rule was deleted, are forgotten so that the list doesn't grow forever.
+const maxFiringAge = 7 * 24 * time.Hour
+
+// storeMutex serialises loading, modifying and storing the firing messages, as Alertmanager may
+// send several webhooks at once.
+var storeMutex sync.Mutex
+
+// A FiringMessage is a message about firing alerts, which is edited once they have all resolved.
+type FiringMessage struct {
+	RoomID     id.RoomID  `json:"room_id"`
+	EventID    id.EventID `json:"event_id"`
+	SentAtSecs int64      `json:"sent_at_secs"`
+	// The fingerprints of the alerts in the message which are still firing.
+	Fingerprints []string `json:"fingerprints"`
+	// The content of the message, which the edit strikes through.
+	Content mevt.MessageEventContent `json:"content"`
+}
+
+// alertTracker updates the firing messages for a webhook notification. It holds storeMutex
+// until store is called.
+type alertTracker struct {
+	service *Service
+	now     time.Time
+	// The fingerprints of the notification's firing and resolved alerts.
+	firing   []string
+	resolved []string
+	// True if some of the notification's alerts don't have a fingerprint, so can't be tracked.
+	untracked bool
+	changed   bool
+}
+
+// newTracker returns a tracker working on the stored copy of the service.
+func (s *Service) newTracker() *alertTracker {
+	storeMutex.Lock()
+	return &alertTracker{service: s.load(), now: time.Now()}
+}
+
+// trackAlerts returns a tracker for the notification.
+func (s *Service) trackAlerts(notif WebhookNotification) *alertTracker {
+	t := s.newTracker()
+	for _, alert := range notif.Alerts {
+		switch {
+		case alert.Fingerprint == "":
+			t.untracked = true
+		case alert.Status == "resolved":
+			t.resolved = append(t.resolved, alert.Fingerprint)
+		default:
+			t.firing = append(t.firing, alert.Fingerprint)
+		}
+	}
+	return t
+}
+
+// resolve edits the room's messages whose alerts have all resolved, and stops tracking them.
+// Returns true if the notification doesn't need to be sent into the room, because it is only
+// about resolved alerts which were all in messages in the room.
+func (t *alertTracker) resolve(cli types.MatrixClient, roomID id.RoomID) bool {
+	inMessage := make(map[string]bool, len(t.resolved))
+	var remaining []FiringMessage
+	for _, m := range t.service.FiringMessages {
+		if m.RoomID != roomID {
+			remaining = append(remaining, m)
+			continue
+		}
+		var stillFiring []string
+		for _, fp := range m.Fingerprints {
+			if contains(t.resolved, fp) {
+				inMessage[fp] = true
+			} else {
+				stillFiring = append(stillFiring, fp)
+			}
+		}
+		if len(stillFiring) != len(m.Fingerprints) {
+			t.changed = true
+		}
+		if len(stillFiring) == 0 {
+			t.edit(cli, m)
+			continue
+		}
+		m.Fingerprints = stillFiring
+		remaining = append(remaining, m)
+	}
+	t.service.FiringMessages = remaining
+	return len(t.firing) == 0 && !t.untracked && len(t.resolved) > 0 && len(inMessage) == len(t.resolved)
+}
+
+// track remembers the message sent into the room, if it is about firing alerts.
+func (t *alertTracker) track(roomID id.RoomID, eventID id.EventID, content mevt.MessageEventContent, fingerprints []string) {
+	if eventID == "" || len(fingerprints) == 0 {
+		return
+	}
+	t.service.FiringMessages = append(t.service.FiringMessages, FiringMessage{
+		RoomID:       roomID,
+		EventID:      eventID,
+		SentAtSecs:   t.now.Unix(),
+		Fingerprints: fingerprints,
+		Content:      content,
+	})
+	t.changed = true
+}
+
+// trackSent remembers a message which was sent after the notifications in it were received.
+func (s *Service) trackSent(roomID id.RoomID, eventID id.EventID, content mevt.MessageEventContent, fingerprints []string) {
+	t := s.newTracker()
+	defer t.store()
+	t.track(roomID, eventID, content, fingerprints)
+}
+
+// store stores the service if the firing messages changed, and releases storeMutex.
+func (t *alertTracker) store() {
+	defer storeMutex.Unlock()
+	var remaining []FiringMessage
+	for _, m := range t.service.FiringMessages {
+		if t.now.Sub(time.Unix(m.SentAtSecs, 0)) < maxFiringAge {
+			remaining = append(remaining, m)
+		} else {
+			t.changed = true
+		}
+	}
+	t.service.FiringMessages = remaining
+	if !t.changed {
+		return
+	}
+	if _, err := database.GetServiceDB().StoreService(t.service); err != nil {
+		log.WithError(err).WithField("service_id", t.service.ServiceID()).Error("Failed to store firing alerts")
+	}
+}
+
+// edit strikes through the message, as all of its alerts have resolved.
+func (t *alertTracker) edit(cli types.MatrixClient, m FiringMessage) {
+	resolved := resolvedContent(m.Content, t.now)
+	edit := mevt.MessageEventContent{
+		MsgType:    resolved.MsgType,
+		Body:       "* " + resolved.Body,
+		NewContent: &resolved,
+		RelatesTo:  &mevt.RelatesTo{Type: mevt.RelReplace, EventID: m.EventID},
+	}
+	if _, err := cli.SendMessageEvent(m.RoomID, mevt.EventMessage, edit); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"room_id":  m.RoomID,
+			"event_id": m.EventID,
+		}).Error("Failed to edit resolved Alertmanager notification")
+	}
+}
+
+// resolvedContent returns the message struck through, followed by when its alerts resolved.
+func resolvedContent(msg mevt.MessageEventContent, now time.Time) mevt.MessageEventContent {
+	at := now.UTC().Format("2006-01-02 15:04 MST")
+	resolved := msg
+	resolved.Body = msg.Body + "\nRESOLVED at " + at
+	resolved.Format = mevt.FormatHTML
+	resolved.FormattedBody = "<del>" + htmlBody(msg) + `</del><br><b><font color="green">RESOLVED</font></b> at ` + at
+	return resolved
+}
+
+// htmlBody returns the message's HTML, or its body as HTML if it is plain text.
+func htmlBody(msg mevt.MessageEventContent) string {
+	if msg.Format == mevt.FormatHTML {
+		return msg.FormattedBody
+	}
+	return strings.ReplaceAll(html.EscapeString(msg.Body), "\n", "<br>")
+}
+
+// load returns the stored copy of this service, as another webhook may have changed the firing
+// messages since this one was loaded. Returns this instance if there is no stored copy.
+func (s *Service) load() *Service {
+	srv, err := database.GetServiceDB().LoadService(s.ServiceID())
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Warn("Failed to load firing alerts")
+	}
+	if latest, ok := srv.(*Service); ok {
+		return latest
+	}
+	return s
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
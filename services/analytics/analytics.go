@@ -0,0 +1,488 @@
+// Package analytics implements a Service which sends website traffic alerts and weekly summaries
+// from Plausible or Matomo into rooms.
+package analytics
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Analytics service
+const ServiceType = "analytics"
+
+// How often current visitors are checked for sites with a spike threshold.
+const pollInterval = 5 * time.Minute
+
+// Weekly summaries are posted at this time, in the room's time zone.
+const (
+	summaryWeekday = time.Monday
+	summaryHour    = 9
+)
+
+// Once a spike has been announced, another isn't announced until the number of visitors has
+// dropped below this fraction of the threshold, so that traffic hovering around the threshold
+// doesn't announce a spike every poll.
+const spikeResetFraction = 0.75
+
+// Service contains the Config fields for the Analytics Service.
+//
+// The service checks the current number of visitors to each site every 5 minutes, and sends a
+// notice into a room when it reaches the room's spike threshold. Rooms can also ask for a summary
+// of the previous week's traffic, which is posted at 9am on Mondays in the room's "timezone" bot
+// option, or UTC if there isn't one.
+//
+// Alerts from elsewhere, such as goal completions, can be sent to the WebhookURL as a JSON POST
+// with the secret token as a bearer token, or as the "token" query parameter:
+//   {
+//       "site": "blog",
+//       "event": "goal",
+//       "goal": "Signup",
+//       "count": 3
+//   }
+// The event is either "goal", with the goal's name and how many times it was completed, or
+// "spike", with the current number of "visitors". An optional "message" is appended to the
+// notice. Webhook alerts are only sent to rooms with "alerts" enabled for the site.
+//
+// Example request:
+//   {
+//       "secret_token": "a long random string",
+//       "sites": {
+//           "blog": {
+//               "provider": "plausible",
+//               "site_id": "blog.example.org",
+//               "api_key": "env:PLAUSIBLE_API_KEY"
+//           },
+//           "shop": {
+//               "provider": "matomo",
+//               "url": "https://matomo.example.org",
+//               "site_id": "3",
+//               "api_key": "3f1e..."
+//           }
+//       },
+//       "rooms": {
+//           "!qmElAGdFYCHoCJuaNt:localhost": {
+//               "sites": {
+//                   "blog": { "spike_threshold": 200, "weekly_summary": true },
+//                   "shop": { "alerts": true }
+//               }
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which alerts can be sent to - Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// Optional. The token which webhook requests must include. If it isn't set then webhooks
+	// are refused. This may instead be a reference to a secret store, see the secrets package.
+	SecretToken string `json:"secret_token"`
+	// A map of names to the sites they refer to.
+	Sites map[string]Site `json:"sites"`
+	// A map of room ID to the sites to report on in that room. A room may be a Space or a label
+	// such as "label:marketing", see utils.ResolveRooms.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+
+	// Internal: the sites whose spikes have been announced in each room, keyed by room ID and
+	// site name. This is populated by Go-NEB.
+	Spiking map[string]bool `json:"spiking,omitempty"`
+	// Internal: when weekly summaries were last posted to each room, keyed by room ID and site
+	// name. This is populated by Go-NEB.
+	LastSummaryTimestampSecs map[string]int64 `json:"last_summary_ts_secs,omitempty"`
+}
+
+// Site is a website tracked by Plausible or Matomo.
+type Site struct {
+	// "plausible" or "matomo".
+	Provider string `json:"provider"`
+	// The URL of the Plausible or Matomo instance. Defaults to https://plausible.io for Plausible,
+	// and is required for Matomo.
+	URL string `json:"url"`
+	// The site's domain in Plausible, or its numeric ID in Matomo.
+	SiteID string `json:"site_id"`
+	// A Plausible Stats API key or Matomo token_auth with view access to the site. This may
+	// instead be a reference to a secret store, see the secrets package.
+	APIKey string `json:"api_key"`
+}
+
+// RoomConfig is the sites to report on in a room.
+type RoomConfig struct {
+	// A map of site name to what to report on for that site.
+	Sites map[string]RoomSite `json:"sites"`
+}
+
+// RoomSite is what to report on for a site in a room.
+type RoomSite struct {
+	// Optional. Announce a spike when the site has at least this many current visitors.
+	SpikeThreshold int `json:"spike_threshold"`
+	// Post a summary of the previous week's traffic every Monday morning.
+	WeeklySummary bool `json:"weekly_summary"`
+	// Send alerts received by the webhook for this site.
+	Alerts bool `json:"alerts"`
+}
+
+// alert is the body of a webhook request.
+type alert struct {
+	Site     string `json:"site"`
+	Event    string `json:"event"`
+	Visitors int    `json:"visitors"`
+	Goal     string `json:"goal"`
+	Count    int    `json:"count"`
+	Message  string `json:"message"`
+}
+
+// stateKey is the key of a site in a room in Spiking and LastSummaryTimestampSecs.
+func stateKey(roomID id.RoomID, site string) string {
+	return roomID.String() + " " + site
+}
+
+// OnReceiveWebhook receives alerts and sends notices to Matrix as a result.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	logger := logging.FromContext(req.Context())
+	if err := s.verify(req); err != nil {
+		logger.WithError(err).WithField("service_id", s.ServiceID()).Warn("Received unauthorised analytics webhook request.")
+		w.WriteHeader(403)
+		return
+	}
+	var a alert
+	if err := json.NewDecoder(req.Body).Decode(&a); err != nil {
+		logger.WithError(err).Error("Analytics webhook received an invalid JSON payload")
+		w.WriteHeader(400)
+		return
+	}
+	if _, ok := s.Sites[a.Site]; !ok {
+		w.WriteHeader(400)
+		w.Write([]byte("Unknown site"))
+		return
+	}
+	var body string
+	switch a.Event {
+	case "spike":
+		body = fmt.Sprintf("📈 Traffic spike on %s: %d visitors right now.", a.Site, a.Visitors)
+	case "goal":
+		body = fmt.Sprintf("🎯 %s: goal %q completed %s.", a.Site, a.Goal, times(a.Count))
+	default:
+		w.WriteHeader(400)
+		w.Write([]byte("Unknown event"))
+		return
+	}
+	if a.Message != "" {
+		body += " " + a.Message
+	}
+
+	for roomID, roomConfig := range s.Rooms {
+		if !roomConfig.Sites[a.Site].Alerts {
+			continue
+		}
+		for _, toRoomID := range utils.ResolveRooms(cli, s.ServiceUserID(), roomID) {
+			if _, e := cli.SendMessageEvent(toRoomID, mevt.EventMessage, notice(body)); e != nil {
+				logger.WithError(e).WithField("room_id", toRoomID).Print(
+					"Failed to send analytics alert to room.")
+			}
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// verify checks the request includes the secret token.
+func (s *Service) verify(req *http.Request) error {
+	if s.SecretToken == "" {
+		return errors.New("no secret_token is configured")
+	}
+	secret, err := secrets.Resolve(s.SecretToken)
+	if err != nil {
+		return err
+	}
+	token := req.URL.Query().Get("token")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return errors.New("token mismatch")
+	}
+	return nil
+}
+
+// OnPoll checks for traffic spikes and posts any weekly summaries which are due. Returns when
+// the next check or summary is due, or 0 if no room wants either.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	return s.poll(cli, time.Now())
+}
+
+// poll does the work of OnPoll at the given time, and stores the service if anything changed.
+func (s *Service) poll(cli types.MatrixClient, now time.Time) time.Time {
+	if s.Spiking == nil {
+		s.Spiking = make(map[string]bool)
+	}
+	if s.LastSummaryTimestampSecs == nil {
+		s.LastSummaryTimestampSecs = make(map[string]int64)
+	}
+	var next time.Time
+	changed := false
+	visitors := make(map[string]int) // the current visitors to each site, fetched once per poll
+	for configRoomID, roomConfig := range s.Rooms {
+		for _, roomID := range utils.ResolveRooms(cli, s.ServiceUserID(), configRoomID) {
+			for _, name := range sortedSites(roomConfig.Sites) {
+				rs := roomConfig.Sites[name]
+				key := stateKey(roomID, name)
+				if rs.SpikeThreshold > 0 {
+					if s.checkSpike(cli, roomID, name, rs.SpikeThreshold, visitors) {
+						changed = true
+					}
+					next = earliest(next, now.Add(pollInterval))
+				}
+				if rs.WeeklySummary {
+					due := lastSummaryTime(now.In(utils.RoomLocation(s.ServiceUserID(), roomID)))
+					last := s.LastSummaryTimestampSecs[key]
+					if last == 0 {
+						// Wait for the next summary rather than posting one as soon as the room
+						// is configured.
+						s.LastSummaryTimestampSecs[key] = now.Unix()
+						changed = true
+					} else if last < due.Unix() {
+						s.postSummary(cli, roomID, name, due)
+						s.LastSummaryTimestampSecs[key] = now.Unix()
+						changed = true
+					}
+					next = earliest(next, due.AddDate(0, 0, 7))
+				}
+			}
+		}
+	}
+
+	if changed {
+		if _, err := database.GetServiceDB().StoreService(s); err != nil {
+			log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to persist analytics state")
+			polling.ReportError(s, err)
+		}
+	}
+	if next.IsZero() {
+		return time.Unix(0, 0)
+	}
+	return next
+}
+
+// checkSpike announces a spike in the room if the site has reached the threshold and one hasn't
+// already been announced. Returns true if Spiking changed.
+func (s *Service) checkSpike(cli types.MatrixClient, roomID id.RoomID, name string, threshold int, visitors map[string]int) bool {
+	n, ok := visitors[name]
+	if !ok {
+		site := s.Sites[name]
+		var err error
+		if n, err = providers[site.Provider].currentVisitors(&site); err != nil {
+			log.WithError(err).WithField("site", name).Error("Failed to fetch current visitors")
+			polling.ReportError(s, fmt.Errorf("current visitors to %s: %s", name, err))
+			n = -1
+		}
+		visitors[name] = n
+	}
+	if n < 0 {
+		return false
+	}
+
+	key := stateKey(roomID, name)
+	if s.Spiking[key] {
+		if float64(n) >= spikeResetFraction*float64(threshold) {
+			return false
+		}
+		delete(s.Spiking, key)
+		return true
+	}
+	if n < threshold {
+		return false
+	}
+	body := fmt.Sprintf("📈 Traffic spike on %s: %d visitors right now (threshold %d).", name, n, threshold)
+	if _, err := cli.SendMessageEvent(roomID, mevt.EventMessage, notice(body)); err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("Failed to send traffic spike alert")
+		polling.ReportError(s, err)
+		return false
+	}
+	s.Spiking[key] = true
+	return true
+}
+
+// postSummary posts the site's stats for the week before the summary time into the room,
+// compared with the week before that.
+func (s *Service) postSummary(cli types.MatrixClient, roomID id.RoomID, name string, due time.Time) {
+	site := s.Sites[name]
+	p := providers[site.Provider]
+	const day = "2006-01-02"
+	from, to := due.AddDate(0, 0, -7), due.AddDate(0, 0, -1)
+	week, err := p.summary(&site, from.Format(day), to.Format(day))
+	if err != nil {
+		log.WithError(err).WithField("site", name).Error("Failed to fetch weekly stats")
+		polling.ReportError(s, fmt.Errorf("weekly stats for %s: %s", name, err))
+		return
+	}
+	prev, err := p.summary(&site, from.AddDate(0, 0, -7).Format(day), to.AddDate(0, 0, -7).Format(day))
+	if err != nil {
+		prev = nil // the summary is still useful without the comparison
+	}
+
+	body := fmt.Sprintf("📊 Traffic to %s, %s – %s: ", name, from.Format("2 Jan"), to.Format("2 Jan"))
+	parts := []string{fmt.Sprintf("%d visitors", week.Visitors), fmt.Sprintf("%d pageviews", week.Pageviews)}
+	if prev != nil {
+		parts[0] += change(prev.Visitors, week.Visitors)
+		parts[1] += change(prev.Pageviews, week.Pageviews)
+	}
+	parts = append(parts, fmt.Sprintf("%d%% bounce rate", week.BounceRate))
+	if week.VisitDuration > 0 {
+		parts = append(parts, utils.HumanDuration(week.VisitDuration)+" average visit")
+	}
+	body += strings.Join(parts, ", ") + "."
+	if _, err := cli.SendMessageEvent(roomID, mevt.EventMessage, notice(body)); err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("Failed to send weekly summary")
+		polling.ReportError(s, err)
+	}
+}
+
+// lastSummaryTime returns the most recent summary time at or before now, in now's location.
+func lastSummaryTime(now time.Time) time.Time {
+	t := time.Date(now.Year(), now.Month(), now.Day(), summaryHour, 0, 0, 0, now.Location())
+	t = t.AddDate(0, 0, -int((now.Weekday()-summaryWeekday+7)%7))
+	if t.After(now) {
+		t = t.AddDate(0, 0, -7)
+	}
+	return t
+}
+
+// change formats the change from prev to cur as " (+12%)", or "" if there was nothing before.
+func change(prev, cur int) string {
+	if prev == 0 {
+		return ""
+	}
+	pct := (cur - prev) * 100 / prev
+	if pct >= 0 {
+		return fmt.Sprintf(" (+%d%%)", pct)
+	}
+	return fmt.Sprintf(" (%d%%)", pct)
+}
+
+func times(n int) string {
+	if n == 1 {
+		return "once"
+	}
+	return fmt.Sprintf("%d times", n)
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func sortedSites(sites map[string]RoomSite) []string {
+	names := make([]string, 0, len(sites))
+	for name := range sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	for name, site := range s.Sites {
+		if providers[site.Provider] == nil {
+			return fmt.Errorf("provider for site %s must be plausible or matomo, not %q", name, site.Provider)
+		}
+		if site.SiteID == "" {
+			return fmt.Errorf("site %s needs a site_id", name)
+		}
+		if siteURL(&site) == "" {
+			return fmt.Errorf("site %s needs a url", name)
+		}
+	}
+	for roomID, roomConfig := range s.Rooms {
+		for name, rs := range roomConfig.Sites {
+			site, ok := s.Sites[name]
+			if !ok {
+				return fmt.Errorf("room %s refers to unknown site %q", roomID, name)
+			}
+			if (rs.SpikeThreshold > 0 || rs.WeeklySummary) && site.APIKey == "" {
+				return fmt.Errorf("site %s needs an api_key for spike thresholds and weekly summaries", name)
+			}
+			if rs.SpikeThreshold < 0 {
+				return fmt.Errorf("spike_threshold for site %s in room %s must not be negative", name, roomID)
+			}
+		}
+	}
+	// Keep track of what has already been announced, so that reconfiguring doesn't repeat it.
+	if old, ok := oldService.(*Service); ok {
+		s.Spiking = old.Spiking
+		s.LastSummaryTimestampSecs = old.LastSummaryTimestampSecs
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+// PostRegister deletes this service if there are no rooms to send notifications to.
+func (s *Service) PostRegister(oldService types.Service) {
+	if len(s.Rooms) > 0 {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_type": s.ServiceType(),
+		"service_id":   s.ServiceID(),
+	})
+	logger.Info("Removing service as no rooms are registered.")
+	if err := database.GetServiceDB().DeleteService(s.ServiceID()); err != nil {
+		logger.WithError(err).Error("Failed to delete service")
+	}
+}
+
+// TargetRooms returns the rooms notifications are sent into.
+func (s *Service) TargetRooms() []id.RoomID {
+	roomIDs := make([]id.RoomID, 0, len(s.Rooms))
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
+func (s *Service) joinRooms(client types.MatrixClient) {
+	for roomID := range s.Rooms {
+		if utils.IsLabel(roomID) {
+			continue // labelled rooms are joined by the service which labels them
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
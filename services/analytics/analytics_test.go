@@ -0,0 +1,196 @@
+package analytics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// mockMatrix returns a client which records the messages sent to each room.
+func mockMatrix(t *testing.T) (*mautrix.Client, map[id.RoomID][]string) {
+	sent := make(map[id.RoomID][]string)
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/hierarchy") {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		if !strings.Contains(req.URL.Path, "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		roomID := id.RoomID(strings.Split(req.URL.Path, "/")[5])
+		sent[roomID] = append(sent[roomID], msg.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hs", "@neb:hs", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+	return matrixCli, sent
+}
+
+func createService(t *testing.T, cli *mautrix.Client, config string) *Service {
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Register(nil, cli); err != nil {
+		t.Fatal("Failed to register service: ", err)
+	}
+	return srv.(*Service)
+}
+
+func TestWebhook(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	matrixCli, sent := mockMatrix(t)
+	srv := createService(t, matrixCli, `{
+		"secret_token": "sekrit",
+		"sites": {"blog": {"provider": "plausible", "site_id": "blog.example.org"}},
+		"rooms": {
+			"!alerts:hs": {"sites": {"blog": {"alerts": true}}},
+			"!quiet:hs": {"sites": {"blog": {}}}
+		}
+	}`)
+
+	send := func(token, body string) int {
+		req, _ := http.NewRequest("POST", "/?token="+token, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		srv.OnReceiveWebhook(w, req, matrixCli)
+		return w.Code
+	}
+
+	if code := send("wrong", `{"site": "blog", "event": "spike", "visitors": 300}`); code != 403 {
+		t.Errorf("wrong token: got HTTP %d, want 403", code)
+	}
+	if code := send("sekrit", `{"site": "shop", "event": "spike", "visitors": 300}`); code != 400 {
+		t.Errorf("unknown site: got HTTP %d, want 400", code)
+	}
+	if code := send("sekrit", `{"site": "blog", "event": "goal", "goal": "Signup", "count": 3, "message": "Nice!"}`); code != 200 {
+		t.Errorf("goal: got HTTP %d, want 200", code)
+	}
+
+	want := []string{`🎯 blog: goal "Signup" completed 3 times. Nice!`}
+	if got := sent["!alerts:hs"]; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+	if got := sent["!quiet:hs"]; len(got) != 0 {
+		t.Errorf("sent %v to a room without alerts", got)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	matrixCli, sent := mockMatrix(t)
+
+	visitors := 250
+	apiTrans := struct{ testutils.MockTransport }{}
+	apiTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch {
+		case req.URL.Path == "/api/v1/stats/realtime/visitors":
+			if req.Header.Get("Authorization") != "Bearer plausible-key" {
+				return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+			}
+			body = fmt.Sprint(visitors)
+		case req.URL.Query().Get("method") == "VisitsSummary.get":
+			req.ParseForm()
+			if req.PostForm.Get("token_auth") != "matomo-token" {
+				return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+			}
+			if req.URL.Query().Get("date") == "2026-10-05,2026-10-11" {
+				body = `{"nb_visits": 1100, "nb_actions": "2700", "bounce_rate": "41%", "avg_time_on_site": 150}`
+			} else {
+				body = `{"nb_visits": 1000, "nb_actions": 3000, "bounce_rate": "45%", "avg_time_on_site": 120}`
+			}
+		default:
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	}
+	httpClient = &http.Client{Transport: apiTrans}
+
+	srv := createService(t, matrixCli, `{
+		"sites": {
+			"blog": {"provider": "plausible", "site_id": "blog.example.org", "api_key": "plausible-key"},
+			"shop": {"provider": "matomo", "url": "https://matomo.example.org/", "site_id": "3", "api_key": "matomo-token"}
+		},
+		"rooms": {
+			"!room:hs": {"sites": {"blog": {"spike_threshold": 200}, "shop": {"weekly_summary": true}}}
+		}
+	}`)
+
+	// Sunday 11 October 2026: the first poll notes when summaries start, but doesn't post one.
+	now := time.Date(2026, 10, 11, 12, 0, 0, 0, time.UTC)
+	if next := srv.poll(matrixCli, now); !next.Equal(now.Add(pollInterval)) {
+		t.Errorf("next poll at %s, want %s", next, now.Add(pollInterval))
+	}
+	now = now.Add(pollInterval)
+	srv.poll(matrixCli, now) // still spiking, so no new alert
+	visitors = 160
+	now = now.Add(pollInterval)
+	srv.poll(matrixCli, now) // above the reset level, so no new alert
+	visitors = 100
+	now = now.Add(pollInterval)
+	srv.poll(matrixCli, now) // resets
+	visitors = 220
+	now = now.Add(pollInterval)
+	srv.poll(matrixCli, now)
+
+	// Monday 12 October 2026, after the summary time.
+	now = time.Date(2026, 10, 12, 9, 1, 0, 0, time.UTC)
+	srv.poll(matrixCli, now)
+	now = now.Add(pollInterval)
+	srv.poll(matrixCli, now) // already posted this week's summary
+
+	want := []string{
+		"📈 Traffic spike on blog: 250 visitors right now (threshold 200).",
+		"📈 Traffic spike on blog: 220 visitors right now (threshold 200).",
+		"📊 Traffic to shop, 5 Oct – 11 Oct: 1100 visitors (+10%), 2700 pageviews (-10%), 41% bounce rate, 3 minutes average visit.",
+	}
+	got := sent["!room:hs"]
+	if len(got) != len(want) {
+		t.Fatalf("sent %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("message %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLastSummaryTime(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("time zone database not available")
+	}
+	for _, tc := range []struct {
+		now  time.Time
+		want time.Time
+	}{
+		{time.Date(2026, 10, 12, 9, 0, 0, 0, time.UTC), time.Date(2026, 10, 12, 9, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 12, 8, 59, 0, 0, time.UTC), time.Date(2026, 10, 5, 9, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC), time.Date(2026, 10, 12, 9, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 29, 12, 0, 0, 0, london), time.Date(2026, 10, 26, 9, 0, 0, 0, london)},
+	} {
+		if got := lastSummaryTime(tc.now); !got.Equal(tc.want) {
+			t.Errorf("lastSummaryTime(%s) = %s, want %s", tc.now, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package analytics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/secrets"
+)
+
+// The window Matomo counts current visitors over.
+const matomoRealtimeMinutes = 30
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// stats is a summary of a site's traffic over a period.
+type stats struct {
+	Visitors  int
+	Pageviews int
+	// The percentage of visits which only viewed one page.
+	BounceRate int
+	// The average visit duration.
+	VisitDuration time.Duration
+}
+
+// provider reads stats from an analytics API.
+type provider interface {
+	// currentVisitors returns the number of people on the site now.
+	currentVisitors(site *Site) (int, error)
+	// summary returns the site's stats between the two dates, inclusive, which are formatted
+	// as "2006-01-02".
+	summary(site *Site, from, to string) (*stats, error)
+}
+
+var providers = map[string]provider{
+	"plausible": plausible{},
+	"matomo":    matomo{},
+}
+
+// The instance used for each provider if a site doesn't give a URL.
+var defaultURLs = map[string]string{
+	"plausible": "https://plausible.io",
+}
+
+func siteURL(site *Site) string {
+	if site.URL != "" {
+		return strings.TrimSuffix(site.URL, "/")
+	}
+	return defaultURLs[site.Provider]
+}
+
+// getJSON makes the request and decodes the JSON response into out.
+func getJSON(req *http.Request, out interface{}) error {
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d from %s", res.StatusCode, req.URL.Host)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// plausible reads stats from the Plausible Stats API.
+type plausible struct{}
+
+func (p plausible) get(site *Site, path string, query url.Values, out interface{}) error {
+	apiKey, err := secrets.Resolve(site.APIKey)
+	if err != nil {
+		return err
+	}
+	query.Set("site_id", site.SiteID)
+	req, err := http.NewRequest("GET", siteURL(site)+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	return getJSON(req, out)
+}
+
+func (p plausible) currentVisitors(site *Site) (int, error) {
+	var visitors int
+	err := p.get(site, "/api/v1/stats/realtime/visitors", url.Values{}, &visitors)
+	return visitors, err
+}
+
+func (p plausible) summary(site *Site, from, to string) (*stats, error) {
+	var res struct {
+		Results map[string]struct {
+			Value float64 `json:"value"`
+		} `json:"results"`
+	}
+	err := p.get(site, "/api/v1/stats/aggregate", url.Values{
+		"period":  {"custom"},
+		"date":    {from + "," + to},
+		"metrics": {"visitors,pageviews,bounce_rate,visit_duration"},
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &stats{
+		Visitors:      int(res.Results["visitors"].Value),
+		Pageviews:     int(res.Results["pageviews"].Value),
+		BounceRate:    int(res.Results["bounce_rate"].Value),
+		VisitDuration: time.Duration(res.Results["visit_duration"].Value) * time.Second,
+	}, nil
+}
+
+// matomo reads stats from the Matomo Reporting API.
+type matomo struct{}
+
+// number is a number which Matomo may send as a string, such as "12" or "45%".
+type number float64
+
+func (n *number) UnmarshalJSON(data []byte) error {
+	s := strings.TrimSuffix(strings.Trim(string(data), `"`), "%")
+	if s == "" || s == "null" {
+		*n = 0
+		return nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	*n = number(f)
+	return err
+}
+
+func (m matomo) call(site *Site, method string, params url.Values, out interface{}) error {
+	token, err := secrets.Resolve(site.APIKey)
+	if err != nil {
+		return err
+	}
+	params.Set("module", "API")
+	params.Set("method", method)
+	params.Set("idSite", site.SiteID)
+	params.Set("format", "JSON")
+	// Matomo recommends sending the token in the body so that it isn't logged.
+	body := url.Values{"token_auth": {token}}
+	req, err := http.NewRequest("POST", siteURL(site)+"/index.php?"+params.Encode(), strings.NewReader(body.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return getJSON(req, out)
+}
+
+func (m matomo) currentVisitors(site *Site) (int, error) {
+	var counters []struct {
+		Visitors number `json:"visitors"`
+	}
+	err := m.call(site, "Live.getCounters", url.Values{"lastMinutes": {strconv.Itoa(matomoRealtimeMinutes)}}, &counters)
+	if err != nil {
+		return 0, err
+	}
+	if len(counters) == 0 {
+		return 0, nil
+	}
+	return int(counters[0].Visitors), nil
+}
+
+func (m matomo) summary(site *Site, from, to string) (*stats, error) {
+	var res struct {
+		Visits        number `json:"nb_visits"`
+		Actions       number `json:"nb_actions"`
+		BounceRate    number `json:"bounce_rate"`
+		AvgTimeOnSite number `json:"avg_time_on_site"`
+	}
+	err := m.call(site, "VisitsSummary.get", url.Values{"period": {"range"}, "date": {from + "," + to}}, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &stats{
+		Visitors:      int(res.Visits),
+		Pageviews:     int(res.Actions),
+		BounceRate:    int(res.BounceRate),
+		VisitDuration: time.Duration(res.AvgTimeOnSite) * time.Second,
+	}, nil
+}
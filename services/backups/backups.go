@@ -0,0 +1,649 @@
+// Package backups implements a Service which receives the results of backup jobs, such as restic,
+// borgmatic or rclone, and alerts rooms when a job fails or stops reporting.
+package backups
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Backups service
+const ServiceType = "backups"
+
+// The report formats accepted by the webhook.
+const (
+	FormatJSON   = "json"
+	FormatRestic = "restic"
+	FormatEmail  = "email"
+)
+
+// The longest message from a report which is included in an alert.
+const maxMessageLength = 500
+
+// The failure_pattern used for emailed reports if a job doesn't have one.
+var defaultFailurePattern = regexp.MustCompile(`(?i)\b(fail|failed|failure|error|errors)\b`)
+
+// Service contains the Config fields for the Backups Service.
+//
+// Backup jobs report their results to the WebhookURL, with the job's name in the "job" query
+// parameter and the secret token as a bearer token or the "token" query parameter. A room is
+// alerted when a job fails, when it succeeds again, and when it hasn't succeeded within its
+// interval. Reports can be:
+//
+// A JSON POST, with "status" either "success" or "failure" and an optional "message":
+//   {
+//       "status": "failure",
+//       "message": "rclone: 3 files failed to copy"
+//   }
+//
+// A request with "status" as a query parameter instead, which is easiest from shell scripts and
+// push monitors. The status may also be an exit code, where 0 is success, "up" or "down", and
+// "msg" is the message. For example, after running rclone:
+//   curl -fsS -X POST "$WEBHOOK_URL?token=$TOKEN&job=photos&status=$?"
+// or as borgmatic's uptime_kuma hook, with the push_url set to "$WEBHOOK_URL?token=...&job=nas".
+// Reports with the status "start" are ignored.
+//
+// The output of "restic backup --json", with "format=restic" as a query parameter. The backup
+// succeeded if the output includes its summary.
+//
+// An email forwarded by a mail gateway, with "format=email" as a query parameter. Mailgun's
+// form-encoded routes and Postmark's JSON inbound webhooks are understood. The job failed if the
+// subject or body matches its failure_pattern.
+//
+// Example request:
+//   {
+//       "secret_token": "a long random string",
+//       "jobs": {
+//           "nas": {
+//               "interval": "1 day",
+//               "rooms": ["!qmElAGdFYCHoCJuaNt:localhost"]
+//           },
+//           "photos": {
+//               "interval": "1 week",
+//               "rooms": ["label:ops"],
+//               "notify_success": true
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which job reports are sent to - Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// The token which webhook requests must include. This may instead be a reference to a
+	// secret store, see the secrets package.
+	SecretToken string `json:"secret_token"`
+	// A map of job name to the job's config.
+	Jobs map[string]Job `json:"jobs"`
+
+	// Internal: the status of each job, keyed by job name. This is populated by Go-NEB.
+	Statuses map[string]*Status `json:"statuses,omitempty"`
+}
+
+// Job is a backup job which reports to Go-NEB.
+type Job struct {
+	// Optional. How often the job should succeed, e.g. "1 day" or "26h". Rooms are alerted if it
+	// hasn't succeeded for this long. Allow some slack for how long the job takes to run.
+	Interval string `json:"interval"`
+	// The rooms to alert. A room may be a Space or a label such as "label:ops", see
+	// utils.ResolveRooms.
+	Rooms []id.RoomID `json:"rooms"`
+	// Optional. Send a notice every time the job succeeds, not just when it recovers.
+	NotifySuccess bool `json:"notify_success"`
+	// Optional. A regular expression which, if it matches an emailed report's subject or body,
+	// means the job failed. Defaults to words like "failed" or "error".
+	FailurePattern string `json:"failure_pattern"`
+}
+
+// Status is what is known about a job. This is populated by Go-NEB.
+type Status struct {
+	// When the job was first configured.
+	SinceSecs int64 `json:"since_ts_secs"`
+	// When the job last reported.
+	LastReportSecs int64 `json:"last_report_ts_secs,omitempty"`
+	// When the job last succeeded.
+	LastSuccessSecs int64 `json:"last_success_ts_secs,omitempty"`
+	// The message of the last report.
+	LastMessage string `json:"last_message,omitempty"`
+	// True if the last report was a failure.
+	Failing bool `json:"failing,omitempty"`
+	// True if rooms have been told that the job hasn't succeeded within its interval.
+	Overdue bool `json:"overdue,omitempty"`
+}
+
+// deadline returns when the job is overdue, or the zero time if it has no interval.
+func (st *Status) deadline(interval time.Duration) time.Time {
+	if interval == 0 {
+		return time.Time{}
+	}
+	last := st.LastSuccessSecs
+	if last == 0 {
+		last = st.SinceSecs
+	}
+	return time.Unix(last, 0).Add(interval)
+}
+
+// report is the result of a job run.
+type report struct {
+	success bool
+	message string
+}
+
+// parseInterval parses a job's interval, which is 0 if it doesn't have one.
+func parseInterval(interval string) (time.Duration, error) {
+	if interval == "" {
+		return 0, nil
+	}
+	d, rest, ok := utils.ParseDuration(strings.Fields(interval))
+	if !ok || len(rest) > 0 || d <= 0 {
+		return 0, fmt.Errorf("Bad interval %q", interval)
+	}
+	return d, nil
+}
+
+// OnReceiveWebhook receives job reports and alerts rooms as a result.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	logger := logging.FromContext(req.Context()).WithField("service_id", s.ServiceID())
+	if err := s.verify(req); err != nil {
+		logger.WithError(err).Warn("Received unauthorised backups webhook request.")
+		w.WriteHeader(403)
+		return
+	}
+	name := req.URL.Query().Get("job")
+	job, ok := s.Jobs[name]
+	if !ok {
+		w.WriteHeader(400)
+		w.Write([]byte("Unknown job"))
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	r, err := parseReport(req, body, &job)
+	if err != nil {
+		logger.WithError(err).WithField("job", name).Warn("Backups webhook received a bad report")
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if r != nil {
+		s.record(cli, name, r, time.Now())
+	}
+	w.WriteHeader(200)
+}
+
+// verify checks the request includes the secret token.
+func (s *Service) verify(req *http.Request) error {
+	if s.SecretToken == "" {
+		return errors.New("no secret_token is configured")
+	}
+	secret, err := secrets.Resolve(s.SecretToken)
+	if err != nil {
+		return err
+	}
+	token := req.URL.Query().Get("token")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return errors.New("token mismatch")
+	}
+	return nil
+}
+
+// parseReport parses a job report in any of the supported formats. Returns nil if the report
+// should be ignored, e.g. because the job has only just started.
+func parseReport(req *http.Request, body []byte, job *Job) (*report, error) {
+	query := req.URL.Query()
+	switch query.Get("format") {
+	case FormatRestic:
+		return parseRestic(body)
+	case FormatEmail:
+		return parseEmail(req, body, job)
+	case "", FormatJSON:
+		status, message := query.Get("status"), query.Get("msg")
+		if status == "" {
+			var j struct {
+				Status  string `json:"status"`
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal(body, &j); err != nil {
+				return nil, fmt.Errorf("Expected a JSON report or a status query parameter")
+			}
+			status, message = j.Status, j.Message
+		}
+		return parseStatus(status, message)
+	}
+	return nil, fmt.Errorf("Unknown format %q", query.Get("format"))
+}
+
+// parseStatus parses a status such as "success", "down" or an exit code.
+func parseStatus(status, message string) (*report, error) {
+	switch strings.ToLower(status) {
+	case "success", "ok", "up":
+		return &report{success: true, message: message}, nil
+	case "failure", "fail", "down":
+		return &report{message: message}, nil
+	case "start":
+		return nil, nil
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown status %q", status)
+	}
+	if code != 0 && message == "" {
+		message = fmt.Sprintf("Exited with status %d", code)
+	}
+	return &report{success: code == 0, message: message}, nil
+}
+
+// resticMessage is a line of the output of "restic backup --json".
+type resticMessage struct {
+	MessageType string `json:"message_type"`
+	Message     string `json:"message"`
+	Error       *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+	FilesNew      int     `json:"files_new"`
+	FilesChanged  int     `json:"files_changed"`
+	DataAdded     int64   `json:"data_added"`
+	TotalDuration float64 `json:"total_duration"`
+	SnapshotID    string  `json:"snapshot_id"`
+}
+
+// parseRestic parses the output of "restic backup --json", which is a JSON object per line.
+func parseRestic(body []byte) (*report, error) {
+	var summary *resticMessage
+	var errs []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, len(body)+1)
+	for scanner.Scan() {
+		var m resticMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			continue // restic may print progress which isn't JSON
+		}
+		switch m.MessageType {
+		case "summary":
+			summary = &m
+		case "error":
+			if m.Error != nil {
+				errs = append(errs, m.Error.Message)
+			}
+		case "exit_error":
+			errs = append(errs, m.Message)
+		}
+	}
+	if summary == nil {
+		if len(errs) == 0 {
+			errs = append(errs, "restic didn't report a summary")
+		}
+		return &report{message: strings.Join(errs, "; ")}, nil
+	}
+	msg := fmt.Sprintf("Snapshot %s: %d new and %d changed files, %s added in %s",
+		summary.SnapshotID, summary.FilesNew, summary.FilesChanged, humanBytes(summary.DataAdded),
+		utils.HumanDuration(time.Duration(summary.TotalDuration)*time.Second))
+	if len(errs) > 0 {
+		// restic carries on past files it can't read, but the snapshot is incomplete.
+		return &report{message: msg + ". Errors: " + strings.Join(errs, "; ")}, nil
+	}
+	return &report{success: true, message: msg}, nil
+}
+
+// parseEmail parses an email forwarded by Mailgun or Postmark.
+func parseEmail(req *http.Request, body []byte, job *Job) (*report, error) {
+	var subject, text string
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if contentType == "application/json" {
+		var email struct {
+			Subject  string
+			TextBody string
+		}
+		if err := json.Unmarshal(body, &email); err != nil {
+			return nil, err
+		}
+		subject, text = email.Subject, email.TextBody
+	} else {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err := req.ParseMultipartForm(int64(len(body)) + 1); err != nil && err != http.ErrNotMultipart {
+			return nil, err
+		}
+		subject, text = req.PostFormValue("subject"), req.PostFormValue("body-plain")
+	}
+	if subject == "" && text == "" {
+		return nil, errors.New("Expected an email with a subject or body")
+	}
+	pattern := defaultFailurePattern
+	if job.FailurePattern != "" {
+		// Checked by Register
+		pattern = regexp.MustCompile(job.FailurePattern)
+	}
+	return &report{
+		success: !pattern.MatchString(subject) && !pattern.MatchString(text),
+		message: subject,
+	}, nil
+}
+
+// record updates the job's status with the report, and alerts rooms if the job failed or has
+// recovered.
+func (s *Service) record(cli types.MatrixClient, name string, r *report, now time.Time) {
+	defer polling.Lock(s)()
+	latest := polling.Latest(s).(*Service)
+	job, ok := latest.Jobs[name]
+	if !ok {
+		return
+	}
+	st := latest.status(name, now)
+
+	var body string
+	switch {
+	case !r.success:
+		body = fmt.Sprintf("❌ Backup job %s failed.", name)
+	case st.Failing || st.Overdue:
+		body = fmt.Sprintf("✅ Backup job %s succeeded again.", name)
+	case job.NotifySuccess:
+		body = fmt.Sprintf("✅ Backup job %s succeeded.", name)
+	}
+	if body != "" && r.message != "" {
+		body += " " + truncate(r.message)
+	}
+
+	st.LastReportSecs = now.Unix()
+	st.LastMessage = truncate(r.message)
+	st.Failing = !r.success
+	if r.success {
+		st.LastSuccessSecs = now.Unix()
+		st.Overdue = false
+	}
+	if _, err := database.GetServiceDB().StoreService(latest); err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to store backup job status")
+	}
+	s.Statuses = latest.Statuses
+	if body != "" {
+		latest.alert(cli, &job, body)
+	}
+	// The job's deadline has moved.
+	if err := polling.StartPolling(latest); err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to start poll loop")
+	}
+}
+
+// status returns the job's status, creating it if the job hasn't been seen before.
+func (s *Service) status(name string, now time.Time) *Status {
+	if s.Statuses == nil {
+		s.Statuses = make(map[string]*Status)
+	}
+	st, ok := s.Statuses[name]
+	if !ok {
+		st = &Status{SinceSecs: now.Unix()}
+		s.Statuses[name] = st
+	}
+	return st
+}
+
+// OnPoll alerts rooms about jobs which haven't succeeded within their interval. Returns when the
+// next job will be overdue, or 0 if there are no jobs with intervals left to check.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	return s.poll(cli, time.Now())
+}
+
+// poll does the work of OnPoll at the given time.
+func (s *Service) poll(cli types.MatrixClient, now time.Time) time.Time {
+	defer polling.Lock(s)()
+	latest := polling.Latest(s).(*Service)
+	s.Statuses = latest.Statuses
+
+	var next time.Time
+	changed := false
+	for _, name := range s.jobNames() {
+		job := s.Jobs[name]
+		interval, err := parseInterval(job.Interval)
+		if err != nil || interval == 0 {
+			continue
+		}
+		st := s.status(name, now)
+		if st.Overdue {
+			continue // wait for it to succeed
+		}
+		deadline := st.deadline(interval)
+		if now.Before(deadline) {
+			if next.IsZero() || deadline.Before(next) {
+				next = deadline
+			}
+			continue
+		}
+		body := fmt.Sprintf("⏰ Backup job %s hasn't succeeded for %s.", name, utils.HumanDuration(interval))
+		if st.LastSuccessSecs == 0 {
+			body = fmt.Sprintf("⏰ Backup job %s hasn't succeeded since it was set up %s ago.", name,
+				utils.HumanDuration(now.Sub(time.Unix(st.SinceSecs, 0)).Truncate(time.Minute)))
+		}
+		if st.Failing && st.LastMessage != "" {
+			body += " The last run failed: " + st.LastMessage
+		}
+		s.alert(cli, &job, body)
+		st.Overdue = true
+		changed = true
+	}
+
+	if changed {
+		if _, err := database.GetServiceDB().StoreService(s); err != nil {
+			log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to persist backup job statuses")
+			polling.ReportError(s, err)
+		}
+	}
+	if next.IsZero() {
+		return time.Unix(0, 0)
+	}
+	return next
+}
+
+// alert sends the message into the job's rooms.
+func (s *Service) alert(cli types.MatrixClient, job *Job, body string) {
+	for _, configRoomID := range job.Rooms {
+		for _, roomID := range utils.ResolveRooms(cli, s.ServiceUserID(), configRoomID) {
+			if _, err := cli.SendMessageEvent(roomID, mevt.EventMessage, notice(body)); err != nil {
+				log.WithError(err).WithField("room_id", roomID).Error("Failed to send backup alert")
+			}
+		}
+	}
+}
+
+// Commands supported:
+//    !backups
+// Lists the jobs which alert this room, with when each last succeeded.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"backups"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdBackups(cli, roomID)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdBackups(cli types.MatrixClient, roomID id.RoomID) (interface{}, error) {
+	latest := polling.Latest(s).(*Service)
+	now := time.Now()
+	var buf bytes.Buffer
+	for _, name := range latest.jobNames() {
+		job := latest.Jobs[name]
+		if !alertsRoom(cli, s.ServiceUserID(), &job, roomID) {
+			continue
+		}
+		var st Status
+		if latest.Statuses[name] != nil {
+			st = *latest.Statuses[name]
+		}
+		state := "OK"
+		switch {
+		case st.LastReportSecs == 0:
+			state = "No reports yet"
+		case st.Failing:
+			state = "Failing"
+		}
+		if st.Overdue {
+			state += ", overdue"
+		}
+		buf.WriteString(fmt.Sprintf("%s: %s.", name, state))
+		if st.LastSuccessSecs != 0 {
+			ago := now.Sub(time.Unix(st.LastSuccessSecs, 0)).Truncate(time.Minute)
+			buf.WriteString(fmt.Sprintf(" Last succeeded %s ago.", utils.HumanDuration(ago)))
+		}
+		if st.Failing && st.LastMessage != "" {
+			buf.WriteString(" " + st.LastMessage)
+		}
+		buf.WriteString("\n")
+	}
+	if buf.Len() == 0 {
+		return notice("There are no backup jobs which alert this room."), nil
+	}
+	return notice(strings.TrimSuffix(buf.String(), "\n")), nil
+}
+
+// alertsRoom returns true if the job's alerts are sent into the room.
+func alertsRoom(cli types.MatrixClient, userID id.UserID, job *Job, roomID id.RoomID) bool {
+	for _, configRoomID := range job.Rooms {
+		for _, r := range utils.ResolveRooms(cli, userID, configRoomID) {
+			if r == roomID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Service) jobNames() []string {
+	names := make([]string, 0, len(s.Jobs))
+	for name := range s.Jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if s.SecretToken == "" {
+		return errors.New("secret_token is required")
+	}
+	for name, job := range s.Jobs {
+		if _, err := parseInterval(job.Interval); err != nil {
+			return fmt.Errorf("Job %s: %s", name, err)
+		}
+		if job.FailurePattern != "" {
+			if _, err := regexp.Compile(job.FailurePattern); err != nil {
+				return fmt.Errorf("Job %s: bad failure_pattern: %s", name, err)
+			}
+		}
+		if len(job.Rooms) == 0 {
+			return fmt.Errorf("Job %s must have at least one room", name)
+		}
+	}
+	// Keep the statuses of jobs, so that reconfiguring doesn't reset their deadlines.
+	if old, ok := oldService.(*Service); ok {
+		s.Statuses = old.Statuses
+	}
+	now := time.Now()
+	for name := range s.Jobs {
+		s.status(name, now)
+	}
+	for name := range s.Statuses {
+		if _, ok := s.Jobs[name]; !ok {
+			delete(s.Statuses, name)
+		}
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+// TargetRooms returns the rooms alerts are sent into.
+func (s *Service) TargetRooms() []id.RoomID {
+	roomSet := make(map[id.RoomID]bool)
+	var roomIDs []id.RoomID
+	for _, job := range s.Jobs {
+		for _, roomID := range job.Rooms {
+			if !roomSet[roomID] {
+				roomSet[roomID] = true
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+	}
+	return roomIDs
+}
+
+func (s *Service) joinRooms(client types.MatrixClient) {
+	for _, roomID := range s.TargetRooms() {
+		if utils.IsLabel(roomID) {
+			continue // labelled rooms are joined by the service which labels them
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+}
+
+// humanBytes formats a number of bytes, e.g. "1.5 GiB".
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func truncate(message string) string {
+	runes := []rune(strings.TrimSpace(message))
+	if len(runes) > maxMessageLength {
+		return string(runes[:maxMessageLength]) + "…"
+	}
+	return string(runes)
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package backups
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+const resticOutput = `{"message_type":"status","percent_done":0.5}
+{"message_type":"summary","files_new":3,"files_changed":1,"data_added":1572864,"total_duration":65.2,"snapshot_id":"4f6c2b1a"}
+`
+
+func TestParseReport(t *testing.T) {
+	reportTests := []struct {
+		query       string
+		contentType string
+		body        string
+		want        *report
+	}{
+		{"", "application/json", `{"status": "failure", "message": "disk full"}`, &report{message: "disk full"}},
+		{"status=success", "", "", &report{success: true}},
+		{"status=0", "", "", &report{success: true}},
+		{"status=2", "", "", &report{message: "Exited with status 2"}},
+		{"status=down&msg=borg+failed", "", "", &report{message: "borg failed"}},
+		{"status=start", "", "", nil},
+		{"format=restic", "", resticOutput, &report{
+			success: true,
+			message: "Snapshot 4f6c2b1a: 3 new and 1 changed files, 1.5 MiB added in 1 minute",
+		}},
+		{"format=restic", "", `{"message_type":"exit_error","code":1,"message":"repository is locked"}`, &report{
+			message: "repository is locked",
+		}},
+		{"format=email", "application/x-www-form-urlencoded",
+			url.Values{"subject": {"Backup nas: OK"}, "body-plain": {"Everything went fine"}}.Encode(),
+			&report{success: true, message: "Backup nas: OK"}},
+		{"format=email", "application/json", `{"Subject": "Backup nas", "TextBody": "Backup FAILED: no space left"}`,
+			&report{message: "Backup nas"}},
+	}
+	for _, test := range reportTests {
+		req := httptest.NewRequest("POST", "/?"+test.query, strings.NewReader(test.body))
+		req.Header.Set("Content-Type", test.contentType)
+		got, err := parseReport(req, []byte(test.body), &Job{})
+		if err != nil {
+			t.Errorf("parseReport(%q): unexpected error %s", test.query, err)
+			continue
+		}
+		if (got == nil) != (test.want == nil) || (got != nil && *got != *test.want) {
+			t.Errorf("parseReport(%q): want %+v, got %+v", test.query, test.want, got)
+		}
+	}
+
+	for _, query := range []string{"", "status=maybe", "format=zip"} {
+		req := httptest.NewRequest("POST", "/?"+query, nil)
+		if _, err := parseReport(req, nil, &Job{}); err == nil {
+			t.Errorf("parseReport(%q): expected an error", query)
+		}
+	}
+}
+
+func TestBackupAlerts(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	var sent []string
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/hierarchy") {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		if !strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			t.Fatalf("Unexpected request: %s", req.URL)
+		}
+		var content mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			t.Fatal("Failed to decode message: ", err)
+		}
+		sent = append(sent, content.Body)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup"}`))}, nil
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"secret_token": "triforce",
+		"jobs": {
+			"nas": {"interval": "1 day", "rooms": ["!ops:hyrule"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+	s.Statuses = map[string]*Status{"nas": {SinceSecs: time.Now().Unix()}}
+
+	webhook := func(query string) int {
+		req := httptest.NewRequest("POST", "https://neb/services/hooks/aWQ?"+query, nil)
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, cli)
+		return w.Code
+	}
+	if code := webhook("job=nas&status=0"); code != 403 {
+		t.Errorf("Expected a request without the token to be refused, got HTTP %d", code)
+	}
+	if code := webhook("token=triforce&job=photos&status=0"); code != 400 {
+		t.Errorf("Expected a report for an unknown job to be refused, got HTTP %d", code)
+	}
+	if code := webhook("token=triforce&job=nas&status=0"); code != 200 {
+		t.Fatalf("Expected the report to be accepted, got HTTP %d", code)
+	}
+	if len(sent) != 0 {
+		t.Errorf("Expected successes not to be announced, got %q", sent)
+	}
+	webhook("token=triforce&job=nas&status=failure&msg=disk+full")
+	webhook("token=triforce&job=nas&status=success")
+
+	// Two days later, the job is overdue
+	now := time.Now()
+	next := s.poll(cli, now.Add(48*time.Hour))
+	if next.Unix() != 0 {
+		t.Errorf("Expected no more polls until the job reports again, got %s", next)
+	}
+	want := []string{
+		"❌ Backup job nas failed. disk full",
+		"✅ Backup job nas succeeded again.",
+		"⏰ Backup job nas hasn't succeeded for 1 day.",
+	}
+	if strings.Join(sent, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected alerts %q, got %q", want, sent)
+	}
+	s.poll(cli, now.Add(72*time.Hour))
+	if len(sent) != 3 {
+		t.Errorf("Expected an overdue job to only be announced once, got %q", sent)
+	}
+}
@@ -0,0 +1,370 @@
+// Package birthdays implements a Service which celebrates birthdays and anniversaries in rooms.
+package birthdays
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Birthdays service
+const ServiceType = "birthdays"
+
+// The hour of the day, in the room's time zone, at which birthdays are celebrated.
+const celebrateHour = 9
+
+// The number of birthdays shown by "!birthdays next".
+const numNext = 5
+
+// The maximum number of birthdays in a room, so that one room can't fill the service's config.
+const maxBirthdaysPerRoom = 500
+
+// The longest time between polls, so that changes to a room's time zone are picked up.
+const maxPollInterval = 24 * time.Hour
+
+// Birthday is a date which is celebrated in a room every year.
+type Birthday struct {
+	RoomID id.RoomID `json:"room_id"`
+	// Who or what is celebrated: either a Matrix user ID, who is mentioned on the day, or a name
+	// such as "Go-NEB".
+	Who   string     `json:"who"`
+	Month time.Month `json:"month"`
+	Day   int        `json:"day"`
+	// The year of birth, or 0 if it isn't known. If it is set then the age is announced.
+	Year int `json:"year,omitempty"`
+	// The user who added the birthday.
+	AddedBy id.UserID `json:"added_by"`
+	// The last year the birthday was celebrated, so that it is only celebrated once a year.
+	LastCelebratedYear int `json:"last_celebrated_year,omitempty"`
+}
+
+// Service contains the Config fields for the Birthdays Service. It has no Config fields which
+// need to be set: birthdays are added with !birthday and stored as part of the service.
+// Birthdays are celebrated at 9am in the room's "timezone" bot option, or UTC if there isn't one.
+//
+// Example request:
+//   {
+//   }
+type Service struct {
+	types.DefaultService
+	// The birthdays in each room. This is populated by Go-NEB.
+	Birthdays []Birthday `json:"birthdays"`
+}
+
+// Commands supported:
+//    !birthday add @alice:example.org 03-14
+//    !birthday add Go-NEB 2015-10-01
+// Celebrates the birthday in this room every year. If the year is given then the age is announced.
+// Birthdays of people who aren't Matrix users, and anniversaries, can be added by name.
+//    !birthday remove @alice:example.org
+// Stops celebrating the birthday in this room.
+//    !birthdays
+// Lists the birthdays in this room, starting with the next one.
+//    !birthdays next
+// Lists the next few birthdays in this room.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"birthday", "add"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdAdd(roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"birthday", "remove"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdRemove(roomID, args)
+			},
+		},
+		{
+			Path: []string{"birthdays", "next"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdList(roomID, numNext)
+			},
+		},
+		{
+			Path: []string{"birthdays"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdList(roomID, 0)
+			},
+		},
+		{
+			Path: []string{"birthday"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return usageMessage(), nil
+			},
+		},
+	}
+}
+
+func usageMessage() *mevt.MessageEventContent {
+	return notice("Usage: !birthday add @alice:example.org 03-14 | !birthday remove @alice:example.org | !birthdays [next]")
+}
+
+func (s *Service) cmdAdd(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return usageMessage(), nil
+	}
+	b, err := parseDate(args[len(args)-1])
+	if err != nil {
+		return nil, err
+	}
+	b.RoomID = roomID
+	b.Who = strings.Join(args[:len(args)-1], " ")
+	b.AddedBy = userID
+	return s.update(func(latest *Service) (interface{}, error) {
+		n := 0
+		for i, existing := range latest.Birthdays {
+			if existing.RoomID != roomID {
+				continue
+			}
+			if existing.Who == b.Who {
+				// Don't celebrate the birthday twice this year if it is corrected on the day.
+				b.LastCelebratedYear = existing.LastCelebratedYear
+				latest.Birthdays[i] = b
+				return notice(fmt.Sprintf("Updated %s's birthday to %s.", b.Who, b.date())), nil
+			}
+			n++
+		}
+		if n >= maxBirthdaysPerRoom {
+			return nil, fmt.Errorf("There are already %d birthdays in this room", maxBirthdaysPerRoom)
+		}
+		latest.Birthdays = append(latest.Birthdays, b)
+		return notice(fmt.Sprintf("Added %s's birthday on %s.", b.Who, b.date())), nil
+	})
+}
+
+func (s *Service) cmdRemove(roomID id.RoomID, args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return usageMessage(), nil
+	}
+	who := strings.Join(args, " ")
+	return s.update(func(latest *Service) (interface{}, error) {
+		for i, b := range latest.Birthdays {
+			if b.RoomID == roomID && b.Who == who {
+				latest.Birthdays = append(latest.Birthdays[:i], latest.Birthdays[i+1:]...)
+				return notice("Removed " + who + "'s birthday."), nil
+			}
+		}
+		return nil, errors.New("There is no birthday for " + who + " in this room")
+	})
+}
+
+// cmdList lists the birthdays in the room in the order they are next celebrated, up to limit
+// birthdays or all of them if limit is 0.
+func (s *Service) cmdList(roomID id.RoomID, limit int) (interface{}, error) {
+	now := time.Now().In(utils.RoomLocation(s.ServiceUserID(), roomID))
+	var birthdays []Birthday
+	for _, b := range s.Birthdays {
+		if b.RoomID == roomID {
+			birthdays = append(birthdays, b)
+		}
+	}
+	if len(birthdays) == 0 {
+		return notice("There are no birthdays in this room. Add one with !birthday add"), nil
+	}
+	sort.SliceStable(birthdays, func(i, j int) bool {
+		return birthdays[i].next(now).Before(birthdays[j].next(now))
+	})
+	if limit > 0 && len(birthdays) > limit {
+		birthdays = birthdays[:limit]
+	}
+	var buf bytes.Buffer
+	for _, b := range birthdays {
+		buf.WriteString(fmt.Sprintf("%s: %s (%s)\n", b.date(), b.Who, describeDay(b.next(now), now)))
+	}
+	return notice(strings.TrimSuffix(buf.String(), "\n")), nil
+}
+
+// parseDate parses a date such as "03-14" or "1990-03-14" into a Birthday.
+func parseDate(s string) (Birthday, error) {
+	var b Birthday
+	// Dates without a year are parsed in 2000, a leap year, so that the 29th of February is accepted.
+	t, err := time.Parse("2006-01-02", s)
+	if err == nil {
+		if t.After(time.Now()) {
+			return b, fmt.Errorf("Bad date %q: it is in the future", s)
+		}
+		b.Year = t.Year()
+	} else if t, err = time.Parse("2006-01-02", "2000-"+s); err != nil {
+		return b, fmt.Errorf("Bad date %q: use MM-DD or YYYY-MM-DD", s)
+	}
+	b.Month, b.Day = t.Month(), t.Day()
+	return b, nil
+}
+
+// date formats the birthday, e.g. "14 March" or "14 March 1990".
+func (b *Birthday) date() string {
+	s := fmt.Sprintf("%d %s", b.Day, b.Month)
+	if b.Year != 0 {
+		s += fmt.Sprintf(" %d", b.Year)
+	}
+	return s
+}
+
+// dayIn returns the day the birthday falls on in the given year. Birthdays on the 29th of February
+// are celebrated on the 28th in other years.
+func (b *Birthday) dayIn(year int, loc *time.Location) time.Time {
+	day := b.Day
+	if b.Month == time.February && day == 29 && !isLeap(year) {
+		day = 28
+	}
+	return time.Date(year, b.Month, day, 0, 0, 0, 0, loc)
+}
+
+func (b *Birthday) isOn(t time.Time) bool {
+	y, m, d := b.dayIn(t.Year(), t.Location()).Date()
+	ty, tm, td := t.Date()
+	return y == ty && m == tm && d == td
+}
+
+// next returns midnight on the next day the birthday is celebrated, which is today if it is
+// today and hasn't been celebrated yet.
+func (b *Birthday) next(now time.Time) time.Time {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	day := b.dayIn(now.Year(), now.Location())
+	if day.Before(today) || (day.Equal(today) && b.LastCelebratedYear >= now.Year()) {
+		day = b.dayIn(now.Year()+1, now.Location())
+	}
+	return day
+}
+
+// celebrateTime returns the time on the given day at which birthdays are celebrated.
+func celebrateTime(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), celebrateHour, 0, 0, 0, day.Location())
+}
+
+// describeDay describes how far away day is, e.g. "today" or "in 3 days".
+func describeDay(day, now time.Time) string {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	// Round as days aren't 24 hours long when the clocks change.
+	days := int(day.Sub(today).Hours()/24 + 0.5)
+	switch days {
+	case 0:
+		return "today"
+	case 1:
+		return "tomorrow"
+	}
+	return fmt.Sprintf("in %d days", days)
+}
+
+func isLeap(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
+
+// update applies fn to the latest copy of the service, see polling.Update.
+func (s *Service) update(fn func(latest *Service) (interface{}, error)) (interface{}, error) {
+	return polling.Update(s, true, func(latest types.Service) (interface{}, error) {
+		return fn(latest.(*Service))
+	})
+}
+
+// OnPoll celebrates the birthdays which are today in their room's time zone, once it is
+// celebrateHour there. Birthdays missed entirely, e.g. because Go-NEB was down all day, are not
+// celebrated late. Returns when the next birthday is due, or 0 if there are no birthdays.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	defer polling.Lock(s)()
+	s.Birthdays = polling.Latest(s).(*Service).Birthdays
+	if len(s.Birthdays) == 0 {
+		return time.Unix(0, 0)
+	}
+	return s.celebrateDue(cli, time.Now())
+}
+
+// celebrateDue celebrates the birthdays which are due at the given time, stores the service if
+// any were, and returns when the next birthday is due.
+func (s *Service) celebrateDue(cli types.MatrixClient, t time.Time) time.Time {
+	locs := make(map[id.RoomID]*time.Location)
+	changed := false
+	next := t.Add(maxPollInterval)
+	for i := range s.Birthdays {
+		b := &s.Birthdays[i]
+		loc, ok := locs[b.RoomID]
+		if !ok {
+			loc = utils.RoomLocation(s.ServiceUserID(), b.RoomID)
+			locs[b.RoomID] = loc
+		}
+		now := t.In(loc)
+		due := celebrateTime(b.next(now))
+		if b.isOn(now) && !now.Before(due) {
+			s.celebrate(cli, b, now)
+			b.LastCelebratedYear = now.Year()
+			changed = true
+			due = celebrateTime(b.next(now))
+		}
+		if due.Before(next) {
+			next = due
+		}
+	}
+
+	if changed {
+		if _, err := database.GetServiceDB().StoreService(s); err != nil {
+			log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to persist birthdays")
+			polling.ReportError(s, err)
+		}
+	}
+	return next
+}
+
+// celebrate sends a celebratory message into the room, mentioning the user if it is a user's
+// birthday.
+func (s *Service) celebrate(cli types.MatrixClient, b *Birthday, now time.Time) {
+	happy := "Happy birthday"
+	if b.Year != 0 && now.Year() > b.Year {
+		happy = fmt.Sprintf("Happy %s birthday", ordinal(now.Year()-b.Year))
+	}
+	who := html.EscapeString(b.Who)
+	if strings.HasPrefix(b.Who, "@") {
+		who = fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, who, who)
+	}
+	content := utils.StrippedHTMLMessage(mevt.MsgText, fmt.Sprintf("🎂 %s, %s! 🎉", happy, who))
+	if _, err := cli.SendMessageEvent(b.RoomID, mevt.EventMessage, content); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"room_id": b.RoomID,
+			"who":     b.Who,
+		}).Error("Failed to send birthday message")
+		polling.ReportError(s, fmt.Errorf("birthday of %s: %s", b.Who, err))
+	}
+}
+
+// ordinal formats n as "1st", "2nd", "3rd", "4th", etc.
+func ordinal(n int) string {
+	suffix := "th"
+	switch {
+	case n%100 >= 11 && n%100 <= 13:
+	case n%10 == 1:
+		suffix = "st"
+	case n%10 == 2:
+		suffix = "nd"
+	case n%10 == 3:
+		suffix = "rd"
+	}
+	return fmt.Sprintf("%d%s", n, suffix)
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package birthdays
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	roomID = id.RoomID("!kitchen:hyrule")
+	userID = id.UserID("@link:hyrule")
+)
+
+func TestCommands(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+	body := func(content interface{}, err error) string {
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		return content.(*mevt.MessageEventContent).Body
+	}
+
+	if got := body(s.cmdAdd(roomID, userID, strings.Fields("@zelda:hyrule 03-14"))); got != "Added @zelda:hyrule's birthday on 14 March." {
+		t.Errorf("Unexpected response: %s", got)
+	}
+	if got := body(s.cmdAdd(roomID, userID, strings.Fields("Hyrule Castle 1986-02-21"))); got != "Added Hyrule Castle's birthday on 21 February 1986." {
+		t.Errorf("Unexpected response: %s", got)
+	}
+	if got := body(s.cmdAdd(roomID, userID, strings.Fields("@zelda:hyrule 02-29"))); got != "Updated @zelda:hyrule's birthday to 29 February." {
+		t.Errorf("Unexpected response: %s", got)
+	}
+	if len(s.Birthdays) != 2 {
+		t.Fatalf("Expected 2 birthdays, got %d", len(s.Birthdays))
+	}
+	for _, input := range []string{"@zelda:hyrule", "@zelda:hyrule 14-03", "@zelda:hyrule 02-30", "@zelda:hyrule 3000-01-01"} {
+		if got, err := s.cmdAdd(roomID, userID, strings.Fields(input)); err == nil && !strings.HasPrefix(got.(*mevt.MessageEventContent).Body, "Usage:") {
+			t.Errorf("!birthday add %s: expected an error", input)
+		}
+	}
+
+	got := body(s.cmdList(roomID, 1))
+	if strings.Count(got, "\n") != 0 {
+		t.Errorf("Expected !birthdays next to be limited, got %s", got)
+	}
+	got = body(s.cmdList(roomID, 0))
+	if !strings.Contains(got, "29 February: @zelda:hyrule (") || !strings.Contains(got, "21 February 1986: Hyrule Castle (") {
+		t.Errorf("Unexpected list: %s", got)
+	}
+	if got := body(s.cmdList("!hall:hyrule", 0)); !strings.HasPrefix(got, "There are no birthdays in this room.") {
+		t.Errorf("Expected birthdays in other rooms to be hidden, got %s", got)
+	}
+	if _, err := s.cmdRemove("!hall:hyrule", []string{"@zelda:hyrule"}); err == nil {
+		t.Error("Expected birthdays in other rooms to be unable to be removed")
+	}
+	if got := body(s.cmdRemove(roomID, []string{"@zelda:hyrule"})); got != "Removed @zelda:hyrule's birthday." {
+		t.Errorf("Unexpected response: %s", got)
+	}
+	if len(s.Birthdays) != 1 || s.Birthdays[0].Who != "Hyrule Castle" {
+		t.Errorf("Expected only Hyrule Castle's birthday to be left, got %+v", s.Birthdays)
+	}
+}
+
+func TestNext(t *testing.T) {
+	leapDay := Birthday{Month: time.February, Day: 29}
+	for _, tc := range []struct {
+		b    Birthday
+		now  time.Time
+		want time.Time
+	}{
+		{leapDay, time.Date(2027, 1, 10, 12, 0, 0, 0, time.UTC), time.Date(2027, 2, 28, 0, 0, 0, 0, time.UTC)},
+		{leapDay, time.Date(2027, 3, 10, 12, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{Birthday{Month: time.March, Day: 14}, time.Date(2027, 3, 14, 23, 0, 0, 0, time.UTC), time.Date(2027, 3, 14, 0, 0, 0, 0, time.UTC)},
+		{Birthday{Month: time.March, Day: 14, LastCelebratedYear: 2027}, time.Date(2027, 3, 14, 23, 0, 0, 0, time.UTC), time.Date(2028, 3, 14, 0, 0, 0, 0, time.UTC)},
+	} {
+		if got := tc.b.next(tc.now); !got.Equal(tc.want) {
+			t.Errorf("next(%+v, %s) => %s, want %s", tc.b, tc.now, got, tc.want)
+		}
+	}
+}
+
+func TestCelebrateDue(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	var sent []mevt.MessageEventContent
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var content mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			t.Fatal("Failed to decode message: ", err)
+		}
+		sent = append(sent, content)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup"}`)),
+		}, nil
+	})
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+
+	s := &Service{
+		DefaultService: types.NewDefaultService("id", "@neb:hyrule", ServiceType),
+		Birthdays: []Birthday{
+			{RoomID: roomID, Who: "@zelda:hyrule", Month: time.March, Day: 14},
+			{RoomID: roomID, Who: "Hyrule Castle", Month: time.March, Day: 14, Year: 1986},
+			{RoomID: roomID, Who: "@ganon:hyrule", Month: time.March, Day: 20},
+		},
+	}
+
+	// Before celebrateHour nothing is sent, and the service waits until celebrateHour.
+	early := time.Date(2027, 3, 14, 7, 0, 0, 0, time.UTC)
+	if next := s.celebrateDue(cli, early); len(sent) != 0 || !next.Equal(early.Add(2*time.Hour)) {
+		t.Fatalf("Expected nothing to be sent before %d:00 and to wait until then, got %d sent and next %s", celebrateHour, len(sent), next)
+	}
+
+	next := s.celebrateDue(cli, early.Add(3*time.Hour))
+	if len(sent) != 2 {
+		t.Fatalf("Expected 2 birthdays to be celebrated, got %d", len(sent))
+	}
+	if want := "🎂 Happy birthday, @zelda:hyrule! 🎉"; sent[0].Body != want {
+		t.Errorf("Bad birthday message: want %q, got %q", want, sent[0].Body)
+	}
+	if !strings.Contains(sent[0].FormattedBody, `href="https://matrix.to/#/@zelda:hyrule"`) {
+		t.Errorf("Expected birthday message to mention the user, got %q", sent[0].FormattedBody)
+	}
+	if want := "🎂 Happy 41st birthday, Hyrule Castle! 🎉"; sent[1].Body != want {
+		t.Errorf("Bad birthday message: want %q, got %q", want, sent[1].Body)
+	}
+	if s.Birthdays[0].LastCelebratedYear != 2027 || s.Birthdays[2].LastCelebratedYear != 0 {
+		t.Errorf("Expected only celebrated birthdays to be marked as celebrated, got %+v", s.Birthdays)
+	}
+	if want := early.Add(3*time.Hour + maxPollInterval); !next.Equal(want) {
+		t.Errorf("Expected to be polled again in %s, got %s", maxPollInterval, next)
+	}
+
+	// Birthdays are only celebrated once.
+	s.celebrateDue(cli, early.Add(4*time.Hour))
+	if len(sent) != 2 {
+		t.Errorf("Expected birthdays to be celebrated once, got %d messages", len(sent))
+	}
+}
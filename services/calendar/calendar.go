@@ -0,0 +1,479 @@
+// Package calendar implements a Service which announces upcoming events from iCal calendars.
+package calendar
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Calendar service
+const ServiceType = "calendar"
+
+// The number of events shown by "!calendar next".
+const numNext = 5
+
+// How long before an event starts it is announced, if a calendar doesn't say.
+const defaultRemindMinutes = 15
+
+// The time to wait between fetches of a calendar, if the service doesn't say, and the shortest.
+const (
+	defaultPollIntervalMins = 15
+	minPollIntervalMins     = 5
+)
+
+// The most announced occurrences remembered per calendar.
+const maxAnnounced = 1000
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Calendar is an iCal calendar whose events are announced into rooms.
+type Calendar struct {
+	// The URL of the calendar's .ics file, e.g. a Google Calendar "secret address in iCal format"
+	// or a CalDAV calendar's export URL. This may be a reference to a secret store, e.g.
+	// "vault:secret/data/go-neb#team_calendar". "webcal://" URLs are fetched with HTTPS.
+	URL string `json:"url"`
+	// The rooms to announce events into. This cannot be empty. A room may be a Space, or a label
+	// such as "label:backend-teams", see utils.ResolveRooms.
+	Rooms []id.RoomID `json:"rooms"`
+	// Optional. How many minutes before an event starts it is announced. Defaults to 15.
+	// Events which last all day are announced at 9am on the day instead.
+	RemindMinutes int `json:"remind_minutes"`
+	// Optional. The IANA time zone of times in the calendar which don't have one, and of all-day
+	// events, e.g. "Europe/London". Defaults to UTC.
+	Timezone string `json:"timezone"`
+	// True if the calendar couldn't be fetched when it was last polled. This is populated by
+	// Go-NEB. Use /getService to retrieve this value.
+	IsFailing bool `json:"is_failing"`
+	// Internal field. The events which have been announced, newest first, so that they are only
+	// announced once.
+	AnnouncedUIDs []string `json:"announced_uids"`
+}
+
+// Service contains the Config fields for the Calendar Service.
+//
+// Calendars are fetched every PollIntervalMins, and each event is announced into the calendar's
+// rooms RemindMinutes before it starts. Recurring events are supported for daily, weekly, monthly
+// and yearly rules. Times are shown in each room's "timezone" bot option, or UTC if there isn't one.
+//
+// Example request:
+//   {
+//       calendars: {
+//           "team": {
+//               url: "https://calendar.google.com/calendar/ical/abc%40group.calendar.google.com/private-123/basic.ics",
+//               rooms: ["!qmElAGdFYCHoCJuaNt:localhost"],
+//               remind_minutes: 10,
+//               timezone: "Europe/London"
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// A map of calendar names to calendars.
+	Calendars map[string]Calendar `json:"calendars"`
+	// Optional. The time to wait between fetches of each calendar. Defaults to 15 minutes, and
+	// can't be less than 5.
+	PollIntervalMins int `json:"poll_interval_mins"`
+}
+
+// fetched is a calendar's events, as of when it was last fetched.
+type fetched struct {
+	at     time.Time
+	events []event
+}
+
+// Parsed calendars are kept here between polls, keyed on their URL, so that they aren't fetched
+// every time an event is announced.
+var (
+	cacheMutex sync.Mutex
+	cache      = make(map[string]*fetched)
+)
+
+// Commands supported:
+//    !calendar today
+// Lists today's events from the calendars which announce into this room.
+//    !calendar next
+// Lists the next few events from the calendars which announce into this room.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"calendar", "today"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdToday(roomID, time.Now())
+			},
+		},
+		{
+			Path: []string{"calendar", "next"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdNext(roomID, time.Now())
+			},
+		},
+		{
+			Path: []string{"calendar"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return notice("Usage: !calendar today | !calendar next"), nil
+			},
+		},
+	}
+}
+
+func (s *Service) cmdToday(roomID id.RoomID, now time.Time) (interface{}, error) {
+	names := s.calendarsFor(roomID)
+	if len(names) == 0 {
+		return nil, errors.New("No calendars announce into this room")
+	}
+	loc := utils.RoomLocation(s.ServiceUserID(), roomID)
+	now = now.In(loc)
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	occs := s.occurrences(names, startOfDay, startOfDay.AddDate(0, 0, 1), now)
+	if len(occs) == 0 {
+		return notice("No events today."), nil
+	}
+	return eventList("Today's events:", occs, loc, false), nil
+}
+
+func (s *Service) cmdNext(roomID id.RoomID, now time.Time) (interface{}, error) {
+	names := s.calendarsFor(roomID)
+	if len(names) == 0 {
+		return nil, errors.New("No calendars announce into this room")
+	}
+	// Look a year ahead, which is far enough for all but the quietest calendars.
+	occs := s.occurrences(names, now, now.AddDate(1, 0, 0), now)
+	if len(occs) == 0 {
+		return notice("No upcoming events."), nil
+	}
+	if len(occs) > numNext {
+		occs = occs[:numNext]
+	}
+	return eventList("Upcoming events:", occs, utils.RoomLocation(s.ServiceUserID(), roomID), true), nil
+}
+
+// calendarsFor returns the names of the calendars which announce into the room.
+func (s *Service) calendarsFor(roomID id.RoomID) []string {
+	var names []string
+	for name, cal := range s.Calendars {
+		for _, r := range cal.Rooms {
+			if r == roomID {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// occurrences returns the occurrences of the named calendars' events which overlap [from, to),
+// fetching calendars which haven't been fetched recently. Calendars which can't be fetched are
+// skipped.
+func (s *Service) occurrences(names []string, from, to, now time.Time) []occurrence {
+	var occs []occurrence
+	for _, name := range names {
+		events, err := s.events(name, now)
+		if err != nil {
+			log.WithError(err).WithField("calendar", name).Error("Failed to fetch calendar")
+			continue
+		}
+		occs = append(occs, occurrences(events, from, to)...)
+	}
+	sort.SliceStable(occs, func(i, j int) bool { return occs[i].Start.Before(occs[j].Start) })
+	return occs
+}
+
+// events returns the events in the named calendar, fetching it if it hasn't been fetched within
+// the poll interval.
+func (s *Service) events(name string, now time.Time) ([]event, error) {
+	cal := s.Calendars[name]
+	cacheMutex.Lock()
+	f := cache[cal.URL]
+	cacheMutex.Unlock()
+	if f != nil && !now.Before(f.at) && now.Sub(f.at) < s.pollInterval() {
+		return f.events, nil
+	}
+	events, err := fetchCalendar(&cal)
+	if err != nil {
+		return nil, err
+	}
+	cacheMutex.Lock()
+	cache[cal.URL] = &fetched{at: now, events: events}
+	cacheMutex.Unlock()
+	return events, nil
+}
+
+func (s *Service) pollInterval() time.Duration {
+	mins := s.PollIntervalMins
+	if mins == 0 {
+		mins = defaultPollIntervalMins
+	} else if mins < minPollIntervalMins {
+		mins = minPollIntervalMins
+	}
+	return time.Duration(mins) * time.Minute
+}
+
+func fetchCalendar(cal *Calendar) ([]event, error) {
+	calURL, err := secrets.Resolve(cal.URL)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(calURL, "webcal://") {
+		calURL = "https://" + strings.TrimPrefix(calURL, "webcal://")
+	}
+	req, err := http.NewRequest("GET", calURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Go-NEB")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("HTTP %d", res.StatusCode)
+	}
+	return parseICal(res.Body, cal.location())
+}
+
+func (cal *Calendar) location() *time.Location {
+	if cal.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(cal.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func (cal *Calendar) remindBefore() time.Duration {
+	if cal.RemindMinutes <= 0 {
+		return defaultRemindMinutes * time.Minute
+	}
+	return time.Duration(cal.RemindMinutes) * time.Minute
+}
+
+// announceAt returns when the occurrence is announced.
+func (cal *Calendar) announceAt(o *occurrence) time.Time {
+	if o.AllDay {
+		return o.Start.Add(utils.DefaultTimeOfDay)
+	}
+	return o.Start.Add(-cal.remindBefore())
+}
+
+func (cal *Calendar) announced(key string) bool {
+	for _, k := range cal.AnnouncedUIDs {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// OnPoll announces the events which are due to be announced.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	return s.poll(cli, time.Now())
+}
+
+// poll announces events which are due at the given time and haven't been announced, stores the
+// service if any were, and returns when the next event is due to be announced or a calendar is
+// due to be fetched again. Events which have already started are not announced late.
+func (s *Service) poll(cli types.MatrixClient, now time.Time) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	next := now.Add(s.pollInterval())
+	changed := false
+	for name, cal := range s.Calendars {
+		events, err := s.events(name, now)
+		if err != nil {
+			logger.WithError(err).WithField("calendar", name).Error("Failed to fetch calendar")
+			polling.ReportError(s, fmt.Errorf("%s: %s", name, err))
+			if !cal.IsFailing {
+				cal.IsFailing = true
+				s.Calendars[name] = cal
+				changed = true
+			}
+			continue
+		}
+		if cal.IsFailing {
+			cal.IsFailing = false
+			changed = true
+		}
+		// Look far enough ahead to find every event announced before the next fetch.
+		lookahead := s.pollInterval() + cal.remindBefore() + 24*time.Hour
+		for _, o := range occurrences(events, now, now.Add(lookahead)) {
+			at := cal.announceAt(&o)
+			if at.After(now) {
+				if at.Before(next) {
+					next = at
+				}
+				continue
+			}
+			key := o.key()
+			if !o.Start.After(now) && !o.AllDay || cal.announced(key) {
+				continue
+			}
+			s.announce(cli, &cal, &o)
+			cal.AnnouncedUIDs = append([]string{key}, cal.AnnouncedUIDs...)
+			if len(cal.AnnouncedUIDs) > maxAnnounced {
+				cal.AnnouncedUIDs = cal.AnnouncedUIDs[:maxAnnounced]
+			}
+			changed = true
+		}
+		s.Calendars[name] = cal
+	}
+
+	if changed {
+		if _, err := database.GetServiceDB().StoreService(s); err != nil {
+			logger.WithError(err).Error("Failed to persist announced events")
+			polling.ReportError(s, err)
+		}
+	}
+	return next
+}
+
+func (s *Service) announce(cli types.MatrixClient, cal *Calendar, o *occurrence) {
+	for _, roomID := range cal.Rooms {
+		for _, toRoomID := range utils.ResolveRooms(cli, s.ServiceUserID(), roomID) {
+			loc := utils.RoomLocation(s.ServiceUserID(), toRoomID)
+			msg := eventList("📅 Starting soon:", []occurrence{*o}, loc, false)
+			if o.AllDay {
+				msg = eventList("📅 Today:", []occurrence{*o}, loc, false)
+			}
+			if _, err := cli.SendMessageEvent(toRoomID, mevt.EventMessage, msg); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"room_id": toRoomID,
+					"uid":     o.UID,
+				}).Error("Failed to announce event")
+				polling.ReportError(s, fmt.Errorf("event %s: %s", o.Summary, err))
+			}
+		}
+	}
+}
+
+// eventList returns a notice listing the occurrences under the title, with times in loc. If
+// withDates is true, the date of each event is shown too.
+func eventList(title string, occs []occurrence, loc *time.Location, withDates bool) *mevt.MessageEventContent {
+	var htmlBuf bytes.Buffer
+	htmlBuf.WriteString("<b>" + html.EscapeString(title) + "</b>")
+	for _, o := range occs {
+		when := o.Start.In(loc).Format("15:04") + "–" + o.End.In(loc).Format("15:04")
+		if o.AllDay {
+			when = "All day"
+		}
+		if withDates {
+			when = o.Start.In(loc).Format("Mon 2 Jan") + " " + when
+			if o.AllDay {
+				// All-day events are dates, not times, so they aren't moved into the room's time zone.
+				when = o.Start.Format("Mon 2 Jan") + " (all day)"
+			}
+		}
+		htmlLine := html.EscapeString(when) + " <b>" + html.EscapeString(o.Summary) + "</b>"
+		if o.URL != "" {
+			htmlLine = html.EscapeString(when) + fmt.Sprintf(` <a href="%s"><b>%s</b></a>`,
+				html.EscapeString(o.URL), html.EscapeString(o.Summary))
+		}
+		if o.Location != "" {
+			htmlLine += " (" + html.EscapeString(o.Location) + ")"
+		}
+		htmlBuf.WriteString("<br>" + htmlLine)
+	}
+	msg := utils.StrippedHTMLMessage(mevt.MsgNotice, htmlBuf.String())
+	return &msg
+}
+
+// Register makes sure that every calendar can be fetched and parsed and has a room.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Calendars) == 0 {
+		return errors.New("At least one calendar is required")
+	}
+	var old *Service
+	if o, ok := oldService.(*Service); ok {
+		old = o
+	}
+	for name, cal := range s.Calendars {
+		if len(cal.Rooms) == 0 {
+			return fmt.Errorf("Calendar %s has no rooms to announce events into", name)
+		}
+		if cal.Timezone != "" {
+			if _, err := time.LoadLocation(cal.Timezone); err != nil {
+				return fmt.Errorf("Calendar %s: bad timezone: %s", name, err)
+			}
+		}
+		events, err := fetchCalendar(&cal)
+		if err != nil {
+			return fmt.Errorf("Failed to read calendar %s: %s", name, err)
+		}
+		// Don't announce events again because the service was reconfigured.
+		if old != nil && len(cal.AnnouncedUIDs) == 0 {
+			cal.AnnouncedUIDs = old.Calendars[name].AnnouncedUIDs
+			s.Calendars[name] = cal
+		}
+		// The time zone may have changed, so replace what was fetched before.
+		cacheMutex.Lock()
+		cache[cal.URL] = &fetched{at: time.Now(), events: events}
+		cacheMutex.Unlock()
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+// TargetRooms returns the rooms events are announced into.
+func (s *Service) TargetRooms() []id.RoomID {
+	roomSet := make(map[id.RoomID]bool)
+	var roomIDs []id.RoomID
+	for _, cal := range s.Calendars {
+		for _, roomID := range cal.Rooms {
+			if !roomSet[roomID] {
+				roomSet[roomID] = true
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+	}
+	return roomIDs
+}
+
+func (s *Service) joinRooms(client types.MatrixClient) {
+	for _, roomID := range s.TargetRooms() {
+		if utils.IsLabel(roomID) {
+			continue // labelled rooms are joined by the service which labels them
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
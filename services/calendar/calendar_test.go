@@ -0,0 +1,184 @@
+package calendar
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+const teamCalendar = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:standup@hyrule\r\n" +
+	"SUMMARY:Standup\r\n" +
+	"DTSTART;TZID=Europe/London:20160104T093000\r\n" +
+	"DURATION:PT15M\r\n" +
+	"RRULE:FREQ=WEEKLY;BYDAY=MO,WE,FR\r\n" +
+	"EXDATE;TZID=Europe/London:20160106T093000\r\n" +
+	"BEGIN:VALARM\r\n" +
+	"TRIGGER:-PT5M\r\n" +
+	"SUMMARY:Not an event\r\n" +
+	"END:VALARM\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:standup@hyrule\r\n" +
+	"RECURRENCE-ID;TZID=Europe/London:20160108T093000\r\n" +
+	"SUMMARY:Standup (moved)\r\n" +
+	"DTSTART;TZID=Europe/London:20160108T110000\r\n" +
+	"DTEND;TZID=Europe/London:20160108T111500\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:retro@hyrule\r\n" +
+	"SUMMARY:Retro\\, with cake\r\n" +
+	"LOCATION:Great Deku\r\n" +
+	"  Tree\r\n" +
+	"DTSTART:20160105T150000Z\r\n" +
+	"DTEND:20160105T160000Z\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:holiday@hyrule\r\n" +
+	"SUMMARY:Hyrule Day\r\n" +
+	"DTSTART;VALUE=DATE:20160107\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestOccurrences(t *testing.T) {
+	events, err := parseICal(strings.NewReader(teamCalendar), time.UTC)
+	if err != nil {
+		t.Fatal("Failed to parse calendar: ", err)
+	}
+	from := time.Date(2016, 1, 4, 0, 0, 0, 0, time.UTC)
+	occs := occurrences(events, from, from.AddDate(0, 0, 7))
+	var got []string
+	for _, o := range occs {
+		got = append(got, o.Start.UTC().Format("Mon 15:04")+" "+o.Summary+" "+o.Location)
+	}
+	want := []string{
+		"Mon 09:30 Standup ",
+		"Tue 15:00 Retro, with cake Great Deku Tree",
+		"Thu 00:00 Hyrule Day ",
+		"Fri 11:00 Standup (moved) ",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("occurrences: want %q, got %q", want, got)
+	}
+	if occs[0].End.Sub(occs[0].Start) != 15*time.Minute {
+		t.Errorf("Expected the standup to last 15 minutes, got %s", occs[0].End.Sub(occs[0].Start))
+	}
+}
+
+func TestExpand(t *testing.T) {
+	start := time.Date(2016, 1, 31, 10, 0, 0, 0, time.UTC)
+	before := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	expandTests := []struct {
+		rrule string
+		want  int
+	}{
+		{"FREQ=DAILY;COUNT=3", 3},
+		{"FREQ=DAILY;INTERVAL=2;UNTIL=20160206", 4},
+		{"FREQ=WEEKLY;BYDAY=SU,TU", 96},
+		{"FREQ=MONTHLY", 7}, // months without a 31st are skipped
+		{"FREQ=YEARLY", 1},
+		{"FREQ=SECONDLY", 1},
+	}
+	for _, test := range expandTests {
+		if got := expand(start, test.rrule, before); len(got) != test.want {
+			t.Errorf("expand(%q): want %d occurrences, got %d", test.rrule, test.want, len(got))
+		}
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	fetches := 0
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "https://calendars.hyrule/team.ics" {
+			t.Fatalf("Unexpected calendar request: %s", req.URL)
+		}
+		fetches++
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(teamCalendar))}, nil
+	})}
+	var sent []string
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/hierarchy") {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		if strings.Contains(req.URL.Path, "/join/") {
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!team:hyrule"}`))}, nil
+		}
+		if !strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			t.Fatalf("Unexpected request: %s", req.URL)
+		}
+		var content mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			t.Fatal("Failed to decode message: ", err)
+		}
+		sent = append(sent, content.Body)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup"}`))}, nil
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"calendars": {
+			"team": {"url": "webcal://calendars.hyrule/team.ics", "rooms": ["!team:hyrule"], "remind_minutes": 10}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+	if err := s.Register(nil, cli); err != nil {
+		t.Fatal("Failed to register service: ", err)
+	}
+
+	// Ten minutes before the retro, which is in UTC
+	now := time.Date(2016, 1, 5, 14, 50, 0, 0, time.UTC)
+	next := s.poll(cli, now)
+	if want := now.Add(15 * time.Minute); !next.Equal(want) {
+		t.Errorf("Expected the next poll at %s, got %s", want, next)
+	}
+	s.poll(cli, now.Add(5*time.Minute))
+	want := []string{"📅 Starting soon:\n15:00–16:00 Retro, with cake (Great Deku Tree)"}
+	if strings.Join(sent, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected announcements %q, got %q", want, sent)
+	}
+	if len(s.Calendars["team"].AnnouncedUIDs) != 1 {
+		t.Errorf("Expected the retro to be remembered, got %q", s.Calendars["team"].AnnouncedUIDs)
+	}
+
+	// The holiday is announced at 9am on the day, and isn't announced again
+	sent = nil
+	day := time.Date(2016, 1, 7, 9, 0, 0, 0, time.UTC)
+	s.poll(cli, day)
+	s.poll(cli, day.Add(time.Hour))
+	want = []string{"📅 Today:\nAll day Hyrule Day"}
+	if strings.Join(sent, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected announcements %q, got %q", want, sent)
+	}
+
+	res, err := s.cmdNext("!team:hyrule", day.Add(time.Hour))
+	if err != nil {
+		t.Fatal("!calendar next failed: ", err)
+	}
+	body := res.(*mevt.MessageEventContent).Body
+	if !strings.HasPrefix(body, "Upcoming events:\nThu 7 Jan (all day) Hyrule Day\nFri 8 Jan 11:00–11:15 Standup (moved)") {
+		t.Errorf("Unexpected !calendar next response: %q", body)
+	}
+	if _, err := s.cmdToday("!elsewhere:hyrule", day.Add(time.Hour)); err == nil {
+		t.Error("Expected !calendar today to fail in a room without calendars")
+	}
+	// Once when registering, then whenever a poll is more than 15 minutes after the last fetch
+	if fetches != 4 {
+		t.Errorf("Expected the calendar to be fetched 4 times, got %d", fetches)
+	}
+}
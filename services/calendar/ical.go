@@ -0,0 +1,386 @@
+package calendar
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The most occurrences of a recurring event which are expanded, so that a rule with no end can't
+// loop forever.
+const maxOccurrences = 5000
+
+// event is a VEVENT from an iCalendar file. Recurring events are expanded into occurrences.
+type event struct {
+	UID      string
+	Summary  string
+	Location string
+	URL      string
+	Start    time.Time
+	End      time.Time
+	// True if the event lasts whole days, e.g. a holiday.
+	AllDay bool
+	// The recurrence rule, e.g. "FREQ=WEEKLY;BYDAY=MO,WE", or "" if the event doesn't repeat.
+	RRule string
+	// The start times of occurrences which don't happen.
+	ExDates []time.Time
+	// For an occurrence of a recurring event which was moved or changed, the start time of the
+	// occurrence it replaces.
+	RecurrenceID time.Time
+	Cancelled    bool
+}
+
+// occurrence is a single time an event happens.
+type occurrence struct {
+	UID      string
+	Summary  string
+	Location string
+	URL      string
+	Start    time.Time
+	End      time.Time
+	AllDay   bool
+}
+
+// key identifies the occurrence, so that it is only announced once.
+func (o *occurrence) key() string {
+	return o.UID + "/" + o.Start.UTC().Format("20060102T150405Z")
+}
+
+// property is a content line, e.g. "DTSTART;TZID=Europe/London:20160101T090000".
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+var durationRegex = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseICal returns the events in an iCalendar file. Times without a time zone are in loc.
+// Components other than VEVENT, such as VTODO and VALARM, are ignored.
+func parseICal(r io.Reader, loc *time.Location) ([]event, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+	var events []event
+	var ev *event
+	var duration time.Duration
+	// Components nested in the current event, e.g. VALARM, whose properties are skipped.
+	nested := 0
+	for _, line := range lines {
+		p, ok := parseProperty(line)
+		if !ok {
+			continue
+		}
+		switch {
+		case p.name == "BEGIN" && p.value == "VEVENT" && ev == nil:
+			ev = &event{}
+			duration = 0
+			continue
+		case p.name == "BEGIN" && ev != nil:
+			nested++
+			continue
+		case p.name == "END" && nested > 0:
+			nested--
+			continue
+		case p.name == "END" && p.value == "VEVENT" && ev != nil:
+			if ev.End.IsZero() {
+				switch {
+				case duration != 0:
+					ev.End = ev.Start.Add(duration)
+				case ev.AllDay:
+					ev.End = ev.Start.AddDate(0, 0, 1)
+				default:
+					ev.End = ev.Start
+				}
+			}
+			if ev.Start.IsZero() {
+				return nil, fmt.Errorf("event %q has no DTSTART", ev.Summary)
+			}
+			events = append(events, *ev)
+			ev = nil
+			continue
+		}
+		if ev == nil || nested > 0 {
+			continue
+		}
+
+		switch p.name {
+		case "UID":
+			ev.UID = p.value
+		case "SUMMARY":
+			ev.Summary = unescapeText(p.value)
+		case "LOCATION":
+			ev.Location = unescapeText(p.value)
+		case "URL":
+			ev.URL = p.value
+		case "STATUS":
+			ev.Cancelled = p.value == "CANCELLED"
+		case "RRULE":
+			ev.RRule = p.value
+		case "DTSTART":
+			ev.Start, ev.AllDay, err = parseDateTime(p, loc)
+		case "DTEND":
+			ev.End, _, err = parseDateTime(p, loc)
+		case "RECURRENCE-ID":
+			ev.RecurrenceID, _, err = parseDateTime(p, loc)
+		case "DURATION":
+			duration, err = parseDuration(p.value)
+		case "EXDATE":
+			for _, v := range strings.Split(p.value, ",") {
+				var t time.Time
+				t, _, err = parseDateTime(property{p.name, p.params, v}, loc)
+				if err != nil {
+					break
+				}
+				ev.ExDates = append(ev.ExDates, t)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad %s %q: %s", p.name, p.value, err)
+		}
+	}
+	return events, nil
+}
+
+// unfold joins lines which were folded by starting the continuation with a space or tab.
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+func parseProperty(line string) (property, bool) {
+	// The value starts after the first colon which isn't in a quoted parameter.
+	inQuotes := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			inQuotes = !inQuotes
+		} else if c == ':' && !inQuotes {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return property{}, false
+	}
+	parts := strings.Split(line[:colon], ";")
+	p := property{
+		name:   strings.ToUpper(parts[0]),
+		params: make(map[string]string),
+		value:  line[colon+1:],
+	}
+	for _, param := range parts[1:] {
+		if eq := strings.Index(param, "="); eq > 0 {
+			p.params[strings.ToUpper(param[:eq])] = strings.Trim(param[eq+1:], `"`)
+		}
+	}
+	return p, true
+}
+
+func unescapeText(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
+
+// parseDateTime parses a DATE or DATE-TIME value, returning true if it is a DATE.
+func parseDateTime(p property, loc *time.Location) (time.Time, bool, error) {
+	if tzid := p.params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	if p.params["VALUE"] == "DATE" || len(p.value) == 8 {
+		t, err := time.ParseInLocation("20060102", p.value, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(p.value, "Z") {
+		t, err := time.Parse("20060102T150405Z", p.value)
+		return t, false, err
+	}
+	t, err := time.ParseInLocation("20060102T150405", p.value, loc)
+	return t, false, err
+}
+
+// parseDuration parses a DURATION value, e.g. "PT1H30M".
+func parseDuration(s string) (time.Duration, error) {
+	m := durationRegex.FindStringSubmatch(s)
+	if m == nil || s == "P" || s == "PT" {
+		return 0, fmt.Errorf("not a duration")
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if m[i+2] != "" {
+			n, _ := strconv.Atoi(m[i+2])
+			d += time.Duration(n) * unit
+		}
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// occurrences returns the occurrences of the events which overlap [from, to), in order of start
+// time. Recurrence rules support FREQ, INTERVAL, COUNT, UNTIL and, for weekly rules, BYDAY.
+// Cancelled occurrences are left out.
+func occurrences(events []event, from, to time.Time) []occurrence {
+	// Occurrences which were moved or changed replace the occurrence they were recurrences of.
+	overridden := make(map[string]bool)
+	for _, ev := range events {
+		if !ev.RecurrenceID.IsZero() {
+			overridden[ev.UID+"/"+ev.RecurrenceID.UTC().Format(time.RFC3339)] = true
+		}
+	}
+
+	var occs []occurrence
+	for _, ev := range events {
+		length := ev.End.Sub(ev.Start)
+		starts := []time.Time{ev.Start}
+		if ev.RRule != "" && ev.RecurrenceID.IsZero() {
+			starts = expand(ev.Start, ev.RRule, to)
+		}
+		for _, start := range starts {
+			if ev.Cancelled || (ev.RecurrenceID.IsZero() && ev.RRule != "" && overridden[ev.UID+"/"+start.UTC().Format(time.RFC3339)]) {
+				continue
+			}
+			if excluded(start, ev.ExDates) {
+				continue
+			}
+			end := start.Add(length)
+			// Events without a length overlap if they start in the range.
+			if !start.Before(to) || (end.Before(from) || end.Equal(from)) && start.Before(from) {
+				continue
+			}
+			occs = append(occs, occurrence{
+				UID:      ev.UID,
+				Summary:  ev.Summary,
+				Location: ev.Location,
+				URL:      ev.URL,
+				Start:    start,
+				End:      end,
+				AllDay:   ev.AllDay,
+			})
+		}
+	}
+	sort.SliceStable(occs, func(i, j int) bool { return occs[i].Start.Before(occs[j].Start) })
+	return occs
+}
+
+func excluded(start time.Time, exDates []time.Time) bool {
+	for _, ex := range exDates {
+		if ex.Equal(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// expand returns the start times of a recurring event which start before the given time.
+func expand(dtstart time.Time, rrule string, before time.Time) []time.Time {
+	rule := make(map[string]string)
+	for _, part := range strings.Split(rrule, ";") {
+		if eq := strings.Index(part, "="); eq > 0 {
+			rule[strings.ToUpper(part[:eq])] = part[eq+1:]
+		}
+	}
+	interval, _ := strconv.Atoi(rule["INTERVAL"])
+	if interval < 1 {
+		interval = 1
+	}
+	count, _ := strconv.Atoi(rule["COUNT"])
+	var until time.Time
+	if u := rule["UNTIL"]; u != "" {
+		until, _, _ = parseDateTime(property{value: u, params: map[string]string{}}, dtstart.Location())
+		if len(u) == 8 {
+			// A date includes the whole day
+			until = until.AddDate(0, 0, 1).Add(-time.Second)
+		}
+	}
+	var byDay []time.Weekday
+	for _, d := range strings.Split(rule["BYDAY"], ",") {
+		if wd, ok := weekdayCodes[strings.ToUpper(d)]; ok {
+			byDay = append(byDay, wd)
+		}
+	}
+	sort.Slice(byDay, func(i, j int) bool {
+		return (byDay[i]+6)%7 < (byDay[j]+6)%7 // weeks start on Monday
+	})
+
+	var starts []time.Time
+	add := func(t time.Time) bool {
+		if (count > 0 && len(starts) >= count) || (!until.IsZero() && t.After(until)) ||
+			!t.Before(before) || len(starts) >= maxOccurrences {
+			return false
+		}
+		starts = append(starts, t)
+		return true
+	}
+	for i := 0; i < maxOccurrences*7; i++ {
+		n := i * interval
+		switch rule["FREQ"] {
+		case "DAILY":
+			if !add(dtstart.AddDate(0, 0, n)) {
+				return starts
+			}
+		case "WEEKLY":
+			week := dtstart.AddDate(0, 0, 7*n)
+			if len(byDay) == 0 {
+				if !add(week) {
+					return starts
+				}
+				continue
+			}
+			monday := week.AddDate(0, 0, -int((week.Weekday()+6)%7))
+			for _, wd := range byDay {
+				t := monday.AddDate(0, 0, int((wd+6)%7))
+				if t.Before(dtstart) {
+					continue
+				}
+				if !add(t) {
+					return starts
+				}
+			}
+		case "MONTHLY":
+			t := dtstart.AddDate(0, n, 0)
+			if t.Day() != dtstart.Day() {
+				continue // e.g. the 31st in a shorter month
+			}
+			if !add(t) {
+				return starts
+			}
+		case "YEARLY":
+			t := dtstart.AddDate(n, 0, 0)
+			if t.Day() != dtstart.Day() {
+				continue // the 29th of February
+			}
+			if !add(t) {
+				return starts
+			}
+		default:
+			// An unsupported rule, so just the first occurrence
+			add(dtstart)
+			return starts
+		}
+	}
+	return starts
+}
@@ -0,0 +1,560 @@
+// Package deploy implements a Service which triggers deploys with GitHub Actions, GitLab CI or
+// Argo CD and reports on their progress.
+package deploy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Deploy service
+const ServiceType = "deploy"
+
+const (
+	// How often the status of running deploys is checked.
+	pollInterval = 30 * time.Second
+	// How long a deploy is tracked for before Go-NEB gives up on it.
+	maxTrackTime = 6 * time.Hour
+	// How long a deploy waits for approval before it is dropped.
+	approvalExpiry = 24 * time.Hour
+)
+
+// statusStarting is the status of a deploy which is being triggered.
+const statusStarting = "starting"
+
+// The subcommands of !deploy, which can't be used as environment names.
+var subcommands = map[string]bool{
+	"approve": true,
+	"cancel":  true,
+	"list":    true,
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Environment is somewhere which can be deployed to.
+type Environment struct {
+	// Either "github", "gitlab" or "argocd".
+	Provider string `json:"provider"`
+	// The API URL. Defaults to "https://api.github.com" for Github and "https://gitlab.com" for
+	// GitLab. Required for Argo CD, e.g. "https://argocd.example.org".
+	URL string `json:"url"`
+	// The repository ("owner/repo") for Github, the project ("group/project" or its ID) for
+	// GitLab, or the application name for Argo CD.
+	Project string `json:"project"`
+	// The workflow file name or ID, e.g. "deploy.yml". Github only. The workflow must have a
+	// workflow_dispatch trigger.
+	Workflow string `json:"workflow"`
+	// The API token. This may instead be a reference to a secret store, see the secrets package.
+	Token string `json:"token"`
+	// Inputs for the Github workflow or variables for the GitLab pipeline, e.g.
+	// {"environment": "production"}. Ignored by Argo CD.
+	Variables map[string]string `json:"variables"`
+	// The rooms !deploy can be used in for this environment. Status updates are sent into the
+	// room the deploy was started from.
+	Rooms []id.RoomID `json:"rooms"`
+	// Who can deploy to this environment. Defaults to users with a power level of 50 in the room.
+	ACL *types.ACL `json:"acl,omitempty"`
+	// If true, deploys must be approved with !deploy approve by someone other than the user
+	// who asked for them before they start.
+	RequireApproval bool `json:"require_approval"`
+	// Who can approve deploys. Defaults to users with a power level of 50 in the room.
+	Approvers *types.ACL `json:"approvers,omitempty"`
+}
+
+// allowsRoom returns true if !deploy can be used in the room for this environment.
+func (env *Environment) allowsRoom(roomID id.RoomID) bool {
+	for _, r := range env.Rooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// Run is a deploy which has been asked for. This is populated by Go-NEB.
+type Run struct {
+	// The ID of the deploy, used to approve or cancel it.
+	ID string `json:"id"`
+	// The environment being deployed to.
+	Environment string `json:"environment"`
+	// The branch, tag or commit being deployed.
+	Ref string `json:"ref"`
+	// The room status updates are sent into.
+	RoomID id.RoomID `json:"room_id"`
+	// The user who asked for the deploy.
+	RequestedBy id.UserID `json:"requested_by"`
+	// The user who approved the deploy, if it needed approval.
+	ApprovedBy id.UserID `json:"approved_by,omitempty"`
+	// When the deploy was asked for.
+	RequestedAtSecs int64 `json:"requested_at_secs"`
+	// When the deploy was started, or 0 if it is waiting for approval.
+	TriggeredAtSecs int64 `json:"triggered_at_secs,omitempty"`
+	// The provider's ID for the deploy, e.g. the pipeline ID.
+	ProviderID string `json:"provider_id,omitempty"`
+	// A link to the deploy.
+	URL string `json:"url,omitempty"`
+	// The last status reported by the provider.
+	Status string `json:"status,omitempty"`
+}
+
+func (r *Run) awaitingApproval() bool {
+	return r.TriggeredAtSecs == 0
+}
+
+func (r *Run) describe() string {
+	return fmt.Sprintf("Deploy %s of %s to %s", r.ID, r.Ref, r.Environment)
+}
+
+// Service contains the Config fields for the Deploy Service.
+//
+// Each environment triggers a GitHub Actions workflow, a GitLab pipeline or an Argo CD sync.
+// Deploys are tracked until they finish, and their status is sent into the room they were
+// started from.
+//
+// Example request:
+//   {
+//       "environments": {
+//           "staging": {
+//               "provider": "github",
+//               "project": "matrix-org/go-neb",
+//               "workflow": "deploy.yml",
+//               "token": "vault:secret/data/go-neb#github_deploy_token",
+//               "variables": {"environment": "staging"},
+//               "rooms": ["!qmElAGdFYCHoCJuaNt:localhost"]
+//           },
+//           "production": {
+//               "provider": "argocd",
+//               "url": "https://argocd.example.org",
+//               "project": "go-neb",
+//               "token": "vault:secret/data/go-neb#argocd_token",
+//               "rooms": ["!qmElAGdFYCHoCJuaNt:localhost"],
+//               "acl": {"users": ["@alice:localhost", "@bob:localhost"]},
+//               "require_approval": true,
+//               "approvers": {"users": ["@alice:localhost", "@bob:localhost"]}
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// A map of environment name to how to deploy to it.
+	Environments map[string]Environment `json:"environments"`
+	// Deploys which are waiting for approval or still running. This is populated by Go-NEB.
+	Runs []Run `json:"runs"`
+	// The ID to give the next deploy. This is populated by Go-NEB.
+	NextID int `json:"next_id"`
+}
+
+// Register makes sure the Config information supplied is valid, and keeps track of any deploys
+// which were running before the config changed.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Environments) == 0 {
+		return errors.New("At least one environment is required")
+	}
+	for name, env := range s.Environments {
+		if name == "" || strings.ContainsAny(name, " \t\n") || subcommands[name] {
+			return fmt.Errorf("Bad environment name %q", name)
+		}
+		if _, err := newProvider(&env); err != nil {
+			return fmt.Errorf("Environment %s: %s", name, err)
+		}
+		if len(env.Rooms) == 0 {
+			return fmt.Errorf("Environment %s must have at least one room", name)
+		}
+		for _, roomID := range env.Rooms {
+			if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+				log.WithError(err).WithField("room_id", roomID).Error("Failed to join room")
+			}
+		}
+	}
+	if old, ok := oldService.(*Service); ok && s.Runs == nil {
+		s.Runs, s.NextID = old.Runs, old.NextID
+	}
+	return nil
+}
+
+// Commands supported:
+//    !deploy production v1.2.0
+// Deploys the branch, tag or commit to the environment, or asks for approval if the environment
+// needs it.
+//    !deploy approve 3
+// Approves deploy 3, which starts it.
+//    !deploy cancel 3
+// Cancels deploy 3 if it is waiting for approval.
+//    !deploy list
+// Lists the deploys in this room which are waiting for approval or still running.
+// Who can deploy to and approve deploys to each environment is configured per environment. All
+// but !deploy list are privileged commands, so the service's or room's ACL must allow the user too.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:       []string{"deploy", "approve"},
+			Privileged: true,
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdApprove(cli, roomID, userID, args)
+			},
+		},
+		{
+			Path:       []string{"deploy", "cancel"},
+			Privileged: true,
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdCancel(cli, roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"deploy", "list"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdList(roomID)
+			},
+		},
+		{
+			Path:       []string{"deploy"},
+			Privileged: true,
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdDeploy(cli, roomID, userID, args)
+			},
+		},
+	}
+}
+
+func usageMessage() *mevt.MessageEventContent {
+	return notice("Usage: !deploy environment ref | !deploy approve id | !deploy cancel id | !deploy list")
+}
+
+func (s *Service) cmdDeploy(cli types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return usageMessage(), nil
+	}
+	name, ref := args[0], args[1]
+	env, ok := s.Environments[name]
+	if !ok || !env.allowsRoom(roomID) {
+		return nil, fmt.Errorf("There is no environment %s which can be deployed to from this room", name)
+	}
+	if !env.ACL.AllowsInRoom(cli, roomID, userID) {
+		return nil, fmt.Errorf("You don't have permission to deploy to %s", name)
+	}
+	run := Run{
+		Environment:     name,
+		Ref:             ref,
+		RoomID:          roomID,
+		RequestedBy:     userID,
+		RequestedAtSecs: time.Now().Unix(),
+	}
+	res, err := s.update(func(latest *Service) (interface{}, error) {
+		latest.NextID++
+		run.ID = strconv.Itoa(latest.NextID)
+		if env.RequireApproval {
+			latest.Runs = append(latest.Runs, run)
+			return notice(fmt.Sprintf("%s needs approval. Someone else who can approve it should run !deploy approve %s",
+				run.describe(), run.ID)), nil
+		}
+		run.TriggeredAtSecs = time.Now().Unix()
+		run.Status = statusStarting
+		latest.Runs = append(latest.Runs, run)
+		return nil, nil
+	})
+	if err != nil || env.RequireApproval {
+		return res, err
+	}
+	return s.start(&env, run)
+}
+
+func (s *Service) cmdApprove(cli types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return usageMessage(), nil
+	}
+	var env Environment
+	var run Run
+	_, err := s.update(func(latest *Service) (interface{}, error) {
+		r, err := latest.awaitingApproval(roomID, args[0])
+		if err != nil {
+			return nil, err
+		}
+		e, ok := latest.Environments[r.Environment]
+		if !ok {
+			return nil, fmt.Errorf("The environment %s no longer exists", r.Environment)
+		}
+		if userID == r.RequestedBy {
+			return nil, errors.New("Deploys must be approved by someone other than the user who asked for them")
+		}
+		if !e.Approvers.AllowsInRoom(cli, roomID, userID) {
+			return nil, fmt.Errorf("You don't have permission to approve deploys to %s", r.Environment)
+		}
+		r.ApprovedBy = userID
+		r.TriggeredAtSecs = time.Now().Unix()
+		r.Status = statusStarting
+		env, run = e, *r
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.start(&env, run)
+}
+
+func (s *Service) cmdCancel(cli types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return usageMessage(), nil
+	}
+	return s.update(func(latest *Service) (interface{}, error) {
+		run, err := latest.awaitingApproval(roomID, args[0])
+		if err != nil {
+			return nil, err
+		}
+		// Either the user who asked for the deploy or an approver can cancel it.
+		env := latest.Environments[run.Environment]
+		if userID != run.RequestedBy && !env.Approvers.AllowsInRoom(cli, roomID, userID) {
+			return nil, fmt.Errorf("You don't have permission to cancel deploys to %s", run.Environment)
+		}
+		latest.removeRun(run.ID)
+		return notice(fmt.Sprintf("Cancelled deploy %s.", args[0])), nil
+	})
+}
+
+func (s *Service) cmdList(roomID id.RoomID) (interface{}, error) {
+	var buf bytes.Buffer
+	for _, r := range s.Runs {
+		if r.RoomID != roomID {
+			continue
+		}
+		status := r.Status
+		if r.awaitingApproval() {
+			status = "awaiting approval"
+		}
+		buf.WriteString(fmt.Sprintf("%s, asked for by %s: %s\n", r.describe(), r.RequestedBy, status))
+	}
+	if buf.Len() == 0 {
+		return notice("There are no deploys waiting for approval or running in this room."), nil
+	}
+	return notice(strings.TrimSuffix(buf.String(), "\n")), nil
+}
+
+// awaitingApproval returns the deploy with the ID in the room if it is waiting for approval.
+func (s *Service) awaitingApproval(roomID id.RoomID, runID string) (*Run, error) {
+	for i := range s.Runs {
+		r := &s.Runs[i]
+		if r.ID == runID && r.RoomID == roomID {
+			if !r.awaitingApproval() {
+				return nil, fmt.Errorf("Deploy %s has already started", runID)
+			}
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("There is no deploy %s waiting for approval in this room", runID)
+}
+
+func (s *Service) removeRun(runID string) {
+	for i, r := range s.Runs {
+		if r.ID == runID {
+			s.Runs = append(s.Runs[:i], s.Runs[i+1:]...)
+			return
+		}
+	}
+}
+
+// start triggers a deploy which has been stored as starting, then stores whether it started. The
+// deploy is stored first so that it can't be started twice, and triggered without holding the
+// service's lock so that other !deploy commands don't wait for the provider. A deploy which fails
+// to start goes back to waiting for approval if it was approved, and is dropped otherwise.
+func (s *Service) start(env *Environment, run Run) (interface{}, error) {
+	triggerErr := s.trigger(env, &run)
+	_, err := s.update(func(latest *Service) (interface{}, error) {
+		for i := range latest.Runs {
+			r := &latest.Runs[i]
+			if r.ID != run.ID {
+				continue
+			}
+			switch {
+			case triggerErr == nil:
+				r.ProviderID, r.URL, r.Status = run.ProviderID, run.URL, run.Status
+			case r.ApprovedBy != "":
+				r.ApprovedBy, r.TriggeredAtSecs, r.Status = "", 0, ""
+			default:
+				latest.removeRun(r.ID)
+			}
+			break
+		}
+		return nil, nil
+	})
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"service_id": s.ServiceID(),
+			"deploy_id":  run.ID,
+		}).Error("Failed to store whether deploy started")
+	}
+	if triggerErr != nil {
+		return nil, triggerErr
+	}
+	return startedMessage(&run), nil
+}
+
+// trigger asks the provider to start the deploy.
+func (s *Service) trigger(env *Environment, run *Run) error {
+	p, err := newProvider(env)
+	if err == nil {
+		err = p.trigger(run)
+	}
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"service_id":  s.ServiceID(),
+			"environment": run.Environment,
+			"ref":         run.Ref,
+		}).Error("Failed to trigger deploy")
+		return fmt.Errorf("Failed to start deploy to %s: %s", run.Environment, err)
+	}
+	run.Status = "started"
+	return nil
+}
+
+func startedMessage(run *Run) *mevt.MessageEventContent {
+	body := run.describe() + " started."
+	if run.URL != "" {
+		body += " " + run.URL
+	}
+	return notice(body)
+}
+
+// update applies fn to the latest copy of the service, see polling.Update.
+func (s *Service) update(fn func(latest *Service) (interface{}, error)) (interface{}, error) {
+	return polling.Update(s, true, func(latest types.Service) (interface{}, error) {
+		return fn(latest.(*Service))
+	})
+}
+
+// OnPoll checks the status of running deploys, sending any changes into their rooms, and drops
+// deploys which have waited too long for approval. Returns when to check again, or 0 if there
+// is nothing left to track.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	defer polling.Lock(s)()
+	latest := polling.Latest(s).(*Service)
+	s.Runs, s.NextID = latest.Runs, latest.NextID
+
+	now := time.Now()
+	changed := false
+	var remaining []Run
+	var next time.Time
+	for _, r := range s.Runs {
+		if r.awaitingApproval() {
+			expiry := time.Unix(r.RequestedAtSecs, 0).Add(approvalExpiry)
+			if now.After(expiry) {
+				s.send(cli, r, notice(r.describe()+" wasn't approved in time, so it has been cancelled."))
+				changed = true
+				continue
+			}
+			if next.IsZero() || expiry.Before(next) {
+				next = expiry
+			}
+			remaining = append(remaining, r)
+			continue
+		}
+		updated, tracking := s.poll(cli, &r, now)
+		if updated || !tracking {
+			changed = true
+		}
+		if !tracking {
+			continue
+		}
+		remaining = append(remaining, r)
+		if at := now.Add(pollInterval); next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	s.Runs = remaining
+
+	if changed {
+		if _, err := database.GetServiceDB().StoreService(s); err != nil {
+			log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to persist deploys")
+			polling.ReportError(s, err)
+		}
+	}
+	if next.IsZero() {
+		return time.Unix(0, 0)
+	}
+	return next
+}
+
+// poll checks the status of a running deploy, sending it into the room if it has changed.
+// Returns whether the run was updated, and false for tracking once it has finished or can no
+// longer be tracked.
+func (s *Service) poll(cli types.MatrixClient, r *Run, now time.Time) (updated, tracking bool) {
+	logger := log.WithFields(log.Fields{
+		"service_id":  s.ServiceID(),
+		"environment": r.Environment,
+		"deploy_id":   r.ID,
+	})
+	if now.Sub(time.Unix(r.TriggeredAtSecs, 0)) > maxTrackTime {
+		s.send(cli, *r, notice(fmt.Sprintf("%s hasn't finished after %s, so its status will no longer be reported.",
+			r.describe(), utils.HumanDuration(maxTrackTime))))
+		return false, false
+	}
+	if r.Status == statusStarting {
+		return false, true // it is still being triggered
+	}
+	env, ok := s.Environments[r.Environment]
+	if !ok {
+		logger.Warn("Environment no longer exists, no longer tracking deploy")
+		return false, false
+	}
+	p, err := newProvider(&env)
+	if err != nil {
+		logger.WithError(err).Error("Bad environment, no longer tracking deploy")
+		return false, false
+	}
+	prevURL := r.URL
+	status, done, err := p.status(r)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to check deploy status")
+		polling.ReportError(s, fmt.Errorf("deploy %s: %s", r.ID, err))
+		return false, true
+	}
+	if status == r.Status && !done {
+		return r.URL != prevURL, true
+	}
+	body := fmt.Sprintf("%s: %s", r.describe(), status)
+	if done {
+		body = fmt.Sprintf("%s finished: %s", r.describe(), status)
+	}
+	if r.URL != "" {
+		body += " " + r.URL
+	}
+	s.send(cli, *r, notice(body))
+	r.Status = status
+	return true, !done
+}
+
+func (s *Service) send(cli types.MatrixClient, r Run, content *mevt.MessageEventContent) {
+	if _, err := cli.SendMessageEvent(r.RoomID, mevt.EventMessage, content); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"room_id":   r.RoomID,
+			"deploy_id": r.ID,
+		}).Error("Failed to send deploy status")
+		polling.ReportError(s, fmt.Errorf("deploy %s: %s", r.ID, err))
+	}
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
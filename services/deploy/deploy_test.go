@@ -0,0 +1,236 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const deployConfig = `{
+	"environments": {
+		"staging": {
+			"provider": "gitlab",
+			"url": "https://gitlab.example",
+			"project": "hyrule/castle",
+			"token": "triforce",
+			"variables": {"ENVIRONMENT": "staging"},
+			"rooms": ["!ops:hyrule"],
+			"acl": {"users": ["@link:hyrule"]}
+		},
+		"production": {
+			"provider": "gitlab",
+			"url": "https://gitlab.example",
+			"project": "hyrule/castle",
+			"token": "triforce",
+			"rooms": ["!ops:hyrule"],
+			"acl": {"users": ["@link:hyrule"]},
+			"require_approval": true,
+			"approvers": {"users": ["@link:hyrule", "@zelda:hyrule"]}
+		}
+	}
+}`
+
+// matrixClient returns a client which records the messages it sends and has no power levels.
+func matrixClient(t *testing.T, sent *[]string) *mautrix.Client {
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/state/m.room.power_levels") {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_NOT_FOUND"}`))}, nil
+		}
+		if !strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			t.Fatalf("Unexpected request: %s", req.URL)
+		}
+		var content mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			t.Fatal("Failed to decode message: ", err)
+		}
+		*sent = append(*sent, content.Body)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup"}`))}, nil
+	})}
+	return cli
+}
+
+func command(s *Service, cli types.MatrixClient, path ...string) func(id.RoomID, id.UserID, []string) (interface{}, error) {
+	for _, cmd := range s.Commands(cli) {
+		if strings.Join(cmd.Path, " ") == strings.Join(path, " ") {
+			return cmd.Command
+		}
+	}
+	return nil
+}
+
+func TestDeploy(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	pipelineStatus := "running"
+	var triggered map[string]interface{}
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("PRIVATE-TOKEN") != "triforce" {
+			t.Errorf("Bad GitLab token: %s", req.Header.Get("PRIVATE-TOKEN"))
+		}
+		var body string
+		switch req.Method + " " + req.URL.String() {
+		case "POST https://gitlab.example/api/v4/projects/hyrule%2Fcastle/pipeline":
+			if err := json.NewDecoder(req.Body).Decode(&triggered); err != nil {
+				t.Fatal("Failed to decode pipeline request: ", err)
+			}
+			body = `{"id": 42, "status": "created", "web_url": "https://gitlab.example/hyrule/castle/-/pipelines/42"}`
+		case "GET https://gitlab.example/api/v4/projects/hyrule%2Fcastle/pipelines/42":
+			body = `{"id": 42, "status": "` + pipelineStatus + `", "web_url": "https://gitlab.example/hyrule/castle/-/pipelines/42"}`
+		default:
+			t.Fatalf("Unexpected GitLab request: %s %s", req.Method, req.URL)
+		}
+		return &http.Response{StatusCode: 201, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})}
+	defer func() { httpClient = &http.Client{} }()
+
+	var sent []string
+	cli := matrixClient(t, &sent)
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(deployConfig))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+	deploy := command(s, cli, "deploy")
+
+	if _, err := deploy("!ops:hyrule", "@ganon:hyrule", []string{"staging", "main"}); err == nil {
+		t.Error("Expected a user without permission to be refused")
+	}
+	if _, err := deploy("!elsewhere:hyrule", "@link:hyrule", []string{"staging", "main"}); err == nil {
+		t.Error("Expected deploying from another room to be refused")
+	}
+	res, err := deploy("!ops:hyrule", "@link:hyrule", []string{"staging", "main"})
+	if err != nil {
+		t.Fatal("!deploy failed: ", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; got != "Deploy 1 of main to staging started. https://gitlab.example/hyrule/castle/-/pipelines/42" {
+		t.Errorf("!deploy responded with %q", got)
+	}
+	variables, _ := json.Marshal(triggered["variables"])
+	if triggered["ref"] != "main" || string(variables) != `[{"key":"ENVIRONMENT","value":"staging"}]` {
+		t.Errorf("Bad pipeline request: %v", triggered)
+	}
+
+	if next := s.OnPoll(cli); next.Unix() == 0 {
+		t.Error("Expected the running deploy to be polled again")
+	}
+	s.OnPoll(cli) // no change, so nothing is sent
+	pipelineStatus = "success"
+	if next := s.OnPoll(cli); next.Unix() != 0 {
+		t.Errorf("Expected polling to stop once the deploy finished, got %s", next)
+	}
+	want := []string{
+		"Deploy 1 of main to staging: running https://gitlab.example/hyrule/castle/-/pipelines/42",
+		"Deploy 1 of main to staging finished: success https://gitlab.example/hyrule/castle/-/pipelines/42",
+	}
+	if strings.Join(sent, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected status updates %q, got %q", want, sent)
+	}
+	if len(s.Runs) != 0 {
+		t.Errorf("Expected finished deploys to be dropped, got %v", s.Runs)
+	}
+}
+
+func TestDeployApproval(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	pipelines := 0
+	failTrigger := true
+	var s *Service
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		pipelines++
+		if r := s.Runs[0]; r.Status != statusStarting || r.ApprovedBy != "@zelda:hyrule" {
+			t.Errorf("Expected the approved deploy to be stored before it is triggered, got %+v", r)
+		}
+		if failTrigger {
+			return &http.Response{StatusCode: 500, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		body := `{"id": 7, "status": "created", "web_url": "https://gitlab.example/hyrule/castle/-/pipelines/7"}`
+		return &http.Response{StatusCode: 201, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})}
+	defer func() { httpClient = &http.Client{} }()
+
+	var sent []string
+	cli := matrixClient(t, &sent)
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(deployConfig))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s = srv.(*Service)
+	deploy := command(s, cli, "deploy")
+	approve := command(s, cli, "deploy", "approve")
+	cancel := command(s, cli, "deploy", "cancel")
+
+	res, err := deploy("!ops:hyrule", "@link:hyrule", []string{"production", "v1.2.0"})
+	if err != nil {
+		t.Fatal("!deploy failed: ", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; !strings.Contains(got, "!deploy approve 1") {
+		t.Errorf("Expected to be asked for approval, got %q", got)
+	}
+	if pipelines != 0 {
+		t.Fatal("Expected the deploy to wait for approval")
+	}
+	if _, err := approve("!ops:hyrule", "@link:hyrule", []string{"1"}); err == nil {
+		t.Error("Expected the user who asked for the deploy to be unable to approve it")
+	}
+	if _, err := approve("!ops:hyrule", "@ganon:hyrule", []string{"1"}); err == nil {
+		t.Error("Expected a user who isn't an approver to be refused")
+	}
+	if _, err := approve("!ops:hyrule", "@zelda:hyrule", []string{"1"}); err == nil {
+		t.Fatal("Expected !deploy approve to fail when the pipeline can't be started")
+	}
+	if !s.Runs[0].awaitingApproval() || s.Runs[0].ApprovedBy != "" {
+		t.Fatalf("Expected the deploy which failed to start to wait for approval again, got %+v", s.Runs[0])
+	}
+	failTrigger = false
+	if _, err := approve("!ops:hyrule", "@zelda:hyrule", []string{"1"}); err != nil {
+		t.Fatal("!deploy approve failed: ", err)
+	}
+	if _, err := approve("!ops:hyrule", "@zelda:hyrule", []string{"1"}); err == nil {
+		t.Error("Expected a started deploy to be impossible to approve again")
+	}
+	if pipelines != 2 || s.Runs[0].ApprovedBy != "@zelda:hyrule" || s.Runs[0].ProviderID != "7" {
+		t.Errorf("Expected the approved deploy to start, got %+v", s.Runs)
+	}
+	if _, err := cancel("!ops:hyrule", "@link:hyrule", []string{"1"}); err == nil {
+		t.Error("Expected a started deploy to be impossible to cancel")
+	}
+
+	// Unapproved deploys expire
+	s.Runs = []Run{{
+		ID:              "2",
+		Environment:     "production",
+		Ref:             "v1.3.0",
+		RoomID:          id.RoomID("!ops:hyrule"),
+		RequestedBy:     "@link:hyrule",
+		RequestedAtSecs: time.Now().Add(-approvalExpiry - time.Minute).Unix(),
+	}}
+	if next := s.OnPoll(cli); next.Unix() != 0 || len(s.Runs) != 0 {
+		t.Errorf("Expected the expired deploy to be dropped, got %+v", s.Runs)
+	}
+	if len(sent) != 1 || !strings.Contains(sent[0], "wasn't approved in time") {
+		t.Errorf("Expected the room to be told the deploy expired, got %q", sent)
+	}
+}
+
+func TestPrivilegedCommands(t *testing.T) {
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(deployConfig))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	for _, cmd := range srv.Commands(nil) {
+		if want := cmd.Path[len(cmd.Path)-1] != "list"; cmd.Privileged != want {
+			t.Errorf("!%s: expected privileged to be %v", strings.Join(cmd.Path, " "), want)
+		}
+	}
+}
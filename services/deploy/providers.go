@@ -0,0 +1,357 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/secrets"
+)
+
+// The supported providers.
+const (
+	ProviderGithub = "github"
+	ProviderGitlab = "gitlab"
+	ProviderArgoCD = "argocd"
+)
+
+const (
+	githubAPIURL = "https://api.github.com"
+	gitlabURL    = "https://gitlab.com"
+)
+
+// How far apart Go-NEB's and Github's clocks may be when matching a dispatched workflow to its run.
+const githubClockSkew = time.Minute
+
+// A provider starts deploys and reports on their progress.
+type provider interface {
+	// trigger starts a deploy of the ref, filling in the run's provider ID and URL if known.
+	trigger(run *Run) error
+	// status returns the run's current status and whether it has finished, updating the run's
+	// provider ID and URL if they weren't known.
+	status(run *Run) (status string, done bool, err error)
+}
+
+// newProvider returns the provider for the environment's config.
+func newProvider(env *Environment) (provider, error) {
+	switch env.Provider {
+	case ProviderGithub:
+		if env.Project == "" || env.Workflow == "" {
+			return nil, fmt.Errorf("project and workflow are required for %s", ProviderGithub)
+		}
+		return &github{env: env}, nil
+	case ProviderGitlab:
+		if env.Project == "" {
+			return nil, fmt.Errorf("project is required for %s", ProviderGitlab)
+		}
+		return &gitlab{env: env}, nil
+	case ProviderArgoCD:
+		if env.URL == "" || env.Project == "" {
+			return nil, fmt.Errorf("url and project are required for %s", ProviderArgoCD)
+		}
+		return &argoCD{env: env}, nil
+	}
+	return nil, fmt.Errorf("provider must be '%s', '%s' or '%s'", ProviderGithub, ProviderGitlab, ProviderArgoCD)
+}
+
+// github runs a GitHub Actions workflow with a workflow_dispatch trigger.
+type github struct {
+	env *Environment
+}
+
+type githubWorkflowRun struct {
+	ID         int64     `json:"id"`
+	Status     string    `json:"status"`
+	Conclusion string    `json:"conclusion"`
+	HTMLURL    string    `json:"html_url"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (p *github) trigger(run *Run) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"ref":    run.Ref,
+		"inputs": p.env.Variables,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := p.request("POST", p.workflowPath()+"/dispatches", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// Dispatching doesn't say which run it started, so status looks for it.
+	return doJSON(req, nil)
+}
+
+func (p *github) status(run *Run) (string, bool, error) {
+	if run.ProviderID == "" {
+		found, err := p.findRun(run)
+		if err != nil || found == nil {
+			return "queued", false, err
+		}
+		run.ProviderID = strconv.FormatInt(found.ID, 10)
+		run.URL = found.HTMLURL
+	}
+	req, err := p.request("GET", "/actions/runs/"+run.ProviderID, nil)
+	if err != nil {
+		return "", false, err
+	}
+	var res githubWorkflowRun
+	if err := doJSON(req, &res); err != nil {
+		return "", false, err
+	}
+	if res.Status == "completed" {
+		return res.Conclusion, true, nil
+	}
+	return res.Status, false, nil
+}
+
+// findRun returns the earliest run of the workflow for the ref which was created after the run
+// was triggered, or nil if it hasn't started yet. Deploys of the same ref triggered at the same
+// time by something other than Go-NEB may be mistaken for each other.
+func (p *github) findRun(run *Run) (*githubWorkflowRun, error) {
+	query := url.Values{
+		"event":    {"workflow_dispatch"},
+		"branch":   {run.Ref},
+		"per_page": {"20"},
+	}
+	req, err := p.request("GET", p.workflowPath()+"/runs?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		WorkflowRuns []githubWorkflowRun `json:"workflow_runs"`
+	}
+	if err := doJSON(req, &res); err != nil {
+		return nil, err
+	}
+	triggered := time.Unix(run.TriggeredAtSecs, 0).Add(-githubClockSkew)
+	var found *githubWorkflowRun
+	for i, r := range res.WorkflowRuns {
+		if r.CreatedAt.Before(triggered) {
+			continue
+		}
+		if found == nil || r.CreatedAt.Before(found.CreatedAt) {
+			found = &res.WorkflowRuns[i]
+		}
+	}
+	return found, nil
+}
+
+func (p *github) workflowPath() string {
+	return "/actions/workflows/" + url.PathEscape(p.env.Workflow)
+}
+
+// request makes a request relative to the repository's API URL.
+func (p *github) request(method, path string, body *bytes.Reader) (*http.Request, error) {
+	token, err := secrets.Resolve(p.env.Token)
+	if err != nil {
+		return nil, err
+	}
+	base := p.env.URL
+	if base == "" {
+		base = githubAPIURL
+	}
+	req, err := newRequest(method, fmt.Sprintf("%s/repos/%s%s", strings.TrimSuffix(base, "/"), p.env.Project, path), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "token "+token)
+	return req, nil
+}
+
+// gitlab runs a GitLab CI pipeline.
+type gitlab struct {
+	env *Environment
+}
+
+type gitlabPipeline struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+	WebURL string `json:"web_url"`
+}
+
+// gitlabFinished are the statuses of pipelines which have finished.
+var gitlabFinished = map[string]bool{
+	"success":  true,
+	"failed":   true,
+	"canceled": true,
+	"skipped":  true,
+}
+
+func (p *gitlab) trigger(run *Run) error {
+	type variable struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	// Sorted so that requests are the same each time.
+	keys := make([]string, 0, len(p.env.Variables))
+	for k := range p.env.Variables {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	variables := make([]variable, 0, len(keys))
+	for _, k := range keys {
+		variables = append(variables, variable{k, p.env.Variables[k]})
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"ref":       run.Ref,
+		"variables": variables,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := p.request("POST", "/pipeline", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	var res gitlabPipeline
+	if err := doJSON(req, &res); err != nil {
+		return err
+	}
+	run.ProviderID = strconv.FormatInt(res.ID, 10)
+	run.URL = res.WebURL
+	return nil
+}
+
+func (p *gitlab) status(run *Run) (string, bool, error) {
+	req, err := p.request("GET", "/pipelines/"+run.ProviderID, nil)
+	if err != nil {
+		return "", false, err
+	}
+	var res gitlabPipeline
+	if err := doJSON(req, &res); err != nil {
+		return "", false, err
+	}
+	return res.Status, gitlabFinished[res.Status], nil
+}
+
+// request makes a request relative to the project's API URL.
+func (p *gitlab) request(method, path string, body *bytes.Reader) (*http.Request, error) {
+	token, err := secrets.Resolve(p.env.Token)
+	if err != nil {
+		return nil, err
+	}
+	base := p.env.URL
+	if base == "" {
+		base = gitlabURL
+	}
+	req, err := newRequest(method, fmt.Sprintf("%s/api/v4/projects/%s%s",
+		strings.TrimSuffix(base, "/"), url.PathEscape(p.env.Project), path), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("PRIVATE-TOKEN", token)
+	return req, nil
+}
+
+// argoCD syncs an Argo CD application.
+type argoCD struct {
+	env *Environment
+}
+
+type argoCDApplication struct {
+	Status struct {
+		OperationState *struct {
+			Phase string `json:"phase"`
+		} `json:"operationState"`
+	} `json:"status"`
+}
+
+// argoCDFinished are the phases of sync operations which have finished.
+var argoCDFinished = map[string]bool{
+	"Succeeded": true,
+	"Failed":    true,
+	"Error":     true,
+}
+
+func (p *argoCD) trigger(run *Run) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"revision": run.Ref,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := p.request("POST", "/sync", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	var res argoCDApplication
+	if err := doJSON(req, &res); err != nil {
+		return err
+	}
+	// Argo CD runs one sync of an application at a time, so the application is the run.
+	run.ProviderID = p.env.Project
+	run.URL = strings.TrimSuffix(p.env.URL, "/") + "/applications/" + url.PathEscape(p.env.Project)
+	return nil
+}
+
+func (p *argoCD) status(run *Run) (string, bool, error) {
+	req, err := p.request("GET", "", nil)
+	if err != nil {
+		return "", false, err
+	}
+	var res argoCDApplication
+	if err := doJSON(req, &res); err != nil {
+		return "", false, err
+	}
+	if res.Status.OperationState == nil {
+		return "Pending", false, nil
+	}
+	phase := res.Status.OperationState.Phase
+	return phase, argoCDFinished[phase], nil
+}
+
+// request makes a request relative to the application's API URL.
+func (p *argoCD) request(method, path string, body *bytes.Reader) (*http.Request, error) {
+	token, err := secrets.Resolve(p.env.Token)
+	if err != nil {
+		return nil, err
+	}
+	req, err := newRequest(method, fmt.Sprintf("%s/api/v1/applications/%s%s",
+		strings.TrimSuffix(p.env.URL, "/"), url.PathEscape(p.env.Project), path), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req, nil
+}
+
+func newRequest(method, url string, body *bytes.Reader) (*http.Request, error) {
+	if body == nil {
+		return http.NewRequest(method, url, nil)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// doJSON makes the request and decodes the JSON response into out, unless out is nil.
+func doJSON(req *http.Request, out interface{}) error {
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("Request error: %d, %s", res.StatusCode, string(body))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,404 @@
+// Package discord implements a Service which accepts Discord webhook payloads, so tools which
+// post to Discord webhooks can post into Matrix rooms instead.
+package discord
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/russross/blackfriday"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Discord service.
+const ServiceType = "discord"
+
+// The most a request body can be, which is Discord's own limit for webhooks without files.
+const maxBodySize = 8 << 20
+
+// The Markdown which Discord supports: no raw HTML, headings or tables, and a newline is a line
+// break.
+const markdownExtensions = blackfriday.EXTENSION_FENCED_CODE |
+	blackfriday.EXTENSION_STRIKETHROUGH |
+	blackfriday.EXTENSION_NO_INTRA_EMPHASIS |
+	blackfriday.EXTENSION_HARD_LINE_BREAK |
+	blackfriday.EXTENSION_AUTOLINK
+
+// Service contains the Config fields for the Discord service.
+//
+// This service sends messages into Matrix rooms when Discord webhook payloads are POSTed to
+// WebhookURL, so existing tooling which posts to Discord webhooks can be pointed at Go-NEB
+// unchanged. Payloads may be JSON, or a form with a "payload_json" field. The message's
+// content and embeds are rendered from Discord's Markdown, led by the username and avatar.
+// Images are uploaded to the homeserver. Like Discord, the webhook responds with
+// 204 No Content, or with the message's ID if the "wait" query parameter is true.
+//
+// You can set msg_type to either m.text or m.notice. It defaults to m.notice.
+//
+// Example JSON request:
+//    {
+//        rooms: {
+//            "!ewfug483gsfe:localhost": {
+//                "msg_type": "m.text"
+//            },
+//        }
+//    }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which should be given to tools in place of a Discord webhook URL - Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// A map of matrix rooms to send messages into. A room may be a Space or a
+	// label such as "label:backend-teams", see utils.ResolveRooms.
+	Rooms map[id.RoomID]struct {
+		MsgType mevt.MessageType `json:"msg_type"`
+	} `json:"rooms"`
+}
+
+// WebhookMessage is the payload of a Discord webhook.
+type WebhookMessage struct {
+	Content   string  `json:"content"`
+	Username  string  `json:"username"`
+	AvatarURL string  `json:"avatar_url"`
+	Embeds    []Embed `json:"embeds"`
+}
+
+// Embed is a rich block of content in a WebhookMessage.
+type Embed struct {
+	Title       string       `json:"title"`
+	Description string       `json:"description"`
+	URL         string       `json:"url"`
+	Color       int          `json:"color"`
+	Timestamp   string       `json:"timestamp"`
+	Author      *EmbedAuthor `json:"author"`
+	Footer      *EmbedFooter `json:"footer"`
+	Fields      []EmbedField `json:"fields"`
+	Image       *EmbedImage  `json:"image"`
+	Thumbnail   *EmbedImage  `json:"thumbnail"`
+}
+
+// EmbedAuthor is the author shown at the top of an Embed.
+type EmbedAuthor struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	IconURL string `json:"icon_url"`
+}
+
+// EmbedFooter is the text shown at the bottom of an Embed.
+type EmbedFooter struct {
+	Text    string `json:"text"`
+	IconURL string `json:"icon_url"`
+}
+
+// EmbedField is a named value in an Embed.
+type EmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+// EmbedImage is an image or thumbnail in an Embed.
+type EmbedImage struct {
+	URL string `json:"url"`
+}
+
+// OnReceiveWebhook receives Discord webhook payloads and sends them into the configured rooms.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	logger := logging.FromContext(req.Context())
+	msg, err := readMessage(w, req)
+	if err != nil {
+		logger.WithError(err).Error("Discord webhook received an invalid payload")
+		writeError(w, 400, err.Error())
+		return
+	}
+	r := renderer{cli: cli}
+	htmlBody := r.message(msg)
+
+	var eventID id.EventID
+	for roomID, roomConfig := range s.Rooms {
+		msgType := roomConfig.MsgType
+		if msgType == "" {
+			msgType = mevt.MsgNotice
+		}
+		content := utils.StrippedHTMLMessage(msgType, htmlBody)
+		for _, toRoomID := range utils.ResolveRooms(cli, s.ServiceUserID(), roomID) {
+			logger.WithField("room_id", toRoomID).Print("Sending Discord webhook message to room")
+			resp, e := cli.SendMessageEvent(toRoomID, mevt.EventMessage, content)
+			if e != nil {
+				logger.WithError(e).WithField("room_id", toRoomID).Print(
+					"Failed to send Discord webhook message to room.")
+				continue
+			}
+			if eventID == "" {
+				eventID = resp.EventID
+			}
+		}
+	}
+
+	if req.URL.Query().Get("wait") != "true" {
+		w.WriteHeader(204)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ID      id.EventID `json:"id"`
+		Content string     `json:"content"`
+	}{eventID, msg.Content})
+}
+
+// readMessage reads the message from a JSON body or a form's "payload_json" or "content" field.
+func readMessage(w http.ResponseWriter, req *http.Request) (*WebhookMessage, error) {
+	req.Body = http.MaxBytesReader(w, req.Body, maxBodySize)
+	var msg WebhookMessage
+	contentType := req.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "multipart/form-data") || strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		if err := req.ParseMultipartForm(maxBodySize); err != nil && err != http.ErrNotMultipart {
+			return nil, err
+		}
+		if payload := req.FormValue("payload_json"); payload != "" {
+			if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+				return nil, fmt.Errorf("invalid payload_json: %s", err)
+			}
+		} else {
+			msg.Content = req.FormValue("content")
+			msg.Username = req.FormValue("username")
+			msg.AvatarURL = req.FormValue("avatar_url")
+		}
+	} else if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %s", err)
+	}
+	if strings.TrimSpace(msg.Content) == "" && len(msg.Embeds) == 0 {
+		return nil, errors.New("Cannot send an empty message")
+	}
+	return &msg, nil
+}
+
+// writeError responds with an error in the shape Discord uses.
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Message string `json:"message"`
+		Code    int    `json:"code"`
+	}{message, 0})
+}
+
+// renderer renders webhook messages as HTML, uploading their images to the homeserver.
+type renderer struct {
+	cli types.MatrixClient
+}
+
+// message renders the message: its username and avatar, content and embeds.
+func (r *renderer) message(msg *WebhookMessage) string {
+	var b strings.Builder
+	if msg.Username != "" || msg.AvatarURL != "" {
+		b.WriteString("<p>")
+		if icon := r.icon(msg.AvatarURL); icon != "" {
+			b.WriteString(icon + " ")
+		}
+		if msg.Username != "" {
+			b.WriteString("<b>" + template.HTMLEscapeString(msg.Username) + "</b>")
+		}
+		b.WriteString("</p>")
+	}
+	b.WriteString(markdown(msg.Content))
+	for _, e := range msg.Embeds {
+		b.WriteString(r.embed(e))
+	}
+	return b.String()
+}
+
+// embed renders an embed as a blockquote, with its title in the embed's colour.
+func (r *renderer) embed(e Embed) string {
+	var b strings.Builder
+	b.WriteString("<blockquote>")
+	if a := e.Author; a != nil && a.Name != "" {
+		b.WriteString("<p>")
+		if icon := r.icon(a.IconURL); icon != "" {
+			b.WriteString(icon + " ")
+		}
+		b.WriteString("<b>" + link(a.URL, template.HTMLEscapeString(a.Name)) + "</b></p>")
+	}
+	if e.Title != "" {
+		title := template.HTMLEscapeString(e.Title)
+		if e.Color != 0 {
+			title = fmt.Sprintf(`<font color="#%06x">%s</font>`, e.Color&0xffffff, title)
+		}
+		b.WriteString("<h4>" + link(e.URL, title) + "</h4>")
+	}
+	b.WriteString(markdown(e.Description))
+	if len(e.Fields) > 0 {
+		b.WriteString("<ul>")
+		for _, f := range e.Fields {
+			b.WriteString("<li><b>" + template.HTMLEscapeString(f.Name) + "</b>: " + inlineMarkdown(f.Value) + "</li>")
+		}
+		b.WriteString("</ul>")
+	}
+	if e.Image != nil {
+		b.WriteString(r.image(e.Image.URL, ""))
+	} else if e.Thumbnail != nil {
+		b.WriteString(r.image(e.Thumbnail.URL, `height="80"`))
+	}
+	if footer := footerText(e); footer != "" {
+		b.WriteString("<p><sub>")
+		if e.Footer != nil {
+			if icon := r.icon(e.Footer.IconURL); icon != "" {
+				b.WriteString(icon + " ")
+			}
+		}
+		b.WriteString(footer + "</sub></p>")
+	}
+	b.WriteString("</blockquote>")
+	return b.String()
+}
+
+// footerText returns the escaped footer text and timestamp of the embed, separated by a dot.
+func footerText(e Embed) string {
+	var parts []string
+	if e.Footer != nil && e.Footer.Text != "" {
+		parts = append(parts, template.HTMLEscapeString(e.Footer.Text))
+	}
+	if e.Timestamp != "" {
+		if ts, err := time.Parse(time.RFC3339, e.Timestamp); err == nil {
+			parts = append(parts, ts.UTC().Format("2006-01-02 15:04 MST"))
+		}
+	}
+	return strings.Join(parts, " • ")
+}
+
+// icon returns a small inline image of the URL, or "" if it can't be uploaded.
+func (r *renderer) icon(url string) string {
+	if url == "" {
+		return ""
+	}
+	mxc, err := r.upload(url)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf(`<img src="%s" alt="" height="24" />`, template.HTMLEscapeString(mxc))
+}
+
+// image returns an image of the URL, or a link to it if it can't be uploaded.
+func (r *renderer) image(url, attrs string) string {
+	if url == "" {
+		return ""
+	}
+	alt := template.HTMLEscapeString(url[strings.LastIndex(url, "/")+1:])
+	mxc, err := r.upload(url)
+	if err != nil {
+		return "<p>" + link(url, alt) + "</p>"
+	}
+	if attrs != "" {
+		attrs = " " + attrs
+	}
+	return fmt.Sprintf(`<p><img src="%s" alt="%s"%s /></p>`, template.HTMLEscapeString(mxc), alt, attrs)
+}
+
+func (r *renderer) upload(url string) (string, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return "", fmt.Errorf("not an HTTP URL: %s", url)
+	}
+	resUpload, err := r.cli.UploadLink(url)
+	if err != nil {
+		log.WithError(err).WithField("url", url).Error("Failed to upload Discord webhook image")
+		return "", err
+	}
+	return resUpload.ContentURI.String(), nil
+}
+
+// link returns the HTML as a link to the URL, if it is an HTTP URL.
+func link(url, html string) string {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return html
+	}
+	return fmt.Sprintf(`<a href="%s">%s</a>`, template.HTMLEscapeString(url), html)
+}
+
+// markdown renders Discord's Markdown as HTML. Raw HTML is dropped rather than passed through.
+func markdown(text string) string {
+	if strings.TrimSpace(text) == "" {
+		return ""
+	}
+	renderer := blackfriday.HtmlRenderer(blackfriday.HTML_SKIP_HTML|blackfriday.HTML_SAFELINK, "", "")
+	return strings.TrimSpace(string(blackfriday.Markdown([]byte(text), renderer, markdownExtensions)))
+}
+
+// inlineMarkdown renders Markdown which is shown inline, e.g. in a list item, without the
+// paragraph around it.
+func inlineMarkdown(text string) string {
+	html := markdown(text)
+	if strings.HasPrefix(html, "<p>") && strings.HasSuffix(html, "</p>") && strings.Count(html, "<p>") == 1 {
+		return strings.TrimSuffix(strings.TrimPrefix(html, "<p>"), "</p>")
+	}
+	return html
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	for roomID, roomConfig := range s.Rooms {
+		if roomConfig.MsgType != "" && roomConfig.MsgType != mevt.MsgNotice && roomConfig.MsgType != mevt.MsgText {
+			return fmt.Errorf("msg_type for room %s is neither 'm.notice' nor 'm.text'", roomID)
+		}
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+// PostRegister deletes this service if there are no rooms to send messages to.
+func (s *Service) PostRegister(oldService types.Service) {
+	if len(s.Rooms) > 0 {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_type": s.ServiceType(),
+		"service_id":   s.ServiceID(),
+	})
+	logger.Info("Removing service as no rooms are registered.")
+	if err := database.GetServiceDB().DeleteService(s.ServiceID()); err != nil {
+		logger.WithError(err).Error("Failed to delete service")
+	}
+}
+
+// TargetRooms returns the rooms messages are sent into.
+func (s *Service) TargetRooms() []id.RoomID {
+	roomIDs := make([]id.RoomID, 0, len(s.Rooms))
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
+func (s *Service) joinRooms(client types.MatrixClient) {
+	for roomID := range s.Rooms {
+		if utils.IsLabel(roomID) {
+			continue // labelled rooms are joined by the service which labels them
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
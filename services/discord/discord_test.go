@@ -0,0 +1,151 @@
+package discord
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestWebhook(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	// Intercept message sending and uploads to Matrix and mock responses
+	var msgs []mevt.MessageEventContent
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		switch {
+		case req.URL.Host == "cdn.discord":
+			return &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Type": []string{"image/png"}},
+				Body:       ioutil.NopCloser(bytes.NewBufferString("png")),
+			}, nil
+		case strings.HasSuffix(req.URL.Path, "/media/r0/upload"):
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://hs/image"}`)),
+			}, nil
+		case strings.Contains(req.URL.String(), "/send/m.room.message"):
+			var msg mevt.MessageEventContent
+			if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+				return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+			}
+			msgs = append(msgs, msg)
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+	}
+	matrixCli, _ := mautrix.NewClient("https://hs", "@neb:hs", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(`{"rooms":{"!testroom:id":{}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/services/hooks/aWQ?wait=true", bytes.NewBufferString(`{
+		"content": "Deploy **finished** <script>",
+		"username": "CI",
+		"avatar_url": "https://cdn.discord/ci.png",
+		"embeds": [{
+			"title": "api v1.2",
+			"url": "https://ci/builds/1",
+			"color": 65280,
+			"description": "All ~~three~~ jobs passed",
+			"fields": [{"name": "Duration", "value": "` + "`4m`" + `", "inline": true}],
+			"thumbnail": {"url": "https://cdn.discord/thumb.png"},
+			"footer": {"text": "ci.example.com"},
+			"timestamp": "2021-07-01T12:00:00.000Z"
+		}]
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to create webhook request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	mockWriter := httptest.NewRecorder()
+	srv.OnReceiveWebhook(mockWriter, req, matrixCli)
+
+	if mockWriter.Code != 200 {
+		t.Fatalf("Expected response 200 OK, got %d", mockWriter.Code)
+	}
+	if !strings.Contains(mockWriter.Body.String(), `"id":"$yup:event"`) {
+		t.Errorf("Expected the response to contain the event ID, got %s", mockWriter.Body.String())
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("Expected sent 1 msgs, sent %d", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.MsgType != mevt.MsgNotice {
+		t.Errorf("Wrong msgtype: got %s want m.notice", msg.MsgType)
+	}
+	for _, want := range []string{
+		`<p><img src="mxc://hs/image" alt="" height="24" /> <b>CI</b></p>`,
+		`<p>Deploy <strong>finished</strong> </p>`,
+		`<h4><a href="https://ci/builds/1"><font color="#00ff00">api v1.2</font></a></h4>`,
+		`<p>All <del>three</del> jobs passed</p>`,
+		`<li><b>Duration</b>: <code>4m</code></li>`,
+		`<img src="mxc://hs/image" alt="thumb.png" height="80" />`,
+		`<p><sub>ci.example.com • 2021-07-01 12:00 UTC</sub></p>`,
+	} {
+		if !strings.Contains(msg.FormattedBody, want) {
+			t.Errorf("Expected formatted body to contain %q, got %q", want, msg.FormattedBody)
+		}
+	}
+	if strings.Contains(msg.FormattedBody, "<script>") {
+		t.Errorf("Expected raw HTML to be dropped, got %q", msg.FormattedBody)
+	}
+
+	// Forms are accepted, and the response is empty without "wait"
+	msgs = nil
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("payload_json", `{"content": "from a form"}`)
+	mw.Close()
+	req, _ = http.NewRequest("POST", "/services/hooks/aWQ", &form)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	mockWriter = httptest.NewRecorder()
+	srv.OnReceiveWebhook(mockWriter, req, matrixCli)
+	if mockWriter.Code != 204 {
+		t.Fatalf("Expected response 204 No Content, got %d", mockWriter.Code)
+	}
+	if len(msgs) != 1 || msgs[0].FormattedBody != "<p>from a form</p>" {
+		t.Errorf("Expected the form's message to be sent, sent %+v", msgs)
+	}
+
+	// Empty messages are rejected
+	msgs = nil
+	req, _ = http.NewRequest("POST", "/services/hooks/aWQ", bytes.NewBufferString(`{"username": "CI"}`))
+	mockWriter = httptest.NewRecorder()
+	srv.OnReceiveWebhook(mockWriter, req, matrixCli)
+	if mockWriter.Code != 400 {
+		t.Errorf("Expected response 400 Bad Request for an empty message, got %d", mockWriter.Code)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("Expected no msgs for an empty message, sent %d", len(msgs))
+	}
+}
+
+func TestRegister(t *testing.T) {
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(`{"rooms":{"!testroom:id":{"msg_type":"m.image"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Register(nil, nil); err == nil {
+		t.Error("Expected an error for an invalid msg_type")
+	}
+}
@@ -0,0 +1,448 @@
+// Package discourse implements a Service which sends Discourse forum notifications into rooms
+// and lets users reply to topics from Matrix.
+package discourse
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/realms/discourse"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Discourse service
+const ServiceType = "discourse"
+
+// The longest excerpt of a reply to include in notifications.
+const maxExcerptLength = 300
+
+// The kinds of notification, which rooms can choose between.
+const (
+	kindTopic  = "topic"
+	kindReply  = "reply"
+	kindSolved = "solved"
+)
+
+// Service contains the Config fields for the Discourse Service.
+//
+// The service sends a notice into the configured rooms when a topic is created, replied to or
+// solved. Add a webhook in the Discourse admin pages with the WebhookURL, content type
+// "application/json" and the secret, and select the "Topic", "Post" and, if the Solved plugin is
+// installed, "Solved" events.
+//
+// Each room can be limited to some kinds of notification ("topic", "reply" or "solved"), to
+// some category IDs and to topics with some tags. If a "discourse" realm is given then users can
+// reply to topics with:
+//    !discourse reply 123 "Thanks, that fixed it!"
+// Replies are posted as the Discourse user whose API key the Matrix user added to the realm.
+//
+// Example request:
+//   {
+//       "server_url": "https://forum.example.org",
+//       "secret": "a long random string",
+//       "realm_id": "discourse-realm",
+//       "rooms": {
+//           "!qmElAGdFYCHoCJuaNt:localhost": {
+//               "categories": [4, 7],
+//               "tags": ["bug"]
+//           },
+//           "!wefiuwegfiuwhe:localhost": {
+//               "events": ["solved"]
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which should be added to Discourse as a webhook - Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// The URL of the Discourse forum.
+	ServerURL string `json:"server_url"`
+	// The secret given to Discourse for the webhook, used to verify requests. This may instead
+	// be a reference to a secret store, see the secrets package.
+	Secret string `json:"secret"`
+	// Optional. The ID of an existing "discourse" realm for the same forum. If set,
+	// "!discourse reply" posts replies using the API keys users have added to it.
+	RealmID string `json:"realm_id"`
+	// A map of room ID to the notifications to send to it. A room may be a Space or a label
+	// such as "label:community", see utils.ResolveRooms.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+}
+
+// RoomConfig filters the notifications sent to a room.
+type RoomConfig struct {
+	// The kinds of notification to send: "topic", "reply" and "solved". Defaults to all of them.
+	Events []string `json:"events"`
+	// The category IDs to send notifications for. Defaults to every category.
+	Categories []int `json:"categories"`
+	// Only send notifications for topics with at least one of these tags. Defaults to every topic.
+	Tags []string `json:"tags"`
+}
+
+// tagList is a list of tag names. Depending on its version and settings, Discourse sends tags
+// either as names or as objects with a name.
+type tagList []string
+
+func (t *tagList) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*t = nil
+	for _, r := range raw {
+		var tag struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(r, &tag.Name); err != nil {
+			if err = json.Unmarshal(r, &tag); err != nil {
+				return err
+			}
+		}
+		*t = append(*t, tag.Name)
+	}
+	return nil
+}
+
+// topic is a topic in a "topic_created" webhook.
+type topic struct {
+	ID         int     `json:"id"`
+	Title      string  `json:"title"`
+	Slug       string  `json:"slug"`
+	CategoryID int     `json:"category_id"`
+	Tags       tagList `json:"tags"`
+	CreatedBy  struct {
+		Username string `json:"username"`
+	} `json:"created_by"`
+}
+
+// post is a post in a "post_created" or "accepted_solution" webhook.
+type post struct {
+	ID         int     `json:"id"`
+	PostNumber int     `json:"post_number"`
+	Username   string  `json:"username"`
+	Raw        string  `json:"raw"`
+	TopicID    int     `json:"topic_id"`
+	TopicTitle string  `json:"topic_title"`
+	TopicSlug  string  `json:"topic_slug"`
+	CategoryID int     `json:"category_id"`
+	TopicTags  tagList `json:"topic_tags"`
+}
+
+// webhookPayload is the body of a Discourse webhook. Which field is set depends on the event.
+type webhookPayload struct {
+	Topic  *topic `json:"topic"`
+	Post   *post  `json:"post"`
+	Solved *post  `json:"solved"`
+}
+
+// notification is a webhook which should be sent into rooms.
+type notification struct {
+	kind       string
+	categoryID int
+	tags       []string
+	content    mevt.MessageEventContent
+}
+
+// wants returns true if the notification should be sent to a room with this config.
+func (c *RoomConfig) wants(n *notification) bool {
+	if len(c.Events) > 0 && !contains(c.Events, n.kind) {
+		return false
+	}
+	if len(c.Categories) > 0 && !containsInt(c.Categories, n.categoryID) {
+		return false
+	}
+	if len(c.Tags) == 0 {
+		return true
+	}
+	for _, tag := range n.tags {
+		if contains(c.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, i int) bool {
+	for _, l := range list {
+		if l == i {
+			return true
+		}
+	}
+	return false
+}
+
+// topicURL returns the URL of a topic, or of a post in it if postNumber isn't 0.
+func (s *Service) topicURL(slug string, topicID, postNumber int) string {
+	u := fmt.Sprintf("%s/t/%s/%d", strings.TrimSuffix(s.ServerURL, "/"), url.PathEscape(slug), topicID)
+	if postNumber > 0 {
+		u += "/" + strconv.Itoa(postNumber)
+	}
+	return u
+}
+
+func excerpt(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if r := []rune(raw); len(r) > maxExcerptLength {
+		return string(r[:maxExcerptLength]) + "…"
+	}
+	return raw
+}
+
+// notificationFor returns the notification to send for a webhook, or nil if the webhook should
+// be ignored.
+func (s *Service) notificationFor(event string, payload *webhookPayload) *notification {
+	switch {
+	case event == "topic_created" && payload.Topic != nil:
+		t := payload.Topic
+		link := s.topicURL(t.Slug, t.ID, 0)
+		return &notification{kindTopic, t.CategoryID, t.Tags, utils.StrippedHTMLMessage(mevt.MsgNotice,
+			fmt.Sprintf(`<strong>New topic</strong> by %s: <a href="%s">%s</a>`,
+				html.EscapeString(t.CreatedBy.Username), html.EscapeString(link), html.EscapeString(t.Title)),
+		)}
+	case event == "post_created" && payload.Post != nil && payload.Post.PostNumber > 1:
+		// The first post of a topic is sent along with "topic_created", so it is ignored here.
+		p := payload.Post
+		link := s.topicURL(p.TopicSlug, p.TopicID, p.PostNumber)
+		return &notification{kindReply, p.CategoryID, p.TopicTags, utils.StrippedHTMLMessage(mevt.MsgNotice,
+			fmt.Sprintf(`%s replied to <a href="%s">%s</a> (%d)<blockquote>%s</blockquote>`,
+				html.EscapeString(p.Username), html.EscapeString(link), html.EscapeString(p.TopicTitle), p.TopicID,
+				html.EscapeString(excerpt(p.Raw))),
+		)}
+	case event == "accepted_solution" && payload.Solved != nil:
+		p := payload.Solved
+		link := s.topicURL(p.TopicSlug, p.TopicID, p.PostNumber)
+		return &notification{kindSolved, p.CategoryID, p.TopicTags, utils.StrippedHTMLMessage(mevt.MsgNotice,
+			fmt.Sprintf(`<strong>Solved</strong>: %s, by <a href="%s">%s's answer</a>`,
+				html.EscapeString(p.TopicTitle), html.EscapeString(link), html.EscapeString(p.Username)),
+		)}
+	}
+	return nil
+}
+
+// OnReceiveWebhook receives webhooks from Discourse and sends notices to Matrix as a result.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	logger := logging.FromContext(req.Context())
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithError(err).Error("Failed to read Discourse webhook body")
+		w.WriteHeader(400)
+		return
+	}
+	if err := s.verify(body, req.Header.Get("X-Discourse-Event-Signature")); err != nil {
+		logger.WithError(err).WithField("service_id", s.ServiceID()).Warn("Received unauthorised Discourse webhook request.")
+		w.WriteHeader(403)
+		return
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		logger.WithError(err).Error("Discourse webhook received an invalid JSON payload")
+		w.WriteHeader(400)
+		return
+	}
+	n := s.notificationFor(req.Header.Get("X-Discourse-Event"), &payload)
+	if n == nil {
+		w.WriteHeader(200) // e.g. a "ping", or an event we don't notify about
+		return
+	}
+
+	for roomID, roomConfig := range s.Rooms {
+		if !roomConfig.wants(n) {
+			continue
+		}
+		for _, toRoomID := range utils.ResolveRooms(cli, s.ServiceUserID(), roomID) {
+			if _, e := cli.SendMessageEvent(toRoomID, mevt.EventMessage, n.content); e != nil {
+				logger.WithError(e).WithField("room_id", toRoomID).Print(
+					"Failed to send Discourse notification to room.")
+			}
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// verify checks the request was signed with the secret.
+func (s *Service) verify(body []byte, signature string) error {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return errors.New("missing X-Discourse-Event-Signature header")
+	}
+	secret, err := secrets.Resolve(s.Secret)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(strings.TrimPrefix(signature, "sha256="))) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// Commands supported:
+//    !discourse reply 123 "Thanks, that fixed it!"
+// Replies to the topic with the given ID as the user's Discourse account. Only available if
+// a realm is configured.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	if s.RealmID == "" {
+		return nil
+	}
+	return []types.Command{
+		{
+			Path: []string{"discourse", "reply"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdReply(userID, args)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdReply(userID id.UserID, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return notice(`Usage: !discourse reply <topic-id> "text"`), nil
+	}
+	topicID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return nil, fmt.Errorf("Bad topic ID %q", args[0])
+	}
+	realm, err := s.realm()
+	if err != nil {
+		return nil, err
+	}
+
+	var created post
+	err = realm.API(userID, "POST", "/posts.json", map[string]interface{}{
+		"topic_id": topicID,
+		"raw":      strings.Join(args[1:], " "),
+	}, &created)
+	if err == discourse.ErrNoSession {
+		return matrix.StarterLinkMessage{
+			Body: "You need to add your Discourse API key before you can reply to topics.",
+			Link: realm.StarterLink,
+		}, nil
+	} else if err != nil {
+		log.WithError(err).WithFields(log.Fields{"user_id": userID, "topic_id": topicID}).Error("Failed to reply to Discourse topic")
+		return nil, fmt.Errorf("Failed to reply: %s", err)
+	}
+	return notice("Replied: " + s.topicURL(created.TopicSlug, created.TopicID, created.PostNumber)), nil
+}
+
+func (s *Service) realm() (*discourse.Realm, error) {
+	r, err := database.GetServiceDB().LoadAuthRealm(s.RealmID)
+	if err != nil {
+		return nil, err
+	}
+	realm, ok := r.(*discourse.Realm)
+	if !ok {
+		return nil, fmt.Errorf("Realm %s is not a Discourse realm", s.RealmID)
+	}
+	return realm, nil
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if u, err := url.Parse(s.ServerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("server_url must be an http or https URL")
+	}
+	if s.Secret == "" {
+		return errors.New("A secret is required")
+	}
+	if s.RealmID != "" {
+		realm, err := s.realm()
+		if err != nil {
+			return err
+		}
+		if realm.ServerURL != strings.TrimSuffix(s.ServerURL, "/") {
+			return fmt.Errorf("Realm %s is for %s, not %s", s.RealmID, realm.ServerURL, s.ServerURL)
+		}
+	}
+	for roomID, roomConfig := range s.Rooms {
+		for _, event := range roomConfig.Events {
+			if event != kindTopic && event != kindReply && event != kindSolved {
+				return fmt.Errorf("events for room %s must be topic, reply or solved, not %q", roomID, event)
+			}
+		}
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+// PostRegister deletes this service if there are no rooms to send notifications to.
+func (s *Service) PostRegister(oldService types.Service) {
+	if len(s.Rooms) > 0 {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_type": s.ServiceType(),
+		"service_id":   s.ServiceID(),
+	})
+	logger.Info("Removing service as no rooms are registered.")
+	if err := database.GetServiceDB().DeleteService(s.ServiceID()); err != nil {
+		logger.WithError(err).Error("Failed to delete service")
+	}
+}
+
+// TargetRooms returns the rooms notifications are sent into.
+func (s *Service) TargetRooms() []id.RoomID {
+	roomIDs := make([]id.RoomID, 0, len(s.Rooms))
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
+func (s *Service) joinRooms(client types.MatrixClient) {
+	for roomID := range s.Rooms {
+		if utils.IsLabel(roomID) {
+			continue // labelled rooms are joined by the service which labels them
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
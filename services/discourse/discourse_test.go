@@ -0,0 +1,136 @@
+package discourse
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const secret = "sekrit"
+
+func TestNotify(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	// Intercept message sending to Matrix and mock responses
+	sent := make(map[id.RoomID][]mevt.MessageEventContent)
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/hierarchy") {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		if !strings.Contains(req.URL.Path, "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		roomID := id.RoomID(strings.Split(req.URL.Path, "/")[5])
+		sent[roomID] = append(sent[roomID], msg)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hs", "@neb:hs", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(`{
+		"server_url": "https://forum.example.org",
+		"secret": "`+secret+`",
+		"rooms": {
+			"!all:hs": {},
+			"!bugs:hs": {"categories": [4], "tags": ["bug"]},
+			"!solved:hs": {"events": ["solved"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal("Failed to register service: ", err)
+	}
+
+	send := func(event, body, signature string) int {
+		if signature == "" {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(body))
+			signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		}
+		req, _ := http.NewRequest("POST", "", bytes.NewBufferString(body))
+		req.Header.Set("X-Discourse-Event", event)
+		req.Header.Set("X-Discourse-Event-Signature", signature)
+		w := httptest.NewRecorder()
+		srv.OnReceiveWebhook(w, req, matrixCli)
+		return w.Code
+	}
+
+	topic := `{"topic":{"id":42,"title":"Bot <crashes>","slug":"bot-crashes","category_id":4,
+		"tags":[{"id":1,"name":"bug","slug":"bug"}],"created_by":{"username":"alice"}}}`
+	if code := send("topic_created", topic, "sha256=bad"); code != 403 {
+		t.Errorf("Expected a bad signature to be rejected, got %d", code)
+	}
+	for _, n := range []struct{ event, body string }{
+		{"topic_created", topic},
+		{"post_created", `{"post":{"post_number":1,"username":"alice","raw":"It crashes","topic_id":42,"topic_slug":"bot-crashes","category_id":4}}`},
+		{"post_created", `{"post":{"post_number":2,"username":"bob","raw":"Have you tried turning it off and on again?",
+			"topic_id":42,"topic_title":"Bot <crashes>","topic_slug":"bot-crashes","category_id":4,"topic_tags":["question"]}}`},
+		{"accepted_solution", `{"solved":{"post_number":2,"username":"bob","topic_id":42,"topic_title":"Bot <crashes>",
+			"topic_slug":"bot-crashes","category_id":4,"topic_tags":["bug"]}}`},
+		{"ping", `{"ping":"OK"}`},
+	} {
+		if code := send(n.event, n.body, ""); code != 200 {
+			t.Errorf("%s: expected response 200 OK, got %d", n.event, code)
+		}
+	}
+
+	if len(sent["!all:hs"]) != 3 || len(sent["!bugs:hs"]) != 2 || len(sent["!solved:hs"]) != 1 {
+		t.Fatalf("Expected 3 notices in !all, 2 in !bugs and 1 in !solved, got %d, %d and %d",
+			len(sent["!all:hs"]), len(sent["!bugs:hs"]), len(sent["!solved:hs"]))
+	}
+	msg := sent["!all:hs"][0]
+	if want := "New topic by alice: Bot <crashes> (https://forum.example.org/t/bot-crashes/42)"; msg.Body != want {
+		t.Errorf("Wrong body: got %q want %q", msg.Body, want)
+	}
+	if !strings.Contains(msg.FormattedBody, `<a href="https://forum.example.org/t/bot-crashes/42">Bot &lt;crashes&gt;</a>`) {
+		t.Errorf("Bad formatted body: %s", msg.FormattedBody)
+	}
+	if want := "bob replied to Bot <crashes> (https://forum.example.org/t/bot-crashes/42/2) (42)\n> Have you tried turning it off and on again?"; sent["!all:hs"][1].Body != want {
+		t.Errorf("Wrong body: got %q want %q", sent["!all:hs"][1].Body, want)
+	}
+	if !strings.HasPrefix(sent["!solved:hs"][0].Body, "Solved: Bot <crashes>, by bob's answer") {
+		t.Errorf("Expected a solved notice, got %q", sent["!solved:hs"][0].Body)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	for _, config := range []string{
+		`{"secret": "s", "rooms": {}}`,
+		`{"server_url": "https://forum.example.org", "rooms": {}}`,
+		`{"server_url": "https://forum.example.org", "secret": "s", "rooms": {"!a:hs": {"events": ["edited"]}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected config %s to be rejected", config)
+		}
+	}
+}
@@ -23,7 +23,8 @@ type Service struct {
 func (e *Service) Commands(cli types.MatrixClient) []types.Command {
 	return []types.Command{
 		{
-			Path: []string{"echo"},
+			Path:       []string{"echo"},
+			Idempotent: true,
 			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
 				return &mevt.MessageEventContent{
 					MsgType: mevt.MsgNotice,
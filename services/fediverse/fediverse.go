@@ -0,0 +1,416 @@
+// Package fediverse implements a Service which follows Mastodon accounts and hashtags.
+package fediverse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jaytaylor/html2text"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Fediverse service
+const ServiceType = "fediverse"
+
+const minPollingIntervalSeconds = 60 * 5 // 5 min, to be kind to instances
+
+// The most statuses fetched per poll, which is the most Mastodon returns.
+const statusesPerPoll = 40
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Follow is an account or hashtag to send new statuses from.
+type Follow struct {
+	// Optional. The time to wait between polls. If this is less than 5 minutes, it is ignored.
+	PollIntervalMins int `json:"poll_interval_mins"`
+	// The list of rooms to send new statuses into. This cannot be empty. A room may be a Space,
+	// or a label such as "label:backend-teams", see utils.ResolveRooms.
+	Rooms []id.RoomID `json:"rooms"`
+	// True to send an account's replies to other accounts too.
+	IncludeReplies bool `json:"include_replies"`
+	// True to send the statuses an account boosts too.
+	IncludeBoosts bool `json:"include_boosts"`
+	// Specified fields must each include at least one of these words. The author is the
+	// account's name and handle, the title is the content warning, and the description is
+	// the status text. See utils.IncludeRules.
+	MustInclude utils.IncludeRules `json:"must_include"`
+	// None of the specified fields must include any of these words.
+	MustNotInclude utils.IncludeRules `json:"must_not_include"`
+	// True if the service is unable to poll this account or hashtag. This is populated by
+	// Go-NEB. Use /getService to retrieve this value.
+	IsFailing bool `json:"is_failing"`
+	// Internal field. The ID of the followed account on its instance.
+	AccountID string `json:"account_id"`
+	// Internal field. The ID of the newest status seen.
+	LastStatusID string `json:"last_status_id"`
+	// Internal field. When we should poll again.
+	NextPollTimestampSecs int64 `json:"next_poll_ts_secs"`
+}
+
+// Service contains the Config fields for the Fediverse service.
+//
+// Accounts are followed as "@user@instance" and hashtags as "#tag@instance", where hashtags are
+// searched on the given instance. Both use the instance's public API, so no account is needed.
+// New statuses are sent into rooms as notices, and their images, videos and audio are uploaded
+// and sent after them.
+//
+// Example request:
+//   {
+//       follows: {
+//           "@matrix@mastodon.matrix.org": {
+//               rooms: ["!qmElAGdFYCHoCJuaNt:localhost"],
+//               include_boosts: true
+//           },
+//           "#golang@fosstodon.org": {
+//               poll_interval_mins: 60,
+//               rooms: ["!cBrPbzWazCtlkMNQSF:localhost"],
+//               must_not_include: {
+//                   description: ["hiring"]
+//               }
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// A map of "@user@instance" accounts and "#tag@instance" hashtags to follow.
+	Follows map[string]Follow `json:"follows"`
+}
+
+type account struct {
+	ID          string `json:"id"`
+	Acct        string `json:"acct"`
+	DisplayName string `json:"display_name"`
+}
+
+type attachment struct {
+	// "image", "gifv", "video", "audio" or "unknown"
+	Type        string `json:"type"`
+	URL         string `json:"url"`
+	Description string `json:"description"`
+}
+
+type status struct {
+	ID               string       `json:"id"`
+	URL              string       `json:"url"`
+	Content          string       `json:"content"`
+	SpoilerText      string       `json:"spoiler_text"`
+	Account          account      `json:"account"`
+	Reblog           *status      `json:"reblog"`
+	MediaAttachments []attachment `json:"media_attachments"`
+}
+
+// parseFollow splits "@user@instance" or "#tag@instance" into the instance and the account or
+// hashtag, without its "@" or "#".
+func parseFollow(follow string) (instance, name string, isTag bool, err error) {
+	if len(follow) < 2 || (follow[0] != '@' && follow[0] != '#') {
+		return "", "", false, fmt.Errorf("%s is not an @user@instance account or #tag@instance hashtag", follow)
+	}
+	at := strings.LastIndex(follow, "@")
+	if at <= 1 || at == len(follow)-1 {
+		return "", "", false, fmt.Errorf("%s has no instance, e.g. %s@mastodon.social", follow, follow)
+	}
+	return follow[at+1:], follow[1:at], follow[0] == '#', nil
+}
+
+// Register makes sure that every account exists and that every follow has a room.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Follows) == 0 {
+		return errors.New("At least one account or hashtag must be followed")
+	}
+	var old *Service
+	if o, ok := oldService.(*Service); ok {
+		old = o
+	}
+	for name, follow := range s.Follows {
+		instance, acct, isTag, err := parseFollow(name)
+		if err != nil {
+			return err
+		}
+		if len(follow.Rooms) == 0 {
+			return fmt.Errorf("%s has no rooms to send statuses to", name)
+		}
+		// Don't resend statuses which were sent before the service was reconfigured.
+		if old != nil {
+			if oldFollow, ok := old.Follows[name]; ok {
+				follow.AccountID = oldFollow.AccountID
+				follow.LastStatusID = oldFollow.LastStatusID
+			}
+		}
+		if !isTag && follow.AccountID == "" {
+			var a account
+			if err := getJSON(instance, "/api/v1/accounts/lookup", url.Values{"acct": {acct}}, &a); err != nil {
+				return fmt.Errorf("Failed to look up %s: %s", name, err)
+			}
+			follow.AccountID = a.ID
+		}
+		follow.NextPollTimestampSecs = 0
+		s.Follows[name] = follow
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+// TargetRooms returns the rooms statuses are sent into.
+func (s *Service) TargetRooms() []id.RoomID {
+	roomSet := make(map[id.RoomID]bool)
+	var roomIDs []id.RoomID
+	for _, follow := range s.Follows {
+		for _, roomID := range follow.Rooms {
+			if !roomSet[roomID] {
+				roomSet[roomID] = true
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+	}
+	return roomIDs
+}
+
+func (s *Service) joinRooms(client types.MatrixClient) {
+	for _, roomID := range s.TargetRooms() {
+		if utils.IsLabel(roomID) {
+			continue // labelled rooms are joined by the service which labels them
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+}
+
+// OnPoll fetches the new statuses of every account and hashtag which is due to be polled, and
+// sends those which pass its filters into its rooms, oldest first. The first poll of an account
+// or hashtag only remembers the newest status, so that rooms aren't flooded with old ones.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
+	now := time.Now().Unix()
+	for name, follow := range s.Follows {
+		if follow.NextPollTimestampSecs != 0 && now < follow.NextPollTimestampSecs {
+			continue
+		}
+		interval := int64(minPollingIntervalSeconds)
+		if follow.PollIntervalMins*60 > minPollingIntervalSeconds {
+			interval = int64(follow.PollIntervalMins * 60)
+		}
+		follow.NextPollTimestampSecs = now + interval
+
+		statuses, err := fetchStatuses(name, &follow)
+		if err != nil {
+			logger.WithField("follow", name).WithError(err).Error("Failed to fetch statuses")
+			polling.ReportError(s, fmt.Errorf("%s: %s", name, err))
+			follow.IsFailing = true
+			s.Follows[name] = follow
+			continue
+		}
+		follow.IsFailing = false
+		firstPoll := follow.LastStatusID == ""
+		if len(statuses) > 0 {
+			follow.LastStatusID = statuses[0].ID
+		}
+		s.Follows[name] = follow
+		if firstPoll {
+			continue
+		}
+		// Statuses are newest first
+		for i := len(statuses) - 1; i >= 0; i-- {
+			if statusFiltered(&statuses[i], &follow.MustInclude, &follow.MustNotInclude) {
+				continue
+			}
+			s.sendToRooms(cli, follow.Rooms, &statuses[i])
+		}
+	}
+
+	// Persist the service to save the newest statuses and next poll times
+	if _, err := database.GetServiceDB().StoreService(s); err != nil {
+		logger.WithError(err).Error("Failed to persist next poll times for service")
+		polling.ReportError(s, err)
+	}
+	return s.nextTimestamp()
+}
+
+// nextTimestamp returns when the next account or hashtag is due to be polled, but not sooner than
+// a minute from now.
+func (s *Service) nextTimestamp() time.Time {
+	var earliest int64
+	for _, follow := range s.Follows {
+		if earliest == 0 || follow.NextPollTimestampSecs < earliest {
+			earliest = follow.NextPollTimestampSecs
+		}
+	}
+	if now := time.Now().Unix(); earliest <= now {
+		earliest = now + 60
+	}
+	return time.Unix(earliest, 0)
+}
+
+// fetchStatuses returns the statuses newer than the last one seen, newest first.
+func fetchStatuses(name string, follow *Follow) ([]status, error) {
+	instance, tag, isTag, err := parseFollow(name)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{"limit": {fmt.Sprint(statusesPerPoll)}}
+	if follow.LastStatusID != "" {
+		query.Set("since_id", follow.LastStatusID)
+	}
+	path := "/api/v1/timelines/tag/" + url.PathEscape(tag)
+	if !isTag {
+		path = "/api/v1/accounts/" + url.PathEscape(follow.AccountID) + "/statuses"
+		query.Set("exclude_replies", fmt.Sprint(!follow.IncludeReplies))
+		query.Set("exclude_reblogs", fmt.Sprint(!follow.IncludeBoosts))
+	}
+	var statuses []status
+	if err := getJSON(instance, path, query, &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func getJSON(instance, path string, query url.Values, out interface{}) error {
+	u := url.URL{Scheme: "https", Host: instance, Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "Go-NEB")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s returned HTTP %d", u.Host, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// statusText returns the text of the status's HTML content.
+func statusText(st *status) string {
+	text, err := html2text.FromString(st.Content, html2text.Options{OmitLinks: true})
+	if err != nil {
+		return html.UnescapeString(st.Content)
+	}
+	return text
+}
+
+func statusFiltered(st *status, mustInclude, mustNotInclude *utils.IncludeRules) bool {
+	shown := st
+	if st.Reblog != nil {
+		shown = st.Reblog
+	}
+	author := shown.Account.DisplayName + " " + shown.Account.Acct
+	text := statusText(shown)
+	// At least one word for each field that has been specified must be included for a status to pass the filter.
+	if (len(mustInclude.Author) > 0 && !utils.ContainsAnyWord(author, mustInclude.Author)) ||
+		(len(mustInclude.Title) > 0 && !utils.ContainsAnyWord(shown.SpoilerText, mustInclude.Title)) ||
+		(len(mustInclude.Description) > 0 && !utils.ContainsAnyWord(text, mustInclude.Description)) {
+		return true
+	}
+	// If at least one word of any field that has been specified is included in the status, it doesn't pass the filter.
+	return utils.ContainsAnyWord(author, mustNotInclude.Author) ||
+		utils.ContainsAnyWord(shown.SpoilerText, mustNotInclude.Title) ||
+		utils.ContainsAnyWord(text, mustNotInclude.Description)
+}
+
+// statusMessage returns a notice with the status's text, e.g.
+//   Matrix (@matrix@mastodon.matrix.org): Synapse 1.50 is out!
+//   https://mastodon.matrix.org/@matrix/1234
+func statusMessage(st *status) mevt.MessageEventContent {
+	var prefix string
+	if st.Reblog != nil {
+		prefix = fmt.Sprintf("%s boosted ", html.EscapeString(displayName(&st.Account)))
+		st = st.Reblog
+	}
+	name := displayName(&st.Account)
+	text := statusText(st)
+	if st.SpoilerText != "" {
+		text = "CW: " + st.SpoilerText + "\n" + text
+	}
+	return utils.StrippedHTMLMessage(mevt.MsgNotice, fmt.Sprintf(`%s<strong>%s</strong> (@%s): %s<br><a href="%s">%s</a>`,
+		prefix, html.EscapeString(name), html.EscapeString(st.Account.Acct),
+		strings.Replace(html.EscapeString(text), "\n", "<br>", -1),
+		html.EscapeString(st.URL), html.EscapeString(st.URL)))
+}
+
+func displayName(a *account) string {
+	if a.DisplayName != "" {
+		return a.DisplayName
+	}
+	return a.Acct
+}
+
+var attachmentMsgTypes = map[string]mevt.MessageType{
+	"image": mevt.MsgImage,
+	"gifv":  mevt.MsgVideo,
+	"video": mevt.MsgVideo,
+	"audio": mevt.MsgAudio,
+}
+
+// mediaMessages uploads the status's media attachments and returns messages for them. Attachments
+// which fail to upload are still linked from the status.
+func mediaMessages(cli types.MatrixClient, st *status) []mevt.MessageEventContent {
+	if st.Reblog != nil {
+		st = st.Reblog
+	}
+	var msgs []mevt.MessageEventContent
+	for _, a := range st.MediaAttachments {
+		msgType, ok := attachmentMsgTypes[a.Type]
+		if !ok {
+			continue
+		}
+		resUpload, err := cli.UploadLink(a.URL)
+		if err != nil {
+			log.WithError(err).WithField("url", a.URL).Error("Failed to upload media attachment")
+			continue
+		}
+		body := a.Description
+		if body == "" {
+			body = a.URL[strings.LastIndex(a.URL, "/")+1:]
+		}
+		msgs = append(msgs, mevt.MessageEventContent{
+			MsgType: msgType,
+			Body:    body,
+			URL:     resUpload.ContentURI.CUString(),
+		})
+	}
+	return msgs
+}
+
+func (s *Service) sendToRooms(cli types.MatrixClient, rooms []id.RoomID, st *status) {
+	logger := log.WithField("status", st.URL)
+	logger.Info("Sending new status")
+	msgs := append([]mevt.MessageEventContent{statusMessage(st)}, mediaMessages(cli, st)...)
+	for _, roomID := range rooms {
+		for _, toRoomID := range utils.ResolveRooms(cli, s.ServiceUserID(), roomID) {
+			for _, msg := range msgs {
+				if _, err := cli.SendMessageEvent(toRoomID, mevt.EventMessage, msg); err != nil {
+					logger.WithError(err).WithField("room_id", toRoomID).Error("Failed to send to room")
+				}
+			}
+		}
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
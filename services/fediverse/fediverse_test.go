@@ -0,0 +1,141 @@
+package fediverse
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+const oldStatuses = `[{"id": "100", "url": "https://hyrule.social/@zelda/100", "content": "<p>Old news</p>",
+	"account": {"id": "7", "acct": "zelda", "display_name": "Zelda"}}]`
+
+const newStatuses = `[
+	{"id": "103", "url": "https://hyrule.social/@zelda/103", "content": "<p>Now hiring knights</p>",
+		"account": {"id": "7", "acct": "zelda", "display_name": "Zelda"}},
+	{"id": "102", "url": "https://hyrule.social/@zelda/102", "content": "",
+		"account": {"id": "7", "acct": "zelda", "display_name": "Zelda"},
+		"reblog": {"id": "99", "url": "https://lorule.social/@hilda/99", "content": "<p>Triforce spotted</p>",
+			"spoiler_text": "spoilers", "account": {"id": "3", "acct": "hilda@lorule.social", "display_name": "Hilda"}}},
+	{"id": "101", "url": "https://hyrule.social/@zelda/101", "content": "<p>The castle is <b>safe</b></p>",
+		"account": {"id": "7", "acct": "zelda", "display_name": "Zelda"},
+		"media_attachments": [{"type": "image", "url": "https://files.hyrule.social/castle.png", "description": "The castle"}]}
+]`
+
+func TestFediverse(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	var apiRequests []string
+	statuses := oldStatuses
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		apiRequests = append(apiRequests, req.URL.String())
+		body := statuses
+		if req.URL.Path == "/api/v1/accounts/lookup" {
+			body = `{"id": "7", "acct": "zelda", "display_name": "Zelda"}`
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})}
+	defer func() { httpClient = &http.Client{} }()
+
+	var sent []mevt.MessageEventContent
+	uploaded := false
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		body := `{}`
+		switch {
+		case req.URL.Host == "files.hyrule.social":
+			uploaded = true
+			return &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"image/png"}},
+				Body: ioutil.NopCloser(bytes.NewBufferString("png"))}, nil
+		case strings.HasSuffix(req.URL.Path, "/hierarchy"):
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		case strings.Contains(req.URL.Path, "/upload"):
+			body = `{"content_uri": "mxc://hyrule/castle"}`
+		case strings.Contains(req.URL.Path, "/send/m.room.message/"):
+			var content mevt.MessageEventContent
+			if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+				t.Fatal("Failed to decode message: ", err)
+			}
+			sent = append(sent, content)
+			body = `{"event_id": "$yup"}`
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})}
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"follows": {
+			"@zelda@hyrule.social": {
+				"rooms": ["!castle:hyrule"],
+				"include_boosts": true,
+				"must_not_include": {"description": ["hiring"]}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+	if err := s.Register(nil, cli); err != nil {
+		t.Fatal("Failed to register service: ", err)
+	}
+	if got := s.Follows["@zelda@hyrule.social"].AccountID; got != "7" {
+		t.Errorf("Expected the account to be looked up, got ID %q", got)
+	}
+
+	// The first poll doesn't send old statuses
+	s.OnPoll(cli)
+	if len(sent) != 0 {
+		t.Fatalf("Expected the first poll not to send anything, sent %v", sent)
+	}
+
+	statuses = newStatuses
+	f := s.Follows["@zelda@hyrule.social"]
+	f.NextPollTimestampSecs = 0
+	s.Follows["@zelda@hyrule.social"] = f
+	s.OnPoll(cli)
+	wantLast := "https://hyrule.social/api/v1/accounts/7/statuses?exclude_reblogs=false&exclude_replies=true&limit=40&since_id=100"
+	if last := apiRequests[len(apiRequests)-1]; last != wantLast {
+		t.Errorf("Expected statuses since the last one seen to be fetched with %s, got %s", wantLast, last)
+	}
+	want := []string{
+		"Zelda (@zelda): The castle is *safe*\nhttps://hyrule.social/@zelda/101",
+		"The castle",
+		"Zelda boosted Hilda (@hilda@lorule.social): CW: spoilers\nTriforce spotted\nhttps://lorule.social/@hilda/99",
+	}
+	var bodies []string
+	for _, msg := range sent {
+		bodies = append(bodies, msg.Body)
+	}
+	if strings.Join(bodies, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected messages %q, got %q", want, bodies)
+	}
+	if !uploaded || len(sent) > 1 && (sent[1].MsgType != mevt.MsgImage || sent[1].URL != "mxc://hyrule/castle") {
+		t.Errorf("Expected the image to be uploaded and sent, got %+v", sent)
+	}
+	if got := s.Follows["@zelda@hyrule.social"].LastStatusID; got != "103" {
+		t.Errorf("Expected the newest status to be remembered, got %q", got)
+	}
+}
+
+func TestParseFollow(t *testing.T) {
+	for follow, want := range map[string][3]string{
+		"@zelda@hyrule.social":    {"hyrule.social", "zelda", ""},
+		"#triforce@hyrule.social": {"hyrule.social", "triforce", "tag"},
+	} {
+		instance, name, isTag, err := parseFollow(follow)
+		if err != nil || instance != want[0] || name != want[1] || isTag != (want[2] == "tag") {
+			t.Errorf("parseFollow(%q) = %q, %q, %v, %v", follow, instance, name, isTag, err)
+		}
+	}
+	for _, follow := range []string{"zelda@hyrule.social", "@zelda", "#triforce@", "@@hyrule.social"} {
+		if _, _, _, err := parseFollow(follow); err == nil {
+			t.Errorf("parseFollow(%q): expected an error", follow)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Package genericwebhook implements a Service which sends any JSON POSTed to it into Matrix rooms.
+package genericwebhook
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	html "html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	text "text/template"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Generic Webhook service.
+const ServiceType = "genericwebhook"
+
+// The largest request body which is accepted.
+const maxBodySize = 1 << 20
+
+// The header holding the shared secret, if one is configured.
+const secretHeader = "X-Webhook-Secret"
+
+var templateFuncs = map[string]interface{}{
+	"json": prettyJSON,
+}
+
+// prettyJSON returns v as indented JSON, without escaping HTML characters.
+func prettyJSON(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// Service contains the Config fields for the Generic Webhook service.
+//
+// Any JSON POSTed to the WebhookURL is sent into each configured room, which lets systems
+// that Go-NEB has no service for send notifications into Matrix. The message is rendered
+// with the room's templates, which are given the decoded JSON, so a payload of
+// {"title": "Deployed"} can be rendered with "{{.title}}". A "json" function is available
+// to pretty-print any part of the payload. If a room has no templates, or the payload
+// isn't JSON, the payload is pretty-printed as a code block.
+//
+// For the template strings, take a look at https://golang.org/pkg/text/template/
+// and the html variant https://golang.org/pkg/html/template/.
+//
+// If a secret is configured, requests must include it in the X-Webhook-Secret header.
+// If no rooms are configured, create_room_if_missing creates a room to send into, see
+// utils.RoomCreation. You can set msg_type to either m.text or m.notice. It defaults to m.notice.
+//
+// Example JSON request:
+//    {
+//        "secret": "a long random string",
+//        "rooms": {
+//            "!ewfug483gsfe:localhost": {
+//                "text_template": "{{.service}} was deployed by {{.user}}",
+//                "html_template": "<b>{{.service}}</b> was deployed by {{.user}}",
+//                "msg_type": "m.text"
+//            },
+//            "!cRrZwTqLjXvPnHy:localhost": {}
+//        }
+//    }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL to POST JSON to - Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// An optional shared secret which requests must include in the X-Webhook-Secret header.
+	Secret string `json:"secret"`
+	// A map of matrix rooms to templates. A room may be a Space or a
+	// label such as "label:backend-teams", see utils.ResolveRooms.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+	// Optional. Create a room to send payloads into if no rooms are configured.
+	utils.RoomCreation
+}
+
+// RoomConfig is the templates for a room.
+type RoomConfig struct {
+	TextTemplate string           `json:"text_template"`
+	HTMLTemplate string           `json:"html_template"`
+	MsgType      mevt.MessageType `json:"msg_type"`
+}
+
+// OnReceiveWebhook receives JSON and sends it into the configured rooms.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	logger := logging.FromContext(req.Context())
+	if s.Secret != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get(secretHeader)), []byte(s.Secret)) != 1 {
+		logger.WithField("service_id", s.ServiceID()).Warn("Received generic webhook with a bad secret")
+		w.WriteHeader(403)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodySize+1))
+	if err != nil {
+		logger.WithError(err).Error("Failed to read generic webhook body")
+		w.WriteHeader(400)
+		return
+	}
+	if len(body) > maxBodySize {
+		w.WriteHeader(413)
+		return
+	}
+	var payload interface{}
+	isJSON := json.Unmarshal(body, &payload) == nil
+
+	for roomID, templates := range s.Rooms {
+		var msg mevt.MessageEventContent
+		if isJSON && templates.TextTemplate != "" {
+			msg, err = render(templates.TextTemplate, templates.HTMLTemplate, payload)
+			if err != nil {
+				logger.WithError(err).WithField("room_id", roomID).Error("Generic webhook failed to execute template")
+				msg = fallback(body, payload, isJSON)
+			}
+		} else {
+			msg = fallback(body, payload, isJSON)
+		}
+		msg.MsgType = templates.MsgType
+		if msg.MsgType == "" {
+			msg.MsgType = mevt.MsgNotice
+		}
+		for _, toRoomID := range utils.ResolveRooms(cli, s.ServiceUserID(), roomID) {
+			if _, e := cli.SendMessageEvent(toRoomID, mevt.EventMessage, msg); e != nil {
+				logger.WithError(e).WithField("room_id", toRoomID).Print(
+					"Failed to send generic webhook notification to room.")
+			}
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// render executes the templates with the payload.
+func render(textTemplate, htmlTemplate string, payload interface{}) (mevt.MessageEventContent, error) {
+	var msg mevt.MessageEventContent
+	// we don't check whether the templates parse because we already did when storing them in the db
+	textTmpl, _ := text.New("textTemplate").Funcs(templateFuncs).Parse(textTemplate)
+	var bodyBuffer bytes.Buffer
+	if err := textTmpl.Execute(&bodyBuffer, payload); err != nil {
+		return msg, err
+	}
+	msg.Body = bodyBuffer.String()
+	if htmlTemplate != "" {
+		htmlTmpl, _ := html.New("htmlTemplate").Funcs(templateFuncs).Parse(htmlTemplate)
+		var formattedBodyBuffer bytes.Buffer
+		if err := htmlTmpl.Execute(&formattedBodyBuffer, payload); err != nil {
+			return msg, err
+		}
+		msg.Format = mevt.FormatHTML
+		msg.FormattedBody = formattedBodyBuffer.String()
+	}
+	return msg, nil
+}
+
+// fallback returns a message with the payload pretty-printed as a code block.
+func fallback(body []byte, payload interface{}, isJSON bool) mevt.MessageEventContent {
+	pretty := string(body)
+	if isJSON {
+		if p, err := prettyJSON(payload); err == nil {
+			pretty = p
+		}
+	}
+	return mevt.MessageEventContent{
+		Body:          pretty,
+		Format:        mevt.FormatHTML,
+		FormattedBody: "<pre><code>" + html.HTMLEscapeString(pretty) + "</code></pre>",
+	}
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	var oldRooms *utils.RoomCreation
+	if old, ok := oldService.(*Service); ok {
+		oldRooms = &old.RoomCreation
+	}
+	roomID, err := s.CreateMissingRoom(client, s.ServiceUserID(), s.Owner, len(s.Rooms) > 0, oldRooms)
+	if err != nil {
+		return fmt.Errorf("failed to create room: %s", err)
+	}
+	if roomID != "" {
+		s.Rooms = map[id.RoomID]RoomConfig{roomID: {}}
+	}
+	for roomID, templates := range s.Rooms {
+		if templates.TextTemplate == "" && templates.HTMLTemplate != "" {
+			return fmt.Errorf("room %s has an html template but no plain text template", roomID)
+		}
+		if _, err := text.New("textTemplate").Funcs(templateFuncs).Parse(templates.TextTemplate); err != nil {
+			return fmt.Errorf("plain text template for room %s is invalid: %v", roomID, err)
+		}
+		if _, err := html.New("htmlTemplate").Funcs(templateFuncs).Parse(templates.HTMLTemplate); err != nil {
+			return fmt.Errorf("html template for room %s is invalid: %v", roomID, err)
+		}
+		if templates.MsgType != "" && templates.MsgType != mevt.MsgNotice && templates.MsgType != mevt.MsgText {
+			return fmt.Errorf("msg_type for room %s is neither 'm.notice' nor 'm.text'", roomID)
+		}
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+// PostRegister deletes this service if there are no rooms to send to.
+func (s *Service) PostRegister(oldService types.Service) {
+	if len(s.Rooms) > 0 {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_type": s.ServiceType(),
+		"service_id":   s.ServiceID(),
+	})
+	logger.Info("Removing service as no rooms are registered.")
+	if err := database.GetServiceDB().DeleteService(s.ServiceID()); err != nil {
+		logger.WithError(err).Error("Failed to delete service")
+	}
+}
+
+// TargetRooms returns the rooms payloads are sent into.
+func (s *Service) TargetRooms() []id.RoomID {
+	roomIDs := make([]id.RoomID, 0, len(s.Rooms))
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
+func (s *Service) joinRooms(client types.MatrixClient) {
+	for roomID := range s.Rooms {
+		if utils.IsLabel(roomID) {
+			continue // labelled rooms are joined by the service which labels them
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
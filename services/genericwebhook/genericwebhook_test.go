@@ -0,0 +1,111 @@
+package genericwebhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestNotify(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	// Intercept message sending to Matrix and mock responses
+	sent := make(map[id.RoomID]mevt.MessageEventContent)
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/hierarchy") {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		if !strings.Contains(req.URL.Path, "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		sent[id.RoomID(strings.Split(req.URL.Path, "/")[5])] = msg
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hs", "@neb:hs", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(`{
+		"secret": "open sesame",
+		"rooms": {
+			"!templated:hs": {
+				"text_template": "{{.service}} deployed by {{.user.name}}",
+				"html_template": "<b>{{.service}}</b> deployed by {{.user.name}}",
+				"msg_type": "m.text"
+			},
+			"!raw:hs": {}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Register(nil, matrixCli); err != nil {
+		// Joining rooms fails with the mock transport but isn't an error
+		t.Fatal(err)
+	}
+
+	post := func(secret, body string) int {
+		req, _ := http.NewRequest("POST", "", bytes.NewBufferString(body))
+		req.Header.Set("X-Webhook-Secret", secret)
+		w := httptest.NewRecorder()
+		srv.OnReceiveWebhook(w, req, matrixCli)
+		return w.Code
+	}
+
+	if code := post("wrong", `{}`); code != 403 || len(sent) != 0 {
+		t.Fatalf("Expected a bad secret to be rejected, got %d", code)
+	}
+	if code := post("open sesame", `{"service":"<api>","user":{"name":"alice"}}`); code != 200 {
+		t.Fatalf("Expected response 200 OK, got %d", code)
+	}
+	msg := sent["!templated:hs"]
+	if msg.MsgType != mevt.MsgText || msg.Body != "<api> deployed by alice" || msg.FormattedBody != "<b>&lt;api&gt;</b> deployed by alice" {
+		t.Errorf("Bad templated message: %+v", msg)
+	}
+	msg = sent["!raw:hs"]
+	if msg.MsgType != mevt.MsgNotice || !strings.HasPrefix(msg.FormattedBody, "<pre><code>{\n  &#34;service&#34;: &#34;&lt;api&gt;&#34;,") {
+		t.Errorf("Bad fallback message: %+v", msg)
+	}
+
+	if code := post("open sesame", `not json`); code != 200 {
+		t.Fatalf("Expected response 200 OK, got %d", code)
+	}
+	if msg := sent["!templated:hs"]; msg.Body != "not json" || msg.FormattedBody != "<pre><code>not json</code></pre>" {
+		t.Errorf("Expected payloads which aren't JSON to fall back to a code block, got %+v", msg)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"rooms":{"!a:hs":{"text_template":"{{.broken"}}}`,
+		`{"rooms":{"!a:hs":{"html_template":"<b>{{.x}}</b>"}}}`,
+		`{"rooms":{"!a:hs":{"text_template":"{{.x}}","msg_type":"m.image"}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected an error registering %s", config)
+		}
+	}
+}
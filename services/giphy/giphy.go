@@ -4,11 +4,14 @@ package giphy
 import (
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/matrix-org/go-neb/secrets"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
@@ -34,8 +37,10 @@ type result struct {
 	} `json:"images"`
 }
 
-type giphySearch struct {
-	Data result `json:"data"`
+// giphyResponse is a response from the Giphy API. Depending on the endpoint, its data is a list of
+// results or a single result, which is an empty list if there isn't one.
+type giphyResponse struct {
+	Data json.RawMessage `json:"data"`
 }
 
 // Service contains the Config fields for the Giphy Service.
@@ -43,22 +48,71 @@ type giphySearch struct {
 // Example request:
 //   {
 //       "api_key": "dc6zaTOxFJmzC",
-//       "use_downsized": false
+//       "use_downsized": false,
+//       "rating": "pg",
+//       "max_results": 10
 //   }
 type Service struct {
 	types.DefaultService
 	// The Giphy API key to use when making HTTP requests to Giphy.
-	// The public beta API key is "dc6zaTOxFJmzC".
+	// The public beta API key is "dc6zaTOxFJmzC". This may instead be a reference to a secret store, see the secrets package.
 	APIKey string `json:"api_key"`
 	// Whether to use the downsized image from Giphy.
 	// Uses the original image when set to false.
 	// Defaults to false.
 	UseDownsized bool `json:"use_downsized"`
+	// Optional. The highest content rating of GIFs to respond with: "g", "pg", "pg-13" or "r".
+	// Defaults to Giphy's default, which allows every rating.
+	Rating string `json:"rating"`
+	// Optional. If greater than 1, !giphy picks one of this many search results at random, so
+	// that repeating a search gives a different GIF. Defaults to the single GIF Giphy's
+	// "text-to-gif" engine picks.
+	MaxResults int `json:"max_results"`
+	// Whether to respond with a link to the GIF on Giphy rather than uploading it to the
+	// homeserver, for homeservers with small media quotas. Defaults to false.
+	UseLink bool `json:"use_link"`
+}
+
+// The ratings Giphy accepts, from most to least restrictive.
+var ratings = []string{"g", "pg", "pg-13", "r"}
+
+// The most search results Giphy returns.
+const maxSearchResults = 50
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// SetupQuestions asks for the Giphy API key.
+func (s *Service) SetupQuestions() []types.SetupQuestion {
+	return []types.SetupQuestion{
+		{Prompt: "What is your Giphy API key?", Apply: types.StoreAnswer(&s.APIKey)},
+	}
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.Rating != "" && !isRating(s.Rating) {
+		return fmt.Errorf("rating must be one of %s", strings.Join(ratings, ", "))
+	}
+	if s.MaxResults < 0 || s.MaxResults > maxSearchResults {
+		return fmt.Errorf("max_results must be at most %d", maxSearchResults)
+	}
+	return nil
+}
+
+func isRating(rating string) bool {
+	for _, r := range ratings {
+		if r == rating {
+			return true
+		}
+	}
+	return false
 }
 
 // Commands supported:
 //   !giphy some search query without quotes
 // Responds with a suitable GIF into the same room as the command.
+//   !giphy random cats
+// Responds with a random GIF with the given tag, or any GIF if no tag is given.
 func (s *Service) Commands(client types.MatrixClient) []types.Command {
 	return []types.Command{
 		types.Command{
@@ -67,6 +121,16 @@ func (s *Service) Commands(client types.MatrixClient) []types.Command {
 				return s.cmdGiphy(client, roomID, userID, args)
 			},
 		},
+		types.Command{
+			Path: []string{"giphy", "random"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				gifResult, err := s.randomGiphy(strings.Join(args, " "))
+				if err != nil {
+					return nil, err
+				}
+				return s.respond(client, gifResult)
+			},
+		},
 	}
 }
 
@@ -77,7 +141,12 @@ func (s *Service) cmdGiphy(client types.MatrixClient, roomID id.RoomID, userID i
 	if err != nil {
 		return nil, err
 	}
+	return s.respond(client, gifResult)
+}
 
+// respond returns the message content for the GIF, either uploading it to the homeserver or
+// linking to it.
+func (s *Service) respond(client types.MatrixClient, gifResult *result) (interface{}, error) {
 	image := gifResult.Images.Original
 	if s.UseDownsized {
 		image = gifResult.Images.Downsized
@@ -86,6 +155,12 @@ func (s *Service) cmdGiphy(client types.MatrixClient, roomID id.RoomID, userID i
 	if image.URL == "" {
 		return nil, fmt.Errorf("No results")
 	}
+	if s.UseLink {
+		return mevt.MessageEventContent{
+			MsgType: mevt.MsgText,
+			Body:    image.URL,
+		}, nil
+	}
 	resUpload, err := client.UploadLink(image.URL)
 	if err != nil {
 		return nil, err
@@ -107,28 +182,73 @@ func (s *Service) cmdGiphy(client types.MatrixClient, roomID id.RoomID, userID i
 // searchGiphy returns info about a gif
 func (s *Service) searchGiphy(query string) (*result, error) {
 	log.Info("Searching giphy for ", query)
-	u, err := url.Parse("http://api.giphy.com/v1/gifs/translate")
+	if s.MaxResults <= 1 {
+		return s.getResult("translate", url.Values{"s": {query}})
+	}
+	data, err := s.get("search", url.Values{"q": {query}, "limit": {strconv.Itoa(s.MaxResults)}})
 	if err != nil {
 		return nil, err
 	}
-	q := u.Query()
-	q.Set("s", query)
-	q.Set("api_key", s.APIKey)
-	u.RawQuery = q.Encode()
-	res, err := http.Get(u.String())
-	if res != nil {
-		defer res.Body.Close()
+	var results []result
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("No results")
+	}
+	return &results[rand.Intn(len(results))], nil
+}
+
+// randomGiphy returns info about a random gif with the tag, which may be empty.
+func (s *Service) randomGiphy(tag string) (*result, error) {
+	log.Info("Fetching random giphy for ", tag)
+	params := url.Values{}
+	if tag != "" {
+		params.Set("tag", tag)
 	}
+	return s.getResult("random", params)
+}
+
+// getResult calls a Giphy endpoint which returns a single result.
+func (s *Service) getResult(endpoint string, params url.Values) (*result, error) {
+	data, err := s.get(endpoint, params)
 	if err != nil {
 		return nil, err
 	}
-	var search giphySearch
-	if err := json.NewDecoder(res.Body).Decode(&search); err != nil {
+	var gifResult result
+	if err := json.Unmarshal(data, &gifResult); err != nil {
 		// Giphy returns a JSON object which has { data: [] } if there are 0 results.
 		// This fails to be deserialised by Go.
 		return nil, fmt.Errorf("No results")
 	}
-	return &search.Data, nil
+	return &gifResult, nil
+}
+
+// get calls a Giphy GIF endpoint, e.g. "search", and returns the data in its response.
+func (s *Service) get(endpoint string, params url.Values) (json.RawMessage, error) {
+	apiKey, err := secrets.Resolve(s.APIKey)
+	if err != nil {
+		return nil, err
+	}
+	params.Set("api_key", apiKey)
+	if s.Rating != "" {
+		params.Set("rating", s.Rating)
+	}
+	res, err := httpClient.Get("https://api.giphy.com/v1/gifs/" + endpoint + "?" + params.Encode())
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Giphy returned HTTP %d", res.StatusCode)
+	}
+	var giphyRes giphyResponse
+	if err := json.NewDecoder(res.Body).Decode(&giphyRes); err != nil {
+		return nil, err
+	}
+	return giphyRes.Data, nil
 }
 
 func asInt(strInt string) int {
@@ -0,0 +1,98 @@
+package giphy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+const gifJSON = `{"slug": "%s", "images": {"original": {"url": "https://media.giphy.com/%s.gif", "width": "200", "height": "100", "size": "1234"}}}`
+
+func TestCommands(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	var requests []string
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		query := req.URL.Query()
+		if query.Get("api_key") != "key" || query.Get("rating") != "pg" {
+			t.Errorf("Bad query for %s: %v", req.URL.Path, query)
+		}
+		requests = append(requests, req.URL.Path)
+		var body string
+		switch req.URL.Path {
+		case "/v1/gifs/search":
+			if query.Get("limit") != "5" {
+				t.Errorf("Bad limit: %s", query.Get("limit"))
+			}
+			body = `{"data": [` + fmt.Sprintf(gifJSON, "cat", "cat") + `]}`
+		case "/v1/gifs/random":
+			if query.Get("tag") == "nothing" {
+				body = `{"data": []}`
+			} else {
+				body = `{"data": ` + fmt.Sprintf(gifJSON, "random-"+query.Get("tag"), "random") + `}`
+			}
+		default:
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL)
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})}
+
+	matrixCli, _ := mautrix.NewClient("https://hs", "@neb:hs", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("Unexpected request to the homeserver: %s", req.URL)
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(
+		`{"api_key": "key", "rating": "pg", "max_results": 5, "use_link": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Register(nil, matrixCli); err != nil {
+		t.Fatal(err)
+	}
+	run := func(args ...string) (interface{}, error) {
+		var best *types.Command
+		cmds := srv.Commands(matrixCli)
+		for i := range cmds {
+			if cmds[i].Matches(args) && (best == nil || len(cmds[i].Path) > len(best.Path)) {
+				best = &cmds[i]
+			}
+		}
+		return best.Command("!room:hs", "@alice:hs", args[len(best.Path):])
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"giphy", "cat"}, "https://media.giphy.com/cat.gif"},
+		{[]string{"giphy", "random", "dogs"}, "https://media.giphy.com/random.gif"},
+	} {
+		content, err := run(tc.args...)
+		if err != nil {
+			t.Fatalf("%v: %s", tc.args, err)
+		}
+		if msg := content.(mevt.MessageEventContent); msg.Body != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.args, msg.Body, tc.want)
+		}
+	}
+	if _, err := run("giphy", "random", "nothing"); err == nil || err.Error() != "No results" {
+		t.Errorf("Expected no results, got %v", err)
+	}
+	if len(requests) != 3 {
+		t.Errorf("Expected 3 requests, got %v", requests)
+	}
+
+	bad, _ := types.CreateService("id", ServiceType, "@neb:hs", []byte(`{"api_key": "key", "rating": "nc-17"}`))
+	if err := bad.Register(nil, matrixCli); err == nil {
+		t.Error("Expected an unknown rating to be rejected")
+	}
+}
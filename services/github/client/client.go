@@ -2,11 +2,15 @@ package client
 
 import (
 	"context"
+	"net/http"
 
 	"github.com/google/go-github/github"
 	"golang.org/x/oauth2"
 )
 
+// Transport is used for requests to the Github API. Tests replace it to replay recorded responses.
+var Transport = http.DefaultTransport
+
 // TrimmedRepository represents a cut-down version of github.Repository with only the keys the end-user is
 // likely to want.
 type TrimmedRepository struct {
@@ -48,6 +52,7 @@ func New(token string) *github.Client {
 			&oauth2.Token{AccessToken: token},
 		)
 	}
-	httpCli := oauth2.NewClient(context.TODO(), tokenSource)
+	ctx := context.WithValue(context.TODO(), oauth2.HTTPClient, &http.Client{Transport: Transport})
+	httpCli := oauth2.NewClient(ctx, tokenSource)
 	return github.NewClient(httpCli)
 }
@@ -0,0 +1,124 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"strings"
+
+	gogithub "github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/services/utils"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+// The overall CI state of a pull request, combining commit statuses and check runs.
+const (
+	ciSuccess = "success"
+	ciPending = "pending"
+	ciFailure = "failure"
+)
+
+var stateColours = map[string]string{
+	"open":    "#30bf2b",
+	"closed":  "#fc3a25",
+	"merged":  "#6f42c1",
+	ciSuccess: "#30bf2b",
+	ciPending: "#dbab09",
+	ciFailure: "#fc3a25",
+}
+
+// issueState returns "open", "closed" or "merged".
+func issueState(i *gogithub.Issue, pr *gogithub.PullRequest) string {
+	if pr != nil && pr.GetMerged() {
+		return "merged"
+	}
+	return i.GetState()
+}
+
+// ciState returns the CI state of the commit, or "" if it has no statuses or check runs. Any
+// failure fails the commit, otherwise anything unfinished makes it pending.
+func ciState(cli *gogithub.Client, owner, repo, ref string) string {
+	failed, pending, found := false, false, false
+
+	combined, _, err := cli.Repositories.GetCombinedStatus(context.Background(), owner, repo, ref, nil)
+	if err != nil {
+		log.WithError(err).WithField("ref", ref).Print("Failed to fetch combined status")
+	} else if combined.GetTotalCount() > 0 {
+		found = true
+		switch combined.GetState() {
+		case "failure", "error":
+			failed = true
+		case "pending":
+			pending = true
+		}
+	}
+
+	checks, _, err := cli.Checks.ListCheckRunsForRef(context.Background(), owner, repo, ref, &gogithub.ListCheckRunsOptions{
+		ListOptions: gogithub.ListOptions{PerPage: 100},
+	})
+	if err != nil {
+		log.WithError(err).WithField("ref", ref).Print("Failed to fetch check runs")
+	} else {
+		for _, c := range checks.CheckRuns {
+			found = true
+			if c.GetStatus() != "completed" {
+				pending = true
+				continue
+			}
+			switch c.GetConclusion() {
+			case "failure", "timed_out", "cancelled", "action_required":
+				failed = true
+			}
+		}
+	}
+
+	switch {
+	case failed:
+		return ciFailure
+	case pending:
+		return ciPending
+	case found:
+		return ciSuccess
+	}
+	return ""
+}
+
+// issueMessage describes an issue or pull request: its state, labels and assignees, and for pull
+// requests the CI state, which may be "" if there isn't any CI.
+func issueMessage(i *gogithub.Issue, pr *gogithub.PullRequest, ci string) *mevt.MessageEventContent {
+	var htmlBuffer bytes.Buffer
+
+	state := issueState(i, pr)
+	htmlBuffer.WriteString(fmt.Sprintf(`<a href="%s">%s</a><br />[<strong><font color='%s'>%s</font></strong>]`,
+		html.EscapeString(i.GetHTMLURL()), html.EscapeString(i.GetTitle()), stateColours[state], state))
+
+	if ci != "" {
+		htmlBuffer.WriteString(fmt.Sprintf(" | CI: <font color='%s'>%s</font>", stateColours[ci], ci))
+	}
+
+	if len(i.Labels) > 0 {
+		var labels []string
+		for _, l := range i.Labels {
+			labels = append(labels, fmt.Sprintf("<code>%s</code>", html.EscapeString(l.GetName())))
+		}
+		htmlBuffer.WriteString(" | Labels: " + strings.Join(labels, ", "))
+	}
+
+	// Older issues may only have the single assignee.
+	assignees := i.Assignees
+	if len(assignees) == 0 && i.Assignee != nil {
+		assignees = []*gogithub.User{i.Assignee}
+	}
+	if len(assignees) > 0 {
+		var logins []string
+		for _, u := range assignees {
+			logins = append(logins, u.GetLogin())
+		}
+		htmlBuffer.WriteString(" | Assigned to " + html.EscapeString(strings.Join(logins, ", ")))
+	}
+
+	msg := utils.StrippedHTMLMessage(mevt.MsgNotice, htmlBuffer.String())
+	return &msg
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/realms/github"
 	"github.com/matrix-org/go-neb/services/github/client"
+	"github.com/matrix-org/go-neb/services/utils"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
@@ -65,15 +66,21 @@ var ownerRepoRegex = regexp.MustCompile(`^([A-z0-9-_.]+)/([A-z0-9-_.]+)$`)
 //    }
 //  }
 //
+// Issue and pull request expansions show their state, labels and assignees, and for pull
+// requests whether CI is passing. Set TerseExpansions to only show the link and title.
+//
 // Example request:
 //   {
-//       "RealmID": "github-realm-id"
+//       "RealmID": "github-realm-id",
+//       "TerseExpansions": false
 //   }
 type Service struct {
 	types.DefaultService
 	// The ID of an existing "github" realm. This realm will be used to obtain
 	// credentials of users when they create issues on Github.
 	RealmID string
+	// If true, issue and pull request expansions only show the link and title.
+	TerseExpansions bool
 }
 
 func (s *Service) requireGithubClientFor(userID id.UserID) (cli *gogithub.Client, resp interface{}, err error) {
@@ -84,8 +91,12 @@ func (s *Service) requireGithubClientFor(userID id.UserID) (cli *gogithub.Client
 			return
 		}
 		if ghRealm, ok := r.(*github.Realm); ok {
+			body := "You need to log into Github before you can create issues."
+			if ghRealm.DeviceFlow {
+				body += " Say " + cmdGithubLoginUsage + " to log in."
+			}
 			resp = matrix.StarterLinkMessage{
-				Body: "You need to log into Github before you can create issues.",
+				Body: body,
 				Link: ghRealm.StarterLink,
 			}
 		} else {
@@ -95,6 +106,91 @@ func (s *Service) requireGithubClientFor(userID id.UserID) (cli *gogithub.Client
 	return
 }
 
+const cmdGithubLoginUsage = `!github login`
+
+func (s *Service) cmdGithubLogin(cli types.MatrixClient, roomID id.RoomID, userID id.UserID) (interface{}, error) {
+	r, err := database.GetServiceDB().LoadAuthRealm(s.RealmID)
+	if err != nil {
+		return nil, err
+	}
+	ghRealm, ok := r.(*github.Realm)
+	if !ok {
+		return nil, fmt.Errorf("Failed to cast realm %s into a GithubRealm", s.RealmID)
+	}
+	if !ghRealm.DeviceFlow {
+		return matrix.StarterLinkMessage{
+			Body: "Logging in with a code isn't enabled. Follow the link to log into Github instead.",
+			Link: ghRealm.StarterLink,
+		}, nil
+	}
+
+	logger := log.WithFields(log.Fields{
+		"room_id":  roomID,
+		"user_id":  userID,
+		"realm_id": s.RealmID,
+	})
+	res, err := ghRealm.StartDeviceFlow(userID, func(err error) {
+		body := fmt.Sprintf("%s has logged into Github.", userID)
+		if err != nil {
+			body = fmt.Sprintf("%s failed to log into Github: %s", userID, err)
+		}
+		_, err = cli.SendMessageEvent(roomID, mevt.EventMessage, mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    body,
+		})
+		if err != nil {
+			logger.WithError(err).Print("Failed to send login result")
+		}
+	})
+	if err != nil {
+		logger.WithError(err).Print("Failed to start device flow")
+		return nil, fmt.Errorf("Failed to start logging into Github")
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body: fmt.Sprintf(
+			"To log into Github, visit %s and enter the code %s within %d minutes.",
+			res.URL, res.UserCode, res.ExpiresInSecs/60,
+		),
+	}, nil
+}
+
+const cmdGithubTokenUsage = `!github token <personal access token>`
+
+func (s *Service) cmdGithubToken(userID id.UserID, args []string, direct bool) (interface{}, error) {
+	if !direct {
+		// The token has been seen by everyone in the room, so don't use it.
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body: "Personal access tokens can only be registered in a direct chat with me. " +
+				"As this one has been posted here, revoke it on Github and create a new one.",
+		}, nil
+	}
+	if len(args) != 1 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Usage: " + cmdGithubTokenUsage,
+		}, nil
+	}
+	r, err := database.GetServiceDB().LoadAuthRealm(s.RealmID)
+	if err != nil {
+		return nil, err
+	}
+	ghRealm, ok := r.(*github.Realm)
+	if !ok {
+		return nil, fmt.Errorf("Failed to cast realm %s into a GithubRealm", s.RealmID)
+	}
+	login, err := ghRealm.StorePersonalAccessToken(userID, args[0])
+	if err != nil {
+		log.WithError(err).WithField("user_id", userID).Print("Failed to store personal access token")
+		return nil, fmt.Errorf("Failed to register the token: %s", err)
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Registered the token. You are now logged into Github as %s.", login),
+	}, nil
+}
+
 const numberGithubSearchSummaries = 3
 const cmdGithubSearchUsage = `!github search "search query"`
 
@@ -127,9 +223,7 @@ func (s *Service) cmdGithubSearch(roomID id.RoomID, userID id.UserID, args []str
 
 	numResults := *searchResult.Total
 	var htmlBuffer bytes.Buffer
-	var plainBuffer bytes.Buffer
 	htmlBuffer.WriteString(fmt.Sprintf("Found %d results, here are the most relevant:<br><ol>", numResults))
-	plainBuffer.WriteString(fmt.Sprintf("Found %d results, here are the most relevant:\n", numResults))
 	for i, issue := range searchResult.Issues {
 		if i >= numberGithubSearchSummaries {
 			break
@@ -139,16 +233,11 @@ func (s *Service) cmdGithubSearch(roomID id.RoomID, userID id.UserID, args []str
 		}
 		escapedTitle, escapedUserLogin := html.EscapeString(*issue.Title), html.EscapeString(*issue.User.Login)
 		htmlBuffer.WriteString(fmt.Sprintf(`<li><a href="%s" rel="noopener">%s: %s</a></li>`, *issue.HTMLURL, escapedUserLogin, escapedTitle))
-		plainBuffer.WriteString(fmt.Sprintf("%d. %s\n", i+1, *issue.HTMLURL))
 	}
 	htmlBuffer.WriteString("</ol>")
 
-	return &mevt.MessageEventContent{
-		Body:          plainBuffer.String(),
-		MsgType:       mevt.MsgNotice,
-		Format:        "org.matrix.custom.html",
-		FormattedBody: htmlBuffer.String(),
-	}, nil
+	msg := utils.StrippedHTMLMessage(mevt.MsgNotice, htmlBuffer.String())
+	return &msg, nil
 }
 
 const cmdGithubCreateUsage = `!github create [owner/repo] "issue title" "description"`
@@ -182,7 +271,7 @@ func (s *Service) cmdGithubCreate(roomID id.RoomID, userID id.UserID, args []str
 
 	if len(ownerRepoGroups) == 0 {
 		// look for a default repo
-		defaultRepo := options.DefaultRepo
+		defaultRepo := s.defaultRepo(roomID, userID)
 		if defaultRepo == "" {
 			return &mevt.MessageEventContent{
 				MsgType: mevt.MsgNotice,
@@ -286,7 +375,7 @@ func (s *Service) cmdGithubReact(roomID id.RoomID, userID id.UserID, args []stri
 	}
 
 	// get owner,repo,issue,resp out of args[0]
-	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, cmdGithubReactUsage)
+	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, userID, cmdGithubReactUsage)
 	if resp != nil {
 		return resp, nil
 	}
@@ -322,7 +411,7 @@ func (s *Service) cmdGithubComment(roomID id.RoomID, userID id.UserID, args []st
 	}
 
 	// get owner,repo,issue,resp out of args[0]
-	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, cmdGithubCommentUsage)
+	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, userID, cmdGithubCommentUsage)
 	if resp != nil {
 		return resp, nil
 	}
@@ -374,7 +463,7 @@ func (s *Service) cmdGithubAssign(roomID id.RoomID, userID id.UserID, args []str
 	}
 
 	// get owner,repo,issue,resp out of args[0]
-	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, cmdGithubAssignUsage)
+	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, userID, cmdGithubAssignUsage)
 	if resp != nil {
 		return resp, nil
 	}
@@ -408,7 +497,7 @@ func (s *Service) githubIssueCloseReopen(roomID id.RoomID, userID id.UserID, arg
 	}
 
 	// get owner,repo,issue,resp out of args[0]
-	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, help)
+	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, userID, help)
 	if resp != nil {
 		return resp, nil
 	}
@@ -443,7 +532,7 @@ func (s *Service) cmdGithubReopen(roomID id.RoomID, userID id.UserID, args []str
 	return s.githubIssueCloseReopen(roomID, userID, args, "open", "open", cmdGithubCloseUsage)
 }
 
-func (s *Service) getIssueDetailsFor(input string, roomID id.RoomID, usage string) (owner, repo string, issueNum int, resp interface{}) {
+func (s *Service) getIssueDetailsFor(input string, roomID id.RoomID, userID id.UserID, usage string) (owner, repo string, issueNum int, resp interface{}) {
 	// We expect the input to look like:
 	// "[owner/repo]#issue"
 	// They can omit the owner/repo if there is a default one set.
@@ -472,7 +561,7 @@ func (s *Service) getIssueDetailsFor(input string, roomID id.RoomID, usage strin
 
 	if ownerRepoIssueGroups[1] == "" {
 		// issue only match, this only works if there is a default repo
-		defaultRepo := s.defaultRepo(roomID)
+		defaultRepo := s.defaultRepo(roomID, userID)
 		if defaultRepo == "" {
 			resp = &mevt.MessageEventContent{
 				MsgType: mevt.MsgNotice,
@@ -509,10 +598,30 @@ func (s *Service) expandIssue(roomID id.RoomID, userID id.UserID, owner, repo st
 		return nil
 	}
 
-	return &mevt.MessageEventContent{
-		MsgType: mevt.MsgNotice,
-		Body:    fmt.Sprintf("%s : %s", *i.HTMLURL, *i.Title),
+	if s.TerseExpansions {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("%s : %s", *i.HTMLURL, *i.Title),
+		}
 	}
+
+	var pr *gogithub.PullRequest
+	var ci string
+	if i.PullRequestLinks != nil {
+		// The issue doesn't say whether a pull request was merged, or what its head is.
+		pr, _, err = cli.PullRequests.Get(context.Background(), owner, repo, issueNum)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"owner":  owner,
+				"repo":   repo,
+				"number": issueNum,
+			}).Print("Failed to fetch pull request")
+			pr = nil
+		} else if pr.Head != nil {
+			ci = ciState(cli, owner, repo, pr.Head.GetSHA())
+		}
+	}
+	return issueMessage(i, pr, ci)
 }
 
 func (s *Service) expandCommit(roomID id.RoomID, userID id.UserID, owner, repo, sha string) interface{} {
@@ -530,15 +639,12 @@ func (s *Service) expandCommit(roomID id.RoomID, userID id.UserID, owner, repo,
 
 	commit := c.Commit
 	var htmlBuffer bytes.Buffer
-	var plainBuffer bytes.Buffer
 
 	shortURL := strings.TrimSuffix(*c.HTMLURL, *c.SHA) + sha
-	htmlBuffer.WriteString(fmt.Sprintf("<a href=\"%s\">%s</a><br />", *c.HTMLURL, shortURL))
-	plainBuffer.WriteString(fmt.Sprintf("%s\n", shortURL))
+	htmlBuffer.WriteString(fmt.Sprintf("<a href=\"%s\">%s</a><br />", html.EscapeString(*c.HTMLURL), html.EscapeString(shortURL)))
 
 	if c.Stats != nil {
 		htmlBuffer.WriteString(fmt.Sprintf("[<strong><font color='#1cc3ed'>~%d</font>, <font color='#30bf2b'>+%d</font>, <font color='#fc3a25'>-%d</font></strong>] ", len(c.Files), *c.Stats.Additions, *c.Stats.Deletions))
-		plainBuffer.WriteString(fmt.Sprintf("[~%d, +%d, -%d] ", len(c.Files), *c.Stats.Additions, *c.Stats.Deletions))
 	}
 
 	if commit.Author != nil {
@@ -549,25 +655,25 @@ func (s *Service) expandCommit(roomID id.RoomID, userID id.UserID, owner, repo,
 			authorName = *commit.Author.Login
 		}
 
-		htmlBuffer.WriteString(fmt.Sprintf("%s: ", authorName))
-		plainBuffer.WriteString(fmt.Sprintf("%s: ", authorName))
+		htmlBuffer.WriteString(html.EscapeString(authorName) + ": ")
 	}
 
 	if commit.Message != nil {
 		segs := strings.SplitN(*commit.Message, "\n", 2)
-		htmlBuffer.WriteString(segs[0])
-		plainBuffer.WriteString(segs[0])
+		htmlBuffer.WriteString(html.EscapeString(segs[0]))
 	}
 
-	return &mevt.MessageEventContent{
-		Body:          plainBuffer.String(),
-		MsgType:       mevt.MsgNotice,
-		Format:        mevt.FormatHTML,
-		FormattedBody: htmlBuffer.String(),
-	}
+	msg := utils.StrippedHTMLMessage(mevt.MsgNotice, htmlBuffer.String())
+	return &msg
 }
 
 // Commands supported:
+//    !github login
+// Responds with a code to enter on github.com to link a Github account to the Matrix user ID
+// issuing the command, if the realm has the device flow enabled, or a Starter Link otherwise.
+//    !github token <personal access token>
+// Links a Github account with a personal access token instead. This only works in a direct chat
+// with the bot, see DirectChatCommands.
 //    !github create owner/repo "issue title" "optional issue description"
 // Responds with the outcome of the issue creation request. This command requires
 // a Github account to be linked to the Matrix user ID issuing the command. If there
@@ -576,8 +682,70 @@ func (s *Service) expandCommit(roomID id.RoomID, userID id.UserID, owner, repo,
 // Responds with the outcome of the issue comment creation request. This command requires
 // a Github account to be linked to the Matrix user ID issuing the command. If there
 // is no link, it will return a Starter Link instead.
+//    !github pr approve [owner/repo]#pr "optional comment"
+//    !github pr request-changes [owner/repo]#pr "comment"
+// Reviews the pull request as the Github account linked to the Matrix user ID issuing the command.
+//    !github pr diffstat [owner/repo]#pr
+// Responds with the number of lines changed in the pull request, and in the files with the most changes.
+//    !github pr merge [owner/repo]#pr [merge|squash|rebase]
+// Merges the pull request with the given method, or the repository's default.
+//    !github defaultrepo [set owner/repo|clear]
+// Shows, sets or clears the user's default repo, which is used by their commands in every room
+// instead of the room's default repo.
+//    !github label [owner/repo]#issue label[,label...]
+//    !github unlabel [owner/repo]#issue label[,label...]
+//    !github milestone [owner/repo]#issue "milestone title"
+// Adds or removes labels, or sets the milestone. Labels and milestones must already exist; if
+// they don't, the response lists the ones which do.
+// Assigning, labelling, closing and reopening issues, setting their milestone, and merging pull
+// requests, are privileged commands, see types.ACL.
+// CommandUsage returns the usage of each command, for the built-in "!help" command.
+func (s *Service) CommandUsage() map[string]string {
+	return map[string]string{
+		"github login":              cmdGithubLoginUsage,
+		"github token":              cmdGithubTokenUsage,
+		"github search":             cmdGithubSearchUsage,
+		"github create":             cmdGithubCreateUsage,
+		"github react":              cmdGithubReactUsage,
+		"github comment":            cmdGithubCommentUsage,
+		"github assign":             cmdGithubAssignUsage,
+		"github label":              cmdGithubLabelUsage,
+		"github unlabel":            cmdGithubUnlabelUsage,
+		"github milestone":          cmdGithubMilestoneUsage,
+		"github close":              cmdGithubCloseUsage,
+		"github reopen":             cmdGithubReopenUsage,
+		"github pr approve":         cmdGithubPRApproveUsage,
+		"github pr request-changes": cmdGithubPRRequestChangesUsage,
+		"github pr diffstat":        cmdGithubPRDiffstatUsage,
+		"github pr merge":           cmdGithubPRMergeUsage,
+		"github defaultrepo":        cmdGithubDefaultRepoUsage,
+	}
+}
+
 func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return s.commands(cli, false)
+}
+
+// DirectChatCommands are the same commands for a direct chat with the bot, where !github token
+// can be used to register a personal access token without other users seeing it.
+func (s *Service) DirectChatCommands(cli types.MatrixClient, userID id.UserID) []types.Command {
+	return s.commands(cli, true)
+}
+
+func (s *Service) commands(cli types.MatrixClient, direct bool) []types.Command {
 	return []types.Command{
+		{
+			Path: []string{"github", "login"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGithubLogin(cli, roomID, userID)
+			},
+		},
+		{
+			Path: []string{"github", "token"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGithubToken(userID, args, direct)
+			},
+		},
 		{
 			Path: []string{"github", "search"},
 			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
@@ -603,35 +771,100 @@ func (s *Service) Commands(cli types.MatrixClient) []types.Command {
 			},
 		},
 		{
-			Path: []string{"github", "assign"},
+			Path:       []string{"github", "assign"},
+			Privileged: true,
 			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
 				return s.cmdGithubAssign(roomID, userID, args)
 			},
 		},
 		{
-			Path: []string{"github", "close"},
+			Path:       []string{"github", "label"},
+			Privileged: true,
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGithubLabel(roomID, userID, args)
+			},
+		},
+		{
+			Path:       []string{"github", "unlabel"},
+			Privileged: true,
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGithubUnlabel(roomID, userID, args)
+			},
+		},
+		{
+			Path:       []string{"github", "milestone"},
+			Privileged: true,
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGithubMilestone(roomID, userID, args)
+			},
+		},
+		{
+			Path:       []string{"github", "close"},
+			Privileged: true,
 			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
 				return s.cmdGithubClose(roomID, userID, args)
 			},
 		},
 		{
-			Path: []string{"github", "reopen"},
+			Path:       []string{"github", "reopen"},
+			Privileged: true,
 			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
 				return s.cmdGithubReopen(roomID, userID, args)
 			},
 		},
+		{
+			Path: []string{"github", "pr", "approve"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGithubPRApprove(roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"github", "pr", "request-changes"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGithubPRRequestChanges(roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"github", "pr", "diffstat"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGithubPRDiffstat(roomID, userID, args)
+			},
+		},
+		{
+			Path:       []string{"github", "pr", "merge"},
+			Privileged: true,
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGithubPRMerge(roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"github", "defaultrepo"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdGithubDefaultRepo(roomID, userID, args)
+			},
+		},
 		{
 			Path: []string{"github", "help"},
 			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
 				return &mevt.MessageEventContent{
 					MsgType: mevt.MsgNotice,
 					Body: strings.Join([]string{
+						cmdGithubLoginUsage,
+						cmdGithubTokenUsage,
 						cmdGithubCreateUsage,
 						cmdGithubReactUsage,
 						cmdGithubCommentUsage,
 						cmdGithubAssignUsage,
+						cmdGithubLabelUsage,
+						cmdGithubUnlabelUsage,
+						cmdGithubMilestoneUsage,
 						cmdGithubCloseUsage,
 						cmdGithubReopenUsage,
+						cmdGithubPRApproveUsage,
+						cmdGithubPRRequestChangesUsage,
+						cmdGithubPRDiffstatUsage,
+						cmdGithubPRMergeUsage,
+						cmdGithubDefaultRepoUsage,
 					}, "\n"),
 				}, nil
 			},
@@ -641,8 +874,8 @@ func (s *Service) Commands(cli types.MatrixClient) []types.Command {
 
 // Expansions expands strings of the form:
 //   owner/repo#12
-// Where #12 is an issue number or pull request. If there is a default repository set on the room,
-// it will also expand strings of the form:
+// Where #12 is an issue number or pull request. If the sender or the room has a default repository
+// set, it will also expand strings of the form:
 //   #12
 // using the default repository.
 func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
@@ -661,7 +894,7 @@ func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
 				}
 				if matchingGroups[1] == "" && matchingGroups[2] == "" {
 					// issue only match, this only works if there is a default repo
-					defaultRepo := s.defaultRepo(roomID)
+					defaultRepo := s.defaultRepo(roomID, userID)
 					if defaultRepo == "" {
 						return nil
 					}
@@ -703,7 +936,7 @@ func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
 				}
 				if matchingGroups[1] == "" && matchingGroups[2] == "" {
 					// issue only match, this only works if there is a default repo
-					defaultRepo := s.defaultRepo(roomID)
+					defaultRepo := s.defaultRepo(roomID, userID)
 					if defaultRepo == "" {
 						return nil
 					}
@@ -771,13 +1004,18 @@ func (s *Service) loadBotOptions(roomID id.RoomID, logger *log.Entry) (result ty
 	return opts.Options.Github, nil
 }
 
-// defaultRepo returns the default repo for the given room, or an empty string.
-func (s *Service) defaultRepo(roomID id.RoomID) string {
+// defaultRepo returns the user's default repo, falling back to the default repo for the given
+// room, or an empty string.
+func (s *Service) defaultRepo(roomID id.RoomID, userID id.UserID) string {
 	logger := log.WithFields(log.Fields{
 		"room_id":     roomID,
+		"user_id":     userID,
 		"bot_user_id": s.ServiceUserID(),
 	})
-	// ignore any errors, we treat it the same as no options and log inside the method
+	// ignore any errors, we treat it the same as no options and log inside the methods
+	if userOpts, _ := loadUserOptions(userID, logger); userOpts.DefaultRepo != "" {
+		return userOpts.DefaultRepo
+	}
 	ghOpts, _ := s.loadBotOptions(roomID, logger)
 	return ghOpts.DefaultRepo
 }
@@ -0,0 +1,266 @@
+package github
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gogithub "github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/github/client"
+	"github.com/matrix-org/go-neb/services/github/webhook"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestIssueMessage(t *testing.T) {
+	str := func(s string) *string { return &s }
+	merged := true
+	issue := &gogithub.Issue{
+		HTMLURL:   str("https://github.com/matrix-org/go-neb/pull/5"),
+		Title:     str("Add <b>things</b>"),
+		State:     str("closed"),
+		Labels:    []gogithub.Label{{Name: str("bug")}, {Name: str("help wanted")}},
+		Assignees: []*gogithub.User{{Login: str("alice")}, {Login: str("bob")}},
+	}
+	pr := &gogithub.PullRequest{Merged: &merged}
+
+	msg := issueMessage(issue, pr, ciFailure)
+	wantBody := "Add <b>things</b> (https://github.com/matrix-org/go-neb/pull/5)\n[merged] | CI: failure | Labels: bug, help wanted | Assigned to alice, bob"
+	if msg.Body != wantBody {
+		t.Errorf("issueMessage body: want %q, got %q", wantBody, msg.Body)
+	}
+	wantHTML := `<a href="https://github.com/matrix-org/go-neb/pull/5">Add &lt;b&gt;things&lt;/b&gt;</a><br />` +
+		`[<strong><font color='#6f42c1'>merged</font></strong>] | CI: <font color='#fc3a25'>failure</font> | ` +
+		`Labels: <code>bug</code>, <code>help wanted</code> | Assigned to alice, bob`
+	if msg.FormattedBody != wantHTML {
+		t.Errorf("issueMessage HTML: want %q, got %q", wantHTML, msg.FormattedBody)
+	}
+
+	// Issues have no CI, and may only have the single assignee
+	issue = &gogithub.Issue{
+		HTMLURL:  str("https://github.com/matrix-org/go-neb/issues/6"),
+		Title:    str("Broken"),
+		State:    str("open"),
+		Assignee: &gogithub.User{Login: str("carol")},
+	}
+	msg = issueMessage(issue, nil, "")
+	wantBody = "Broken (https://github.com/matrix-org/go-neb/issues/6)\n[open] | Assigned to carol"
+	if msg.Body != wantBody {
+		t.Errorf("issueMessage body: want %q, got %q", wantBody, msg.Body)
+	}
+}
+
+func TestPushMatches(t *testing.T) {
+	push := &webhook.Push{Branch: "release/1.0", Paths: []string{"README.md", "docs/api/v1.md"}}
+	matchTests := []struct {
+		branches []string
+		paths    []string
+		want     bool
+	}{
+		{nil, nil, true},
+		{[]string{"main", "release/*"}, nil, true},
+		{[]string{"main"}, nil, false},
+		{nil, []string{"docs/**"}, true},
+		{nil, []string{"src/**"}, false},
+		{[]string{"release/*"}, []string{"src/**", "*.md"}, true},
+		{[]string{"main"}, []string{"docs/**"}, false},
+	}
+	for _, test := range matchTests {
+		if got := pushMatches(push, test.branches, test.paths); got != test.want {
+			t.Errorf("pushMatches(%v, %v): want %v, got %v", test.branches, test.paths, test.want, got)
+		}
+	}
+
+	// Tags aren't branches
+	if pushMatches(&webhook.Push{}, []string{"*"}, nil) {
+		t.Error("Expected a tag push not to match a branch filter")
+	}
+}
+
+func TestBatchPush(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	var sent []string
+	cli, _ := mautrix.NewClient("https://hyrule", "@ghwebhook:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/hierarchy") {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		var content mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			t.Fatal("Failed to decode message: ", err)
+		}
+		sent = append(sent, content.Body)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup"}`))}, nil
+	})}
+	s := makeService(t)
+	logger := log.WithField("test", "TestBatchPush")
+	room := id.RoomID(roomID)
+	push := func(forced bool, commits ...string) *webhook.Push {
+		p := &webhook.Push{
+			Repo:    "DummyAccount/reponame",
+			Ref:     "refs/heads/main",
+			Branch:  "main",
+			Pusher:  "alice",
+			Forced:  forced,
+			URL:     "https://github.com/DummyAccount/reponame/commit/" + commits[len(commits)-1],
+			Compare: "https://github.com/DummyAccount/reponame/compare/a...b",
+		}
+		for _, c := range commits {
+			p.Commits = append(p.Commits, webhook.PushCommit{ID: c, Summary: "alice: Commit " + c})
+		}
+		return p
+	}
+	first := &utils.Notification{Source: "DummyAccount/reponame", Summary: []utils.Span{utils.Plain("alice pushed")}}
+
+	// A lone push is sent as it was
+	s.batchPush(cli, logger, room, push(false, "1"), first, time.Hour)
+	s.flushPushes(cli, logger, room, "id|"+roomID+"|dummyaccount/reponame|refs/heads/main")
+	if len(sent) != 1 || sent[0] != "[DummyAccount/reponame] alice pushed" {
+		t.Fatalf("Expected the push to be sent as it was, got %q", sent)
+	}
+
+	sent = nil
+	s.batchPush(cli, logger, room, push(false, "1", "2"), first, time.Hour)
+	s.batchPush(cli, logger, room, push(true, "1", "3"), first, time.Hour)
+	s.batchPush(cli, logger, room, push(true, "1", "3", "4"), first, time.Hour)
+	if len(sent) != 0 {
+		t.Fatalf("Expected pushes to be held back, got %q", sent)
+	}
+	s.flushPushes(cli, logger, room, "id|"+roomID+"|dummyaccount/reponame|refs/heads/main")
+	want := "[DummyAccount/reponame] alice pushed 4 commits to main in 3 pushes, 2 of them forced: " +
+		"https://github.com/DummyAccount/reponame/commit/4\n" +
+		"alice: Commit 1\nalice: Commit 2\nalice: Commit 3\nalice: Commit 4"
+	if len(sent) != 1 || sent[0] != want {
+		t.Errorf("Expected one summary of the pushes %q, got %q", want, sent)
+	}
+}
+
+// noRealmStore has no auth realms, so Github requests are unauthenticated.
+type noRealmStore struct {
+	database.NopStorage
+}
+
+func (s *noRealmStore) LoadAuthRealm(realmID string) (types.AuthRealm, error) {
+	return nil, sql.ErrNoRows
+}
+
+func TestExpandIssueRecorded(t *testing.T) {
+	database.SetServiceDB(&noRealmStore{})
+	cassette := testutils.NewCassette(t, "testdata/expand_pull.json")
+	client.Transport = cassette
+	defer func() { client.Transport = http.DefaultTransport }()
+
+	s := &Service{DefaultService: types.NewDefaultService("id", "@neb:hyrule", ServiceType)}
+	msg, ok := s.expandIssue("!room:hyrule", "@alice:hyrule", "matrix-org", "go-neb", 5).(*mevt.MessageEventContent)
+	if !ok {
+		t.Fatal("Expected the pull request to be expanded")
+	}
+	want := "Add a Giphy service (https://github.com/matrix-org/go-neb/pull/5)\n[open] | CI: failure | Labels: enhancement | Assigned to bob"
+	if msg.Body != want {
+		t.Errorf("expandIssue: want %q, got %q", want, msg.Body)
+	}
+}
+
+// preferenceStore has a default repo for !room:hyrule, and stores users' preferences in memory.
+type preferenceStore struct {
+	database.NopStorage
+	prefs map[id.UserID]json.RawMessage
+}
+
+func (s *preferenceStore) LoadBotOptions(userID id.UserID, roomID id.RoomID) (types.BotOptions, error) {
+	if roomID != "!room:hyrule" {
+		return types.BotOptions{}, sql.ErrNoRows
+	}
+	return types.BotOptions{Options: &types.BotOptionsContent{
+		Github: types.GithubOptions{DefaultRepo: "matrix-org/go-neb"},
+	}}, nil
+}
+
+func (s *preferenceStore) LoadUserPreference(userID id.UserID, key string) (json.RawMessage, error) {
+	if pref, ok := s.prefs[userID]; ok && key == userPreferenceKey {
+		return pref, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *preferenceStore) StoreUserPreference(userID id.UserID, key string, pref json.RawMessage) error {
+	s.prefs[userID] = pref
+	return nil
+}
+
+func (s *preferenceStore) RemoveUserPreference(userID id.UserID, key string) error {
+	delete(s.prefs, userID)
+	return nil
+}
+
+func TestDefaultRepoPreference(t *testing.T) {
+	database.SetServiceDB(&preferenceStore{prefs: make(map[id.UserID]json.RawMessage)})
+	s := &Service{DefaultService: types.NewDefaultService("id", "@neb:hyrule", ServiceType)}
+	command := func(roomID id.RoomID, args ...string) string {
+		res, err := s.cmdGithubDefaultRepo(roomID, "@alice:hyrule", args)
+		if err != nil {
+			t.Fatalf("cmdGithubDefaultRepo(%q) returned an error: %s", args, err)
+		}
+		return res.(*mevt.MessageEventContent).Body
+	}
+
+	if got, want := command("!room:hyrule"), "You have no default repo set. This room's default repo is matrix-org/go-neb."; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if got := command("!room:hyrule", "set", "not a repo"); !strings.HasPrefix(got, "Malformed repo") {
+		t.Errorf("Expected a malformed repo to be rejected, got %q", got)
+	}
+	command("!room:hyrule", "set", "alice/dotfiles")
+	if got, want := command("!other:hyrule"), "Your default repo is alice/dotfiles."; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	// The user's default repo is preferred over the room's, in every room
+	for _, roomID := range []id.RoomID{"!room:hyrule", "!other:hyrule"} {
+		if repo := s.defaultRepo(roomID, "@alice:hyrule"); repo != "alice/dotfiles" {
+			t.Errorf("Expected alice's default repo in %s, got %q", roomID, repo)
+		}
+	}
+	owner, repo, num, resp := s.getIssueDetailsFor("#12", "!other:hyrule", "@alice:hyrule", cmdGithubCommentUsage)
+	if resp != nil || owner != "alice" || repo != "dotfiles" || num != 12 {
+		t.Errorf("Expected alice/dotfiles#12, got %s/%s#%d (%v)", owner, repo, num, resp)
+	}
+	if repo := s.defaultRepo("!room:hyrule", "@bob:hyrule"); repo != "matrix-org/go-neb" {
+		t.Errorf("Expected the room's default repo for other users, got %q", repo)
+	}
+
+	command("!room:hyrule", "clear")
+	if repo := s.defaultRepo("!room:hyrule", "@alice:hyrule"); repo != "matrix-org/go-neb" {
+		t.Errorf("Expected the room's default repo after clearing, got %q", repo)
+	}
+	if repo := s.defaultRepo("!other:hyrule", "@alice:hyrule"); repo != "" {
+		t.Errorf("Expected no default repo after clearing, got %q", repo)
+	}
+}
+
+func TestTokenOnlyInDirectChats(t *testing.T) {
+	database.SetServiceDB(&noRealmStore{})
+	s := &Service{DefaultService: types.NewDefaultService("id", "@neb:hyrule", ServiceType), RealmID: "ghrealm"}
+	res, err := s.cmdGithubToken("@alice:hyrule", []string{"ghp_secret"}, false)
+	if err != nil {
+		t.Fatalf("cmdGithubToken returned an error: %s", err)
+	}
+	if body := res.(*mevt.MessageEventContent).Body; !strings.Contains(body, "revoke it") {
+		t.Errorf("Expected the token to be refused outside a direct chat, got %q", body)
+	}
+	// In a direct chat the realm is used, which doesn't exist here
+	if _, err = s.cmdGithubToken("@alice:hyrule", []string{"ghp_secret"}, true); err == nil {
+		t.Error("Expected an error for an unknown realm in a direct chat")
+	}
+}
@@ -6,11 +6,16 @@ import (
 	"net/http"
 	"sort"
 	"strings"
+	"time"
 
 	gogithub "github.com/google/go-github/github"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/go-neb/realms/email"
+	"github.com/matrix-org/go-neb/secrets"
 	"github.com/matrix-org/go-neb/services/github/client"
 	"github.com/matrix-org/go-neb/services/github/webhook"
+	"github.com/matrix-org/go-neb/services/utils"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	"maunium.net/go/mautrix/event"
@@ -37,11 +42,15 @@ const WebhookServiceType = "github-webhook"
 //           "!qmElAGdFYCHoCJuaNt:localhost": {
 //               Repos: {
 //                   "matrix-org/go-neb": {
-//                       Events: ["push", "issues", "pull_request", "labels"]
+//                       Events: ["push", "issues", "pull_request", "labels"],
+//                       Branches: ["master", "release/*"],
+//                       Paths: ["docs/**"]
 //                   }
 //               }
 //           }
-//       }
+//       },
+//       PushBatchWindow: "30s",
+//       EmailRealm: "email-realm-id"
 //   }
 type WebhookService struct {
 	types.DefaultService
@@ -51,7 +60,8 @@ type WebhookService struct {
 	// The ID of an existing "github" realm. This realm will be used to obtain
 	// the Github credentials of the ClientUserID.
 	RealmID string
-	// A map from Matrix room ID to Github "owner/repo"-style repositories.
+	// A map from Matrix room ID to Github "owner/repo"-style repositories. A room may be a Space
+	// or a label such as "label:backend-teams", see utils.ResolveRooms.
 	Rooms map[id.RoomID]struct {
 		// A map of "owner/repo"-style repositories to the events to listen for.
 		Repos map[string]struct { // owner/repo => { events: ["push","issue","pull_request"] }
@@ -66,11 +76,24 @@ type WebhookService struct {
 			//    assignments : When any issue or pull request is assigned/unassigned. Unique to Go-NEB.
 			// Most of these events are directly from: https://developer.github.com/webhooks/#events
 			Events []string
+			// Optional. Only notify about pushes to these branches, e.g. ["main", "release/*"].
+			Branches []string
+			// Optional. Only notify about pushes which change these paths, e.g. ["docs/**"],
+			// where "**" matches any number of directories. See utils.MatchGlob.
+			Paths []string
 		}
 	}
 	// Optional. The secret token to supply when creating the webhook. If supplied,
 	// Go-NEB will perform security checks on incoming webhook requests using this token.
+	// This may instead be a reference to a secret store, see the secrets package.
 	SecretToken string
+	// Optional. How long to wait for more pushes to a branch before notifying about them, e.g.
+	// "30s". Pushes which arrive within the window are summarised in a single notice. If
+	// empty, every push is sent straight away.
+	PushBatchWindow string
+	// Optional. The ID of an "email" realm. If given, the authors of pushed commits who have linked
+	// their commit email address to a Matrix user with the realm are mentioned in push notices.
+	EmailRealm string
 }
 
 // OnReceiveWebhook receives requests from Github and possibly sends requests to Matrix as a result.
@@ -82,15 +105,26 @@ type WebhookService struct {
 // If the "owner/repo" string doesn't exist in this Service config, then the webhook will be deleted from
 // Github.
 func (s *WebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
-	evType, repo, msg, err := webhook.OnReceiveRequest(req, s.SecretToken)
+	secret, resolveErr := secrets.Resolve(s.SecretToken)
+	if resolveErr != nil {
+		logging.FromContext(req.Context()).WithError(resolveErr).Error("Failed to resolve the secret token")
+		w.WriteHeader(500)
+		return
+	}
+	evType, repo, msg, push, err := webhook.OnReceiveRequest(req, secret)
 	if err != nil {
 		w.WriteHeader(err.Code)
 		return
 	}
-	logger := log.WithFields(log.Fields{
+	logger := logging.FromContext(req.Context()).WithFields(log.Fields{
 		"event": evType,
 		"repo":  *repo.FullName,
 	})
+	if push != nil && msg != nil {
+		msg.Mentions = s.authors(logger, push)
+	}
+	// Validated by Register
+	window, _ := time.ParseDuration(s.PushBatchWindow)
 	repoExistsInConfig := false
 	for roomID, roomConfig := range s.Rooms {
 		for ownerRepo, repoConfig := range roomConfig.Repos {
@@ -105,15 +139,13 @@ func (s *WebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Reque
 					break
 				}
 			}
-			if notifyRoom {
-				logger.WithFields(log.Fields{
-					"message": msg,
-					"room_id": roomID,
-				}).Print("Sending notification to room")
-				if _, e := cli.SendMessageEvent(roomID, event.EventMessage, msg); e != nil {
-					logger.WithError(e).WithField("room_id", roomID).Print(
-						"Failed to send notification to room.")
-				}
+			if notifyRoom && push != nil {
+				notifyRoom = pushMatches(push, repoConfig.Branches, repoConfig.Paths)
+			}
+			if notifyRoom && push != nil && window > 0 {
+				s.batchPush(cli, logger, roomID, push, msg, window)
+			} else if notifyRoom {
+				s.notifyRoom(cli, logger, roomID, msg)
 			}
 		}
 	}
@@ -135,6 +167,32 @@ func (s *WebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Reque
 	w.WriteHeader(200)
 }
 
+// pushMatches returns true if the push is to one of the branches and changes one of the paths.
+// Empty filters match every push.
+func pushMatches(push *webhook.Push, branches, paths []string) bool {
+	if len(branches) > 0 && !matchesAny(branches, push.Branch) {
+		return false
+	}
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range push.Paths {
+		if matchesAny(paths, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if name != "" && utils.MatchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
 // Register will create webhooks for the repos specified in Rooms
 //
 // The hooks made are a delta between the old service and the current configuration. If all webhooks are made,
@@ -149,10 +207,23 @@ func (s *WebhookService) Register(oldService types.Service, client types.MatrixC
 	if s.RealmID == "" || s.ClientUserID == "" {
 		return fmt.Errorf("RealmID and ClientUserID is required")
 	}
+	if s.PushBatchWindow != "" {
+		if _, err := time.ParseDuration(s.PushBatchWindow); err != nil {
+			return fmt.Errorf("Bad PushBatchWindow: %s", err)
+		}
+	}
+	if _, err := secrets.Resolve(s.SecretToken); err != nil {
+		return fmt.Errorf("Bad SecretToken: %s", err)
+	}
 	realm, err := s.loadRealm()
 	if err != nil {
 		return err
 	}
+	if s.EmailRealm != "" {
+		if _, err = s.loadEmailRealm(); err != nil {
+			return err
+		}
+	}
 
 	// In order to register the GH service as a client, you must have authed with GH.
 	cli := s.githubClientFor(s.ClientUserID, false)
@@ -251,8 +322,35 @@ func (s *WebhookService) PostRegister(oldService types.Service) {
 	}
 }
 
+// TargetRooms returns the rooms repository notifications are sent into.
+func (s *WebhookService) TargetRooms() []id.RoomID {
+	roomIDs := make([]id.RoomID, 0, len(s.Rooms))
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
+// notifyRoom sends msg into the room, or every room it resolves to if it is a space or label.
+func (s *WebhookService) notifyRoom(cli types.MatrixClient, logger *log.Entry, roomID id.RoomID, n *utils.Notification) {
+	for _, toRoomID := range utils.ResolveRooms(cli, s.ServiceUserID(), roomID) {
+		msg := n.Message(utils.RoomFormat(s.ServiceUserID(), toRoomID))
+		logger.WithFields(log.Fields{
+			"message": msg,
+			"room_id": toRoomID,
+		}).Print("Sending notification to room")
+		if _, e := cli.SendMessageEvent(toRoomID, event.EventMessage, msg); e != nil {
+			logger.WithError(e).WithField("room_id", toRoomID).Print(
+				"Failed to send notification to room.")
+		}
+	}
+}
+
 func (s *WebhookService) joinWebhookRooms(client types.MatrixClient) error {
 	for roomID := range s.Rooms {
+		if utils.IsLabel(roomID) {
+			continue // labelled rooms are joined by the service which labels them
+		}
 		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
 			// TODO: Leave the rooms we successfully joined?
 			return err
@@ -299,7 +397,11 @@ func (s *WebhookService) createHook(cli *gogithub.Client, ownerRepo string) erro
 		"url":          s.webhookEndpointURL,
 	}
 	if s.SecretToken != "" {
-		cfg["secret"] = s.SecretToken
+		secret, err := secrets.Resolve(s.SecretToken)
+		if err != nil {
+			return err
+		}
+		cfg["secret"] = secret
 	}
 	events := []string{"push", "pull_request", "issues", "issue_comment", "pull_request_review_comment"}
 	_, res, err := cli.Repositories.CreateHook(context.Background(), owner, repo, &gogithub.Hook{
@@ -432,6 +534,47 @@ func (s *WebhookService) loadRealm() (types.AuthRealm, error) {
 	return realm, nil
 }
 
+func (s *WebhookService) loadEmailRealm() (*email.Realm, error) {
+	realm, err := database.GetServiceDB().LoadAuthRealm(s.EmailRealm)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load EmailRealm: %s", err)
+	}
+	emailRealm, ok := realm.(*email.Realm)
+	if !ok {
+		return nil, fmt.Errorf("EmailRealm is of type '%s', not '%s'", realm.Type(), email.RealmType)
+	}
+	return emailRealm, nil
+}
+
+// authors returns the Matrix users who wrote the pushed commits, if there is an EmailRealm.
+// Failures are logged, as the push should still be notified about.
+func (s *WebhookService) authors(logger *log.Entry, pushes ...*webhook.Push) []id.UserID {
+	if s.EmailRealm == "" {
+		return nil
+	}
+	realm, err := s.loadEmailRealm()
+	if err != nil {
+		logger.WithError(err).Error("Failed to load email realm")
+		return nil
+	}
+	var userIDs []id.UserID
+	seen := make(map[id.UserID]bool)
+	for _, push := range pushes {
+		for _, address := range push.AuthorEmails {
+			userID, err := realm.UserForEmail(address)
+			if err != nil {
+				logger.WithError(err).Error("Failed to look up commit author")
+				return userIDs
+			}
+			if userID != "" && !seen[userID] {
+				seen[userID] = true
+				userIDs = append(userIDs, userID)
+			}
+		}
+	}
+	return userIDs
+}
+
 func init() {
 	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
 		return &WebhookService{
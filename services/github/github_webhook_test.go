@@ -2,17 +2,26 @@ package github
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/realms/email"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/services/github/webhook"
 	"github.com/matrix-org/go-neb/testutils"
 	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
 	"maunium.net/go/mautrix"
 	mevt "maunium.net/go/mautrix/event"
 )
@@ -222,6 +231,53 @@ func TestGithubWebhook(t *testing.T) {
 	}
 }
 
+// secretStore is a secret store holding the secrets in the map.
+type secretStore map[string]string
+
+func (s secretStore) Fetch(ref string) (string, time.Duration, error) {
+	if secret, ok := s[ref]; ok {
+		return secret, 0, nil
+	}
+	return "", 0, errors.New("not found")
+}
+
+func TestWebhookSecretReference(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	secrets.Register("test", secretStore{"github_webhook": "s3cret"})
+	defer secrets.Unregister("test")
+	ghwh := makeService(t)
+	if ghwh == nil {
+		t.Fatal("TestWebhookSecretReference Failed to create service")
+	}
+
+	body := `{"zen": "Keep it logically awesome."}`
+	for _, test := range []struct {
+		secretToken string
+		signedWith  string
+		wantCode    int
+	}{
+		{"test:github_webhook", "s3cret", 200},
+		{"test:github_webhook", "test:github_webhook", 403},
+		{"test:missing", "s3cret", 500},
+	} {
+		ghwh.SecretToken = test.secretToken
+		mac := hmac.New(sha1.New, []byte(test.signedWith))
+		mac.Write([]byte(body))
+		req, err := http.NewRequest("POST", "https://neb.endpoint/gh-webhook-service", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("TestWebhookSecretReference Failed to create webhook request: %s", err)
+		}
+		req.Header.Set("X-GitHub-Event", "ping")
+		req.Header.Set("X-Hub-Signature", "sha1="+hex.EncodeToString(mac.Sum(nil)))
+		mockWriter := httptest.NewRecorder()
+		ghwh.OnReceiveWebhook(mockWriter, req, nil)
+		if mockWriter.Code != test.wantCode {
+			t.Errorf("TestWebhookSecretReference %s signed with %s: expected response %d, got %d",
+				test.secretToken, test.signedWith, test.wantCode, mockWriter.Code)
+		}
+	}
+}
+
 func makeService(t *testing.T) *WebhookService {
 	srv, err := types.CreateService("id", WebhookServiceType, "@ghwebhook:hyrule", []byte(
 		`{
@@ -244,3 +300,44 @@ func makeService(t *testing.T) *WebhookService {
 	}
 	return srv.(*WebhookService)
 }
+
+type emailRealmStore struct {
+	database.NopStorage
+	realm types.AuthRealm
+}
+
+func (s *emailRealmStore) LoadAuthRealm(realmID string) (types.AuthRealm, error) {
+	return s.realm, nil
+}
+
+func (s *emailRealmStore) LoadAuthSessionsByRealm(realmID string) ([]types.AuthSession, error) {
+	session := s.realm.AuthSession("sid", "@link:hyrule", realmID)
+	if err := json.Unmarshal([]byte(`{"Email":"link@hyrule.example","VerifiedTimestampSecs":1}`), session); err != nil {
+		return nil, err
+	}
+	return []types.AuthSession{session}, nil
+}
+
+func TestAuthors(t *testing.T) {
+	realm, err := types.CreateAuthRealm("email", email.RealmType, []byte(`{
+		"From": "neb@hyrule.example",
+		"SMTP": {"Host": "smtp.hyrule.example"}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create email realm: ", err)
+	}
+	database.SetServiceDB(&emailRealmStore{realm: realm})
+	ghwh := makeService(t)
+	logger := log.WithField("test", "TestAuthors")
+	pushes := []*webhook.Push{
+		{AuthorEmails: []string{"zelda@hyrule.example", "link@hyrule.example"}},
+		{AuthorEmails: []string{"link@hyrule.example"}},
+	}
+	if got := ghwh.authors(logger, pushes...); got != nil {
+		t.Errorf("Expected no authors without an EmailRealm, got %v", got)
+	}
+	ghwh.EmailRealm = "email"
+	if got := ghwh.authors(logger, pushes...); len(got) != 1 || got[0] != "@link:hyrule" {
+		t.Errorf("Expected authors [@link:hyrule], got %v", got)
+	}
+}
@@ -0,0 +1,267 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	gogithub "github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The most labels or milestones suggested when a command names one which doesn't exist.
+const numberGithubSuggestions = 20
+
+const cmdGithubLabelUsage = `!github label [owner/repo]#issue label[,label...]`
+
+func (s *Service) cmdGithubLabel(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	cli, resp, err := s.requireGithubClientFor(userID)
+	if cli == nil {
+		return resp, err
+	}
+	if len(args) < 2 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Usage: " + cmdGithubLabelUsage,
+		}, nil
+	}
+
+	// get owner,repo,issue,resp out of args[0]
+	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, userID, cmdGithubLabelUsage)
+	if resp != nil {
+		return resp, nil
+	}
+	labels, resp, err := repoLabels(cli, owner, repo, splitLabels(args[1:]), cmdGithubLabelUsage)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	_, res, err := cli.Issues.AddLabelsToIssue(context.Background(), owner, repo, issueNum, labels)
+	if err != nil {
+		log.WithField("err", err).Print("Failed to add issue labels")
+		if res == nil {
+			return nil, fmt.Errorf("Failed to add issue labels. Failed to connect to Github")
+		}
+		return nil, fmt.Errorf("Failed to add issue labels. HTTP %d", res.StatusCode)
+	}
+
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Added labels to issue %s/%s#%d: %s", owner, repo, issueNum, strings.Join(labels, ", ")),
+	}, nil
+}
+
+const cmdGithubUnlabelUsage = `!github unlabel [owner/repo]#issue label[,label...]`
+
+func (s *Service) cmdGithubUnlabel(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	cli, resp, err := s.requireGithubClientFor(userID)
+	if cli == nil {
+		return resp, err
+	}
+	if len(args) < 2 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Usage: " + cmdGithubUnlabelUsage,
+		}, nil
+	}
+
+	// get owner,repo,issue,resp out of args[0]
+	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, userID, cmdGithubUnlabelUsage)
+	if resp != nil {
+		return resp, nil
+	}
+
+	// Only the issue's own labels can be removed, so check against those.
+	issue, res, err := cli.Issues.Get(context.Background(), owner, repo, issueNum)
+	if err != nil {
+		log.WithField("err", err).Print("Failed to get issue")
+		if res == nil {
+			return nil, fmt.Errorf("Failed to get issue. Failed to connect to Github")
+		}
+		return nil, fmt.Errorf("Failed to get issue. HTTP %d", res.StatusCode)
+	}
+	var current []string
+	for _, l := range issue.Labels {
+		current = append(current, l.GetName())
+	}
+	labels, unknown := matchNames(splitLabels(args[1:]), current)
+	if len(unknown) > 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body: fmt.Sprintf("Issue %s/%s#%d isn't labelled %s. Its labels are: %s",
+				owner, repo, issueNum, strings.Join(unknown, ", "), suggestions(current)),
+		}, nil
+	}
+
+	for _, label := range labels {
+		res, err := cli.Issues.RemoveLabelForIssue(context.Background(), owner, repo, issueNum, label)
+		if err != nil {
+			log.WithField("err", err).Print("Failed to remove issue label")
+			if res == nil {
+				return nil, fmt.Errorf("Failed to remove issue label. Failed to connect to Github")
+			}
+			return nil, fmt.Errorf("Failed to remove issue label %s. HTTP %d", label, res.StatusCode)
+		}
+	}
+
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Removed labels from issue %s/%s#%d: %s", owner, repo, issueNum, strings.Join(labels, ", ")),
+	}, nil
+}
+
+const cmdGithubMilestoneUsage = `!github milestone [owner/repo]#issue "milestone title"`
+
+func (s *Service) cmdGithubMilestone(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	cli, resp, err := s.requireGithubClientFor(userID)
+	if cli == nil {
+		return resp, err
+	}
+	if len(args) < 2 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Usage: " + cmdGithubMilestoneUsage,
+		}, nil
+	}
+
+	// get owner,repo,issue,resp out of args[0]
+	owner, repo, issueNum, resp := s.getIssueDetailsFor(args[0], roomID, userID, cmdGithubMilestoneUsage)
+	if resp != nil {
+		return resp, nil
+	}
+	// a title without quote marks is split into several args
+	title := strings.Join(args[1:], " ")
+
+	var milestones []*gogithub.Milestone
+	opts := &gogithub.MilestoneListOptions{ListOptions: gogithub.ListOptions{PerPage: 100}}
+	for {
+		page, res, err := cli.Issues.ListMilestones(context.Background(), owner, repo, opts)
+		if err != nil {
+			log.WithField("err", err).Print("Failed to list milestones")
+			if res == nil {
+				return nil, fmt.Errorf("Failed to list milestones. Failed to connect to Github")
+			}
+			return nil, fmt.Errorf("Failed to list milestones. HTTP %d", res.StatusCode)
+		}
+		milestones = append(milestones, page...)
+		if res.NextPage == 0 {
+			break
+		}
+		opts.Page = res.NextPage
+	}
+
+	var milestone *gogithub.Milestone
+	titles := make([]string, 0, len(milestones))
+	for _, m := range milestones {
+		titles = append(titles, m.GetTitle())
+		if strings.EqualFold(m.GetTitle(), title) {
+			milestone = m
+		}
+	}
+	if milestone == nil {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("No open milestone called %q in %s/%s. Open milestones are: %s", title, owner, repo, suggestions(titles)),
+		}, nil
+	}
+
+	issue, res, err := cli.Issues.Edit(context.Background(), owner, repo, issueNum, &gogithub.IssueRequest{
+		Milestone: milestone.Number,
+	})
+	if err != nil {
+		log.WithField("err", err).Print("Failed to set issue milestone")
+		if res == nil {
+			return nil, fmt.Errorf("Failed to set issue milestone. Failed to connect to Github")
+		}
+		return nil, fmt.Errorf("Failed to set issue milestone. HTTP %d", res.StatusCode)
+	}
+
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Set milestone of issue to %s: %s", milestone.GetTitle(), issue.GetHTMLURL()),
+	}, nil
+}
+
+// repoLabels returns the repository's names for the given labels, which are matched
+// case-insensitively. If any don't exist, it returns a notice listing the labels which do.
+func repoLabels(cli *gogithub.Client, owner, repo string, names []string, usage string) ([]string, interface{}, error) {
+	if len(names) == 0 {
+		return nil, &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Needs at least one label. Usage: " + usage,
+		}, nil
+	}
+	var existing []string
+	opts := &gogithub.ListOptions{PerPage: 100}
+	for {
+		page, res, err := cli.Issues.ListLabels(context.Background(), owner, repo, opts)
+		if err != nil {
+			log.WithField("err", err).Print("Failed to list labels")
+			if res == nil {
+				return nil, nil, fmt.Errorf("Failed to list labels. Failed to connect to Github")
+			}
+			return nil, nil, fmt.Errorf("Failed to list labels. HTTP %d", res.StatusCode)
+		}
+		for _, l := range page {
+			existing = append(existing, l.GetName())
+		}
+		if res.NextPage == 0 {
+			break
+		}
+		opts.Page = res.NextPage
+	}
+
+	labels, unknown := matchNames(names, existing)
+	if len(unknown) > 0 {
+		return nil, &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body: fmt.Sprintf("%s/%s has no label called %s. Its labels are: %s",
+				owner, repo, strings.Join(unknown, ", "), suggestions(existing)),
+		}, nil
+	}
+	return labels, nil, nil
+}
+
+// splitLabels splits comma-separated labels, e.g. ["bug,help", "wanted"] is
+// ["bug", "help wanted"].
+func splitLabels(args []string) []string {
+	var labels []string
+	for _, l := range strings.Split(strings.Join(args, " "), ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
+
+// matchNames matches each name against the known names case-insensitively, returning the known
+// names of the matches and the names which didn't match.
+func matchNames(names, known []string) (matched, unknown []string) {
+	for _, name := range names {
+		found := false
+		for _, k := range known {
+			if strings.EqualFold(name, k) {
+				matched = append(matched, k)
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, name)
+		}
+	}
+	return
+}
+
+// suggestions lists names in a notice, truncating long lists.
+func suggestions(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	if len(names) > numberGithubSuggestions {
+		return fmt.Sprintf("%s and %d more", strings.Join(names[:numberGithubSuggestions], ", "), len(names)-numberGithubSuggestions)
+	}
+	return strings.Join(names, ", ")
+}
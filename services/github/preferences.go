@@ -0,0 +1,112 @@
+package github
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The key which users' Github preferences are stored under. They have the same format as the
+// "github" bot options, but apply to the user's commands in every room.
+const userPreferenceKey = "github"
+
+const cmdGithubDefaultRepoUsage = `!github defaultrepo [set owner/repo|clear]`
+
+func (s *Service) cmdGithubDefaultRepo(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	logger := log.WithFields(log.Fields{
+		"room_id":     roomID,
+		"user_id":     userID,
+		"bot_user_id": s.ServiceUserID(),
+	})
+	opts, err := loadUserOptions(userID, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(args) == 0:
+		if opts.DefaultRepo != "" {
+			return &mevt.MessageEventContent{
+				MsgType: mevt.MsgNotice,
+				Body:    fmt.Sprintf("Your default repo is %s.", opts.DefaultRepo),
+			}, nil
+		}
+		roomOpts, err := s.loadBotOptions(roomID, logger)
+		if err != nil {
+			return nil, err
+		}
+		body := "You have no default repo set."
+		if roomOpts.DefaultRepo != "" {
+			body += fmt.Sprintf(" This room's default repo is %s.", roomOpts.DefaultRepo)
+		}
+		return &mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: body}, nil
+	case len(args) == 2 && args[0] == "set":
+		if !ownerRepoRegex.MatchString(args[1]) {
+			return &mevt.MessageEventContent{
+				MsgType: mevt.MsgNotice,
+				Body:    "Malformed repo. Usage: " + cmdGithubDefaultRepoUsage,
+			}, nil
+		}
+		opts.DefaultRepo = args[1]
+		if err := storeUserOptions(userID, opts, logger); err != nil {
+			return nil, err
+		}
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("Your default repo is now %s, in every room.", opts.DefaultRepo),
+		}, nil
+	case len(args) == 1 && args[0] == "clear":
+		opts.DefaultRepo = ""
+		if err := storeUserOptions(userID, opts, logger); err != nil {
+			return nil, err
+		}
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Cleared your default repo. Each room's default repo will be used instead.",
+		}, nil
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    "Usage: " + cmdGithubDefaultRepoUsage,
+	}, nil
+}
+
+// loadUserOptions returns the Github preferences the user has set for themselves.
+func loadUserOptions(userID id.UserID, logger *log.Entry) (opts types.GithubOptions, err error) {
+	pref, err := database.GetServiceDB().LoadUserPreference(userID, userPreferenceKey)
+	if err == sql.ErrNoRows {
+		return opts, nil
+	} else if err != nil {
+		logger.WithError(err).Error("Failed to load user preferences")
+		return opts, errors.New("Failed to load user preferences")
+	}
+	if err = json.Unmarshal(pref, &opts); err != nil {
+		logger.WithError(err).Error("Failed to parse user preferences")
+		return opts, errors.New("Failed to load user preferences")
+	}
+	return opts, nil
+}
+
+// storeUserOptions stores the user's Github preferences, removing them if none are set.
+func storeUserOptions(userID id.UserID, opts types.GithubOptions, logger *log.Entry) (err error) {
+	if opts.DefaultRepo == "" && len(opts.NewIssueLabels) == 0 {
+		err = database.GetServiceDB().RemoveUserPreference(userID, userPreferenceKey)
+	} else {
+		var pref []byte
+		if pref, err = json.Marshal(opts); err == nil {
+			err = database.GetServiceDB().StoreUserPreference(userID, userPreferenceKey, pref)
+		}
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to store user preferences")
+		return errors.New("Failed to store user preferences")
+	}
+	return nil
+}
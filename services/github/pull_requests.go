@@ -0,0 +1,213 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+
+	gogithub "github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/services/utils"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The most files listed by !github pr diffstat.
+const numberGithubDiffstatFiles = 10
+
+var cmdGithubPRMergeMethods = map[string]bool{
+	"merge":  true,
+	"squash": true,
+	"rebase": true,
+}
+
+const cmdGithubPRApproveUsage = `!github pr approve [owner/repo]#pr ["comment"]`
+
+func (s *Service) cmdGithubPRApprove(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	return s.githubPRReview(roomID, userID, args, "APPROVE", "approve", cmdGithubPRApproveUsage)
+}
+
+const cmdGithubPRRequestChangesUsage = `!github pr request-changes [owner/repo]#pr "comment"`
+
+func (s *Service) cmdGithubPRRequestChanges(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Needs a comment. Usage: " + cmdGithubPRRequestChangesUsage,
+		}, nil
+	}
+	return s.githubPRReview(roomID, userID, args, "REQUEST_CHANGES", "request changes on", cmdGithubPRRequestChangesUsage)
+}
+
+func (s *Service) githubPRReview(roomID id.RoomID, userID id.UserID, args []string, event, verb, usage string) (interface{}, error) {
+	cli, resp, err := s.requireGithubClientFor(userID)
+	if cli == nil {
+		return resp, err
+	}
+	if len(args) == 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Usage: " + usage,
+		}, nil
+	}
+
+	// get owner,repo,issue,resp out of args[0]
+	owner, repo, prNum, resp := s.getIssueDetailsFor(args[0], roomID, userID, usage)
+	if resp != nil {
+		return resp, nil
+	}
+
+	review := &gogithub.PullRequestReviewRequest{Event: &event}
+	if len(args) > 1 {
+		// a comment without quote marks is split into several args
+		comment := strings.Join(args[1:], " ")
+		review.Body = &comment
+	}
+
+	_, res, err := cli.PullRequests.CreateReview(context.Background(), owner, repo, prNum, review)
+	if err != nil {
+		log.WithField("err", err).Printf("Failed to %s pull request", verb)
+		if res == nil {
+			return nil, fmt.Errorf("Failed to %s pull request. Failed to connect to Github", verb)
+		}
+		return nil, fmt.Errorf("Failed to %s pull request. HTTP %d", verb, res.StatusCode)
+	}
+
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Reviewed pull request: https://github.com/%s/%s/pull/%d", owner, repo, prNum),
+	}, nil
+}
+
+const cmdGithubPRMergeUsage = `!github pr merge [owner/repo]#pr [merge|squash|rebase]`
+
+func (s *Service) cmdGithubPRMerge(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	cli, resp, err := s.requireGithubClientFor(userID)
+	if cli == nil {
+		return resp, err
+	}
+	if len(args) == 0 || len(args) > 2 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Usage: " + cmdGithubPRMergeUsage,
+		}, nil
+	}
+
+	// get owner,repo,issue,resp out of args[0]
+	owner, repo, prNum, resp := s.getIssueDetailsFor(args[0], roomID, userID, cmdGithubPRMergeUsage)
+	if resp != nil {
+		return resp, nil
+	}
+
+	// Leaving the method empty uses the repository's default.
+	var opts gogithub.PullRequestOptions
+	if len(args) == 2 {
+		opts.MergeMethod = strings.ToLower(args[1])
+		if !cmdGithubPRMergeMethods[opts.MergeMethod] {
+			return &mevt.MessageEventContent{
+				MsgType: mevt.MsgNotice,
+				Body:    "Invalid merge method. Usage: " + cmdGithubPRMergeUsage,
+			}, nil
+		}
+	}
+
+	result, res, err := cli.PullRequests.Merge(context.Background(), owner, repo, prNum, "", &opts)
+	if err != nil {
+		log.WithField("err", err).Print("Failed to merge pull request")
+		if res == nil {
+			return nil, fmt.Errorf("Failed to merge pull request. Failed to connect to Github")
+		}
+		// Github explains why a pull request can't be merged, e.g. failing required checks.
+		if ghErr, ok := err.(*gogithub.ErrorResponse); ok && ghErr.Message != "" {
+			return nil, fmt.Errorf("Failed to merge pull request: %s", ghErr.Message)
+		}
+		return nil, fmt.Errorf("Failed to merge pull request. HTTP %d", res.StatusCode)
+	}
+	if !result.GetMerged() {
+		return nil, fmt.Errorf("Failed to merge pull request: %s", result.GetMessage())
+	}
+
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Merged pull request: https://github.com/%s/%s/pull/%d", owner, repo, prNum),
+	}, nil
+}
+
+const cmdGithubPRDiffstatUsage = `!github pr diffstat [owner/repo]#pr`
+
+func (s *Service) cmdGithubPRDiffstat(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	cli := s.githubClientFor(userID, true)
+	if len(args) != 1 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "Usage: " + cmdGithubPRDiffstatUsage,
+		}, nil
+	}
+
+	// get owner,repo,issue,resp out of args[0]
+	owner, repo, prNum, resp := s.getIssueDetailsFor(args[0], roomID, userID, cmdGithubPRDiffstatUsage)
+	if resp != nil {
+		return resp, nil
+	}
+
+	pr, res, err := cli.PullRequests.Get(context.Background(), owner, repo, prNum)
+	if err != nil {
+		log.WithField("err", err).Print("Failed to get pull request")
+		if res == nil {
+			return nil, fmt.Errorf("Failed to get pull request. Failed to connect to Github")
+		}
+		return nil, fmt.Errorf("Failed to get pull request. HTTP %d", res.StatusCode)
+	}
+	files, res, err := cli.PullRequests.ListFiles(context.Background(), owner, repo, prNum, &gogithub.ListOptions{
+		PerPage: 100,
+	})
+	if err != nil {
+		log.WithField("err", err).Print("Failed to list pull request files")
+		if res == nil {
+			return nil, fmt.Errorf("Failed to list pull request files. Failed to connect to Github")
+		}
+		return nil, fmt.Errorf("Failed to list pull request files. HTTP %d", res.StatusCode)
+	}
+	return diffstatMessage(pr, files), nil
+}
+
+// diffstatMessage summarises the changes in a pull request, listing the files with the most
+// changes first.
+func diffstatMessage(pr *gogithub.PullRequest, files []*gogithub.CommitFile) *mevt.MessageEventContent {
+	var htmlBuffer bytes.Buffer
+
+	htmlBuffer.WriteString(fmt.Sprintf(
+		`<a href="%s">%s</a><br />[<strong><font color='#1cc3ed'>~%d</font>, <font color='#30bf2b'>+%d</font>, <font color='#fc3a25'>-%d</font></strong>]`,
+		html.EscapeString(pr.GetHTMLURL()), html.EscapeString(pr.GetTitle()), pr.GetChangedFiles(), pr.GetAdditions(), pr.GetDeletions(),
+	))
+
+	sorted := make([]*gogithub.CommitFile, len(files))
+	copy(sorted, files)
+	// Stable so that files with the same number of changes stay in path order.
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].GetAdditions()+sorted[i].GetDeletions() > sorted[j].GetAdditions()+sorted[j].GetDeletions()
+	})
+	if len(sorted) > 0 {
+		htmlBuffer.WriteString("<ul>")
+	}
+	for i, f := range sorted {
+		if i >= numberGithubDiffstatFiles {
+			break
+		}
+		htmlBuffer.WriteString(fmt.Sprintf("<li><code>%s</code> <font color='#30bf2b'>+%d</font> <font color='#fc3a25'>-%d</font></li>",
+			html.EscapeString(f.GetFilename()), f.GetAdditions(), f.GetDeletions(),
+		))
+	}
+	if len(sorted) > 0 {
+		htmlBuffer.WriteString("</ul>")
+	}
+	if more := pr.GetChangedFiles() - numberGithubDiffstatFiles; more > 0 {
+		htmlBuffer.WriteString(fmt.Sprintf("and %d more files", more))
+	}
+
+	msg := utils.StrippedHTMLMessage(mevt.MsgNotice, htmlBuffer.String())
+	return &msg
+}
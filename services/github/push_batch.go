@@ -0,0 +1,66 @@
+package github
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/services/github/webhook"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// pushBatch is the pushes to one ref which are waiting to be sent to a room.
+type pushBatch struct {
+	pushes []*webhook.Push
+	// The notification for the first push, which is sent as is if no more pushes arrive.
+	first *utils.Notification
+}
+
+// Webhook services are loaded afresh for every request, so pending batches are kept here, keyed
+// on the service, room, repo and ref.
+var (
+	pushBatchesMutex sync.Mutex
+	pushBatches      = make(map[string]*pushBatch)
+)
+
+// batchPush holds the push back for the batching window, so that pushes to the same ref in quick
+// succession are sent to the room as a single notice. Deleted refs are sent straight away.
+func (s *WebhookService) batchPush(cli types.MatrixClient, logger *log.Entry, roomID id.RoomID, push *webhook.Push, n *utils.Notification, window time.Duration) {
+	if push.Deleted {
+		s.notifyRoom(cli, logger, roomID, n)
+		return
+	}
+	key := strings.Join([]string{s.ServiceID(), roomID.String(), strings.ToLower(push.Repo), push.Ref}, "|")
+
+	pushBatchesMutex.Lock()
+	defer pushBatchesMutex.Unlock()
+	if b, ok := pushBatches[key]; ok {
+		b.pushes = append(b.pushes, push)
+		return
+	}
+	pushBatches[key] = &pushBatch{pushes: []*webhook.Push{push}, first: n}
+	time.AfterFunc(window, func() {
+		s.flushPushes(cli, logger, roomID, key)
+	})
+}
+
+// flushPushes sends the batch of pushes to the room.
+func (s *WebhookService) flushPushes(cli types.MatrixClient, logger *log.Entry, roomID id.RoomID, key string) {
+	pushBatchesMutex.Lock()
+	b := pushBatches[key]
+	delete(pushBatches, key)
+	pushBatchesMutex.Unlock()
+	if b == nil {
+		return
+	}
+
+	n := b.first
+	if len(b.pushes) > 1 {
+		n = webhook.PushesNotification(b.pushes)
+		n.Mentions = s.authors(logger, b.pushes...)
+	}
+	s.notifyRoom(cli, logger.WithField("pushes", len(b.pushes)), roomID, n)
+}
@@ -6,7 +6,6 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"html"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -15,14 +14,107 @@ import (
 	"github.com/matrix-org/go-neb/services/utils"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
-	mevt "maunium.net/go/mautrix/event"
 )
 
+// The most commits listed by a notification about several pushes.
+const maxBatchedCommits = 10
+
+// Push is what a push event changed, which rooms can filter on and several of which can be
+// summarised together.
+type Push struct {
+	// The repository pushed to, e.g. "matrix-org/go-neb".
+	Repo string
+	// The ref pushed to, e.g. "refs/heads/main".
+	Ref string
+	// The branch pushed to, e.g. "release/1.0", or "" if a tag was pushed.
+	Branch string
+	// The paths added, modified or removed by the pushed commits. Github only includes the
+	// first 20 commits of a push.
+	Paths []string
+	// Who pushed.
+	Pusher string
+	// True if the push was forced, e.g. after a rebase.
+	Forced bool
+	// True if the branch or tag was deleted.
+	Deleted bool
+	// The pushed commits, oldest first.
+	Commits []PushCommit
+	// The email addresses of the pushed commits' authors, without duplicates.
+	AuthorEmails []string
+	// A link to the head commit, if there is one.
+	URL string
+	// A link to the changes, if there is one.
+	Compare string
+}
+
+// PushCommit is a commit in a push.
+type PushCommit struct {
+	ID string
+	// The author and first line of the message, e.g. "alice: Fix the tests".
+	Summary string
+}
+
+// PushesNotification summarises several pushes to the same ref, oldest first, e.g. after a
+// series of force-pushes. Commits which were pushed more than once are only listed once.
+func PushesNotification(pushes []*Push) *utils.Notification {
+	last := pushes[len(pushes)-1]
+	var pushers []string
+	seenPushers := make(map[string]bool)
+	var commits []string
+	seenCommits := make(map[string]bool)
+	forced := 0
+	for _, p := range pushes {
+		if !seenPushers[p.Pusher] {
+			seenPushers[p.Pusher] = true
+			pushers = append(pushers, p.Pusher)
+		}
+		if p.Forced {
+			forced++
+		}
+		for _, c := range p.Commits {
+			if !seenCommits[c.ID] {
+				seenCommits[c.ID] = true
+				commits = append(commits, c.Summary)
+			}
+		}
+	}
+
+	summary := fmt.Sprintf("%s pushed %d commits to ", strings.Join(pushers, ", "), len(commits))
+	var detail string
+	if forced > 0 {
+		detail = fmt.Sprintf(" in %d pushes, %d of them forced", len(pushes), forced)
+	} else {
+		detail = fmt.Sprintf(" in %d pushes", len(pushes))
+	}
+	if len(commits) > maxBatchedCommits {
+		commits = append(commits[:maxBatchedCommits], fmt.Sprintf("and %d more", len(commits)-maxBatchedCommits))
+	}
+	ref := last.Branch
+	if ref == "" {
+		ref = strings.TrimPrefix(last.Ref, "refs/tags/")
+	}
+	n := &utils.Notification{
+		Source: last.Repo,
+		Summary: []utils.Span{
+			utils.Plain(summary),
+			utils.Bold(ref),
+			utils.Plain(detail),
+		},
+		URL:   last.URL,
+		Lines: commits,
+	}
+	if last.Compare != "" {
+		n.Fields = []utils.Field{{Name: "Compare", Value: last.Compare}}
+	}
+	return n
+}
+
 // OnReceiveRequest processes incoming github webhook requests and returns a
-// matrix message to send, along with parsed repo information.
+// notification to send, along with parsed repo information. For push events, what
+// was pushed is also returned.
 // The secretToken, if supplied, will be used to verify the request is from
 // Github. If it isn't, an error is returned.
-func OnReceiveRequest(r *http.Request, secretToken string) (string, *github.Repository, *mevt.MessageEventContent, *util.JSONResponse) {
+func OnReceiveRequest(r *http.Request, secretToken string) (string, *github.Repository, *utils.Notification, *Push, *util.JSONResponse) {
 	// Verify the HMAC signature if NEB was configured with a secret token
 	eventType := r.Header.Get("X-GitHub-Event")
 	signatureSHA1 := r.Header.Get("X-Hub-Signature")
@@ -30,7 +122,7 @@ func OnReceiveRequest(r *http.Request, secretToken string) (string, *github.Repo
 	if err != nil {
 		log.WithError(err).Print("Failed to read Github webhook body")
 		resErr := util.MessageResponse(400, "Failed to parse body")
-		return "", nil, nil, &resErr
+		return "", nil, nil, nil, &resErr
 	}
 	// Verify request if a secret token has been supplied.
 	if secretToken != "" {
@@ -41,7 +133,7 @@ func OnReceiveRequest(r *http.Request, secretToken string) (string, *github.Repo
 			log.WithError(err).WithField("X-Hub-Signature", sigHex).Print(
 				"Failed to decode signature as hex.")
 			resErr := util.MessageResponse(400, "Failed to decode signature")
-			return "", nil, nil, &resErr
+			return "", nil, nil, nil, &resErr
 		}
 
 		if !checkMAC([]byte(content), sigBytes, []byte(secretToken)) {
@@ -49,7 +141,7 @@ func OnReceiveRequest(r *http.Request, secretToken string) (string, *github.Repo
 				"X-Hub-Signature": signatureSHA1,
 			}).Print("Received Github event which failed MAC check.")
 			resErr := util.MessageResponse(403, "Bad signature")
-			return "", nil, nil, &resErr
+			return "", nil, nil, nil, &resErr
 		}
 	}
 
@@ -63,19 +155,62 @@ func OnReceiveRequest(r *http.Request, secretToken string) (string, *github.Repo
 		// to return a 200 in order for the webhook to be marked as "up" (this doesn't
 		// affect delivery, just the tick/cross status flag).
 		res := util.MessageResponse(200, "pong")
-		return "", nil, nil, &res
+		return "", nil, nil, nil, &res
 	}
 
-	htmlStr, repo, refinedType, err := parseGithubEvent(eventType, content)
+	notif, repo, refinedType, err := parseGithubEvent(eventType, content)
 	if err != nil {
 		log.WithError(err).Print("Failed to parse github event")
 		resErr := util.MessageResponse(500, "Failed to parse github event")
-		return "", nil, nil, &resErr
+		return "", nil, nil, nil, &resErr
 	}
 
-	msg := utils.StrippedHTMLMessage(mevt.MsgNotice, htmlStr)
+	var push *Push
+	if eventType == "push" {
+		var ev github.PushEvent
+		if err := json.Unmarshal(content, &ev); err == nil {
+			push = pushFor(ev)
+		}
+	}
+	return refinedType, repo, notif, push, nil
+}
 
-	return refinedType, repo, &msg, nil
+func pushFor(ev github.PushEvent) *Push {
+	push := Push{
+		Repo:    ev.GetRepo().GetFullName(),
+		Ref:     ev.GetRef(),
+		Pusher:  ev.GetPusher().GetName(),
+		Forced:  ev.GetForced(),
+		Deleted: ev.GetDeleted(),
+		Compare: ev.GetCompare(),
+	}
+	if strings.HasPrefix(push.Ref, "refs/heads/") {
+		push.Branch = strings.TrimPrefix(push.Ref, "refs/heads/")
+	}
+	if ev.HeadCommit != nil {
+		push.URL = ev.HeadCommit.GetURL()
+	}
+	seen := make(map[string]bool)
+	seenEmails := make(map[string]bool)
+	for _, c := range ev.Commits {
+		push.Commits = append(push.Commits, PushCommit{
+			ID:      c.GetID(),
+			Summary: fmt.Sprintf("%s: %s", nameForAuthor(c.Author), strings.SplitN(c.GetMessage(), "\n", 2)[0]),
+		})
+		if email := strings.ToLower(c.GetAuthor().GetEmail()); email != "" && !seenEmails[email] {
+			seenEmails[email] = true
+			push.AuthorEmails = append(push.AuthorEmails, email)
+		}
+		for _, files := range [][]string{c.Added, c.Modified, c.Removed} {
+			for _, f := range files {
+				if !seen[f] {
+					seen[f] = true
+					push.Paths = append(push.Paths, f)
+				}
+			}
+		}
+	}
+	return &push
 }
 
 // checkMAC reports whether messageMAC is a valid HMAC tag for message.
@@ -87,26 +222,26 @@ func checkMAC(message, messageMAC, key []byte) bool {
 }
 
 // parseGithubEvent parses a github event type and JSON data and returns an explanatory
-// HTML string, the github repository and the refined event type, or an error.
-func parseGithubEvent(eventType string, data []byte) (string, *github.Repository, string, error) {
+// notification, the github repository and the refined event type, or an error.
+func parseGithubEvent(eventType string, data []byte) (*utils.Notification, *github.Repository, string, error) {
 	if eventType == "pull_request" {
 		var ev github.PullRequestEvent
 		if err := json.Unmarshal(data, &ev); err != nil {
-			return "", nil, eventType, err
+			return nil, nil, eventType, err
 		}
 		refinedEventType := refineEventType(eventType, ev.Action)
-		return pullRequestHTMLMessage(ev), ev.Repo, refinedEventType, nil
+		return pullRequestNotification(ev), ev.Repo, refinedEventType, nil
 	} else if eventType == "issues" {
 		var ev github.IssuesEvent
 		if err := json.Unmarshal(data, &ev); err != nil {
-			return "", nil, eventType, err
+			return nil, nil, eventType, err
 		}
 		refinedEventType := refineEventType(eventType, ev.Action)
-		return issueHTMLMessage(ev), ev.Repo, refinedEventType, nil
+		return issueNotification(ev), ev.Repo, refinedEventType, nil
 	} else if eventType == "push" {
 		var ev github.PushEvent
 		if err := json.Unmarshal(data, &ev); err != nil {
-			return "", nil, eventType, err
+			return nil, nil, eventType, err
 		}
 
 		// The 'push' event repository format is subtly different from normal, so munge the bits we need.
@@ -118,21 +253,21 @@ func parseGithubEvent(eventType string, data []byte) (string, *github.Repository
 			Name:     ev.Repo.Name,
 			FullName: &fullName,
 		}
-		return pushHTMLMessage(ev), &repo, eventType, nil
+		return pushNotification(ev), &repo, eventType, nil
 	} else if eventType == "issue_comment" {
 		var ev github.IssueCommentEvent
 		if err := json.Unmarshal(data, &ev); err != nil {
-			return "", nil, eventType, err
+			return nil, nil, eventType, err
 		}
-		return issueCommentHTMLMessage(ev), ev.Repo, eventType, nil
+		return issueCommentNotification(ev), ev.Repo, eventType, nil
 	} else if eventType == "pull_request_review_comment" {
 		var ev github.PullRequestReviewCommentEvent
 		if err := json.Unmarshal(data, &ev); err != nil {
-			return "", nil, eventType, err
+			return nil, nil, eventType, err
 		}
-		return prReviewCommentHTMLMessage(ev), ev.Repo, eventType, nil
+		return prReviewCommentNotification(ev), ev.Repo, eventType, nil
 	}
-	return "", nil, eventType, fmt.Errorf("Unrecognized event type")
+	return nil, nil, eventType, fmt.Errorf("Unrecognized event type")
 }
 
 func refineEventType(eventType string, action *string) string {
@@ -150,7 +285,7 @@ func refineEventType(eventType string, action *string) string {
 	return eventType
 }
 
-func pullRequestHTMLMessage(p github.PullRequestEvent) string {
+func pullRequestNotification(p github.PullRequestEvent) *utils.Notification {
 	var actionTarget string
 	if p.PullRequest.Assignee != nil && p.PullRequest.Assignee.Login != nil {
 		actionTarget = fmt.Sprintf(" to %s", *p.PullRequest.Assignee.Login)
@@ -161,42 +296,68 @@ func pullRequestHTMLMessage(p github.PullRequestEvent) string {
 		prAction = "merged"
 	}
 
-	return fmt.Sprintf(
-		"[<u>%s</u>] %s %s <b>pull request #%d</b>: %s [%s]%s - %s",
-		html.EscapeString(*p.Repo.FullName),
-		html.EscapeString(*p.Sender.Login),
-		html.EscapeString(prAction),
-		*p.Number,
-		html.EscapeString(*p.PullRequest.Title),
-		html.EscapeString(*p.PullRequest.State),
-		html.EscapeString(actionTarget),
-		html.EscapeString(*p.PullRequest.HTMLURL),
-	)
+	var labels []string
+	for _, l := range p.PullRequest.Labels {
+		labels = append(labels, l.GetName())
+	}
+	n := &utils.Notification{
+		Source: *p.Repo.FullName,
+		Summary: []utils.Span{
+			utils.Plain(*p.Sender.Login + " " + prAction + " "),
+			utils.Bold(fmt.Sprintf("pull request #%d", *p.Number)),
+		},
+		Title:       *p.PullRequest.Title,
+		Note:        "[" + *p.PullRequest.State + "]" + actionTarget,
+		URL:         *p.PullRequest.HTMLURL,
+		Fields:      labelFields(labels, p.PullRequest.Milestone),
+		Description: p.PullRequest.GetBody(),
+	}
+	if p.PullRequest.Head != nil && p.PullRequest.Base != nil {
+		n.Fields = append(n.Fields, utils.Field{
+			Name:  "Branch",
+			Value: p.PullRequest.Head.GetLabel() + " → " + p.PullRequest.Base.GetLabel(),
+		})
+	}
+	// e.g. so that a pull request being opened and CI building it are one notification
+	n.CorrelationID = utils.CommitCorrelationID(*p.Repo.FullName, p.PullRequest.GetHead().GetSHA())
+	if p.PullRequest.ChangedFiles != nil {
+		n.Fields = append(n.Fields, utils.Field{
+			Name: "Changes",
+			Value: fmt.Sprintf("+%d -%d in %d files",
+				p.PullRequest.GetAdditions(), p.PullRequest.GetDeletions(), p.PullRequest.GetChangedFiles()),
+		})
+	}
+	return n
 }
 
-func issueHTMLMessage(p github.IssuesEvent) string {
+func issueNotification(p github.IssuesEvent) *utils.Notification {
 	var actionTarget string
 	if p.Issue.Assignee != nil && p.Issue.Assignee.Login != nil {
 		actionTarget = fmt.Sprintf(" to %s", *p.Issue.Assignee.Login)
 	}
-	action := html.EscapeString(*p.Action)
+	var labels []string
+	for _, l := range p.Issue.Labels {
+		labels = append(labels, l.GetName())
+	}
+	action := *p.Action
 	if p.Label != nil && (*p.Action == "labeled" || *p.Action == "unlabeled") {
-		action = *p.Action + " [" + html.EscapeString(*p.Label.Name) + "] to"
-	}
-	return fmt.Sprintf(
-		"[<u>%s</u>] %s %s <b>issue #%d</b>: %s [%s]%s - %s",
-		html.EscapeString(*p.Repo.FullName),
-		html.EscapeString(*p.Sender.Login),
-		action,
-		*p.Issue.Number,
-		html.EscapeString(*p.Issue.Title),
-		html.EscapeString(*p.Issue.State),
-		html.EscapeString(actionTarget),
-		html.EscapeString(*p.Issue.HTMLURL),
-	)
+		action = *p.Action + " [" + *p.Label.Name + "] to"
+	}
+	return &utils.Notification{
+		Source: *p.Repo.FullName,
+		Summary: []utils.Span{
+			utils.Plain(*p.Sender.Login + " " + action + " "),
+			utils.Bold(fmt.Sprintf("issue #%d", *p.Issue.Number)),
+		},
+		Title:       *p.Issue.Title,
+		Note:        "[" + *p.Issue.State + "]" + actionTarget,
+		URL:         *p.Issue.HTMLURL,
+		Fields:      labelFields(labels, p.Issue.Milestone),
+		Description: p.Issue.GetBody(),
+	}
 }
 
-func issueCommentHTMLMessage(p github.IssueCommentEvent) string {
+func issueCommentNotification(p github.IssueCommentEvent) *utils.Notification {
 	var kind string
 	if p.Issue.PullRequestLinks == nil {
 		kind = "issue"
@@ -204,47 +365,60 @@ func issueCommentHTMLMessage(p github.IssueCommentEvent) string {
 		kind = "pull request"
 	}
 
-	return fmt.Sprintf(
-		"[<u>%s</u>] %s commented on %s's <b>%s #%d</b>: %s - %s",
-		html.EscapeString(*p.Repo.FullName),
-		html.EscapeString(*p.Comment.User.Login),
-		html.EscapeString(*p.Issue.User.Login),
-		kind,
-		*p.Issue.Number,
-		html.EscapeString(*p.Issue.Title),
-		html.EscapeString(*p.Issue.HTMLURL),
-	)
+	return &utils.Notification{
+		Source: *p.Repo.FullName,
+		Summary: []utils.Span{
+			utils.Plain(*p.Comment.User.Login + " commented on " + *p.Issue.User.Login + "'s "),
+			utils.Bold(fmt.Sprintf("%s #%d", kind, *p.Issue.Number)),
+		},
+		Title:       *p.Issue.Title,
+		URL:         *p.Issue.HTMLURL,
+		Description: p.Comment.GetBody(),
+	}
 }
 
-func prReviewCommentHTMLMessage(p github.PullRequestReviewCommentEvent) string {
+func prReviewCommentNotification(p github.PullRequestReviewCommentEvent) *utils.Notification {
 	assignee := "None"
 	if p.PullRequest.Assignee != nil {
-		assignee = html.EscapeString(*p.PullRequest.Assignee.Login)
-	}
-	return fmt.Sprintf(
-		"[<u>%s</u>] %s made a line comment on %s's <b>pull request #%d</b> (assignee: %s): %s - %s",
-		html.EscapeString(*p.Repo.FullName),
-		html.EscapeString(*p.Sender.Login),
-		html.EscapeString(*p.PullRequest.User.Login),
-		*p.PullRequest.Number,
-		assignee,
-		html.EscapeString(*p.PullRequest.Title),
-		html.EscapeString(*p.Comment.HTMLURL),
-	)
+		assignee = *p.PullRequest.Assignee.Login
+	}
+	n := &utils.Notification{
+		Source: *p.Repo.FullName,
+		Summary: []utils.Span{
+			utils.Plain(*p.Sender.Login + " made a line comment on " + *p.PullRequest.User.Login + "'s "),
+			utils.Bold(fmt.Sprintf("pull request #%d", *p.PullRequest.Number)),
+			utils.Plain(" (assignee: " + assignee + ")"),
+		},
+		Title:       *p.PullRequest.Title,
+		URL:         *p.Comment.HTMLURL,
+		Description: p.Comment.GetBody(),
+		Diff:        p.Comment.GetDiffHunk(),
+	}
+	if path := p.Comment.GetPath(); path != "" {
+		n.Fields = []utils.Field{{Name: "File", Value: path}}
+	}
+	return n
 }
 
-func pushHTMLMessage(p github.PushEvent) string {
+func pushNotification(p github.PushEvent) *utils.Notification {
 	// /refs/heads/alice/branch-name => alice/branch-name
 	branch := strings.Replace(*p.Ref, "refs/heads/", "", -1)
 
 	// this branch was deleted, no HeadCommit object and deleted=true
 	if p.HeadCommit == nil && p.Deleted != nil && *p.Deleted {
-		return fmt.Sprintf(
-			`[<u>%s</u>] %s <b><font color="red">deleted</font> %s</b>`,
-			html.EscapeString(*p.Repo.FullName),
-			html.EscapeString(*p.Pusher.Name),
-			html.EscapeString(branch),
-		)
+		return &utils.Notification{
+			Source: *p.Repo.FullName,
+			Summary: []utils.Span{
+				utils.Plain(*p.Pusher.Name + " "),
+				{Text: "deleted", Bold: true, Color: "red"},
+				utils.Bold(" " + branch),
+			},
+		}
+	}
+
+	var fields []utils.Field
+	if p.GetCompare() != "" {
+		fields = []utils.Field{{Name: "Compare", Value: p.GetCompare()}}
 	}
 
 	if p.Commits != nil && len(p.Commits) > 1 {
@@ -253,33 +427,46 @@ func pushHTMLMessage(p github.PushEvent) string {
 		// <up to 3 commits>
 		var cList []string
 		for _, c := range p.Commits {
-			cList = append(cList, fmt.Sprintf(
-				`%s: %s`,
-				html.EscapeString(nameForAuthor(c.Author)),
-				html.EscapeString(*c.Message),
-			))
+			cList = append(cList, fmt.Sprintf("%s: %s", nameForAuthor(c.Author), *c.Message))
+		}
+		return &utils.Notification{
+			Source: *p.Repo.FullName,
+			Summary: []utils.Span{
+				utils.Plain(fmt.Sprintf("%s pushed %d commits to ", nameForAuthor(p.HeadCommit.Committer), len(p.Commits))),
+				utils.Bold(branch),
+			},
+			URL:           *p.HeadCommit.URL,
+			Lines:         cList,
+			Fields:        fields,
+			CorrelationID: utils.CommitCorrelationID(*p.Repo.FullName, p.HeadCommit.GetID()),
 		}
-		return fmt.Sprintf(
-			`[<u>%s</u>] %s pushed %d commits to <b>%s</b>: %s<br>%s`,
-			html.EscapeString(*p.Repo.FullName),
-			html.EscapeString(nameForAuthor(p.HeadCommit.Committer)),
-			len(p.Commits),
-			html.EscapeString(branch),
-			html.EscapeString(*p.HeadCommit.URL),
-			strings.Join(cList, "<br>"),
-		)
 	}
 
 	// single commit message
 	// [<repo>] <username> pushed to <branch>: <msg> - <git.io link>
-	return fmt.Sprintf(
-		`[<u>%s</u>] %s pushed to <b>%s</b>: %s  - %s`,
-		html.EscapeString(*p.Repo.FullName),
-		html.EscapeString(nameForAuthor(p.HeadCommit.Committer)),
-		html.EscapeString(branch),
-		html.EscapeString(*p.HeadCommit.Message),
-		html.EscapeString(*p.HeadCommit.URL),
-	)
+	return &utils.Notification{
+		Source: *p.Repo.FullName,
+		Summary: []utils.Span{
+			utils.Plain(nameForAuthor(p.HeadCommit.Committer) + " pushed to "),
+			utils.Bold(branch),
+		},
+		Title:         *p.HeadCommit.Message,
+		URL:           *p.HeadCommit.URL,
+		Fields:        fields,
+		CorrelationID: utils.CommitCorrelationID(*p.Repo.FullName, p.HeadCommit.GetID()),
+	}
+}
+
+// labelFields returns the fields describing an issue or pull request's labels and milestone.
+func labelFields(labels []string, milestone *github.Milestone) []utils.Field {
+	var fields []utils.Field
+	if len(labels) > 0 {
+		fields = append(fields, utils.Field{Name: "Labels", Value: strings.Join(labels, ", ")})
+	}
+	if milestone.GetTitle() != "" {
+		fields = append(fields, utils.Field{Name: "Milestone", Value: milestone.GetTitle()})
+	}
+	return fields
 }
 
 func nameForAuthor(a *github.CommitAuthor) string {
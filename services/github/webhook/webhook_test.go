@@ -3,6 +3,8 @@ package webhook
 import (
 	"strings"
 	"testing"
+
+	"github.com/matrix-org/go-neb/services/utils"
 )
 
 var ghtests = []struct {
@@ -1507,10 +1509,11 @@ var ghtests = []struct {
 
 func TestParseGithubEvent(t *testing.T) {
 	for _, gh := range ghtests {
-		outHTML, outRepo, outType, outErr := parseGithubEvent(gh.eventType, []byte(gh.jsonBody))
+		outNotif, outRepo, outType, outErr := parseGithubEvent(gh.eventType, []byte(gh.jsonBody))
 		if outErr != nil {
 			t.Fatal(outErr)
 		}
+		outHTML := outNotif.HTML(utils.FormatNormal)
 		if strings.TrimSpace(outHTML) != strings.TrimSpace(gh.outHTML) {
 			t.Errorf("ParseGithubEvent(%s) => HTML output does not match. Got:\n%s\n\nExpected:\n%s", gh.eventType,
 				strings.TrimSpace(outHTML), strings.TrimSpace(gh.outHTML))
@@ -0,0 +1,397 @@
+// Package gitlab implements a Service which reports GitLab CI pipelines and adds !commands for them.
+package gitlab
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the GitLab service
+const ServiceType = "gitlab"
+
+// DefaultHost is the GitLab instance used if none is configured.
+const DefaultHost = "https://gitlab.com"
+
+// The pipeline statuses which are notified about by default, as they are final.
+var defaultStatuses = []string{"success", "failed", "canceled"}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Service contains the Config fields for the GitLab Service.
+//
+// The service sends a notice into the configured rooms when GitLab sends a pipeline
+// webhook for one of the room's projects, and adds commands to check on and retry
+// pipelines. Add a webhook for "Pipeline events" to each project in GitLab, with the
+// WebhookURL and the secret token. Commands use the access token, which needs the "api"
+// scope, and only work for projects configured for the room they are sent in.
+//
+// Each project can be limited to some branches, which may use globs such as "release/*",
+// and to some pipeline statuses, which default to success, failed and canceled.
+//
+// Example request:
+//   {
+//       "host": "https://gitlab.example.com",
+//       "access_token": "glpat-...",
+//       "secret_token": "a long random string",
+//       "rooms": {
+//           "!qmElAGdFYCHoCJuaNt:localhost": {
+//               "projects": {
+//                   "matrix-org/go-neb": {
+//                       "branches": ["main", "release/*"]
+//                   },
+//                   "matrix-org/docs": {
+//                       "statuses": ["failed"]
+//                   }
+//               }
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which should be added to GitLab projects as a webhook - Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// The GitLab instance. Defaults to DefaultHost.
+	Host string `json:"host"`
+	// An access token used for commands. This may instead be a reference to a secret store, see the secrets package.
+	AccessToken string `json:"access_token"`
+	// The secret token given to GitLab for the webhook. Requests without it are rejected.
+	SecretToken string `json:"secret_token"`
+	// A map of room ID to the GitLab projects for that room. A room may be a Space or a
+	// label such as "label:backend-teams", see utils.ResolveRooms.
+	Rooms map[id.RoomID]struct {
+		// A map of "group/project" paths to the pipelines to notify about.
+		Projects map[string]struct {
+			// The branches to notify about, which may be globs. Defaults to every branch.
+			Branches []string `json:"branches"`
+			// The pipeline statuses to notify about.
+			Statuses []string `json:"statuses"`
+		} `json:"projects"`
+	} `json:"rooms"`
+}
+
+// pipeline is a GitLab pipeline as returned by the API.
+type pipeline struct {
+	ID        int    `json:"id"`
+	Ref       string `json:"ref"`
+	SHA       string `json:"sha"`
+	Status    string `json:"status"`
+	WebURL    string `json:"web_url"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// pipelineEvent is a "Pipeline Hook" webhook payload.
+type pipelineEvent struct {
+	ObjectKind       string `json:"object_kind"`
+	ObjectAttributes struct {
+		ID       int    `json:"id"`
+		Ref      string `json:"ref"`
+		Tag      bool   `json:"tag"`
+		SHA      string `json:"sha"`
+		Status   string `json:"status"`
+		Duration int    `json:"duration"`
+	} `json:"object_attributes"`
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		WebURL            string `json:"web_url"`
+	} `json:"project"`
+	Commit struct {
+		Message string `json:"message"`
+	} `json:"commit"`
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	if s.Host == "" {
+		s.Host = DefaultHost
+	}
+	if u, err := url.Parse(s.Host); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("host must be an http or https URL")
+	}
+	if s.SecretToken == "" {
+		return errors.New("A secret_token is required")
+	}
+	for roomID, room := range s.Rooms {
+		for project, filter := range room.Projects {
+			if !strings.Contains(project, "/") {
+				return fmt.Errorf("project %q for room %s must be a 'group/project' path", project, roomID)
+			}
+			for _, branch := range filter.Branches {
+				if _, err := path.Match(branch, ""); err != nil {
+					return fmt.Errorf("branch %q for project %s is an invalid glob", branch, project)
+				}
+			}
+		}
+		if utils.IsLabel(roomID) {
+			continue // labelled rooms are joined by the service which labels them
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+// TargetRooms returns the rooms pipeline notifications are sent into.
+func (s *Service) TargetRooms() []id.RoomID {
+	roomIDs := make([]id.RoomID, 0, len(s.Rooms))
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
+// Commands supported:
+//    !gitlab pipeline status [group/project] [ref]
+// Responds with the status of the latest pipeline. The project can be left out in rooms with
+// a single project.
+//    !gitlab retry [group/project] 1234
+// Retries the failed jobs in a pipeline. This is a privileged command, see types.ACL.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"gitlab", "pipeline", "status"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdPipelineStatus(roomID, args)
+			},
+		},
+		{
+			Path:       []string{"gitlab", "retry"},
+			Privileged: true,
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdRetry(roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"gitlab"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return notice("Usage: !gitlab pipeline status [group/project] [ref] | !gitlab retry [group/project] pipeline"), nil
+			},
+		},
+	}
+}
+
+// projectFor returns the project a command is for, taking it from the args if given, and the
+// remaining args.
+func (s *Service) projectFor(roomID id.RoomID, args []string) (string, []string, error) {
+	projects := s.Rooms[roomID].Projects
+	if len(args) > 0 && strings.Contains(args[0], "/") {
+		if _, ok := projects[args[0]]; !ok {
+			return "", nil, fmt.Errorf("%s is not configured for this room", args[0])
+		}
+		return args[0], args[1:], nil
+	}
+	if len(projects) != 1 {
+		return "", nil, errors.New("Please give the project as group/project")
+	}
+	for project := range projects {
+		return project, args, nil
+	}
+	return "", nil, nil // unreachable
+}
+
+func (s *Service) cmdPipelineStatus(roomID id.RoomID, args []string) (interface{}, error) {
+	project, args, err := s.projectFor(roomID, args)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{"per_page": {"1"}}
+	if len(args) > 0 {
+		query.Set("ref", args[0])
+	}
+	var pipelines []pipeline
+	if err := s.api("GET", "/projects/"+url.PathEscape(project)+"/pipelines?"+query.Encode(), &pipelines); err != nil {
+		return nil, err
+	}
+	if len(pipelines) == 0 {
+		return notice(fmt.Sprintf("%s has no pipelines%s", project, onRef(query.Get("ref")))), nil
+	}
+	p := pipelines[0]
+	return notice(fmt.Sprintf("%s pipeline #%d on %s: %s %s", project, p.ID, p.Ref, p.Status, p.WebURL)), nil
+}
+
+func (s *Service) cmdRetry(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	project, args, err := s.projectFor(roomID, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 1 {
+		return notice("Usage: !gitlab retry [group/project] pipeline"), nil
+	}
+	pipelineID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a pipeline ID", args[0])
+	}
+	var p pipeline
+	if err := s.api("POST", fmt.Sprintf("/projects/%s/pipelines/%d/retry", url.PathEscape(project), pipelineID), &p); err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{"project": project, "pipeline": pipelineID, "user_id": userID}).Info("Retried GitLab pipeline")
+	return notice(fmt.Sprintf("Retrying %s pipeline #%d: %s %s", project, p.ID, p.Status, p.WebURL)), nil
+}
+
+// api makes a request to the GitLab API and decodes the response into out.
+func (s *Service) api(method, apiPath string, out interface{}) error {
+	host := s.Host
+	if host == "" {
+		host = DefaultHost
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(host, "/")+"/api/v4"+apiPath, nil)
+	if err != nil {
+		return err
+	}
+	if s.AccessToken != "" {
+		token, err := secrets.Resolve(s.AccessToken)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("PRIVATE-TOKEN", token)
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		log.WithError(err).Error("Failed to call the GitLab API")
+		return errors.New("Failed to reach GitLab")
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return errors.New("GitLab couldn't find that")
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		var gitlabErr struct {
+			Message interface{} `json:"message"`
+		}
+		if json.NewDecoder(res.Body).Decode(&gitlabErr) == nil && gitlabErr.Message != nil {
+			return fmt.Errorf("GitLab returned an error: %v", gitlabErr.Message)
+		}
+		return fmt.Errorf("GitLab returned HTTP %d", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// OnReceiveWebhook receives pipeline webhooks from GitLab and sends notices to Matrix as a result.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	logger := logging.FromContext(req.Context())
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("X-Gitlab-Token")), []byte(s.SecretToken)) != 1 {
+		logger.WithField("service_id", s.ServiceID()).Warn("Received GitLab webhook with a bad token")
+		w.WriteHeader(403)
+		return
+	}
+	var ev pipelineEvent
+	if err := json.NewDecoder(req.Body).Decode(&ev); err != nil {
+		logger.WithError(err).Error("GitLab webhook received an invalid JSON payload")
+		w.WriteHeader(400)
+		return
+	}
+	if ev.ObjectKind != "pipeline" {
+		w.WriteHeader(200) // Other events are ignored
+		return
+	}
+	msg := pipelineMessage(&ev)
+	for roomID, room := range s.Rooms {
+		filter, ok := room.Projects[ev.Project.PathWithNamespace]
+		if !ok || !matchesAny(filter.Branches, ev.ObjectAttributes.Ref) {
+			continue
+		}
+		statuses := filter.Statuses
+		if len(statuses) == 0 {
+			statuses = defaultStatuses
+		}
+		if !contains(statuses, ev.ObjectAttributes.Status) {
+			continue
+		}
+		for _, toRoomID := range utils.ResolveRooms(cli, s.ServiceUserID(), roomID) {
+			if _, err := cli.SendMessageEvent(toRoomID, mevt.EventMessage, msg); err != nil {
+				logger.WithError(err).WithField("room_id", toRoomID).Print(
+					"Failed to send GitLab notification to room.")
+			}
+		}
+	}
+	w.WriteHeader(200)
+}
+
+func pipelineMessage(ev *pipelineEvent) mevt.MessageEventContent {
+	a := ev.ObjectAttributes
+	pipelineURL := fmt.Sprintf("%s/-/pipelines/%d", ev.Project.WebURL, a.ID)
+	shortSHA := a.SHA
+	if len(shortSHA) > 8 {
+		shortSHA = shortSHA[:8]
+	}
+	subject := strings.SplitN(ev.Commit.Message, "\n", 2)[0]
+	body := fmt.Sprintf("[%s] Pipeline #%d on %s %s (%s: %s by %s)", ev.Project.PathWithNamespace, a.ID, a.Ref,
+		a.Status, shortSHA, subject, ev.User.Username)
+	if a.Duration > 0 {
+		body += " in " + utils.HumanDuration(time.Duration(a.Duration)*time.Second)
+	}
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body + " " + pipelineURL,
+	}
+}
+
+// matchesAny returns true if there are no globs or ref matches one of them.
+func matchesAny(globs []string, ref string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, ref); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func onRef(ref string) string {
+	if ref == "" {
+		return ""
+	}
+	return " on " + ref
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package gitlab
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const roomID = id.RoomID("!ci:hyrule")
+
+func newService(t *testing.T) *Service {
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"host": "https://gitlab.hyrule",
+		"access_token": "glpat-triforce",
+		"secret_token": "sekrit",
+		"rooms": {
+			"!ci:hyrule": {
+				"projects": {
+					"hyrule/castle": {"branches": ["main", "release/*"]},
+					"hyrule/village": {"statuses": ["failed"]}
+				}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	return srv.(*Service)
+}
+
+func TestCommands(t *testing.T) {
+	var requests []string
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("PRIVATE-TOKEN") != "glpat-triforce" {
+			t.Errorf("Missing access token: %v", req.Header)
+		}
+		requests = append(requests, req.Method+" "+req.URL.String())
+		body := `[{"id":42,"ref":"main","status":"failed","web_url":"https://gitlab.hyrule/hyrule/castle/-/pipelines/42"}]`
+		if req.Method == "POST" {
+			body = `{"id":42,"ref":"main","status":"running","web_url":"https://gitlab.hyrule/hyrule/castle/-/pipelines/42"}`
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})}
+	defer func() { httpClient = &http.Client{} }()
+	s := newService(t)
+
+	body := func(content interface{}, err error) string {
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		return content.(*mevt.MessageEventContent).Body
+	}
+	if got := body(s.cmdPipelineStatus(roomID, []string{"hyrule/castle", "main"})); got != "hyrule/castle pipeline #42 on main: failed https://gitlab.hyrule/hyrule/castle/-/pipelines/42" {
+		t.Errorf("Unexpected status: %s", got)
+	}
+	if got := body(s.cmdRetry(roomID, "@link:hyrule", []string{"hyrule/castle", "#42"})); !strings.HasPrefix(got, "Retrying hyrule/castle pipeline #42: running") {
+		t.Errorf("Unexpected retry response: %s", got)
+	}
+	want := []string{
+		"GET https://gitlab.hyrule/api/v4/projects/hyrule%2Fcastle/pipelines?per_page=1&ref=main",
+		"POST https://gitlab.hyrule/api/v4/projects/hyrule%2Fcastle/pipelines/42/retry",
+	}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Bad API requests: got %v want %v", requests, want)
+	}
+
+	if _, err := s.cmdPipelineStatus(roomID, nil); err == nil {
+		t.Error("Expected an error when the project is ambiguous")
+	}
+	if _, err := s.cmdRetry(roomID, "@link:hyrule", []string{"ganon/tower", "1"}); err == nil {
+		t.Error("Expected an error for a project which isn't configured for the room")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	var msgs []string
+	matrixTrans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/hierarchy") {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		msgs = append(msgs, msg.Body)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup"}`))}, nil
+	})
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: matrixTrans}
+	s := newService(t)
+
+	send := func(token, project, ref, status string) int {
+		req, _ := http.NewRequest("POST", "", bytes.NewBufferString(fmt.Sprintf(`{
+			"object_kind": "pipeline",
+			"object_attributes": {"id": 7, "ref": %q, "sha": "0123456789abcdef", "status": %q, "duration": 125},
+			"user": {"username": "link"},
+			"project": {"path_with_namespace": %q, "web_url": "https://gitlab.hyrule/%s"},
+			"commit": {"message": "Open the gate\n\nWith the key"}
+		}`, ref, status, project, project)))
+		req.Header.Set("X-Gitlab-Token", token)
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, cli)
+		return w.Code
+	}
+
+	if code := send("wrong", "hyrule/castle", "main", "success"); code != 403 {
+		t.Errorf("Expected a bad token to be rejected, got %d", code)
+	}
+	send("sekrit", "hyrule/castle", "release/1.0", "success")
+	send("sekrit", "hyrule/castle", "feature/x", "success")
+	send("sekrit", "hyrule/castle", "main", "running")
+	send("sekrit", "hyrule/village", "main", "success")
+	send("sekrit", "hyrule/village", "main", "failed")
+	want := []string{
+		"[hyrule/castle] Pipeline #7 on release/1.0 success (01234567: Open the gate by link) in 2 minutes https://gitlab.hyrule/hyrule/castle/-/pipelines/7",
+		"[hyrule/village] Pipeline #7 on main failed (01234567: Open the gate by link) in 2 minutes https://gitlab.hyrule/hyrule/village/-/pipelines/7",
+	}
+	if strings.Join(msgs, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Bad notifications:\ngot  %v\nwant %v", msgs, want)
+	}
+}
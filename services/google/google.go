@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/matrix-org/go-neb/secrets"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
@@ -53,22 +54,38 @@ type googleImage struct {
 
 // Service contains the Config fields for the Google service.
 //
+// The API key is also used for the YouTube Data API, which must be enabled for it to search
+// YouTube.
+//
 // Example request:
 //   {
 //			"api_key": "AIzaSyA4FD39..."
 //			"cx": "ASdsaijwdfASD..."
+//			"expand_youtube_links": true
 //   }
 type Service struct {
 	types.DefaultService
-	// The Google API key to use when making HTTP requests to Google.
+	// The Google API key to use when making HTTP requests to Google. This may instead be a reference to a secret store, see the secrets package.
 	APIKey string `json:"api_key"`
 	// The Google custom search engine ID
 	Cx string `json:"cx"`
+	// Whether to respond to links to YouTube videos with the video's title, channel and duration.
+	ExpandYouTubeLinks bool `json:"expand_youtube_links"`
+}
+
+// SetupQuestions asks for the Google API key and custom search engine ID.
+func (s *Service) SetupQuestions() []types.SetupQuestion {
+	return []types.SetupQuestion{
+		{Prompt: "What is your Google API key?", Apply: types.StoreAnswer(&s.APIKey)},
+		{Prompt: "What is your Google custom search engine ID?", Apply: types.StoreAnswer(&s.Cx)},
+	}
 }
 
 // Commands supported:
 //    !google image some_search_query_without_quotes
 // Responds with a suitable image into the same room as the command.
+//    !google youtube some_search_query_without_quotes
+// Responds with the title, channel, duration and a link for the top YouTube video result.
 func (s *Service) Commands(client types.MatrixClient) []types.Command {
 	return []types.Command{
 		{
@@ -77,6 +94,12 @@ func (s *Service) Commands(client types.MatrixClient) []types.Command {
 				return s.cmdGoogleImgSearch(client, roomID, userID, args)
 			},
 		},
+		{
+			Path: []string{"google", "youtube"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdYouTubeSearch(args)
+			},
+		},
 		{
 			Path: []string{"google", "help"},
 			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
@@ -92,11 +115,26 @@ func (s *Service) Commands(client types.MatrixClient) []types.Command {
 	}
 }
 
+// Expansions expands links to YouTube videos, if ExpandYouTubeLinks is set.
+func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
+	if !s.ExpandYouTubeLinks {
+		return nil
+	}
+	return []types.Expansion{
+		{
+			Regexp: youtubeLinkRegex,
+			Expand: func(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
+				return s.expandYouTubeLink(roomID, userID, matchingGroups[1])
+			},
+		},
+	}
+}
+
 // usageMessage returns a matrix TextMessage representation of the service usage
 func usageMessage() *mevt.MessageEventContent {
 	return &mevt.MessageEventContent{
 		MsgType: mevt.MsgNotice,
-		Body:    `Usage: !google image image_search_text`,
+		Body:    "Usage:\n!google image image_search_text\n!google youtube video_search_text",
 	}
 }
 
@@ -151,6 +189,11 @@ func (s *Service) text2imgGoogle(query string) (*googleSearchResult, error) {
 		return nil, err
 	}
 
+	apiKey, err := secrets.Resolve(s.APIKey)
+	if err != nil {
+		return nil, err
+	}
+
 	q := u.Query()
 	q.Set("q", query)            // String to search for
 	q.Set("num", "1")            // Just return 1 image result
@@ -158,8 +201,8 @@ func (s *Service) text2imgGoogle(query string) (*googleSearchResult, error) {
 	q.Set("imgSize", "large")    // Just search for medium size images
 	q.Set("searchType", "image") // Search for images
 
-	q.Set("key", s.APIKey) // Set the API key for the request
-	q.Set("cx", s.Cx)      // Set the custom search engine ID
+	q.Set("key", apiKey) // Set the API key for the request
+	q.Set("cx", s.Cx)    // Set the custom search engine ID
 
 	u.RawQuery = q.Encode()
 	// log.Info("Request URL: ", u)
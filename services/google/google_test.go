@@ -13,6 +13,7 @@ import (
 	"github.com/matrix-org/go-neb/testutils"
 	"github.com/matrix-org/go-neb/types"
 	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
 )
 
 // TODO: It would be nice to tabularise this test so we can try failing different combinations of responses to make
@@ -106,7 +107,7 @@ func TestCommand(t *testing.T) {
 
 	// Execute the matrix !command
 	cmds := google.Commands(matrixCli)
-	if len(cmds) != 3 {
+	if len(cmds) != 4 {
 		t.Fatalf("Unexpected number of commands: %d", len(cmds))
 	}
 	cmd := cmds[0]
@@ -115,3 +116,80 @@ func TestCommand(t *testing.T) {
 		t.Fatalf("Failed to process command: %s", err.Error())
 	}
 }
+
+func TestYouTube(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	video := `{"items": [{"id": "dQw4w9WgXcQ", "snippet": {"title": "Never Gonna Give You Up", "channelTitle": "Rick Astley"},
+		"contentDetails": {"duration": "PT3M33S"}}]}`
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		query := req.URL.Query()
+		if query.Get("key") != "secret" {
+			t.Errorf("Bad API key: %s", query.Get("key"))
+		}
+		var body string
+		switch req.URL.Path {
+		case "/youtube/v3/search":
+			body = `{"items": [{"id": {"videoId": "dQw4w9WgXcQ"}}]}`
+		case "/youtube/v3/videos":
+			if query.Get("id") != "dQw4w9WgXcQ" {
+				return nil, fmt.Errorf("Unexpected video ID: %s", query.Get("id"))
+			}
+			body = video
+		default:
+			return nil, fmt.Errorf("Unknown URL: %s", req.URL)
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@googlebot:hyrule", []byte(
+		`{"api_key": "secret", "expand_youtube_links": true}`,
+	))
+	if err != nil {
+		t.Fatal("Failed to create Google service: ", err)
+	}
+	google := srv.(*Service)
+	want := "Never Gonna Give You Up (https://www.youtube.com/watch?v=dQw4w9WgXcQ) - Rick Astley (3:33)"
+
+	content, err := google.cmdYouTubeSearch([]string{"rick", "astley"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := content.(*mevt.MessageEventContent).Body; body != want {
+		t.Errorf("search: got %q, want %q", body, want)
+	}
+
+	expansions := google.Expansions(nil)
+	if len(expansions) != 1 {
+		t.Fatalf("Unexpected number of expansions: %d", len(expansions))
+	}
+	for _, msg := range []string{
+		"look at https://www.youtube.com/watch?v=dQw4w9WgXcQ",
+		"https://youtube.com/watch?feature=share&v=dQw4w9WgXcQ&t=10",
+		"youtu.be/dQw4w9WgXcQ",
+	} {
+		groups := expansions[0].Regexp.FindStringSubmatch(msg)
+		if groups == nil {
+			t.Errorf("%q didn't match", msg)
+			continue
+		}
+		content := expansions[0].Expand("!someroom:hyrule", "@navi:hyrule", groups)
+		if body := content.(*mevt.MessageEventContent).Body; body != want {
+			t.Errorf("%q: got %q, want %q", msg, body, want)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	for iso, want := range map[string]string{
+		"PT3M33S":  "3:33",
+		"PT45S":    "0:45",
+		"PT1H2M3S": "1:02:03",
+		"P1DT1H":   "25:00:00",
+		"P0D":      "",
+		"bogus":    "",
+	} {
+		if got := formatDuration(iso); got != want {
+			t.Errorf("formatDuration(%q) = %q, want %q", iso, got, want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package google
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/services/utils"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const youtubeAPIURL = "https://www.googleapis.com/youtube/v3/"
+
+// Matches links to YouTube videos, capturing the video ID.
+var youtubeLinkRegex = regexp.MustCompile(`(?:https?://)?(?:www\.|m\.)?(?:youtube\.com/watch\?(?:[^\s#]*&)?v=|youtu\.be/)([\w-]{11})`)
+
+// Matches ISO 8601 durations as returned by YouTube, e.g. "PT1H2M3S" or "P1DT2H".
+var isoDurationRegex = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+type youtubeSearchResults struct {
+	Items []struct {
+		ID struct {
+			VideoID string `json:"videoId"`
+		} `json:"id"`
+	} `json:"items"`
+}
+
+type youtubeVideos struct {
+	Items []youtubeVideo `json:"items"`
+}
+
+type youtubeVideo struct {
+	ID      string `json:"id"`
+	Snippet struct {
+		Title                string `json:"title"`
+		ChannelTitle         string `json:"channelTitle"`
+		LiveBroadcastContent string `json:"liveBroadcastContent"`
+	} `json:"snippet"`
+	ContentDetails struct {
+		Duration string `json:"duration"`
+	} `json:"contentDetails"`
+}
+
+func (s *Service) cmdYouTubeSearch(args []string) (interface{}, error) {
+	if len(args) < 1 {
+		return usageMessage(), nil
+	}
+	query := strings.Join(args, " ")
+	log.Info("Searching YouTube for ", query)
+
+	var results youtubeSearchResults
+	err := s.youtubeAPI("search", url.Values{
+		"part":       {"id"},
+		"type":       {"video"},
+		"maxResults": {"1"},
+		"q":          {query},
+	}, &results)
+	if err != nil {
+		return nil, err
+	}
+	if len(results.Items) == 0 {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    "No videos found!",
+		}, nil
+	}
+	video, err := s.youtubeVideo(results.Items[0].ID.VideoID)
+	if err != nil {
+		return nil, err
+	}
+	return video.message(), nil
+}
+
+// expandYouTubeLink responds to a link to a YouTube video with the video's details.
+func (s *Service) expandYouTubeLink(roomID id.RoomID, userID id.UserID, videoID string) interface{} {
+	video, err := s.youtubeVideo(videoID)
+	if err != nil {
+		log.WithError(err).WithField("video_id", videoID).Print("Failed to expand YouTube link")
+		return nil
+	}
+	return video.message()
+}
+
+// youtubeVideo returns the details of the video with the given ID.
+func (s *Service) youtubeVideo(videoID string) (*youtubeVideo, error) {
+	var videos youtubeVideos
+	err := s.youtubeAPI("videos", url.Values{
+		"part": {"snippet,contentDetails"},
+		"id":   {videoID},
+	}, &videos)
+	if err != nil {
+		return nil, err
+	}
+	if len(videos.Items) == 0 {
+		return nil, fmt.Errorf("Video %s not found", videoID)
+	}
+	return &videos.Items[0], nil
+}
+
+// youtubeAPI calls a YouTube Data API endpoint, e.g. "search", and decodes the response into out.
+func (s *Service) youtubeAPI(endpoint string, q url.Values, out interface{}) error {
+	apiKey, err := secrets.Resolve(s.APIKey)
+	if err != nil {
+		return err
+	}
+	q.Set("key", apiKey)
+	res, err := httpClient.Get(youtubeAPIURL + endpoint + "?" + q.Encode())
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode > 200 {
+		return fmt.Errorf("Request error: %d, %s", res.StatusCode, response2String(res))
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// message returns a notice with the video's title, channel and duration, linking to it.
+func (v *youtubeVideo) message() *mevt.MessageEventContent {
+	link := "https://www.youtube.com/watch?v=" + v.ID
+	duration := formatDuration(v.ContentDetails.Duration)
+	if v.Snippet.LiveBroadcastContent == "live" {
+		duration = "live"
+	}
+	details := v.Snippet.ChannelTitle
+	if duration != "" {
+		details += " (" + duration + ")"
+	}
+	msg := utils.StrippedHTMLMessage(mevt.MsgNotice, fmt.Sprintf(`<a href="%s">%s</a> - %s`,
+		html.EscapeString(link), html.EscapeString(v.Snippet.Title), html.EscapeString(details)))
+	return &msg
+}
+
+// formatDuration formats an ISO 8601 duration like "PT1H2M3S" as "1:02:03", or returns "" if it
+// can't be parsed or is zero, as it is for live streams.
+func formatDuration(iso string) string {
+	m := isoDurationRegex.FindStringSubmatch(iso)
+	if m == nil {
+		return ""
+	}
+	var parts [4]int
+	for i := range parts {
+		parts[i], _ = strconv.Atoi(m[i+1])
+	}
+	hours, mins, secs := parts[0]*24+parts[1], parts[2], parts[3]
+	switch {
+	case hours > 0:
+		return fmt.Sprintf("%d:%02d:%02d", hours, mins, secs)
+	case mins > 0 || secs > 0:
+		return fmt.Sprintf("%d:%02d", mins, secs)
+	}
+	return ""
+}
@@ -0,0 +1,272 @@
+// Package grafana implements a Service capable of processing webhooks from Grafana alerting.
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	html "html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Grafana service.
+const ServiceType = "grafana"
+
+// The colours used for each alert status, which match the colours Grafana uses.
+var statusColours = map[string]string{
+	"firing":   "#e02f44",
+	"resolved": "#1b855e",
+}
+
+// The colour used for any other alert status, such as "pending".
+const defaultColour = "#ff9830"
+
+var htmlTemplate = html.Must(html.New("grafana").Funcs(html.FuncMap{
+	"colour": colour,
+	"links":  links,
+	"upper":  strings.ToUpper,
+}).Parse(`<strong><font color="{{colour .Status}}">[{{upper .Status}}{{if .Alerts}}:{{len .Alerts}}{{end}}]</font> {{.Heading}}</strong>
+{{- if .Alerts}}<ul>
+{{- range .Alerts}}<li><font color="{{colour .Status}}">{{upper .Status}}</font> <strong>{{index .Labels "alertname"}}</strong>
+{{- with index .Annotations "summary"}}: {{.}}{{end}}
+{{- with .ValueString}}<br><code>{{.}}</code>{{end}}
+{{- with index .Annotations "description"}}<br>{{.}}{{end}}
+{{- $links := links .}}{{if $links}}<br>{{range $i, $l := $links}}{{if $i}} | {{end}}<a href="{{$l.URL}}">{{$l.Name}}</a>{{end}}{{end}}</li>
+{{- end}}</ul>{{end}}`))
+
+// Service contains the Config fields for the Grafana service.
+//
+// This service will send notifications into a Matrix room when Grafana sends alert webhooks
+// to it. It requires a public domain which Grafana can reach. Add a "Webhook" contact point
+// to Grafana with the WebhookURL once the service has been registered.
+//
+// Each notification lists the alerts in the group, coloured by their status, along with
+// their summary annotation and links to the panel, dashboard and silence pages.
+//
+// You can set msg_type to either m.text or m.notice. It defaults to m.notice.
+//
+// Example JSON request:
+//    {
+//        rooms: {
+//            "!ewfug483gsfe:localhost": {
+//                "msg_type": "m.text"
+//            },
+//        }
+//    }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which should be added to Grafana as a webhook contact point - Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// A map of matrix rooms to send alerts into. A room may be a Space or a
+	// label such as "label:backend-teams", see utils.ResolveRooms.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+	// Optional. Create a room to send alerts into if no rooms are configured.
+	utils.RoomCreation
+}
+
+// RoomConfig is how alerts are sent into a room.
+type RoomConfig struct {
+	MsgType mevt.MessageType `json:"msg_type"`
+}
+
+// Alert is a single alert in a WebhookNotification.
+type Alert struct {
+	Status       string             `json:"status"`
+	Labels       map[string]string  `json:"labels"`
+	Annotations  map[string]string  `json:"annotations"`
+	StartsAt     string             `json:"startsAt"`
+	EndsAt       string             `json:"endsAt"`
+	Values       map[string]float64 `json:"values"`
+	ValueString  string             `json:"valueString"`
+	GeneratorURL string             `json:"generatorURL"`
+	Fingerprint  string             `json:"fingerprint"`
+	SilenceURL   string             `json:"silenceURL"`
+	DashboardURL string             `json:"dashboardURL"`
+	PanelURL     string             `json:"panelURL"`
+}
+
+// WebhookNotification is the payload from Grafana unified alerting.
+type WebhookNotification struct {
+	Receiver          string            `json:"receiver"`
+	Status            string            `json:"status"`
+	OrgID             int               `json:"orgId"`
+	Alerts            []Alert           `json:"alerts"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Version           string            `json:"version"`
+	GroupKey          string            `json:"groupKey"`
+	TruncatedAlerts   int               `json:"truncatedAlerts"`
+	Title             string            `json:"title"`
+	State             string            `json:"state"`
+	Message           string            `json:"message"`
+}
+
+// Heading returns a short description of the alert group for the first line of notifications.
+func (n *WebhookNotification) Heading() string {
+	if name := n.CommonLabels["alertname"]; name != "" {
+		return name
+	}
+	if n.Receiver != "" {
+		return n.Receiver
+	}
+	return "Grafana alert"
+}
+
+type link struct {
+	Name string
+	URL  string
+}
+
+func links(a Alert) []link {
+	var ls []link
+	for _, l := range []link{
+		{"Panel", a.PanelURL},
+		{"Dashboard", a.DashboardURL},
+		{"Source", a.GeneratorURL},
+		{"Silence", a.SilenceURL},
+	} {
+		if l.URL != "" {
+			ls = append(ls, l)
+		}
+	}
+	return ls
+}
+
+func colour(status string) string {
+	if c, ok := statusColours[status]; ok {
+		return c
+	}
+	return defaultColour
+}
+
+// render returns the HTML body of a notification.
+func render(n *WebhookNotification) (string, error) {
+	var htmlBuf bytes.Buffer
+	if err := htmlTemplate.Execute(&htmlBuf, n); err != nil {
+		return "", err
+	}
+	return htmlBuf.String(), nil
+}
+
+// OnReceiveWebhook receives requests from Grafana and sends requests to Matrix as a result.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	logger := logging.FromContext(req.Context())
+	var notif WebhookNotification
+	if err := json.NewDecoder(req.Body).Decode(&notif); err != nil {
+		logger.WithError(err).Error("Grafana webhook received an invalid JSON payload")
+		w.WriteHeader(400)
+		return
+	}
+	// List firing alerts before resolved ones
+	sort.SliceStable(notif.Alerts, func(i, j int) bool {
+		return notif.Alerts[i].Status < notif.Alerts[j].Status
+	})
+	htmlBody, err := render(&notif)
+	if err != nil {
+		logger.WithError(err).Error("Grafana webhook failed to execute HTML template")
+		w.WriteHeader(500)
+		return
+	}
+
+	for roomID, roomConfig := range s.Rooms {
+		msgType := roomConfig.MsgType
+		if msgType == "" {
+			msgType = mevt.MsgNotice
+		}
+		msg := utils.StrippedHTMLMessage(msgType, htmlBody)
+		for _, toRoomID := range utils.ResolveRooms(cli, s.ServiceUserID(), roomID) {
+			logger.WithFields(log.Fields{
+				"status":  notif.Status,
+				"room_id": toRoomID,
+			}).Print("Sending Grafana notification to room")
+			if _, e := cli.SendMessageEvent(toRoomID, mevt.EventMessage, msg); e != nil {
+				logger.WithError(e).WithField("room_id", toRoomID).Print(
+					"Failed to send Grafana notification to room.")
+			}
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	var oldRooms *utils.RoomCreation
+	if old, ok := oldService.(*Service); ok {
+		oldRooms = &old.RoomCreation
+	}
+	roomID, err := s.CreateMissingRoom(client, s.ServiceUserID(), s.Owner, len(s.Rooms) > 0, oldRooms)
+	if err != nil {
+		return fmt.Errorf("failed to create room: %s", err)
+	}
+	if roomID != "" {
+		s.Rooms = map[id.RoomID]RoomConfig{roomID: {}}
+	}
+	for roomID, roomConfig := range s.Rooms {
+		if roomConfig.MsgType != "" && roomConfig.MsgType != mevt.MsgNotice && roomConfig.MsgType != mevt.MsgText {
+			return fmt.Errorf("msg_type for room %s is neither 'm.notice' nor 'm.text'", roomID)
+		}
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+// PostRegister deletes this service if there are no rooms to send alerts to.
+func (s *Service) PostRegister(oldService types.Service) {
+	if len(s.Rooms) > 0 {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_type": s.ServiceType(),
+		"service_id":   s.ServiceID(),
+	})
+	logger.Info("Removing service as no rooms are registered.")
+	if err := database.GetServiceDB().DeleteService(s.ServiceID()); err != nil {
+		logger.WithError(err).Error("Failed to delete service")
+	}
+}
+
+// TargetRooms returns the rooms alerts are sent into.
+func (s *Service) TargetRooms() []id.RoomID {
+	roomIDs := make([]id.RoomID, 0, len(s.Rooms))
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
+func (s *Service) joinRooms(client types.MatrixClient) {
+	for roomID := range s.Rooms {
+		if utils.IsLabel(roomID) {
+			continue // labelled rooms are joined by the service which labels them
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
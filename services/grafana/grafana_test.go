@@ -0,0 +1,110 @@
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestNotify(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	// Intercept message sending to Matrix and mock responses
+	var msgs []mevt.MessageEventContent
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if !strings.Contains(req.URL.String(), "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		msgs = append(msgs, msg)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hs", "@neb:hs", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(`{"rooms":{"!testroom:id":{}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "", bytes.NewBufferString(`{
+		"receiver": "matrix",
+		"status": "firing",
+		"alerts": [
+			{
+				"status": "resolved",
+				"labels": {"alertname": "DiskFull"},
+				"annotations": {},
+				"generatorURL": "http://grafana/alerting/2"
+			},
+			{
+				"status": "firing",
+				"labels": {"alertname": "HighCPU"},
+				"annotations": {"summary": "CPU <90%>"},
+				"valueString": "[ var='B' value=97 ]",
+				"panelURL": "http://grafana/d/abc?viewPanel=1",
+				"silenceURL": "http://grafana/alerting/silence/new"
+			}
+		],
+		"commonLabels": {}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to create webhook request: %s", err)
+	}
+	mockWriter := httptest.NewRecorder()
+	srv.OnReceiveWebhook(mockWriter, req, matrixCli)
+
+	if mockWriter.Code != 200 {
+		t.Fatalf("Expected response 200 OK, got %d", mockWriter.Code)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("Expected sent 1 msgs, sent %d", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.MsgType != mevt.MsgNotice {
+		t.Errorf("Wrong msgtype: got %s want m.notice", msg.MsgType)
+	}
+	wantBody := "[FIRING:2] matrix\n" +
+		"- FIRING HighCPU: CPU <90%>\n  [ var='B' value=97 ]\n  Panel (http://grafana/d/abc?viewPanel=1) | Silence (http://grafana/alerting/silence/new)\n" +
+		"- RESOLVED DiskFull\n  Source (http://grafana/alerting/2)"
+	if msg.Body != wantBody {
+		t.Errorf("Wrong body: got %q want %q", msg.Body, wantBody)
+	}
+	for _, want := range []string{
+		`<strong><font color="#e02f44">[FIRING:2]</font> matrix</strong>`,
+		`<li><font color="#e02f44">FIRING</font> <strong>HighCPU</strong>: CPU &lt;90%&gt;<br><code>[ var=&#39;B&#39; value=97 ]</code><br><a href="http://grafana/d/abc?viewPanel=1">Panel</a> | <a href="http://grafana/alerting/silence/new">Silence</a></li>`,
+		`<li><font color="#1b855e">RESOLVED</font> <strong>DiskFull</strong><br><a href="http://grafana/alerting/2">Source</a></li>`,
+	} {
+		if !strings.Contains(msg.FormattedBody, want) {
+			t.Errorf("Expected formatted body to contain %q, got %q", want, msg.FormattedBody)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(`{"rooms":{"!testroom:id":{"msg_type":"m.image"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Register(nil, nil); err == nil {
+		t.Error("Expected an error for an invalid msg_type")
+	}
+}
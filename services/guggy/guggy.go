@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/matrix-org/go-neb/secrets"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
@@ -43,10 +44,17 @@ type guggyGifResult struct {
 //   }
 type Service struct {
 	types.DefaultService
-	// The Guggy API key to use when making HTTP requests to Guggy.
+	// The Guggy API key to use when making HTTP requests to Guggy. This may instead be a reference to a secret store, see the secrets package.
 	APIKey string `json:"api_key"`
 }
 
+// SetupQuestions asks for the Guggy API key.
+func (s *Service) SetupQuestions() []types.SetupQuestion {
+	return []types.SetupQuestion{
+		{Prompt: "What is your Guggy API key?", Apply: types.StoreAnswer(&s.APIKey)},
+	}
+}
+
 // Commands supported:
 //    !guggy some search query without quotes
 // Responds with a suitable GIF into the same room as the command.
@@ -113,7 +121,11 @@ func (s *Service) text2gifGuggy(querySentence string) (*guggyGifResult, error) {
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("apiKey", s.APIKey)
+	apiKey, err := secrets.Resolve(s.APIKey)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("apiKey", apiKey)
 
 	res, err := httpClient.Do(req)
 	if res != nil {
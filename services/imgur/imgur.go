@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/matrix-org/go-neb/secrets"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
@@ -106,12 +107,23 @@ type imgurSearchResponse struct {
 //   }
 type Service struct {
 	types.DefaultService
-	// The Imgur client ID
+	// The Imgur client ID. This may instead be a reference to a secret store, see the secrets package.
 	ClientID string `json:"client_id"`
-	// The API key to use when making HTTP requests to Imgur.
+	// The API key to use when making HTTP requests to Imgur. This may instead be a reference to a
+	// secret store.
 	ClientSecret string `json:"client_secret"`
 }
 
+// Register makes sure the client ID and secret can be resolved.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	for _, value := range []string{s.ClientID, s.ClientSecret} {
+		if _, err := secrets.Resolve(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Commands supported:
 //    !imgur some_search_query_without_quotes
 // Responds with a suitable image into the same room as the command.
@@ -197,7 +209,11 @@ func (s *Service) cmdImgSearch(client types.MatrixClient, roomID id.RoomID, user
 // text2img returns info about an image or an album
 func (s *Service) text2img(query string) (*imgurGalleryImage, *imgurGalleryAlbum, error) {
 	log.Info("Searching Imgur for an image of a ", query)
-	bytes, err := queryImgur(query, s.ClientID)
+	clientID, err := secrets.Resolve(s.ClientID)
+	if err != nil {
+		return nil, nil, err
+	}
+	bytes, err := queryImgur(query, clientID)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -3,13 +3,16 @@ package imgur
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/secrets"
 	"github.com/matrix-org/go-neb/testutils"
 	"github.com/matrix-org/go-neb/types"
 	"maunium.net/go/mautrix"
@@ -120,3 +123,54 @@ func TestCommand(t *testing.T) {
 		t.Fatalf("Failed to process command: %s", err.Error())
 	}
 }
+
+func TestSearchRecorded(t *testing.T) {
+	cassette := testutils.NewCassette(t, "testdata/search.json")
+	httpClient = cassette.Client()
+	s := &Service{ClientID: testutils.Credential("IMGUR_CLIENT_ID", "my_client_id")}
+
+	img, _, err := s.text2img("corgi")
+	if err != nil {
+		t.Fatal("Failed to search imgur: ", err)
+	}
+	// Albums are skipped
+	if !strings.HasPrefix(img.Link, "https://i.imgur.com/") || !strings.HasPrefix(img.Type, "image/") {
+		t.Errorf("Expected an image, got %+v", img)
+	}
+}
+
+// secretStore is a secret store holding the secrets in the map.
+type secretStore map[string]string
+
+func (s secretStore) Fetch(ref string) (string, time.Duration, error) {
+	if secret, ok := s[ref]; ok {
+		return secret, 0, nil
+	}
+	return "", 0, errors.New("not found")
+}
+
+func TestSecretReferences(t *testing.T) {
+	secrets.Register("test", secretStore{"imgur_client_id": "My ID", "imgur_client_secret": "My secret"})
+	defer secrets.Unregister("test")
+	var authHeader string
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		authHeader = req.Header.Get("Authorization")
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"data":[],"success":true,"status":200}`)),
+		}, nil
+	})}
+
+	s := &Service{ClientID: "test:imgur_client_id", ClientSecret: "test:missing"}
+	if err := s.Register(nil, nil); err == nil {
+		t.Error("Expected an error registering with a missing client secret")
+	}
+	s.ClientSecret = "test:imgur_client_secret"
+	if err := s.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register: ", err)
+	}
+	s.text2img("corgi")
+	if authHeader != "Client-ID My ID" {
+		t.Errorf("Bad client ID - Expected: %s, got %s", "Client-ID My ID", authHeader)
+	}
+}
@@ -0,0 +1,261 @@
+// Package janitor implements a Service which redacts the bot's own old messages.
+package janitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Janitor service
+const ServiceType = "janitor"
+
+// DefaultRedactionsPerMinute is the rate redactions are sent at if none is configured.
+const DefaultRedactionsPerMinute = 30
+
+// How often to look for messages to redact.
+const pollInterval = time.Hour
+
+// The number of messages to fetch per page of room history, and the most pages to fetch per room
+// per poll, to bound the work done for rooms with a huge history.
+const (
+	pageSize = 100
+	maxPages = 50
+)
+
+// sleep is called between redactions. It is replaced in tests.
+var sleep = time.Sleep
+
+// Service contains the Config fields for the Janitor Service.
+//
+// The janitor redacts messages sent by the service user ID which are older than the
+// configured age, which keeps rooms with noisy notifications, such as alerts, usable.
+// Only messages with one of the configured msgtypes are redacted, which defaults to
+// just m.notice. Redactions are rate limited so the homeserver isn't flooded with them.
+//
+// Example request:
+//   {
+//       "rooms": {
+//           "!qmElAGdFYCHoCJuaNt:localhost": {
+//               "max_age_days": 7
+//           },
+//           "!wfEDRAwRuaNtPdlgNt:localhost": {
+//               "max_age_days": 30,
+//               "msg_types": ["m.notice", "m.text"]
+//           }
+//       },
+//       "redactions_per_minute": 10,
+//       "reason": "Cleaning up old notifications"
+//   }
+type Service struct {
+	types.DefaultService
+	// A map of room ID to the messages to redact in that room. A room may be a Space or a
+	// label such as "label:backend-teams", see utils.ResolveRooms.
+	Rooms map[id.RoomID]struct {
+		// Messages older than this many days are redacted. Required.
+		MaxAgeDays int `json:"max_age_days"`
+		// The msgtypes of the messages to redact. Defaults to m.notice.
+		MsgTypes []mevt.MessageType `json:"msg_types"`
+	} `json:"rooms"`
+	// The most redactions to send per minute. Defaults to DefaultRedactionsPerMinute.
+	RedactionsPerMinute int `json:"redactions_per_minute"`
+	// The optional reason given for each redaction.
+	Reason string `json:"reason"`
+	// The timestamp in milliseconds up to which each room has been cleaned up, so that
+	// history isn't scanned again. This is populated by Go-NEB.
+	CleanedUpTo map[id.RoomID]int64 `json:"cleaned_up_to"`
+}
+
+// messagesResponse is the part of the response to GET /rooms/{roomID}/messages which is used.
+type messagesResponse struct {
+	Chunk []struct {
+		EventID   id.EventID `json:"event_id"`
+		Timestamp int64      `json:"origin_server_ts"`
+		Content   struct {
+			MsgType mevt.MessageType `json:"msgtype"`
+		} `json:"content"`
+	} `json:"chunk"`
+	End string `json:"end"`
+}
+
+// Register makes sure the Config information supplied is valid and joins the rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Rooms) == 0 {
+		return errors.New("At least one room is required")
+	}
+	for roomID, room := range s.Rooms {
+		if room.MaxAgeDays < 1 {
+			return fmt.Errorf("max_age_days for room %s must be at least 1", roomID)
+		}
+	}
+	if s.RedactionsPerMinute < 0 {
+		return errors.New("redactions_per_minute cannot be negative")
+	}
+	if oldJanitor, ok := oldService.(*Service); ok && s.CleanedUpTo == nil {
+		s.CleanedUpTo = oldJanitor.CleanedUpTo
+	}
+	for roomID := range s.Rooms {
+		if utils.IsLabel(roomID) {
+			continue // labelled rooms are joined by the service which labels them
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+// TargetRooms returns the rooms which are cleaned up.
+func (s *Service) TargetRooms() []id.RoomID {
+	roomIDs := make([]id.RoomID, 0, len(s.Rooms))
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
+// OnPoll redacts old messages in each room. At most half a poll interval's worth of
+// redactions are sent per poll, the rest are picked up by the next poll.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	perMinute := s.RedactionsPerMinute
+	if perMinute == 0 {
+		perMinute = DefaultRedactionsPerMinute
+	}
+	budget := perMinute * int(pollInterval/time.Minute) / 2
+	cleaned := make(map[id.RoomID]int64)
+
+	for configRoomID, room := range s.Rooms {
+		msgTypes := room.MsgTypes
+		if len(msgTypes) == 0 {
+			msgTypes = []mevt.MessageType{mevt.MsgNotice}
+		}
+		cutoff := time.Now().Add(-time.Duration(room.MaxAgeDays)*24*time.Hour).UnixNano() / int64(time.Millisecond)
+		for _, roomID := range utils.ResolveRooms(cli, s.ServiceUserID(), configRoomID) {
+			logger := log.WithFields(log.Fields{"service_id": s.ServiceID(), "room_id": roomID})
+			redacted, done, err := s.cleanRoom(cli, roomID, msgTypes, cutoff, budget, time.Minute/time.Duration(perMinute))
+			budget -= redacted
+			if err != nil {
+				logger.WithError(err).Error("Failed to clean up room")
+			} else if done {
+				cleaned[roomID] = cutoff
+			}
+			if redacted > 0 {
+				logger.WithField("redacted", redacted).Info("Redacted old messages")
+			}
+		}
+	}
+	if len(cleaned) > 0 {
+		s.storeProgress(cleaned)
+	}
+	return time.Now().Add(pollInterval)
+}
+
+// cleanRoom redacts messages sent before cutoff, newest first, stopping at messages which were
+// cleaned up by a previous poll. Returns the number of messages redacted and whether the room
+// was cleaned up completely.
+func (s *Service) cleanRoom(cli types.MatrixClient, roomID id.RoomID, msgTypes []mevt.MessageType, cutoff int64, budget int, interval time.Duration) (int, bool, error) {
+	redactable := make(map[mevt.MessageType]bool)
+	for _, msgType := range msgTypes {
+		redactable[msgType] = true
+	}
+	cleanedUpTo := s.CleanedUpTo[roomID]
+	redacted := 0
+	from := ""
+	for page := 0; page < maxPages; page++ {
+		resp, err := s.messages(cli, roomID, from)
+		if err != nil {
+			return redacted, false, err
+		}
+		for _, ev := range resp.Chunk {
+			if ev.Timestamp <= cleanedUpTo {
+				return redacted, true, nil
+			}
+			// Redacted events have no msgtype so are skipped too
+			if ev.Timestamp > cutoff || !redactable[ev.Content.MsgType] {
+				continue
+			}
+			if redacted >= budget {
+				return redacted, false, nil
+			}
+			if _, err := cli.RedactEvent(roomID, ev.EventID, mautrix.ReqRedact{Reason: s.Reason}); err != nil {
+				return redacted, false, err
+			}
+			redacted++
+			sleep(interval)
+		}
+		if resp.End == "" || len(resp.Chunk) == 0 {
+			return redacted, true, nil
+		}
+		from = resp.End
+	}
+	return redacted, false, nil
+}
+
+// messages returns a page of messages sent by the service user in the room, going backwards from
+// the from token, or from the latest message if from is empty.
+func (s *Service) messages(cli types.MatrixClient, roomID id.RoomID, from string) (*messagesResponse, error) {
+	u, err := url.Parse(cli.BuildBaseURL("_matrix", "client", "r0", "rooms", roomID, "messages"))
+	if err != nil {
+		return nil, err
+	}
+	filter, err := json.Marshal(mautrix.FilterPart{
+		Senders: []id.UserID{s.ServiceUserID()},
+		Types:   []mevt.Type{mevt.EventMessage},
+	})
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("dir", "b")
+	q.Set("limit", fmt.Sprintf("%d", pageSize))
+	q.Set("filter", string(filter))
+	if from != "" {
+		q.Set("from", from)
+	}
+	u.RawQuery = q.Encode()
+	var resp messagesResponse
+	if _, err := cli.MakeRequest("GET", u.String(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// storeProgress merges the rooms which were cleaned up into the latest stored copy of this
+// service, as the config may have been updated whilst redacting.
+func (s *Service) storeProgress(cleaned map[id.RoomID]int64) {
+	_, err := polling.Update(s, false, func(srv types.Service) (interface{}, error) {
+		latest := srv.(*Service)
+		if latest.CleanedUpTo == nil {
+			latest.CleanedUpTo = make(map[id.RoomID]int64)
+		}
+		for roomID, ts := range cleaned {
+			latest.CleanedUpTo[roomID] = ts
+		}
+		s.CleanedUpTo = latest.CleanedUpTo
+		return nil, nil
+	})
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to store janitor progress")
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
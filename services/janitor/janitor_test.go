@@ -0,0 +1,103 @@
+package janitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const roomID = id.RoomID("!kitchen:hyrule")
+
+func TestOnPoll(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	sleep = func(time.Duration) {}
+	defer func() { sleep = time.Sleep }()
+
+	day := int64(24 * 60 * 60 * 1000)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	// Newest first, as returned by /messages?dir=b
+	pages := map[string]string{
+		"": fmt.Sprintf(`{"chunk":[
+			{"event_id":"$new","origin_server_ts":%d,"content":{"msgtype":"m.notice"}},
+			{"event_id":"$text","origin_server_ts":%d,"content":{"msgtype":"m.text"}},
+			{"event_id":"$old1","origin_server_ts":%d,"content":{"msgtype":"m.notice"}}
+		],"end":"page2"}`, now-day, now-8*day, now-8*day),
+		"page2": fmt.Sprintf(`{"chunk":[
+			{"event_id":"$gone","origin_server_ts":%d,"content":{}},
+			{"event_id":"$old2","origin_server_ts":%d,"content":{"msgtype":"m.notice"}}
+		],"end":"page3"}`, now-9*day, now-10*day),
+		"page3": `{"chunk":[],"end":""}`,
+	}
+	var redacted []string
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		body := `{"event_id":"$redaction"}`
+		if strings.HasSuffix(req.URL.Path, "/messages") {
+			if req.URL.Query().Get("dir") != "b" || !strings.Contains(req.URL.Query().Get("filter"), `"senders":["@neb:hyrule"]`) {
+				t.Errorf("Bad /messages request: %s", req.URL)
+			}
+			body = pages[req.URL.Query().Get("from")]
+		} else if strings.Contains(req.URL.Path, "/redact/") {
+			var r mautrix.ReqRedact
+			if err := json.NewDecoder(req.Body).Decode(&r); err != nil || r.Reason != "tidy up" {
+				t.Errorf("Bad redaction reason: %+v", r)
+			}
+			parts := strings.Split(req.URL.Path, "/")
+			redacted = append(redacted, parts[len(parts)-2])
+		} else if strings.HasSuffix(req.URL.Path, "/hierarchy") {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"rooms": {"!kitchen:hyrule": {"max_age_days": 7}},
+		"reason": "tidy up"
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+
+	s.OnPoll(cli)
+	if strings.Join(redacted, ",") != "$old1,$old2" {
+		t.Errorf("Expected old notices to be redacted, got %v", redacted)
+	}
+	if s.CleanedUpTo[roomID] < now-7*day {
+		t.Errorf("Expected the room to be marked as cleaned up, got %d", s.CleanedUpTo[roomID])
+	}
+
+	// Nothing older than the previous cutoff is looked at again
+	redacted = nil
+	s.CleanedUpTo[roomID] = now - 9*day
+	s.OnPoll(cli)
+	if strings.Join(redacted, ",") != "$old1" {
+		t.Errorf("Expected only messages since the last clean up to be redacted, got %v", redacted)
+	}
+
+	// Rooms aren't marked as cleaned up when the budget runs out
+	s.CleanedUpTo = nil
+	n, done, err := s.cleanRoom(cli, roomID, []mevt.MessageType{mevt.MsgNotice}, now-7*day, 1, 0)
+	if err != nil {
+		t.Fatal("Failed to clean up room: ", err)
+	}
+	if n != 1 || done {
+		t.Errorf("Expected one redaction before running out of budget, got %d (done=%v)", n, done)
+	}
+}
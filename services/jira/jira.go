@@ -14,6 +14,7 @@ import (
 
 	gojira "github.com/andygrunwald/go-jira"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
 	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/realms/jira"
 	"github.com/matrix-org/go-neb/realms/jira/urls"
@@ -44,7 +45,7 @@ var projectKeyRegex = regexp.MustCompile("^[A-z]+$")
 //                   "jira-realm-id": {
 //                       Projects: {
 //                           "SYN": { Expand: true },
-//                           "BOTS": { Expand: true, Track: true }
+//                           "BOTS": { Expand: true, Track: true, Comments: true, Sprints: true }
 //                       }
 //                   }
 //               }
@@ -63,16 +64,58 @@ type Service struct {
 		// endpoint used.
 		Realms map[string]struct {
 			// A map of project keys e.g. "SYN" to config options.
-			Projects map[string]struct {
-				// True to expand issues with this key e.g "SYN-123" will be expanded.
-				Expand bool
-				// True to add a webhook to this project and send updates into the room.
-				Track bool
-			}
+			Projects map[string]ProjectConfig
 		}
 	}
 }
 
+// ProjectConfig is the config for a JIRA project in a room.
+//
+// Webhooks created by Go-NEB include every class of event. A webhook created by an older
+// version of Go-NEB only sends issue events until a JIRA admin adds the other events to it.
+type ProjectConfig struct {
+	// True to expand issues with this key e.g "SYN-123" will be expanded.
+	Expand bool
+	// True to add a webhook to this project and send updates into the room.
+	Track bool
+	// True to send comments on the project's issues into the room.
+	Comments bool
+	// True to send work logged on the project's issues into the room.
+	Worklogs bool
+	// True to send sprints of the project's boards being created, started and closed into
+	// the room.
+	Sprints bool
+}
+
+// sends returns true if the project sends the given class of webhook event into the room.
+func (p ProjectConfig) sends(class string) bool {
+	switch class {
+	case webhook.EventClassIssue:
+		return p.Track
+	case webhook.EventClassComment:
+		return p.Comments
+	case webhook.EventClassWorklog:
+		return p.Worklogs
+	case webhook.EventClassSprint:
+		return p.Sprints
+	}
+	return false
+}
+
+// tracked returns true if the project needs a webhook.
+func (p ProjectConfig) tracked() bool {
+	return p.Track || p.Comments || p.Worklogs || p.Sprints
+}
+
+// TargetRooms returns the rooms project notifications are sent into.
+func (s *Service) TargetRooms() []id.RoomID {
+	roomIDs := make([]id.RoomID, 0, len(s.Rooms))
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
 // Register ensures that the given realm IDs are valid JIRA realms and registers webhooks
 // with those JIRA endpoints.
 func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
@@ -172,6 +215,191 @@ func (s *Service) cmdJiraCreate(roomID id.RoomID, userID id.UserID, args []strin
 	}, nil
 }
 
+// issueClient returns a JIRA client for the user on the realm which has the issue's project. If
+// the user hasn't authenticated with that realm, a StarterLinkMessage is returned instead.
+func (s *Service) issueClient(userID id.UserID, issueKey string) (*gojira.Client, interface{}, error) {
+	groups := issueKeyRegex.FindStringSubmatch(issueKey)
+	if groups == nil || groups[0] != issueKey {
+		return nil, nil, errors.New("Issue key must look like 'ABC-123'")
+	}
+	pkey := strings.ToUpper(groups[1])
+	r, err := s.projectToRealm(userID, pkey)
+	if err != nil {
+		log.WithError(err).Print("Failed to map project key to realm")
+		return nil, nil, errors.New("Failed to map project key to a JIRA endpoint")
+	}
+	if r == nil {
+		return nil, nil, errors.New("No known project exists with that project key")
+	}
+	cli, err := r.JIRAClient(userID, false)
+	if err != nil {
+		if err == sql.ErrNoRows { // no client found
+			return nil, matrix.StarterLinkMessage{
+				Body: fmt.Sprintf(
+					"You need to OAuth with JIRA on %s before you can update issues.",
+					r.JIRAEndpoint,
+				),
+				Link: r.StarterLink,
+			}, nil
+		}
+		return nil, nil, err
+	}
+	return cli, nil, nil
+}
+
+const cmdJiraTokenUsage = "!jira token [realm_id] <personal access token>"
+
+func (s *Service) cmdJiraToken(userID id.UserID, args []string, direct bool) (interface{}, error) {
+	if !direct {
+		// The token has been seen by everyone in the room, so don't use it.
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body: "Personal access tokens can only be registered in a direct chat with me. " +
+				"As this one has been posted here, revoke it in JIRA and create a new one.",
+		}, nil
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errors.New("Usage: " + cmdJiraTokenUsage)
+	}
+	realms, err := database.GetServiceDB().LoadAuthRealmsByType(jira.RealmType)
+	if err != nil {
+		return nil, err
+	}
+	var r *jira.Realm
+	token := args[len(args)-1]
+	for _, realm := range realms {
+		jrealm, ok := realm.(*jira.Realm)
+		if !ok {
+			continue
+		}
+		// The realm can be left out if there is only one.
+		if (len(args) == 2 && jrealm.ID() == args[0]) || (len(args) == 1 && len(realms) == 1) {
+			r = jrealm
+		}
+	}
+	if r == nil {
+		ids := make([]string, len(realms))
+		for i, realm := range realms {
+			ids[i] = realm.ID()
+		}
+		return nil, fmt.Errorf("Give the ID of the JIRA realm to register the token with: %s", strings.Join(ids, ", "))
+	}
+	displayName, err := r.StorePersonalAccessToken(userID, token)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"user_id":  userID,
+			"realm_id": r.ID(),
+		}).Print("Failed to store personal access token")
+		return nil, fmt.Errorf("Failed to register the token: %s", err)
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Registered the token. You are now logged into %s as %s.", r.JIRAEndpoint, displayName),
+	}, nil
+}
+
+func (s *Service) cmdJiraComment(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	// E.g jira comment PROJ-123 "Some comment"
+	if len(args) < 2 {
+		return nil, errors.New("Missing issue key (e.g 'ABC-123') and/or comment")
+	}
+	issueKey := strings.ToUpper(args[0])
+	cli, starter, err := s.issueClient(userID, issueKey)
+	if cli == nil {
+		return starter, err
+	}
+	_, res, err := cli.Issue.AddComment(issueKey, &gojira.Comment{
+		Body: strings.Join(args[1:], " "),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"user_id":    userID,
+			"issue_key":  issueKey,
+		}).Print("Failed to comment on issue")
+		return nil, errors.New("Failed to comment on issue")
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("Failed to comment on issue: JIRA returned %d", res.StatusCode)
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Commented on %s", issueKey),
+	}, nil
+}
+
+func (s *Service) cmdJiraAssign(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	// E.g jira assign PROJ-123 alice
+	if len(args) != 2 {
+		return nil, errors.New("Missing issue key (e.g 'ABC-123') and/or JIRA username")
+	}
+	issueKey := strings.ToUpper(args[0])
+	cli, starter, err := s.issueClient(userID, issueKey)
+	if cli == nil {
+		return starter, err
+	}
+	res, err := cli.Issue.UpdateAssignee(issueKey, &gojira.User{Name: args[1]})
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"user_id":    userID,
+			"issue_key":  issueKey,
+		}).Print("Failed to assign issue")
+		if res != nil && res.StatusCode == 400 {
+			return nil, fmt.Errorf("JIRA user '%s' cannot be assigned to %s", args[1], issueKey)
+		}
+		return nil, errors.New("Failed to assign issue")
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    fmt.Sprintf("Assigned %s to %s", issueKey, args[1]),
+	}, nil
+}
+
+func (s *Service) cmdJiraTransition(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	// E.g jira transition PROJ-123 "In Progress"
+	if len(args) < 2 {
+		return nil, errors.New("Missing issue key (e.g 'ABC-123') and/or transition")
+	}
+	issueKey := strings.ToUpper(args[0])
+	// > 2 args is probably a transition without quote marks
+	name := strings.Join(args[1:], " ")
+	cli, starter, err := s.issueClient(userID, issueKey)
+	if cli == nil {
+		return starter, err
+	}
+	logger := log.WithFields(log.Fields{
+		"user_id":   userID,
+		"issue_key": issueKey,
+	})
+	transitions, _, err := cli.Issue.GetTransitions(issueKey)
+	if err != nil {
+		logger.WithError(err).Print("Failed to get transitions")
+		return nil, errors.New("Failed to get the issue's transitions")
+	}
+	// Match either the transition or the status it moves to, e.g. "Start Progress" or
+	// "In Progress", as people tend to know the latter.
+	var names []string
+	for _, t := range transitions {
+		if !strings.EqualFold(t.Name, name) && !strings.EqualFold(t.To.Name, name) {
+			names = append(names, t.Name)
+			continue
+		}
+		if _, err = cli.Issue.DoTransition(issueKey, t.ID); err != nil {
+			logger.WithError(err).WithField("transition", t.Name).Print("Failed to transition issue")
+			return nil, errors.New("Failed to transition issue")
+		}
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("Moved %s to %s", issueKey, t.To.Name),
+		}, nil
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%s has no transitions available", issueKey)
+	}
+	return nil, fmt.Errorf("Unknown transition '%s'. %s can be moved with: %s", name, issueKey, strings.Join(names, ", "))
+}
+
 func (s *Service) expandIssue(roomID id.RoomID, userID id.UserID, issueKeyGroups []string) interface{} {
 	// issueKeyGroups => ["SYN-123", "SYN", "123"]
 	if len(issueKeyGroups) != 3 {
@@ -234,14 +462,31 @@ func (s *Service) expandIssue(roomID id.RoomID, userID id.UserID, issueKeyGroups
 
 // Commands supported:
 //    !jira create KEY "issue title" "optional issue description"
-// Responds with the outcome of the issue creation request. This command requires
-// a JIRA account to be linked to the Matrix user ID issuing the command. It also
-// requires there to be a project with the given project key (e.g. "KEY") to exist
+//    !jira comment KEY-123 "comment text"
+//    !jira assign KEY-123 username
+//    !jira transition KEY-123 "In Progress"
+// Responds with the outcome of the request. Transitions can be given by name or by the
+// status they move the issue to. These commands require
+// a JIRA account to be linked to the Matrix user ID issuing the command. They also
+// require there to be a project with the given project key (e.g. "KEY") to exist
 // on the linked JIRA account. If there are multiple JIRA accounts which contain the
 // same project key, which project is chosen is undefined. If there
 // is no JIRA account linked to the Matrix user ID, it will return a Starter Link
 // if there is a known public project with that project key.
+//    !jira token [realm_id] <personal access token>
+// Links a JIRA account with a personal access token instead of OAuth. The realm ID is only
+// needed if there is more than one JIRA realm. This only works in a direct chat with the bot.
 func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return s.commands(false)
+}
+
+// DirectChatCommands are the same commands for a direct chat with the bot, where !jira token
+// can be used to register a personal access token without other users seeing it.
+func (s *Service) DirectChatCommands(cli types.MatrixClient, userID id.UserID) []types.Command {
+	return s.commands(true)
+}
+
+func (s *Service) commands(direct bool) []types.Command {
 	return []types.Command{
 		types.Command{
 			Path: []string{"jira", "create"},
@@ -249,6 +494,30 @@ func (s *Service) Commands(cli types.MatrixClient) []types.Command {
 				return s.cmdJiraCreate(roomID, userID, args)
 			},
 		},
+		types.Command{
+			Path: []string{"jira", "comment"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdJiraComment(roomID, userID, args)
+			},
+		},
+		types.Command{
+			Path: []string{"jira", "assign"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdJiraAssign(roomID, userID, args)
+			},
+		},
+		types.Command{
+			Path: []string{"jira", "transition"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdJiraTransition(roomID, userID, args)
+			},
+		},
+		types.Command{
+			Path: []string{"jira", "token"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdJiraToken(userID, args, direct)
+			},
+		},
 	}
 }
 
@@ -271,23 +540,33 @@ func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
 
 // OnReceiveWebhook receives requests from JIRA and possibly sends requests to Matrix as a result.
 func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	logger := logging.FromContext(req.Context())
 	eventProjectKey, event, httpErr := webhook.OnReceiveRequest(req)
 	if httpErr != nil {
-		log.Print("Failed to handle JIRA webhook")
+		logger.Print("Failed to handle JIRA webhook")
 		w.WriteHeader(httpErr.Code)
 		return
 	}
 	// grab base jira url
-	jurl, err := urls.ParseJIRAURL(event.Issue.Self)
+	jurl, err := urls.ParseJIRAURL(event.Self())
 	if err != nil {
-		log.WithError(err).Print("Failed to parse base JIRA URL")
+		logger.WithError(err).Print("Failed to parse base JIRA URL")
 		w.WriteHeader(500)
 		return
 	}
+	class := event.Class()
+	// worklog and sprint events don't say which project they are for, so look it up
+	if class == webhook.EventClassWorklog || class == webhook.EventClassSprint {
+		if eventProjectKey, err = s.lookUpProject(event, jurl.Base); err != nil {
+			logger.WithError(err).WithField("event", event.WebhookEvent).Print("Failed to look up project for event")
+			w.WriteHeader(200)
+			return
+		}
+	}
 	// work out the HTML to send
 	htmlText := htmlForEvent(event, jurl.Base)
 	if htmlText == "" {
-		log.WithField("project", eventProjectKey).Print("Unable to process event for project")
+		logger.WithField("project", eventProjectKey).Print("Unable to process event for project")
 		w.WriteHeader(200)
 		return
 	}
@@ -295,14 +574,14 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 	for roomID, roomConfig := range s.Rooms {
 		for _, realmConfig := range roomConfig.Realms {
 			for pkey, projectConfig := range realmConfig.Projects {
-				if pkey != eventProjectKey || !projectConfig.Track {
+				if pkey != eventProjectKey || !projectConfig.sends(class) {
 					continue
 				}
 				_, msgErr := cli.SendMessageEvent(
 					roomID, mevt.EventMessage, utils.StrippedHTMLMessage(mevt.MsgNotice, htmlText),
 				)
 				if msgErr != nil {
-					log.WithFields(log.Fields{
+					logger.WithFields(log.Fields{
 						log.ErrorKey: msgErr,
 						"project":    pkey,
 						"room_id":    roomID,
@@ -314,6 +593,46 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 	w.WriteHeader(200)
 }
 
+// lookUpProject returns the project key for a worklog or sprint event. The issue of a worklog
+// event is loaded into the event.
+func (s *Service) lookUpProject(event *webhook.Event, jiraBaseURL string) (string, error) {
+	cli, err := s.clientForURL(jiraBaseURL)
+	if err != nil {
+		return "", err
+	}
+	if event.Sprint != nil {
+		// Sprints belong to boards, which may be for a project.
+		boardConfig, _, err := cli.Board.GetBoardConfiguration(event.Sprint.OriginBoardID)
+		if err != nil {
+			return "", err
+		}
+		if boardConfig.Location.Type != "project" {
+			return "", fmt.Errorf("Board %d isn't for a project", event.Sprint.OriginBoardID)
+		}
+		return strings.ToUpper(boardConfig.Location.Key), nil
+	}
+	issue, _, err := cli.Issue.Get(event.Worklog.IssueID, nil)
+	if err != nil {
+		return "", err
+	}
+	event.Issue = *issue
+	return webhook.ProjectKey(issue.Key), nil
+}
+
+// clientForURL returns a client for the tracked realm with the given JIRA base URL.
+func (s *Service) clientForURL(jiraBaseURL string) (*gojira.Client, error) {
+	for realmID := range projectsAndRealmsToTrack(s) {
+		realm, err := database.GetServiceDB().LoadAuthRealm(realmID)
+		if err != nil {
+			return nil, err
+		}
+		if jrealm, ok := realm.(*jira.Realm); ok && urls.SameJIRAURL(jrealm.JIRAEndpoint, jiraBaseURL) {
+			return jrealm.JIRAClient(s.ClientUserID, false)
+		}
+	}
+	return nil, fmt.Errorf("No tracked realm for %s", jiraBaseURL)
+}
+
 func (s *Service) realmIDForProject(roomID id.RoomID, projectKey string) string {
 	// TODO: Multiple realms with the same pkey will be randomly chosen.
 	for r, realmConfig := range s.Rooms[roomID].Realms {
@@ -394,7 +713,7 @@ func projectsAndRealmsToTrack(s *Service) map[string][]string {
 	for _, roomConfig := range s.Rooms {
 		for realmID, realmConfig := range roomConfig.Realms {
 			for projectKey, projectConfig := range realmConfig.Projects {
-				if projectConfig.Track {
+				if projectConfig.tracked() {
 					ridsToProjects[realmID] = append(
 						ridsToProjects[realmID], projectKey,
 					)
@@ -426,6 +745,15 @@ func htmlSummaryForIssue(issue *gojira.Issue) string {
 // htmlForEvent formats a webhook event as HTML. Returns an empty string if there is nothing to send/cannot
 // be parsed.
 func htmlForEvent(whe *webhook.Event, jiraBaseURL string) string {
+	switch whe.Class() {
+	case webhook.EventClassComment:
+		return htmlForComment(whe, jiraBaseURL)
+	case webhook.EventClassWorklog:
+		return htmlForWorklog(whe, jiraBaseURL)
+	case webhook.EventClassSprint:
+		return htmlForSprint(whe, jiraBaseURL)
+	}
+
 	action := ""
 	if whe.WebhookEvent == "jira:issue_updated" {
 		action = "updated"
@@ -437,17 +765,120 @@ func htmlForEvent(whe *webhook.Event, jiraBaseURL string) string {
 		return ""
 	}
 
-	summaryHTML := htmlSummaryForIssue(&whe.Issue)
+	return htmlForIssueAction(userName(&whe.User), action, &whe.Issue, jiraBaseURL)
+}
 
+// htmlForIssueAction formats something a user did to an issue as HTML, e.g:
+//   "alice commented on SYN-123 - Flibble Wibble [P1, In Progress] https://..."
+func htmlForIssueAction(user, action string, issue *gojira.Issue, jiraBaseURL string) string {
+	summaryHTML := ""
+	if f := issue.Fields; f != nil && f.Status != nil && f.Priority != nil {
+		summaryHTML = htmlSummaryForIssue(issue)
+	} else if f != nil {
+		summaryHTML = html.EscapeString(f.Summary)
+	}
 	return fmt.Sprintf("%s %s <b>%s</b> - %s %s",
-		html.EscapeString(whe.User.Name),
+		html.EscapeString(user),
 		html.EscapeString(action),
-		html.EscapeString(whe.Issue.Key),
+		html.EscapeString(issue.Key),
 		summaryHTML,
-		html.EscapeString(jiraBaseURL+"browse/"+whe.Issue.Key),
+		html.EscapeString(jiraBaseURL+"browse/"+issue.Key),
 	)
 }
 
+func htmlForComment(whe *webhook.Event, jiraBaseURL string) string {
+	var action string
+	author := &whe.Comment.Author
+	switch whe.WebhookEvent {
+	case "comment_created":
+		action = "commented on"
+	case "comment_updated":
+		action = "edited a comment on"
+		author = &whe.Comment.UpdateAuthor
+	case "comment_deleted":
+		action = "deleted a comment on"
+		if whe.User.Name != "" || whe.User.DisplayName != "" {
+			author = &whe.User
+		}
+	default:
+		return ""
+	}
+	htmlText := htmlForIssueAction(userName(author), action, &whe.Issue, jiraBaseURL)
+	if whe.WebhookEvent != "comment_deleted" && whe.Comment.Body != "" {
+		htmlText += "<blockquote>" + htmlQuote(whe.Comment.Body) + "</blockquote>"
+	}
+	return htmlText
+}
+
+func htmlForWorklog(whe *webhook.Event, jiraBaseURL string) string {
+	var action string
+	author := whe.Worklog.Author
+	switch whe.WebhookEvent {
+	case "worklog_created":
+		action = "logged " + whe.Worklog.TimeSpent + " on"
+	case "worklog_updated":
+		action = "changed work logged to " + whe.Worklog.TimeSpent + " on"
+		if whe.Worklog.UpdateAuthor != nil {
+			author = whe.Worklog.UpdateAuthor
+		}
+	case "worklog_deleted":
+		action = "deleted " + whe.Worklog.TimeSpent + " of work logged on"
+	default:
+		return ""
+	}
+	if author == nil {
+		author = &whe.User
+	}
+	htmlText := htmlForIssueAction(userName(author), action, &whe.Issue, jiraBaseURL)
+	if whe.WebhookEvent != "worklog_deleted" && whe.Worklog.Comment != "" {
+		htmlText += "<blockquote>" + htmlQuote(whe.Worklog.Comment) + "</blockquote>"
+	}
+	return htmlText
+}
+
+func htmlForSprint(whe *webhook.Event, jiraBaseURL string) string {
+	action := map[string]string{
+		"sprint_created": "created",
+		"sprint_started": "started",
+		"sprint_closed":  "closed",
+		"sprint_updated": "updated",
+		"sprint_deleted": "deleted",
+	}[whe.WebhookEvent]
+	if action == "" {
+		return ""
+	}
+	htmlText := fmt.Sprintf("Sprint <b>%s</b> %s - %s",
+		html.EscapeString(whe.Sprint.Name),
+		html.EscapeString(action),
+		html.EscapeString(fmt.Sprintf("%ssecure/RapidBoard.jspa?rapidView=%d", jiraBaseURL, whe.Sprint.OriginBoardID)),
+	)
+	if whe.Sprint.Goal != "" && (whe.WebhookEvent == "sprint_created" || whe.WebhookEvent == "sprint_started") {
+		htmlText += "<br>Goal: " + html.EscapeString(whe.Sprint.Goal)
+	}
+	return htmlText
+}
+
+// The most characters of a comment shown in a notification.
+const maxQuoteLength = 500
+
+// htmlQuote escapes and truncates text to be quoted in a notification.
+func htmlQuote(text string) string {
+	text = strings.TrimSpace(text)
+	if runes := []rune(text); len(runes) > maxQuoteLength {
+		text = string(runes[:maxQuoteLength]) + "…"
+	}
+	return strings.Replace(html.EscapeString(text), "\n", "<br>", -1)
+}
+
+// userName returns the name to show for a JIRA user. JIRA Cloud doesn't send usernames, so this
+// falls back to the display name.
+func userName(u *gojira.User) string {
+	if u.Name != "" {
+		return u.Name
+	}
+	return u.DisplayName
+}
+
 func init() {
 	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
 		return &Service{
@@ -0,0 +1,51 @@
+package jira
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/go-neb/services/jira/webhook"
+)
+
+func TestHTMLForEvent(t *testing.T) {
+	issue := `"issue": {"key": "SYN-12", "self": "https://jira.example.com/rest/api/2/issue/10012", "fields": {
+		"summary": "Flibble <Wibble>", "priority": {"name": "P1"}, "status": {"name": "Open"}
+	}}`
+	for _, tc := range []struct {
+		body string
+		want string
+	}{
+		{
+			`{"webhookEvent": "jira:issue_created", "user": {"name": "alice"}, ` + issue + `}`,
+			`alice created <b>SYN-12</b> - Flibble &lt;Wibble&gt; [P1, Open] https://jira.example.com/browse/SYN-12`,
+		},
+		{
+			`{"webhookEvent": "comment_created", "comment": {"author": {"displayName": "Bob"}, "body": "Looks good\nto me"}, ` + issue + `}`,
+			`Bob commented on <b>SYN-12</b> - Flibble &lt;Wibble&gt; [P1, Open] https://jira.example.com/browse/SYN-12<blockquote>Looks good<br>to me</blockquote>`,
+		},
+		{
+			`{"webhookEvent": "comment_deleted", "comment": {"author": {"name": "alice"}, "body": "Oops"}, ` + issue + `}`,
+			`alice deleted a comment on <b>SYN-12</b> - Flibble &lt;Wibble&gt; [P1, Open] https://jira.example.com/browse/SYN-12`,
+		},
+		{
+			`{"webhookEvent": "worklog_updated", "worklog": {"author": {"name": "alice"}, "updateAuthor": {"name": "bob"}, "timeSpent": "2h", "issueId": "10012"}, ` + issue + `}`,
+			`bob changed work logged to 2h on <b>SYN-12</b> - Flibble &lt;Wibble&gt; [P1, Open] https://jira.example.com/browse/SYN-12`,
+		},
+		{
+			`{"webhookEvent": "sprint_started", "sprint": {"name": "Sprint 4", "goal": "Ship it", "originBoardId": 7, "self": "https://jira.example.com/rest/agile/1.0/sprint/4"}}`,
+			`Sprint <b>Sprint 4</b> started - https://jira.example.com/secure/RapidBoard.jspa?rapidView=7<br>Goal: Ship it`,
+		},
+		{
+			`{"webhookEvent": "board_created", "user": {"name": "alice"}}`,
+			``,
+		},
+	} {
+		var event webhook.Event
+		if err := json.Unmarshal([]byte(tc.body), &event); err != nil {
+			t.Fatalf("Failed to unmarshal %s: %s", tc.body, err)
+		}
+		if got := htmlForEvent(&event, "https://jira.example.com/"); got != tc.want {
+			t.Errorf("htmlForEvent(%s)\ngot  %s\nwant %s", event.WebhookEvent, got, tc.want)
+		}
+	}
+}
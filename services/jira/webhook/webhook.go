@@ -24,12 +24,76 @@ type jiraWebhook struct {
 	Enabled bool `json:"enabled"`
 }
 
+// The classes of webhook event which a project can send into rooms.
+const (
+	EventClassIssue   = "issue"
+	EventClassComment = "comment"
+	EventClassWorklog = "worklog"
+	EventClassSprint  = "sprint"
+)
+
+// Events are the webhook events which Go-NEB asks JIRA to send it.
+var Events = []string{
+	"jira:issue_created", "jira:issue_deleted", "jira:issue_updated",
+	"comment_created", "comment_updated", "comment_deleted",
+	"worklog_created", "worklog_updated", "worklog_deleted",
+	"sprint_created", "sprint_started", "sprint_closed", "sprint_updated", "sprint_deleted",
+}
+
 // Event represents an incoming JIRA webhook event
 type Event struct {
 	WebhookEvent string       `json:"webhookEvent"`
 	Timestamp    int64        `json:"timestamp"`
 	User         gojira.User  `json:"user"`
 	Issue        gojira.Issue `json:"issue"`
+	// The comment, for comment events.
+	Comment *gojira.Comment `json:"comment"`
+	// The work logged, for worklog events. These events don't include the issue.
+	Worklog *gojira.WorklogRecord `json:"worklog"`
+	// The sprint, for sprint events. These events don't include an issue or project.
+	Sprint *Sprint `json:"sprint"`
+}
+
+// Sprint is the sprint in a sprint event.
+type Sprint struct {
+	ID            int    `json:"id"`
+	Self          string `json:"self"`
+	Name          string `json:"name"`
+	State         string `json:"state"`
+	Goal          string `json:"goal"`
+	OriginBoardID int    `json:"originBoardId"`
+}
+
+// Class returns which class of event this is, e.g. EventClassComment, or "" if it isn't one
+// Go-NEB knows about.
+func (e *Event) Class() string {
+	switch {
+	case strings.HasPrefix(e.WebhookEvent, "jira:issue_"):
+		return EventClassIssue
+	case strings.HasPrefix(e.WebhookEvent, "comment_") && e.Comment != nil:
+		return EventClassComment
+	case strings.HasPrefix(e.WebhookEvent, "worklog_") && e.Worklog != nil:
+		return EventClassWorklog
+	case strings.HasPrefix(e.WebhookEvent, "sprint_") && e.Sprint != nil:
+		return EventClassSprint
+	}
+	return ""
+}
+
+// Self returns the REST URL of the thing the event is about, which identifies the JIRA
+// installation the event came from.
+func (e *Event) Self() string {
+	switch {
+	case e.Issue.Self != "":
+		return e.Issue.Self
+	case e.Comment != nil:
+		return e.Comment.Self
+	case e.Worklog != nil:
+		return e.Worklog.Self
+	case e.Sprint != nil:
+		return e.Sprint.Self
+	}
+	return ""
 }
 
 // RegisterHook checks to see if this user is allowed to track the given projects and then tracks them.
@@ -101,7 +165,8 @@ func RegisterHook(jrealm *jira.Realm, projects []string, userID id.UserID, webho
 }
 
 // OnReceiveRequest is called when JIRA hits NEB with an update.
-// Returns the project key and webhook event, or an error.
+// Returns the project key and webhook event, or an error. The project key is "" for worklog
+// and sprint events, as they don't include the issue or project.
 func OnReceiveRequest(req *http.Request) (string, *Event, *util.JSONResponse) {
 	// extract the JIRA webhook event JSON
 	defer req.Body.Close()
@@ -116,9 +181,15 @@ func OnReceiveRequest(req *http.Request) (string, *Event, *util.JSONResponse) {
 		resErr := util.MessageResponse(400, "Failed to parse JIRA URL")
 		return "", nil, &resErr
 	}
-	projKey := strings.Split(whe.Issue.Key, "-")[0]
-	projKey = strings.ToUpper(projKey)
-	return projKey, &whe, nil
+	return ProjectKey(whe.Issue.Key), &whe, nil
+}
+
+// ProjectKey returns the project key of an issue key, e.g. "SYN" for "SYN-123".
+func ProjectKey(issueKey string) string {
+	if issueKey == "" {
+		return ""
+	}
+	return strings.ToUpper(strings.Split(issueKey, "-")[0])
 }
 
 func createWebhook(jrealm *jira.Realm, webhookEndpointURL string, userID id.UserID) error {
@@ -130,7 +201,7 @@ func createWebhook(jrealm *jira.Realm, webhookEndpointURL string, userID id.User
 	req, err := cli.NewRequest("POST", "rest/webhooks/1.0/webhook", jiraWebhook{
 		Name:    "Go-NEB",
 		URL:     webhookEndpointURL,
-		Events:  []string{"jira:issue_created", "jira:issue_deleted", "jira:issue_updated"},
+		Events:  Events,
 		Filter:  "",
 		Exclude: false,
 	})
@@ -0,0 +1,313 @@
+// Package linkguard implements a Service which warns about or redacts links to known bad sites.
+package linkguard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Linkguard service
+const ServiceType = "linkguard"
+
+// The modes a room can be in.
+const (
+	// ModeWarn sends a warning into the room when a bad link is posted.
+	ModeWarn = "warn"
+	// ModeRedact redacts messages containing bad links, falling back to a warning if the
+	// bot doesn't have the power to redact.
+	ModeRedact = "redact"
+)
+
+var urlRegex = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"']+`)
+
+var safeBrowsingURL = "https://safebrowsing.googleapis.com/v4/threatMatches:find"
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Blocklist files are cached until they are modified.
+type blocklistFile struct {
+	modTime time.Time
+	domains []string
+}
+
+var (
+	filesMutex sync.Mutex
+	fileCache  = make(map[string]blocklistFile)
+)
+
+// Service contains the Config fields for the Linkguard Service.
+//
+// Links posted in the configured rooms are checked against blocklists of domains, which
+// can be given in the config or read from files with one domain per line. Blocking a
+// domain also blocks its subdomains. If a Google Safe Browsing API key is configured,
+// links are also checked against Safe Browsing. Domains on the allowlist are never flagged.
+//
+// In "warn" mode a warning is sent into the room. In "redact" mode the message is also
+// redacted, if the bot has the power to, which requires the bot to be a moderator.
+//
+// Example request:
+//   {
+//       "blocklist": ["evil.example", "free-nitro.example"],
+//       "blocklist_files": ["/etc/go-neb/phishing-domains.txt"],
+//       "allowlist": ["matrix.org"],
+//       "safe_browsing_api_key": "AIza...",
+//       "rooms": {
+//           "!qmElAGdFYCHoCJuaNt:localhost": {
+//               "mode": "redact"
+//           },
+//           "!wfEDRAwRuaNtPdlgNt:localhost": {}
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// Domains to flag, including their subdomains.
+	Blocklist []string `json:"blocklist"`
+	// Paths to files of domains to flag, one per line. Blank lines and lines starting with # are ignored.
+	BlocklistFiles []string `json:"blocklist_files"`
+	// Domains, including their subdomains, which are never flagged.
+	Allowlist []string `json:"allowlist"`
+	// An optional Google Safe Browsing API key. This may instead be a reference to a secret store, see the secrets package.
+	SafeBrowsingAPIKey string `json:"safe_browsing_api_key"`
+	// A map of room ID to the settings for that room. Only links in these rooms are checked.
+	Rooms map[id.RoomID]struct {
+		// Either "warn" or "redact". Defaults to "warn".
+		Mode string `json:"mode"`
+	} `json:"rooms"`
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Blocklist) == 0 && len(s.BlocklistFiles) == 0 && s.SafeBrowsingAPIKey == "" {
+		return errors.New("At least one of blocklist, blocklist_files or safe_browsing_api_key is required")
+	}
+	for _, path := range s.BlocklistFiles {
+		if _, err := loadFile(path); err != nil {
+			return fmt.Errorf("Failed to read blocklist file: %s", err)
+		}
+	}
+	for roomID, room := range s.Rooms {
+		if room.Mode != "" && room.Mode != ModeWarn && room.Mode != ModeRedact {
+			return fmt.Errorf("mode for room %s must be 'warn' or 'redact'", roomID)
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+// OnMessage checks the links in messages in the configured rooms.
+func (s *Service) OnMessage(cli types.MatrixClient, ev *mevt.Event) {
+	if _, ok := s.Rooms[ev.RoomID]; !ok {
+		return
+	}
+	links := urlRegex.FindAllString(ev.Content.AsMessage().Body, -1)
+	if len(links) == 0 {
+		return
+	}
+	go s.check(cli, ev, links)
+}
+
+// check acts on the message if any of the links are bad.
+func (s *Service) check(cli types.MatrixClient, ev *mevt.Event, links []string) {
+	logger := log.WithFields(log.Fields{"room_id": ev.RoomID, "event_id": ev.ID, "sender": ev.Sender})
+	link, reason := s.badLink(links)
+	if link == "" {
+		return
+	}
+	logger.WithFields(log.Fields{"link": link, "reason": reason}).Info("Found bad link")
+
+	warning := fmt.Sprintf("Warning: the link to %s posted by %s is %s. Do not open it.", hostOf(link), ev.Sender, reason)
+	if s.Rooms[ev.RoomID].Mode == ModeRedact {
+		_, err := cli.RedactEvent(ev.RoomID, ev.ID, mautrix.ReqRedact{Reason: "Link " + reason})
+		if err == nil {
+			warning = fmt.Sprintf("Removed a message from %s with a link to %s, which is %s.", ev.Sender, hostOf(link), reason)
+		} else {
+			logger.WithError(err).Warn("Failed to redact message with bad link")
+		}
+	}
+	if _, err := cli.SendMessageEvent(ev.RoomID, mevt.EventMessage, mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    warning,
+	}); err != nil {
+		logger.WithError(err).Error("Failed to send bad link warning")
+	}
+}
+
+// badLink returns the first bad link and why it is bad, or "" if all the links are fine.
+func (s *Service) badLink(links []string) (string, string) {
+	var unknown []string
+	for _, link := range links {
+		host := hostOf(link)
+		if host == "" || matchesDomain(host, s.Allowlist) {
+			continue
+		}
+		if matchesDomain(host, s.Blocklist) {
+			return link, "on a blocklist"
+		}
+		for _, path := range s.BlocklistFiles {
+			domains, err := loadFile(path)
+			if err != nil {
+				log.WithError(err).WithField("path", path).Error("Failed to read blocklist file")
+			}
+			if matchesDomain(host, domains) {
+				return link, "on a blocklist"
+			}
+		}
+		unknown = append(unknown, link)
+	}
+	if s.SafeBrowsingAPIKey == "" || len(unknown) == 0 {
+		return "", ""
+	}
+	link, threat, err := s.checkSafeBrowsing(unknown)
+	if err != nil {
+		log.WithError(err).Error("Failed to check links with Safe Browsing")
+		return "", ""
+	}
+	if link == "" {
+		return "", ""
+	}
+	return link, "flagged by Google Safe Browsing (" + strings.ToLower(strings.Replace(threat, "_", " ", -1)) + ")"
+}
+
+type safeBrowsingRequest struct {
+	Client struct {
+		ClientID      string `json:"clientId"`
+		ClientVersion string `json:"clientVersion"`
+	} `json:"client"`
+	ThreatInfo struct {
+		ThreatTypes      []string `json:"threatTypes"`
+		PlatformTypes    []string `json:"platformTypes"`
+		ThreatEntryTypes []string `json:"threatEntryTypes"`
+		ThreatEntries    []struct {
+			URL string `json:"url"`
+		} `json:"threatEntries"`
+	} `json:"threatInfo"`
+}
+
+type safeBrowsingResponse struct {
+	Matches []struct {
+		ThreatType string `json:"threatType"`
+		Threat     struct {
+			URL string `json:"url"`
+		} `json:"threat"`
+	} `json:"matches"`
+}
+
+// checkSafeBrowsing returns the first link which Safe Browsing has a threat for, and the type of
+// threat, or "" if there are none.
+func (s *Service) checkSafeBrowsing(links []string) (string, string, error) {
+	var sbReq safeBrowsingRequest
+	sbReq.Client.ClientID = "go-neb"
+	sbReq.Client.ClientVersion = "1.0"
+	sbReq.ThreatInfo.ThreatTypes = []string{"MALWARE", "SOCIAL_ENGINEERING", "UNWANTED_SOFTWARE", "POTENTIALLY_HARMFUL_APPLICATION"}
+	sbReq.ThreatInfo.PlatformTypes = []string{"ANY_PLATFORM"}
+	sbReq.ThreatInfo.ThreatEntryTypes = []string{"URL"}
+	for _, link := range links {
+		sbReq.ThreatInfo.ThreatEntries = append(sbReq.ThreatInfo.ThreatEntries, struct {
+			URL string `json:"url"`
+		}{link})
+	}
+	body, err := json.Marshal(sbReq)
+	if err != nil {
+		return "", "", err
+	}
+	apiKey, err := secrets.Resolve(s.SafeBrowsingAPIKey)
+	if err != nil {
+		return "", "", err
+	}
+	res, err := httpClient.Post(safeBrowsingURL+"?key="+url.QueryEscape(apiKey), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("Safe Browsing returned HTTP %d", res.StatusCode)
+	}
+	var sbResp safeBrowsingResponse
+	if err := json.NewDecoder(res.Body).Decode(&sbResp); err != nil {
+		return "", "", err
+	}
+	if len(sbResp.Matches) == 0 {
+		return "", "", nil
+	}
+	return sbResp.Matches[0].Threat.URL, sbResp.Matches[0].ThreatType, nil
+}
+
+func hostOf(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+// matchesDomain returns true if host is one of the domains or a subdomain of one.
+func matchesDomain(host string, domains []string) bool {
+	for _, domain := range domains {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadFile returns the domains in a blocklist file, reading it again if it has been modified.
+func loadFile(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+	if cached, ok := fileCache[path]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.domains, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var domains []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			domains = append(domains, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	fileCache[path] = blocklistFile{info.ModTime(), domains}
+	return domains, nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package linkguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linkguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listPath := filepath.Join(dir, "blocklist.txt")
+	if err := ioutil.WriteFile(listPath, []byte("# phishing\nphish.example\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var checked []string
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Query().Get("key") != "sb-key" {
+			t.Errorf("Bad Safe Browsing request: %s", req.URL)
+		}
+		var sbReq safeBrowsingRequest
+		if err := json.NewDecoder(req.Body).Decode(&sbReq); err != nil {
+			t.Fatal("Failed to decode Safe Browsing request: ", err)
+		}
+		body := `{}`
+		for _, entry := range sbReq.ThreatInfo.ThreatEntries {
+			checked = append(checked, entry.URL)
+			if strings.Contains(entry.URL, "malware.example") {
+				body = `{"matches":[{"threatType":"SOCIAL_ENGINEERING","threat":{"url":"` + entry.URL + `"}}]}`
+			}
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})}
+	defer func() { httpClient = &http.Client{} }()
+
+	var sent []mevt.MessageEventContent
+	var redacted []string
+	matrixTrans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/redact/") {
+			redacted = append(redacted, req.URL.Path)
+			if strings.Contains(req.URL.Path, "!powerless") {
+				return &http.Response{StatusCode: 403, Body: ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_FORBIDDEN"}`))}, nil
+			}
+		} else {
+			var msg mevt.MessageEventContent
+			if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+				t.Fatal("Failed to decode message: ", err)
+			}
+			sent = append(sent, msg)
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup"}`))}, nil
+	})
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"blocklist": ["Evil.example"],
+		"blocklist_files": ["`+listPath+`"],
+		"allowlist": ["good.evil.example"],
+		"safe_browsing_api_key": "sb-key",
+		"rooms": {
+			"!warn:hyrule": {},
+			"!redact:hyrule": {"mode": "redact"},
+			"!powerless:hyrule": {"mode": "redact"}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+
+	for _, tc := range []struct {
+		roomID   id.RoomID
+		body     string
+		warning  string
+		redacted bool
+	}{
+		{"!warn:hyrule", "see https://www.evil.example/login", "Warning: the link to www.evil.example posted by @link:hyrule is on a blocklist. Do not open it.", false},
+		{"!warn:hyrule", "see https://good.evil.example/ and https://matrix.org", "", false},
+		{"!redact:hyrule", "free stuff http://phish.example", "Removed a message from @link:hyrule with a link to phish.example, which is on a blocklist.", true},
+		{"!powerless:hyrule", "https://malware.example/x", "Warning: the link to malware.example posted by @link:hyrule is flagged by Google Safe Browsing (social engineering). Do not open it.", true},
+	} {
+		sent, redacted = nil, nil
+		ev := &mevt.Event{
+			ID:      "$spam",
+			RoomID:  tc.roomID,
+			Sender:  "@link:hyrule",
+			Content: mevt.Content{Parsed: &mevt.MessageEventContent{MsgType: mevt.MsgText, Body: tc.body}},
+		}
+		s.check(cli, ev, urlRegex.FindAllString(tc.body, -1))
+		if tc.warning == "" && len(sent) != 0 {
+			t.Errorf("%s: expected no warning, got %+v", tc.body, sent)
+		} else if tc.warning != "" && (len(sent) != 1 || sent[0].Body != tc.warning) {
+			t.Errorf("%s: expected warning %q, got %+v", tc.body, tc.warning, sent)
+		}
+		if tc.redacted != (len(redacted) == 1) {
+			t.Errorf("%s: expected redacted=%v, got %v", tc.body, tc.redacted, redacted)
+		}
+	}
+	if strings.Join(checked, ",") != "https://matrix.org,https://malware.example/x" {
+		t.Errorf("Expected only unknown links to be checked with Safe Browsing, got %v", checked)
+	}
+}
@@ -0,0 +1,378 @@
+// Package minutes implements a Service which captures meeting minutes.
+package minutes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Minutes service
+const ServiceType = "minutes"
+
+// DefaultRetentionDays is how long minutes are kept for if no retention is configured.
+const DefaultRetentionDays = 30
+
+// How often to check for minutes which have passed their retention period.
+const pruneInterval = time.Hour
+
+// Messages captured per meeting are capped to stop a forgotten !minutes start growing forever.
+const maxEntries = 5000
+
+var (
+	anyMessageRegex = regexp.MustCompile(`(?s)^.+$`)
+	markerRegex     = regexp.MustCompile(`(?i)#(action|decision)\b`)
+	slugRegex       = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// Entry is a single captured message.
+type Entry struct {
+	UserID        id.UserID `json:"user_id"`
+	TimestampSecs int64     `json:"ts_secs"`
+	Body          string    `json:"body"`
+}
+
+// Meeting is the minutes of a single meeting.
+type Meeting struct {
+	ID                 string    `json:"id"`
+	RoomID             id.RoomID `json:"room_id"`
+	Title              string    `json:"title"`
+	StartedBy          id.UserID `json:"started_by"`
+	StartTimestampSecs int64     `json:"start_ts_secs"`
+	// 0 whilst the meeting is in progress.
+	EndTimestampSecs int64   `json:"end_ts_secs"`
+	Entries          []Entry `json:"entries"`
+}
+
+// Service contains the Config fields for the Minutes Service.
+//
+// Whilst a meeting is in progress every message in the room is captured. Messages containing
+// #action or #decision are listed in the summary which is posted when the meeting stops, along
+// with a log file of the whole meeting. Minutes are kept for the retention period so they can
+// be listed and uploaded again with !minutes list and !minutes log.
+//
+// Example request:
+//   {
+//       "retention_days": 90,
+//       "rooms": {
+//           "!qmElAGdFYCHoCJuaNt:localhost": {
+//               "retention_days": 7
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// The number of days to keep minutes for. Defaults to DefaultRetentionDays.
+	RetentionDays int `json:"retention_days"`
+	// Optional per-room settings which override the defaults.
+	Rooms map[id.RoomID]struct {
+		// The number of days to keep minutes for in this room.
+		RetentionDays int `json:"retention_days"`
+	} `json:"rooms"`
+	// The minutes of meetings in progress and past meetings. This is populated by Go-NEB.
+	Meetings []Meeting `json:"meetings"`
+	// The ID to give the next meeting. This is populated by Go-NEB.
+	NextID int `json:"next_id"`
+}
+
+// Register makes sure the retention settings are valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.RetentionDays < 0 {
+		return errors.New("retention_days cannot be negative")
+	}
+	for roomID, room := range s.Rooms {
+		if room.RetentionDays < 0 {
+			return fmt.Errorf("retention_days for room %s cannot be negative", roomID)
+		}
+	}
+	if oldMinutes, ok := oldService.(*Service); ok && len(s.Meetings) == 0 {
+		// Don't lose the minutes when the config is updated
+		s.Meetings, s.NextID = oldMinutes.Meetings, oldMinutes.NextID
+	}
+	return nil
+}
+
+func (s *Service) retention(roomID id.RoomID) time.Duration {
+	days := s.RetentionDays
+	if room, ok := s.Rooms[roomID]; ok && room.RetentionDays > 0 {
+		days = room.RetentionDays
+	}
+	if days == 0 {
+		days = DefaultRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Commands supported:
+//    !minutes start "Weekly sync"
+// Starts capturing messages in this room.
+//    !minutes stop
+// Stops capturing messages, posts a summary of the actions and decisions and uploads a log.
+//    !minutes list
+// Lists the minutes kept for this room.
+//    !minutes log 3
+// Uploads the log of a past meeting again.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"minutes", "start"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdStart(roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"minutes", "stop"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdStop(cli, roomID)
+			},
+		},
+		{
+			Path: []string{"minutes", "list"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdList(roomID)
+			},
+		},
+		{
+			Path: []string{"minutes", "log"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdLog(cli, roomID, args)
+			},
+		},
+		{
+			Path: []string{"minutes"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return notice(`Usage: !minutes start "title" | !minutes stop | !minutes list | !minutes log id`), nil
+			},
+		},
+	}
+}
+
+// Expansions captures every message in rooms with a meeting in progress. It never responds.
+func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
+	return []types.Expansion{
+		{
+			Regexp: anyMessageRegex,
+			Expand: func(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
+				if s.current(roomID) != nil {
+					s.capture(roomID, userID, matchingGroups[0])
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// current returns the meeting in progress in the room, or nil if there isn't one.
+func (s *Service) current(roomID id.RoomID) *Meeting {
+	for i := range s.Meetings {
+		if s.Meetings[i].RoomID == roomID && s.Meetings[i].EndTimestampSecs == 0 {
+			return &s.Meetings[i]
+		}
+	}
+	return nil
+}
+
+func (s *Service) find(roomID id.RoomID, meetingID string) *Meeting {
+	for i := range s.Meetings {
+		if s.Meetings[i].RoomID == roomID && s.Meetings[i].ID == meetingID {
+			return &s.Meetings[i]
+		}
+	}
+	return nil
+}
+
+func (s *Service) capture(roomID id.RoomID, userID id.UserID, body string) {
+	_, err := s.update(func(latest *Service) (interface{}, error) {
+		m := latest.current(roomID)
+		if m == nil || len(m.Entries) >= maxEntries {
+			return nil, nil
+		}
+		m.Entries = append(m.Entries, Entry{userID, time.Now().Unix(), body})
+		return nil, nil
+	})
+	if err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("Failed to capture message for minutes")
+	}
+}
+
+func (s *Service) cmdStart(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	title := strings.Join(args, " ")
+	if title == "" {
+		title = "Meeting"
+	}
+	return s.update(func(latest *Service) (interface{}, error) {
+		if m := latest.current(roomID); m != nil {
+			return nil, fmt.Errorf("%q is already being minuted. Use !minutes stop to finish it", m.Title)
+		}
+		latest.NextID++
+		latest.Meetings = append(latest.Meetings, Meeting{
+			ID:                 strconv.Itoa(latest.NextID),
+			RoomID:             roomID,
+			Title:              title,
+			StartedBy:          userID,
+			StartTimestampSecs: time.Now().Unix(),
+		})
+		return notice(fmt.Sprintf("Taking minutes for %q. Mark messages with #action or #decision to include them in the summary. Use !minutes stop to finish.", title)), nil
+	})
+}
+
+func (s *Service) cmdStop(cli types.MatrixClient, roomID id.RoomID) (interface{}, error) {
+	var meeting Meeting
+	_, err := s.update(func(latest *Service) (interface{}, error) {
+		m := latest.current(roomID)
+		if m == nil {
+			return nil, errors.New("No meeting is being minuted in this room")
+		}
+		m.EndTimestampSecs = time.Now().Unix()
+		meeting = *m
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	loc := utils.RoomLocation(s.ServiceUserID(), roomID)
+	if _, err := cli.SendMessageEvent(roomID, mevt.EventMessage, summary(meeting, loc)); err != nil {
+		return nil, fmt.Errorf("Failed to send the summary: %s", err)
+	}
+	return uploadLog(cli, meeting, loc)
+}
+
+func (s *Service) cmdList(roomID id.RoomID) (interface{}, error) {
+	loc := utils.RoomLocation(s.ServiceUserID(), roomID)
+	var buf bytes.Buffer
+	for _, m := range s.Meetings {
+		if m.RoomID != roomID {
+			continue
+		}
+		status := "in progress"
+		if m.EndTimestampSecs != 0 {
+			status = fmt.Sprintf("%d messages", len(m.Entries))
+		}
+		buf.WriteString(fmt.Sprintf("%s: %q on %s (%s)\n", m.ID, m.Title,
+			time.Unix(m.StartTimestampSecs, 0).In(loc).Format("Mon, 02 Jan 2006 15:04 MST"), status))
+	}
+	if buf.Len() == 0 {
+		return notice("There are no minutes for this room."), nil
+	}
+	return notice(fmt.Sprintf("%sMinutes are kept for %s.", buf.String(), utils.HumanDuration(s.retention(roomID)))), nil
+}
+
+func (s *Service) cmdLog(cli types.MatrixClient, roomID id.RoomID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return notice("Usage: !minutes log id"), nil
+	}
+	m := s.find(roomID, args[0])
+	if m == nil || m.EndTimestampSecs == 0 {
+		return nil, errors.New("There are no finished minutes " + args[0] + " in this room")
+	}
+	return uploadLog(cli, *m, utils.RoomLocation(s.ServiceUserID(), roomID))
+}
+
+// summary returns an HTML message listing the decisions and actions from the meeting.
+func summary(m Meeting, loc *time.Location) mevt.MessageEventContent {
+	var decisions, actions []string
+	participants := make(map[id.UserID]bool)
+	for _, e := range m.Entries {
+		participants[e.UserID] = true
+		for _, marker := range markerRegex.FindAllStringSubmatch(e.Body, -1) {
+			item := fmt.Sprintf("<li>%s (%s)</li>", html.EscapeString(strings.TrimSpace(markerRegex.ReplaceAllString(e.Body, ""))), html.EscapeString(string(e.UserID)))
+			if strings.EqualFold(marker[1], "action") {
+				actions = append(actions, item)
+			} else {
+				decisions = append(decisions, item)
+			}
+			break // a message marked as both is listed under its first marker
+		}
+	}
+	start := time.Unix(m.StartTimestampSecs, 0).In(loc)
+	htmlBody := fmt.Sprintf("<strong>Minutes: %s</strong><br>%s, %s, %d messages from %d participants",
+		html.EscapeString(m.Title), start.Format("Mon, 02 Jan 2006 15:04 MST"),
+		utils.HumanDuration(time.Duration(m.EndTimestampSecs-m.StartTimestampSecs)*time.Second),
+		len(m.Entries), len(participants))
+	htmlBody += section("Decisions", decisions) + section("Actions", actions)
+	return utils.StrippedHTMLMessage(mevt.MsgNotice, htmlBody)
+}
+
+func section(heading string, items []string) string {
+	if len(items) == 0 {
+		return "<br><em>No " + strings.ToLower(heading) + "</em>"
+	}
+	return "<br><strong>" + heading + "</strong><ul>" + strings.Join(items, "") + "</ul>"
+}
+
+// uploadLog uploads the full log of the meeting and returns an m.file message for it.
+func uploadLog(cli types.MatrixClient, m Meeting, loc *time.Location) (interface{}, error) {
+	start := time.Unix(m.StartTimestampSecs, 0).In(loc)
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("Minutes: %s\nStarted by %s on %s\n\n", m.Title, m.StartedBy, start.Format("Mon, 02 Jan 2006 15:04 MST")))
+	for _, e := range m.Entries {
+		buf.WriteString(fmt.Sprintf("[%s] %s: %s\n", time.Unix(e.TimestampSecs, 0).In(loc).Format("15:04"), e.UserID, e.Body))
+	}
+	fileName := fmt.Sprintf("minutes-%s-%s.txt", strings.Trim(slugRegex.ReplaceAllString(strings.ToLower(m.Title), "-"), "-"), start.Format("2006-01-02"))
+	resp, err := cli.UploadBytesWithName(buf.Bytes(), "text/plain", fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to upload the log: %s", err)
+	}
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgFile,
+		Body:    fileName,
+		URL:     resp.ContentURI.CUString(),
+		Info: &mevt.FileInfo{
+			MimeType: "text/plain",
+			Size:     buf.Len(),
+		},
+	}, nil
+}
+
+// update applies fn to the latest copy of the service, see polling.Update.
+func (s *Service) update(fn func(latest *Service) (interface{}, error)) (interface{}, error) {
+	return polling.Update(s, false, func(latest types.Service) (interface{}, error) {
+		return fn(latest.(*Service))
+	})
+}
+
+// OnPoll deletes finished minutes which have passed their room's retention period.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	now := time.Now()
+	_, err := s.update(func(latest *Service) (interface{}, error) {
+		var kept []Meeting
+		for _, m := range latest.Meetings {
+			if m.EndTimestampSecs == 0 || now.Sub(time.Unix(m.EndTimestampSecs, 0)) < latest.retention(m.RoomID) {
+				kept = append(kept, m)
+			}
+		}
+		latest.Meetings = kept
+		return nil, nil
+	})
+	if err != nil {
+		log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to prune minutes")
+	}
+	return now.Add(pruneInterval)
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
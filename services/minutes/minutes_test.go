@@ -0,0 +1,137 @@
+package minutes
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const roomID = id.RoomID("!kitchen:hyrule")
+
+func TestMinutes(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	var sent []mevt.MessageEventContent
+	var uploaded string
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/upload") {
+			if !strings.HasPrefix(req.URL.Query().Get("filename"), "minutes-weekly-sync-") {
+				t.Errorf("Bad upload filename: %s", req.URL.Query().Get("filename"))
+			}
+			b, _ := ioutil.ReadAll(req.Body)
+			uploaded = string(b)
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://hyrule/log"}`)),
+			}, nil
+		}
+		var content mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			t.Fatal("Failed to decode message: ", err)
+		}
+		sent = append(sent, content)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup"}`)),
+		}, nil
+	})
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+	expand := s.Expansions(cli)[0]
+	say := func(userID id.UserID, body string) {
+		if expand.Regexp.MatchString(body) {
+			expand.Expand(roomID, userID, expand.Regexp.FindStringSubmatch(body))
+		}
+	}
+
+	say("@link:hyrule", "not captured")
+	if _, err := s.cmdStop(cli, roomID); err == nil {
+		t.Error("Expected an error stopping a meeting which hasn't started")
+	}
+	if _, err := s.cmdStart(roomID, "@link:hyrule", []string{"Weekly", "sync"}); err != nil {
+		t.Fatal("Failed to start meeting: ", err)
+	}
+	if _, err := s.cmdStart(roomID, "@link:hyrule", nil); err == nil {
+		t.Error("Expected an error starting a second meeting in the room")
+	}
+	say("@link:hyrule", "Hello")
+	say("@zelda:hyrule", "We will use <b>the master sword</b> #DECISION")
+	say("@link:hyrule", "#action find the master sword")
+
+	content, err := s.cmdStop(cli, roomID)
+	if err != nil {
+		t.Fatal("Failed to stop meeting: ", err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("Expected a summary to be sent, got %d messages", len(sent))
+	}
+	summary := sent[0].FormattedBody
+	for _, want := range []string{
+		"<strong>Minutes: Weekly sync</strong>",
+		"3 messages from 2 participants",
+		"<strong>Decisions</strong><ul><li>We will use &lt;b&gt;the master sword&lt;/b&gt; (@zelda:hyrule)</li></ul>",
+		"<strong>Actions</strong><ul><li>find the master sword (@link:hyrule)</li></ul>",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("Expected summary to contain %q, got %q", want, summary)
+		}
+	}
+	file := content.(mevt.MessageEventContent)
+	if file.MsgType != mevt.MsgFile || file.URL != "mxc://hyrule/log" {
+		t.Errorf("Bad log file message: %+v", file)
+	}
+	if !strings.Contains(uploaded, "@zelda:hyrule: We will use <b>the master sword</b> #DECISION\n") || strings.Contains(uploaded, "not captured") {
+		t.Errorf("Bad log file: %s", uploaded)
+	}
+
+	say("@link:hyrule", "not captured either")
+	if len(s.Meetings) != 1 || len(s.Meetings[0].Entries) != 3 {
+		t.Errorf("Expected messages after the meeting not to be captured, got %+v", s.Meetings)
+	}
+}
+
+func TestOnPoll(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	now := time.Now()
+	ended := func(days int) int64 { return now.Add(-time.Duration(days) * 24 * time.Hour).Unix() }
+	s := &Service{
+		DefaultService: types.NewDefaultService("id", "@neb:hyrule", ServiceType),
+		Meetings: []Meeting{
+			{ID: "1", RoomID: roomID, EndTimestampSecs: ended(40)},
+			{ID: "2", RoomID: roomID, EndTimestampSecs: ended(20)},
+			{ID: "3", RoomID: "!short:hyrule", EndTimestampSecs: ended(10)},
+			{ID: "4", RoomID: "!short:hyrule", StartTimestampSecs: ended(10)},
+		},
+	}
+	s.Rooms = map[id.RoomID]struct {
+		RetentionDays int `json:"retention_days"`
+	}{"!short:hyrule": {RetentionDays: 7}}
+
+	next := s.OnPoll(nil)
+	var kept []string
+	for _, m := range s.Meetings {
+		kept = append(kept, m.ID)
+	}
+	if strings.Join(kept, ",") != "2,4" {
+		t.Errorf("Expected meetings 2 and 4 to be kept, got %v", kept)
+	}
+	if next.Before(now.Add(pruneInterval)) {
+		t.Errorf("Expected to be polled again in an hour, got %s", next)
+	}
+}
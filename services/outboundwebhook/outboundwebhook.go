@@ -0,0 +1,266 @@
+// Package outboundwebhook implements a Service which forwards room messages to an HTTP endpoint.
+package outboundwebhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Outbound Webhook service
+const ServiceType = "outboundwebhook"
+
+// SignatureHeader is the header holding the HMAC-SHA256 signature of the request body.
+const SignatureHeader = "X-Go-NEB-Signature"
+
+var anyMessageRegex = regexp.MustCompile(`(?s)^.+$`)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Service contains the Config fields for the Outbound Webhook Service.
+//
+// Messages in the configured rooms are POSTed as JSON to the URL, which lets chat-ops
+// pipelines act on them. Each room can forward !commands, messages matching regular
+// expressions, or, if neither is configured, every message. If a secret is configured,
+// requests are signed with an HMAC-SHA256 of the body, which is sent hex encoded in the
+// X-Go-NEB-Signature header as "sha256=<signature>".
+//
+// The request body looks like:
+//   {
+//       "room_id": "!qmElAGdFYCHoCJuaNt:localhost",
+//       "sender": "@alice:localhost",
+//       "body": "!deploy api production",
+//       "command": "deploy",
+//       "args": ["api", "production"],
+//       "timestamp": 1625140800000
+//   }
+// "matches" holds the groups of the regular expression which matched, instead of "command"
+// and "args", for messages matching a pattern. If the endpoint responds to a !command with
+// a JSON object containing a "body" string, it is sent into the room as a notice.
+//
+// Example request:
+//   {
+//       "url": "https://ci.example.com/hooks/matrix",
+//       "secret": "a long random string",
+//       "rooms": {
+//           "!qmElAGdFYCHoCJuaNt:localhost": {
+//               "commands": ["deploy", "rollback"],
+//               "patterns": ["(?i)\\bincident\\b"]
+//           },
+//           "!wfEDRAwRuaNtPdlgNt:localhost": {}
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// The URL to POST messages to. Required.
+	URL string `json:"url"`
+	// An optional secret used to sign requests.
+	Secret string `json:"secret"`
+	// A map of room ID to the messages to forward from that room.
+	Rooms map[id.RoomID]struct {
+		// The !commands to forward, without the "!".
+		Commands []string `json:"commands"`
+		// Regular expressions matching messages to forward.
+		Patterns []string `json:"patterns"`
+	} `json:"rooms"`
+}
+
+// Payload is the JSON body POSTed to the URL.
+type Payload struct {
+	RoomID    id.RoomID `json:"room_id"`
+	Sender    id.UserID `json:"sender"`
+	Body      string    `json:"body"`
+	Command   string    `json:"command,omitempty"`
+	Args      []string  `json:"args,omitempty"`
+	Matches   []string  `json:"matches,omitempty"`
+	Timestamp int64     `json:"timestamp"`
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("url must be an http or https URL")
+	}
+	if len(s.Rooms) == 0 {
+		return errors.New("At least one room is required")
+	}
+	for roomID, room := range s.Rooms {
+		for _, pattern := range room.Patterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("pattern %q for room %s is invalid: %s", pattern, roomID, err)
+			}
+		}
+		for _, command := range room.Commands {
+			if command == "" || strings.ContainsAny(command, " !") {
+				return fmt.Errorf("command %q for room %s is invalid", command, roomID)
+			}
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+// Commands forwards each configured !command in the rooms it is configured for.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	seen := make(map[string]bool)
+	var cmds []types.Command
+	for _, room := range s.Rooms {
+		for _, command := range room.Commands {
+			if seen[command] {
+				continue
+			}
+			seen[command] = true
+			command := command
+			cmds = append(cmds, types.Command{
+				Path: []string{command},
+				Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+					return s.forwardCommand(roomID, userID, command, args)
+				},
+			})
+		}
+	}
+	return cmds
+}
+
+// Expansions forwards messages matching the configured patterns, or every message in rooms
+// with no commands or patterns.
+func (s *Service) Expansions(cli types.MatrixClient) []types.Expansion {
+	return []types.Expansion{
+		{
+			Regexp: anyMessageRegex,
+			Expand: func(roomID id.RoomID, userID id.UserID, matchingGroups []string) interface{} {
+				if matches := s.match(roomID, matchingGroups[0]); matches != nil {
+					go s.post(Payload{
+						RoomID:  roomID,
+						Sender:  userID,
+						Body:    matchingGroups[0],
+						Matches: matches,
+					})
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// match returns the groups of the first pattern in the room which matches body, or nil if the
+// message shouldn't be forwarded.
+func (s *Service) match(roomID id.RoomID, body string) []string {
+	room, ok := s.Rooms[roomID]
+	if !ok {
+		return nil
+	}
+	if len(room.Patterns) == 0 && len(room.Commands) == 0 {
+		return []string{body}
+	}
+	for _, pattern := range room.Patterns {
+		// Patterns were validated when the service was registered
+		if m := regexp.MustCompile(pattern).FindStringSubmatch(body); m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *Service) forwardCommand(roomID id.RoomID, userID id.UserID, command string, args []string) (interface{}, error) {
+	room, ok := s.Rooms[roomID]
+	if !ok || !contains(room.Commands, command) {
+		return nil, nil
+	}
+	respBody, err := s.post(Payload{
+		RoomID:  roomID,
+		Sender:  userID,
+		Body:    strings.TrimSpace("!" + command + " " + strings.Join(args, " ")),
+		Command: command,
+		Args:    args,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to forward !%s", command)
+	}
+	var reply struct {
+		Body string `json:"body"`
+	}
+	if json.Unmarshal(respBody, &reply) != nil || reply.Body == "" {
+		return nil, nil
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    reply.Body,
+	}, nil
+}
+
+// post sends the payload to the URL and returns the response body.
+func (s *Service) post(p Payload) ([]byte, error) {
+	p.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	logger := log.WithFields(log.Fields{"service_id": s.ServiceID(), "room_id": p.RoomID})
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+sign(s.Secret, body))
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		logger.WithError(err).Error("Failed to forward message")
+		return nil, err
+	}
+	defer res.Body.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(res.Body); err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		logger.WithField("status", res.StatusCode).Error("Failed to forward message")
+		return nil, fmt.Errorf("request returned HTTP %d", res.StatusCode)
+	}
+	return buf.Bytes(), nil
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
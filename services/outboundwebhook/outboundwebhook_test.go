@@ -0,0 +1,105 @@
+package outboundwebhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestForward(t *testing.T) {
+	posted := make(chan Payload, 10)
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.URL.String() != "https://ci.hyrule/hook" {
+			t.Errorf("Bad URL: %s", req.URL)
+		}
+		if got, want := req.Header.Get(SignatureHeader), "sha256="+sign("sekrit", body); got != want {
+			t.Errorf("Bad signature: got %s want %s", got, want)
+		}
+		var p Payload
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Fatal("Failed to decode payload: ", err)
+		}
+		posted <- p
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"body":"Deploying api"}`)),
+		}, nil
+	})}
+	defer func() { httpClient = &http.Client{} }()
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"url": "https://ci.hyrule/hook",
+		"secret": "sekrit",
+		"rooms": {
+			"!ops:hyrule": {"commands": ["deploy"], "patterns": ["(?i)incident (\\w+)"]},
+			"!all:hyrule": {}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+
+	cmds := s.Commands(nil)
+	if len(cmds) != 1 || cmds[0].Path[0] != "deploy" {
+		t.Fatalf("Expected a !deploy command, got %+v", cmds)
+	}
+	content, err := cmds[0].Command("!ops:hyrule", "@link:hyrule", []string{"api"})
+	if err != nil {
+		t.Fatal("!deploy failed: ", err)
+	}
+	if body := content.(*mevt.MessageEventContent).Body; body != "Deploying api" {
+		t.Errorf("Expected the response to be relayed, got %q", body)
+	}
+	if p := <-posted; p.Command != "deploy" || strings.Join(p.Args, " ") != "api" || p.Body != "!deploy api" || p.Timestamp == 0 {
+		t.Errorf("Bad command payload: %+v", p)
+	}
+	if content, _ := cmds[0].Command("!all:hyrule", "@link:hyrule", nil); content != nil || len(posted) != 0 {
+		t.Error("Expected commands not to be forwarded from rooms they aren't configured for")
+	}
+
+	expand := s.Expansions(nil)[0]
+	for _, m := range []struct {
+		roomID id.RoomID
+		body   string
+	}{{"!ops:hyrule", "just chatting"}, {"!ops:hyrule", "Incident db1 is down"}, {"!all:hyrule", "hello"}, {"!other:hyrule", "hi"}} {
+		expand.Expand(m.roomID, "@link:hyrule", expand.Regexp.FindStringSubmatch(m.body))
+	}
+	got := map[id.RoomID]Payload{}
+	for i := 0; i < 2; i++ {
+		p := <-posted
+		got[p.RoomID] = p
+	}
+	if p := got["!ops:hyrule"]; p.Body != "Incident db1 is down" || strings.Join(p.Matches, ",") != "Incident db1,db1" {
+		t.Errorf("Bad pattern payload: %+v", p)
+	}
+	if p := got["!all:hyrule"]; p.Body != "hello" || p.Sender != "@link:hyrule" {
+		t.Errorf("Bad message payload: %+v", p)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, config := range []string{
+		`{"url":"ftp://x","rooms":{"!a:hs":{}}}`,
+		`{"url":"https://x","rooms":{}}`,
+		`{"url":"https://x","rooms":{"!a:hs":{"patterns":["("]}}}`,
+		`{"url":"https://x","rooms":{"!a:hs":{"commands":["!deploy"]}}}`,
+	} {
+		srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.Register(nil, nil); err == nil {
+			t.Errorf("Expected an error registering %s", config)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+// Package remindme implements a Service which reminds users about things at a given time.
+package remindme
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Remind Me service
+const ServiceType = "remindme"
+
+// The shortest interval between repeats of a recurring reminder.
+const minInterval = time.Minute
+
+// How late a reminder can fire, e.g. because Go-NEB was down, before saying it is late.
+const lateThreshold = 5 * time.Minute
+
+// Reminder is a message to send to a user at a given time.
+type Reminder struct {
+	ID      string    `json:"id"`
+	RoomID  id.RoomID `json:"room_id"`
+	UserID  id.UserID `json:"user_id"`
+	Message string    `json:"message"`
+	// When the reminder is due.
+	AtTimestampSecs int64 `json:"at_ts_secs"`
+	// The interval between repeats, or 0 if the reminder doesn't repeat.
+	EverySecs int64 `json:"every_secs,omitempty"`
+	// True if the reminder was set in a direct chat with the bot, so doesn't mention the user.
+	Direct bool `json:"direct,omitempty"`
+}
+
+// Service contains the Config fields for the Remind Me Service. It has no Config fields which
+// need to be set: reminders are added with !remind and stored as part of the service.
+//
+// Example request:
+//   {
+//   }
+type Service struct {
+	types.DefaultService
+	// The pending reminders. This is populated by Go-NEB.
+	Reminders []Reminder `json:"reminders"`
+	// The ID to give the next new reminder. This is populated by Go-NEB.
+	NextID int `json:"next_id"`
+}
+
+// Commands supported:
+//    !remind 2h30m check the oven
+//    !remind tomorrow at 9am call the bank
+//    !remind every friday 16:00 submit timesheet
+// Reminds the user in this room at the given time. See utils.ParseTime for the time formats.
+// Times are in the room's "timezone" bot option, or UTC if there isn't one.
+//    !remind list
+// Lists the user's reminders in this room.
+//    !remind cancel 3
+// Cancels one of the user's reminders.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return s.commands(false)
+}
+
+// DirectChatCommands are the same commands for a direct chat with the bot, where reminders are
+// personal: they don't mention the user, and !remind list and !remind cancel cover the user's
+// reminders in every room.
+func (s *Service) DirectChatCommands(cli types.MatrixClient, userID id.UserID) []types.Command {
+	return s.commands(true)
+}
+
+func (s *Service) commands(direct bool) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"remind", "list"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdList(roomID, userID, direct)
+			},
+		},
+		{
+			Path: []string{"remind", "cancel"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdCancel(roomID, userID, args, direct)
+			},
+		},
+		{
+			Path: []string{"remind"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdRemind(roomID, userID, args, direct)
+			},
+		},
+	}
+}
+
+func usageMessage() *mevt.MessageEventContent {
+	return notice("Usage: !remind 2h30m check the oven | !remind tomorrow at 9am message | !remind list | !remind cancel id")
+}
+
+func (s *Service) cmdRemind(roomID id.RoomID, userID id.UserID, args []string, direct bool) (interface{}, error) {
+	if len(args) == 0 {
+		return usageMessage(), nil
+	}
+	now := time.Now()
+	pt, rest, err := utils.ParseTime(args, now, utils.RoomLocation(s.ServiceUserID(), roomID))
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) == 0 {
+		return nil, errors.New("What should I remind you about? e.g. !remind 2h30m check the oven")
+	}
+	if !pt.At.After(now) {
+		return nil, errors.New("That time is in the past")
+	}
+	if pt.Every > 0 && pt.Every < minInterval {
+		return nil, fmt.Errorf("Reminders can repeat at most every %s", utils.HumanDuration(minInterval))
+	}
+	r := Reminder{
+		RoomID:          roomID,
+		UserID:          userID,
+		Message:         strings.Join(rest, " "),
+		AtTimestampSecs: pt.At.Unix(),
+		EverySecs:       int64(pt.Every / time.Second),
+		Direct:          direct,
+	}
+	return s.update(func(latest *Service) (interface{}, error) {
+		latest.NextID++
+		r.ID = strconv.Itoa(latest.NextID)
+		latest.Reminders = append(latest.Reminders, r)
+		return notice(fmt.Sprintf("Reminder %s set for %s.", r.ID, pt.Describe(now))), nil
+	})
+}
+
+// cmdList lists the user's reminders in the room, or in every room if it is a direct chat.
+func (s *Service) cmdList(roomID id.RoomID, userID id.UserID, direct bool) (interface{}, error) {
+	now := time.Now()
+	loc := utils.RoomLocation(s.ServiceUserID(), roomID)
+	var buf bytes.Buffer
+	for _, r := range s.Reminders {
+		if !r.belongsTo(roomID, userID, direct) {
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("%s: %q at %s", r.ID, r.Message, r.parsedTime(loc).Describe(now)))
+		if r.RoomID != roomID {
+			buf.WriteString(" in " + string(r.RoomID))
+		}
+		buf.WriteString("\n")
+	}
+	if buf.Len() == 0 && direct {
+		return notice("You have no reminders."), nil
+	} else if buf.Len() == 0 {
+		return notice("You have no reminders in this room."), nil
+	}
+	return notice(strings.TrimSuffix(buf.String(), "\n")), nil
+}
+
+// cmdCancel cancels one of the user's reminders in the room, or in any room if it is a direct chat.
+func (s *Service) cmdCancel(roomID id.RoomID, userID id.UserID, args []string, direct bool) (interface{}, error) {
+	if len(args) != 1 {
+		return usageMessage(), nil
+	}
+	return s.update(func(latest *Service) (interface{}, error) {
+		for i, r := range latest.Reminders {
+			if r.ID == args[0] && r.belongsTo(roomID, userID, direct) {
+				latest.Reminders = append(latest.Reminders[:i], latest.Reminders[i+1:]...)
+				return notice("Cancelled reminder " + r.ID + "."), nil
+			}
+		}
+		if direct {
+			return nil, errors.New("You have no reminder " + args[0])
+		}
+		return nil, errors.New("You have no reminder " + args[0] + " in this room")
+	})
+}
+
+// belongsTo returns true if the reminder is the user's and was set in the room, or in any room
+// if anyRoom is true.
+func (r *Reminder) belongsTo(roomID id.RoomID, userID id.UserID, anyRoom bool) bool {
+	return r.UserID == userID && (anyRoom || r.RoomID == roomID)
+}
+
+func (r *Reminder) parsedTime(loc *time.Location) utils.ParsedTime {
+	return utils.ParsedTime{
+		At:    time.Unix(r.AtTimestampSecs, 0).In(loc),
+		Every: time.Duration(r.EverySecs) * time.Second,
+	}
+}
+
+// update applies fn to the latest copy of the service, see polling.Update.
+func (s *Service) update(fn func(latest *Service) (interface{}, error)) (interface{}, error) {
+	return polling.Update(s, true, func(latest types.Service) (interface{}, error) {
+		return fn(latest.(*Service))
+	})
+}
+
+// OnPoll sends any reminders which are due. Reminders which were due whilst Go-NEB was down are
+// sent late rather than dropped. Returns the time the next reminder is due, or 0 if there are none.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	defer polling.Lock(s)()
+	latest := polling.Latest(s).(*Service)
+	s.Reminders, s.NextID = latest.Reminders, latest.NextID
+
+	now := time.Now()
+	sent := false
+	var remaining []Reminder
+	for _, r := range s.Reminders {
+		if r.AtTimestampSecs > now.Unix() {
+			remaining = append(remaining, r)
+			continue
+		}
+		s.send(cli, r, now)
+		sent = true
+		if r.EverySecs > 0 {
+			// Daily and weekly reminders stay at the same time of day in the room's time zone.
+			loc := utils.RoomLocation(s.ServiceUserID(), r.RoomID)
+			every := time.Duration(r.EverySecs) * time.Second
+			at := time.Unix(r.AtTimestampSecs, 0)
+			for !at.After(now) { // skip any repeats we missed
+				at = utils.NextRepeat(at, every, loc)
+			}
+			r.AtTimestampSecs = at.Unix()
+			remaining = append(remaining, r)
+		}
+	}
+	s.Reminders = remaining
+
+	if sent {
+		if _, err := database.GetServiceDB().StoreService(s); err != nil {
+			log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to persist reminders")
+			polling.ReportError(s, err)
+		}
+	}
+	return s.nextTimestamp()
+}
+
+// send reminds the user, mentioning them so that they are notified unless the reminder is in a
+// direct chat.
+func (s *Service) send(cli types.MatrixClient, r Reminder, now time.Time) {
+	late := ""
+	if due := time.Unix(r.AtTimestampSecs, 0); now.Sub(due) > lateThreshold {
+		late = fmt.Sprintf(" (this was due %s ago)", utils.HumanDuration(now.Sub(due)))
+	}
+	content := utils.StrippedHTMLMessage(mevt.MsgText, fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>: reminder: %s%s`,
+		html.EscapeString(string(r.UserID)), html.EscapeString(string(r.UserID)), html.EscapeString(r.Message), late))
+	if r.Direct {
+		content = mevt.MessageEventContent{MsgType: mevt.MsgText, Body: "Reminder: " + r.Message + late}
+	}
+	if _, err := cli.SendMessageEvent(r.RoomID, mevt.EventMessage, content); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"room_id":     r.RoomID,
+			"reminder_id": r.ID,
+		}).Error("Failed to send reminder")
+		polling.ReportError(s, fmt.Errorf("reminder %s: %s", r.ID, err))
+	}
+}
+
+func (s *Service) nextTimestamp() time.Time {
+	var earliest int64
+	for _, r := range s.Reminders {
+		if earliest == 0 || r.AtTimestampSecs < earliest {
+			earliest = r.AtTimestampSecs
+		}
+	}
+	return time.Unix(earliest, 0)
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
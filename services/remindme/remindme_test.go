@@ -0,0 +1,215 @@
+package remindme
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	roomID = id.RoomID("!kitchen:hyrule")
+	userID = id.UserID("@link:hyrule")
+)
+
+func TestCommands(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+	body := func(content interface{}, err error) string {
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		return content.(*mevt.MessageEventContent).Body
+	}
+
+	before := time.Now()
+	if got := body(s.cmdRemind(roomID, userID, strings.Fields("2h30m check the oven"), false)); !strings.HasPrefix(got, "Reminder 1 set for") {
+		t.Errorf("Unexpected response: %s", got)
+	}
+	if len(s.Reminders) != 1 {
+		t.Fatalf("Expected 1 reminder, got %d", len(s.Reminders))
+	}
+	r := s.Reminders[0]
+	if r.Message != "check the oven" || r.UserID != userID || r.RoomID != roomID {
+		t.Errorf("Bad reminder: %+v", r)
+	}
+	if want := before.Add(150 * time.Minute).Unix(); r.AtTimestampSecs < want || r.AtTimestampSecs > want+5 {
+		t.Errorf("Bad reminder time: want about %d, got %d", want, r.AtTimestampSecs)
+	}
+
+	for _, input := range []string{"check the oven", "2h30m", "every 10 seconds drink water"} {
+		if _, err := s.cmdRemind(roomID, userID, strings.Fields(input), false); err == nil {
+			t.Errorf("!remind %s: expected an error", input)
+		}
+	}
+
+	if got := body(s.cmdList(roomID, userID, false)); !strings.HasPrefix(got, `1: "check the oven" at `) {
+		t.Errorf("Unexpected list: %s", got)
+	}
+	if got := body(s.cmdList(roomID, "@zelda:hyrule", false)); got != "You have no reminders in this room." {
+		t.Errorf("Expected other users' reminders to be hidden, got %s", got)
+	}
+	if _, err := s.cmdCancel(roomID, "@zelda:hyrule", []string{"1"}, false); err == nil {
+		t.Error("Expected other users to be unable to cancel the reminder")
+	}
+	if got := body(s.cmdCancel(roomID, userID, []string{"1"}, false)); got != "Cancelled reminder 1." {
+		t.Errorf("Unexpected response: %s", got)
+	}
+	if len(s.Reminders) != 0 {
+		t.Errorf("Expected no reminders, got %d", len(s.Reminders))
+	}
+}
+
+func TestDirectChatCommands(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+	run := func(cmds []types.Command, roomID id.RoomID, input string) string {
+		args := strings.Fields(input)
+		for _, cmd := range cmds {
+			if cmd.Matches(args) {
+				content, err := cmd.Command(roomID, userID, args[len(cmd.Path):])
+				if err != nil {
+					return err.Error()
+				}
+				return content.(*mevt.MessageEventContent).Body
+			}
+		}
+		t.Fatalf("No command matched %q", input)
+		return ""
+	}
+	const dmRoomID = id.RoomID("!dm:hyrule")
+	direct := s.DirectChatCommands(nil, userID)
+
+	run(s.Commands(nil), roomID, "remind 2h30m check the oven")
+	run(direct, dmRoomID, "remind 1h call the bank")
+	if len(s.Reminders) != 2 || s.Reminders[0].Direct || !s.Reminders[1].Direct {
+		t.Fatalf("Expected only the reminder set in the direct chat to be direct, got %+v", s.Reminders)
+	}
+
+	// The direct chat covers the user's reminders in every room
+	list := run(direct, dmRoomID, "remind list")
+	if !strings.Contains(list, `1: "check the oven"`) || !strings.Contains(list, "in "+string(roomID)) ||
+		!strings.Contains(list, `2: "call the bank"`) {
+		t.Errorf("Expected the direct chat to list every reminder, got %s", list)
+	}
+	if got := run(s.Commands(nil), roomID, "remind cancel 2"); got != "You have no reminder 2 in this room" {
+		t.Errorf("Expected the group room to only cancel its own reminders, got %s", got)
+	}
+	if got := run(direct, dmRoomID, "remind cancel 1"); got != "Cancelled reminder 1." {
+		t.Errorf("Expected the direct chat to cancel reminders in other rooms, got %s", got)
+	}
+}
+
+func TestOnPoll(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	var sent []mevt.MessageEventContent
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var content mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			t.Fatal("Failed to decode message: ", err)
+		}
+		sent = append(sent, content)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup"}`)),
+		}, nil
+	})
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+
+	now := time.Now().Unix()
+	s := &Service{
+		DefaultService: types.NewDefaultService("id", "@neb:hyrule", ServiceType),
+		Reminders: []Reminder{
+			{ID: "1", RoomID: roomID, UserID: userID, Message: "check the oven", AtTimestampSecs: now - 1},
+			{ID: "2", RoomID: roomID, UserID: userID, Message: "weekly", AtTimestampSecs: now - 2*60*60, EverySecs: 7 * 24 * 60 * 60},
+			{ID: "3", RoomID: roomID, UserID: userID, Message: "later", AtTimestampSecs: now + 60*60},
+			{ID: "4", RoomID: "!dm:hyrule", UserID: userID, Message: "call the bank", AtTimestampSecs: now - 1, Direct: true},
+		},
+	}
+	next := s.OnPoll(cli)
+
+	if len(sent) != 3 {
+		t.Fatalf("Expected 3 reminders to be sent, got %d", len(sent))
+	}
+	if want := "@link:hyrule: reminder: check the oven"; sent[0].Body != want {
+		t.Errorf("Bad reminder: want %q, got %q", want, sent[0].Body)
+	}
+	if !strings.Contains(sent[0].FormattedBody, `href="https://matrix.to/#/@link:hyrule"`) {
+		t.Errorf("Expected reminder to mention the user, got %q", sent[0].FormattedBody)
+	}
+	if !strings.HasSuffix(sent[1].Body, "(this was due 2 hours ago)") {
+		t.Errorf("Expected late reminder to say so, got %q", sent[1].Body)
+	}
+	if sent[2].Body != "Reminder: call the bank" || sent[2].FormattedBody != "" {
+		t.Errorf("Expected a direct reminder not to mention the user, got %+v", sent[2])
+	}
+	if len(s.Reminders) != 2 || s.Reminders[0].ID != "2" || s.Reminders[0].AtTimestampSecs != now-2*60*60+7*24*60*60 {
+		t.Errorf("Expected the weekly reminder to be rescheduled, got %+v", s.Reminders)
+	}
+	if next.Unix() != now+60*60 {
+		t.Errorf("Expected to be polled again when the next reminder is due, got %s", next)
+	}
+}
+
+// timezoneStore gives every room the same time zone.
+type timezoneStore struct {
+	database.NopStorage
+	timezone string
+}
+
+func (s *timezoneStore) LoadBotOptions(userID id.UserID, roomID id.RoomID) (types.BotOptions, error) {
+	return types.BotOptions{Options: &types.BotOptionsContent{Timezone: s.timezone}}, nil
+}
+
+func TestOnPollDST(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("No time zone database available: ", err)
+	}
+	database.SetServiceDB(&timezoneStore{timezone: "Europe/London"})
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup"}`)),
+		}, nil
+	})
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+
+	// Due before the clocks went forward on 2016-03-27, so the repeats we missed cross many DST changes.
+	s := &Service{
+		DefaultService: types.NewDefaultService("id", "@neb:hyrule", ServiceType),
+		Reminders: []Reminder{
+			{ID: "1", RoomID: roomID, UserID: userID, Message: "daily", EverySecs: 24 * 60 * 60,
+				AtTimestampSecs: time.Date(2016, 3, 26, 9, 0, 0, 0, london).Unix()},
+		},
+	}
+	s.OnPoll(cli)
+
+	if len(s.Reminders) != 1 {
+		t.Fatalf("Expected the daily reminder to be rescheduled, got %+v", s.Reminders)
+	}
+	at := time.Unix(s.Reminders[0].AtTimestampSecs, 0).In(london)
+	if at.Hour() != 9 || at.Minute() != 0 || !at.After(time.Now()) {
+		t.Errorf("Expected the daily reminder to be due at the next 09:00 in London, got %s", at)
+	}
+}
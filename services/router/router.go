@@ -0,0 +1,71 @@
+// Package router implements a Service which labels rooms, so that notification services can
+// target labels rather than lists of room IDs.
+package router
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Router service
+const ServiceType = "router"
+
+// Service contains the Config fields for the Router Service.
+//
+// Services for the same user can then send into "label:backend-teams" instead of a room ID,
+// meaning every room with that label. When a team room is added or removed, only the labels
+// need to change rather than every service config. Rooms can also be labelled by giving them a
+// room tag, see utils.ResolveRooms.
+//
+// Example request:
+//   {
+//       "labels": {
+//           "backend-teams": ["!qmElAGdFYCHoCJuaNt:localhost", "!cBrPbzWazCtlkMNQSF:localhost"],
+//           "on-call": ["!aldkjfhwekjrhwea:localhost"]
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// A map from label to the rooms with that label. Rooms may be Spaces.
+	Labels map[string][]id.RoomID `json:"labels"`
+}
+
+// LabelledRooms returns the rooms with the given label.
+func (s *Service) LabelledRooms(label string) []id.RoomID {
+	return s.Labels[label]
+}
+
+// Register makes sure the labels are valid and joins the labelled rooms.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Labels) == 0 {
+		return errors.New("At least one label must be specified")
+	}
+	for label, roomIDs := range s.Labels {
+		if label == "" || strings.ContainsAny(label, " \t") {
+			return fmt.Errorf("Bad label %q: labels must not be empty or contain spaces", label)
+		}
+		for _, roomID := range roomIDs {
+			if utils.IsLabel(roomID) {
+				return fmt.Errorf("Label %s: labels cannot contain other labels", label)
+			}
+			if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+				log.WithError(err).WithField("room_id", roomID).Error("Failed to join room")
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package rssbot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Commands supported:
+//    !rss subscribe https://www.wired.com/feed/
+// Sends new items from the feed into this room.
+//    !rss unsubscribe https://www.wired.com/feed/
+// Stops sending items from the feed into this room.
+//    !rss list
+// Lists the feeds which send items into this room.
+//    !rss latest https://www.wired.com/feed/
+// Shows the most recent item in one of this room's feeds.
+// Subscribing and unsubscribing are privileged commands, see types.ACL.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:       []string{"rss", "subscribe"},
+			Privileged: true,
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdSubscribe(roomID, args)
+			},
+		},
+		{
+			Path:       []string{"rss", "unsubscribe"},
+			Privileged: true,
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdUnsubscribe(roomID, args)
+			},
+		},
+		{
+			Path: []string{"rss", "list"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdList(roomID)
+			},
+		},
+		{
+			Path: []string{"rss", "latest"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdLatest(roomID, args)
+			},
+		},
+		{
+			Path: []string{"rss"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return usageMessage(), nil
+			},
+		},
+	}
+}
+
+func usageMessage() *mevt.MessageEventContent {
+	return notice("Usage: !rss subscribe url | !rss unsubscribe url | !rss list | !rss latest url")
+}
+
+func (s *Service) cmdSubscribe(roomID id.RoomID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return usageMessage(), nil
+	}
+	feedURL, err := parseFeedURL(args[0])
+	if err != nil {
+		return nil, err
+	}
+	// Check the feed can be read before saving it
+	res := s.fetchFeed(context.Background(), feedURL, validators{})
+	feed, err := res.feed, res.err
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %s", feedURL, err)
+	}
+	return s.update(func(latest *Service) (interface{}, error) {
+		f := latest.Feeds[feedURL]
+		for _, r := range f.Rooms {
+			if r == roomID {
+				return notice("This room is already subscribed to " + feedURL), nil
+			}
+		}
+		// Feeds which haven't been polled send no items on their first poll, so the room isn't
+		// flooded with old items.
+		f.Rooms = append(f.Rooms, roomID)
+		if latest.Feeds == nil {
+			latest.Feeds = make(map[string]Feed)
+		}
+		latest.Feeds[feedURL] = f
+		title := feed.Title
+		if title == "" {
+			title = feedURL
+		}
+		return notice(fmt.Sprintf("Subscribed to %s. New items will be sent into this room.", title)), nil
+	})
+}
+
+func (s *Service) cmdUnsubscribe(roomID id.RoomID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return usageMessage(), nil
+	}
+	feedURL, err := parseFeedURL(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return s.update(func(latest *Service) (interface{}, error) {
+		f, ok := latest.Feeds[feedURL]
+		if ok {
+			for i, r := range f.Rooms {
+				if r != roomID {
+					continue
+				}
+				f.Rooms = append(f.Rooms[:i:i], f.Rooms[i+1:]...)
+				if len(f.Rooms) == 0 {
+					delete(latest.Feeds, feedURL)
+				} else {
+					latest.Feeds[feedURL] = f
+				}
+				return notice("Unsubscribed from " + feedURL), nil
+			}
+		}
+		return nil, errors.New("This room isn't subscribed to " + feedURL)
+	})
+}
+
+func (s *Service) cmdList(roomID id.RoomID) (interface{}, error) {
+	feedURLs := s.feedsFor(roomID)
+	if len(feedURLs) == 0 {
+		return notice("This room isn't subscribed to any feeds."), nil
+	}
+	var buf bytes.Buffer
+	for _, feedURL := range feedURLs {
+		buf.WriteString(feedURL)
+		if s.Feeds[feedURL].IsFailing {
+			buf.WriteString(" (failing)")
+		}
+		buf.WriteString("\n")
+	}
+	return notice(strings.TrimSuffix(buf.String(), "\n")), nil
+}
+
+func (s *Service) cmdLatest(roomID id.RoomID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return usageMessage(), nil
+	}
+	feedURL, err := parseFeedURL(args[0])
+	if err != nil {
+		return nil, err
+	}
+	// Only feeds the room is subscribed to, so the bot can't be used to fetch arbitrary URLs
+	subscribed := false
+	for _, u := range s.feedsFor(roomID) {
+		subscribed = subscribed || u == feedURL
+	}
+	if !subscribed {
+		return nil, errors.New("This room isn't subscribed to " + feedURL)
+	}
+	res := s.fetchFeed(context.Background(), feedURL, validators{})
+	feed, err := res.feed, res.err
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %s", feedURL, err)
+	}
+	ensureItemsHaveGUIDs(feed)
+	if len(feed.Items) == 0 || feed.Items[0] == nil {
+		return notice("There are no items in " + feedURL), nil
+	}
+	item := *feed.Items[0]
+	msg := itemToHTML(feed, item)
+	return &msg, nil
+}
+
+// feedsFor returns the URLs of the feeds which send items into the room, in order.
+func (s *Service) feedsFor(roomID id.RoomID) []string {
+	var feedURLs []string
+	for feedURL, f := range s.Feeds {
+		for _, r := range f.Rooms {
+			if r == roomID {
+				feedURLs = append(feedURLs, feedURL)
+				break
+			}
+		}
+	}
+	sort.Strings(feedURLs)
+	return feedURLs
+}
+
+func parseFeedURL(s string) (string, error) {
+	// Some clients send links wrapped in angle brackets
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "<"), ">")
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%s isn't an http or https URL", s)
+	}
+	return u.String(), nil
+}
+
+// update applies fn to the latest copy of the service, see polling.Update.
+func (s *Service) update(fn func(latest *Service) (interface{}, error)) (interface{}, error) {
+	return polling.Update(s, true, func(latest types.Service) (interface{}, error) {
+		return fn(latest.(*Service))
+	})
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
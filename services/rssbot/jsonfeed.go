@@ -0,0 +1,152 @@
+package rssbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// jsonFeed is a JSON Feed, version 1 or 1.1. See https://jsonfeed.org/version/1.1
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Description string           `json:"description"`
+	Icon        string           `json:"icon"`
+	Language    string           `json:"language"`
+	Author      *jsonFeedAuthor  `json:"author"`
+	Authors     []jsonFeedAuthor `json:"authors"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type jsonFeedItem struct {
+	// IDs should be strings, but some feeds use numbers.
+	ID            json.RawMessage  `json:"id"`
+	URL           string           `json:"url"`
+	Title         string           `json:"title"`
+	ContentHTML   string           `json:"content_html"`
+	ContentText   string           `json:"content_text"`
+	Summary       string           `json:"summary"`
+	Image         string           `json:"image"`
+	DatePublished string           `json:"date_published"`
+	DateModified  string           `json:"date_modified"`
+	Author        *jsonFeedAuthor  `json:"author"`
+	Authors       []jsonFeedAuthor `json:"authors"`
+	Tags          []string         `json:"tags"`
+	Attachments   []struct {
+		URL      string `json:"url"`
+		MimeType string `json:"mime_type"`
+		Size     int64  `json:"size_in_bytes"`
+	} `json:"attachments"`
+}
+
+// isJSONFeed returns true if the response looks like a JSON Feed rather than XML, going by its
+// Content-Type or, as servers often send feeds as text/plain, its first character.
+func isJSONFeed(contentType string, body []byte) bool {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if mediaType == "application/feed+json" || mediaType == "application/json" {
+			return true
+		}
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("{"))
+}
+
+// parseJSONFeed parses a JSON Feed into the structure gofeed returns for RSS and Atom feeds.
+func parseJSONFeed(body []byte) (*gofeed.Feed, error) {
+	var jf jsonFeed
+	if err := json.Unmarshal(body, &jf); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON Feed: %s", err)
+	}
+	if !strings.HasPrefix(jf.Version, "https://jsonfeed.org/version/") {
+		return nil, fmt.Errorf("failed to parse JSON Feed: unknown version %q", jf.Version)
+	}
+	feed := &gofeed.Feed{
+		Title:       jf.Title,
+		Description: jf.Description,
+		Link:        jf.HomePageURL,
+		FeedLink:    jf.FeedURL,
+		Language:    jf.Language,
+		Author:      jsonFeedPerson(jf.Author, jf.Authors),
+		FeedType:    "json",
+		FeedVersion: strings.TrimPrefix(jf.Version, "https://jsonfeed.org/version/"),
+	}
+	if jf.Icon != "" {
+		feed.Image = &gofeed.Image{URL: jf.Icon}
+	}
+	for _, ji := range jf.Items {
+		item := &gofeed.Item{
+			GUID:        jsonFeedID(ji.ID),
+			Title:       ji.Title,
+			Description: ji.Summary,
+			Content:     ji.ContentHTML,
+			Link:        ji.URL,
+			Published:   ji.DatePublished,
+			Updated:     ji.DateModified,
+			Author:      jsonFeedPerson(ji.Author, ji.Authors),
+			Categories:  ji.Tags,
+		}
+		if item.Author == nil {
+			// Items without authors are by the feed's author
+			item.Author = feed.Author
+		}
+		if item.Content == "" {
+			item.Content = ji.ContentText
+		}
+		if item.Description == "" {
+			item.Description = item.Content
+		}
+		item.PublishedParsed = parseJSONFeedDate(ji.DatePublished)
+		item.UpdatedParsed = parseJSONFeedDate(ji.DateModified)
+		if ji.Image != "" {
+			item.Image = &gofeed.Image{URL: ji.Image}
+		}
+		for _, a := range ji.Attachments {
+			item.Enclosures = append(item.Enclosures, &gofeed.Enclosure{
+				URL:    a.URL,
+				Type:   a.MimeType,
+				Length: fmt.Sprint(a.Size),
+			})
+		}
+		feed.Items = append(feed.Items, item)
+	}
+	return feed, nil
+}
+
+// jsonFeedID returns the item's ID as a string, whether it was a string or a number.
+func jsonFeedID(raw json.RawMessage) string {
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return id
+	}
+	return string(raw)
+}
+
+// jsonFeedPerson returns the first author, from the 1.1 "authors" list or the 1.0 "author".
+func jsonFeedPerson(author *jsonFeedAuthor, authors []jsonFeedAuthor) *gofeed.Person {
+	if len(authors) > 0 {
+		author = &authors[0]
+	}
+	if author == nil || author.Name == "" {
+		return nil
+	}
+	return &gofeed.Person{Name: author.Name}
+}
+
+func parseJSONFeedDate(date string) *time.Time {
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
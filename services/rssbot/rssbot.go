@@ -2,19 +2,23 @@
 package rssbot
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"html"
+	"io/ioutil"
 	"net/http"
+	"sort"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
-	"unicode"
 
 	"github.com/die-net/lrucache"
 	"github.com/gregjones/httpcache"
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/services/utils"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/mmcdole/gofeed"
 	"github.com/prometheus/client_golang/prometheus"
@@ -37,34 +41,19 @@ var (
 
 const minPollingIntervalSeconds = 60 * 5 // 5 min (News feeds can be genuinely spammy)
 
-// includeRules contains the rules for including or excluding a feed item. For the fields Author, Title
-// and Description in a feed item, there can be some words specified in the config that determine whether
-// the item will be displayed or not, depending on whether these words are included in that field.
-//
-//   - If specified in the `must_include` field, the feed item must include at least one word for each field
-//     that has been specified. This means that if some words have been specified for both Author and Title,
-//     both the Author and Title must contain at least one of their respective words or the item will be skipped.
-//   - If specified in the `must_not_include` field, the feed item fields must not contain any of the words
-//     that were specified for each field. This means that if some words have been specified for both Author
-//     and Title, if either of them includes at least one of their respective words, the item will be skipped,
-//     even in the case that the item matched the `must_include` rules.
-//
-//   In both cases, specifying an empty list for a field or not specifying anything causes the field to be ignored.
-//   The field being checked each time will be split into words (any non-alphanumeric character starts a new word)
-//   and they will be checked against the provided list.
-type includeRules struct {
-	// Author is a case-sensitive list of words that the author name must contain or not contain.
-	Author []string `json:"author"`
-	// Title is a case-sensitive list of words that the author name must contain or not contain.
-	Title []string `json:"title"`
-	// Description is a case-sensitive list of words that the author name must contain or not contain.
-	Description []string `json:"description"`
-}
+const (
+	defaultConcurrency     = 10
+	defaultFeedTimeoutSecs = 30
+	// Feeds which haven't been fetched by the end of a poll are left for the next one, so that
+	// polls finish promptly however many feeds are slow.
+	maxPollDuration = minPollingIntervalSeconds * time.Second
+)
 
 // Service contains the Config fields for this service.
 //
 // Example request:
 //   {
+//       concurrency: 20,
 //       feeds: {
 //           "http://rss.cnn.com/rss/edition.rss": {
 //                poll_interval_mins: 60,
@@ -78,28 +67,44 @@ type includeRules struct {
 type Service struct {
 	types.DefaultService
 	// Feeds is a map of feed URL to configuration options for this feed.
-	Feeds map[string]struct {
-		// Optional. The time to wait between polls. If this is less than minPollingIntervalSeconds, it is ignored.
-		PollIntervalMins int `json:"poll_interval_mins"`
-		// The list of rooms to send feed updates into. This cannot be empty.
-		Rooms []id.RoomID `json:"rooms"`
-		// True if rss bot is unable to poll this feed. This is populated by Go-NEB. Use /getService to
-		// retrieve this value.
-		IsFailing bool `json:"is_failing"`
-		// The time of the last successful poll. This is populated by Go-NEB. Use /getService to retrieve
-		// this value.
-		FeedUpdatedTimestampSecs int64 `json:"last_updated_ts_secs"`
-		// Specified fields must each include at least one of these words.
-		MustInclude includeRules `json:"must_include"`
-		// None of the specified fields must include any of these words.
-		MustNotInclude includeRules `json:"must_not_include"`
-		// Internal field. When we should poll again.
-		NextPollTimestampSecs int64
-		// Internal field. The most recently seen GUIDs. Sized to the number of items in the feed.
-		RecentGUIDs []string
-	} `json:"feeds"`
+	Feeds map[string]Feed `json:"feeds"`
+	// Optional. The number of feeds to fetch at once. Defaults to 10.
+	Concurrency int `json:"concurrency"`
+	// Optional. The number of seconds to wait for a feed before giving up on it until its next
+	// poll. Defaults to 30.
+	FeedTimeoutSecs int `json:"feed_timeout_secs"`
 }
 
+// Feed contains the configuration options for a feed.
+type Feed struct {
+	// Optional. The time to wait between polls. If this is less than minPollingIntervalSeconds, it is ignored.
+	PollIntervalMins int `json:"poll_interval_mins"`
+	// The list of rooms to send feed updates into. This cannot be empty. A room may be a Space,
+	// or a label such as "label:backend-teams", see utils.ResolveRooms.
+	Rooms []id.RoomID `json:"rooms"`
+	// True if rss bot is unable to poll this feed. This is populated by Go-NEB. Use /getService to
+	// retrieve this value.
+	IsFailing bool `json:"is_failing"`
+	// The time of the last successful poll. This is populated by Go-NEB. Use /getService to retrieve
+	// this value.
+	FeedUpdatedTimestampSecs int64 `json:"last_updated_ts_secs"`
+	// Specified fields must each include at least one of these words. See utils.IncludeRules.
+	MustInclude utils.IncludeRules `json:"must_include"`
+	// None of the specified fields must include any of these words.
+	MustNotInclude utils.IncludeRules `json:"must_not_include"`
+	// Internal field. When we should poll again.
+	NextPollTimestampSecs int64
+	// Internal field. The most recently seen GUIDs. Sized to the number of items in the feed.
+	RecentGUIDs []string
+	// Internal field. The ETag and Last-Modified headers of the feed when it was last fetched, which
+	// are sent back when polling so that the feed isn't downloaded again if it hasn't changed.
+	ETag         string
+	LastModified string
+}
+
+// errNotModified is the error when fetching a feed which hasn't changed since it was last fetched.
+var errNotModified = errors.New("feed not modified")
+
 // Register will check the liveness of each RSS feed given. If all feeds check out okay, no error is returned.
 func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
 	if len(s.Feeds) == 0 {
@@ -116,29 +121,48 @@ func (s *Service) Register(oldService types.Service, client types.MatrixClient)
 		}
 		return nil
 	}
-	// Make sure we can parse the feed
+	if s.Concurrency < 0 || s.FeedTimeoutSecs < 0 {
+		return errors.New("concurrency and feed_timeout_secs can't be negative")
+	}
+	var feedURLs []string
 	for feedURL, feedInfo := range s.Feeds {
-		if _, err := readFeed(feedURL); err != nil {
-			return fmt.Errorf("Failed to read URL %s: %s", feedURL, err.Error())
-		}
 		if len(feedInfo.Rooms) == 0 {
 			return fmt.Errorf("Feed %s has no rooms to send updates to", feedURL)
 		}
+		feedURLs = append(feedURLs, feedURL)
+	}
+	// Make sure we can parse the feeds
+	sort.Strings(feedURLs)
+	for i, res := range s.fetchFeeds(context.Background(), feedURLs, false) {
+		if res.err != nil {
+			return fmt.Errorf("Failed to read URL %s: %s", feedURLs[i], res.err.Error())
+		}
 	}
 
 	s.joinRooms(client)
 	return nil
 }
 
-func (s *Service) joinRooms(client types.MatrixClient) {
+// TargetRooms returns the rooms feed updates are sent into.
+func (s *Service) TargetRooms() []id.RoomID {
 	roomSet := make(map[id.RoomID]bool)
+	var roomIDs []id.RoomID
 	for _, feedInfo := range s.Feeds {
 		for _, roomID := range feedInfo.Rooms {
-			roomSet[roomID] = true
+			if !roomSet[roomID] {
+				roomSet[roomID] = true
+				roomIDs = append(roomIDs, roomID)
+			}
 		}
 	}
+	return roomIDs
+}
 
-	for roomID := range roomSet {
+func (s *Service) joinRooms(client types.MatrixClient) {
+	for _, roomID := range s.TargetRooms() {
+		if utils.IsLabel(roomID) {
+			continue // labelled rooms are joined by the service which labels them
+		}
 		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
 			log.WithFields(log.Fields{
 				log.ErrorKey: err,
@@ -165,6 +189,10 @@ func (s *Service) PostRegister(oldService types.Service) {
 
 // OnPoll rechecks RSS feeds which are due to be polled.
 //
+// Feeds are fetched concurrently, up to Concurrency at a time, and each fetch is abandoned after
+// FeedTimeoutSecs, so a slow or hanging feed only delays itself. Feeds which fail are retried on
+// the next poll.
+//
 // In order for a feed to be polled, the current time must be greater than NextPollTimestampSecs.
 // In order for an item on a feed to be sent to Matrix, the item's GUID must not exist in RecentGUIDs.
 // The GUID for an item is created according to the following rules:
@@ -172,12 +200,20 @@ func (s *Service) PostRegister(oldService types.Service) {
 //   - Else if there is a Link field, use it as the GUID.
 //   - Else if there is a Title field, use it as the GUID.
 //
-// Returns a timestamp representing when this Service should have OnPoll called again.
+// Returns a timestamp representing when this Service should have OnPoll called again, or 0 if
+// there are no feeds.
 func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
 	logger := log.WithFields(log.Fields{
 		"service_id":   s.ServiceID(),
 		"service_type": s.ServiceType(),
 	})
+	// Feeds may have been changed with !rss since this poll loop started
+	unlock := polling.Lock(s)
+	s.Feeds = polling.Latest(s).(*Service).Feeds
+	if len(s.Feeds) == 0 {
+		unlock()
+		return time.Unix(0, 0) // every room unsubscribed, so stop polling
+	}
 	now := time.Now().Unix() // Second resolution
 
 	// Work out which feeds should be polled
@@ -188,20 +224,37 @@ func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
 			pollFeeds = append(pollFeeds, u)
 		}
 	}
+	unlock()
 
 	if len(pollFeeds) == 0 {
 		return s.nextTimestamp()
 	}
 
-	// Query each feed and send new items to subscribed rooms
-	for _, u := range pollFeeds {
-		feed, items, err := s.queryFeed(u)
+	// Fetch the feeds without holding the service's lock, so that !rss commands aren't blocked by
+	// slow feeds
+	ctx, cancel := context.WithTimeout(context.Background(), maxPollDuration)
+	defer cancel()
+	results := s.fetchFeeds(ctx, pollFeeds, true)
+
+	defer polling.Lock(s)()
+	s.Feeds = polling.Latest(s).(*Service).Feeds
+	// Send new items to subscribed rooms
+	for i, u := range pollFeeds {
+		if _, ok := s.Feeds[u]; !ok {
+			continue // unsubscribed while it was being fetched
+		}
+		feed, items, err := s.updateFeed(u, results[i])
 		if err != nil {
 			logger.WithField("feed_url", u).WithError(err).Error("Failed to query feed")
+			polling.ReportError(s, fmt.Errorf("%s: %s", u, err))
 			incrementMetrics(u, err)
 			continue
 		}
-		incrementMetrics(u, nil)
+		incrementMetrics(u, results[i].err)
+		if feed == nil {
+			logger.WithField("feed_url", u).Info("Feed not modified")
+			continue
+		}
 		logger.WithFields(log.Fields{
 			"feed_url":   u,
 			"feed_items": len(feed.Items),
@@ -223,13 +276,16 @@ func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
 	// Persist the service to save the next poll times
 	if _, err := database.GetServiceDB().StoreService(s); err != nil {
 		logger.WithError(err).Error("Failed to persist next poll times for service")
+		polling.ReportError(s, err)
 	}
 
 	return s.nextTimestamp()
 }
 
 func incrementMetrics(urlStr string, err error) {
-	if err != nil {
+	if err == errNotModified {
+		pollCounter.With(prometheus.Labels{"http_status": "304"}).Inc()
+	} else if err != nil {
 		herr, ok := err.(gofeed.HTTPError)
 		statusCode := 0 // e.g. network timeout
 		if ok {
@@ -260,11 +316,94 @@ func (s *Service) nextTimestamp() time.Time {
 	return time.Unix(earliestNextTS, 0)
 }
 
+// validators are the headers which tell whether a feed has changed since it was fetched.
+type validators struct {
+	etag         string
+	lastModified string
+}
+
+// fetchResult is the result of fetching a feed.
+type fetchResult struct {
+	feed *gofeed.Feed
+	validators
+	// errNotModified if the feed hasn't changed, in which case feed is nil.
+	err error
+}
+
+// fetchFeeds fetches the feeds with a pool of at most Concurrency workers. If conditional is true,
+// feeds which haven't changed since they were last fetched aren't downloaded again, and fail with
+// errNotModified. Feeds which haven't been fetched when ctx is done fail with its error. Returns
+// results in the same order as feedURLs.
+func (s *Service) fetchFeeds(ctx context.Context, feedURLs []string, conditional bool) []fetchResult {
+	results := make([]fetchResult, len(feedURLs))
+	conds := make([]validators, len(feedURLs))
+	if conditional {
+		for i, feedURL := range feedURLs {
+			conds[i] = validators{s.Feeds[feedURL].ETag, s.Feeds[feedURL].LastModified}
+		}
+	}
+	workers := s.Concurrency
+	if workers <= 0 {
+		workers = defaultConcurrency
+	}
+	if workers > len(feedURLs) {
+		workers = len(feedURLs)
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = s.fetchFeed(ctx, feedURLs[i], conds[i])
+			}
+		}()
+	}
+	for i := range feedURLs {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			results[i].err = ctx.Err()
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// fetchFeed reads the feed, giving up after FeedTimeoutSecs. If the validators aren't empty, the
+// feed is only downloaded if it has changed since they were returned.
+func (s *Service) fetchFeed(ctx context.Context, feedURL string, cond validators) fetchResult {
+	timeout := s.FeedTimeoutSecs
+	if timeout <= 0 {
+		timeout = defaultFeedTimeoutSecs
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+	log.WithField("feed_url", feedURL).Info("Querying feed")
+	return readFeed(ctx, feedURL, cond)
+}
+
 // Query the given feed, update relevant timestamps and return NEW items
 func (s *Service) queryFeed(feedURL string) (*gofeed.Feed, []gofeed.Item, error) {
-	log.WithField("feed_url", feedURL).Info("Querying feed")
+	f := s.Feeds[feedURL]
+	return s.updateFeed(feedURL, s.fetchFeed(context.Background(), feedURL, validators{f.ETag, f.LastModified}))
+}
+
+// updateFeed updates the feed's relevant timestamps with the result of fetching it and returns NEW
+// items. Returns a nil feed if it hasn't changed.
+func (s *Service) updateFeed(feedURL string, res fetchResult) (*gofeed.Feed, []gofeed.Item, error) {
 	var items []gofeed.Item
-	feed, err := readFeed(feedURL)
+	feed, err := res.feed, res.err
+	if err == errNotModified {
+		f := s.Feeds[feedURL]
+		f.NextPollTimestampSecs = nextPollTimestamp(f)
+		f.FeedUpdatedTimestampSecs = time.Now().Unix()
+		f.IsFailing = false
+		s.Feeds[feedURL] = f
+		return nil, nil, nil
+	}
 	// check for no items in addition to any returned errors as it appears some RSS feeds
 	// do not consistently return items.
 	if err == nil && len(feed.Items) == 0 {
@@ -289,14 +428,7 @@ func (s *Service) queryFeed(feedURL string) (*gofeed.Feed, []gofeed.Item, error)
 	}
 
 	now := time.Now().Unix() // Second resolution
-
-	// Work out when to next poll this feed
-	nextPollTSSec := now + minPollingIntervalSeconds
-	if s.Feeds[feedURL].PollIntervalMins > int(minPollingIntervalSeconds/60) {
-		nextPollTSSec = now + int64(s.Feeds[feedURL].PollIntervalMins*60)
-	}
-	// TODO: Handle the 'sy' Syndication extension to control update interval.
-	// See http://www.feedforall.com/syndication.htm and http://web.resource.org/rss/1.0/modules/syndication/
+	nextPollTSSec := nextPollTimestamp(s.Feeds[feedURL])
 
 	// Work out which GUIDs to remember. We don't want to remember every GUID ever as that leads to completely
 	// unbounded growth of data.
@@ -327,40 +459,36 @@ func (s *Service) queryFeed(feedURL string) (*gofeed.Feed, []gofeed.Item, error)
 	f.FeedUpdatedTimestampSecs = now
 	f.RecentGUIDs = guids
 	f.IsFailing = false
+	f.ETag = res.etag
+	f.LastModified = res.lastModified
 	s.Feeds[feedURL] = f
 
 	return feed, items, nil
 }
 
-// containsAny takes a string and an array of words and returns whether any of the words
-// in the list are contained in the string. The words in the string are considered to be
-// separated by any non-alphanumeric character.
-func containsAny(item string, filterWords []string) bool {
-	itemWords := strings.FieldsFunc(item, func(c rune) bool {
-		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
-	})
-	for _, itemWord := range itemWords {
-		for _, filterWord := range filterWords {
-			if filterWord == itemWord {
-				return true
-			}
-		}
+// nextPollTimestamp returns when to next poll the feed.
+func nextPollTimestamp(f Feed) int64 {
+	now := time.Now().Unix() // Second resolution
+	if f.PollIntervalMins > int(minPollingIntervalSeconds/60) {
+		return now + int64(f.PollIntervalMins*60)
 	}
-	return false
+	// TODO: Handle the 'sy' Syndication extension to control update interval.
+	// See http://www.feedforall.com/syndication.htm and http://web.resource.org/rss/1.0/modules/syndication/
+	return now + minPollingIntervalSeconds
 }
 
-func itemFiltered(i *gofeed.Item, mustInclude, mustNotInclude *includeRules) bool {
+func itemFiltered(i *gofeed.Item, mustInclude, mustNotInclude *utils.IncludeRules) bool {
 	// At least one word for each field that has been specified must be included for an item to pass the filter.
-	if (i.Author != nil && len(mustInclude.Author) > 0 && !containsAny(i.Author.Name, mustInclude.Author)) ||
-		(len(mustInclude.Title) > 0 && !containsAny(i.Title, mustInclude.Title)) ||
-		(len(mustInclude.Description) > 0 && !containsAny(i.Description, mustInclude.Description)) {
+	if (i.Author != nil && len(mustInclude.Author) > 0 && !utils.ContainsAnyWord(i.Author.Name, mustInclude.Author)) ||
+		(len(mustInclude.Title) > 0 && !utils.ContainsAnyWord(i.Title, mustInclude.Title)) ||
+		(len(mustInclude.Description) > 0 && !utils.ContainsAnyWord(i.Description, mustInclude.Description)) {
 		return true
 	}
 
 	// If at least one word of any field that has been specified is included in the item, it doesn't pass the filter.
-	if (i.Author != nil && containsAny(i.Author.Name, mustNotInclude.Author)) ||
-		containsAny(i.Title, mustNotInclude.Title) ||
-		containsAny(i.Description, mustNotInclude.Description) {
+	if (i.Author != nil && utils.ContainsAnyWord(i.Author.Name, mustNotInclude.Author)) ||
+		utils.ContainsAnyWord(i.Title, mustNotInclude.Title) ||
+		utils.ContainsAnyWord(i.Description, mustNotInclude.Description) {
 		return true
 	}
 	return false
@@ -414,8 +542,10 @@ func (s *Service) sendToRooms(cli types.MatrixClient, feedURL string, feed *gofe
 	})
 	logger.Info("Sending new feed item")
 	for _, roomID := range s.Feeds[feedURL].Rooms {
-		if _, err := cli.SendMessageEvent(roomID, mevt.EventMessage, itemToHTML(feed, item)); err != nil {
-			logger.WithError(err).WithField("room_id", roomID).Error("Failed to send to room")
+		for _, toRoomID := range utils.ResolveRooms(cli, s.ServiceUserID(), roomID) {
+			if _, err := cli.SendMessageEvent(toRoomID, mevt.EventMessage, itemToHTML(feed, item)); err != nil {
+				logger.WithError(err).WithField("room_id", toRoomID).Error("Failed to send to room")
+			}
 		}
 	}
 	return nil
@@ -443,8 +573,7 @@ func itemToHTML(feed *gofeed.Feed, item gofeed.Item) mevt.MessageEventContent {
 		}
 	}
 	return mevt.MessageEventContent{
-		Body: fmt.Sprintf("%s: %s ( %s )",
-			html.EscapeString(feed.Title), html.EscapeString(itemTitle), html.EscapeString(item.Link)),
+		Body:          utils.PlainText(fmtBody),
 		MsgType:       "m.notice",
 		Format:        mevt.FormatHTML,
 		FormattedBody: fmtBody,
@@ -507,24 +636,57 @@ func (rt userAgentRoundTripper) RoundTrip(req *http.Request) (*http.Response, er
 	return rt.Transport.RoundTrip(req)
 }
 
-func readFeed(feedURL string) (*gofeed.Feed, error) {
+// readFeed downloads and parses the feed, which may be RSS, Atom or JSON Feed. If the validators aren't empty, they are sent as
+// If-None-Match and If-Modified-Since headers, and errNotModified is returned if the feed hasn't
+// changed.
+func readFeed(ctx context.Context, feedURL string, cond validators) fetchResult {
 	// Don't use fp.ParseURL because it leaks on non-2xx responses as of 2016/11/29 (cac19c6c27)
 	fp := gofeed.NewParser()
-	resp, err := cachingClient.Get(feedURL)
+	req, err := http.NewRequestWithContext(ctx, "GET", feedURL, nil)
+	if err != nil {
+		return fetchResult{err: err}
+	}
+	if cond.etag != "" {
+		req.Header.Set("If-None-Match", cond.etag)
+	}
+	if cond.lastModified != "" {
+		req.Header.Set("If-Modified-Since", cond.lastModified)
+	}
+	resp, err := cachingClient.Do(req)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
 	if err != nil {
-		return nil, err
+		return fetchResult{err: err}
 	}
 
+	res := fetchResult{validators: validators{resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")}}
+	// The cache turns 304s for feeds it has into the cached response, which has the same ETag.
+	if resp.StatusCode == http.StatusNotModified || (cond.etag != "" && res.etag == cond.etag) {
+		if res.etag == "" && res.lastModified == "" {
+			res.validators = cond
+		}
+		res.err = errNotModified
+		return res
+	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, gofeed.HTTPError{
+		res.err = gofeed.HTTPError{
 			StatusCode: resp.StatusCode,
 			Status:     resp.Status,
 		}
+		return res
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	if isJSONFeed(resp.Header.Get("Content-Type"), body) {
+		res.feed, res.err = parseJSONFeed(body)
+		return res
 	}
-	return fp.Parse(resp.Body)
+	res.feed, res.err = fp.Parse(bytes.NewReader(body))
+	return res
 }
 
 func init() {
@@ -2,8 +2,10 @@ package rssbot
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -171,3 +173,192 @@ func TestFeedItemFiltering(t *testing.T) {
 		t.Errorf("Expected 0 items, got %v", items)
 	}
 }
+
+func TestFetchFeeds(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	cachingClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+		if req.URL.Host == "hanging.hyrule" {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+		time.Sleep(10 * time.Millisecond)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(rssFeedXML))}, nil
+	})}
+	s := &Service{Concurrency: 2, FeedTimeoutSecs: 1}
+	feedURLs := []string{"https://hanging.hyrule"}
+	for i := 0; i < 6; i++ {
+		feedURLs = append(feedURLs, fmt.Sprintf("https://shop%d.hyrule", i))
+	}
+
+	start := time.Now()
+	results := s.fetchFeeds(context.Background(), feedURLs, false)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the hanging feed to time out after a second, took %s", elapsed)
+	}
+	if maxInFlight != 2 {
+		t.Errorf("Expected 2 feeds to be fetched at once, got %d", maxInFlight)
+	}
+	if results[0].err == nil {
+		t.Error("Expected the hanging feed to fail")
+	}
+	for i, res := range results[1:] {
+		if res.err != nil || res.feed.Title != "Mask Shop" {
+			t.Errorf("Expected %s to be fetched, got %v", feedURLs[i+1], res.err)
+		}
+	}
+
+	// Feeds which haven't started when the poll is cancelled aren't fetched
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i, res := range s.fetchFeeds(ctx, feedURLs, false) {
+		if res.err == nil {
+			t.Errorf("Expected %s to fail after cancellation", feedURLs[i])
+		}
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	feedURL := "https://thehappymaskshop.hyrule"
+	rssbot := createRSSClient(t, feedURL)
+	var conditions []string
+	cachingClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		conditions = append(conditions, req.Header.Get("If-None-Match")+"|"+req.Header.Get("If-Modified-Since"))
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			return &http.Response{StatusCode: 304, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewBufferString(""))}, nil
+		}
+		header := http.Header{}
+		header.Set("ETag", `"v1"`)
+		header.Set("Last-Modified", "Tue, 05 Jan 2016 15:00:00 GMT")
+		return &http.Response{StatusCode: 200, Header: header, Body: ioutil.NopCloser(bytes.NewBufferString(rssFeedXML))}, nil
+	})}
+
+	if _, _, err := rssbot.queryFeed(feedURL); err != nil {
+		t.Fatal("Failed to query feed: ", err)
+	}
+	f := rssbot.Feeds[feedURL]
+	if f.ETag != `"v1"` || f.LastModified != "Tue, 05 Jan 2016 15:00:00 GMT" {
+		t.Errorf("Expected the feed's validators to be stored, got %q and %q", f.ETag, f.LastModified)
+	}
+	f.NextPollTimestampSecs = time.Now().Unix() - 1
+	f.IsFailing = true
+	rssbot.Feeds[feedURL] = f
+
+	feed, items, err := rssbot.queryFeed(feedURL)
+	if err != nil || feed != nil || items != nil {
+		t.Errorf("Expected an unmodified feed to have no items, got %v, %v, %v", feed, items, err)
+	}
+	if f := rssbot.Feeds[feedURL]; f.IsFailing || f.NextPollTimestampSecs <= time.Now().Unix() || f.ETag != `"v1"` {
+		t.Errorf("Expected an unmodified feed to be polled later, got %+v", f)
+	}
+	want := []string{"|", `"v1"|Tue, 05 Jan 2016 15:00:00 GMT`}
+	if strings.Join(conditions, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected conditions %q, got %q", want, conditions)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	feedURL := "https://thehappymaskshop.hyrule"
+	rssbot := createRSSClient(t, feedURL)
+	room := id.RoomID("!masks:hyrule")
+	body := func(content interface{}, err error) string {
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return content.(*mevt.MessageEventContent).Body
+	}
+
+	if got := body(rssbot.cmdList(room)); got != "This room isn't subscribed to any feeds." {
+		t.Errorf("!rss list: got %q", got)
+	}
+	if got := body(rssbot.cmdLatest(room, []string{feedURL})); !strings.HasPrefix(got, "error: This room isn't subscribed") {
+		t.Errorf("Expected !rss latest to refuse a feed the room isn't subscribed to, got %q", got)
+	}
+	if got := body(rssbot.cmdSubscribe(room, []string{"ftp://thehappymaskshop.hyrule"})); !strings.HasPrefix(got, "error: ") {
+		t.Errorf("Expected !rss subscribe to refuse an ftp URL, got %q", got)
+	}
+	if got := body(rssbot.cmdSubscribe(room, []string{"<" + feedURL + ">"})); got != "Subscribed to Mask Shop. New items will be sent into this room." {
+		t.Errorf("!rss subscribe: got %q", got)
+	}
+	if got := rssbot.Feeds[feedURL].Rooms; len(got) != 2 || got[1] != room {
+		t.Errorf("Expected the room to be added to the feed, got %v", got)
+	}
+	if got := body(rssbot.cmdList(room)); got != feedURL {
+		t.Errorf("!rss list: got %q", got)
+	}
+	if got := body(rssbot.cmdLatest(room, []string{feedURL})); got != "Mask Shop:\nNew Item: Majora\u2019s Mask (http://go.neb/rss/majoras-mask) by The Skullkid!" {
+		t.Errorf("!rss latest: got %q", got)
+	}
+
+	if got := body(rssbot.cmdUnsubscribe(room, []string{feedURL})); got != "Unsubscribed from "+feedURL {
+		t.Errorf("!rss unsubscribe: got %q", got)
+	}
+	if got := body(rssbot.cmdUnsubscribe(room, []string{feedURL})); !strings.HasPrefix(got, "error: ") {
+		t.Errorf("Expected unsubscribing twice to fail, got %q", got)
+	}
+	// The feed still sends items into its other room
+	if got := rssbot.Feeds[feedURL].Rooms; len(got) != 1 || got[0] != "!linksroom:hyrule" {
+		t.Errorf("Expected only the room to be removed from the feed, got %v", got)
+	}
+}
+
+func TestJSONFeed(t *testing.T) {
+	cachingClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": []string{"application/feed+json; charset=utf-8"}},
+			Body: ioutil.NopCloser(bytes.NewBufferString(`{
+				"version": "https://jsonfeed.org/version/1.1",
+				"title": "Mask Shop",
+				"home_page_url": "http://go.neb/shop",
+				"authors": [{"name": "The Happy Mask Salesman"}],
+				"items": [
+					{
+						"id": "majoras-mask",
+						"url": "http://go.neb/rss/majoras-mask",
+						"title": "New Item: Majora's Mask",
+						"content_html": "<p>It's <b>cursed</b></p>",
+						"date_published": "2021-07-01T12:00:00Z",
+						"tags": ["masks"]
+					},
+					{"id": 2, "content_text": "Bunny Hood restocked"}
+				]
+			}`)),
+		}, nil
+	})}
+
+	res := readFeed(context.Background(), "https://thehappymaskshop.hyrule/feed.json", validators{})
+	if res.err != nil {
+		t.Fatalf("Failed to read JSON Feed: %s", res.err)
+	}
+	if res.feed.Title != "Mask Shop" || res.feed.Link != "http://go.neb/shop" || res.feed.FeedType != "json" {
+		t.Errorf("Wrong feed: %+v", res.feed)
+	}
+	if len(res.feed.Items) != 2 {
+		t.Fatalf("Expected 2 items, got %d", len(res.feed.Items))
+	}
+	item := res.feed.Items[0]
+	if item.GUID != "majoras-mask" || item.Link != "http://go.neb/rss/majoras-mask" || item.Title != "New Item: Majora's Mask" {
+		t.Errorf("Wrong item: %+v", item)
+	}
+	if item.Description != "<p>It's <b>cursed</b></p>" || item.PublishedParsed == nil || item.Categories[0] != "masks" {
+		t.Errorf("Wrong item content: %+v", item)
+	}
+	if item.Author == nil || item.Author.Name != "The Happy Mask Salesman" {
+		t.Errorf("Expected the feed's author, got %+v", item.Author)
+	}
+	if item := res.feed.Items[1]; item.GUID != "2" || item.Description != "Bunny Hood restocked" {
+		t.Errorf("Wrong text item: %+v", item)
+	}
+}
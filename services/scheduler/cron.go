@@ -0,0 +1,150 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a parsed 5 field cron expression: minute, hour, day of month, month and day of week.
+// Each field is a bitset of the values it matches.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// Whether the day of month or day of week fields were "*". If neither was, a day matches
+	// when EITHER field matches, as with the classic cron.
+	domStar, dowStar bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronFields = []cronField{
+		{"minute", 0, 59, nil},
+		{"hour", 0, 23, nil},
+		{"day of month", 1, 31, nil},
+		{"month", 1, 12, map[string]int{
+			"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+			"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+		}},
+		// 7 is also Sunday
+		{"day of week", 0, 7, map[string]int{
+			"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+		}},
+	}
+	// How far ahead to look for a matching time before giving up, e.g. for "0 0 30 2 *"
+	cronSearchLimit = 5 * 366 * 24 * time.Hour
+)
+
+// parseCron parses a cron expression such as "0 9 * * MON-FRI" or "*/15 * * * *".
+func parseCron(spec string) (*cronSpec, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("A cron expression needs 5 fields (minute hour day-of-month month day-of-week), got %d", len(fields))
+	}
+	var bits [5]uint64
+	for i, f := range cronFields {
+		b, err := f.parse(fields[i])
+		if err != nil {
+			return nil, err
+		}
+		bits[i] = b
+	}
+	// Fold day 7 onto Sunday
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &cronSpec{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}, nil
+}
+
+// parse parses a comma separated list of "*", "N" or "N-M", each optionally followed by "/step".
+func (f cronField) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(strings.ToLower(s), ",") {
+		rangePart, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("Bad step in %s field: %q", f.name, item)
+			}
+			rangePart, step = item[:i], n
+		}
+		lo, hi := f.min, f.max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if lo, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = f.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				hi = f.max // "5/15" means from 5 onwards
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("Bad range in %s field: %q", f.name, item)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[s]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("Bad %s: %q", f.name, s)
+	}
+	return v, nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time strictly after t which matches, in t's location. Returns the zero
+// time if nothing matches within cronSearchLimit.
+func (c *cronSpec) next(t time.Time) time.Time {
+	limit := t.Add(cronSearchLimit)
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
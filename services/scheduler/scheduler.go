@@ -0,0 +1,327 @@
+// Package scheduler implements a Service which sends scheduled and recurring messages into rooms.
+package scheduler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Scheduler service
+const ServiceType = "scheduler"
+
+// The shortest interval between repeats of an interval schedule.
+const minInterval = time.Minute
+
+// Schedule is a message which is sent into a room on a schedule.
+type Schedule struct {
+	// The ID of the schedule, used to remove it. Populated by Go-NEB if not given.
+	ID string `json:"id"`
+	// The room to send the message into.
+	RoomID id.RoomID `json:"room_id"`
+	// When to send the message. Either a 5 field cron expression such as "0 9 * * MON", or an
+	// interval such as "every 30 minutes" or "every monday 10am". Cron expressions are evaluated
+	// in the room's "timezone" bot option, or UTC if there isn't one.
+	Spec string `json:"spec"`
+	// The message to send.
+	Message string `json:"message"`
+	// The user who added the schedule. Populated by Go-NEB for schedules added with !schedule.
+	CreatedBy id.UserID `json:"created_by,omitempty"`
+	// When the message will next be sent. This is populated by Go-NEB.
+	NextTimestampSecs int64 `json:"next_ts_secs"`
+}
+
+// Service contains the Config fields for the Scheduler Service.
+//
+// Schedules are usually managed with !schedule commands rather than configured directly.
+//
+// Example request:
+//   {
+//       "schedules": [
+//           {
+//               "room_id": "!qmElAGdFYCHoCJuaNt:localhost",
+//               "spec": "50 8 * * MON-FRI",
+//               "message": "Standup in 10 minutes"
+//           }
+//       ]
+//   }
+type Service struct {
+	types.DefaultService
+	// The scheduled messages.
+	Schedules []Schedule `json:"schedules"`
+	// The ID to give the next new schedule. This is populated by Go-NEB.
+	NextID int `json:"next_id"`
+}
+
+// nextTime returns when a message with this spec should next be sent after now, in loc. prev
+// is when the message was last due, or the zero time if it is a new schedule. Intervals are
+// counted from prev, and intervals of whole days keep its time of day in loc, so that they don't
+// drift.
+func nextTime(spec string, prev, now time.Time, loc *time.Location) (time.Time, error) {
+	words := strings.Fields(spec)
+	if len(words) > 0 && strings.ToLower(words[0]) == "every" {
+		pt, rest, err := utils.ParseTime(words, now, loc)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if len(rest) > 0 {
+			return time.Time{}, fmt.Errorf("Unexpected %q after the interval", strings.Join(rest, " "))
+		}
+		if pt.Every < minInterval {
+			return time.Time{}, fmt.Errorf("The interval must be at least %s", utils.HumanDuration(minInterval))
+		}
+		if prev.IsZero() {
+			return pt.At, nil
+		}
+		next := utils.NextRepeat(prev, pt.Every, loc)
+		for !next.After(now) { // skip any repeats we missed, e.g. whilst Go-NEB was down
+			next = utils.NextRepeat(next, pt.Every, loc)
+		}
+		return next, nil
+	}
+	cron, err := parseCron(spec)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := cron.next(now.In(loc))
+	if next.IsZero() {
+		return time.Time{}, fmt.Errorf("The cron expression %q never matches", spec)
+	}
+	return next, nil
+}
+
+// schedule works out when sc should next be sent after now.
+func (s *Service) schedule(sc *Schedule, now time.Time) error {
+	var prev time.Time
+	if sc.NextTimestampSecs != 0 {
+		prev = time.Unix(sc.NextTimestampSecs, 0)
+	}
+	next, err := nextTime(sc.Spec, prev, now, utils.RoomLocation(s.ServiceUserID(), sc.RoomID))
+	if err != nil {
+		return err
+	}
+	sc.NextTimestampSecs = next.Unix()
+	return nil
+}
+
+// Register validates the schedules and works out when each will next be sent.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	now := time.Now()
+	for i := range s.Schedules {
+		sc := &s.Schedules[i]
+		if sc.RoomID == "" || sc.Message == "" {
+			return fmt.Errorf("Schedule %d must have a room_id and a message", i)
+		}
+		if sc.ID == "" {
+			s.NextID++
+			sc.ID = strconv.Itoa(s.NextID)
+		}
+		if sc.NextTimestampSecs == 0 {
+			if err := s.schedule(sc, now); err != nil {
+				return fmt.Errorf("Schedule %s: %s", sc.ID, err)
+			}
+		}
+		if _, err := client.JoinRoom(sc.RoomID.String(), "", nil); err != nil {
+			log.WithError(err).WithField("room_id", sc.RoomID).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+// TargetRooms returns the rooms scheduled messages are sent into.
+func (s *Service) TargetRooms() []id.RoomID {
+	roomSet := make(map[id.RoomID]bool)
+	var roomIDs []id.RoomID
+	for _, sc := range s.Schedules {
+		if !roomSet[sc.RoomID] {
+			roomSet[sc.RoomID] = true
+			roomIDs = append(roomIDs, sc.RoomID)
+		}
+	}
+	return roomIDs
+}
+
+// Commands supported:
+//    !schedule add "0 9 * * MON" "Standup in 10 minutes"
+//    !schedule add "every 2 hours" Drink some water
+// Sends the message into this room on a cron schedule or at an interval.
+//    !schedule list
+// Lists the schedules in this room.
+//    !schedule remove 3
+// Removes the schedule with the given ID.
+// Adding and removing schedules are privileged commands, see types.ACL.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:       []string{"schedule", "add"},
+			Privileged: true,
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdAdd(roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"schedule", "list"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdList(roomID)
+			},
+		},
+		{
+			Path:       []string{"schedule", "remove"},
+			Privileged: true,
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdRemove(roomID, args)
+			},
+		},
+		{
+			Path: []string{"schedule"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return usageMessage(), nil
+			},
+		},
+	}
+}
+
+func usageMessage() *mevt.MessageEventContent {
+	return notice(`Usage: !schedule add "0 9 * * MON" "Standup in 10 minutes" | !schedule add "every 2 hours" message | !schedule list | !schedule remove id`)
+}
+
+func (s *Service) cmdAdd(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return usageMessage(), nil
+	}
+	sc := Schedule{
+		RoomID:    roomID,
+		Spec:      args[0],
+		Message:   strings.Join(args[1:], " "),
+		CreatedBy: userID,
+	}
+	now := time.Now()
+	if err := s.schedule(&sc, now); err != nil {
+		return nil, err
+	}
+	return s.update(func(latest *Service) (interface{}, error) {
+		latest.NextID++
+		sc.ID = strconv.Itoa(latest.NextID)
+		latest.Schedules = append(latest.Schedules, sc)
+		loc := utils.RoomLocation(s.ServiceUserID(), roomID)
+		return notice(fmt.Sprintf("Added schedule %s. The first message will be sent %s.", sc.ID,
+			utils.ParsedTime{At: time.Unix(sc.NextTimestampSecs, 0).In(loc)}.Describe(now))), nil
+	})
+}
+
+func (s *Service) cmdList(roomID id.RoomID) (interface{}, error) {
+	loc := utils.RoomLocation(s.ServiceUserID(), roomID)
+	var buf bytes.Buffer
+	for _, sc := range s.Schedules {
+		if sc.RoomID != roomID {
+			continue
+		}
+		next := time.Unix(sc.NextTimestampSecs, 0).In(loc).Format("Mon, 02 Jan 2006 15:04 MST")
+		buf.WriteString(fmt.Sprintf("%s: %q at %q (next %s)\n", sc.ID, sc.Message, sc.Spec, next))
+	}
+	if buf.Len() == 0 {
+		return notice("There are no schedules in this room."), nil
+	}
+	return notice(strings.TrimSuffix(buf.String(), "\n")), nil
+}
+
+func (s *Service) cmdRemove(roomID id.RoomID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return usageMessage(), nil
+	}
+	return s.update(func(latest *Service) (interface{}, error) {
+		for i, sc := range latest.Schedules {
+			// Only allow removing schedules from the room they were added to
+			if sc.ID == args[0] && sc.RoomID == roomID {
+				latest.Schedules = append(latest.Schedules[:i], latest.Schedules[i+1:]...)
+				return notice("Removed schedule " + sc.ID + "."), nil
+			}
+		}
+		return nil, errors.New("There is no schedule " + args[0] + " in this room")
+	})
+}
+
+// update applies fn to the latest copy of the service, see polling.Update.
+func (s *Service) update(fn func(latest *Service) (interface{}, error)) (interface{}, error) {
+	return polling.Update(s, true, func(latest types.Service) (interface{}, error) {
+		return fn(latest.(*Service))
+	})
+}
+
+// OnPoll sends any messages which are due and works out when they should next be sent.
+// Returns the time the next message is due, or 0 if there are no schedules.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	defer polling.Lock(s)()
+	latest := polling.Latest(s).(*Service)
+	s.Schedules, s.NextID = latest.Schedules, latest.NextID
+
+	now := time.Now()
+	sent := false
+	var remaining []Schedule
+	for _, sc := range s.Schedules {
+		if sc.NextTimestampSecs <= now.Unix() {
+			s.send(cli, sc)
+			sent = true
+			if err := s.schedule(&sc, now); err != nil {
+				log.WithError(err).WithField("schedule", sc).Error("Failed to reschedule, removing schedule")
+				continue
+			}
+		}
+		remaining = append(remaining, sc)
+	}
+	s.Schedules = remaining
+
+	if sent {
+		if _, err := database.GetServiceDB().StoreService(s); err != nil {
+			log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to persist next schedule times")
+			polling.ReportError(s, err)
+		}
+	}
+	return s.nextTimestamp()
+}
+
+func (s *Service) send(cli types.MatrixClient, sc Schedule) {
+	if _, err := cli.SendMessageEvent(sc.RoomID, mevt.EventMessage, notice(sc.Message)); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"room_id":     sc.RoomID,
+			"schedule_id": sc.ID,
+		}).Error("Failed to send scheduled message")
+		polling.ReportError(s, fmt.Errorf("schedule %s: %s", sc.ID, err))
+	}
+}
+
+func (s *Service) nextTimestamp() time.Time {
+	var earliest int64
+	for _, sc := range s.Schedules {
+		if earliest == 0 || sc.NextTimestampSecs < earliest {
+			earliest = sc.NextTimestampSecs
+		}
+	}
+	return time.Unix(earliest, 0)
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
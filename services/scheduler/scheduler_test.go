@@ -0,0 +1,130 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestCronNext(t *testing.T) {
+	// A Wednesday
+	now := time.Date(2016, 11, 30, 12, 0, 0, 0, time.UTC)
+	cronTests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2016, 11, 30, 12, 1, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2016, 11, 30, 12, 15, 0, 0, time.UTC)},
+		{"0 9 * * MON", time.Date(2016, 12, 5, 9, 0, 0, 0, time.UTC)},
+		{"30 8 * * mon-fri", time.Date(2016, 12, 1, 8, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 25 dec *", time.Date(2016, 12, 25, 12, 0, 0, 0, time.UTC)},
+		{"0 10 * * 7", time.Date(2016, 12, 4, 10, 0, 0, 0, time.UTC)},
+		{"0 10,14 * * *", time.Date(2016, 11, 30, 14, 0, 0, 0, time.UTC)},
+		// day of month OR day of week when both are given
+		{"0 0 15 * fri", time.Date(2016, 12, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range cronTests {
+		cron, err := parseCron(test.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): unexpected error %s", test.spec, err)
+			continue
+		}
+		if got := cron.next(now); !got.Equal(test.want) {
+			t.Errorf("parseCron(%q).next: want %s, got %s", test.spec, test.want, got)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * * * funday", "5-1 * * * *", "*/0 * * * *"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q): expected an error", spec)
+		}
+	}
+	if _, err := nextTime("0 0 30 2 *", time.Time{}, now, time.UTC); err == nil {
+		t.Error("Expected an error for a cron expression which never matches")
+	}
+}
+
+func TestIntervalNext(t *testing.T) {
+	now := time.Date(2016, 11, 30, 12, 0, 0, 0, time.UTC)
+	first, err := nextTime("every 2 hours", time.Time{}, now, time.UTC)
+	if err != nil || !first.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("Bad first interval: %s, %v", first, err)
+	}
+	// Missed repeats are skipped without drifting
+	next, err := nextTime("every 2 hours", first, first.Add(5*time.Hour), time.UTC)
+	if err != nil || !next.Equal(first.Add(6*time.Hour)) {
+		t.Fatalf("Bad next interval: %s, %v", next, err)
+	}
+	// Daily repeats stay at the same time of day when the clocks change
+	if london, err := time.LoadLocation("Europe/London"); err == nil {
+		prev := time.Date(2016, 3, 26, 9, 0, 0, 0, london)
+		next, err := nextTime("every day at 9:00", prev, prev.Add(time.Hour), london)
+		if want := time.Date(2016, 3, 27, 9, 0, 0, 0, london); err != nil || !next.Equal(want) {
+			t.Errorf("Bad daily interval across DST: want %s, got %s, %v", want, next, err)
+		}
+	}
+	for _, spec := range []string{"every 10 seconds", "every 2 hours please"} {
+		if _, err := nextTime(spec, time.Time{}, now, time.UTC); err == nil {
+			t.Errorf("nextTime(%q): expected an error", spec)
+		}
+	}
+}
+
+func TestOnPoll(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	var sent []string
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if !strings.Contains(req.URL.Path, "/send/m.room.message/") {
+			t.Fatalf("Unexpected request: %s", req.URL)
+		}
+		var content mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			t.Fatal("Failed to decode message: ", err)
+		}
+		sent = append(sent, content.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup"}`)),
+		}, nil
+	})
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+
+	now := time.Now()
+	due := now.Add(-time.Minute).Unix()
+	later := now.Add(time.Hour).Unix()
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"schedules": [
+			{"id": "1", "room_id": "!a:hyrule", "spec": "every 2 hours", "message": "due", "next_ts_secs": `+strconv.FormatInt(due, 10)+`},
+			{"id": "2", "room_id": "!a:hyrule", "spec": "* * * * *", "message": "later", "next_ts_secs": `+strconv.FormatInt(later, 10)+`}
+		]
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+	next := s.OnPoll(cli)
+
+	if len(sent) != 1 || sent[0] != "due" {
+		t.Errorf("Expected only the due message to be sent, got %v", sent)
+	}
+	if s.Schedules[0].NextTimestampSecs != due+2*60*60 {
+		t.Errorf("Expected the due schedule to repeat in 2 hours, got %d", s.Schedules[0].NextTimestampSecs)
+	}
+	if next.Unix() != later || len(s.Schedules) != 2 {
+		t.Errorf("Expected to be polled again when the later message is due, got %s", next)
+	}
+}
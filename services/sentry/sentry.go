@@ -0,0 +1,290 @@
+// Package sentry implements a Service capable of processing issue webhooks from Sentry.
+package sentry
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Sentry service.
+const ServiceType = "sentry"
+
+// levels orders Sentry's event levels from least to most severe.
+var levels = map[string]int{
+	"debug":   0,
+	"info":    1,
+	"warning": 2,
+	"error":   3,
+	"fatal":   4,
+}
+
+// The description of each issue action in notifications. Other actions, such as "assigned",
+// are ignored. Sentry sends "unresolved" when a resolved issue regresses.
+var actions = map[string]string{
+	"created":    "New issue",
+	"unresolved": "Regressed",
+	"resolved":   "Resolved",
+}
+
+// Service contains the Config fields for the Sentry service.
+//
+// This service will send notices into a Matrix room when Sentry sends issue webhooks to it.
+// It requires a public domain which Sentry can reach. Create an internal integration in
+// Sentry with the WebhookURL, subscribe it to "issue" events and set the client_secret
+// to the integration's client secret so that requests can be verified.
+//
+// Notices are sent when issues are created, regress or are resolved. Each room can be
+// limited to some projects and to issues of at least a minimum level.
+//
+// Example JSON request:
+//    {
+//        "client_secret": "8c6b1ef5a6b1...",
+//        "rooms": {
+//            "!ewfug483gsfe:localhost": {
+//                "projects": ["backend", "frontend"],
+//                "min_level": "error"
+//            }
+//        }
+//    }
+type Service struct {
+	types.DefaultService
+	webhookEndpointURL string
+	// The URL which should be added to the Sentry integration - Populated by Go-NEB after Service registration.
+	WebhookURL string `json:"webhook_url"`
+	// The client secret of the Sentry integration, used to verify webhook requests.
+	ClientSecret string `json:"client_secret"`
+	// A map of matrix rooms to the issues to send to them. A room may be a Space or a
+	// label such as "label:backend-teams", see utils.ResolveRooms.
+	Rooms map[id.RoomID]RoomConfig `json:"rooms"`
+	// Optional. Create a room to send issues into if no rooms are configured.
+	utils.RoomCreation
+}
+
+// RoomConfig is which issues are sent into a room.
+type RoomConfig struct {
+	// The project slugs to send issues for. Defaults to all projects.
+	Projects []string `json:"projects"`
+	// The least severe level to send issues for: one of debug, info, warning, error or
+	// fatal. Defaults to all levels.
+	MinLevel string `json:"min_level"`
+}
+
+// Issue is the part of a Sentry issue which is used in notifications.
+type Issue struct {
+	ShortID   string `json:"shortId"`
+	Title     string `json:"title"`
+	Culprit   string `json:"culprit"`
+	Level     string `json:"level"`
+	Permalink string `json:"permalink"`
+	WebURL    string `json:"web_url"`
+	Project   struct {
+		Name string `json:"name"`
+		Slug string `json:"slug"`
+	} `json:"project"`
+	Metadata struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"metadata"`
+}
+
+// WebhookNotification is the payload of an issue webhook from Sentry.
+type WebhookNotification struct {
+	Action string `json:"action"`
+	Data   struct {
+		Issue Issue `json:"issue"`
+	} `json:"data"`
+}
+
+func (i *Issue) link() string {
+	if i.Permalink != "" {
+		return i.Permalink
+	}
+	return i.WebURL
+}
+
+// message returns a notice describing what happened to the issue.
+func message(action string, i *Issue) mevt.MessageEventContent {
+	project := i.Project.Slug
+	if i.Project.Name != "" {
+		project = i.Project.Name
+	}
+	errMsg := i.Metadata.Value
+	if errMsg == "" {
+		errMsg = i.Title
+	}
+	htmlBody := fmt.Sprintf("<strong>[%s] %s</strong> (%s): <a href=\"%s\">%s</a>",
+		html.EscapeString(project), actions[action], html.EscapeString(i.Level),
+		html.EscapeString(i.link()), html.EscapeString(i.ShortID))
+	if i.Culprit != "" {
+		htmlBody += " in <code>" + html.EscapeString(i.Culprit) + "</code>"
+	}
+	htmlBody += "<br>" + html.EscapeString(errMsg)
+	return utils.StrippedHTMLMessage(mevt.MsgNotice, htmlBody)
+}
+
+// wants returns true if issues from project at level should be sent to the room.
+func wants(projects []string, minLevel string, project, level string) bool {
+	if minLevel != "" && levels[level] < levels[minLevel] {
+		return false
+	}
+	if len(projects) == 0 {
+		return true
+	}
+	for _, p := range projects {
+		if p == project {
+			return true
+		}
+	}
+	return false
+}
+
+// OnReceiveWebhook receives issue webhooks from Sentry and sends notices to Matrix as a result.
+func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	logger := logging.FromContext(req.Context())
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithError(err).Error("Failed to read Sentry webhook body")
+		w.WriteHeader(400)
+		return
+	}
+	if err := s.verify(body, req.Header.Get("Sentry-Hook-Signature")); err != nil {
+		logger.WithError(err).Warn("Received unauthorised Sentry webhook request.")
+		w.WriteHeader(403)
+		return
+	}
+	if resource := req.Header.Get("Sentry-Hook-Resource"); resource != "" && resource != "issue" {
+		w.WriteHeader(200) // The integration is subscribed to other resources, which we ignore
+		return
+	}
+	var notif WebhookNotification
+	if err := json.Unmarshal(body, &notif); err != nil {
+		logger.WithError(err).Error("Sentry webhook received an invalid JSON payload")
+		w.WriteHeader(400)
+		return
+	}
+	if _, ok := actions[notif.Action]; !ok {
+		w.WriteHeader(200)
+		return
+	}
+
+	issue := &notif.Data.Issue
+	msg := message(notif.Action, issue)
+	for roomID, roomConfig := range s.Rooms {
+		if !wants(roomConfig.Projects, roomConfig.MinLevel, issue.Project.Slug, issue.Level) {
+			continue
+		}
+		for _, toRoomID := range utils.ResolveRooms(cli, s.ServiceUserID(), roomID) {
+			logger.WithFields(log.Fields{
+				"issue":   issue.ShortID,
+				"room_id": toRoomID,
+			}).Print("Sending Sentry notification to room")
+			if _, e := cli.SendMessageEvent(toRoomID, mevt.EventMessage, msg); e != nil {
+				logger.WithError(e).WithField("room_id", toRoomID).Print(
+					"Failed to send Sentry notification to room.")
+			}
+		}
+	}
+	w.WriteHeader(200)
+}
+
+// verify checks the request was signed with the client secret, if one is configured.
+func (s *Service) verify(body []byte, signature string) error {
+	if s.ClientSecret == "" {
+		return nil
+	}
+	if signature == "" {
+		return errors.New("missing Sentry-Hook-Signature header")
+	}
+	mac := hmac.New(sha256.New, []byte(s.ClientSecret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	s.WebhookURL = s.webhookEndpointURL
+	var oldRooms *utils.RoomCreation
+	if old, ok := oldService.(*Service); ok {
+		oldRooms = &old.RoomCreation
+	}
+	roomID, err := s.CreateMissingRoom(client, s.ServiceUserID(), s.Owner, len(s.Rooms) > 0, oldRooms)
+	if err != nil {
+		return fmt.Errorf("failed to create room: %s", err)
+	}
+	if roomID != "" {
+		s.Rooms = map[id.RoomID]RoomConfig{roomID: {}}
+	}
+	for roomID, roomConfig := range s.Rooms {
+		if _, ok := levels[roomConfig.MinLevel]; roomConfig.MinLevel != "" && !ok {
+			return fmt.Errorf("min_level for room %s must be one of debug, info, warning, error or fatal", roomID)
+		}
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+// PostRegister deletes this service if there are no rooms to send issues to.
+func (s *Service) PostRegister(oldService types.Service) {
+	if len(s.Rooms) > 0 {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_type": s.ServiceType(),
+		"service_id":   s.ServiceID(),
+	})
+	logger.Info("Removing service as no rooms are registered.")
+	if err := database.GetServiceDB().DeleteService(s.ServiceID()); err != nil {
+		logger.WithError(err).Error("Failed to delete service")
+	}
+}
+
+// TargetRooms returns the rooms issues are sent into.
+func (s *Service) TargetRooms() []id.RoomID {
+	roomIDs := make([]id.RoomID, 0, len(s.Rooms))
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
+func (s *Service) joinRooms(client types.MatrixClient) {
+	for roomID := range s.Rooms {
+		if utils.IsLabel(roomID) {
+			continue // labelled rooms are joined by the service which labels them
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService:     types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package sentry
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const secret = "sekrit"
+
+func TestNotify(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+
+	// Intercept message sending to Matrix and mock responses
+	sent := make(map[id.RoomID][]mevt.MessageEventContent)
+	matrixTrans := struct{ testutils.MockTransport }{}
+	matrixTrans.RT = func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/hierarchy") {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		if !strings.Contains(req.URL.Path, "/send/m.room.message") {
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("Failed to decode request JSON: %s", err)
+		}
+		roomID := id.RoomID(strings.Split(req.URL.Path, "/")[5])
+		sent[roomID] = append(sent[roomID], msg)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup:event"}`)),
+		}, nil
+	}
+	matrixCli, _ := mautrix.NewClient("https://hs", "@neb:hs", "its_a_secret")
+	matrixCli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(`{
+		"client_secret": "`+secret+`",
+		"rooms": {
+			"!all:hs": {},
+			"!backend:hs": {"projects": ["backend"], "min_level": "error"}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(action, level, signature string) int {
+		body := fmt.Sprintf(`{"action":%q,"data":{"issue":{
+			"shortId": "BACKEND-1A",
+			"title": "ZeroDivisionError: division by zero",
+			"culprit": "app.views in index",
+			"level": %q,
+			"permalink": "https://sentry.io/issues/1",
+			"project": {"name": "Backend", "slug": "backend"},
+			"metadata": {"type": "ZeroDivisionError", "value": "division by <zero>"}
+		}}}`, action, level)
+		if signature == "" {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(body))
+			signature = hex.EncodeToString(mac.Sum(nil))
+		}
+		req, _ := http.NewRequest("POST", "", bytes.NewBufferString(body))
+		req.Header.Set("Sentry-Hook-Resource", "issue")
+		req.Header.Set("Sentry-Hook-Signature", signature)
+		w := httptest.NewRecorder()
+		srv.OnReceiveWebhook(w, req, matrixCli)
+		return w.Code
+	}
+
+	if code := send("created", "error", "bad"); code != 403 {
+		t.Errorf("Expected a bad signature to be rejected, got %d", code)
+	}
+	for _, n := range []struct{ action, level string }{
+		{"created", "error"}, {"unresolved", "warning"}, {"assigned", "fatal"},
+	} {
+		if code := send(n.action, n.level, ""); code != 200 {
+			t.Errorf("Expected response 200 OK, got %d", code)
+		}
+	}
+
+	if len(sent["!all:hs"]) != 2 || len(sent["!backend:hs"]) != 1 {
+		t.Fatalf("Expected 2 notices in !all and 1 in !backend, got %d and %d", len(sent["!all:hs"]), len(sent["!backend:hs"]))
+	}
+	msg := sent["!backend:hs"][0]
+	want := "[Backend] New issue (error): BACKEND-1A (https://sentry.io/issues/1) in app.views in index\ndivision by <zero>"
+	if msg.Body != want {
+		t.Errorf("Wrong body: got %q want %q", msg.Body, want)
+	}
+	if !strings.Contains(msg.FormattedBody, `<a href="https://sentry.io/issues/1">BACKEND-1A</a>`) ||
+		!strings.Contains(msg.FormattedBody, "division by &lt;zero&gt;") {
+		t.Errorf("Bad formatted body: %s", msg.FormattedBody)
+	}
+	if !strings.HasPrefix(sent["!all:hs"][1].Body, "[Backend] Regressed (warning)") {
+		t.Errorf("Expected a regression notice, got %q", sent["!all:hs"][1].Body)
+	}
+}
@@ -0,0 +1,71 @@
+package setup
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/utils"
+	"maunium.net/go/mautrix/id"
+)
+
+const auditUsage = "Usage: !audit [7d]"
+
+// auditLines is the most audit log entries !audit shows. /admin/auditLog returns the rest.
+const auditLines = 20
+
+// cmdAudit lists the commands run in the room, and the webhook notifications sent into it, over
+// the given period, newest first.
+func (s *Service) cmdAudit(roomID id.RoomID, userID id.UserID, args []string, now time.Time) (interface{}, error) {
+	if !s.isAdmin(userID) {
+		return nil, errors.New("Only admins can use !audit")
+	}
+	period := 7 * 24 * time.Hour
+	if len(args) > 0 {
+		var rest []string
+		var ok bool
+		if period, rest, ok = utils.ParseDuration(args); !ok || period <= 0 || len(rest) > 0 {
+			return notice(auditUsage), nil
+		}
+	}
+
+	entries, err := database.GetServiceDB().LoadAuditEntries(database.AuditQuery{
+		RoomID: roomID,
+		Since:  now.Add(-period),
+		Limit:  auditLines + 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load the audit log: %s", err)
+	}
+	if len(entries) == 0 {
+		return notice(fmt.Sprintf("Nothing was recorded in this room in the last %s.", utils.HumanDuration(period))), nil
+	}
+
+	loc := utils.RoomLocation(s.ServiceUserID(), roomID)
+	lines := []string{fmt.Sprintf("Audit log for the last %s, newest first:", utils.HumanDuration(period))}
+	for i, e := range entries {
+		if i == auditLines {
+			lines = append(lines, fmt.Sprintf("Only the latest %d entries are shown.", auditLines))
+			break
+		}
+		lines = append(lines, describeAuditEntry(e, loc))
+	}
+	return notice(strings.Join(lines, "\n")), nil
+}
+
+// describeAuditEntry returns a line describing the entry, e.g.
+// "2016-01-05 14:50 UTC: @link:hyrule ran !github create (github) - success".
+func describeAuditEntry(e database.AuditEntry, loc *time.Location) string {
+	what := fmt.Sprintf("%s ran !%s", e.UserID, e.Command)
+	if e.Kind == database.AuditWebhookSend {
+		what = fmt.Sprintf("%s sent a webhook notification", e.UserID)
+	}
+	line := fmt.Sprintf("%s: %s (%s) - %s", e.Timestamp.In(loc).Format("2006-01-02 15:04 MST"), what, e.ServiceID, e.Outcome)
+	if e.Detail != "" {
+		line += ": " + e.Detail
+	}
+	return line
+}
+
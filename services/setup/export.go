@@ -0,0 +1,124 @@
+package setup
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const exportUsage = "Usage: !export 30d [html|csv]"
+
+var exportTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Notifications in {{.RoomID}}</title>
+<style>
+body { font-family: sans-serif; }
+td, th { padding: 4px 8px; text-align: left; vertical-align: top; }
+td.body { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Notifications in {{.RoomID}}</h1>
+<p>Sent by {{.UserID}} from {{.From}} to {{.To}}.</p>
+<table>
+<tr><th>Time</th><th>Service</th><th>Event</th><th>Message</th></tr>
+{{range .Rows}}<tr><td>{{.Time}}</td><td>{{.ServiceID}}</td><td>{{.EventID}}</td><td class="body">{{.Body}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type exportRow struct {
+	Time      string
+	ServiceID string
+	EventID   id.EventID
+	Body      string
+}
+
+// cmdExport uploads the notifications this client sent into the room over the given period, as
+// an HTML or CSV file, e.g. for incident reviews.
+func (s *Service) cmdExport(cli types.MatrixClient, roomID id.RoomID, userID id.UserID, args []string, now time.Time) (interface{}, error) {
+	if !s.isAdmin(userID) {
+		return nil, errors.New("Only admins can use !export")
+	}
+	period, rest, ok := utils.ParseDuration(args)
+	if !ok || period <= 0 || len(rest) > 1 {
+		return notice(exportUsage), nil
+	}
+	format := "html"
+	if len(rest) == 1 {
+		format = strings.ToLower(rest[0])
+	}
+	if format != "html" && format != "csv" {
+		return notice(exportUsage), nil
+	}
+	if period > clients.NotificationRetention {
+		return nil, fmt.Errorf("Notifications are only kept for %s", utils.HumanDuration(clients.NotificationRetention))
+	}
+
+	from := now.Add(-period)
+	sent, err := database.GetServiceDB().LoadSentNotifications(s.ServiceUserID(), roomID, from)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load notifications: %s", err)
+	}
+	if len(sent) == 0 {
+		return notice(fmt.Sprintf("I haven't sent any notifications into this room in the last %s.", utils.HumanDuration(period))), nil
+	}
+
+	loc := utils.RoomLocation(s.ServiceUserID(), roomID)
+	const layout = "2006-01-02 15:04:05 MST"
+	rows := make([]exportRow, len(sent))
+	for i, n := range sent {
+		rows[i] = exportRow{n.Timestamp.In(loc).Format(layout), n.ServiceID, n.EventID, n.Body}
+	}
+	var buf bytes.Buffer
+	contentType := "text/html"
+	if format == "csv" {
+		contentType = "text/csv"
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"time", "service_id", "event_id", "body"})
+		for _, r := range rows {
+			w.Write([]string{r.Time, r.ServiceID, string(r.EventID), r.Body})
+		}
+		w.Flush()
+		err = w.Error()
+	} else {
+		err = exportTemplate.Execute(&buf, struct {
+			RoomID   id.RoomID
+			UserID   id.UserID
+			From, To string
+			Rows     []exportRow
+		}{roomID, s.ServiceUserID(), from.In(loc).Format(layout), now.In(loc).Format(layout), rows})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to render notifications: %s", err)
+	}
+
+	fileName := fmt.Sprintf("notifications-%s-to-%s.%s", from.In(loc).Format("2006-01-02"), now.In(loc).Format("2006-01-02"), format)
+	resp, err := cli.UploadBytesWithName(buf.Bytes(), contentType, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to upload the export: %s", err)
+	}
+	return mevt.MessageEventContent{
+		MsgType: mevt.MsgFile,
+		Body:    fileName,
+		URL:     resp.ContentURI.CUString(),
+		Info: &mevt.FileInfo{
+			MimeType: contentType,
+			Size:     buf.Len(),
+		},
+	}, nil
+}
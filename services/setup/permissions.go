@@ -0,0 +1,118 @@
+package setup
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// cmdPermissions reports what this service's user can do in each room it is in or which
+// a service targets, to help work out why a bot is silent in a room.
+func (s *Service) cmdPermissions(cli types.MatrixClient, userID id.UserID) (interface{}, error) {
+	if !s.isAdmin(userID) {
+		return nil, errors.New("Only admins can use !neb permissions")
+	}
+	resp, err := cli.JoinedRooms()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list joined rooms: %s", err)
+	}
+	joined := make(map[id.RoomID]bool)
+	for _, roomID := range resp.JoinedRooms {
+		joined[roomID] = true
+	}
+	servicesByRoom := s.servicesByRoom(cli)
+
+	roomIDs := make([]string, 0, len(joined))
+	for roomID := range joined {
+		roomIDs = append(roomIDs, string(roomID))
+	}
+	for roomID := range servicesByRoom {
+		if !joined[roomID] {
+			roomIDs = append(roomIDs, string(roomID))
+		}
+	}
+	if len(roomIDs) == 0 {
+		return notice("I'm not in any rooms."), nil
+	}
+	sort.Strings(roomIDs)
+
+	lines := make([]string, len(roomIDs))
+	for i, roomID := range roomIDs {
+		lines[i] = s.describeRoom(cli, id.RoomID(roomID), joined[id.RoomID(roomID)], servicesByRoom[id.RoomID(roomID)])
+	}
+	return notice(strings.Join(lines, "\n")), nil
+}
+
+// servicesByRoom returns the IDs of this user's services which send into each room, after
+// resolving spaces and labels.
+func (s *Service) servicesByRoom(cli types.MatrixClient) map[id.RoomID][]string {
+	services, err := database.GetServiceDB().LoadServicesForUser(s.ServiceUserID())
+	if err != nil {
+		log.WithError(err).WithField("service_user_id", s.ServiceUserID()).Error("Failed to load services")
+	}
+	servicesByRoom := make(map[id.RoomID][]string)
+	for _, service := range services {
+		if targeter, ok := service.(types.RoomTargeter); ok {
+			for _, target := range targeter.TargetRooms() {
+				for _, roomID := range utils.ResolveRooms(cli, s.ServiceUserID(), target) {
+					ids := servicesByRoom[roomID]
+					if len(ids) == 0 || ids[len(ids)-1] != service.ServiceID() {
+						servicesByRoom[roomID] = append(ids, service.ServiceID())
+					}
+				}
+			}
+		}
+	}
+	return servicesByRoom
+}
+
+// describeRoom returns a one line summary of what this service's user can do in the room.
+func (s *Service) describeRoom(cli types.MatrixClient, roomID id.RoomID, joined bool, serviceIDs []string) string {
+	desc := string(roomID) + ": "
+	services := "none"
+	if len(serviceIDs) > 0 {
+		sort.Strings(serviceIDs)
+		services = strings.Join(serviceIDs, ", ")
+	}
+	if !joined {
+		return desc + "NOT JOINED, services: " + services
+	}
+
+	var pl mevt.PowerLevelsEventContent
+	if err := cli.StateEvent(roomID, mevt.StatePowerLevels, "", &pl); err != nil {
+		return desc + fmt.Sprintf("failed to read power levels (%s), services: %s", err, services)
+	}
+	level := pl.GetUserLevel(s.ServiceUserID())
+	// A room without an m.room.encryption state event isn't encrypted.
+	var encryption mevt.EncryptionEventContent
+	encrypted := true
+	if err := cli.StateEvent(roomID, mevt.StateEncryption, "", &encryption); errors.Is(err, mautrix.MNotFound) {
+		encrypted = false
+	} else if err != nil {
+		return desc + fmt.Sprintf("failed to read encryption state (%s), services: %s", err, services)
+	}
+	// Messages in encrypted rooms are sent as m.room.encrypted events.
+	canSend := level >= pl.GetEventLevel(mevt.EventMessage)
+	if encrypted {
+		canSend = canSend && level >= pl.GetEventLevel(mevt.EventEncrypted)
+	}
+
+	return desc + fmt.Sprintf("power level %d, can send messages: %s, can send state: %s, encrypted: %s, services: %s",
+		level, yesNo(canSend), yesNo(level >= pl.StateDefault()), yesNo(encrypted), services)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,68 @@
+package setup
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/provision"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix/id"
+)
+
+// addRoom and removeRoom change the rooms of several services at once. They are variables so
+// tests can avoid needing real clients.
+var (
+	addRoom    = provision.AddRoom
+	removeRoom = provision.RemoveRoom
+)
+
+const roomsUsage = "Usage: !neb rooms add !room:example.org to service1,service2 | !neb rooms remove !room:example.org from service1,service2"
+
+// cmdRooms adds a room to or removes a room from several of this client's services at once, e.g.
+// "!neb rooms add !newteam:example.org to team_alerts,team_github". Either every service is changed
+// or none are.
+func (s *Service) cmdRooms(userID id.UserID, args []string) (interface{}, error) {
+	if !s.isAdmin(userID) {
+		return nil, errors.New("Only admins can use !neb rooms")
+	}
+	if len(args) < 4 || (args[0] != "add" || args[2] != "to") && (args[0] != "remove" || args[2] != "from") {
+		return notice(roomsUsage), nil
+	}
+	roomID := id.RoomID(args[1])
+	var serviceIDs []string
+	for _, arg := range args[3:] {
+		for _, serviceID := range strings.Split(arg, ",") {
+			if serviceID != "" {
+				serviceIDs = append(serviceIDs, serviceID)
+			}
+		}
+	}
+	// Admins can only change services which run as this client, as with !setup
+	for _, serviceID := range serviceIDs {
+		srv, err := database.GetServiceDB().LoadService(serviceID)
+		if err != nil || srv.ServiceUserID() != s.ServiceUserID() {
+			return nil, fmt.Errorf("I don't run a service called %s", serviceID)
+		}
+	}
+
+	var services []types.Service
+	var err error
+	if args[0] == "add" {
+		services, err = addRoom(serviceIDs, roomID)
+	} else {
+		services, err = removeRoom(serviceIDs, roomID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("No services were changed: %s", err)
+	}
+	changed := make([]string, len(services))
+	for i, srv := range services {
+		changed[i] = srv.ServiceID()
+	}
+	if args[0] == "add" {
+		return notice(fmt.Sprintf("Added %s to %s.", roomID, strings.Join(changed, ", "))), nil
+	}
+	return notice(fmt.Sprintf("Removed %s from %s.", roomID, strings.Join(changed, ", "))), nil
+}
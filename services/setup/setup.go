@@ -0,0 +1,232 @@
+// Package setup implements a Service which walks admins through configuring other services, and
+// provides other admin commands.
+package setup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/provision"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Setup service
+const ServiceType = "setup"
+
+// configure provisions a service. It is a variable so tests can avoid needing real clients.
+var configure = provision.Configure
+
+// Service contains the Config fields for the Setup Service.
+//
+// Admins can configure new services by sending "!setup" in a direct message with the service's
+// user. The wizard lists the available service types, asks for the minimal config for the chosen
+// type, then configures it exactly as /admin/configureService would. Services are configured to
+// run as the same user as this service.
+//
+// Example request:
+//   {
+//       "admins": ["@alice:localhost"]
+//   }
+type Service struct {
+	types.DefaultService
+	// The users who are allowed to use !setup.
+	Admins []id.UserID `json:"admins"`
+}
+
+// Register makes sure that at least one admin has been given.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if len(s.Admins) == 0 {
+		return errors.New("At least one admin must be specified")
+	}
+	return nil
+}
+
+// Commands supported:
+//    !setup
+// Starts the setup wizard. Only admins can use this, and only in a direct message.
+//    !setup cancel
+// Stops the setup wizard. Any other !command also stops it.
+//    !neb permissions
+// Lists every room this service's user is in or which a service sends into, along with the
+// user's power level, whether it can send messages and state, whether the room is encrypted
+// and which services send into it. Only admins can use this.
+//    !neb rooms add !newteam:example.org to team_alerts,team_github
+//    !neb rooms remove !oldteam:example.org from team_alerts,team_github
+// Adds a room to or removes a room from several of this user's services at once. Either every
+// service is changed or none are. Only admins can use this.
+//    !export 30d [html|csv]
+// Uploads the notifications this user's services sent into this room over the period, as an HTML
+// (the default) or CSV file. Only admins can use this.
+//    !audit [7d]
+// Lists the commands run in this room and the webhook notifications sent into it over the period,
+// which defaults to a week. Only admins can use this.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"neb", "permissions"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdPermissions(cli, userID)
+			},
+		},
+		{
+			Path: []string{"neb", "rooms"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdRooms(userID, args)
+			},
+		},
+		{
+			Path: []string{"export"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdExport(cli, roomID, userID, args, time.Now())
+			},
+		},
+		{
+			Path: []string{"audit"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdAudit(roomID, userID, args, time.Now())
+			},
+		},
+		{
+			Path: []string{"setup", "cancel"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				// The pending question was abandoned as soon as this command was sent.
+				return notice("Setup cancelled."), nil
+			},
+		},
+		{
+			Path: []string{"setup"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdSetup(cli, roomID, userID)
+			},
+		},
+	}
+}
+
+func (s *Service) cmdSetup(cli types.MatrixClient, roomID id.RoomID, userID id.UserID) (interface{}, error) {
+	if !s.isAdmin(userID) {
+		return nil, errors.New("Only admins can use !setup")
+	}
+	members, err := cli.JoinedMembers(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to check room members: %s", err)
+	}
+	if len(members.Joined) != 2 {
+		return nil, errors.New("!setup can only be used in a direct message with me")
+	}
+	w := &wizard{
+		botUserID: s.ServiceUserID(),
+		roomID:    roomID,
+		userID:    userID,
+	}
+	return w.ask(w.chooseType, "Which service would you like to set up? Choose one of: "+
+		strings.Join(serviceTypes(), ", ")+". Send !setup cancel to stop at any time.")
+}
+
+func (s *Service) isAdmin(userID id.UserID) bool {
+	for _, admin := range s.Admins {
+		if admin == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceTypes returns the service types which can be set up, which is all of them except this one.
+func serviceTypes() []string {
+	var serviceTypes []string
+	for _, t := range types.ServiceTypes() {
+		if t != ServiceType {
+			serviceTypes = append(serviceTypes, t)
+		}
+	}
+	return serviceTypes
+}
+
+// wizard holds the state of one run of !setup between questions.
+type wizard struct {
+	botUserID id.UserID
+	roomID    id.RoomID
+	userID    id.UserID
+	// The service being set up, and the questions about it which haven't been answered yet.
+	service   types.Service
+	questions []types.SetupQuestion
+}
+
+func (w *wizard) ask(answerer types.Answerer, prompt string) (interface{}, error) {
+	types.AskQuestion(w.botUserID, w.roomID, w.userID, answerer)
+	return notice(prompt), nil
+}
+
+func (w *wizard) chooseType(answer string) (interface{}, error) {
+	serviceType := strings.ToLower(strings.TrimSpace(answer))
+	known := false
+	for _, t := range serviceTypes() {
+		known = known || t == serviceType
+	}
+	if !known {
+		return w.ask(w.chooseType, "Unknown service type. Choose one of: "+strings.Join(serviceTypes(), ", ")+".")
+	}
+
+	serviceID := fmt.Sprintf("%s_%d", serviceType, time.Now().Unix())
+	service, err := types.CreateService(serviceID, serviceType, w.botUserID, []byte("{}"))
+	if err != nil {
+		return nil, err
+	}
+	w.service = service
+
+	provider, ok := service.(types.SetupProvider)
+	if !ok {
+		return w.ask(w.applyJSON, "Please send the JSON config for the "+serviceType+" service, or {} if it doesn't need any.")
+	}
+	w.questions = provider.SetupQuestions()
+	return w.nextQuestion()
+}
+
+func (w *wizard) nextQuestion() (interface{}, error) {
+	if len(w.questions) == 0 {
+		return w.provision()
+	}
+	return w.ask(w.answerQuestion, w.questions[0].Prompt)
+}
+
+func (w *wizard) answerQuestion(answer string) (interface{}, error) {
+	if err := w.questions[0].Apply(strings.TrimSpace(answer)); err != nil {
+		return w.ask(w.answerQuestion, fmt.Sprintf("%s. %s", err, w.questions[0].Prompt))
+	}
+	w.questions = w.questions[1:]
+	return w.nextQuestion()
+}
+
+func (w *wizard) applyJSON(answer string) (interface{}, error) {
+	if err := json.Unmarshal([]byte(answer), w.service); err != nil {
+		return w.ask(w.applyJSON, fmt.Sprintf("That isn't valid config: %s. Please try again.", err))
+	}
+	return w.provision()
+}
+
+func (w *wizard) provision() (interface{}, error) {
+	if _, err := configure(w.service); err != nil {
+		return nil, fmt.Errorf("Failed to set up the %s service: %s", w.service.ServiceType(), err)
+	}
+	return notice(fmt.Sprintf("Set up the %s service with ID %s.", w.service.ServiceType(), w.service.ServiceID())), nil
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
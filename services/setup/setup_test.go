@@ -0,0 +1,409 @@
+package setup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	botUserID   = id.UserID("@neb:hyrule")
+	adminUserID = id.UserID("@link:hyrule")
+	dmRoomID    = id.RoomID("!dm:hyrule")
+	groupRoomID = id.RoomID("!group:hyrule")
+)
+
+// questionService is configured by answering a question.
+type questionService struct {
+	types.DefaultService
+	APIKey string `json:"api_key"`
+}
+
+func (s *questionService) SetupQuestions() []types.SetupQuestion {
+	return []types.SetupQuestion{{Prompt: "API key?", Apply: types.StoreAnswer(&s.APIKey)}}
+}
+
+// jsonService is configured by sending JSON.
+type jsonService struct {
+	types.DefaultService
+	Name string `json:"name"`
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &questionService{DefaultService: types.NewDefaultService(serviceID, serviceUserID, "questiontest")}
+	})
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &jsonService{DefaultService: types.NewDefaultService(serviceID, serviceUserID, "jsontest")}
+	})
+}
+
+func newClient(t *testing.T) *mautrix.Client {
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		joined := map[id.UserID]interface{}{botUserID: struct{}{}, adminUserID: struct{}{}}
+		if strings.Contains(req.URL.Path, string(groupRoomID)) {
+			joined["@zelda:hyrule"] = struct{}{}
+		}
+		b, err := json.Marshal(map[string]interface{}{"joined": joined})
+		if err != nil {
+			t.Fatalf("Failed to marshal joined members: %s", err)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBuffer(b)),
+		}, nil
+	})
+	cli, _ := mautrix.NewClient("https://hyrule", botUserID, "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+	return cli
+}
+
+// answer answers the pending question and returns the body of the reply.
+func answer(t *testing.T, text string) string {
+	answerer := types.TakeQuestion(botUserID, dmRoomID, adminUserID)
+	if answerer == nil {
+		t.Fatalf("No question pending when answering %q", text)
+	}
+	content, err := answerer(text)
+	if err != nil {
+		t.Fatalf("Answering %q: unexpected error %s", text, err)
+	}
+	return content.(*mevt.MessageEventContent).Body
+}
+
+func startSetup(t *testing.T) types.Command {
+	srv, err := types.CreateService("id", ServiceType, botUserID, []byte(`{"admins":["`+string(adminUserID)+`"]}`))
+	if err != nil {
+		t.Fatal("Failed to create setup service: ", err)
+	}
+	return findCommand(t, srv.Commands(newClient(t)), "setup")
+}
+
+func findCommand(t *testing.T, cmds []types.Command, path ...string) types.Command {
+	for _, cmd := range cmds {
+		if strings.Join(cmd.Path, " ") == strings.Join(path, " ") {
+			return cmd
+		}
+	}
+	t.Fatalf("No command %v", path)
+	return types.Command{}
+}
+
+func TestSetupRestrictions(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	setup := startSetup(t)
+	if _, err := setup.Command(dmRoomID, "@zelda:hyrule", nil); err == nil {
+		t.Error("Expected an error for a non-admin")
+	}
+	if _, err := setup.Command(groupRoomID, adminUserID, nil); err == nil {
+		t.Error("Expected an error outside a direct message")
+	}
+	if types.TakeQuestion(botUserID, groupRoomID, adminUserID) != nil {
+		t.Error("Expected no question to be asked")
+	}
+}
+
+func TestSetupWizard(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	var configured []types.Service
+	configure = func(service types.Service) (types.Service, error) {
+		configured = append(configured, service)
+		return nil, nil
+	}
+
+	setup := startSetup(t)
+	if _, err := setup.Command(dmRoomID, adminUserID, nil); err != nil {
+		t.Fatal("Unexpected error starting setup: ", err)
+	}
+	if got := answer(t, "nonsense"); !strings.HasPrefix(got, "Unknown service type") {
+		t.Errorf("Expected unknown service type to be rejected, got %q", got)
+	}
+	if got := answer(t, "questiontest"); got != "API key?" {
+		t.Errorf("Expected to be asked for an API key, got %q", got)
+	}
+	if got := answer(t, "  "); !strings.Contains(got, "API key?") {
+		t.Errorf("Expected to be asked for an API key again, got %q", got)
+	}
+	if got := answer(t, "s3cr3t"); !strings.HasPrefix(got, "Set up the questiontest service") {
+		t.Errorf("Expected service to be set up, got %q", got)
+	}
+
+	if _, err := setup.Command(dmRoomID, adminUserID, nil); err != nil {
+		t.Fatal("Unexpected error starting setup: ", err)
+	}
+	answer(t, "jsontest")
+	if got := answer(t, "{nope"); !strings.HasPrefix(got, "That isn't valid config") {
+		t.Errorf("Expected invalid JSON to be rejected, got %q", got)
+	}
+	answer(t, `{"name": "epona"}`)
+
+	if len(configured) != 2 {
+		t.Fatalf("Expected 2 services to be configured, got %d", len(configured))
+	}
+	if s := configured[0].(*questionService); s.APIKey != "s3cr3t" || s.ServiceUserID() != botUserID {
+		t.Errorf("Bad questiontest service: %+v", s)
+	}
+	if s := configured[1].(*jsonService); s.Name != "epona" {
+		t.Errorf("Bad jsontest service: %+v", s)
+	}
+}
+
+// targetService sends into a room.
+type targetService struct {
+	types.DefaultService
+}
+
+func (s *targetService) TargetRooms() []id.RoomID {
+	return []id.RoomID{"!quiet:hyrule", "!gone:hyrule"}
+}
+
+type servicesStore struct {
+	database.NopStorage
+}
+
+func (d *servicesStore) LoadServicesForUser(userID id.UserID) ([]types.Service, error) {
+	return []types.Service{&targetService{types.NewDefaultService("rss", userID, "targettest")}}, nil
+}
+
+func (d *servicesStore) LoadService(serviceID string) (types.Service, error) {
+	userID := botUserID
+	if serviceID == "elsewhere" {
+		userID = "@other:hyrule"
+	}
+	return &targetService{types.NewDefaultService(serviceID, userID, "targettest")}, nil
+}
+
+func TestRooms(t *testing.T) {
+	database.SetServiceDB(&servicesStore{})
+	var gotIDs []string
+	var gotRoom id.RoomID
+	addRoom = func(serviceIDs []string, roomID id.RoomID) ([]types.Service, error) {
+		gotIDs, gotRoom = serviceIDs, roomID
+		var services []types.Service
+		for _, serviceID := range serviceIDs {
+			services = append(services, &targetService{types.NewDefaultService(serviceID, botUserID, "targettest")})
+		}
+		return services, nil
+	}
+	srv, err := types.CreateService("id", ServiceType, botUserID, []byte(`{"admins":["`+string(adminUserID)+`"]}`))
+	if err != nil {
+		t.Fatal("Failed to create setup service: ", err)
+	}
+	rooms := findCommand(t, srv.Commands(nil), "neb", "rooms")
+
+	args := strings.Fields("add !new:hyrule to rss,github")
+	if _, err := rooms.Command(dmRoomID, "@zelda:hyrule", args); err == nil {
+		t.Error("Expected an error for a non-admin")
+	}
+	content, err := rooms.Command(dmRoomID, adminUserID, args)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if want := "Added !new:hyrule to rss, github."; content.(*mevt.MessageEventContent).Body != want {
+		t.Errorf("Bad reply: want %q, got %q", want, content.(*mevt.MessageEventContent).Body)
+	}
+	if gotRoom != "!new:hyrule" || strings.Join(gotIDs, ",") != "rss,github" {
+		t.Errorf("Added %s to %v, want !new:hyrule to [rss github]", gotRoom, gotIDs)
+	}
+
+	// Services run by other clients can't be changed
+	gotIDs = nil
+	if _, err := rooms.Command(dmRoomID, adminUserID, strings.Fields("add !new:hyrule to rss,elsewhere")); err == nil || gotIDs != nil {
+		t.Errorf("Expected an error for another client's service, got %v", err)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	database.SetServiceDB(&servicesStore{})
+	responses := map[string]string{
+		"/joined_rooms": `{"joined_rooms":["!quiet:hyrule","!secret:hyrule","!forbidden:hyrule","!strict:hyrule"]}`,
+		"/rooms/!quiet:hyrule/state/m.room.power_levels":     `{"users":{"@neb:hyrule":0},"events_default":50,"state_default":50}`,
+		"/rooms/!secret:hyrule/state/m.room.power_levels":    `{"users":{"@neb:hyrule":100}}`,
+		"/rooms/!secret:hyrule/state/m.room.encryption":      `{"algorithm":"m.megolm.v1.aes-sha2"}`,
+		"/rooms/!forbidden:hyrule/state/m.room.power_levels": `{"users":{"@neb:hyrule":100}}`,
+		"/rooms/!strict:hyrule/state/m.room.power_levels":    `{"users":{"@neb:hyrule":50},"events":{"m.room.encrypted":100}}`,
+		"/rooms/!strict:hyrule/state/m.room.encryption":      `{"algorithm":"m.megolm.v1.aes-sha2"}`,
+	}
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		path := strings.TrimPrefix(req.URL.Path, "/_matrix/client/r0")
+		body, ok := responses[strings.TrimSuffix(path, "/")]
+		code := 200
+		if strings.HasPrefix(path, "/rooms/!forbidden:hyrule/state/m.room.encryption") {
+			code, body = 403, `{"errcode":"M_FORBIDDEN"}`
+		} else if !ok {
+			code, body = 404, `{"errcode":"M_NOT_FOUND"}`
+		}
+		return &http.Response{
+			StatusCode: code,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+	cli, _ := mautrix.NewClient("https://hyrule", botUserID, "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+	srv, err := types.CreateService("id", ServiceType, botUserID, []byte(`{"admins":["`+string(adminUserID)+`"]}`))
+	if err != nil {
+		t.Fatal("Failed to create setup service: ", err)
+	}
+	permissions := findCommand(t, srv.Commands(cli), "neb", "permissions")
+
+	if _, err := permissions.Command(dmRoomID, "@zelda:hyrule", nil); err == nil {
+		t.Error("Expected an error for a non-admin")
+	}
+	content, err := permissions.Command(dmRoomID, adminUserID, nil)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	want := "!forbidden:hyrule: failed to read encryption state (failed to GET /_matrix/client/r0/rooms/!forbidden:hyrule/state/m.room.encryption/: M_FORBIDDEN (HTTP 403): ), services: none\n" +
+		"!gone:hyrule: NOT JOINED, services: rss\n" +
+		"!quiet:hyrule: power level 0, can send messages: no, can send state: no, encrypted: no, services: rss\n" +
+		"!secret:hyrule: power level 100, can send messages: yes, can send state: yes, encrypted: yes, services: none\n" +
+		"!strict:hyrule: power level 50, can send messages: no, can send state: yes, encrypted: yes, services: none"
+	if got := content.(*mevt.MessageEventContent).Body; got != want {
+		t.Errorf("Bad report: want\n%s\ngot\n%s", want, got)
+	}
+}
+
+type notificationsStore struct {
+	database.NopStorage
+	since time.Time
+}
+
+func (d *notificationsStore) LoadSentNotifications(userID id.UserID, roomID id.RoomID, since time.Time) ([]database.SentNotification, error) {
+	d.since = since
+	if userID != botUserID || roomID != groupRoomID {
+		return nil, nil
+	}
+	return []database.SentNotification{
+		{UserID: botUserID, RoomID: groupRoomID, EventID: "$one", ServiceID: "alerts",
+			Timestamp: time.Date(2016, 1, 5, 14, 50, 0, 0, time.UTC), Body: "Disk <full>, on \"hyrule\""},
+		{UserID: botUserID, RoomID: groupRoomID, EventID: "$two", ServiceID: "alerts",
+			Timestamp: time.Date(2016, 1, 5, 15, 0, 0, 0, time.UTC), Body: "Resolved"},
+	}, nil
+}
+
+func TestExport(t *testing.T) {
+	store := &notificationsStore{}
+	database.SetServiceDB(store)
+	var uploaded string
+	var contentType string
+	cli, _ := mautrix.NewClient("https://hyrule", botUserID, "its_a_secret")
+	cli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if !strings.HasSuffix(req.URL.Path, "/upload") {
+			t.Fatalf("Unexpected request: %s", req.URL)
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		uploaded, contentType = string(body), req.Header.Get("Content-Type")
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://hyrule/export"}`))}, nil
+	})}
+	srv, err := types.CreateService("id", ServiceType, botUserID, []byte(`{"admins":["`+string(adminUserID)+`"]}`))
+	if err != nil {
+		t.Fatal("Failed to create setup service: ", err)
+	}
+	s := srv.(*Service)
+	now := time.Date(2016, 1, 6, 12, 0, 0, 0, time.UTC)
+
+	if _, err := s.cmdExport(cli, groupRoomID, "@zelda:hyrule", []string{"30d"}, now); err == nil {
+		t.Error("Expected an error for a non-admin")
+	}
+	if _, err := s.cmdExport(cli, groupRoomID, adminUserID, []string{"1000d"}, now); err == nil {
+		t.Error("Expected an error for a period longer than notifications are kept")
+	}
+	content, err := s.cmdExport(cli, groupRoomID, adminUserID, []string{"30d", "csv"}, now)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	msg := content.(mevt.MessageEventContent)
+	if msg.MsgType != mevt.MsgFile || msg.URL != "mxc://hyrule/export" || msg.Body != "notifications-2015-12-07-to-2016-01-06.csv" {
+		t.Errorf("Bad file message: %+v", msg)
+	}
+	if want := now.AddDate(0, 0, -30); !store.since.Equal(want) {
+		t.Errorf("Expected notifications since %s, got %s", want, store.since)
+	}
+	want := "time,service_id,event_id,body\n" +
+		"2016-01-05 14:50:00 UTC,alerts,$one,\"Disk <full>, on \"\"hyrule\"\"\"\n" +
+		"2016-01-05 15:00:00 UTC,alerts,$two,Resolved\n"
+	if uploaded != want || contentType != "text/csv" {
+		t.Errorf("Bad CSV upload (%s): want\n%s\ngot\n%s", contentType, want, uploaded)
+	}
+
+	if _, err = s.cmdExport(cli, groupRoomID, adminUserID, []string{"1", "week"}, now); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if !strings.Contains(uploaded, "<td class=\"body\">Disk &lt;full&gt;, on &#34;hyrule&#34;</td>") || contentType != "text/html" {
+		t.Errorf("Bad HTML upload (%s):\n%s", contentType, uploaded)
+	}
+
+	content, err = s.cmdExport(cli, dmRoomID, adminUserID, []string{"30d"}, now)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if body := content.(*mevt.MessageEventContent).Body; !strings.HasPrefix(body, "I haven't sent any notifications") {
+		t.Errorf("Expected no notifications, got %q", body)
+	}
+}
+
+type auditStore struct {
+	database.NopStorage
+	query database.AuditQuery
+}
+
+func (d *auditStore) LoadAuditEntries(q database.AuditQuery) ([]database.AuditEntry, error) {
+	d.query = q
+	if q.RoomID != groupRoomID {
+		return nil, nil
+	}
+	return []database.AuditEntry{
+		{Kind: database.AuditCommand, UserID: adminUserID, RoomID: groupRoomID, ServiceID: "github",
+			Command: "github create", Outcome: database.AuditDenied, Detail: "You must be a room moderator",
+			Timestamp: time.Date(2016, 1, 5, 15, 0, 0, 0, time.UTC)},
+		{Kind: database.AuditWebhookSend, UserID: botUserID, RoomID: groupRoomID, ServiceID: "alerts",
+			Outcome: database.AuditSuccess, Timestamp: time.Date(2016, 1, 5, 14, 50, 0, 0, time.UTC)},
+	}, nil
+}
+
+func TestAudit(t *testing.T) {
+	store := &auditStore{}
+	database.SetServiceDB(store)
+	srv, err := types.CreateService("id", ServiceType, botUserID, []byte(`{"admins":["`+string(adminUserID)+`"]}`))
+	if err != nil {
+		t.Fatal("Failed to create setup service: ", err)
+	}
+	s := srv.(*Service)
+	now := time.Date(2016, 1, 6, 12, 0, 0, 0, time.UTC)
+
+	if _, err := s.cmdAudit(groupRoomID, "@zelda:hyrule", nil, now); err == nil {
+		t.Error("Expected an error for a non-admin")
+	}
+	content, err := s.cmdAudit(groupRoomID, adminUserID, []string{"2d"}, now)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if want := now.AddDate(0, 0, -2); !store.query.Since.Equal(want) || store.query.RoomID != groupRoomID {
+		t.Errorf("Expected entries for the room since %s, got %+v", want, store.query)
+	}
+	want := "Audit log for the last 2 days, newest first:\n" +
+		"2016-01-05 15:00 UTC: @link:hyrule ran !github create (github) - denied: You must be a room moderator\n" +
+		"2016-01-05 14:50 UTC: @neb:hyrule sent a webhook notification (alerts) - success"
+	if body := content.(*mevt.MessageEventContent).Body; body != want {
+		t.Errorf("Bad audit log: want\n%s\ngot\n%s", want, body)
+	}
+
+	content, err = s.cmdAudit(dmRoomID, adminUserID, nil, now)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if body := content.(*mevt.MessageEventContent).Body; body != "Nothing was recorded in this room in the last 1 week." {
+		t.Errorf("Expected nothing recorded, got %q", body)
+	}
+}
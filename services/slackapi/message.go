@@ -2,19 +2,20 @@ package slackapi
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"mime"
 	"net/http"
 	"regexp"
-	"time"
+	"strings"
 
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
 	"github.com/russross/blackfriday"
 	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 type slackAttachment struct {
@@ -36,17 +37,62 @@ type slackAttachment struct {
 	Text         string `json:"text"`
 	TextRendered template.HTML
 
+	Fields         []slackField `json:"fields"`
+	FieldsRendered template.HTML
+	ImageURL       string `json:"image_url"`
+	ImageRendered  template.HTML
+	Blocks         []slackBlock `json:"blocks"`
+	BlocksRendered template.HTML
+
 	MrkdwnIn []string `json:"mrkdwn_in"`
 	TS       *int64   `json:"ts"`
 }
 
+// slackField is a field of an attachment, shown in a table.
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+// slackText is a Block Kit text object, which is either "mrkdwn" or "plain_text".
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// slackBlock is a Block Kit layout block. Only the fields of the types of block which are
+// rendered are included: section, header, divider, image and context.
+type slackBlock struct {
+	Type      string         `json:"type"`
+	Text      *slackText     `json:"text"`
+	Fields    []slackText    `json:"fields"`
+	Accessory *slackElement  `json:"accessory"`
+	Elements  []slackElement `json:"elements"`
+	ImageURL  string         `json:"image_url"`
+	AltText   string         `json:"alt_text"`
+	Title     *slackText     `json:"title"`
+}
+
+// slackElement is a Block Kit element, e.g. a text object or image in a context block, or a
+// section's accessory.
+type slackElement struct {
+	Type string `json:"type"`
+	// A string for text objects, or a text object for buttons.
+	Text     json.RawMessage `json:"text"`
+	ImageURL string          `json:"image_url"`
+	AltText  string          `json:"alt_text"`
+	URL      string          `json:"url"`
+}
+
 type slackMessage struct {
-	Text         string `json:"text"`
-	TextRendered template.HTML
-	Username     string            `json:"username"`
-	Channel      string            `json:"channel"`
-	Mrkdwn       *bool             `json:"mrkdwn"`
-	Attachments  []slackAttachment `json:"attachments"`
+	Text           string `json:"text"`
+	TextRendered   template.HTML
+	Username       string            `json:"username"`
+	Channel        string            `json:"channel"`
+	Mrkdwn         *bool             `json:"mrkdwn"`
+	Attachments    []slackAttachment `json:"attachments"`
+	Blocks         []slackBlock      `json:"blocks"`
+	BlocksRendered template.HTML
 }
 
 // We use text.template because any fields of any attachments could
@@ -54,15 +100,19 @@ type slackMessage struct {
 // We do not do this yet, since it's assumed that clients also escape the content we send them.
 var htmlTemplate, _ = template.New("htmlTemplate").Parse(`
 <strong>@{{ .Username }}</strong> via <strong>#{{ .Channel }}</strong><br />
-{{- with (or .TextRendered .Text nil) }}
-	{{- if . }}
-		{{- . }}<br />
+{{- if .BlocksRendered }}
+	{{- .BlocksRendered }}
+{{- else }}
+	{{- with (or .TextRendered .Text nil) }}
+		{{- if . }}
+			{{- . }}<br />
+		{{- end }}
 	{{- end }}
 {{- end }}
 {{- range .Attachments }}
 		{{- if .AuthorName }}
 			{{- if .AuthorLink }}<a href="{{ .AuthorLink }}">{{ end }}
-				{{- if .AuthorIconUrl }}<img src="{{ .AuthorIconUrl }}" />{{ end }}
+				{{- if .AuthorIconURL }}<img src="{{ .AuthorIconURL }}" />{{ end }}
 				{{- .AuthorName }}
 			{{- if .AuthorLink }}</a>{{ end }}
 			<br />
@@ -78,15 +128,24 @@ var htmlTemplate, _ = template.New("htmlTemplate").Parse(`
 	</strong>
 	{{- if .Pretext }}{{ or .PretextRendered .Pretext }}<br />{{ end }}
 	{{- if .Text }}{{ or .TextRendered .Text }}<br />{{ end }}
+	{{- .FieldsRendered }}
+	{{- .BlocksRendered }}
+	{{- .ImageRendered }}
 {{- end }}
 `)
 
-var netClient = &http.Client{
-	Timeout: time.Second * 10,
-}
+// linkRegex matches Slack's links, e.g. <https://example.com|Example>, but not user mentions.
+var linkRegex, _ = regexp.Compile(`<([^@|>][^|>]*)(\|([^>]+))?>`)
 
-// TODO: What does this do?
-var linkRegex, _ = regexp.Compile(`<([^|]+)(\|([^>]+))?>`)
+// mentionRegex matches Slack's user mentions, e.g. <@U024BE7LH> or <@U024BE7LH|alice>.
+var mentionRegex = regexp.MustCompile(`<@([A-Z0-9]+)(?:\|([^>]+))?>`)
+
+// renderer converts the parts of Slack messages into Matrix HTML.
+type renderer struct {
+	cli types.MatrixClient
+	// Slack user IDs to Matrix user IDs, see Service.Users.
+	users map[string]id.UserID
+}
 
 func getSlackMessage(req http.Request) (message slackMessage, err error) {
 	ct := req.Header.Get("Content-Type")
@@ -111,6 +170,135 @@ func linkifyString(text string) string {
 	return linkRegex.ReplaceAllString(text, "<a href=\"$1\">$3</a>")
 }
 
+// mentions replaces Slack user mentions with mentions of the Matrix users they are mapped to, or
+// with the user's name if they aren't mapped.
+func (r *renderer) mentions(text string) string {
+	return mentionRegex.ReplaceAllStringFunc(text, func(mention string) string {
+		m := mentionRegex.FindStringSubmatch(mention)
+		if userID, ok := r.users[m[1]]; ok {
+			return fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, template.HTMLEscapeString(string(userID)),
+				template.HTMLEscapeString(string(userID)))
+		}
+		if m[2] != "" {
+			return "@" + template.HTMLEscapeString(m[2])
+		}
+		return "@" + m[1]
+	})
+}
+
+// mrkdwn renders Slack formatted text.
+func (r *renderer) mrkdwn(text string) template.HTML {
+	return template.HTML(blackfriday.MarkdownBasic([]byte(r.mentions(linkifyString(text)))))
+}
+
+// text renders a Block Kit text object.
+func (r *renderer) text(t *slackText) template.HTML {
+	if t == nil {
+		return ""
+	}
+	if t.Type == "mrkdwn" {
+		return r.mrkdwn(t.Text)
+	}
+	return template.HTML(template.HTMLEscapeString(t.Text))
+}
+
+// image uploads the image to the homeserver and returns an <img> of it. If it can't be
+// uploaded, it is linked instead.
+func (r *renderer) image(url, alt string) template.HTML {
+	if url == "" {
+		return ""
+	}
+	if alt == "" {
+		alt = url[strings.LastIndex(url, "/")+1:]
+	}
+	resUpload, err := r.cli.UploadLink(url)
+	if err != nil {
+		log.WithError(err).WithField("url", url).Error("Failed to upload Slack image")
+		return template.HTML(fmt.Sprintf(`<a href="%s">%s</a>`, template.HTMLEscapeString(url), template.HTMLEscapeString(alt)))
+	}
+	return template.HTML(fmt.Sprintf(`<img src="%s" alt="%s" />`,
+		template.HTMLEscapeString(resUpload.ContentURI.String()), template.HTMLEscapeString(alt)))
+}
+
+// element renders a Block Kit element: text, an image or a link button.
+func (r *renderer) element(e *slackElement) template.HTML {
+	switch e.Type {
+	case "image":
+		return r.image(e.ImageURL, e.AltText)
+	case "mrkdwn", "plain_text":
+		var text string
+		if err := json.Unmarshal(e.Text, &text); err != nil {
+			return ""
+		}
+		return r.text(&slackText{Type: e.Type, Text: text})
+	case "button":
+		var text slackText
+		if err := json.Unmarshal(e.Text, &text); err != nil || e.URL == "" {
+			return ""
+		}
+		return template.HTML(fmt.Sprintf(`<a href="%s">%s</a>`, template.HTMLEscapeString(e.URL), r.text(&text)))
+	}
+	return ""
+}
+
+// blocks renders Block Kit blocks. Sections' fields are rendered as lists. Interactive blocks,
+// such as inputs and menus, aren't rendered.
+func (r *renderer) blocks(blocks []slackBlock) template.HTML {
+	var sb strings.Builder
+	for i := range blocks {
+		b := &blocks[i]
+		switch b.Type {
+		case "header":
+			sb.WriteString("<h4>" + string(r.text(b.Text)) + "</h4>")
+		case "divider":
+			sb.WriteString("<hr />")
+		case "image":
+			sb.WriteString("<p>")
+			if b.Title != nil {
+				sb.WriteString(string(r.text(b.Title)) + "<br />")
+			}
+			sb.WriteString(string(r.image(b.ImageURL, b.AltText)) + "</p>")
+		case "context":
+			var parts []string
+			for j := range b.Elements {
+				if part := r.element(&b.Elements[j]); part != "" {
+					parts = append(parts, string(part))
+				}
+			}
+			if len(parts) > 0 {
+				sb.WriteString("<p><em>" + strings.Join(parts, " · ") + "</em></p>")
+			}
+		case "section":
+			sb.WriteString(string(r.text(b.Text)))
+			if len(b.Fields) > 0 {
+				sb.WriteString("<ul>")
+				for j := range b.Fields {
+					sb.WriteString("<li>" + string(r.text(&b.Fields[j])) + "</li>")
+				}
+				sb.WriteString("</ul>")
+			}
+			if b.Accessory != nil {
+				sb.WriteString(string(r.element(b.Accessory)))
+			}
+		}
+	}
+	return template.HTML(sb.String())
+}
+
+// fields renders an attachment's fields as a table.
+func (r *renderer) fields(fields []slackField) template.HTML {
+	if len(fields) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("<table>")
+	for _, f := range fields {
+		sb.WriteString("<tr><th>" + template.HTMLEscapeString(f.Title) + "</th><td>" + string(r.mrkdwn(f.Value)) + "</td></tr>")
+	}
+	sb.WriteString("</table>")
+	return template.HTML(sb.String())
+}
+
 // Convert a Slack colour (defined at https://api.slack.com/docs/message-attachments )
 // into an HTML color.
 func getColor(color *string) string {
@@ -131,44 +319,20 @@ func getColor(color *string) string {
 	return *color
 }
 
-// fetches an image and encodes it as a data URL
-// returns an empty string if fetch fails
-func fetchAndEncodeImage(url *string) (data template.URL) {
-	if url == nil {
-		return
-	}
-
-	var resp *http.Response
-	resp, err := netClient.Get(*url)
-	if err != nil {
-		log.WithError(err).WithField("url", url).Error("Failed to GET URL")
-		return
-	}
-
-	var (
-		body        []byte
-		contentType string
-	)
-
-	if body, err = ioutil.ReadAll(resp.Body); err != nil {
-		return
-	}
-	if contentType, _, err = mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil {
-		return
-	}
-	base64Body := base64.StdEncoding.EncodeToString(body)
-	data = template.URL(fmt.Sprintf("data:%s;base64,%s", contentType, base64Body))
-
-	return
-}
-
-func renderSlackAttachment(attachment *slackAttachment) {
+func (r *renderer) renderSlackAttachment(attachment *slackAttachment) {
 	if attachment == nil {
 		return
 	}
 
 	attachment.ColorRendered = template.HTMLAttr(getColor(attachment.Color))
-	attachment.AuthorIconURL = fetchAndEncodeImage(attachment.AuthorIcon)
+	if attachment.AuthorIcon != nil {
+		if resUpload, err := r.cli.UploadLink(*attachment.AuthorIcon); err == nil {
+			attachment.AuthorIconURL = template.URL(resUpload.ContentURI.String())
+		}
+	}
+	attachment.FieldsRendered = r.fields(attachment.Fields)
+	attachment.BlocksRendered = r.blocks(attachment.Blocks)
+	attachment.ImageRendered = r.image(attachment.ImageURL, "")
 
 	for _, fieldName := range attachment.MrkdwnIn {
 		var (
@@ -189,37 +353,28 @@ func renderSlackAttachment(attachment *slackAttachment) {
 		}
 
 		if targetField != nil && srcField != nil {
-			*targetField = template.HTML(
-				blackfriday.MarkdownBasic([]byte(linkifyString(*srcField))))
+			*targetField = r.mrkdwn(*srcField)
 		}
 	}
 }
 
-func slackMessageToHTMLMessage(message slackMessage) (html mevt.MessageEventContent, err error) {
-	text := linkifyString(message.Text)
+// slackMessageToHTMLMessage renders the message, its attachments and its Block Kit blocks as HTML.
+// When a message has blocks, its text is only a fallback for notifications, so isn't rendered.
+func (r *renderer) slackMessageToHTMLMessage(message slackMessage) (html mevt.MessageEventContent, err error) {
 	if message.Mrkdwn == nil || *message.Mrkdwn {
-		message.TextRendered = template.HTML(blackfriday.MarkdownBasic([]byte(text)))
+		message.TextRendered = r.mrkdwn(message.Text)
 	}
+	message.BlocksRendered = r.blocks(message.Blocks)
 
 	for attachmentID := range message.Attachments {
-		renderSlackAttachment(&message.Attachments[attachmentID])
+		r.renderSlackAttachment(&message.Attachments[attachmentID])
 	}
 
 	var buffer bytes.Buffer
 	html.MsgType = "m.text"
 	html.Format = "org.matrix.custom.html"
-	html.Body, _ = slackMessageToMarkdown(message)
 	err = htmlTemplate.ExecuteTemplate(&buffer, "htmlTemplate", message)
 	html.FormattedBody = buffer.String()
-	return
-}
-
-// This can be improved; Markdown does support all of Slack's formatting
-// Which we're just throwing away at the moment.
-func slackMessageToMarkdown(message slackMessage) (markdown string, err error) {
-	markdown += message.Text + "\n"
-	for _, attachment := range message.Attachments {
-		markdown += attachment.Fallback + "\n"
-	}
+	html.Body = utils.PlainText(html.FormattedBody)
 	return
 }
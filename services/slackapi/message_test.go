@@ -0,0 +1,79 @@
+package slackapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestSlackMessageToHTMLMessage(t *testing.T) {
+	trans := struct{ testutils.MockTransport }{}
+	trans.RT = func(req *http.Request) (*http.Response, error) {
+		switch {
+		case req.URL.Host == "images.slack":
+			return &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Type": []string{"image/png"}},
+				Body:       ioutil.NopCloser(bytes.NewBufferString("png")),
+			}, nil
+		case strings.HasSuffix(req.URL.Path, "/media/r0/upload"):
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://hs/chart"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+	}
+	cli, _ := mautrix.NewClient("https://hs", "@neb:hs", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+	r := &renderer{cli: cli, users: map[string]id.UserID{"U024BE7LH": "@alice:hs"}}
+
+	var message slackMessage
+	if err := json.Unmarshal([]byte(`{
+		"username": "deploybot",
+		"channel": "ops",
+		"text": "fallback which isn't shown",
+		"blocks": [
+			{"type": "header", "text": {"type": "plain_text", "text": "Deploy <finished>"}},
+			{"type": "section", "text": {"type": "mrkdwn", "text": "Deployed by <@U024BE7LH> and <@U0G9QF9C6|bob>"},
+			 "fields": [{"type": "mrkdwn", "text": "*Env*: prod"}]},
+			{"type": "divider"},
+			{"type": "image", "image_url": "https://images.slack/chart.png", "alt_text": "Latency"},
+			{"type": "context", "elements": [{"type": "plain_text", "text": "v1.2"}]}
+		],
+		"attachments": [
+			{"title": "Checks", "fields": [{"title": "Tests", "value": "passed"}]}
+		]
+	}`), &message); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := r.slackMessageToHTMLMessage(message)
+	if err != nil {
+		t.Fatalf("Failed to render message: %s", err)
+	}
+
+	for _, want := range []string{
+		"<h4>Deploy &lt;finished&gt;</h4>",
+		`Deployed by <a href="https://matrix.to/#/@alice:hs">@alice:hs</a> and @bob`,
+		"<li><p><em>Env</em>: prod</p>\n</li>",
+		"<hr />",
+		`<img src="mxc://hs/chart" alt="Latency" />`,
+		"<p><em>v1.2</em></p>",
+		"<table><tr><th>Tests</th><td><p>passed</p>\n</td></tr></table>",
+	} {
+		if !strings.Contains(msg.FormattedBody, want) {
+			t.Errorf("Expected the HTML to contain %q, got %s", want, msg.FormattedBody)
+		}
+	}
+	if strings.Contains(msg.FormattedBody, "fallback") {
+		t.Errorf("Expected the text of a message with blocks not to be shown, got %s", msg.FormattedBody)
+	}
+}
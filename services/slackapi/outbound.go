@@ -0,0 +1,100 @@
+package slackapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// slackEscaper escapes the characters Slack treats as control characters in message text.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackPayload is the JSON body POSTed to a Slack incoming webhook.
+type slackPayload struct {
+	Text     string `json:"text"`
+	Username string `json:"username,omitempty"`
+	Channel  string `json:"channel,omitempty"`
+}
+
+// OnMessage relays messages in the room to Slack, if SlackWebhookURL is set.
+func (s *Service) OnMessage(cli types.MatrixClient, ev *mevt.Event) {
+	if s.SlackWebhookURL == "" || ev.RoomID != s.RoomID {
+		return
+	}
+	text, ok := s.relayText(ev)
+	if !ok {
+		return
+	}
+	go s.relay(ev.Sender, text)
+}
+
+// relayText returns the text to send to Slack for the message, or false if the message shouldn't
+// be relayed.
+func (s *Service) relayText(ev *mevt.Event) (string, bool) {
+	msg := ev.Content.AsMessage()
+	// Notices are sent by bots, including the messages this service sends from Slack, so relaying
+	// them could loop. Edits are skipped as Slack can't apply them to the relayed message.
+	if msg.MsgType == mevt.MsgNotice || (msg.RelatesTo != nil && msg.RelatesTo.Type == mevt.RelReplace) {
+		return "", false
+	}
+	if len(s.RelayUsers) > 0 && !containsUser(s.RelayUsers, ev.Sender) {
+		return "", false
+	}
+	body := msg.Body
+	if s.RelayPrefix != "" {
+		if !strings.HasPrefix(body, s.RelayPrefix) {
+			return "", false
+		}
+		body = strings.TrimSpace(strings.TrimPrefix(body, s.RelayPrefix))
+	}
+	if body == "" {
+		return "", false
+	}
+	if msg.MsgType == mevt.MsgEmote {
+		body = "_" + body + "_"
+	}
+	return slackEscaper.Replace(body), true
+}
+
+// relay POSTs the text to the Slack incoming webhook, as sent by the Matrix user.
+func (s *Service) relay(sender id.UserID, text string) error {
+	logger := log.WithFields(log.Fields{"service_id": s.ServiceID(), "sender": sender})
+	body, err := json.Marshal(slackPayload{
+		Text:     text,
+		Username: sender.String(),
+		Channel:  s.SlackChannel,
+	})
+	if err != nil {
+		return err
+	}
+	res, err := httpClient.Post(s.SlackWebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.WithError(err).Error("Failed to relay message to Slack")
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		logger.WithField("status", res.StatusCode).Error("Failed to relay message to Slack")
+		return fmt.Errorf("request returned HTTP %d", res.StatusCode)
+	}
+	return nil
+}
+
+func containsUser(users []id.UserID, userID id.UserID) bool {
+	for _, u := range users {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
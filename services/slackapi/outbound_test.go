@@ -0,0 +1,75 @@
+package slackapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRelayToSlack(t *testing.T) {
+	s := &Service{
+		RoomID:          "!room:hs",
+		SlackWebhookURL: "https://hooks.slack.com/services/T/B/X",
+		SlackChannel:    "#ops",
+		RelayUsers:      []id.UserID{"@alice:hs"},
+		RelayPrefix:     "!slack",
+	}
+	message := func(sender id.UserID, msg mevt.MessageEventContent) *mevt.Event {
+		return &mevt.Event{
+			Sender:  sender,
+			RoomID:  "!room:hs",
+			Content: mevt.Content{Parsed: &msg},
+		}
+	}
+
+	tests := []struct {
+		name string
+		ev   *mevt.Event
+		text string
+		ok   bool
+	}{
+		{"prefixed", message("@alice:hs", mevt.MessageEventContent{MsgType: mevt.MsgText, Body: "!slack deploy <done> & dusted"}), "deploy &lt;done&gt; &amp; dusted", true},
+		{"emote", message("@alice:hs", mevt.MessageEventContent{MsgType: mevt.MsgEmote, Body: "!slack waves"}), "_waves_", true},
+		{"no prefix", message("@alice:hs", mevt.MessageEventContent{MsgType: mevt.MsgText, Body: "deploy"}), "", false},
+		{"other user", message("@bob:hs", mevt.MessageEventContent{MsgType: mevt.MsgText, Body: "!slack deploy"}), "", false},
+		{"notice", message("@alice:hs", mevt.MessageEventContent{MsgType: mevt.MsgNotice, Body: "!slack deploy"}), "", false},
+		{"edit", message("@alice:hs", mevt.MessageEventContent{
+			MsgType:   mevt.MsgText,
+			Body:      "!slack deploy",
+			RelatesTo: &mevt.RelatesTo{Type: mevt.RelReplace, EventID: "$orig"},
+		}), "", false},
+		{"empty", message("@alice:hs", mevt.MessageEventContent{MsgType: mevt.MsgText, Body: "!slack "}), "", false},
+	}
+	for _, test := range tests {
+		text, ok := s.relayText(test.ev)
+		if text != test.text || ok != test.ok {
+			t.Errorf("%s: relayText returned (%q, %v), want (%q, %v)", test.name, text, ok, test.text, test.ok)
+		}
+	}
+
+	var got slackPayload
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != s.SlackWebhookURL {
+			t.Errorf("relay POSTed to %s, want %s", req.URL, s.SlackWebhookURL)
+		}
+		if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+			t.Errorf("Failed to decode relayed message: %s", err)
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString("ok"))}, nil
+	})}
+	defer func() { httpClient = &http.Client{} }()
+
+	if err := s.relay("@alice:hs", "deploy"); err != nil {
+		t.Fatalf("relay returned an error: %s", err)
+	}
+	want := slackPayload{Text: "deploy", Username: "@alice:hs", Channel: "#ops"}
+	if got != want {
+		t.Errorf("relay sent %+v, want %+v", got, want)
+	}
+}
@@ -1,9 +1,12 @@
 package slackapi
 
 import (
+	"errors"
 	"net/http"
+	"net/url"
 	"strings"
 
+	"github.com/matrix-org/go-neb/logging"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	"maunium.net/go/mautrix/event"
@@ -16,12 +19,24 @@ const ServiceType = "slackapi"
 // Service contains the Config fields for the Slack API service.
 //
 // This service will send HTML formatted messages into a room when an outgoing slack webhook
-// hits WebhookURL.
+// hits WebhookURL. Attachments and Block Kit sections, fields, headers, images and context are
+// rendered, with images uploaded to the homeserver. Mentions of Slack users in Users are turned
+// into mentions of their Matrix users.
+//
+// If SlackWebhookURL is set, messages posted in the room are also relayed to that Slack incoming
+// webhook, making the service a simple two-way bridge. Notices and edits are never relayed, and
+// RelayUsers and RelayPrefix limit which messages are.
 //
 // Example JSON request:
 // {
 //   "room_id": "!someroomid:some.domain.com",
-//   "message_type": "m.text"
+//   "message_type": "m.text",
+//   "users": {
+//     "U024BE7LH": "@alice:some.domain.com"
+//   },
+//   "slack_webhook_url": "https://hooks.slack.com/services/T000/B000/XXXX",
+//   "slack_channel": "#ops",
+//   "relay_prefix": "!slack"
 // }
 type Service struct {
 	types.DefaultService
@@ -30,6 +45,16 @@ type Service struct {
 	WebhookURL  string            `json:"webhook_url"`
 	RoomID      id.RoomID         `json:"room_id"`
 	MessageType event.MessageType `json:"message_type"`
+	// Optional. Slack user IDs to the Matrix user IDs to mention in their place.
+	Users map[string]id.UserID `json:"users"`
+	// Optional. The Slack incoming webhook to relay messages in the room to.
+	SlackWebhookURL string `json:"slack_webhook_url"`
+	// Optional. The Slack channel to post relayed messages in, instead of the webhook's default.
+	SlackChannel string `json:"slack_channel"`
+	// Optional. Only relay messages from these Matrix users.
+	RelayUsers []id.UserID `json:"relay_users"`
+	// Optional. Only relay messages starting with this prefix, which is removed.
+	RelayPrefix string `json:"relay_prefix"`
 }
 
 // OnReceiveWebhook receives requests from a slack outgoing webhook and possibly sends requests
@@ -37,6 +62,7 @@ type Service struct {
 //
 // This requires that the WebhookURL is given to an outgoing slack webhook (see https://api.slack.com/outgoing-webhooks)
 func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	logger := logging.FromContext(req.Context())
 	segments := strings.Split(req.URL.Path, "/")
 
 	if len(segments) < 2 {
@@ -52,14 +78,15 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 
 	slackMessage, err := getSlackMessage(*req)
 	if err != nil {
-		log.WithFields(log.Fields{"slackMessage": slackMessage, log.ErrorKey: err}).Error("Slack message error")
+		logger.WithFields(log.Fields{"slackMessage": slackMessage, log.ErrorKey: err}).Error("Slack message error")
 		w.WriteHeader(500)
 		return
 	}
 
-	htmlMessage, err := slackMessageToHTMLMessage(slackMessage)
+	r := &renderer{cli: cli, users: s.Users}
+	htmlMessage, err := r.slackMessageToHTMLMessage(slackMessage)
 	if err != nil {
-		log.WithError(err).Error("Converting slack message to HTML")
+		logger.WithError(err).Error("Converting slack message to HTML")
 		w.WriteHeader(500)
 		return
 	}
@@ -70,8 +97,19 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 	w.WriteHeader(200)
 }
 
+// TargetRooms returns the room Slack messages are sent into.
+func (s *Service) TargetRooms() []id.RoomID {
+	return []id.RoomID{s.RoomID}
+}
+
 // Register joins the configured room and sets the public WebhookURL
 func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.SlackWebhookURL != "" {
+		u, err := url.Parse(s.SlackWebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("slack_webhook_url must be an http or https URL")
+		}
+	}
 	s.WebhookURL = s.webhookEndpointURL
 	if _, err := client.JoinRoom(s.RoomID.String(), "", nil); err != nil {
 		log.WithFields(log.Fields{
@@ -0,0 +1,407 @@
+// Package summarize implements a Service which summarizes conversations and web pages with an LLM.
+package summarize
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaytaylor/html2text"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Summarize service
+const ServiceType = "summarize"
+
+// Defaults for the config fields.
+const (
+	DefaultAPIURL          = "https://api.openai.com/v1"
+	DefaultMaxInputTokens  = 3000
+	DefaultMaxOutputTokens = 300
+	DefaultMessages        = 50
+)
+
+// The most messages which can be summarized at once.
+const maxMessages = 200
+
+// The largest web page which is fetched by !tldr.
+const maxPageSize = 2 << 20
+
+// Tokens are estimated from the input length, as tokenizers differ between models. Most
+// tokenizers average about 4 characters of English per token.
+const charsPerToken = 4
+
+const (
+	conversationPrompt = "Summarize the following chat conversation in a few short bullet points. Mention who decided or asked for what."
+	pagePrompt         = "Summarize the following web page in a few sentences."
+)
+
+var httpClient = &http.Client{Timeout: time.Minute}
+
+// Service contains the Config fields for the Summarize Service.
+//
+// This service sends room messages and web pages to an external LLM API, so it is opt-in per
+// room: commands only work in the rooms listed in the config, and optionally only for some
+// users. Any OpenAI-compatible chat completions API can be used, including self-hosted ones.
+// Input is truncated to max_input_tokens, keeping the most recent messages, and responses
+// are limited to max_output_tokens. Messages in encrypted rooms can't be summarized.
+//
+// Example request:
+//   {
+//       "api_url": "https://api.openai.com/v1",
+//       "api_key": "sk-...",
+//       "model": "gpt-4o-mini",
+//       "max_input_tokens": 2000,
+//       "rooms": {
+//           "!qmElAGdFYCHoCJuaNt:localhost": {},
+//           "!wfEDRAwRuaNtPdlgNt:localhost": {
+//               "allowed_users": ["@alice:localhost"]
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// The base URL of the OpenAI-compatible API. Defaults to DefaultAPIURL.
+	APIURL string `json:"api_url"`
+	// The API key, which is sent as a bearer token. This may instead be a reference to a secret store, see the secrets package.
+	APIKey string `json:"api_key"`
+	// The model to use. Required.
+	Model string `json:"model"`
+	// The most tokens to send to the API per command. Defaults to DefaultMaxInputTokens.
+	MaxInputTokens int `json:"max_input_tokens"`
+	// The most tokens the API may respond with. Defaults to DefaultMaxOutputTokens.
+	MaxOutputTokens int `json:"max_output_tokens"`
+	// The rooms where the commands are enabled.
+	Rooms map[id.RoomID]struct {
+		// The users who may use the commands in this room. Defaults to everyone in the room.
+		AllowedUsers []id.UserID `json:"allowed_users"`
+	} `json:"rooms"`
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatRequest struct {
+	Model     string        `json:"model"`
+	Messages  []chatMessage `json:"messages"`
+	MaxTokens int           `json:"max_tokens"`
+}
+
+type chatResponse struct {
+	Choices []struct {
+		Message chatMessage `json:"message"`
+	} `json:"choices"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// roomEvent is the part of an m.room.message event which is summarized.
+type roomEvent struct {
+	Sender  id.UserID `json:"sender"`
+	Content struct {
+		Body string `json:"body"`
+	} `json:"content"`
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.Model == "" {
+		return errors.New("A model is required")
+	}
+	if len(s.Rooms) == 0 {
+		return errors.New("At least one room must be enabled")
+	}
+	if s.APIURL == "" {
+		s.APIURL = DefaultAPIURL
+	}
+	if _, err := url.Parse(s.APIURL); err != nil {
+		return fmt.Errorf("api_url is invalid: %s", err)
+	}
+	if s.MaxInputTokens < 0 || s.MaxOutputTokens < 0 {
+		return errors.New("Token limits cannot be negative")
+	}
+	return nil
+}
+
+// Commands supported:
+//    !summarize [N]
+// Summarizes the last N messages in the room, 50 by default.
+//    !summarize $threadRootEventID
+// Summarizes a thread.
+//    !tldr https://example.com/some/article
+// Summarizes a web page.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"summarize"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				if err := s.checkAllowed(roomID, userID); err != nil {
+					return nil, err
+				}
+				return s.cmdSummarize(cli, roomID, args)
+			},
+		},
+		{
+			Path: []string{"tldr"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				if err := s.checkAllowed(roomID, userID); err != nil {
+					return nil, err
+				}
+				return s.cmdTLDR(args)
+			},
+		},
+	}
+}
+
+func (s *Service) checkAllowed(roomID id.RoomID, userID id.UserID) error {
+	room, ok := s.Rooms[roomID]
+	if !ok {
+		return errors.New("Summaries are not enabled in this room")
+	}
+	if len(room.AllowedUsers) == 0 {
+		return nil
+	}
+	for _, allowed := range room.AllowedUsers {
+		if allowed == userID {
+			return nil
+		}
+	}
+	return errors.New("You are not allowed to request summaries in this room")
+}
+
+func (s *Service) cmdSummarize(cli types.MatrixClient, roomID id.RoomID, args []string) (interface{}, error) {
+	if len(args) > 1 {
+		return notice("Usage: !summarize [number of messages | thread root event ID]"), nil
+	}
+	var lines []string
+	var err error
+	if len(args) == 1 && strings.HasPrefix(args[0], "$") {
+		lines, err = s.threadMessages(cli, roomID, id.EventID(args[0]))
+	} else {
+		n := DefaultMessages
+		if len(args) == 1 {
+			if n, err = strconv.Atoi(args[0]); err != nil || n < 1 || n > maxMessages {
+				return nil, fmt.Errorf("The number of messages must be between 1 and %d", maxMessages)
+			}
+		}
+		lines, err = s.recentMessages(cli, roomID, n)
+	}
+	if err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("Failed to fetch messages to summarize")
+		return nil, errors.New("Failed to fetch the messages to summarize")
+	}
+	if len(lines) == 0 {
+		return notice("There are no messages to summarize."), nil
+	}
+	// Keep the most recent messages which fit within the limit
+	limit := s.maxInputChars()
+	total := 0
+	start := len(lines)
+	for start > 0 && total+len(lines[start-1])+1 <= limit {
+		start--
+		total += len(lines[start]) + 1
+	}
+	if start == len(lines) {
+		return nil, errors.New("The latest message is too long to summarize")
+	}
+	summary, err := s.complete(conversationPrompt, strings.Join(lines[start:], "\n"))
+	if err != nil {
+		return nil, err
+	}
+	return notice(fmt.Sprintf("Summary of the last %d messages:\n%s", len(lines)-start, summary)), nil
+}
+
+func (s *Service) cmdTLDR(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return notice("Usage: !tldr https://example.com/some/article"), nil
+	}
+	u, err := url.Parse(args[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.New("That doesn't look like a web page URL")
+	}
+	text, err := fetchPage(u.String())
+	if err != nil {
+		log.WithError(err).WithField("url", u.String()).Warn("Failed to fetch page to summarize")
+		return nil, errors.New("Failed to fetch that page")
+	}
+	if limit := s.maxInputChars(); len(text) > limit {
+		text = text[:limit]
+	}
+	summary, err := s.complete(pagePrompt, text)
+	if err != nil {
+		return nil, err
+	}
+	return notice("TL;DR: " + summary), nil
+}
+
+func (s *Service) maxInputChars() int {
+	tokens := s.MaxInputTokens
+	if tokens == 0 {
+		tokens = DefaultMaxInputTokens
+	}
+	return tokens * charsPerToken
+}
+
+// recentMessages returns the last n messages in the room as "sender: body" lines, oldest first.
+func (s *Service) recentMessages(cli types.MatrixClient, roomID id.RoomID, n int) ([]string, error) {
+	filter, err := json.Marshal(mautrix.FilterPart{Types: []mevt.Type{mevt.EventMessage}})
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(cli.BuildBaseURL("_matrix", "client", "r0", "rooms", roomID, "messages"))
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("dir", "b")
+	q.Set("limit", strconv.Itoa(n+1)) // +1 to skip the !summarize command itself
+	q.Set("filter", string(filter))
+	u.RawQuery = q.Encode()
+	var resp struct {
+		Chunk []roomEvent `json:"chunk"`
+	}
+	if _, err := cli.MakeRequest("GET", u.String(), nil, &resp); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for i := len(resp.Chunk) - 1; i >= 0; i-- {
+		lines = appendLine(lines, resp.Chunk[i])
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// threadMessages returns the root and replies of a thread as "sender: body" lines, oldest first.
+func (s *Service) threadMessages(cli types.MatrixClient, roomID id.RoomID, rootID id.EventID) ([]string, error) {
+	var root roomEvent
+	if _, err := cli.MakeRequest("GET", cli.BuildBaseURL("_matrix", "client", "r0", "rooms", roomID, "event", rootID), nil, &root); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(cli.BuildBaseURL("_matrix", "client", "v1", "rooms", roomID, "relations", rootID, "m.thread"))
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("limit", strconv.Itoa(maxMessages))
+	u.RawQuery = q.Encode()
+	var resp struct {
+		Chunk []roomEvent `json:"chunk"`
+	}
+	if _, err := cli.MakeRequest("GET", u.String(), nil, &resp); err != nil {
+		return nil, err
+	}
+	lines := appendLine(nil, root)
+	for i := len(resp.Chunk) - 1; i >= 0; i-- {
+		lines = appendLine(lines, resp.Chunk[i])
+	}
+	return lines, nil
+}
+
+func appendLine(lines []string, ev roomEvent) []string {
+	body := strings.TrimSpace(ev.Content.Body)
+	if body == "" || strings.HasPrefix(body, "!") {
+		return lines // redacted or encrypted messages, and bot commands
+	}
+	return append(lines, fmt.Sprintf("%s: %s", ev.Sender, body))
+}
+
+// fetchPage returns the text of a web page.
+func fetchPage(pageURL string) (string, error) {
+	res, err := httpClient.Get(pageURL)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("request returned HTTP %d", res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(&io.LimitedReader{R: res.Body, N: maxPageSize})
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(res.Header.Get("Content-Type"), "html") {
+		return string(body), nil
+	}
+	return html2text.FromString(string(body), html2text.Options{OmitLinks: true})
+}
+
+// complete sends the prompt and input to the chat completions API and returns its reply.
+func (s *Service) complete(prompt, input string) (string, error) {
+	maxTokens := s.MaxOutputTokens
+	if maxTokens == 0 {
+		maxTokens = DefaultMaxOutputTokens
+	}
+	reqBody, err := json.Marshal(chatRequest{
+		Model: s.Model,
+		Messages: []chatMessage{
+			{Role: "system", Content: prompt},
+			{Role: "user", Content: input},
+		},
+		MaxTokens: maxTokens,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(s.APIURL, "/")+"/chat/completions", bytes.NewReader(reqBody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.APIKey != "" {
+		apiKey, err := secrets.Resolve(s.APIKey)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		log.WithError(err).Error("Failed to call the summarization API")
+		return "", errors.New("Failed to reach the summarization API")
+	}
+	defer res.Body.Close()
+	var resp chatResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return "", fmt.Errorf("The summarization API returned HTTP %d", res.StatusCode)
+	}
+	if resp.Error != nil {
+		return "", fmt.Errorf("The summarization API returned an error: %s", resp.Error.Message)
+	}
+	if len(resp.Choices) == 0 {
+		return "", errors.New("The summarization API returned no summary")
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
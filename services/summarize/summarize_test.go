@@ -0,0 +1,103 @@
+package summarize
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const roomID = id.RoomID("!kitchen:hyrule")
+
+func response(body string) *http.Response {
+	return &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": []string{"text/html"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+	}
+}
+
+func TestCommands(t *testing.T) {
+	var prompts []chatRequest
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "example.com" {
+			return response(`<html><body><h1>Ocarina</h1><p>A musical instrument.</p></body></html>`), nil
+		}
+		if req.URL.String() != "https://llm.hyrule/v1/chat/completions" || req.Header.Get("Authorization") != "Bearer sk-triforce" {
+			t.Errorf("Bad API request: %s %v", req.URL, req.Header)
+		}
+		var r chatRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			t.Fatal("Failed to decode API request: ", err)
+		}
+		prompts = append(prompts, r)
+		return response(`{"choices":[{"message":{"role":"assistant","content":" The sword was found. "}}]}`), nil
+	})}
+	defer func() { httpClient = &http.Client{} }()
+
+	matrixTrans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if !strings.HasSuffix(req.URL.Path, "/messages") {
+			t.Errorf("Unexpected request: %s", req.URL)
+		}
+		// Newest first, as returned by /messages?dir=b
+		return response(`{"chunk":[
+			{"sender":"@link:hyrule","content":{"body":"!summarize 2"}},
+			{"sender":"@zelda:hyrule","content":{"body":"Found it in the woods"}},
+			{"sender":"@link:hyrule","content":{"body":"Where is the sword?"}},
+			{"sender":"@link:hyrule","content":{}}
+		]}`), nil
+	})
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: matrixTrans}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"api_url": "https://llm.hyrule/v1/",
+		"api_key": "sk-triforce",
+		"model": "tiny",
+		"max_input_tokens": 12,
+		"rooms": {"!kitchen:hyrule": {"allowed_users": ["@link:hyrule"]}}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	if err := srv.Register(nil, cli); err != nil {
+		t.Fatal("Failed to register service: ", err)
+	}
+	s := srv.(*Service)
+	cmds := s.Commands(cli)
+
+	if _, err := cmds[0].Command("!other:hyrule", "@link:hyrule", nil); err == nil {
+		t.Error("Expected summaries to be disabled in unlisted rooms")
+	}
+	if _, err := cmds[0].Command(roomID, "@ganon:hyrule", nil); err == nil {
+		t.Error("Expected users who aren't allowed to be refused")
+	}
+
+	content, err := cmds[0].Command(roomID, "@link:hyrule", []string{"2"})
+	if err != nil {
+		t.Fatal("!summarize failed: ", err)
+	}
+	// 12 tokens is only enough for the latest message
+	if got := content.(*mevt.MessageEventContent).Body; got != "Summary of the last 1 messages:\nThe sword was found." {
+		t.Errorf("Unexpected summary: %q", got)
+	}
+	if len(prompts) != 1 || prompts[0].Model != "tiny" || prompts[0].MaxTokens != DefaultMaxOutputTokens ||
+		prompts[0].Messages[1].Content != "@zelda:hyrule: Found it in the woods" {
+		t.Errorf("Bad API request: %+v", prompts)
+	}
+
+	if _, err := cmds[1].Command(roomID, "@link:hyrule", []string{"https://example.com/ocarina"}); err != nil {
+		t.Fatal("!tldr failed: ", err)
+	}
+	if got := prompts[1].Messages[1].Content; !strings.Contains(got, "Ocarina") || strings.Contains(got, "<") || len(got) > 48 {
+		t.Errorf("Expected the page text, truncated to the input limit, got %q", got)
+	}
+}
@@ -0,0 +1,252 @@
+// Package timer implements a Service which runs countdown timers, e.g. "!timer 15m pizza".
+package timer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/services/utils"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Timer service
+const ServiceType = "timer"
+
+// The shortest and longest timers. Anything longer is better served by !remind.
+const (
+	minDuration = time.Second
+	maxDuration = 7 * 24 * time.Hour
+)
+
+// The maximum number of running timers in a room, so that one room can't fill the service's config.
+const maxTimersPerRoom = 50
+
+// How late a timer can go off, e.g. because Go-NEB was down, before saying it is late.
+const lateThreshold = time.Minute
+
+// Timer is a countdown which pings a user when it ends.
+type Timer struct {
+	ID     string    `json:"id"`
+	RoomID id.RoomID `json:"room_id"`
+	UserID id.UserID `json:"user_id"`
+	// What the timer is for, e.g. "pizza". May be empty.
+	Label string `json:"label,omitempty"`
+	// When the timer was started and when it ends.
+	StartedTimestampSecs int64 `json:"started_ts_secs"`
+	EndsTimestampSecs    int64 `json:"ends_ts_secs"`
+}
+
+// Service contains the Config fields for the Timer Service. It has no Config fields which need to
+// be set: timers are started with !timer and stored as part of the service, so they survive
+// restarts.
+//
+// Example request:
+//   {
+//   }
+type Service struct {
+	types.DefaultService
+	// The running timers. This is populated by Go-NEB.
+	Timers []Timer `json:"timers"`
+	// The ID to give the next new timer. This is populated by Go-NEB.
+	NextID int `json:"next_id"`
+}
+
+// Commands supported:
+//    !timer 15m pizza
+//    !timer 1 hour and 30 minutes
+// Starts a timer which pings the user in this room when it ends.
+//    !timers
+// Lists the running timers in this room.
+//    !timer cancel 3
+// Cancels one of the user's timers.
+func (s *Service) Commands(cli types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"timers"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdList(roomID)
+			},
+		},
+		{
+			Path: []string{"timer", "cancel"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdCancel(roomID, userID, args)
+			},
+		},
+		{
+			Path: []string{"timer"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdStart(roomID, userID, args)
+			},
+		},
+	}
+}
+
+func usageMessage() *mevt.MessageEventContent {
+	return notice("Usage: !timer 15m pizza | !timers | !timer cancel id")
+}
+
+func (s *Service) cmdStart(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	d, rest, ok := utils.ParseDuration(args)
+	if !ok || len(rest) == len(args) {
+		return usageMessage(), nil
+	}
+	if d < minDuration || d > maxDuration {
+		return nil, fmt.Errorf("Timers must be between %s and %s long. Try !remind for anything longer",
+			utils.HumanDuration(minDuration), utils.HumanDuration(maxDuration))
+	}
+	now := time.Now()
+	t := Timer{
+		RoomID:               roomID,
+		UserID:               userID,
+		Label:                strings.Join(rest, " "),
+		StartedTimestampSecs: now.Unix(),
+		EndsTimestampSecs:    now.Add(d).Unix(),
+	}
+	return s.update(func(latest *Service) (interface{}, error) {
+		if len(latest.timersInRoom(roomID)) >= maxTimersPerRoom {
+			return nil, fmt.Errorf("There are already %d timers running in this room", maxTimersPerRoom)
+		}
+		latest.NextID++
+		t.ID = strconv.Itoa(latest.NextID)
+		latest.Timers = append(latest.Timers, t)
+		return notice(fmt.Sprintf("Timer %s started: %s%s.", t.ID, utils.HumanDuration(d), t.forLabel())), nil
+	})
+}
+
+func (s *Service) cmdList(roomID id.RoomID) (interface{}, error) {
+	now := time.Now()
+	var buf bytes.Buffer
+	for _, t := range s.timersInRoom(roomID) {
+		left := time.Unix(t.EndsTimestampSecs, 0).Sub(now)
+		if left < time.Second {
+			left = time.Second // about to go off
+		}
+		buf.WriteString(fmt.Sprintf("%s%s: %s left, started by %s\n", t.ID, t.forLabel(), utils.HumanDuration(left), t.UserID))
+	}
+	if buf.Len() == 0 {
+		return notice("There are no timers running in this room."), nil
+	}
+	return notice(strings.TrimSuffix(buf.String(), "\n")), nil
+}
+
+func (s *Service) cmdCancel(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return usageMessage(), nil
+	}
+	return s.update(func(latest *Service) (interface{}, error) {
+		for i, t := range latest.Timers {
+			if t.ID == args[0] && t.RoomID == roomID && t.UserID == userID {
+				latest.Timers = append(latest.Timers[:i], latest.Timers[i+1:]...)
+				return notice("Cancelled timer " + t.ID + t.forLabel() + "."), nil
+			}
+		}
+		return nil, errors.New("You have no timer " + args[0] + " in this room")
+	})
+}
+
+func (s *Service) timersInRoom(roomID id.RoomID) []Timer {
+	var timers []Timer
+	for _, t := range s.Timers {
+		if t.RoomID == roomID {
+			timers = append(timers, t)
+		}
+	}
+	return timers
+}
+
+// forLabel returns ` for "pizza"`, or nothing if the timer has no label.
+func (t *Timer) forLabel() string {
+	if t.Label == "" {
+		return ""
+	}
+	return fmt.Sprintf(" for %q", t.Label)
+}
+
+// update applies fn to the latest copy of the service, see polling.Update.
+func (s *Service) update(fn func(latest *Service) (interface{}, error)) (interface{}, error) {
+	return polling.Update(s, true, func(latest types.Service) (interface{}, error) {
+		return fn(latest.(*Service))
+	})
+}
+
+// OnPoll pings the users whose timers have ended. Timers which ended whilst Go-NEB was down go off
+// late rather than being dropped. Returns the time the next timer ends, or 0 if there are none.
+func (s *Service) OnPoll(cli types.MatrixClient) time.Time {
+	defer polling.Lock(s)()
+	latest := polling.Latest(s).(*Service)
+	s.Timers, s.NextID = latest.Timers, latest.NextID
+
+	now := time.Now()
+	var remaining []Timer
+	for _, t := range s.Timers {
+		if t.EndsTimestampSecs > now.Unix() {
+			remaining = append(remaining, t)
+			continue
+		}
+		s.send(cli, t, now)
+	}
+
+	if len(remaining) != len(s.Timers) {
+		s.Timers = remaining
+		if _, err := database.GetServiceDB().StoreService(s); err != nil {
+			log.WithError(err).WithField("service_id", s.ServiceID()).Error("Failed to persist timers")
+			polling.ReportError(s, err)
+		}
+	}
+	return s.nextTimestamp()
+}
+
+// send pings the user who started the timer, mentioning them so that they are notified.
+func (s *Service) send(cli types.MatrixClient, t Timer, now time.Time) {
+	length := utils.HumanDuration(time.Duration(t.EndsTimestampSecs-t.StartedTimestampSecs) * time.Second)
+	late := ""
+	if ends := time.Unix(t.EndsTimestampSecs, 0); now.Sub(ends) > lateThreshold {
+		late = fmt.Sprintf(" It ended %s ago.", utils.HumanDuration(now.Sub(ends)))
+	}
+	text := fmt.Sprintf("your timer%s is up (%s).%s", t.forLabel(), length, late)
+	content := utils.StrippedHTMLMessage(mevt.MsgText, fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>: %s`,
+		html.EscapeString(string(t.UserID)), html.EscapeString(string(t.UserID)), html.EscapeString(text)))
+	if _, err := cli.SendMessageEvent(t.RoomID, mevt.EventMessage, content); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"room_id":  t.RoomID,
+			"timer_id": t.ID,
+		}).Error("Failed to send timer")
+		polling.ReportError(s, fmt.Errorf("timer %s: %s", t.ID, err))
+	}
+}
+
+func (s *Service) nextTimestamp() time.Time {
+	var earliest int64
+	for _, t := range s.Timers {
+		if earliest == 0 || t.EndsTimestampSecs < earliest {
+			earliest = t.EndsTimestampSecs
+		}
+	}
+	return time.Unix(earliest, 0)
+}
+
+func notice(body string) *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
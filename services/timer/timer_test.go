@@ -0,0 +1,128 @@
+package timer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	roomID = id.RoomID("!kitchen:hyrule")
+	userID = id.UserID("@link:hyrule")
+)
+
+func TestCommands(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+	body := func(content interface{}, err error) string {
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		return content.(*mevt.MessageEventContent).Body
+	}
+
+	before := time.Now()
+	if got := body(s.cmdStart(roomID, userID, strings.Fields("15m pizza"))); got != `Timer 1 started: 15 minutes for "pizza".` {
+		t.Errorf("Unexpected response: %s", got)
+	}
+	if len(s.Timers) != 1 {
+		t.Fatalf("Expected 1 timer, got %d", len(s.Timers))
+	}
+	tm := s.Timers[0]
+	if tm.Label != "pizza" || tm.UserID != userID || tm.RoomID != roomID {
+		t.Errorf("Bad timer: %+v", tm)
+	}
+	if want := before.Add(15 * time.Minute).Unix(); tm.EndsTimestampSecs < want || tm.EndsTimestampSecs > want+5 {
+		t.Errorf("Bad timer end: want about %d, got %d", want, tm.EndsTimestampSecs)
+	}
+	if got := body(s.cmdStart(roomID, userID, strings.Fields("1 hour and 30 minutes"))); got != "Timer 2 started: 1 hour 30 minutes." {
+		t.Errorf("Unexpected response: %s", got)
+	}
+
+	if got := body(s.cmdStart(roomID, userID, strings.Fields("pizza"))); !strings.HasPrefix(got, "Usage:") {
+		t.Errorf("Expected usage for a timer with no duration, got %s", got)
+	}
+	if _, err := s.cmdStart(roomID, userID, strings.Fields("30 days holiday")); err == nil {
+		t.Error("Expected an error for a timer longer than a week")
+	}
+
+	got := body(s.cmdList(roomID))
+	if !strings.HasPrefix(got, `1 for "pizza": 15 minutes left, started by @link:hyrule`) || !strings.Contains(got, "\n2: 1 hour 30 minutes left") {
+		t.Errorf("Unexpected list: %s", got)
+	}
+	if got := body(s.cmdList("!hall:hyrule")); got != "There are no timers running in this room." {
+		t.Errorf("Expected timers in other rooms to be hidden, got %s", got)
+	}
+	if _, err := s.cmdCancel(roomID, "@zelda:hyrule", []string{"1"}); err == nil {
+		t.Error("Expected other users to be unable to cancel the timer")
+	}
+	if got := body(s.cmdCancel(roomID, userID, []string{"1"})); got != `Cancelled timer 1 for "pizza".` {
+		t.Errorf("Unexpected response: %s", got)
+	}
+	if len(s.Timers) != 1 || s.Timers[0].ID != "2" {
+		t.Errorf("Expected only timer 2 to be left, got %+v", s.Timers)
+	}
+}
+
+func TestOnPoll(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	var sent []mevt.MessageEventContent
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var content mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			t.Fatal("Failed to decode message: ", err)
+		}
+		sent = append(sent, content)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup"}`)),
+		}, nil
+	})
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+
+	now := time.Now().Unix()
+	s := &Service{
+		DefaultService: types.NewDefaultService("id", "@neb:hyrule", ServiceType),
+		Timers: []Timer{
+			{ID: "1", RoomID: roomID, UserID: userID, Label: "pizza", StartedTimestampSecs: now - 15*60 - 1, EndsTimestampSecs: now - 1},
+			{ID: "2", RoomID: roomID, UserID: userID, StartedTimestampSecs: now - 3*60*60, EndsTimestampSecs: now - 2*60*60},
+			{ID: "3", RoomID: roomID, UserID: userID, StartedTimestampSecs: now, EndsTimestampSecs: now + 60*60},
+		},
+	}
+	next := s.OnPoll(cli)
+
+	if len(sent) != 2 {
+		t.Fatalf("Expected 2 timers to go off, got %d", len(sent))
+	}
+	if want := `@link:hyrule: your timer for "pizza" is up (15 minutes).`; sent[0].Body != want {
+		t.Errorf("Bad timer message: want %q, got %q", want, sent[0].Body)
+	}
+	if !strings.Contains(sent[0].FormattedBody, `href="https://matrix.to/#/@link:hyrule"`) {
+		t.Errorf("Expected timer message to mention the user, got %q", sent[0].FormattedBody)
+	}
+	if !strings.HasSuffix(sent[1].Body, "It ended 2 hours ago.") {
+		t.Errorf("Expected late timer to say so, got %q", sent[1].Body)
+	}
+	if len(s.Timers) != 1 || s.Timers[0].ID != "3" {
+		t.Errorf("Expected only timer 3 to be left, got %+v", s.Timers)
+	}
+	if next.Unix() != now+60*60 {
+		t.Errorf("Expected to be polled again when the next timer ends, got %s", next)
+	}
+}
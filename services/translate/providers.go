@@ -0,0 +1,154 @@
+package translate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/go-neb/secrets"
+)
+
+// The supported providers.
+const (
+	ProviderDeepL          = "deepl"
+	ProviderLibreTranslate = "libretranslate"
+)
+
+const (
+	deeplFreeURL = "https://api-free.deepl.com"
+	deeplProURL  = "https://api.deepl.com"
+)
+
+// A provider translates text. Languages are lower case codes like "de" or "pt-br".
+type provider interface {
+	// translate translates the text into the target language, detecting the source language if
+	// source is "". It returns the translation and the language translated from.
+	translate(text, source, target string) (translation, detected string, err error)
+}
+
+// newProvider returns the provider for the service's config.
+func newProvider(s *Service) (provider, error) {
+	switch s.Provider {
+	case ProviderDeepL:
+		return &deepl{url: s.URL, apiKey: s.APIKey}, nil
+	case ProviderLibreTranslate:
+		if s.URL == "" {
+			return nil, fmt.Errorf("url is required for %s", ProviderLibreTranslate)
+		}
+		return &libreTranslate{url: s.URL, apiKey: s.APIKey}, nil
+	}
+	return nil, fmt.Errorf("provider must be '%s' or '%s'", ProviderDeepL, ProviderLibreTranslate)
+}
+
+type deepl struct {
+	url    string
+	apiKey string
+}
+
+type deeplResponse struct {
+	Translations []struct {
+		DetectedSourceLanguage string `json:"detected_source_language"`
+		Text                   string `json:"text"`
+	} `json:"translations"`
+}
+
+func (p *deepl) translate(text, source, target string) (string, string, error) {
+	apiKey, err := secrets.Resolve(p.apiKey)
+	if err != nil {
+		return "", "", err
+	}
+	base := p.url
+	if base == "" {
+		// Keys for the free API end with ":fx".
+		base = deeplProURL
+		if strings.HasSuffix(apiKey, ":fx") {
+			base = deeplFreeURL
+		}
+	}
+	form := url.Values{
+		"text":        {text},
+		"target_lang": {strings.ToUpper(target)},
+	}
+	if source != "" {
+		form.Set("source_lang", strings.ToUpper(source))
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(base, "/")+"/v2/translate", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "DeepL-Auth-Key "+apiKey)
+	var res deeplResponse
+	if err := doJSON(req, &res); err != nil {
+		return "", "", err
+	}
+	if len(res.Translations) == 0 {
+		return "", "", fmt.Errorf("No translation returned")
+	}
+	return res.Translations[0].Text, strings.ToLower(res.Translations[0].DetectedSourceLanguage), nil
+}
+
+type libreTranslate struct {
+	url    string
+	apiKey string
+}
+
+type libreTranslateResponse struct {
+	TranslatedText   string `json:"translatedText"`
+	DetectedLanguage struct {
+		Language string `json:"language"`
+	} `json:"detectedLanguage"`
+}
+
+func (p *libreTranslate) translate(text, source, target string) (string, string, error) {
+	apiKey, err := secrets.Resolve(p.apiKey)
+	if err != nil {
+		return "", "", err
+	}
+	if source == "" {
+		source = "auto"
+	}
+	body, err := json.Marshal(map[string]string{
+		"q":       text,
+		"source":  source,
+		"target":  target,
+		"format":  "text",
+		"api_key": apiKey,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(p.url, "/")+"/translate", bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var res libreTranslateResponse
+	if err := doJSON(req, &res); err != nil {
+		return "", "", err
+	}
+	detected := res.DetectedLanguage.Language
+	if source != "auto" {
+		detected = source
+	}
+	return res.TranslatedText, strings.ToLower(detected), nil
+}
+
+func doJSON(req *http.Request, out interface{}) error {
+	res, err := httpClient.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode > 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("Request error: %d, %s", res.StatusCode, string(body))
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
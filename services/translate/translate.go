@@ -0,0 +1,197 @@
+// Package translate implements a Service which translates messages with DeepL or LibreTranslate.
+package translate
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Translate service
+const ServiceType = "translate"
+
+// Matches language codes, e.g. "de" or "pt-br".
+var languageRegex = regexp.MustCompile(`^[a-z]{2,3}(-[a-z]{2,4})?$`)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Service contains the Config fields for the Translate service.
+//
+// In the configured rooms, messages in a foreign language are automatically translated, with the
+// translation sent as a reply. Messages are sent to the translation API to detect their language,
+// so only configure rooms whose members are happy for that to happen.
+//
+// Example request:
+//   {
+//       "provider": "deepl",
+//       "api_key": "0123abcd-...:fx",
+//       "rooms": {
+//           "!qmElAGdFYCHoCJuaNt:localhost": {
+//               "languages": ["de", "fr"],
+//               "target": "en"
+//           }
+//       }
+//   }
+type Service struct {
+	types.DefaultService
+	// Either "deepl" or "libretranslate".
+	Provider string `json:"provider"`
+	// The URL of the translation API, e.g. "https://libretranslate.example.org". Required for
+	// LibreTranslate. For DeepL, this defaults to the free or pro API depending on the API key.
+	URL string `json:"url"`
+	// The API key. Optional for LibreTranslate instances which don't require one. This may
+	// instead be a reference to a secret store, see the secrets package.
+	APIKey string `json:"api_key"`
+	// A map of room ID to the automatic translation settings for that room.
+	Rooms map[id.RoomID]AutoTranslate `json:"rooms"`
+}
+
+// AutoTranslate are the settings for automatically translating messages in a room.
+type AutoTranslate struct {
+	// The languages to translate from, e.g. ["de", "fr"]. Defaults to every language other
+	// than the target.
+	Languages []string `json:"languages"`
+	// The language to translate into, e.g. "en".
+	Target string `json:"target"`
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if _, err := newProvider(s); err != nil {
+		return err
+	}
+	for roomID, room := range s.Rooms {
+		if !languageRegex.MatchString(room.Target) {
+			return fmt.Errorf("Bad target language %q for room %s", room.Target, roomID)
+		}
+		for _, lang := range room.Languages {
+			if !languageRegex.MatchString(lang) {
+				return fmt.Errorf("Bad language %q for room %s", lang, roomID)
+			}
+		}
+		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"room_id":    roomID,
+			}).Error("Failed to join room")
+		}
+	}
+	return nil
+}
+
+// Commands supported:
+//    !translate de some text to translate
+// Responds with the text translated into the given language.
+func (s *Service) Commands(client types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path: []string{"translate"},
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdTranslate(args)
+			},
+		},
+	}
+}
+
+func usageMessage() *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    "Usage: !translate language text, e.g. !translate de Good morning",
+	}
+}
+
+func (s *Service) cmdTranslate(args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return usageMessage(), nil
+	}
+	target := strings.ToLower(args[0])
+	if !languageRegex.MatchString(target) {
+		return usageMessage(), nil
+	}
+	p, err := newProvider(s)
+	if err != nil {
+		return nil, err
+	}
+	translation, _, err := p.translate(strings.Join(args[1:], " "), "", target)
+	if err != nil {
+		return nil, err
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    translation,
+	}, nil
+}
+
+// OnMessage translates messages in the configured rooms.
+func (s *Service) OnMessage(cli types.MatrixClient, ev *mevt.Event) {
+	room, ok := s.Rooms[ev.RoomID]
+	if !ok {
+		return
+	}
+	msg := ev.Content.AsMessage()
+	// Notices are from other bots, which may be translating too.
+	if msg.MsgType == mevt.MsgNotice || strings.TrimSpace(msg.Body) == "" || strings.HasPrefix(msg.Body, "!") {
+		return
+	}
+	go s.autoTranslate(cli, ev, msg.Body, room)
+}
+
+// autoTranslate replies to the message with its translation, if it is in one of the room's
+// languages.
+func (s *Service) autoTranslate(cli types.MatrixClient, ev *mevt.Event, body string, room AutoTranslate) {
+	logger := log.WithFields(log.Fields{"room_id": ev.RoomID, "event_id": ev.ID})
+	p, err := newProvider(s)
+	if err != nil {
+		logger.WithError(err).Error("Bad translation provider")
+		return
+	}
+	translation, detected, err := p.translate(body, "", room.Target)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to translate message")
+		return
+	}
+	if !room.translates(detected) || strings.TrimSpace(translation) == strings.TrimSpace(body) {
+		return
+	}
+	if _, err := cli.SendMessageEvent(ev.RoomID, mevt.EventMessage, mevt.MessageEventContent{
+		MsgType:   mevt.MsgNotice,
+		Body:      fmt.Sprintf("🌐 %s → %s: %s", detected, room.Target, translation),
+		RelatesTo: &mevt.RelatesTo{Type: mevt.RelReply, EventID: ev.ID},
+	}); err != nil {
+		logger.WithError(err).Error("Failed to send translation")
+	}
+}
+
+// translates returns true if messages in the language should be translated.
+func (room AutoTranslate) translates(lang string) bool {
+	base := func(l string) string {
+		return strings.SplitN(strings.ToLower(l), "-", 2)[0]
+	}
+	if lang == "" || base(lang) == base(room.Target) {
+		return false
+	}
+	if len(room.Languages) == 0 {
+		return true
+	}
+	for _, l := range room.Languages {
+		if base(l) == base(lang) {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package translate
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
+)
+
+func TestDeepLCommand(t *testing.T) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "https://api-free.deepl.com/v2/translate" {
+			t.Errorf("Bad DeepL URL: %s", req.URL)
+		}
+		if req.Header.Get("Authorization") != "DeepL-Auth-Key key:fx" {
+			t.Errorf("Bad DeepL auth: %s", req.Header.Get("Authorization"))
+		}
+		req.ParseForm()
+		if req.PostForm.Get("target_lang") != "DE" || req.PostForm.Get("text") != "Good morning" {
+			t.Errorf("Bad DeepL request: %v", req.PostForm)
+		}
+		body := `{"translations": [{"detected_source_language": "EN", "text": "Guten Morgen"}]}`
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})}
+	defer func() { httpClient = &http.Client{} }()
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{"provider": "deepl", "api_key": "key:fx"}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	if err = srv.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register service: ", err)
+	}
+	res, err := srv.Commands(nil)[0].Command("!room:hyrule", "@link:hyrule", []string{"de", "Good", "morning"})
+	if err != nil {
+		t.Fatal("Command failed: ", err)
+	}
+	if got := res.(*mevt.MessageEventContent).Body; got != "Guten Morgen" {
+		t.Errorf("!translate responded with %q, want %q", got, "Guten Morgen")
+	}
+}
+
+func TestAutoTranslate(t *testing.T) {
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var body struct {
+			Q      string `json:"q"`
+			Source string `json:"source"`
+			Target string `json:"target"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Fatal("Failed to decode LibreTranslate request: ", err)
+		}
+		if req.URL.String() != "https://libre.example/translate" || body.Source != "auto" || body.Target != "en" {
+			t.Errorf("Bad LibreTranslate request to %s: %+v", req.URL, body)
+		}
+		res := map[string]string{
+			"Bonjour":    `{"translatedText": "Hello", "detectedLanguage": {"confidence": 90, "language": "fr"}}`,
+			"Hallo":      `{"translatedText": "Hello", "detectedLanguage": {"confidence": 90, "language": "de"}}`,
+			"Hello":      `{"translatedText": "Hello", "detectedLanguage": {"confidence": 90, "language": "en"}}`,
+			"Boa tarde!": `{"translatedText": "Good afternoon!", "detectedLanguage": {"confidence": 90, "language": "pt"}}`,
+		}[body.Q]
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(res))}, nil
+	})}
+	defer func() { httpClient = &http.Client{} }()
+
+	var sent []mevt.MessageEventContent
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		var msg mevt.MessageEventContent
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			t.Fatal("Failed to decode message: ", err)
+		}
+		sent = append(sent, msg)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$yup"}`))}, nil
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@neb:hyrule", []byte(`{
+		"provider": "libretranslate",
+		"url": "https://libre.example/",
+		"rooms": {
+			"!room:hyrule": {"languages": ["fr", "pt-br"], "target": "en"}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("Failed to create service: ", err)
+	}
+	s := srv.(*Service)
+
+	for _, tc := range []struct {
+		body string
+		want string
+	}{
+		{"Bonjour", "🌐 fr → en: Hello"},
+		{"Hallo", ""},
+		{"Hello", ""},
+		{"Boa tarde!", "🌐 pt → en: Good afternoon!"},
+	} {
+		sent = nil
+		ev := &mevt.Event{
+			ID:      "$msg",
+			RoomID:  "!room:hyrule",
+			Sender:  "@link:hyrule",
+			Content: mevt.Content{Parsed: &mevt.MessageEventContent{MsgType: mevt.MsgText, Body: tc.body}},
+		}
+		s.autoTranslate(cli, ev, tc.body, s.Rooms["!room:hyrule"])
+		if tc.want == "" && len(sent) != 0 {
+			t.Errorf("%s: expected no translation, got %+v", tc.body, sent)
+		} else if tc.want != "" {
+			if len(sent) != 1 || sent[0].Body != tc.want {
+				t.Errorf("%s: expected translation %q, got %+v", tc.body, tc.want, sent)
+			} else if sent[0].RelatesTo == nil || sent[0].RelatesTo.EventID != "$msg" {
+				t.Errorf("%s: translation isn't a reply: %+v", tc.body, sent[0].RelatesTo)
+			}
+		}
+	}
+}
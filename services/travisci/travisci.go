@@ -11,6 +11,9 @@ import (
 	"time"
 
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/services/utils"
 	"github.com/matrix-org/go-neb/types"
 	log "github.com/sirupsen/logrus"
 	mevt "maunium.net/go/mautrix/event"
@@ -54,7 +57,8 @@ type Service struct {
 	webhookEndpointURL string
 	// The URL which should be added to .travis.yml - Populated by Go-NEB after Service registration.
 	WebhookURL string `json:"webhook_url"`
-	// A map from Matrix room ID to Github-style owner/repo repositories.
+	// A map from Matrix room ID to Github-style owner/repo repositories. A room may be a Space
+	// or a label such as "label:backend-teams", see utils.ResolveRooms.
 	Rooms map[id.RoomID]struct {
 		// A map of "owner/repo" to configuration information
 		Repos map[string]struct {
@@ -180,19 +184,20 @@ func outputForTemplate(travisTmpl string, tmpl map[string]string) (out string) {
 //
 // See https://docs.travis-ci.com/user/notifications#Webhook-notifications for more information.
 func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli types.MatrixClient) {
+	logger := logging.FromContext(req.Context())
 	if err := req.ParseForm(); err != nil {
-		log.WithError(err).Error("Failed to read incoming Travis-CI webhook form")
+		logger.WithError(err).Error("Failed to read incoming Travis-CI webhook form")
 		w.WriteHeader(400)
 		return
 	}
 	payload := req.PostFormValue("payload")
 	if payload == "" {
-		log.Error("Travis-CI webhook is missing payload= form value")
+		logger.Error("Travis-CI webhook is missing payload= form value")
 		w.WriteHeader(400)
 		return
 	}
 	if err := verifyOrigin([]byte(payload), req.Header.Get("Signature")); err != nil {
-		log.WithFields(log.Fields{
+		logger.WithFields(log.Fields{
 			"Signature":  req.Header.Get("Signature"),
 			log.ErrorKey: err,
 		}).Warn("Received unauthorised Travis-CI webhook request.")
@@ -202,19 +207,19 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 
 	var notif webhookNotification
 	if err := json.Unmarshal([]byte(payload), &notif); err != nil {
-		log.WithError(err).Error("Travis-CI webhook received an invalid JSON payload=")
+		logger.WithError(err).Error("Travis-CI webhook received an invalid JSON payload=")
 		w.WriteHeader(400)
 		return
 	}
 	if notif.Repository.OwnerName == "" || notif.Repository.Name == "" {
-		log.WithField("repo", notif.Repository).Error("Travis-CI webhook missing repository fields")
+		logger.WithField("repo", notif.Repository).Error("Travis-CI webhook missing repository fields")
 		w.WriteHeader(400)
 		return
 	}
 	whForRepo := notif.Repository.OwnerName + "/" + notif.Repository.Name
 	tmplData := notifToTemplate(notif)
 
-	logger := log.WithFields(log.Fields{
+	logger = logger.WithFields(log.Fields{
 		"repo": whForRepo,
 	})
 
@@ -223,18 +228,23 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 			if ownerRepo != whForRepo {
 				continue
 			}
-			msg := mevt.MessageEventContent{
-				Body:    outputForTemplate(repoData.Template, tmplData),
-				MsgType: "m.notice",
+			msg := matrix.CorrelatedMessage{
+				MessageEventContent: mevt.MessageEventContent{
+					Body:    outputForTemplate(repoData.Template, tmplData),
+					MsgType: "m.notice",
+				},
+				CorrelationID: utils.CommitCorrelationID(whForRepo, notif.Commit),
 			}
 
-			logger.WithFields(log.Fields{
-				"message": msg,
-				"room_id": roomID,
-			}).Print("Sending Travis-CI notification to room")
-			if _, e := cli.SendMessageEvent(roomID, mevt.EventMessage, msg); e != nil {
-				logger.WithError(e).WithField("room_id", roomID).Print(
-					"Failed to send Travis-CI notification to room.")
+			for _, toRoomID := range utils.ResolveRooms(cli, s.ServiceUserID(), roomID) {
+				logger.WithFields(log.Fields{
+					"message": msg,
+					"room_id": toRoomID,
+				}).Print("Sending Travis-CI notification to room")
+				if _, e := cli.SendMessageEvent(toRoomID, mevt.EventMessage, msg); e != nil {
+					logger.WithError(e).WithField("room_id", toRoomID).Print(
+						"Failed to send Travis-CI notification to room.")
+				}
 			}
 		}
 	}
@@ -274,8 +284,20 @@ func (s *Service) PostRegister(oldService types.Service) {
 	}
 }
 
+// TargetRooms returns the rooms build notifications are sent into.
+func (s *Service) TargetRooms() []id.RoomID {
+	roomIDs := make([]id.RoomID, 0, len(s.Rooms))
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
 func (s *Service) joinRooms(client types.MatrixClient) {
 	for roomID := range s.Rooms {
+		if utils.IsLabel(roomID) {
+			continue // labelled rooms are joined by the service which labels them
+		}
 		if _, err := client.JoinRoom(roomID.String(), "", nil); err != nil {
 			log.WithFields(log.Fields{
 				log.ErrorKey: err,
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"strings"
+	"unicode"
+)
+
+// IncludeRules contains the rules for including or excluding a feed item. For the fields Author, Title
+// and Description in a feed item, there can be some words specified in the config that determine whether
+// the item will be displayed or not, depending on whether these words are included in that field.
+//
+//   - If specified in the `must_include` field, the feed item must include at least one word for each field
+//     that has been specified. This means that if some words have been specified for both Author and Title,
+//     both the Author and Title must contain at least one of their respective words or the item will be skipped.
+//   - If specified in the `must_not_include` field, the feed item fields must not contain any of the words
+//     that were specified for each field. This means that if some words have been specified for both Author
+//     and Title, if either of them includes at least one of their respective words, the item will be skipped,
+//     even in the case that the item matched the `must_include` rules.
+//
+//   In both cases, specifying an empty list for a field or not specifying anything causes the field to be ignored.
+//   The field being checked each time will be split into words (any non-alphanumeric character starts a new word)
+//   and they will be checked against the provided list.
+type IncludeRules struct {
+	// Author is a case-sensitive list of words that the author name must contain or not contain.
+	Author []string `json:"author"`
+	// Title is a case-sensitive list of words that the title must contain or not contain.
+	Title []string `json:"title"`
+	// Description is a case-sensitive list of words that the description must contain or not contain.
+	Description []string `json:"description"`
+}
+
+// ContainsAnyWord takes a string and an array of words and returns whether any of the words
+// in the list are contained in the string. The words in the string are considered to be
+// separated by any non-alphanumeric character.
+func ContainsAnyWord(item string, filterWords []string) bool {
+	itemWords := strings.FieldsFunc(item, func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+	})
+	for _, itemWord := range itemWords {
+		for _, filterWord := range filterWords {
+			if filterWord == itemWord {
+				return true
+			}
+		}
+	}
+	return false
+}
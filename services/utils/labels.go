@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// LabelPrefix marks a configured room as a label rather than a room ID, e.g. "label:backend-teams".
+const LabelPrefix = "label:"
+
+// The namespace clients use for user defined room tags.
+const userTagPrefix = "u."
+
+type tagEntry struct {
+	roomsByTag map[string][]id.RoomID
+	fetchedAt  time.Time
+}
+
+var (
+	tagsMutex sync.Mutex
+	tagCache  = make(map[id.UserID]tagEntry)
+)
+
+// IsLabel returns true if the configured room is a label rather than a room ID.
+func IsLabel(roomID id.RoomID) bool {
+	return strings.HasPrefix(string(roomID), LabelPrefix)
+}
+
+// ResolveRooms returns the rooms to send into for a configured room, which may be:
+//   - a room ID.
+//   - a Space ID, meaning every room in the space. See SpaceRooms.
+//   - a label such as "label:backend-teams", meaning every room given that label by a
+//     types.RoomLabeller service for userID, or which userID has tagged "backend-teams" or
+//     "u.backend-teams". Labelled rooms may themselves be spaces.
+// This decouples service configs from room churn. userID is the user ID of cli.
+func ResolveRooms(cli types.MatrixClient, userID id.UserID, roomID id.RoomID) []id.RoomID {
+	if !IsLabel(roomID) {
+		return SpaceRooms(cli, userID, roomID)
+	}
+	seen := make(map[id.RoomID]bool)
+	var rooms []id.RoomID
+	for _, labelled := range labelledRooms(cli, userID, strings.TrimPrefix(string(roomID), LabelPrefix)) {
+		for _, r := range SpaceRooms(cli, userID, labelled) {
+			if !seen[r] {
+				seen[r] = true
+				rooms = append(rooms, r)
+			}
+		}
+	}
+	return rooms
+}
+
+func labelledRooms(cli types.MatrixClient, userID id.UserID, label string) []id.RoomID {
+	services, err := database.GetServiceDB().LoadServicesForUser(userID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", userID).Error("Failed to load services for room labels")
+	}
+	var rooms []id.RoomID
+	for _, service := range services {
+		if labeller, ok := service.(types.RoomLabeller); ok {
+			rooms = append(rooms, labeller.LabelledRooms(label)...)
+		}
+	}
+	roomsByTag := taggedRooms(cli, userID)
+	rooms = append(rooms, roomsByTag[label]...)
+	return append(rooms, roomsByTag[userTagPrefix+label]...)
+}
+
+// taggedRooms returns the rooms userID is in for each of its room tags. Results are cached for
+// SpaceRefreshInterval as this takes a request per room.
+func taggedRooms(cli types.MatrixClient, userID id.UserID) map[string][]id.RoomID {
+	tagsMutex.Lock()
+	entry, cached := tagCache[userID]
+	tagsMutex.Unlock()
+	if cached && time.Since(entry.fetchedAt) < SpaceRefreshInterval {
+		return entry.roomsByTag
+	}
+
+	resp, err := cli.JoinedRooms()
+	if err != nil {
+		log.WithError(err).WithField("user_id", userID).Warn("Failed to list joined rooms for room tags")
+		return entry.roomsByTag
+	}
+	roomsByTag := make(map[string][]id.RoomID)
+	for _, roomID := range resp.JoinedRooms {
+		tags, err := cli.GetTags(roomID)
+		if err != nil {
+			log.WithError(err).WithField("room_id", roomID).Warn("Failed to get room tags")
+			continue
+		}
+		for tag := range tags.Tags {
+			roomsByTag[tag] = append(roomsByTag[tag], roomID)
+		}
+	}
+
+	tagsMutex.Lock()
+	tagCache[userID] = tagEntry{roomsByTag, time.Now()}
+	tagsMutex.Unlock()
+	return roomsByTag
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+type labelService struct {
+	types.DefaultService
+}
+
+func (s *labelService) LabelledRooms(label string) []id.RoomID {
+	if label == "backend-teams" {
+		return []id.RoomID{"!api:hyrule", "!db:hyrule"}
+	}
+	return nil
+}
+
+type labelStore struct {
+	database.NopStorage
+}
+
+func (d *labelStore) LoadServicesForUser(userID id.UserID) ([]types.Service, error) {
+	return []types.Service{&labelService{}}, nil
+}
+
+func TestResolveRooms(t *testing.T) {
+	database.SetServiceDB(&labelStore{})
+	responses := map[string]string{
+		"/joined_rooms": `{"joined_rooms":["!db:hyrule","!ops:hyrule"]}`,
+		"/user/@labeller:hyrule/rooms/!db:hyrule/tags":  `{"tags":{"u.backend-teams":{}}}`,
+		"/user/@labeller:hyrule/rooms/!ops:hyrule/tags": `{"tags":{"backend-teams":{},"m.favourite":{}}}`,
+	}
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		body, ok := responses[strings.TrimPrefix(req.URL.Path, "/_matrix/client/r0")]
+		code := 200
+		if !ok {
+			code, body = 404, `{"errcode":"M_UNRECOGNIZED"}`
+		}
+		return &http.Response{
+			StatusCode: code,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+	cli, _ := mautrix.NewClient("https://hyrule", "@labeller:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+
+	want := []id.RoomID{"!api:hyrule", "!db:hyrule", "!ops:hyrule"}
+	if got := ResolveRooms(cli, "@labeller:hyrule", "label:backend-teams"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Label: want %v, got %v", want, got)
+	}
+	if got := ResolveRooms(cli, "@labeller:hyrule", "label:nobody"); len(got) != 0 {
+		t.Errorf("Unknown label: want no rooms, got %v", got)
+	}
+	if got := ResolveRooms(cli, "@labeller:hyrule", "!room:hyrule"); !reflect.DeepEqual(got, []id.RoomID{"!room:hyrule"}) {
+		t.Errorf("Room: want just the room, got %v", got)
+	}
+}
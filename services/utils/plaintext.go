@@ -0,0 +1,266 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// PlainText returns a plain text rendering of the HTML of a message, for its body, so that text
+// bridges and screen readers get everything the HTML says. For example:
+//   <b>alice</b> opened <a href="https://example.com/1">issue #1</a><br>Steps:<ul><li>one</li></ul>
+// is rendered as:
+//   alice opened issue #1 (https://example.com/1)
+//   Steps:
+//   - one
+// Links are followed by their URL unless it is the same as their text, blockquotes are quoted
+// with "> ", preformatted text is kept as it is, and replies' fallbacks are dropped. Matrix user
+// and room links ("pills") are rendered as their text.
+func PlainText(htmlText string) string {
+	nodes, err := html.ParseFragment(strings.NewReader(htmlText), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "div",
+		DataAtom: atom.Div,
+	})
+	if err != nil {
+		// Only returned if reading fails, which it can't from a strings.Reader
+		return htmlText
+	}
+	var w plainWriter
+	for _, n := range nodes {
+		w.node(n)
+	}
+	return w.String()
+}
+
+// A plainWriter writes the plain text of HTML nodes, collapsing whitespace as browsers do.
+// Line breaks and spaces are only written before the text which follows them, so that there
+// are none at the start or end of the text.
+type plainWriter struct {
+	b strings.Builder
+	// The number of line breaks to write before the next text.
+	newlines int
+	// Whether to write a space before the next text.
+	space bool
+	// Whether a block has ended since the last text, so that a line break straight after it
+	// doesn't add a blank line.
+	afterBlock bool
+	// Written at the start of every line, e.g. "> " in blockquotes.
+	prefix string
+	// Whether whitespace is kept, in preformatted text.
+	pre bool
+}
+
+func (w *plainWriter) String() string {
+	return w.b.String()
+}
+
+// write writes text as it is, after any pending line breaks or space.
+func (w *plainWriter) write(s string) {
+	if s == "" {
+		return
+	}
+	if w.b.Len() == 0 {
+		w.b.WriteString(w.prefix)
+	} else if w.newlines > 0 {
+		for i := 0; i < w.newlines; i++ {
+			w.b.WriteString("\n")
+			if i < w.newlines-1 {
+				// Don't leave trailing spaces on blank lines
+				w.b.WriteString(strings.TrimRight(w.prefix, " "))
+			}
+		}
+		w.b.WriteString(w.prefix)
+	} else if w.space {
+		w.b.WriteString(" ")
+	}
+	w.b.WriteString(s)
+	w.newlines = 0
+	w.space = false
+	w.afterBlock = false
+}
+
+// text writes the text of a text node.
+func (w *plainWriter) text(s string) {
+	if w.pre {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				w.newlines++
+			}
+			w.write(line)
+		}
+		return
+	}
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		w.space = w.space || s != ""
+		return
+	}
+	if strings.TrimLeft(s, " \t\n\r\f") != s {
+		w.space = true
+	}
+	for i, word := range words {
+		if i > 0 {
+			w.space = true
+		}
+		w.write(word)
+	}
+	if strings.TrimRight(s, " \t\n\r\f") != s {
+		w.space = true
+	}
+}
+
+// block makes sure that the next text is at least n lines after the last.
+func (w *plainWriter) block(n int) {
+	if w.newlines < n {
+		w.newlines = n
+	}
+	w.afterBlock = true
+}
+
+func (w *plainWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.node(c)
+	}
+}
+
+func (w *plainWriter) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		w.children(n)
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Head, atom.Title:
+		return
+	case atom.Br:
+		if w.afterBlock {
+			w.afterBlock = false
+		} else {
+			w.newlines++
+		}
+	case atom.Hr:
+		w.block(1)
+		w.write("---")
+		w.block(1)
+	case atom.Img:
+		// e.g. custom emoji, which have their shortcode as their alt text
+		w.write(attr(n, "alt"))
+	case atom.A:
+		w.link(n)
+	case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		w.block(2)
+		w.children(n)
+		w.block(2)
+	case atom.Blockquote:
+		w.block(1)
+		prefix := w.prefix
+		w.prefix += "> "
+		w.children(n)
+		w.prefix = prefix
+		w.block(1)
+	case atom.Pre:
+		w.block(1)
+		w.pre = true
+		w.children(n)
+		w.pre = false
+		w.block(1)
+	case atom.Li:
+		w.block(1)
+		w.write(listMarker(n))
+		w.space = true
+		prefix := w.prefix
+		w.prefix += "  "
+		w.children(n)
+		w.prefix = prefix
+		w.block(1)
+	case atom.Td, atom.Th:
+		if prevElement(n) != nil {
+			w.space = true
+			w.write("|")
+			w.space = true
+		}
+		w.children(n)
+	case atom.Div, atom.Ul, atom.Ol, atom.Table, atom.Tr, atom.Details, atom.Summary, atom.Caption:
+		w.block(1)
+		w.children(n)
+		w.block(1)
+	default:
+		if n.Data == "mx-reply" {
+			return
+		}
+		w.children(n)
+	}
+}
+
+// link writes a link's text, followed by its URL if that isn't the same.
+func (w *plainWriter) link(n *html.Node) {
+	w.children(n)
+	href := attr(n, "href")
+	if href == "" || strings.HasPrefix(href, "https://matrix.to/#/") {
+		return
+	}
+	text := strings.Join(strings.Fields(textContent(n)), " ")
+	href = strings.TrimPrefix(href, "mailto:")
+	if text == href {
+		return
+	}
+	if text != "" {
+		w.space = true
+		href = "(" + href + ")"
+	}
+	w.write(href)
+}
+
+// listMarker returns "-" for items of unordered lists, or the item's number for ordered lists.
+func listMarker(li *html.Node) string {
+	if li.Parent == nil || li.Parent.DataAtom != atom.Ol {
+		return "-"
+	}
+	num := 1
+	if start, err := strconv.Atoi(attr(li.Parent, "start")); err == nil {
+		num = start
+	}
+	for s := li.PrevSibling; s != nil; s = s.PrevSibling {
+		if s.Type == html.ElementNode && s.DataAtom == atom.Li {
+			num++
+		}
+	}
+	return strconv.Itoa(num) + "."
+}
+
+func prevElement(n *html.Node) *html.Node {
+	for s := n.PrevSibling; s != nil; s = s.PrevSibling {
+		if s.Type == html.ElementNode {
+			return s
+		}
+	}
+	return nil
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(textContent(c))
+	}
+	return b.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
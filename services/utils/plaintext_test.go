@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestPlainText(t *testing.T) {
+	for _, tc := range []struct {
+		html string
+		want string
+	}{
+		{"just text", "just text"},
+		{"  lots   of\n whitespace  ", "lots of whitespace"},
+		{"<b>bold</b> and <i>italic</i>, <code>code</code>", "bold and italic, code"},
+		{"&lt;escaped&gt; &amp; &quot;quoted&quot;", `<escaped> & "quoted"`},
+		{"one<br>two<br/><br />four", "one\ntwo\n\nfour"},
+		{"<br>leading and trailing<br>", "leading and trailing"},
+		{`see <a href="https://example.com">the docs</a>`, "see the docs (https://example.com)"},
+		{`<a href="https://example.com">https://example.com</a>`, "https://example.com"},
+		{`by <a href="mailto:link@hyrule.example">link@hyrule.example</a>`, "by link@hyrule.example"},
+		{`by <a href="mailto:link@hyrule.example">Link</a>`, "by Link (link@hyrule.example)"},
+		{`<a href="https://matrix.to/#/@alice:hyrule">Alice</a>: hi`, "Alice: hi"},
+		{`<a href="https://example.com"><img src="mxc://hyrule/img"></a>`, "https://example.com"},
+		{`nice <img data-mx-emoticon src="mxc://hyrule/party" alt=":party:">`, "nice :party:"},
+		{"<p>first</p><p>second</p>", "first\n\nsecond"},
+		{"<h1>Title</h1>body", "Title\n\nbody"},
+		{"Steps:<ul><li>one</li><li>two</li></ul>done", "Steps:\n- one\n- two\ndone"},
+		{"<ol><li>one</li><li>two</li></ol>", "1. one\n2. two"},
+		{`<ol start="3"><li>three</li><li>four</li></ol>`, "3. three\n4. four"},
+		{"<ul><li>outer<ul><li>inner</li></ul></li><li>next</li></ul>", "- outer\n  - inner\n- next"},
+		{"said:<blockquote>line one<br>line two</blockquote>ok", "said:\n> line one\n> line two\nok"},
+		{"<blockquote>quoted</blockquote><br>after", "> quoted\nafter"},
+		{"<blockquote><p>para one</p><p>para two</p></blockquote>", "> para one\n>\n> para two"},
+		{"<pre><code>func main() {\n\tfmt.Println(\"hi\")\n}\n</code></pre>after", "func main() {\n\tfmt.Println(\"hi\")\n}\nafter"},
+		{"<table><tr><th>Name</th><th>Value</th></tr><tr><td>a</td><td>1</td></tr></table>", "Name | Value\na | 1"},
+		{"above<hr>below", "above\n---\nbelow"},
+		{`<mx-reply><blockquote><a href="https://matrix.to/#/!room/$event">In reply to</a> earlier</blockquote></mx-reply>the reply`, "the reply"},
+		{"<script>alert(1)</script><style>b {}</style>safe", "safe"},
+	} {
+		if got := PlainText(tc.html); got != tc.want {
+			t.Errorf("PlainText(%q): want\n%s\ngot\n%s", tc.html, tc.want, got)
+		}
+	}
+}
+
+// The bodies of notifications are their HTML as plain text, so they must read as the HTML does in
+// every profile.
+func TestPlainTextNotifications(t *testing.T) {
+	n := Notification{
+		Source:      "owner/repo",
+		Summary:     []Span{Plain("alice pushed "), Bold("2 commits"), {Text: " to main", Color: "red"}},
+		URL:         "https://example.com/compare",
+		Lines:       []string{"abc1234: Fix <the> bug", "def5678: Add a test"},
+		Fields:      []Field{{"Files", "main.go, main_test.go"}},
+		Description: "Tidy up\n\nand fix things",
+		Diff:        "--- a/main.go\n+++ b/main.go\n-\tbroken()\n+\tfixed()",
+		Mentions:    []id.UserID{"@alice:hyrule"},
+	}
+	want := map[string]string{
+		FormatNormal: "[owner/repo] alice pushed 2 commits to main: https://example.com/compare\n" +
+			"abc1234: Fix <the> bug\ndef5678: Add a test\ncc @alice:hyrule",
+		FormatVerbose: "[owner/repo] alice pushed 2 commits to main: https://example.com/compare\n" +
+			"abc1234: Fix <the> bug\ndef5678: Add a test\nFiles: main.go, main_test.go\n" +
+			"> Tidy up\n>\n> and fix things\n" +
+			"--- a/main.go\n+++ b/main.go\n-\tbroken()\n+\tfixed()\ncc @alice:hyrule",
+	}
+	for profile, body := range want {
+		if got := n.Render(profile).Body; got != body {
+			t.Errorf("%s: want body\n%s\ngot\n%s", profile, body, got)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package utils
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The formatting profiles a room can choose with the "format" bot option.
+const (
+	// FormatCompact renders notifications as a single line of plain text.
+	FormatCompact = "compact"
+	// FormatNormal renders notifications as a line of HTML, followed by any lines of detail
+	// such as commit messages. This is the default.
+	FormatNormal = "normal"
+	// FormatVerbose renders everything FormatNormal does, as well as the full details of the
+	// notification, e.g. labels, descriptions and diffs.
+	FormatVerbose = "verbose"
+)
+
+// The most characters of a description shown in verbose notifications.
+const maxDescriptionLength = 2000
+
+// escapeHTML escapes text for element content and double-quoted attributes. Unlike
+// escapeHTML, it leaves apostrophes alone so that bodies read naturally, e.g. "alice's".
+var escapeHTML = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace
+
+// A Notification is what a service wants to tell a room, e.g. that an issue was opened, as
+// structured data. It is rendered according to the room's formatting profile. In the normal
+// profile, this looks like:
+//   [Source] Summary: Title Note - URL
+//   Lines
+type Notification struct {
+	// What the notification is about, e.g. "matrix-org/go-neb".
+	Source string
+	// What happened, e.g. "alice opened pull request #12".
+	Summary []Span
+	// The title of the thing which changed, e.g. the pull request's title.
+	Title string
+	// A short note shown after the title, except in the compact profile, e.g. "[open]".
+	Note string
+	// A link to more information.
+	URL string
+	// Lines of detail shown after the summary, except in the compact profile, e.g. commits.
+	Lines []string
+	// Details only shown in the verbose profile, e.g. labels.
+	Fields []Field
+	// A description only shown in the verbose profile, e.g. an issue's body. Long descriptions
+	// are truncated.
+	Description string
+	// A diff only shown in the verbose profile.
+	Diff string
+	// The msgtype to send the notification with. Defaults to m.notice.
+	MsgType mevt.MessageType
+	// Optional. Identifies what the notification is about, so that it can be combined with other
+	// services' notifications about the same thing, e.g. from CommitCorrelationID.
+	CorrelationID string
+	// Matrix users to mention at the end of the notification, in every profile, e.g. the authors
+	// of pushed commits.
+	Mentions []id.UserID
+}
+
+// CommitCorrelationID returns the correlation ID for notifications about a commit, e.g. pushes
+// and CI builds, so that every service which notifies about commits uses the same ID. Returns ""
+// if the commit's SHA isn't known.
+func CommitCorrelationID(repo, sha string) string {
+	if sha == "" {
+		return ""
+	}
+	return strings.ToLower(repo) + "@" + sha
+}
+
+// A Span is part of a Notification's summary.
+type Span struct {
+	Text string
+	Bold bool
+	// An optional HTML colour, e.g. "red".
+	Color string
+}
+
+// A Field is a named detail of a Notification, e.g. "Labels: bug, help wanted".
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Plain returns a span of plain text.
+func Plain(text string) Span {
+	return Span{Text: text}
+}
+
+// Bold returns a span of bold text.
+func Bold(text string) Span {
+	return Span{Text: text, Bold: true}
+}
+
+// RoomFormat returns the formatting profile configured for this room via the "format" bot
+// option, or FormatNormal if there isn't one. Errors are logged and treated as no option being
+// set.
+func RoomFormat(botUserID id.UserID, roomID id.RoomID) string {
+	opts, err := database.GetServiceDB().LoadBotOptions(botUserID, roomID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithError(err).WithFields(log.Fields{
+				"room_id":     roomID,
+				"bot_user_id": botUserID,
+			}).Error("Failed to load bot options")
+		}
+		return FormatNormal
+	}
+	if opts.Options == nil {
+		return FormatNormal
+	}
+	switch opts.Options.Format {
+	case FormatCompact, FormatVerbose:
+		return opts.Options.Format
+	}
+	return FormatNormal
+}
+
+// Render returns the message for the notification in the given formatting profile.
+func (n *Notification) Render(profile string) mevt.MessageEventContent {
+	msgType := n.MsgType
+	if msgType == "" {
+		msgType = mevt.MsgNotice
+	}
+	if profile == FormatCompact {
+		return mevt.MessageEventContent{
+			MsgType: msgType,
+			Body:    n.headline(false, false) + n.mentions(false, " "),
+		}
+	}
+	htmlText := n.HTML(profile)
+	return mevt.MessageEventContent{
+		MsgType:       msgType,
+		Body:          PlainText(htmlText),
+		Format:        mevt.FormatHTML,
+		FormattedBody: htmlText,
+	}
+}
+
+// Message returns the content to send for the notification in the given formatting profile. This
+// is a matrix.CorrelatedMessage if the notification has a CorrelationID.
+func (n *Notification) Message(profile string) interface{} {
+	msg := n.Render(profile)
+	if n.CorrelationID == "" {
+		return msg
+	}
+	return matrix.CorrelatedMessage{MessageEventContent: msg, CorrelationID: n.CorrelationID}
+}
+
+// HTML returns the HTML of the notification in the given formatting profile.
+func (n *Notification) HTML(profile string) string {
+	return n.html(profile) + n.mentions(true, "<br>")
+}
+
+func (n *Notification) html(profile string) string {
+	var b strings.Builder
+	b.WriteString(n.headline(true, profile != FormatCompact))
+	if profile == FormatCompact {
+		return b.String()
+	}
+	for _, line := range n.Lines {
+		b.WriteString("<br>" + escapeHTML(line))
+	}
+	if profile != FormatVerbose {
+		return b.String()
+	}
+	for _, f := range n.Fields {
+		b.WriteString("<br><b>" + escapeHTML(f.Name) + ":</b> " + escapeHTML(f.Value))
+	}
+	if desc := truncate(n.Description); desc != "" {
+		b.WriteString("<blockquote>" + strings.Replace(escapeHTML(desc), "\n", "<br>", -1) + "</blockquote>")
+	}
+	if n.Diff != "" {
+		b.WriteString(`<pre><code class="language-diff">` + escapeHTML(n.Diff) + "</code></pre>")
+	}
+	return b.String()
+}
+
+// headline returns the first line of the notification, as HTML or plain text.
+func (n *Notification) headline(asHTML, withNote bool) string {
+	esc := func(s string) string { return s }
+	if asHTML {
+		esc = escapeHTML
+	}
+	var b strings.Builder
+	if n.Source != "" {
+		if asHTML {
+			b.WriteString("[<u>" + esc(n.Source) + "</u>] ")
+		} else {
+			b.WriteString("[" + n.Source + "] ")
+		}
+	}
+	bold := false
+	for _, span := range n.Summary {
+		if asHTML && span.Bold != bold {
+			if span.Bold {
+				b.WriteString("<b>")
+			} else {
+				b.WriteString("</b>")
+			}
+			bold = span.Bold
+		}
+		if asHTML && span.Color != "" {
+			b.WriteString(`<font color="` + esc(span.Color) + `">` + esc(span.Text) + "</font>")
+		} else {
+			b.WriteString(esc(span.Text))
+		}
+	}
+	if bold {
+		b.WriteString("</b>")
+	}
+	if n.Title != "" {
+		b.WriteString(": " + esc(n.Title))
+	}
+	if withNote && n.Note != "" {
+		b.WriteString(" " + esc(n.Note))
+	}
+	if n.URL != "" {
+		if n.Title != "" {
+			b.WriteString(" - ")
+		} else {
+			b.WriteString(": ")
+		}
+		b.WriteString(esc(n.URL))
+	}
+	return b.String()
+}
+
+// mentions returns "cc" and the users to mention, after sep, or "" if there aren't any.
+func (n *Notification) mentions(asHTML bool, sep string) string {
+	if len(n.Mentions) == 0 {
+		return ""
+	}
+	users := make([]string, len(n.Mentions))
+	for i, userID := range n.Mentions {
+		if asHTML {
+			users[i] = `<a href="https://matrix.to/#/` + escapeHTML(string(userID)) + `">` + escapeHTML(string(userID)) + "</a>"
+		} else {
+			users[i] = string(userID)
+		}
+	}
+	return sep + "cc " + strings.Join(users, ", ")
+}
+
+func truncate(s string) string {
+	s = strings.TrimSpace(s)
+	if runes := []rune(s); len(runes) > maxDescriptionLength {
+		return string(runes[:maxDescriptionLength]) + "…"
+	}
+	return s
+}
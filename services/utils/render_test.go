@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"testing"
+
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRender(t *testing.T) {
+	n := &Notification{
+		Source: "owner/repo",
+		Summary: []Span{
+			Plain("alice opened "),
+			Bold("issue #1"),
+		},
+		Title:       "Crash on <startup>",
+		Note:        "[open]",
+		URL:         "https://example.com/1",
+		Lines:       []string{"first", "second"},
+		Fields:      []Field{{Name: "Labels", Value: "bug"}},
+		Description: "It crashes.\nEvery time.",
+	}
+	for _, tc := range []struct {
+		profile string
+		body    string
+		html    string
+	}{
+		{
+			FormatCompact,
+			"[owner/repo] alice opened issue #1: Crash on <startup> - https://example.com/1",
+			"",
+		},
+		{
+			FormatNormal,
+			"[owner/repo] alice opened issue #1: Crash on <startup> [open] - https://example.com/1\nfirst\nsecond",
+			"[<u>owner/repo</u>] alice opened <b>issue #1</b>: Crash on &lt;startup&gt; [open] - https://example.com/1<br>first<br>second",
+		},
+		{
+			FormatVerbose,
+			"[owner/repo] alice opened issue #1: Crash on <startup> [open] - https://example.com/1\nfirst\nsecond\nLabels: bug\n> It crashes.\n> Every time.",
+			"[<u>owner/repo</u>] alice opened <b>issue #1</b>: Crash on &lt;startup&gt; [open] - https://example.com/1<br>first<br>second" +
+				"<br><b>Labels:</b> bug<blockquote>It crashes.<br>Every time.</blockquote>",
+		},
+	} {
+		msg := n.Render(tc.profile)
+		if msg.MsgType != mevt.MsgNotice {
+			t.Errorf("%s: expected msgtype %s, got %s", tc.profile, mevt.MsgNotice, msg.MsgType)
+		}
+		if msg.Body != tc.body {
+			t.Errorf("%s: expected body:\n%s\ngot:\n%s", tc.profile, tc.body, msg.Body)
+		}
+		if msg.FormattedBody != tc.html {
+			t.Errorf("%s: expected HTML:\n%s\ngot:\n%s", tc.profile, tc.html, msg.FormattedBody)
+		}
+	}
+}
+
+func TestRenderMentions(t *testing.T) {
+	n := &Notification{
+		Source:   "owner/repo",
+		Summary:  []Span{Plain("alice pushed to "), Bold("main")},
+		Mentions: []id.UserID{"@alice:hyrule", "@bob:hyrule"},
+	}
+	if body := n.Render(FormatCompact).Body; body != "[owner/repo] alice pushed to main cc @alice:hyrule, @bob:hyrule" {
+		t.Errorf("Bad compact body: %q", body)
+	}
+	msg := n.Render(FormatNormal)
+	if msg.Body != "[owner/repo] alice pushed to main\ncc @alice:hyrule, @bob:hyrule" {
+		t.Errorf("Bad body: %q", msg.Body)
+	}
+	want := `[<u>owner/repo</u>] alice pushed to <b>main</b><br>cc <a href="https://matrix.to/#/@alice:hyrule">@alice:hyrule</a>, ` +
+		`<a href="https://matrix.to/#/@bob:hyrule">@bob:hyrule</a>`
+	if msg.FormattedBody != want {
+		t.Errorf("Bad HTML: want\n%s\ngot\n%s", want, msg.FormattedBody)
+	}
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RoomCreation is the config for services which create the room they send into, rather than
+// being given one. Services embed it, so its fields sit alongside the service's own config:
+//
+//    {
+//        "create_room_if_missing": true,
+//        "room_name": "Alerts",
+//        "room_topic": "Alerts from production",
+//        "room_invite": ["@alice:localhost"],
+//        "room_encrypted": true
+//    }
+type RoomCreation struct {
+	// Optional. Create a room when the service is registered without any rooms, and send into it.
+	CreateRoomIfMissing bool `json:"create_room_if_missing,omitempty"`
+	// Optional. The name of the created room.
+	RoomName string `json:"room_name,omitempty"`
+	// Optional. The topic of the created room.
+	RoomTopic string `json:"room_topic,omitempty"`
+	// Optional. Who to invite into the created room. They, and the service's owner, are made
+	// admins of it.
+	RoomInvite []id.UserID `json:"room_invite,omitempty"`
+	// Optional. Whether to enable encryption in the created room.
+	RoomEncrypted bool `json:"room_encrypted,omitempty"`
+	// The room which was created - Populated by Go-NEB after Service registration.
+	CreatedRoomID id.RoomID `json:"created_room_id,omitempty"`
+}
+
+// createRoomRequest is the request to POST /_matrix/client/r0/createRoom. mautrix.ReqCreateRoom
+// can't override the power levels.
+type createRoomRequest struct {
+	Preset             string              `json:"preset"`
+	Name               string              `json:"name,omitempty"`
+	Topic              string              `json:"topic,omitempty"`
+	Invite             []id.UserID         `json:"invite,omitempty"`
+	InitialState       []initialState      `json:"initial_state,omitempty"`
+	PowerLevelOverride *powerLevelOverride `json:"power_level_content_override,omitempty"`
+}
+
+type initialState struct {
+	Type     string      `json:"type"`
+	StateKey string      `json:"state_key"`
+	Content  interface{} `json:"content"`
+}
+
+type powerLevelOverride struct {
+	Users map[id.UserID]int `json:"users"`
+}
+
+type createRoomResponse struct {
+	RoomID id.RoomID `json:"room_id"`
+}
+
+// CreateMissingRoom creates the service's room, if CreateRoomIfMissing is set and the service has
+// no rooms, and returns it so that the service can add it to its rooms. It returns "" if no room
+// was needed. The room created for the service's old config is reused, so that updating the
+// service doesn't create another room. cli is the client for userID, which becomes an admin of
+// the room, as do owner and the invited users.
+func (c *RoomCreation) CreateMissingRoom(cli types.MatrixClient, userID id.UserID, owner id.UserID, hasRooms bool, old *RoomCreation) (id.RoomID, error) {
+	if c.CreatedRoomID == "" && old != nil {
+		c.CreatedRoomID = old.CreatedRoomID
+	}
+	if !c.CreateRoomIfMissing || hasRooms {
+		return "", nil
+	}
+	if c.CreatedRoomID != "" {
+		return c.CreatedRoomID, nil
+	}
+
+	invite := c.RoomInvite
+	if owner != "" && owner != userID && !containsUser(invite, owner) {
+		invite = append(append([]id.UserID{}, invite...), owner)
+	}
+	req := createRoomRequest{
+		Preset: "private_chat",
+		Name:   c.RoomName,
+		Topic:  c.RoomTopic,
+		Invite: invite,
+		PowerLevelOverride: &powerLevelOverride{
+			Users: map[id.UserID]int{userID: 100},
+		},
+	}
+	for _, u := range invite {
+		req.PowerLevelOverride.Users[u] = 100
+	}
+	if c.RoomEncrypted {
+		req.InitialState = append(req.InitialState, initialState{
+			Type:    mevt.StateEncryption.Type,
+			Content: mevt.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1},
+		})
+	}
+	var res createRoomResponse
+	if _, err := cli.MakeRequest("POST", cli.BuildBaseURL("_matrix", "client", "r0", "createRoom"), req, &res); err != nil {
+		return "", err
+	}
+	log.WithFields(log.Fields{
+		"room_id": res.RoomID,
+		"user_id": userID,
+	}).Info("Created room for service")
+	c.CreatedRoomID = res.RoomID
+	return res.RoomID, nil
+}
+
+func containsUser(userIDs []id.UserID, userID id.UserID) bool {
+	for _, u := range userIDs {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestCreateMissingRoom(t *testing.T) {
+	var created []createRoomRequest
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/createRoom" {
+			t.Errorf("Unexpected request: %s %s", req.Method, req.URL)
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		var body createRoomRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode createRoom request: %s", err)
+		}
+		created = append(created, body)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!new:hyrule"}`)),
+		}, nil
+	})
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+
+	// Not enabled, or the service already has rooms
+	var c RoomCreation
+	if roomID, err := c.CreateMissingRoom(cli, "@neb:hyrule", "", false, nil); roomID != "" || err != nil {
+		t.Errorf("Expected no room without create_room_if_missing, got %q %v", roomID, err)
+	}
+	c = RoomCreation{CreateRoomIfMissing: true}
+	if roomID, err := c.CreateMissingRoom(cli, "@neb:hyrule", "", true, nil); roomID != "" || err != nil {
+		t.Errorf("Expected no room when the service has rooms, got %q %v", roomID, err)
+	}
+
+	c = RoomCreation{
+		CreateRoomIfMissing: true,
+		RoomName:            "Alerts",
+		RoomTopic:           "Alerts from production",
+		RoomInvite:          []id.UserID{"@alice:hyrule"},
+		RoomEncrypted:       true,
+	}
+	roomID, err := c.CreateMissingRoom(cli, "@neb:hyrule", "@bob:hyrule", false, nil)
+	if err != nil {
+		t.Fatalf("CreateMissingRoom returned an error: %s", err)
+	}
+	if roomID != "!new:hyrule" || c.CreatedRoomID != "!new:hyrule" {
+		t.Errorf("Expected the created room to be returned and stored, got %q and %q", roomID, c.CreatedRoomID)
+	}
+	if len(created) != 1 {
+		t.Fatalf("Expected 1 room to be created, got %d", len(created))
+	}
+	req := created[0]
+	if req.Name != "Alerts" || req.Topic != "Alerts from production" || len(req.Invite) != 2 || req.Invite[1] != "@bob:hyrule" {
+		t.Errorf("Expected the room's name, topic and invites to be set, got %+v", req)
+	}
+	for _, u := range []id.UserID{"@neb:hyrule", "@alice:hyrule", "@bob:hyrule"} {
+		if req.PowerLevelOverride == nil || req.PowerLevelOverride.Users[u] != 100 {
+			t.Errorf("Expected %s to be an admin, got %+v", u, req.PowerLevelOverride)
+		}
+	}
+	if len(req.InitialState) != 1 || req.InitialState[0].Type != "m.room.encryption" {
+		t.Errorf("Expected encryption to be enabled, got %+v", req.InitialState)
+	}
+
+	// Updating the service reuses the room
+	updated := RoomCreation{CreateRoomIfMissing: true}
+	if roomID, err := updated.CreateMissingRoom(cli, "@neb:hyrule", "", false, &c); roomID != "!new:hyrule" || err != nil {
+		t.Errorf("Expected the old room to be reused, got %q %v", roomID, err)
+	}
+	if len(created) != 1 {
+		t.Errorf("Expected no more rooms to be created, got %d", len(created))
+	}
+}
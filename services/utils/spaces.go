@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// SpaceRefreshInterval is how long the rooms in a space, and room tags, are cached for. Rooms
+// which are added to a space or tagged start receiving notifications within this time.
+const SpaceRefreshInterval = 10 * time.Minute
+
+// The most pages of the space hierarchy to fetch, to bound the work done for huge spaces.
+const maxHierarchyPages = 20
+
+const roomTypeSpace = "m.space"
+
+type spaceKey struct {
+	userID id.UserID
+	roomID id.RoomID
+}
+
+type spaceEntry struct {
+	rooms     []id.RoomID
+	fetchedAt time.Time
+}
+
+var (
+	spacesMutex sync.Mutex
+	spaceCache  = make(map[spaceKey]spaceEntry)
+)
+
+// hierarchyResponse is the response to GET /_matrix/client/v1/rooms/{roomID}/hierarchy
+type hierarchyResponse struct {
+	Rooms []struct {
+		RoomID   id.RoomID `json:"room_id"`
+		RoomType string    `json:"room_type"`
+	} `json:"rooms"`
+	NextBatch string `json:"next_batch"`
+}
+
+// SpaceRooms returns the rooms to send into for a configured room ID. If roomID is a Space this
+// is every room in it, including rooms in subspaces, but not the spaces themselves. Otherwise it
+// is just roomID. This lets services target "all rooms in this space". userID is the user ID of
+// cli, as which rooms are visible depends on the user.
+//
+// Results are cached for SpaceRefreshInterval, so rooms which are added to the space are picked
+// up without any config changes. The client joins rooms when they are first found in the space.
+// If the space hierarchy can't be fetched, the last known rooms are returned.
+func SpaceRooms(cli types.MatrixClient, userID id.UserID, roomID id.RoomID) []id.RoomID {
+	key := spaceKey{userID, roomID}
+	spacesMutex.Lock()
+	entry, cached := spaceCache[key]
+	spacesMutex.Unlock()
+	if cached && time.Since(entry.fetchedAt) < SpaceRefreshInterval {
+		return entry.rooms
+	}
+
+	logger := log.WithField("room_id", roomID)
+	rooms, err := fetchSpaceRooms(cli, roomID)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to fetch space hierarchy")
+		if cached {
+			return entry.rooms
+		}
+		// Most likely this homeserver doesn't support spaces, so treat it as a plain room
+		// until we next check.
+		rooms = []id.RoomID{roomID}
+	}
+	if len(rooms) == 0 {
+		// An empty space, one with only subspaces, or one whose rooms can't be seen.
+		rooms = []id.RoomID{}
+	} else if len(rooms) > 1 || rooms[0] != roomID {
+		joinNewRooms(cli, entry.rooms, rooms)
+	}
+
+	spacesMutex.Lock()
+	spaceCache[key] = spaceEntry{rooms, time.Now()}
+	spacesMutex.Unlock()
+	return rooms
+}
+
+// fetchSpaceRooms walks the space hierarchy below roomID.
+func fetchSpaceRooms(cli types.MatrixClient, roomID id.RoomID) ([]id.RoomID, error) {
+	var rooms []id.RoomID
+	from := ""
+	for page := 0; page < maxHierarchyPages; page++ {
+		u, err := url.Parse(cli.BuildBaseURL("_matrix", "client", "v1", "rooms", roomID, "hierarchy"))
+		if err != nil {
+			return nil, err
+		}
+		if from != "" {
+			q := u.Query()
+			q.Set("from", from)
+			u.RawQuery = q.Encode()
+		}
+		var resp hierarchyResponse
+		if _, err := cli.MakeRequest("GET", u.String(), nil, &resp); err != nil {
+			return nil, err
+		}
+		for _, room := range resp.Rooms {
+			if room.RoomID == roomID && room.RoomType != roomTypeSpace {
+				return []id.RoomID{roomID}, nil
+			}
+			if room.RoomType != roomTypeSpace {
+				rooms = append(rooms, room.RoomID)
+			}
+		}
+		if resp.NextBatch == "" {
+			break
+		}
+		from = resp.NextBatch
+	}
+	return rooms, nil
+}
+
+func joinNewRooms(cli types.MatrixClient, oldRooms, newRooms []id.RoomID) {
+	known := make(map[id.RoomID]bool)
+	for _, roomID := range oldRooms {
+		known[roomID] = true
+	}
+	for _, roomID := range newRooms {
+		if known[roomID] {
+			continue
+		}
+		if _, err := cli.JoinRoom(roomID.String(), "", nil); err != nil {
+			log.WithError(err).WithField("room_id", roomID).Error("Failed to join room in space")
+		}
+	}
+}
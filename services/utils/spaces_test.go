@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/testutils"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestSpaceRooms(t *testing.T) {
+	var joined []string
+	hierarchyRequests := 0
+	trans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		body := `{"errcode":"M_NOT_FOUND"}`
+		code := 404
+		switch {
+		case strings.Contains(req.URL.Path, "/join/"):
+			joined = append(joined, req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:])
+			code, body = 200, `{"room_id":"!joined:hyrule"}`
+		case strings.Contains(req.URL.Path, "/rooms/!team:hyrule/hierarchy"):
+			hierarchyRequests++
+			code = 200
+			if req.URL.Query().Get("from") == "" {
+				body = `{"rooms":[
+					{"room_id":"!team:hyrule","room_type":"m.space"},
+					{"room_id":"!backend:hyrule"},
+					{"room_id":"!sub:hyrule","room_type":"m.space"}
+				],"next_batch":"page2"}`
+			} else {
+				body = `{"rooms":[{"room_id":"!frontend:hyrule"}]}`
+			}
+		case strings.Contains(req.URL.Path, "/rooms/!empty:hyrule/hierarchy"):
+			code, body = 200, `{"rooms":[{"room_id":"!empty:hyrule","room_type":"m.space"}]}`
+		case strings.Contains(req.URL.Path, "/rooms/!nested:hyrule/hierarchy"):
+			code, body = 200, `{"rooms":[
+				{"room_id":"!nested:hyrule","room_type":"m.space"},
+				{"room_id":"!inner:hyrule","room_type":"m.space"}
+			]}`
+		case strings.Contains(req.URL.Path, "/rooms/!plain:hyrule/hierarchy"):
+			code, body = 200, `{"rooms":[{"room_id":"!plain:hyrule"}]}`
+		}
+		return &http.Response{
+			StatusCode: code,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+	cli, _ := mautrix.NewClient("https://hyrule", "@neb:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: trans}
+
+	want := []id.RoomID{"!backend:hyrule", "!frontend:hyrule"}
+	if got := SpaceRooms(cli, "@neb:hyrule", "!team:hyrule"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Space: want %v, got %v", want, got)
+	}
+	if want := []string{"!backend:hyrule", "!frontend:hyrule"}; !reflect.DeepEqual(joined, want) {
+		t.Errorf("Expected rooms in the space to be joined: want %v, got %v", want, joined)
+	}
+	// Cached
+	SpaceRooms(cli, "@neb:hyrule", "!team:hyrule")
+	if hierarchyRequests != 2 {
+		t.Errorf("Expected the space to be cached, got %d hierarchy requests", hierarchyRequests)
+	}
+
+	for _, roomID := range []id.RoomID{"!plain:hyrule", "!unsupported:hyrule"} {
+		if got := SpaceRooms(cli, "@neb:hyrule", roomID); !reflect.DeepEqual(got, []id.RoomID{roomID}) {
+			t.Errorf("Room %s: want just the room, got %v", roomID, got)
+		}
+	}
+
+	// Spaces without any rooms, or with only subspaces, have no rooms to send into
+	joined = nil
+	for _, roomID := range []id.RoomID{"!empty:hyrule", "!nested:hyrule"} {
+		got := SpaceRooms(cli, "@neb:hyrule", roomID)
+		if got == nil || len(got) != 0 {
+			t.Errorf("Space %s: want no rooms, got %v", roomID, got)
+		}
+		// Cached
+		if got := SpaceRooms(cli, "@neb:hyrule", roomID); got == nil || len(got) != 0 {
+			t.Errorf("Space %s: want no rooms from the cache, got %v", roomID, got)
+		}
+	}
+	if len(joined) != 0 {
+		t.Errorf("Expected no rooms to be joined for empty spaces, got %v", joined)
+	}
+}
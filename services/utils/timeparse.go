@@ -0,0 +1,383 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultTimeOfDay is the time used when an expression names a day but not a time, e.g. "tomorrow".
+const DefaultTimeOfDay = 9 * time.Hour
+
+// ParsedTime is the result of parsing a natural language time expression.
+type ParsedTime struct {
+	// When the event should (first) happen.
+	At time.Time
+	// The interval between repeats. Zero if the event only happens once.
+	Every time.Duration
+}
+
+// ErrNoTime is returned by ParseTime when the words do not start with a time expression.
+var ErrNoTime = errors.New("No time given. Try e.g. \"in 90 minutes\", \"next friday 17:00\" or \"every 2 weeks\"")
+
+var (
+	clockRegex  = regexp.MustCompile(`^(\d{1,2})(?:[:.](\d{2}))?(am|pm)?$`)
+	numberRegex = regexp.MustCompile(`^\d+$`)
+	// time.ParseDuration doesn't know days or weeks
+	daysRegex = regexp.MustCompile(`^(\d+)([dw])$`)
+	weekdays  = map[string]time.Weekday{
+		"sunday": time.Sunday, "sun": time.Sunday,
+		"monday": time.Monday, "mon": time.Monday,
+		"tuesday": time.Tuesday, "tue": time.Tuesday, "tues": time.Tuesday,
+		"wednesday": time.Wednesday, "wed": time.Wednesday,
+		"thursday": time.Thursday, "thu": time.Thursday, "thurs": time.Thursday,
+		"friday": time.Friday, "fri": time.Friday,
+		"saturday": time.Saturday, "sat": time.Saturday,
+	}
+	units = map[string]time.Duration{
+		"s": time.Second, "sec": time.Second, "secs": time.Second, "second": time.Second, "seconds": time.Second,
+		"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+		"h": time.Hour, "hr": time.Hour, "hrs": time.Hour, "hour": time.Hour, "hours": time.Hour,
+		"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+	}
+)
+
+// ParseTime parses a natural language time expression from the start of words and returns
+// the parsed time along with the words which were not part of the expression. All times are
+// relative to now and interpreted in loc. The supported forms are:
+//
+//   in 90 minutes, in 1 hour and 30 minutes, in 2h30m, 2h30m
+//   today 17:00, tomorrow at 5pm, friday 9:30, next friday at 17:00, 2016-11-29 12:00
+//   at 17:00, 17:00, noon, midnight
+//   every 2 weeks, every day at 9:00, every monday 10am
+//
+// A day without a time means DefaultTimeOfDay. A bare weekday or time refers to the next
+// occurrence which is still in the future, whereas "next <weekday>" always skips today. Times
+// "today" or on a date which have already passed, and durations which aren't positive, are errors.
+// Returns ErrNoTime if words do not start with a time expression.
+func ParseTime(words []string, now time.Time, loc *time.Location) (ParsedTime, []string, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	now = now.In(loc)
+	p := &timeParser{words: words}
+	switch p.peek() {
+	case "every":
+		p.next()
+		return p.parseEvery(now)
+	case "in":
+		p.next()
+		d, ok := p.parseDuration()
+		if !ok {
+			return ParsedTime{}, words, errors.New("Expected a duration after \"in\", e.g. \"in 90 minutes\"")
+		}
+		return ParsedTime{At: now.Add(d)}, p.rest(), nil
+	}
+	if d, ok := p.parseDuration(); ok {
+		return ParsedTime{At: now.Add(d)}, p.rest(), nil
+	}
+	at, ok, err := p.parseDayAndTime(now)
+	if err != nil {
+		return ParsedTime{}, words, err
+	}
+	if !ok {
+		return ParsedTime{}, words, ErrNoTime
+	}
+	return ParsedTime{At: at}, p.rest(), nil
+}
+
+// ParseDuration parses a duration such as "15m", "30d", "90 minutes" or "1 hour and 30 minutes" from the
+// start of words and returns it along with the words which were not part of it. Returns false if
+// words do not start with a duration.
+func ParseDuration(words []string) (time.Duration, []string, bool) {
+	p := &timeParser{words: words}
+	d, ok := p.parseDuration()
+	return d, p.rest(), ok
+}
+
+// Describe returns a confirmation string for the parsed time, e.g.
+// "Fri, 27 Nov 2026 17:00 CET (in 2 days), repeating every 1 week".
+func (pt ParsedTime) Describe(now time.Time) string {
+	s := fmt.Sprintf("%s (in %s)", pt.At.Format("Mon, 02 Jan 2006 15:04 MST"), HumanDuration(pt.At.Sub(now)))
+	if pt.Every > 0 {
+		s += ", repeating every " + HumanDuration(pt.Every)
+	}
+	return s
+}
+
+// NextRepeat returns when an event repeating every interval, which was last due at prev, is next
+// due. Repeats of whole days keep prev's time of day in loc, so they don't drift when the clocks
+// change.
+func NextRepeat(prev time.Time, every time.Duration, loc *time.Location) time.Time {
+	if every%(24*time.Hour) != 0 {
+		return prev.Add(every)
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	return prev.In(loc).AddDate(0, 0, int(every/(24*time.Hour)))
+}
+
+// HumanDuration formats a duration using the largest whole units, e.g. "1 day 2 hours".
+// Seconds are only shown for durations under a minute.
+func HumanDuration(d time.Duration) string {
+	if d < time.Minute {
+		return pluralise(int64(d.Round(time.Second)/time.Second), "second")
+	}
+	d = d.Round(time.Minute)
+	var parts []string
+	for _, u := range []struct {
+		name string
+		d    time.Duration
+	}{{"week", 7 * 24 * time.Hour}, {"day", 24 * time.Hour}, {"hour", time.Hour}, {"minute", time.Minute}} {
+		if n := d / u.d; n > 0 {
+			parts = append(parts, pluralise(int64(n), u.name))
+			d -= n * u.d
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func pluralise(n int64, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// RoomLocation returns the time zone configured for this room via the "timezone" bot option,
+// or UTC if there isn't one. Errors are logged and treated as no option being set.
+func RoomLocation(botUserID id.UserID, roomID id.RoomID) *time.Location {
+	logger := log.WithFields(log.Fields{
+		"room_id":     roomID,
+		"bot_user_id": botUserID,
+	})
+	opts, err := database.GetServiceDB().LoadBotOptions(botUserID, roomID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logger.WithError(err).Error("Failed to load bot options")
+		}
+		return time.UTC
+	}
+	if opts.Options == nil || opts.Options.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(opts.Options.Timezone)
+	if err != nil {
+		logger.WithError(err).WithField("timezone", opts.Options.Timezone).Warn("Unknown room timezone")
+		return time.UTC
+	}
+	return loc
+}
+
+type timeParser struct {
+	words []string
+	pos   int
+}
+
+func (p *timeParser) peek() string {
+	if p.pos >= len(p.words) {
+		return ""
+	}
+	return strings.ToLower(p.words[p.pos])
+}
+
+func (p *timeParser) next() string {
+	w := p.peek()
+	p.pos++
+	return w
+}
+
+func (p *timeParser) rest() []string {
+	if p.pos >= len(p.words) {
+		return []string{}
+	}
+	return p.words[p.pos:]
+}
+
+// parseDuration consumes "90 minutes", "1 hour and 30 minutes", "2h30m" or "30d". Durations which
+// aren't positive, e.g. "-5m" or "0 minutes", are not consumed.
+func (p *timeParser) parseDuration() (time.Duration, bool) {
+	begin := p.pos
+	var total time.Duration
+	for {
+		start := p.pos
+		w := p.next()
+		if d, err := time.ParseDuration(w); err == nil && d > 0 && !numberRegex.MatchString(w) {
+			total += d
+		} else if m := daysRegex.FindStringSubmatch(w); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			total += time.Duration(n) * units[m[2]]
+		} else if numberRegex.MatchString(w) && units[p.peek()] > 0 {
+			n, _ := strconv.Atoi(w)
+			total += time.Duration(n) * units[p.next()]
+		} else {
+			p.pos = start
+			if total <= 0 {
+				p.pos = begin
+				return 0, false
+			}
+			return total, true
+		}
+		if p.peek() == "and" && p.pos+1 < len(p.words) {
+			p.next()
+		}
+	}
+}
+
+func (p *timeParser) parseEvery(now time.Time) (ParsedTime, []string, error) {
+	w := p.peek()
+	if wd, ok := weekdays[w]; ok {
+		p.next()
+		clock, _ := p.parseClock()
+		return ParsedTime{At: nextWeekday(now, wd, clock, false), Every: 7 * 24 * time.Hour}, p.rest(), nil
+	}
+	n := 1
+	if numberRegex.MatchString(w) {
+		p.next()
+		n, _ = strconv.Atoi(w)
+	}
+	unit := units[p.next()]
+	if unit == 0 || n == 0 {
+		return ParsedTime{}, p.words, errors.New("Expected an interval after \"every\", e.g. \"every 2 weeks\" or \"every monday\"")
+	}
+	every := time.Duration(n) * unit
+	at := now.Add(every)
+	// "every day at 9:00" should be anchored to that time of day
+	if unit >= 24*time.Hour {
+		if clock, ok := p.parseClock(); ok {
+			at = nextClock(now, clock)
+		}
+	}
+	return ParsedTime{At: at, Every: every}, p.rest(), nil
+}
+
+func (p *timeParser) parseDayAndTime(now time.Time) (time.Time, bool, error) {
+	w := p.peek()
+	switch {
+	case w == "today" || w == "tomorrow":
+		p.next()
+		clock, ok := p.parseClock()
+		if !ok {
+			clock = DefaultTimeOfDay
+		}
+		if w == "tomorrow" {
+			return atClock(now.AddDate(0, 0, 1), clock), true, nil
+		}
+		at := atClock(now, clock)
+		if !at.After(now) {
+			return time.Time{}, false, fmt.Errorf("%s today has already passed", at.Format("15:04"))
+		}
+		return at, true, nil
+	case w == "next":
+		p.next()
+		wd, ok := weekdays[p.next()]
+		if !ok {
+			return time.Time{}, false, errors.New("Expected a weekday after \"next\", e.g. \"next friday\"")
+		}
+		clock, ok := p.parseClock()
+		if !ok {
+			clock = DefaultTimeOfDay
+		}
+		return nextWeekday(now, wd, clock, true), true, nil
+	}
+	if wd, ok := weekdays[w]; ok {
+		p.next()
+		clock, ok := p.parseClock()
+		if !ok {
+			clock = DefaultTimeOfDay
+		}
+		return nextWeekday(now, wd, clock, false), true, nil
+	}
+	if date, err := time.ParseInLocation("2006-01-02", w, now.Location()); err == nil {
+		p.next()
+		clock, ok := p.parseClock()
+		if !ok {
+			clock = DefaultTimeOfDay
+		}
+		at := atClock(date, clock)
+		if !at.After(now) {
+			return time.Time{}, false, fmt.Errorf("%s has already passed", at.Format("2006-01-02 15:04"))
+		}
+		return at, true, nil
+	}
+	if clock, ok := p.parseClock(); ok {
+		return nextClock(now, clock), true, nil
+	}
+	return time.Time{}, false, nil
+}
+
+// parseClock consumes an optional "at" followed by a time of day and returns the offset from
+// midnight. Nothing is consumed if there is no time of day.
+func (p *timeParser) parseClock() (time.Duration, bool) {
+	start := p.pos
+	if p.peek() == "at" {
+		p.next()
+	}
+	w := p.next()
+	switch w {
+	case "noon", "midday":
+		return 12 * time.Hour, true
+	case "midnight":
+		return 0, true
+	}
+	if suffix := p.peek(); (suffix == "am" || suffix == "pm") && numberRegex.MatchString(w) {
+		w += p.next()
+	}
+	m := clockRegex.FindStringSubmatch(w)
+	// a bare number without a ":mm" or am/pm is too ambiguous to be a time
+	if m == nil || (m[2] == "" && m[3] == "") {
+		p.pos = start
+		return 0, false
+	}
+	hour, _ := strconv.Atoi(m[1])
+	minute, _ := strconv.Atoi(m[2])
+	if m[3] != "" {
+		if hour < 1 || hour > 12 {
+			p.pos = start
+			return 0, false
+		}
+		hour %= 12
+		if m[3] == "pm" {
+			hour += 12
+		}
+	}
+	if hour > 23 || minute > 59 {
+		p.pos = start
+		return 0, false
+	}
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute, true
+}
+
+// atClock returns the given day at the given offset from midnight, respecting DST changes.
+func atClock(day time.Time, clock time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), int(clock/time.Hour), int(clock%time.Hour/time.Minute), 0, 0, day.Location())
+}
+
+// nextClock returns the next time it is this time of day, which may be today.
+func nextClock(now time.Time, clock time.Duration) time.Time {
+	t := atClock(now, clock)
+	if !t.After(now) {
+		t = atClock(now.AddDate(0, 0, 1), clock)
+	}
+	return t
+}
+
+// nextWeekday returns the next time it is this weekday and time of day. If skipToday is
+// false, this may be today if the time of day is still in the future.
+func nextWeekday(now time.Time, wd time.Weekday, clock time.Duration, skipToday bool) time.Time {
+	days := (int(wd) - int(now.Weekday()) + 7) % 7
+	if days == 0 && (skipToday || !atClock(now, clock).After(now)) {
+		days = 7
+	}
+	return atClock(now.AddDate(0, 0, days), clock)
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("No time zone database available: ", err)
+	}
+	// A Wednesday
+	now := time.Date(2016, 11, 30, 12, 0, 0, 0, london)
+	day := 24 * time.Hour
+
+	parseTests := []struct {
+		input     string
+		wantAt    time.Time
+		wantEvery time.Duration
+		wantRest  []string
+	}{
+		{"in 90 minutes check the oven", now.Add(90 * time.Minute), 0, []string{"check", "the", "oven"}},
+		{"in 1 hour and 30 minutes", now.Add(90 * time.Minute), 0, []string{}},
+		{"2h30m check the oven", now.Add(150 * time.Minute), 0, []string{"check", "the", "oven"}},
+		{"tomorrow at 5pm", time.Date(2016, 12, 1, 17, 0, 0, 0, london), 0, []string{}},
+		{"today 17:30", time.Date(2016, 11, 30, 17, 30, 0, 0, london), 0, []string{}},
+		{"tomorrow standup", time.Date(2016, 12, 1, 9, 0, 0, 0, london), 0, []string{"standup"}},
+		{"Friday 17:00", time.Date(2016, 12, 2, 17, 0, 0, 0, london), 0, []string{}},
+		{"wednesday 17:00", time.Date(2016, 11, 30, 17, 0, 0, 0, london), 0, []string{}},
+		{"next wednesday 17:00", time.Date(2016, 12, 7, 17, 0, 0, 0, london), 0, []string{}},
+		{"11:00 coffee", time.Date(2016, 12, 1, 11, 0, 0, 0, london), 0, []string{"coffee"}},
+		{"at noon", time.Date(2016, 12, 1, 12, 0, 0, 0, london), 0, []string{}},
+		{"2016-12-25 10am presents", time.Date(2016, 12, 25, 10, 0, 0, 0, london), 0, []string{"presents"}},
+		{"2016-11-30 17:00", time.Date(2016, 11, 30, 17, 0, 0, 0, london), 0, []string{}},
+		{"every 2 weeks", now.Add(14 * day), 14 * day, []string{}},
+		{"every day at 9:00 standup", time.Date(2016, 12, 1, 9, 0, 0, 0, london), day, []string{"standup"}},
+		{"every monday 10 am", time.Date(2016, 12, 5, 10, 0, 0, 0, london), 7 * day, []string{}},
+	}
+	for _, test := range parseTests {
+		pt, rest, err := ParseTime(strings.Fields(test.input), now, london)
+		if err != nil {
+			t.Errorf("ParseTime(%q): unexpected error %s", test.input, err)
+			continue
+		}
+		if !pt.At.Equal(test.wantAt) || pt.Every != test.wantEvery {
+			t.Errorf("ParseTime(%q): want %s every %s, got %s every %s", test.input, test.wantAt, test.wantEvery, pt.At, pt.Every)
+		}
+		if !reflect.DeepEqual(rest, test.wantRest) {
+			t.Errorf("ParseTime(%q): want rest %v, got %v", test.input, test.wantRest, rest)
+		}
+	}
+
+	for _, input := range []string{"check the oven", "5 apples", "next week", "every", "in a bit", "in -5m", "in 0 minutes", "-5m", "today 9am", "today",
+		"2016-11-29 12:00", "2016-11-30 12:00", "2016-11-30", "2015-12-25 10am"} {
+		if _, _, err := ParseTime(strings.Fields(input), now, london); err == nil {
+			t.Errorf("ParseTime(%q): expected an error", input)
+		}
+	}
+}
+
+func TestParseTimeDST(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("No time zone database available: ", err)
+	}
+	// The clocks go forward at 01:00 on 2016-03-27 and back at 02:00 on 2016-10-30.
+	for _, test := range []struct {
+		now    time.Time
+		input  string
+		wantAt time.Time
+	}{
+		{time.Date(2016, 3, 26, 12, 0, 0, 0, london), "tomorrow 9:00", time.Date(2016, 3, 27, 9, 0, 0, 0, london)},
+		{time.Date(2016, 3, 27, 0, 30, 0, 0, london), "today 17:00", time.Date(2016, 3, 27, 17, 0, 0, 0, london)},
+		{time.Date(2016, 10, 29, 12, 0, 0, 0, london), "2016-10-30 12:00", time.Date(2016, 10, 30, 12, 0, 0, 0, london)},
+		{time.Date(2016, 10, 29, 12, 0, 0, 0, london), "tomorrow", time.Date(2016, 10, 30, 9, 0, 0, 0, london)},
+	} {
+		pt, _, err := ParseTime(strings.Fields(test.input), test.now, london)
+		if err != nil {
+			t.Errorf("ParseTime(%q) at %s: unexpected error %s", test.input, test.now, err)
+			continue
+		}
+		if !pt.At.Equal(test.wantAt) {
+			t.Errorf("ParseTime(%q) at %s: want %s, got %s", test.input, test.now, test.wantAt, pt.At)
+		}
+	}
+}
+
+func TestNextRepeat(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("No time zone database available: ", err)
+	}
+	// The clocks go forward at 01:00 on 2016-03-27.
+	prev := time.Date(2016, 3, 26, 9, 0, 0, 0, london)
+	for _, test := range []struct {
+		every time.Duration
+		want  time.Time
+	}{
+		{24 * time.Hour, time.Date(2016, 3, 27, 9, 0, 0, 0, london)},
+		{7 * 24 * time.Hour, time.Date(2016, 4, 2, 9, 0, 0, 0, london)},
+		{12 * time.Hour, time.Date(2016, 3, 26, 21, 0, 0, 0, london)},
+		{36 * time.Hour, time.Date(2016, 3, 27, 22, 0, 0, 0, london)},
+	} {
+		if got := NextRepeat(prev, test.every, london); !got.Equal(test.want) {
+			t.Errorf("NextRepeat(%s, %s): want %s, got %s", prev, test.every, test.want, got)
+		}
+	}
+}
+
+func TestParsedTimeDescribe(t *testing.T) {
+	now := time.Date(2016, 11, 30, 12, 0, 0, 0, time.UTC)
+	pt := ParsedTime{At: now.Add(26*time.Hour + 30*time.Minute), Every: 14 * 24 * time.Hour}
+	want := "Thu, 01 Dec 2016 14:30 UTC (in 1 day 2 hours 30 minutes), repeating every 2 weeks"
+	if got := pt.Describe(now); got != want {
+		t.Errorf("Describe: want %q, got %q", want, got)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for input, want := range map[string]time.Duration{
+		"15m pizza":                   15 * time.Minute,
+		"1 hour and 30 minutes pizza": 90 * time.Minute,
+		"90 s pizza":                  90 * time.Second,
+		"30d pizza":                   30 * 24 * time.Hour,
+		"2w 1d pizza":                 15 * 24 * time.Hour,
+	} {
+		d, rest, ok := ParseDuration(strings.Fields(input))
+		if !ok || d != want || !reflect.DeepEqual(rest, []string{"pizza"}) {
+			t.Errorf("ParseDuration(%q): want %s [pizza], got %s %v (ok=%v)", input, want, d, rest, ok)
+		}
+	}
+	for _, input := range []string{"tomorrow pizza", "-5m pizza", "0 minutes pizza", "0s pizza"} {
+		if _, rest, ok := ParseDuration(strings.Fields(input)); ok || !reflect.DeepEqual(rest, strings.Fields(input)) {
+			t.Errorf("ParseDuration(%q): expected no duration, got rest %v (ok=%v)", input, rest, ok)
+		}
+	}
+}
@@ -1,21 +1,47 @@
 package utils
 
 import (
-	"html"
-	"regexp"
+	"path"
+	"strings"
 
 	mevt "maunium.net/go/mautrix/event"
 )
 
-var htmlRegex = regexp.MustCompile("<[^<]+?>")
-
-// StrippedHTMLMessage returns a MessageEventContent with the body set to a stripped version of the provided HTML,
-// in addition to the provided HTML.
+// StrippedHTMLMessage returns a MessageEventContent with the provided HTML, and the body set to its
+// plain text, as rendered by PlainText.
 func StrippedHTMLMessage(msgtype mevt.MessageType, htmlText string) mevt.MessageEventContent {
 	return mevt.MessageEventContent{
-		Body:          html.UnescapeString(htmlRegex.ReplaceAllLiteralString(htmlText, "")),
+		Body:          PlainText(htmlText),
 		MsgType:       msgtype,
 		Format:        mevt.FormatHTML,
 		FormattedBody: htmlText,
 	}
 }
+
+// MatchGlob returns true if the slash-separated name matches the pattern. Each segment of the
+// pattern is matched as by path.Match, except that a "**" segment matches any number of
+// segments, e.g. "docs/**" matches "docs/index.md" and "docs/api/v1.md".
+func MatchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
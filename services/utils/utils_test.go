@@ -17,3 +17,29 @@ func TestHTMLStrip(t *testing.T) {
 		t.Fatalf(`Expected Body "%v", got "%v"`, expected, stripped.Body)
 	}
 }
+
+func TestMatchGlob(t *testing.T) {
+	globTests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"main", "main", true},
+		{"main", "master", false},
+		{"release/*", "release/1.0", true},
+		{"release/*", "release/1.0/hotfix", false},
+		{"docs/**", "docs/index.md", true},
+		{"docs/**", "docs/api/v1.md", true},
+		{"docs/**", "src/docs/index.md", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "services/utils/utils.go", true},
+		{"**/*.go", "README.md", false},
+		{"services/**/README.md", "services/github/README.md", true},
+		{"services/**/README.md", "services/README.md", true},
+	}
+	for _, test := range globTests {
+		if got := MatchGlob(test.pattern, test.name); got != test.want {
+			t.Errorf("MatchGlob(%q, %q): want %v, got %v", test.pattern, test.name, test.want, got)
+		}
+	}
+}
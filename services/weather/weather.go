@@ -0,0 +1,433 @@
+// Package weather implements a Service which responds to !weather and !forecast commands with
+// the weather from Open-Meteo.
+package weather
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	log "github.com/sirupsen/logrus"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServiceType of the Weather service
+const ServiceType = "weather"
+
+const (
+	defaultForecastURL  = "https://api.open-meteo.com/v1/forecast"
+	defaultGeocodingURL = "https://geocoding-api.open-meteo.com/v1/search"
+	forecastDays        = 3
+)
+
+// Supported values for the units.
+const (
+	unitsMetric   = "metric"
+	unitsImperial = "imperial"
+)
+
+// Matches locations given as coordinates, e.g. "52.52, 13.41".
+var coordinatesRegex = regexp.MustCompile(`^(-?\d{1,2}(?:\.\d+)?)\s*,\s*(-?\d{1,3}(?:\.\d+)?)$`)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// unitSystem holds the Open-Meteo query parameters and labels for a system of units.
+type unitSystem struct {
+	params        url.Values
+	temperature   string
+	windSpeed     string
+	precipitation string
+	// The number of decimal places to show precipitation to.
+	precision int
+}
+
+var unitSystems = map[string]unitSystem{
+	unitsMetric: {
+		params:        url.Values{},
+		temperature:   "°C",
+		windSpeed:     "km/h",
+		precipitation: "mm",
+		precision:     1,
+	},
+	unitsImperial: {
+		params: url.Values{
+			"temperature_unit":   {"fahrenheit"},
+			"windspeed_unit":     {"mph"},
+			"precipitation_unit": {"inch"},
+		},
+		temperature:   "°F",
+		windSpeed:     "mph",
+		precipitation: "in",
+		precision:     2,
+	},
+}
+
+// A place found by the geocoding API.
+type place struct {
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Country   string  `json:"country"`
+	// The country's two letter code, e.g. "GB".
+	CountryCode string `json:"country_code"`
+	// The state, region or similar, e.g. "England".
+	Admin1 string `json:"admin1"`
+}
+
+func (p *place) String() string {
+	if p.Country == "" {
+		return p.Name
+	}
+	return p.Name + ", " + p.Country
+}
+
+// matches returns true if the qualifier given after the place name, e.g. "UK" in "London, UK",
+// matches the place's country or region.
+func (p *place) matches(qualifier string) bool {
+	qualifier = strings.ToLower(qualifier)
+	if qualifier == "uk" {
+		qualifier = "gb"
+	}
+	for _, s := range []string{p.Country, p.CountryCode, p.Admin1} {
+		if s != "" && strings.ToLower(s) == qualifier {
+			return true
+		}
+	}
+	return false
+}
+
+type geocodingResults struct {
+	Results []place `json:"results"`
+}
+
+type forecastResponse struct {
+	CurrentWeather struct {
+		Temperature   float64 `json:"temperature"`
+		WindSpeed     float64 `json:"windspeed"`
+		WindDirection float64 `json:"winddirection"`
+		WeatherCode   int     `json:"weathercode"`
+	} `json:"current_weather"`
+	Daily struct {
+		Time             []string  `json:"time"`
+		WeatherCode      []int     `json:"weathercode"`
+		TemperatureMax   []float64 `json:"temperature_2m_max"`
+		TemperatureMin   []float64 `json:"temperature_2m_min"`
+		PrecipitationSum []float64 `json:"precipitation_sum"`
+	} `json:"daily"`
+}
+
+// Service contains the Config fields for the Weather service.
+//
+// Rooms can set the location to use when a command doesn't name one, and their own units, in
+// the "weather" section of their m.room.bot.options state event:
+//   {
+//       "weather": {
+//           "location": "Berlin",
+//           "units": "metric"
+//       }
+//   }
+//
+// Example request:
+//   {
+//       "units": "imperial",
+//       "default_location": "New York"
+//   }
+type Service struct {
+	types.DefaultService
+	// Optional. "metric" or "imperial". Defaults to "metric".
+	Units string `json:"units"`
+	// Optional. The location to use in rooms which haven't set one when a command doesn't name
+	// one, e.g. "London, UK".
+	DefaultLocation string `json:"default_location"`
+	// Optional. The URL of the Open-Meteo forecast API, e.g. for a self-hosted instance.
+	ForecastURL string `json:"forecast_url"`
+	// Optional. The URL of the Open-Meteo geocoding API, e.g. for a self-hosted instance.
+	GeocodingURL string `json:"geocoding_url"`
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if _, ok := unitSystems[s.Units]; s.Units != "" && !ok {
+		return fmt.Errorf("units must be '%s' or '%s'", unitsMetric, unitsImperial)
+	}
+	for _, u := range []string{s.ForecastURL, s.GeocodingURL} {
+		if _, err := url.Parse(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commands supported:
+//    !weather [location]
+// Responds with the current weather at the location.
+//    !forecast [location]
+// Responds with the forecast for the next 3 days at the location.
+//
+// The location is a place name, optionally followed by its country or region, e.g.
+// "Portland, Maine", or coordinates, e.g. "52.52, 13.41". It defaults to the room's location.
+func (s *Service) Commands(client types.MatrixClient) []types.Command {
+	return []types.Command{
+		{
+			Path:       []string{"weather"},
+			Idempotent: true,
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdWeather(roomID, args, false)
+			},
+		},
+		{
+			Path:       []string{"forecast"},
+			Idempotent: true,
+			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
+				return s.cmdWeather(roomID, args, true)
+			},
+		},
+	}
+}
+
+func usageMessage() *mevt.MessageEventContent {
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body: "Usage:\n!weather location\n!forecast location\n" +
+			"The location can be left out if the room has set one in its weather bot options.",
+	}
+}
+
+func (s *Service) cmdWeather(roomID id.RoomID, args []string, forecast bool) (interface{}, error) {
+	opts := s.roomOptions(roomID)
+	location := strings.TrimSpace(strings.Join(args, " "))
+	if location == "" {
+		location = opts.Location
+	}
+	if location == "" {
+		location = s.DefaultLocation
+	}
+	if location == "" {
+		return usageMessage(), nil
+	}
+	units := s.Units
+	if _, ok := unitSystems[opts.Units]; ok {
+		units = opts.Units
+	}
+	if units == "" {
+		units = unitsMetric
+	}
+
+	p, err := s.findPlace(location)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return &mevt.MessageEventContent{
+			MsgType: mevt.MsgNotice,
+			Body:    fmt.Sprintf("Couldn't find %s.", location),
+		}, nil
+	}
+	res, err := s.fetchForecast(p, units)
+	if err != nil {
+		return nil, err
+	}
+	body := currentMessage(p, res, unitSystems[units])
+	if forecast {
+		body = forecastMessage(p, res, unitSystems[units])
+	}
+	return &mevt.MessageEventContent{
+		MsgType: mevt.MsgNotice,
+		Body:    body,
+	}, nil
+}
+
+// roomOptions returns the weather options set for the room, if any.
+func (s *Service) roomOptions(roomID id.RoomID) types.WeatherOptions {
+	opts, err := database.GetServiceDB().LoadBotOptions(s.ServiceUserID(), roomID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithError(err).WithField("room_id", roomID).Error("Failed to load bot options")
+		}
+		return types.WeatherOptions{}
+	}
+	if opts.Options == nil {
+		return types.WeatherOptions{}
+	}
+	return opts.Options.Weather
+}
+
+// findPlace looks up the location, returning nil if there is no such place.
+func (s *Service) findPlace(location string) (*place, error) {
+	if m := coordinatesRegex.FindStringSubmatch(location); m != nil {
+		lat, _ := strconv.ParseFloat(m[1], 64)
+		lon, _ := strconv.ParseFloat(m[2], 64)
+		if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+			return nil, nil
+		}
+		return &place{Name: fmt.Sprintf("%.2f, %.2f", lat, lon), Latitude: lat, Longitude: lon}, nil
+	}
+
+	// The geocoding API only searches place names, so anything after a comma is used to pick
+	// between the places it finds.
+	name, qualifier := location, ""
+	if i := strings.Index(location, ","); i >= 0 {
+		name, qualifier = strings.TrimSpace(location[:i]), strings.TrimSpace(location[i+1:])
+	}
+	geocodingURL := s.GeocodingURL
+	if geocodingURL == "" {
+		geocodingURL = defaultGeocodingURL
+	}
+	var results geocodingResults
+	err := getJSON(geocodingURL, url.Values{
+		"name":   {name},
+		"count":  {"10"},
+		"format": {"json"},
+	}, &results)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results.Results {
+		if qualifier == "" || results.Results[i].matches(qualifier) {
+			return &results.Results[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *Service) fetchForecast(p *place, units string) (*forecastResponse, error) {
+	forecastURL := s.ForecastURL
+	if forecastURL == "" {
+		forecastURL = defaultForecastURL
+	}
+	q := url.Values{
+		"latitude":        {strconv.FormatFloat(p.Latitude, 'f', -1, 64)},
+		"longitude":       {strconv.FormatFloat(p.Longitude, 'f', -1, 64)},
+		"current_weather": {"true"},
+		"daily":           {"weathercode,temperature_2m_max,temperature_2m_min,precipitation_sum"},
+		"forecast_days":   {strconv.Itoa(forecastDays)},
+		"timezone":        {"auto"},
+	}
+	for k, v := range unitSystems[units].params {
+		q[k] = v
+	}
+	var res forecastResponse
+	if err := getJSON(forecastURL, q, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func getJSON(u string, q url.Values, out interface{}) error {
+	log.WithField("url", u).Info("Fetching weather")
+	res, err := httpClient.Get(u + "?" + q.Encode())
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode > 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("Request error: %d, %s", res.StatusCode, string(body))
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// currentMessage describes the weather now, e.g.
+// "Berlin, Germany: ⛅ Partly cloudy, 14°C, wind 12 km/h from the NW".
+func currentMessage(p *place, res *forecastResponse, units unitSystem) string {
+	cw := res.CurrentWeather
+	return fmt.Sprintf("%s: %s, %d%s, wind %d %s from the %s",
+		p, describe(cw.WeatherCode), round(cw.Temperature), units.temperature,
+		round(cw.WindSpeed), units.windSpeed, compassPoint(cw.WindDirection))
+}
+
+// forecastMessage describes the weather each day, with one line per day.
+func forecastMessage(p *place, res *forecastResponse, units unitSystem) string {
+	d := res.Daily
+	lines := []string{fmt.Sprintf("Forecast for %s:", p)}
+	for i, day := range d.Time {
+		if i >= len(d.WeatherCode) || i >= len(d.TemperatureMin) || i >= len(d.TemperatureMax) {
+			break
+		}
+		date, err := time.Parse("2006-01-02", day)
+		if err != nil {
+			continue
+		}
+		line := fmt.Sprintf("%s: %s, %d–%d%s", date.Format("Mon 2 Jan"), describe(d.WeatherCode[i]),
+			round(d.TemperatureMin[i]), round(d.TemperatureMax[i]), units.temperature)
+		if i < len(d.PrecipitationSum) && d.PrecipitationSum[i] > 0 {
+			line += fmt.Sprintf(", %.*f %s precipitation", units.precision, d.PrecipitationSum[i], units.precipitation)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func round(f float64) int {
+	return int(math.Round(f))
+}
+
+// compassPoint returns the nearest of the 8 points of the compass to the direction in degrees.
+func compassPoint(degrees float64) string {
+	points := []string{"N", "NE", "E", "SE", "S", "SW", "W", "NW"}
+	i := int(math.Round(degrees/45)) % len(points)
+	if i < 0 {
+		i += len(points)
+	}
+	return points[i]
+}
+
+// describe returns an emoji and description for a WMO weather code, as used by Open-Meteo.
+func describe(code int) string {
+	switch code {
+	case 0:
+		return "☀️ Clear sky"
+	case 1:
+		return "🌤️ Mainly clear"
+	case 2:
+		return "⛅ Partly cloudy"
+	case 3:
+		return "☁️ Overcast"
+	case 45, 48:
+		return "🌫️ Fog"
+	case 51, 53, 55:
+		return "🌦️ Drizzle"
+	case 56, 57:
+		return "🌧️ Freezing drizzle"
+	case 61, 63:
+		return "🌧️ Rain"
+	case 65:
+		return "🌧️ Heavy rain"
+	case 66, 67:
+		return "🌧️ Freezing rain"
+	case 71, 73, 77:
+		return "🌨️ Snow"
+	case 75:
+		return "❄️ Heavy snow"
+	case 80, 81, 82:
+		return "🌦️ Rain showers"
+	case 85, 86:
+		return "🌨️ Snow showers"
+	case 95:
+		return "⛈️ Thunderstorm"
+	case 96, 99:
+		return "⛈️ Thunderstorm with hail"
+	}
+	return "Unknown conditions"
+}
+
+func init() {
+	types.RegisterService(func(serviceID string, serviceUserID id.UserID, webhookEndpointURL string) types.Service {
+		return &Service{
+			DefaultService: types.NewDefaultService(serviceID, serviceUserID, ServiceType),
+		}
+	})
+}
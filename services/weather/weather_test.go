@@ -0,0 +1,116 @@
+package weather
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/types"
+	mevt "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const forecastJSON = `{
+	"current_weather": {"temperature": 14.4, "windspeed": 11.6, "winddirection": 300, "weathercode": 2},
+	"daily": {
+		"time": ["2026-10-16", "2026-10-17", "2026-10-18"],
+		"weathercode": [2, 61, 0],
+		"temperature_2m_max": [15.2, 12.0, 13.6],
+		"temperature_2m_min": [8.6, 7.4, -0.4],
+		"precipitation_sum": [0, 3.24, 0]
+	}
+}`
+
+// roomOptionsStore returns the same weather options for every room.
+type roomOptionsStore struct {
+	database.NopStorage
+	weather types.WeatherOptions
+}
+
+func (s *roomOptionsStore) LoadBotOptions(userID id.UserID, roomID id.RoomID) (types.BotOptions, error) {
+	return types.BotOptions{Options: &types.BotOptionsContent{Weather: s.weather}}, nil
+}
+
+func TestCommands(t *testing.T) {
+	var forecastQuery string
+	apiTrans := struct{ testutils.MockTransport }{}
+	apiTrans.RT = func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch req.URL.Host {
+		case "geocoding-api.open-meteo.com":
+			if req.URL.Query().Get("name") != "London" {
+				body = `{}`
+				break
+			}
+			body = `{"results": [
+				{"name": "London", "latitude": 42.98, "longitude": -81.23, "country": "Canada", "country_code": "CA", "admin1": "Ontario"},
+				{"name": "London", "latitude": 51.51, "longitude": -0.13, "country": "United Kingdom", "country_code": "GB", "admin1": "England"}
+			]}`
+		case "api.open-meteo.com":
+			forecastQuery = req.URL.RawQuery
+			body = forecastJSON
+		default:
+			return nil, fmt.Errorf("Unhandled URL: %s", req.URL.String())
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	}
+	httpClient = &http.Client{Transport: apiTrans}
+
+	store := &roomOptionsStore{}
+	database.SetServiceDB(store)
+	srv, err := types.CreateService("id", ServiceType, "@neb:hs", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register service: ", err)
+	}
+	cmds := srv.Commands(nil)
+
+	run := func(cmd int, args ...string) string {
+		res, err := cmds[cmd].Command("!room:hs", "@alice:hs", args)
+		if err != nil {
+			t.Fatalf("Command %v returned error: %s", cmds[cmd].Path, err)
+		}
+		return res.(*mevt.MessageEventContent).Body
+	}
+
+	if got, want := run(0, "London,", "UK"), "London, United Kingdom: ⛅ Partly cloudy, 14°C, wind 12 km/h from the NW"; got != want {
+		t.Errorf("!weather: got %q, want %q", got, want)
+	}
+	if got, want := run(0, "Atlantis"), "Couldn't find Atlantis."; got != want {
+		t.Errorf("!weather for an unknown place: got %q, want %q", got, want)
+	}
+	if got := run(0); got != usageMessage().Body {
+		t.Errorf("!weather without a location: got %q, want usage", got)
+	}
+
+	store.weather = types.WeatherOptions{Location: "London", Units: "imperial"}
+	want := "Forecast for London, Canada:\n" +
+		"Fri 16 Oct: ⛅ Partly cloudy, 9–15°F\n" +
+		"Sat 17 Oct: 🌧️ Rain, 7–12°F, 3.24 in precipitation\n" +
+		"Sun 18 Oct: ☀️ Clear sky, 0–14°F"
+	if got := run(1); got != want {
+		t.Errorf("!forecast with the room's location: got %q, want %q", got, want)
+	}
+	if want := "temperature_unit=fahrenheit"; !strings.Contains(forecastQuery, want) {
+		t.Errorf("forecast query %q doesn't contain %q", forecastQuery, want)
+	}
+
+	if got, want := run(0, "52.52,", "13.41"), "52.52, 13.41: ⛅ Partly cloudy, 14°F, wind 12 mph from the NW"; got != want {
+		t.Errorf("!weather with coordinates: got %q, want %q", got, want)
+	}
+}
+
+func TestCompassPoint(t *testing.T) {
+	for degrees, want := range map[float64]string{0: "N", 22: "N", 23: "NE", 180: "S", 300: "NW", 350: "N", 360: "N"} {
+		if got := compassPoint(degrees); got != want {
+			t.Errorf("compassPoint(%v) = %s, want %s", degrees, got, want)
+		}
+	}
+}
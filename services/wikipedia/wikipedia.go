@@ -7,6 +7,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/jaytaylor/html2text"
@@ -18,7 +20,26 @@ import (
 
 // ServiceType of the Wikipedia service
 const ServiceType = "wikipedia"
-const maxExtractLength = 1024 // Max length of extract string in bytes
+const maxExtractLength = 1024 // Default max length of extract string in characters
+const maxSentences = 10       // The most sentences Wikipedia will limit an extract to
+const defaultLanguage = "en"
+
+// Matches Wikipedia language codes, which are also their subdomains, e.g. "de" or "zh-yue".
+var languageRegex = regexp.MustCompile(`^[a-z]{2,3}(-[a-z]+)*$`)
+
+// The languages which can be given at the start of a !wikipedia command. This is limited to the
+// larger Wikipedias so that searches starting with short words are less likely to be mistaken
+// for a language.
+var commandLanguages = map[string]bool{
+	"af": true, "ar": true, "az": true, "be": true, "bg": true, "bn": true, "ca": true, "cs": true,
+	"cy": true, "da": true, "de": true, "el": true, "en": true, "eo": true, "es": true, "et": true,
+	"eu": true, "fa": true, "fi": true, "fr": true, "ga": true, "gl": true, "he": true, "hi": true,
+	"hr": true, "hu": true, "hy": true, "id": true, "it": true, "ja": true, "ka": true, "kk": true,
+	"ko": true, "la": true, "lt": true, "lv": true, "ms": true, "nl": true, "nn": true, "no": true,
+	"pl": true, "pt": true, "ro": true, "ru": true, "sh": true, "simple": true, "sk": true,
+	"sl": true, "sr": true, "sv": true, "ta": true, "th": true, "tr": true, "uk": true, "ur": true,
+	"uz": true, "vi": true, "zh": true,
+}
 
 var httpClient = &http.Client{}
 
@@ -43,17 +64,48 @@ type wikipediaPage struct {
 }
 
 // Service contains the Config fields for the Wikipedia service.
+//
+// Example request:
+//   {
+//       "language": "de",
+//       "max_sentences": 3
+//   }
 type Service struct {
 	types.DefaultService
+	// Optional. The language code of the Wikipedia to search, e.g. "de". Defaults to "en".
+	Language string `json:"language"`
+	// Optional. The most sentences of an article's extract to respond with, up to 10. Defaults
+	// to as many as fit in MaxLength.
+	MaxSentences int `json:"max_sentences"`
+	// Optional. The most characters of an article's extract to respond with. Defaults to 1024.
+	MaxLength int `json:"max_length"`
+}
+
+// Register makes sure the Config information supplied is valid.
+func (s *Service) Register(oldService types.Service, client types.MatrixClient) error {
+	if s.Language != "" && !languageRegex.MatchString(s.Language) {
+		return fmt.Errorf("Bad language code %q", s.Language)
+	}
+	if s.MaxSentences < 0 || s.MaxSentences > maxSentences {
+		return fmt.Errorf("max_sentences must be between 0 and %d", maxSentences)
+	}
+	if s.MaxLength < 0 {
+		return fmt.Errorf("max_length must not be negative")
+	}
+	return nil
 }
 
 // Commands supported:
 //    !wikipedia some_search_query_without_quotes
 // Responds with a suitable article extract and link to the referenced page into the same room as the command.
+//    !wikipedia de some_search_query_without_quotes
+// Searches the Wikipedia in the given language instead, falling back to searching for the whole
+// query in the service's language if there are no results.
 func (s *Service) Commands(client types.MatrixClient) []types.Command {
 	return []types.Command{
 		{
-			Path: []string{"wikipedia"},
+			Path:       []string{"wikipedia"},
+			Idempotent: true,
 			Command: func(roomID id.RoomID, userID id.UserID, args []string) (interface{}, error) {
 				return s.cmdWikipediaSearch(client, roomID, userID, args)
 			},
@@ -65,7 +117,7 @@ func (s *Service) Commands(client types.MatrixClient) []types.Command {
 func usageMessage() *mevt.MessageEventContent {
 	return &mevt.MessageEventContent{
 		MsgType: mevt.MsgNotice,
-		Body:    "Usage: !wikipedia search_text",
+		Body:    "Usage: !wikipedia [language] search_text",
 	}
 }
 
@@ -75,11 +127,29 @@ func (s *Service) cmdWikipediaSearch(client types.MatrixClient, roomID id.RoomID
 		return usageMessage(), nil
 	}
 
-	// Get the query text and per,form search
+	language := s.Language
+	if language == "" {
+		language = defaultLanguage
+	}
+
+	// Get the query text and perform search, in the language given in the command if there is one
 	querySentence := strings.Join(args, " ")
-	searchResultPage, err := s.text2Wikipedia(querySentence)
-	if err != nil {
-		return nil, err
+	var searchResultPage *wikipediaPage
+	var err error
+	if len(args) > 1 && commandLanguages[strings.ToLower(args[0])] {
+		commandLanguage := strings.ToLower(args[0])
+		searchResultPage, err = s.text2Wikipedia(commandLanguage, strings.Join(args[1:], " "))
+		if err == nil && searchResultPage != nil {
+			language = commandLanguage
+		} else {
+			searchResultPage = nil
+		}
+	}
+	if searchResultPage == nil {
+		searchResultPage, err = s.text2Wikipedia(language, querySentence)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// No article extracts
@@ -100,12 +170,16 @@ func (s *Service) cmdWikipediaSearch(client types.MatrixClient, roomID id.RoomID
 	}
 
 	// Truncate the extract text, if necessary
-	if len(extractText) > maxExtractLength {
-		extractText = extractText[:maxExtractLength] + "..."
+	maxLength := s.MaxLength
+	if maxLength == 0 {
+		maxLength = maxExtractLength
+	}
+	if runes := []rune(extractText); len(runes) > maxLength {
+		extractText = string(runes[:maxLength]) + "..."
 	}
 
 	// Add a link to the bottom of the extract
-	extractText += fmt.Sprintf("\nhttp://en.wikipedia.org/?curid=%d", searchResultPage.PageID)
+	extractText += fmt.Sprintf("\nhttps://%s.wikipedia.org/?curid=%d", language, searchResultPage.PageID)
 
 	// Return article extract
 	return mevt.MessageEventContent{
@@ -114,11 +188,11 @@ func (s *Service) cmdWikipediaSearch(client types.MatrixClient, roomID id.RoomID
 	}, nil
 }
 
-// text2Wikipedia returns a Wikipedia article summary
-func (s *Service) text2Wikipedia(query string) (*wikipediaPage, error) {
+// text2Wikipedia returns a summary of an article in the Wikipedia for the given language
+func (s *Service) text2Wikipedia(language, query string) (*wikipediaPage, error) {
 	log.Info("Searching Wikipedia for: ", query)
 
-	u, err := url.Parse("https://en.wikipedia.org/w/api.php")
+	u, err := url.Parse("https://" + language + ".wikipedia.org/w/api.php")
 	if err != nil {
 		return nil, err
 	}
@@ -131,6 +205,9 @@ func (s *Service) text2Wikipedia(query string) (*wikipediaPage, error) {
 	q.Set("redirects", "")
 	// q.Set("exintro", "")
 	q.Set("titles", query) // Text to search for
+	if s.MaxSentences > 0 {
+		q.Set("exsentences", strconv.Itoa(s.MaxSentences))
+	}
 
 	u.RawQuery = q.Encode()
 	// log.Info("Request URL: ", u)
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -13,6 +14,7 @@ import (
 	"github.com/matrix-org/go-neb/testutils"
 	"github.com/matrix-org/go-neb/types"
 	"maunium.net/go/mautrix"
+	mevt "maunium.net/go/mautrix/event"
 )
 
 // TODO: It would be nice to tabularise this test so we can try failing different combinations of responses to make
@@ -97,3 +99,60 @@ func TestCommand(t *testing.T) {
 		t.Fatalf("Failed to process command: %s", err.Error())
 	}
 }
+
+func TestLanguages(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	var searches []string
+	httpClient = &http.Client{Transport: testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+		query := req.URL.Query()
+		if query.Get("exsentences") != "2" {
+			t.Errorf("Bad exsentences: %q", query.Get("exsentences"))
+		}
+		searches = append(searches, req.URL.Host+" "+query.Get("titles"))
+		extract := ""
+		if query.Get("titles") != "crowd" { // the Italian Wikipedia has nothing for "crowd"
+			extract = "<p>Über " + query.Get("titles") + "</p>"
+		}
+		b, _ := json.Marshal(wikipediaSearchResults{Query: wikipediaQuery{Pages: map[string]wikipediaPage{
+			"42": {PageID: 42, Title: query.Get("titles"), Extract: extract},
+		}}})
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBuffer(b))}, nil
+	})}
+
+	srv, err := types.CreateService("id", ServiceType, "@wikipediabot:hyrule", []byte(
+		`{"language": "fr", "max_sentences": 2, "max_length": 5}`))
+	if err != nil {
+		t.Fatal("Failed to create Wikipedia service: ", err)
+	}
+	if err = srv.Register(nil, nil); err != nil {
+		t.Fatal("Failed to register Wikipedia service: ", err)
+	}
+	cmd := srv.Commands(nil)[0]
+
+	for _, tc := range []struct {
+		args         []string
+		wantSearches []string
+		wantBody     string
+	}{
+		{[]string{"Paris"}, []string{"fr.wikipedia.org Paris"}, "Über ...\nhttps://fr.wikipedia.org/?curid=42"},
+		{[]string{"de", "Berlin"}, []string{"de.wikipedia.org Berlin"}, "Über ...\nhttps://de.wikipedia.org/?curid=42"},
+		{[]string{"it", "crowd"}, []string{"it.wikipedia.org crowd", "fr.wikipedia.org it crowd"}, "Über ...\nhttps://fr.wikipedia.org/?curid=42"},
+	} {
+		searches = nil
+		content, err := cmd.Command("!someroom:hyrule", "@navi:hyrule", tc.args)
+		if err != nil {
+			t.Fatalf("%v: %s", tc.args, err)
+		}
+		if !reflect.DeepEqual(searches, tc.wantSearches) {
+			t.Errorf("%v: searched %v, want %v", tc.args, searches, tc.wantSearches)
+		}
+		if body := content.(mevt.MessageEventContent).Body; body != tc.wantBody {
+			t.Errorf("%v: got %q, want %q", tc.args, body, tc.wantBody)
+		}
+	}
+
+	bad, _ := types.CreateService("id", ServiceType, "@wikipediabot:hyrule", []byte(`{"max_sentences": 50}`))
+	if err := bad.Register(nil, nil); err == nil {
+		t.Error("Expected max_sentences over 10 to be rejected")
+	}
+}
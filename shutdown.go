@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/polling"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultShutdownTimeout is how long shutting down waits for work under way to finish by default.
+const defaultShutdownTimeout = 30 * time.Second
+
+// shutdown drains Go-NEB in order: it stops accepting HTTP requests, including webhooks, and
+// waits for those being handled, then stops polling and waits for the polls which are running,
+// then stops the clients syncing, waits for the commands and sends under way, and flushes their
+// crypto stores. Each stage is given whatever is left of the timeout. Returns false if any stage
+// didn't finish cleanly.
+func shutdown(srv *http.Server, matrixClients *clients.Clients, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stages := []struct {
+		name string
+		stop func(context.Context) error
+	}{
+		{"http", srv.Shutdown},
+		{"polling", polling.Stop},
+		{"clients", matrixClients.Shutdown},
+	}
+	clean := true
+	for _, stage := range stages {
+		logger := log.WithField("stage", stage.name)
+		start := time.Now()
+		if err := stage.stop(ctx); err != nil {
+			logger.WithError(err).Error("Failed to shut down cleanly")
+			clean = false
+			continue
+		}
+		logger.WithField("duration", time.Since(start)).Info("Shut down")
+	}
+	return clean
+}
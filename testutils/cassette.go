@@ -0,0 +1,196 @@
+package testutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var record = flag.Bool("record", false,
+	"Send requests to external APIs and record the responses into cassettes, instead of replaying them")
+
+// Query parameters which are replaced with "REDACTED" in recorded URLs, so that cassettes can be
+// committed. Request headers, such as Authorization, are never recorded.
+var secretParams = []string{"access_token", "api_key", "client_id", "client_secret", "key", "token"}
+
+// Response headers which are never recorded.
+var secretHeaders = []string{"Set-Cookie"}
+
+// Interaction is a recorded HTTP request and its response.
+type Interaction struct {
+	Method string `json:"method"`
+	// The request URL, with secret query parameters redacted.
+	URL string `json:"url"`
+	// The response.
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers,omitempty"`
+	// The response body, as JSON if it is JSON so that cassettes are easy to read and edit, or as
+	// a string otherwise.
+	JSON json.RawMessage `json:"json,omitempty"`
+	Body string          `json:"body,omitempty"`
+
+	used bool
+}
+
+// Cassette is a RoundTripper which replays recorded responses from external APIs such as Github,
+// JIRA and imgur, so that services can be tested against the real shapes of those APIs without
+// credentials or network access.
+//
+// Cassettes are JSON files, usually in the testdata directory of the package under test. To record
+// or re-record them, run the package's tests with -record, for example:
+//   go test ./services/imgur -record
+// Requests are then sent to the real API, and the cassette is rewritten when the test finishes.
+// Use Credential to give tests real credentials while recording.
+type Cassette struct {
+	Interactions []*Interaction `json:"interactions"`
+
+	t         testing.TB
+	path      string
+	recording bool
+	real      http.RoundTripper
+	mu        sync.Mutex
+}
+
+// NewCassette returns a Cassette which replays the interactions in the file at path, failing the
+// test if a request wasn't recorded. If the tests are being run with -record, requests are sent
+// with http.DefaultTransport instead and the file is written when the test finishes.
+func NewCassette(t testing.TB, path string) *Cassette {
+	c := &Cassette{t: t, path: path, recording: *record, real: http.DefaultTransport}
+	if c.recording {
+		t.Cleanup(c.save)
+		return c
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read cassette (run with -record to create it): %s", err)
+	}
+	if err = json.Unmarshal(data, c); err != nil {
+		t.Fatalf("Failed to parse cassette %s: %s", path, err)
+	}
+	return c
+}
+
+// Credential returns the environment variable with the given name when recording, so that real
+// requests can be authenticated, or fallback when replaying. Credentials aren't recorded.
+func Credential(name, fallback string) string {
+	if v := os.Getenv(name); *record && v != "" {
+		return v
+	}
+	return fallback
+}
+
+// Client returns an http.Client which uses the cassette.
+func (c *Cassette) Client() *http.Client {
+	return &http.Client{Transport: c}
+}
+
+// RoundTrip replays the first unused interaction with the same method and URL, or records one.
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqURL := redactURL(req.URL)
+	if c.recording {
+		return c.recordRequest(req, reqURL)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, in := range c.Interactions {
+		if in.used || in.Method != req.Method || in.URL != reqURL {
+			continue
+		}
+		in.used = true
+		body := []byte(in.Body)
+		if in.JSON != nil {
+			body = in.JSON
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", in.Status, http.StatusText(in.Status)),
+			StatusCode:    in.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        in.Headers.Clone(),
+			Body:          ioutil.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+	c.t.Errorf("No recorded response for %s %s in %s (run with -record to record it)", req.Method, reqURL, c.path)
+	return nil, fmt.Errorf("no recorded response for %s %s", req.Method, reqURL)
+}
+
+func (c *Cassette) recordRequest(req *http.Request, reqURL string) (*http.Response, error) {
+	res, err := c.real.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	in := &Interaction{
+		Method:  req.Method,
+		URL:     reqURL,
+		Status:  res.StatusCode,
+		Headers: res.Header.Clone(),
+	}
+	for _, h := range secretHeaders {
+		in.Headers.Del(h)
+	}
+	if len(body) > 0 && json.Valid(body) {
+		in.JSON = body
+		// The body is reformatted when the cassette is saved
+		in.Headers.Del("Content-Length")
+	} else {
+		in.Body = string(body)
+	}
+	c.mu.Lock()
+	c.Interactions = append(c.Interactions, in)
+	c.mu.Unlock()
+	return res, nil
+}
+
+func (c *Cassette) save() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		c.t.Errorf("Failed to encode cassette: %s", err)
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		c.t.Errorf("Failed to create cassette directory: %s", err)
+		return
+	}
+	if err = ioutil.WriteFile(c.path, append(data, '\n'), 0644); err != nil {
+		c.t.Errorf("Failed to write cassette: %s", err)
+	}
+}
+
+func redactURL(u *url.URL) string {
+	redacted := *u
+	query := redacted.Query()
+	changed := false
+	for name := range query {
+		for _, secret := range secretParams {
+			if strings.EqualFold(name, secret) {
+				query.Set(name, "REDACTED")
+				changed = true
+			}
+		}
+	}
+	if changed {
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.String()
+}
@@ -0,0 +1,58 @@
+package testutils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCassette(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	// Record two requests, as if with -record
+	*record = true
+	t.Run("record", func(t *testing.T) {
+		c := NewCassette(t, path)
+		c.real = NewRoundTripper(func(req *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			header.Set("Set-Cookie", "session=secret")
+			header.Set("Content-Type", "text/plain")
+			body := "page " + req.URL.Query().Get("page")
+			if req.Header.Get("Authorization") != "Bearer secret" {
+				body = "unauthorised"
+			}
+			return &http.Response{StatusCode: 200, Header: header, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+		})
+		for _, page := range []string{"1", "2"} {
+			req, _ := http.NewRequest("GET", "https://api.hyrule/items?access_token=secret&page="+page, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			if _, err := c.Client().Do(req); err != nil {
+				t.Fatal("Failed to record request: ", err)
+			}
+		}
+	})
+	*record = false
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("Failed to read cassette: ", err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("Expected secrets to be redacted, got %s", data)
+	}
+
+	c := NewCassette(t, path)
+	for _, page := range []string{"2", "1"} {
+		res, err := c.Client().Get("https://api.hyrule/items?access_token=other&page=" + page)
+		if err != nil {
+			t.Fatal("Failed to replay request: ", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		if string(body) != "page "+page || res.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("Replayed %s %q, want text/plain %q", res.Header.Get("Content-Type"), body, "page "+page)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package types
+
+import (
+	"path"
+
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultPrivilegedPowerLevel is the power level needed to run privileged commands when no ACL
+// has been configured, which is the level of a moderator.
+const DefaultPrivilegedPowerLevel = 50
+
+// An ACL controls who can run privileged commands, and who can change a room's bot options. A user
+// is allowed if their user ID matches one of Users, or if their power level in the room is at
+// least PowerLevel. An ACL with neither set is the same as no ACL, which allows users with
+// DefaultPrivilegedPowerLevel.
+//
+// Example:
+//   {
+//       "users": ["@alice:localhost", "@*:ops.example.org"],
+//       "power_level": 100
+//   }
+type ACL struct {
+	// User IDs which are always allowed. These may be globs, e.g. "@*:example.org".
+	Users []string `json:"users,omitempty"`
+	// The power level at or above which users are allowed. If Users is set and this isn't then
+	// only those users are allowed.
+	PowerLevel *int `json:"power_level,omitempty"`
+}
+
+// IsZero returns true if the ACL has nothing set, so the default applies.
+func (acl *ACL) IsZero() bool {
+	return acl == nil || (len(acl.Users) == 0 && acl.PowerLevel == nil)
+}
+
+// Allows returns true if the user is allowed by the ACL. powerLevel returns the user's power level
+// in the room, and is only called if the user doesn't match Users.
+func (acl *ACL) Allows(userID id.UserID, powerLevel func() (int, error)) (bool, error) {
+	minLevel := DefaultPrivilegedPowerLevel
+	if !acl.IsZero() {
+		for _, pattern := range acl.Users {
+			if ok, _ := path.Match(pattern, string(userID)); ok {
+				return true, nil
+			}
+		}
+		if acl.PowerLevel == nil {
+			return false, nil
+		}
+		minLevel = *acl.PowerLevel
+	}
+	level, err := powerLevel()
+	if err != nil {
+		return false, err
+	}
+	return level >= minLevel, nil
+}
+
+// AllowsInRoom returns true if the user is allowed by the ACL in the room, looking up their power
+// level with cli if needed. Users whose power level can't be checked are not allowed.
+func (acl *ACL) AllowsInRoom(cli MatrixClient, roomID id.RoomID, userID id.UserID) bool {
+	allowed, err := acl.Allows(userID, func() (int, error) {
+		var pl event.PowerLevelsEventContent
+		if err := cli.StateEvent(roomID, event.StatePowerLevels, "", &pl); err != nil {
+			return 0, err
+		}
+		return pl.GetUserLevel(userID), nil
+	})
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"room_id": roomID,
+			"user_id": userID,
+		}).Warn("Failed to check power level")
+	}
+	return allowed
+}
+
+// A CommandACLer is a Service which may have its own ACL for privileged commands.
+type CommandACLer interface {
+	// CommandACL returns the service's ACL, or nil if it doesn't have one.
+	CommandACL() *ACL
+}
@@ -14,8 +14,40 @@ import (
 type Command struct {
 	Path      []string
 	Arguments []string
-	Help      string
-	Command   func(roomID id.RoomID, userID id.UserID, arguments []string) (content interface{}, err error)
+	// Optional. A short description of what the command does, listed by "!help".
+	Help string
+	// Privileged commands can only be run by users allowed by the service's or room's ACL.
+	Privileged bool
+	// Optional. How to send the command's response, one of the Replies* constants. Defaults to
+	// the service's reply style.
+	Replies string
+	// Idempotent commands only look things up, so running them late or more than once does no
+	// harm. Clients which catch up on the commands they missed run only these, see
+	// api.ClientConfig.CatchUp.
+	Idempotent bool
+	// Command returns the JSON encodable content of the response, e.g. a mevt.MessageEventContent
+	// or one of the message types in the matrix package, such as a LocationMessage.
+	Command func(roomID id.RoomID, userID id.UserID, arguments []string) (content interface{}, err error)
+}
+
+// The ways in which a service's responses to commands and expansions can be sent.
+const (
+	// RepliesPlain sends responses as ordinary messages in the room. This is the default.
+	RepliesPlain = "plain"
+	// RepliesReply sends responses as rich replies to the message which triggered them.
+	RepliesReply = "reply"
+	// RepliesThread sends responses into a thread on the message which triggered them, or into
+	// its thread if it is already in one.
+	RepliesThread = "thread"
+)
+
+// IsReplyStyle returns true if style is "" or one of the Replies* constants.
+func IsReplyStyle(style string) bool {
+	switch style {
+	case "", RepliesPlain, RepliesReply, RepliesThread:
+		return true
+	}
+	return false
 }
 
 // An Expansion is something that actives when the user sends any message
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"sort"
+	"time"
 
 	"maunium.net/go/mautrix/id"
 )
@@ -21,6 +23,28 @@ type AuthRealm interface {
 	RequestAuthSession(userID id.UserID, config json.RawMessage) interface{}
 }
 
+// A SelfTester is an AuthRealm which can check that the APIs it uses can be reached, for the
+// self-test. Realms which don't use any APIs needn't implement it.
+type SelfTester interface {
+	SelfTest() error
+}
+
+// A SessionRefresher is an AuthRealm whose sessions' credentials expire, and can be refreshed
+// before they do. Sessions are refreshed shortly before they expire, see polling.RefreshSessions.
+type SessionRefresher interface {
+	// SessionExpiry returns when the session's credentials expire, or the zero time if they don't.
+	SessionExpiry(session AuthSession) time.Time
+	// RefreshSession refreshes the session's credentials and stores the session. If the session
+	// can't be refreshed, e.g. because the user revoked access, the realm stores the session so
+	// that it is no longer Authenticated and returns an error wrapping ErrReauthRequired, so that
+	// the user is asked to authenticate again. Other errors are retried.
+	RefreshSession(session AuthSession) error
+}
+
+// ErrReauthRequired is returned by SessionRefresher.RefreshSession when the user must
+// authenticate again.
+var ErrReauthRequired = errors.New("re-authentication required")
+
 var realmsByType = map[string]func(string, string) AuthRealm{}
 
 // RegisterAuthRealm registers a factory for creating AuthRealm instances.
@@ -28,6 +52,15 @@ func RegisterAuthRealm(factory func(string, string) AuthRealm) {
 	realmsByType[factory("", "").Type()] = factory
 }
 
+// AuthRealmTypes returns the sorted list of registered realm types.
+func AuthRealmTypes() (types []string) {
+	for t := range realmsByType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return
+}
+
 // CreateAuthRealm creates an AuthRealm of the given type and realm ID.
 // Returns an error if the realm couldn't be created or the JSON cannot be unmarshalled.
 func CreateAuthRealm(realmID, realmType string, realmJSON []byte) (AuthRealm, error) {
@@ -0,0 +1,93 @@
+package types
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// QuestionTimeout is how long a question asked with AskQuestion waits for an answer.
+const QuestionTimeout = 10 * time.Minute
+
+// An Answerer handles the answer to a question asked by a service. It returns the content of
+// a matrix message event to reply with, exactly like a Command. It may ask a follow-up
+// question by calling AskQuestion again before returning.
+type Answerer func(answer string) (content interface{}, err error)
+
+type questionKey struct {
+	botUserID id.UserID
+	roomID    id.RoomID
+	userID    id.UserID
+}
+
+type pendingQuestion struct {
+	answerer Answerer
+	expires  time.Time
+}
+
+var (
+	questionsMutex sync.Mutex
+	questions      = make(map[questionKey]pendingQuestion)
+)
+
+// AskQuestion waits for userID to answer a question asked by botUserID in roomID. The next
+// message which isn't a !command that the user sends in the room is passed to answerer instead
+// of being processed as usual. Sending a !command abandons the question. Only one question per
+// user and room can be pending at a time; asking another replaces it.
+func AskQuestion(botUserID id.UserID, roomID id.RoomID, userID id.UserID, answerer Answerer) {
+	questionsMutex.Lock()
+	defer questionsMutex.Unlock()
+	questions[questionKey{botUserID, roomID, userID}] = pendingQuestion{
+		answerer: answerer,
+		expires:  time.Now().Add(QuestionTimeout),
+	}
+}
+
+// TakeQuestion removes and returns the question userID has been asked by botUserID in roomID.
+// Returns nil if there is no question pending or it has expired.
+func TakeQuestion(botUserID id.UserID, roomID id.RoomID, userID id.UserID) Answerer {
+	questionsMutex.Lock()
+	defer questionsMutex.Unlock()
+	now := time.Now()
+	for k, q := range questions {
+		if now.After(q.expires) {
+			delete(questions, k)
+		}
+	}
+	key := questionKey{botUserID, roomID, userID}
+	q, ok := questions[key]
+	if !ok {
+		return nil
+	}
+	delete(questions, key)
+	return q.answerer
+}
+
+// A SetupQuestion is one step of the !setup wizard.
+type SetupQuestion struct {
+	// The question to ask, e.g. "What is your Giphy API key?"
+	Prompt string
+	// Apply validates the answer and stores it in the service's config.
+	Apply func(answer string) error
+}
+
+// A SetupProvider is a Service which can be configured by answering questions with !setup.
+// Services which don't implement this are configured by sending their JSON config instead.
+type SetupProvider interface {
+	// SetupQuestions returns the minimal questions needed to configure the service, in order.
+	SetupQuestions() []SetupQuestion
+}
+
+// StoreAnswer returns a SetupQuestion Apply function which stores the answer in dst. Empty
+// answers are rejected.
+func StoreAnswer(dst *string) func(answer string) error {
+	return func(answer string) error {
+		if answer == "" {
+			return errors.New("An answer is required")
+		}
+		*dst = answer
+		return nil
+	}
+}
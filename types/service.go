@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,8 +19,26 @@ type GithubOptions struct {
 	NewIssueLabels []string `json:"new_issue_labels,omitempty"`
 }
 
+// WeatherOptions are the weather settings for a room.
+type WeatherOptions struct {
+	// The place to give the weather for when a command doesn't name one, e.g. "London, UK".
+	Location string `json:"location,omitempty"`
+	// "metric" or "imperial". Overrides the units set in the service config.
+	Units string `json:"units,omitempty"`
+}
+
 type BotOptionsContent struct {
-	Github GithubOptions `json:"github"`
+	Github  GithubOptions  `json:"github"`
+	Weather WeatherOptions `json:"weather,omitempty"`
+	// The IANA time zone for the room, e.g. "Europe/London". Used by services which
+	// parse or display times. Defaults to UTC.
+	Timezone string `json:"timezone,omitempty"`
+	// How much detail notifications sent into the room have: "compact", "normal" or "verbose".
+	// Defaults to "normal".
+	Format string `json:"format,omitempty"`
+	// Who can run privileged commands in the room, and change these options. Services with their
+	// own ACL use that instead.
+	ACL *ACL `json:"acl,omitempty"`
 }
 
 // BotOptions for a given bot user in a given room
@@ -44,8 +63,46 @@ type MatrixClient interface {
 	// Send a message event to a room.
 	SendMessageEvent(roomID id.RoomID, eventType event.Type, contentJSON interface{},
 		extra ...mautrix.ReqSendEvent) (resp *mautrix.RespSendEvent, err error)
+	// Redact an event from a room.
+	RedactEvent(roomID id.RoomID, eventID id.EventID, extra ...mautrix.ReqRedact) (resp *mautrix.RespSendEvent, err error)
 	// Upload an HTTP URL.
 	UploadLink(link string) (*mautrix.RespMediaUpload, error)
+	// Upload some bytes as a file with the given name.
+	UploadBytesWithName(data []byte, contentType, fileName string) (*mautrix.RespMediaUpload, error)
+	// List the users currently joined to a room.
+	JoinedMembers(roomID id.RoomID) (resp *mautrix.RespJoinedMembers, err error)
+	// List the rooms the client is currently joined to.
+	JoinedRooms() (resp *mautrix.RespJoinedRooms, err error)
+	// Fetch a state event from a room and unmarshal its content into outContent.
+	StateEvent(roomID id.RoomID, eventType event.Type, stateKey string, outContent interface{}) (err error)
+	// Fetch the client's tags for a room.
+	GetTags(roomID id.RoomID) (tags event.TagEventContent, err error)
+	// Build a homeserver URL from path segments, which must include the API prefix.
+	BuildBaseURL(urlPath ...interface{}) string
+	// Make a request to the homeserver, for APIs which aren't wrapped by another method.
+	MakeRequest(method string, httpURL string, reqBody interface{}, resBody interface{}) ([]byte, error)
+}
+
+// A RoomTargeter is a Service which sends notifications into a configured set of rooms, e.g. a
+// webhook or feed service. Services which only respond to commands don't implement this.
+type RoomTargeter interface {
+	// TargetRooms returns the rooms the service is configured to send into.
+	TargetRooms() []id.RoomID
+}
+
+// A RoomLabeller is a Service which assigns labels to rooms, so that other services can send
+// into "all rooms labelled backend-teams" rather than a list of room IDs.
+type RoomLabeller interface {
+	// LabelledRooms returns the rooms with the given label.
+	LabelledRooms(label string) []id.RoomID
+}
+
+// A MessageListener is a Service which sees every message in the rooms the bot is in, other than
+// the bot's own, whether or not it is a command. Unlike expansions, listeners get the whole event,
+// so they can act on it, e.g. by redacting it.
+type MessageListener interface {
+	// OnMessage is called for each message. It must not block, as messages are handled in turn.
+	OnMessage(cli MatrixClient, ev *event.Event)
 }
 
 // A Service is the configuration for a bot service.
@@ -76,11 +133,82 @@ type DefaultService struct {
 	id            string
 	serviceUserID id.UserID
 	serviceType   string
+
+	// Optional. Who can run the service's privileged commands, in every room. Defaults to the
+	// ACL in each room's bot options.
+	ACL *ACL `json:"acl,omitempty"`
+	// Optional. Who to tell when the service can't send its notifications into a room.
+	Owner id.UserID `json:"owner,omitempty"`
+	// Optional. The room to send notifications into when they can't be sent into the room they
+	// were meant for, e.g. because the bot was kicked from it.
+	FallbackRoomID id.RoomID `json:"fallback_room_id,omitempty"`
+	// Optional. How to send responses to commands and expansions: "plain", "reply" or "thread".
+	// Commands can override it. Defaults to "plain".
+	Replies string `json:"replies,omitempty"`
+	// Optional. The client to send notifications with, instead of the service's user, so that
+	// services sending into the same room can be told apart. Commands are still answered by the
+	// service's user.
+	SenderUserID id.UserID `json:"sender_user_id,omitempty"`
+	// Optional. The display name and avatar to send notifications with, by room. They are set in
+	// the sender's member event before each notification, if it differs.
+	RoomProfiles map[id.RoomID]RoomProfile `json:"room_profiles,omitempty"`
+}
+
+// A RoomProfile is how a user appears in a single room. Fields which aren't set are left as they
+// are.
+type RoomProfile struct {
+	DisplayName string              `json:"displayname,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+}
+
+// An OwnedService is a Service which has a user to tell about its problems.
+type OwnedService interface {
+	// ServiceOwner returns the service's owner, or "" if it doesn't have one.
+	ServiceOwner() id.UserID
+}
+
+// A FallbackService is a Service which has a room to send notifications into when they can't be
+// sent into the room they were meant for.
+type FallbackService interface {
+	// FallbackRoom returns the service's fallback room, or "" if it doesn't have one.
+	FallbackRoom() id.RoomID
+}
+
+// A SenderService is a Service which chooses who its notifications are sent by, and how they
+// appear in each room.
+type SenderService interface {
+	// NotificationSender returns the user to send notifications as, or "" for the service's user.
+	NotificationSender() id.UserID
+	// RoomProfile returns the sender's profile in the room, or nil to leave it as it is.
+	RoomProfile(roomID id.RoomID) *RoomProfile
+}
+
+// A ReplyingService is a Service which chooses how its responses are sent.
+type ReplyingService interface {
+	// ReplyStyle returns one of the Replies* constants, or "" for the default.
+	ReplyStyle() string
+}
+
+// A DocumentedService is a Service which describes how to use its commands, so that they can be
+// listed by the built-in "!help" command.
+type DocumentedService interface {
+	// CommandUsage returns the usage of each command, keyed by the command's path joined with
+	// spaces, e.g. "github create" => `!github create [owner/repo] "issue title" "description"`.
+	CommandUsage() map[string]string
+}
+
+// A DirectChatService is a Service which supports being used in direct chats with the bot, i.e.
+// rooms the bot joined from an invite marked as direct. In a direct chat its commands come from
+// DirectChatCommands rather than Commands, so they can behave differently, e.g. by not needing
+// the room's config or by being personal to the user. Other services use Commands everywhere.
+type DirectChatService interface {
+	// DirectChatCommands returns the commands available in a direct chat with userID.
+	DirectChatCommands(cli MatrixClient, userID id.UserID) []Command
 }
 
 // NewDefaultService creates a new service with implementations for ServiceID(), ServiceType() and ServiceUserID()
 func NewDefaultService(serviceID string, serviceUserID id.UserID, serviceType string) DefaultService {
-	return DefaultService{serviceID, serviceUserID, serviceType}
+	return DefaultService{id: serviceID, serviceUserID: serviceUserID, serviceType: serviceType}
 }
 
 // ServiceID returns the service's ID. In order for this to return the ID, DefaultService MUST have been
@@ -103,6 +231,39 @@ func (s *DefaultService) ServiceType() string {
 	return s.serviceType
 }
 
+// CommandACL returns the service's ACL for privileged commands, or nil if it doesn't have one.
+func (s *DefaultService) CommandACL() *ACL {
+	return s.ACL
+}
+
+// ServiceOwner returns the user to tell about the service's problems, or "" if there isn't one.
+func (s *DefaultService) ServiceOwner() id.UserID {
+	return s.Owner
+}
+
+// FallbackRoom returns the room to send undeliverable notifications into, or "" if there isn't one.
+func (s *DefaultService) FallbackRoom() id.RoomID {
+	return s.FallbackRoomID
+}
+
+// NotificationSender returns the user to send notifications as, or "" for the service's user.
+func (s *DefaultService) NotificationSender() id.UserID {
+	return s.SenderUserID
+}
+
+// RoomProfile returns how notifications appear in the room, or nil if they use the sender's profile.
+func (s *DefaultService) RoomProfile(roomID id.RoomID) *RoomProfile {
+	if profile, ok := s.RoomProfiles[roomID]; ok {
+		return &profile
+	}
+	return nil
+}
+
+// ReplyStyle returns how to send responses to commands and expansions, or "" for the default.
+func (s *DefaultService) ReplyStyle() string {
+	return s.Replies
+}
+
 // Commands returns no commands.
 func (s *DefaultService) Commands(cli MatrixClient) []Command {
 	return []Command{}
@@ -163,6 +324,15 @@ func PollingServiceTypes() (types []string) {
 	return
 }
 
+// ServiceTypes returns the sorted list of registered service types.
+func ServiceTypes() (types []string) {
+	for t := range servicesByType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return
+}
+
 // CreateService creates a Service of the given type and serviceID.
 // Returns an error if the Service couldn't be created.
 func CreateService(serviceID, serviceType string, serviceUserID id.UserID, serviceJSON []byte) (Service, error) {